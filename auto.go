@@ -0,0 +1,84 @@
+package zmodem
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// ErrCannotDetermineRole is returned by Auto when the peer's first frame does
+// not say which way the transfer goes, or none arrives within
+// Config.AutoDetectTimeout.
+var ErrCannotDetermineRole = errors.New("zmodem: cannot determine transfer role")
+
+// defaultAutoDetectTimeout is Config.AutoDetectTimeout's default.
+const defaultAutoDetectTimeout = 30 * time.Second
+
+// Auto runs a Send or a Receive, whichever the peer asks for. It sends nothing
+// until the peer's first frame arrives: a ZRQINIT or ZFILE means the peer is
+// sending, and Auto receives; a ZRINIT means it is receiving, and Auto sends
+// the handler's files (none, and the session ends at once with ZFIN, as Send's
+// would). The frame is handed to the chosen state machine, which answers it
+// as if it had read it itself. Line noise before it, the rz\r trigger sz sends
+// included, is skipped; any other frame, or none within
+// Config.AutoDetectTimeout, ends Auto with ErrCannotDetermineRole.
+func (s *Session) Auto(ctx context.Context) error {
+	return s.run(ctx, roleAuto, s.runAuto)
+}
+
+func (s *Session) runAuto(ctx context.Context) error {
+	hdr, err := s.detectRole(ctx)
+	if err != nil {
+		return err
+	}
+	s.pending = &hdr
+	defer func() { s.pending = nil }()
+	if hdr.Type == ZRINIT {
+		s.setRole(roleSend)
+		s.logger.Debug("auto: peer is receiving, sending")
+		return s.runSender(ctx)
+	}
+	s.setRole(roleReceive)
+	s.logger.Debug("auto: peer is sending, receiving", "frame", frameTypeName(hdr.Type))
+	return s.runReceiver(ctx)
+}
+
+// detectRole reads the peer's first frame, skipping whatever cannot be read
+// as one until Config.AutoDetectTimeout has passed.
+func (s *Session) detectRole(ctx context.Context) (Header, error) {
+	end := s.tr.now().Add(s.cfg.AutoDetectTimeout)
+	// Reads are bounded by RecvTimeout when the session manages deadlines;
+	// otherwise by the wait itself, as a deadline or through the context an
+	// asyncReader waits on.
+	if s.tr.ds != nil && s.tr.activeTimeout() <= 0 {
+		s.tr.setDeadline(end)
+		defer s.tr.setDeadline(time.Time{})
+	}
+	dctx, cancel := context.WithDeadline(ctx, end)
+	defer cancel()
+	s.tr.wire.ctx = dctx
+	defer func() { s.tr.wire.ctx = ctx }()
+
+	for {
+		hdr, err := s.recvHeader()
+		if ctx.Err() != nil {
+			return Header{}, context.Cause(ctx)
+		}
+		if err == nil {
+			switch hdr.Type {
+			case ZRQINIT, ZFILE, ZRINIT:
+				return hdr, nil
+			}
+			return Header{}, fmt.Errorf("%w: peer opened with %s", ErrCannotDetermineRole, frameTypeName(hdr.Type))
+		}
+		if errors.Is(err, ErrAborted) || errors.Is(err, io.EOF) || s.tw.err() != nil {
+			return Header{}, err
+		}
+		if !s.tr.now().Before(end) {
+			return Header{}, fmt.Errorf("%w: no opening frame in %v: %w", ErrCannotDetermineRole, s.cfg.AutoDetectTimeout, err)
+		}
+		s.logger.Debug("auto: no frame yet", "err", err)
+	}
+}
@@ -0,0 +1,114 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// autoLoopback runs Auto against an explicit Send (autoSends false) or
+// Receive, and returns the receiving side's handler.
+func autoLoopback(t *testing.T, autoSends bool, content []byte) *testFileHandler {
+	t.Helper()
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+	senderHandler := newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{{Name: "auto.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	receiverHandler := newTestHandler()
+	sender := NewSession(senderT, senderHandler, &Config{Use32BitCRC: true, Logger: discardLogger()})
+	receiver := NewSession(receiverT, receiverHandler, &Config{Use32BitCRC: true, Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer senderClose()
+		if autoSends {
+			sendErr = sender.Auto(ctx)
+		} else {
+			sendErr = sender.Send(ctx)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		defer receiverClose()
+		if autoSends {
+			recvErr = receiver.Receive(ctx)
+		} else {
+			recvErr = receiver.Auto(ctx)
+		}
+	}()
+	wg.Wait()
+
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+	return receiverHandler
+}
+
+func TestAutoReceivesFromSend(t *testing.T) {
+	content := randomContent(20000)
+	h := autoLoopback(t, false, content)
+	if got := h.receivedFiles["auto.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("auto.bin not received intact")
+	}
+}
+
+func TestAutoSendsToReceive(t *testing.T) {
+	content := randomContent(20000)
+	h := autoLoopback(t, true, content)
+	if got := h.receivedFiles["auto.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("auto.bin not received intact")
+	}
+}
+
+// TestAutoCannotDetermineRole: a peer opening with a frame that says nothing
+// of its role, or sending nothing at all, ends Auto with
+// ErrCannotDetermineRole.
+func TestAutoCannotDetermineRole(t *testing.T) {
+	t.Run("ZDATA", func(t *testing.T) {
+		r1, w1 := bufferedPipe(256) // peer -> session
+		_, w2 := bufferedPipe(256)  // session -> peer
+		peer := NewSession(&pipeReadWriter{Writer: w1}, newTestHandler(), &Config{})
+		if err := peer.sendBinHeader(makePosHeader(ZDATA, 1024)); err != nil {
+			t.Fatal(err)
+		}
+		if err := peer.tw.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		s := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(), &Config{Logger: discardLogger()})
+		if err := s.Auto(context.Background()); !errors.Is(err, ErrCannotDetermineRole) {
+			t.Fatalf("Auto = %v, want ErrCannotDetermineRole", err)
+		}
+	})
+	t.Run("silence with deadlines", func(t *testing.T) {
+		c1, c2 := net.Pipe()
+		defer c1.Close()
+		defer c2.Close()
+		s := NewSession(c1, newTestHandler(),
+			&Config{AutoDetectTimeout: 100 * time.Millisecond, Logger: discardLogger()})
+		if err := s.Auto(context.Background()); !errors.Is(err, ErrCannotDetermineRole) {
+			t.Fatalf("Auto = %v, want ErrCannotDetermineRole", err)
+		}
+	})
+	t.Run("silence", func(t *testing.T) {
+		r1, _ := bufferedPipe(256)
+		_, w2 := bufferedPipe(256)
+		s := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(),
+			&Config{AutoDetectTimeout: 100 * time.Millisecond, Logger: discardLogger()})
+		start := time.Now()
+		if err := s.Auto(context.Background()); !errors.Is(err, ErrCannotDetermineRole) {
+			t.Fatalf("Auto = %v, want ErrCannotDetermineRole", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("Auto gave up after %v", elapsed)
+		}
+	})
+}
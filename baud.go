@@ -0,0 +1,50 @@
+package zmodem
+
+import (
+	"context"
+	"time"
+)
+
+// pacer holds output to an emulated serial line rate (Config.EmulatedBaud).
+// A byte takes 10 bit times on an async line (start bit, 8 data bits, stop
+// bit), and the wireWriter hands the transport one chunk of about 50ms of line
+// time at a time, waiting before each until the emulated line would have
+// finished sending everything before it.
+type pacer struct {
+	byteTime time.Duration // line time of one byte
+	chunk    int           // bytes per paced write
+	free     time.Time     // when the emulated line is done with what was sent
+}
+
+func newPacer(baud int) *pacer {
+	return &pacer{
+		byteTime: 10 * time.Second / time.Duration(baud),
+		chunk:    max(baud/10/20, 1),
+	}
+}
+
+// wait blocks until the emulated line is free or ctx is done.
+func (p *pacer) wait(ctx context.Context) error {
+	d := time.Until(p.free)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sent books n bytes of line time. An idle line does not bank time for a
+// later burst.
+func (p *pacer) sent(n int) {
+	now := time.Now()
+	if p.free.Before(now) {
+		p.free = now
+	}
+	p.free = p.free.Add(time.Duration(n) * p.byteTime)
+}
@@ -0,0 +1,91 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestEmulatedBaudTransferTime(t *testing.T) {
+	if testing.Short() {
+		t.Skip("takes 10s of emulated line time")
+	}
+	t.Parallel()
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+
+	content := bytes.Repeat([]byte("28.8k "), 28*1024/6)
+	sh := newTestHandler()
+	sh.filesToSend = []*FileOffer{{Name: "door.txt", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	rh := newTestHandler()
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, sh, &Config{EmulatedBaud: 28800, Logger: discardLogger()})
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, rh, &Config{Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	start := time.Now()
+	wg.Add(2)
+	go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+	elapsed := time.Since(start)
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send=%v recv=%v", sendErr, recvErr)
+	}
+	rh.mu.Lock()
+	got := rh.receivedFiles["door.txt"]
+	rh.mu.Unlock()
+	if got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("content mismatch")
+	}
+
+	// 2880 bytes/s on the line; the file plus framing is just over 10s of it.
+	lineTime := time.Duration(sender.Stats().BytesWritten) * time.Second / 2880
+	t.Logf("%d bytes on the line in %v (line time %v)", sender.Stats().BytesWritten, elapsed, lineTime)
+	if elapsed < 9*time.Second || elapsed > 12*time.Second {
+		t.Fatalf("28 KB at 28800 baud took %v, want about 10s", elapsed)
+	}
+}
+
+func TestEmulatedBaudChunksAndCancel(t *testing.T) {
+	w := &writeLog{}
+	s := NewSession(w, newTestHandler(), &Config{EmulatedBaud: 9600, Logger: discardLogger()})
+	// 9600 baud is 960 bytes/s: 48-byte chunks of 50ms each.
+	if err := s.sendSubpacket(make([]byte, 100), ZCRCW); err != nil {
+		t.Fatal(err)
+	}
+	for i, wr := range w.writes {
+		if len(wr) > 48 {
+			t.Fatalf("write %d is %d bytes, more than 50ms of line time", i, len(wr))
+		}
+	}
+
+	// A paced write gives up when the session's context ends.
+	ctx, cancel := context.WithCancel(context.Background())
+	s.tw.wire.ctx = ctx
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	err := s.sendSubpacket(make([]byte, 2000), ZCRCW) // 2s of line time
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("paced write after cancel = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Fatalf("cancel took %v to stop a paced write", elapsed)
+	}
+}
+
+func TestEmulatedBaudAtomicFramesStayWhole(t *testing.T) {
+	w := &writeLog{}
+	s := NewSession(w, newTestHandler(), &Config{EmulatedBaud: 9600, AtomicFrames: true, Logger: discardLogger()})
+	if err := s.sendSubpacket(make([]byte, 100), ZCRCW); err != nil {
+		t.Fatal(err)
+	}
+	if len(w.writes) != 1 {
+		t.Fatalf("%d writes for one atomic frame", len(w.writes))
+	}
+}
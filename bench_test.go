@@ -0,0 +1,200 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Benchmarks for the whole pipeline. Everything runs over in-memory
+// transports; the optional per-write latency (a sleep per Write, see
+// latencyWriter) stands in for a syscall and a packet without making results
+// depend on a real network.
+
+// benchTransfer sends one file of size bytes per iteration through a full
+// sender/receiver session pair.
+func benchTransfer(b *testing.B, size, block int, crc32 bool, latency time.Duration) {
+	content := make([]byte, size)
+	rng := rand.New(rand.NewPCG(5, 6))
+	for i := range content {
+		content[i] = byte(rng.Uint32())
+	}
+	cfg := &Config{MaxBlockSize: block, Use32BitCRC: crc32, Logger: discardLogger()}
+	b.SetBytes(int64(size))
+	b.ReportAllocs()
+	for b.Loop() {
+		r1, w1 := bufferedPipe(256)
+		r2, w2 := bufferedPipe(256)
+		sh := newTestHandler()
+		sh.filesToSend = []*FileOffer{{Name: "bench.bin", Size: int64(size), Reader: bytes.NewReader(content)}}
+		sender := NewSession(&pipeReadWriter{Reader: r2, Writer: &latencyWriter{w: w1, cost: latency}}, sh, cfg)
+		receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(), cfg)
+
+		var wg sync.WaitGroup
+		var sendErr, recvErr error
+		wg.Add(2)
+		go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(context.Background()) }()
+		go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(context.Background()) }()
+		wg.Wait()
+		if sendErr != nil || recvErr != nil {
+			b.Fatalf("send=%v recv=%v", sendErr, recvErr)
+		}
+	}
+}
+
+func BenchmarkTransfer(b *testing.B) {
+	for _, block := range []int{1024, 8192} {
+		for _, crc32 := range []bool{false, true} {
+			name := fmt.Sprintf("block=%d/crc16", block)
+			if crc32 {
+				name = fmt.Sprintf("block=%d/crc32", block)
+			}
+			b.Run(name, func(b *testing.B) { benchTransfer(b, 1<<20, block, crc32, 0) })
+		}
+	}
+	b.Run("block=1024/crc32/latency=100us", func(b *testing.B) {
+		benchTransfer(b, 256<<10, 1024, true, 100*time.Microsecond)
+	})
+}
+
+// BenchmarkEscapeOverhead encodes 8 KB subpackets per escape mode over random
+// data and over data made only of control bytes, the worst case for
+// EscapeAll.
+func BenchmarkEscapeOverhead(b *testing.B) {
+	random := make([]byte, 8192)
+	rng := rand.New(rand.NewPCG(7, 8))
+	for i := range random {
+		random[i] = byte(rng.Uint32())
+	}
+	control := make([]byte, 8192)
+	for i := range control {
+		control[i] = byte(i % 0x20)
+	}
+	for _, mode := range []struct {
+		name string
+		mode EscapeMode
+	}{{"standard", EscapeStandard}, {"all", EscapeAll}} {
+		for _, data := range []struct {
+			name string
+			data []byte
+		}{{"random", random}, {"control", control}} {
+			b.Run(mode.name+"/"+data.name, func(b *testing.B) {
+				fw := NewFrameWriter(io.Discard, mode.mode)
+				b.SetBytes(int64(len(data.data)))
+				for b.Loop() {
+					if err := fw.WriteSubpacket(data.data, ZCRCG, true); err != nil {
+						b.Fatal(err)
+					}
+				}
+				b.ReportMetric(float64(fw.tw.escapes)/float64(b.N)/float64(len(data.data))*100, "%escaped")
+			})
+		}
+	}
+}
+
+// BenchmarkHeaderRoundTrip encodes and decodes one header per iteration.
+func BenchmarkHeaderRoundTrip(b *testing.B) {
+	for _, enc := range []string{"hex", "bin32"} {
+		b.Run(enc, func(b *testing.B) {
+			var buf bytes.Buffer
+			fw := NewFrameWriter(&buf, EscapeStandard)
+			fr := NewFrameReader(&buf, EscapeStandard)
+			hdr := makePosHeader(ZRPOS, 0x12345678)
+			b.ReportAllocs()
+			for b.Loop() {
+				var err error
+				if enc == "hex" {
+					err = fw.WriteHexHeader(hdr)
+				} else {
+					err = fw.WriteBinHeader(hdr, true)
+				}
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := fr.ReadHeader(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkSessionHeaderLogging sends and receives a header through a
+// Session's logging wrappers, with Debug records discarded by the handler (the
+// production case) and with them formatted and written to io.Discard.
+func BenchmarkSessionHeaderLogging(b *testing.B) {
+	for _, level := range []slog.Level{slog.LevelInfo, slog.LevelDebug} {
+		b.Run(level.String(), func(b *testing.B) {
+			var buf bytes.Buffer
+			logger := slog.New(slog.NewTextHandler(io.Discard, &slog.HandlerOptions{Level: level}))
+			s := &Session{
+				tw:     newTransportWriter(&buf, EscapeStandard),
+				tr:     newTransportReader(&buf, 1200, 0, true, logger),
+				logger: logger,
+			}
+			hdr := makePosHeader(ZRPOS, 0x12345678)
+			b.ReportAllocs()
+			for b.Loop() {
+				if err := s.sendHexHeader(hdr); err != nil {
+					b.Fatal(err)
+				}
+				if _, err := s.recvHeader(); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// loopReader replays the same bytes forever.
+type loopReader struct {
+	data []byte
+	off  int
+}
+
+func (l *loopReader) Read(p []byte) (int, error) {
+	n := 0
+	for n < len(p) {
+		m := copy(p[n:], l.data[l.off:])
+		n += m
+		l.off = (l.off + m) % len(l.data)
+	}
+	return n, nil
+}
+
+// BenchmarkSubpacketAllocs reports allocations per 1 KB subpacket sent and
+// received.
+func BenchmarkSubpacketAllocs(b *testing.B) {
+	block := make([]byte, 1024)
+	for i := range block {
+		block[i] = byte(i)
+	}
+	b.Run("send", func(b *testing.B) {
+		fw := NewFrameWriter(io.Discard, EscapeStandard)
+		b.SetBytes(int64(len(block)))
+		b.ReportAllocs()
+		for b.Loop() {
+			if err := fw.WriteSubpacket(block, ZCRCG, true); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("receive", func(b *testing.B) {
+		var enc bytes.Buffer
+		NewFrameWriter(&enc, EscapeStandard).WriteSubpacket(block, ZCRCG, true)
+		fr := NewFrameReader(&loopReader{data: enc.Bytes()}, EscapeStandard)
+		b.SetBytes(int64(len(block)))
+		b.ReportAllocs()
+		for b.Loop() {
+			if _, _, err := fr.ReadSubpacket(len(block), true); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,94 @@
+package zmodem
+
+import (
+	"context"
+	"io"
+)
+
+// contextReader is implemented by the session's read layers that can give up
+// waiting when the running Send or Receive is cancelled.
+type contextReader interface {
+	readContext(ctx context.Context, p []byte) (int, error)
+}
+
+// asyncReader makes a transport without read deadlines cancellable. While the
+// session's context can be cancelled each Read of the transport runs on a
+// helper goroutine and the session waits for it or for the context, whichever
+// comes first. A Read abandoned that way carries on; what it returns is kept
+// for the next Read, so no byte is lost, and its goroutine ends when the
+// transport yields data, an error or EOF (see Config.CloseOnCancel). The cost
+// is one goroutine handoff per transport Read — per bufio fill, not per byte.
+// With a context that cannot be cancelled the transport is read directly.
+type asyncReader struct {
+	src     io.Reader
+	buf     []byte
+	rest    []byte           // read by the helper, not yet returned
+	err     error            // the helper's error, returned once rest is drained
+	pending chan asyncResult // non-nil while the helper is reading
+}
+
+// testAsyncRead, if set, is called with the transport as a helper goroutine
+// starts reading it, and what it returns as that Read ends. Tests use it to
+// see that no helper outlives its transport.
+var testAsyncRead func(src io.Reader) (ended func())
+
+type asyncResult struct {
+	n   int
+	err error
+}
+
+func newAsyncReader(r io.Reader) *asyncReader {
+	return &asyncReader{src: r}
+}
+
+func (a *asyncReader) Read(p []byte) (int, error) {
+	return a.readContext(context.Background(), p)
+}
+
+func (a *asyncReader) readContext(ctx context.Context, p []byte) (int, error) {
+	if len(a.rest) > 0 {
+		n := copy(p, a.rest)
+		a.rest = a.rest[n:]
+		return n, nil
+	}
+	if a.err != nil {
+		err := a.err
+		a.err = nil
+		return 0, err
+	}
+	if a.pending == nil {
+		if ctx.Done() == nil {
+			return a.src.Read(p)
+		}
+		if cap(a.buf) < len(p) {
+			a.buf = make([]byte, len(p))
+		}
+		buf := a.buf[:len(p)]
+		done := make(chan asyncResult, 1)
+		a.pending = done
+		var ended func()
+		if testAsyncRead != nil {
+			ended = testAsyncRead(a.src)
+		}
+		go func() {
+			n, err := a.src.Read(buf)
+			if ended != nil {
+				ended()
+			}
+			done <- asyncResult{n, err}
+		}()
+	}
+	select {
+	case r := <-a.pending:
+		a.pending = nil
+		n := copy(p, a.buf[:r.n])
+		a.rest = a.buf[n:r.n]
+		if len(a.rest) > 0 {
+			a.err = r.err
+			return n, nil
+		}
+		return n, r.err
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
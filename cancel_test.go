@@ -0,0 +1,221 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// countAsyncReads counts the asyncReader helper goroutines reading src, for
+// the rest of the test.
+func countAsyncReads(t *testing.T, src io.Reader) *atomic.Int32 {
+	t.Helper()
+	var running atomic.Int32
+	testAsyncRead = func(r io.Reader) func() {
+		if r != src {
+			return nil
+		}
+		running.Add(1)
+		return func() { running.Add(-1) }
+	}
+	t.Cleanup(func() { testAsyncRead = nil })
+	return &running
+}
+
+// waitAsyncReads polls until no helper counted by running is reading.
+func waitAsyncReads(t *testing.T, running *atomic.Int32) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for running.Load() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d asyncReader helpers still reading", running.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// idleReceive starts Receive on a deadline-less pipe nobody sends on, waits for
+// its ZRINIT, then cancels and returns Receive's error and how long it took.
+func idleReceive(t *testing.T, transport io.ReadWriter, peer io.Reader, cfg *Config) (error, time.Duration) {
+	t.Helper()
+	receiver := NewSession(transport, newTestHandler(), cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := make(chan error, 1)
+	go func() { result <- receiver.Receive(ctx) }()
+
+	if _, err := peer.Read(make([]byte, 64)); err != nil {
+		t.Fatalf("waiting for ZRINIT: %v", err)
+	}
+	time.Sleep(20 * time.Millisecond) // let the receiver block in its read
+	start := time.Now()
+	cancel()
+	select {
+	case err := <-result:
+		return err, time.Since(start)
+	case <-time.After(2 * time.Second):
+		t.Fatal("Receive did not return after cancel")
+		return nil, 0
+	}
+}
+
+// TestReceiveCancelWithoutDeadlines: a receiver blocked reading a transport
+// with no SetReadDeadline (and no idle timeout) returns at once when its
+// context is cancelled, and the helper read ends with the transport.
+func TestReceiveCancelWithoutDeadlines(t *testing.T) {
+	peer, transport, peerClose, _ := newTestTransports()
+	running := countAsyncReads(t, transport)
+
+	err, took := idleReceive(t, transport, peer, &Config{RecvTimeout: 0, Logger: discardLogger()})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Receive = %v, want context.Canceled", err)
+	}
+	if took > 500*time.Millisecond {
+		t.Fatalf("Receive took %v to return after cancel", took)
+	}
+
+	// The abandoned Read is still waiting on the pipe; closing it ends it.
+	if n := running.Load(); n != 1 {
+		t.Fatalf("%d asyncReader helpers reading after cancel, want the abandoned one", n)
+	}
+	peerClose()
+	waitAsyncReads(t, running)
+}
+
+// closingTransport is a deadline-less transport whose Close ends a blocked Read.
+type closingTransport struct {
+	*pipeReadWriter
+	in     *chanWriter
+	closed chan struct{}
+}
+
+func (c *closingTransport) Close() error {
+	close(c.closed)
+	return c.in.Close()
+}
+
+// TestCloseOnCancel: with Config.CloseOnCancel the session closes the
+// transport itself, so nothing is left reading it.
+func TestCloseOnCancel(t *testing.T) {
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+	transport := &closingTransport{
+		pipeReadWriter: &pipeReadWriter{Reader: r1, Writer: w2},
+		in:             w1,
+		closed:         make(chan struct{}),
+	}
+	running := countAsyncReads(t, transport)
+
+	err, _ := idleReceive(t, transport, r2, &Config{CloseOnCancel: true, Logger: discardLogger()})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Receive = %v, want context.Canceled", err)
+	}
+	select {
+	case <-transport.closed:
+	default:
+		t.Fatal("transport not closed on cancel")
+	}
+	waitAsyncReads(t, running)
+}
+
+// TestAsyncReaderKeepsAbandonedRead: bytes that arrive after a cancelled wait
+// are returned by the next Read, not lost.
+func TestAsyncReaderKeepsAbandonedRead(t *testing.T) {
+	r, w := bufferedPipe(4)
+	a := newAsyncReader(r)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := a.readContext(ctx, make([]byte, 8)); !errors.Is(err, context.Canceled) {
+		t.Fatalf("cancelled read = %v, want context.Canceled", err)
+	}
+
+	w.Write([]byte("0123456789"))
+	got := make([]byte, 0, 10)
+	buf := make([]byte, 4)
+	for len(got) < 10 {
+		n, err := a.Read(buf)
+		if err != nil {
+			t.Fatalf("Read: %v", err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if string(got) != "0123456789" {
+		t.Fatalf("read %q, want %q", got, "0123456789")
+	}
+
+	w.Close()
+	if _, err := a.Read(buf); err != io.EOF {
+		t.Fatalf("Read after close = %v, want io.EOF", err)
+	}
+}
+
+// TestAbortDuringTransfer calls Abort from another goroutine while the sender
+// is streaming data (run it under -race): Send stops with ErrLocalAbort, the
+// file in flight is reported with it, and the receiver sees a clean CAN abort
+// rather than noise in the middle of a frame.
+func TestAbortDuringTransfer(t *testing.T) {
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+
+	content := bytes.Repeat([]byte("abort me "), 1<<19)
+	senderHandler := newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{{
+		Name: "big.txt", Size: int64(len(content)), Reader: bytes.NewReader(content),
+	}}
+	receiverHandler := newTestHandler()
+	cfg := &Config{MaxBlockSize: 1024, Logger: discardLogger()}
+	sender := NewSession(senderT, senderHandler, cfg)
+	receiver := NewSession(receiverT, receiverHandler, cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var sendErr, recvErr, abortErr error
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		defer senderClose()
+		sendErr = sender.Send(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		defer receiverClose()
+		recvErr = receiver.Receive(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		for ctx.Err() == nil {
+			receiverHandler.mu.Lock()
+			got := receiverHandler.progress["big.txt"]
+			receiverHandler.mu.Unlock()
+			if got > 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+		abortErr = sender.Abort()
+	}()
+	wg.Wait()
+
+	if abortErr != nil {
+		t.Fatalf("Abort = %v", abortErr)
+	}
+	if !errors.Is(sendErr, ErrLocalAbort) {
+		t.Fatalf("Send = %v, want ErrLocalAbort", sendErr)
+	}
+	if !errors.Is(recvErr, ErrAborted) {
+		t.Fatalf("Receive = %v, want ErrAborted", recvErr)
+	}
+	senderHandler.mu.Lock()
+	defer senderHandler.mu.Unlock()
+	if got := senderHandler.completedFiles["big.txt"]; !errors.Is(got, ErrLocalAbort) {
+		t.Fatalf("FileCompleted(big.txt) = %v, want ErrLocalAbort", got)
+	}
+}
@@ -0,0 +1,518 @@
+package zmodem
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// ==== Wire captures ====
+//
+// A capture (testdata/capture/*.zcap) is a session as it went over the wire
+// between a Session and a third-party peer, recorded from a live run (see
+// recordCapture): direction-tagged, timestamped byte chunks. TestCaptures
+// plays the peer's side of each against a Session and checks what the
+// Session sends against what it sent then, so an interop scenario runs where
+// the peer's binary cannot. The files and their content come from the frames
+// themselves. One line per item; # starts a comment.
+//
+//	session send|receive    what the recorded Session did
+//	config OPTION...        its Config, as in a replay script
+//	SECONDS < "BYTES"       bytes the Session read, SECONDS into the session
+//	SECONDS > "BYTES"       bytes the Session wrote
+//
+// A peer chunk is played once the Session has sent every header the capture
+// shows before it, and after a peer chunk before it no sooner than the
+// capture has it. What only timing decides is not held against the Session:
+//
+//   - repeats of a header in a row count once, on either side, so a
+//     retransmit after a timeout, then or now, is no difference;
+//   - bytes outside frames (rz\r, OO, XON) are not compared;
+//   - headers are compared by type, and by offset for ZRPOS, ZDATA, ZEOF and
+//     ZACK; flags are not;
+//   - data is compared as the files it builds, whatever the block sizes.
+
+// captureChunk is one chunk of a capture.
+type captureChunk struct {
+	at   time.Duration
+	peer bool // read by the Session, else written by it
+	data []byte
+}
+
+// capture is a parsed capture file.
+type capture struct {
+	send   bool
+	cfg    Config
+	chunks []captureChunk
+}
+
+func parseCapture(t testing.TB, path string) capture {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	c := capture{cfg: Config{Logger: discardLogger()}}
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 16<<20)
+	for n := 1; sc.Scan(); n++ {
+		args, err := splitReplayLine(sc.Text())
+		if err != nil {
+			t.Fatalf("%s:%d: %v", path, n, err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+		switch args[0] {
+		case "session":
+			c.send = len(args) > 1 && args[1] == "send"
+		case "config":
+			for _, opt := range args[1:] {
+				if !setReplayConfig(&c.cfg, opt) {
+					t.Fatalf("%s:%d: unknown config %q", path, n, opt)
+				}
+			}
+		default:
+			secs, err := strconv.ParseFloat(args[0], 64)
+			if err != nil || len(args) != 3 || (args[1] != "<" && args[1] != ">") {
+				t.Fatalf("%s:%d: want SECONDS < or > \"BYTES\"", path, n)
+			}
+			c.chunks = append(c.chunks, captureChunk{
+				at:   time.Duration(secs * float64(time.Second)),
+				peer: args[1] == "<",
+				data: []byte(args[2]),
+			})
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// captureFile is a file as the frames of one direction carry it.
+type captureFile struct {
+	name string
+	size int64
+	data []byte
+}
+
+// decodeCapture decodes the frames in one direction's bytes, up to where
+// they end, mid-frame or not: the headers, repeats in a row counted once,
+// and the files the ZFILE and ZDATA frames carry. Data at an offset past
+// what came before it (a resumed file) is preceded by zeros.
+func decodeCapture(stream []byte) (headers []string, files []*captureFile, err error) {
+	fr := NewFrameReader(bytes.NewReader(stream), EscapeStandard)
+	var cur *captureFile
+	for {
+		hdr, err := fr.ReadHeader()
+		if err != nil {
+			return headers, files, captureEnd(err)
+		}
+		name := captureHeader(hdr)
+		if len(headers) == 0 || headers[len(headers)-1] != name {
+			headers = append(headers, name)
+		}
+		crc32 := hdr.Encoding == ZBIN32
+		switch hdr.Type {
+		case ZFILE:
+			data, _, err := fr.ReadSubpacket(2048, crc32)
+			if err != nil {
+				return headers, files, captureEnd(err)
+			}
+			info, err := parseFileInfo(data)
+			if err != nil {
+				return headers, files, err
+			}
+			i := slices.IndexFunc(files, func(f *captureFile) bool { return f.name == info.Name })
+			if i < 0 {
+				files = append(files, &captureFile{name: info.Name, size: info.Size})
+				i = len(files) - 1
+			}
+			cur = files[i]
+		case ZDATA:
+			if cur == nil {
+				return headers, files, errors.New("ZDATA before ZFILE")
+			}
+			pos := hdr.Position()
+			if int64(len(cur.data)) > pos {
+				cur.data = cur.data[:pos]
+			} else {
+				cur.data = append(cur.data, make([]byte, pos-int64(len(cur.data)))...)
+			}
+			for {
+				data, end, err := fr.ReadSubpacket(maxLargeBlockSize, crc32)
+				if err != nil {
+					return headers, files, captureEnd(err)
+				}
+				cur.data = append(cur.data, data...)
+				if end == ZCRCE || end == ZCRCW {
+					break
+				}
+			}
+		case ZSINIT, ZCOMMAND:
+			if _, _, err := fr.ReadSubpacket(1024, crc32); err != nil {
+				return headers, files, captureEnd(err)
+			}
+		}
+	}
+}
+
+// captureEnd is nil for err meaning the bytes ran out.
+func captureEnd(err error) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return nil
+	}
+	return err
+}
+
+// captureHeader names a header as captures compare it.
+func captureHeader(hdr Header) string {
+	switch hdr.Type {
+	case ZRPOS, ZDATA, ZEOF, ZACK:
+		return fmt.Sprintf("%s %d", frameTypeName(hdr.Type), hdr.Position())
+	}
+	return frameTypeName(hdr.Type)
+}
+
+// captureResume returns the offset a receiving Session accepted its file at,
+// resuming it: that of its first ZRPOS.
+func captureResume(headers []string) int64 {
+	for _, h := range headers {
+		if pos, ok := strings.CutPrefix(h, frameTypeName(ZRPOS)+" "); ok {
+			n, _ := strconv.ParseInt(pos, 10, 64)
+			return n
+		}
+	}
+	return 0
+}
+
+// captureConn is the Session's transport in a playback: it reads the peer's
+// chunks, with read deadlines, and keeps what the Session writes.
+type captureConn struct {
+	*replayReader
+
+	mu    sync.Mutex
+	out   []byte
+	wrote chan struct{} // signalled on each Write
+}
+
+func (c *captureConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.out = append(c.out, p...)
+	c.mu.Unlock()
+	select {
+	case c.wrote <- struct{}{}:
+	default:
+	}
+	return len(p), nil
+}
+
+// sent returns the headers and files the Session has sent so far.
+func (c *captureConn) sent() ([]string, []*captureFile, error) {
+	c.mu.Lock()
+	out := bytes.Clone(c.out)
+	c.mu.Unlock()
+	return decodeCapture(out)
+}
+
+func runCapture(t *testing.T, path string) {
+	c := parseCapture(t, path)
+	var ours, theirs []byte
+	for _, ch := range c.chunks {
+		if ch.peer {
+			theirs = append(theirs, ch.data...)
+		} else {
+			ours = append(ours, ch.data...)
+		}
+	}
+	wantHeaders, wantFiles, err := decodeCapture(ours)
+	if err != nil {
+		t.Fatalf("capture, Session side: %v", err)
+	}
+	_, peerFiles, err := decodeCapture(theirs)
+	if err != nil {
+		t.Fatalf("capture, peer side: %v", err)
+	}
+
+	handler := newTestHandler()
+	if c.send {
+		for _, f := range wantFiles {
+			handler.filesToSend = append(handler.filesToSend,
+				&FileOffer{Name: f.name, Size: f.size, Reader: bytes.NewReader(f.data)})
+		}
+	} else {
+		handler.acceptOffset = captureResume(wantHeaders)
+	}
+	r, w := bufferedPipe(256)
+	conn := &captureConn{replayReader: &replayReader{chanReader: r}, wrote: make(chan struct{}, 1)}
+	session := NewSession(conn, handler, &c.cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var runErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if c.send {
+			runErr = session.Send(ctx)
+		} else {
+			runErr = session.Receive(ctx)
+		}
+	}()
+
+	// awaitSent waits for the Session to have sent n headers, failing on any
+	// the capture does not have.
+	awaitSent := func(n int) {
+		t.Helper()
+		for {
+			got, _, err := conn.sent()
+			if err != nil {
+				t.Fatalf("Session sent a bad frame: %v", err)
+			}
+			for i, h := range got {
+				if i >= len(wantHeaders) || h != wantHeaders[i] {
+					t.Fatalf("Session sent %v,\ncapture has %v", got, wantHeaders)
+				}
+			}
+			if len(got) >= n {
+				return
+			}
+			select {
+			case <-conn.wrote:
+			case <-done:
+				t.Fatalf("Session returned (%v) after sending %v,\ncapture has %v", runErr, got, wantHeaders)
+			case <-ctx.Done():
+				t.Fatalf("Session sent %v and stopped,\ncapture has %v", got, wantHeaders)
+			}
+		}
+	}
+
+	var before []byte // the Session's bytes before the current chunk
+	var prev *captureChunk
+	for i := range c.chunks {
+		ch := &c.chunks[i]
+		if !ch.peer {
+			before = append(before, ch.data...)
+			prev = ch
+			continue
+		}
+		headers, _, _ := decodeCapture(before)
+		awaitSent(len(headers))
+		if prev != nil && prev.peer {
+			time.Sleep(ch.at - prev.at)
+		}
+		w.Write(ch.data)
+		prev = ch
+	}
+	awaitSent(len(wantHeaders))
+	<-done
+	w.Close()
+	if runErr != nil {
+		t.Fatalf("session: %v", runErr)
+	}
+
+	gotHeaders, gotFiles, _ := conn.sent()
+	if !slices.Equal(gotHeaders, wantHeaders) {
+		t.Fatalf("Session sent %v,\ncapture has %v", gotHeaders, wantHeaders)
+	}
+	if c.send {
+		for i, f := range wantFiles {
+			if i >= len(gotFiles) || gotFiles[i].name != f.name || !bytes.Equal(gotFiles[i].data, f.data) {
+				t.Errorf("file %s not sent as captured", f.name)
+			}
+		}
+		return
+	}
+	for _, f := range peerFiles {
+		got := handler.receivedFiles[f.name]
+		if got == nil || !bytes.Equal(got.Bytes(), f.data[min(handler.acceptOffset, int64(len(f.data))):]) {
+			t.Errorf("file %s not received as captured", f.name)
+		}
+	}
+}
+
+// TestCaptures plays every capture in testdata/capture.
+func TestCaptures(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "capture", "*.zcap"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no captures")
+	}
+	for _, path := range paths {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".zcap"), func(t *testing.T) {
+			runCapture(t, path)
+		})
+	}
+}
+
+// captureLog is a recording of what a Session reads and writes, for
+// recordCapture and recordStdioCapture.
+type captureLog struct {
+	start time.Time
+
+	mu     sync.Mutex
+	chunks []captureChunk
+}
+
+func (l *captureLog) add(peer bool, p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	l.mu.Lock()
+	l.chunks = append(l.chunks, captureChunk{at: time.Since(l.start), peer: peer, data: bytes.Clone(p)})
+	l.mu.Unlock()
+}
+
+// captureRecorder is a connection recording a session run over it.
+type captureRecorder struct {
+	net.Conn
+	log *captureLog
+}
+
+func (r *captureRecorder) Read(p []byte) (int, error) {
+	n, err := r.Conn.Read(p)
+	r.log.add(true, p[:n])
+	return n, err
+}
+
+func (r *captureRecorder) Write(p []byte) (int, error) {
+	n, err := r.Conn.Write(p)
+	r.log.add(false, p[:n])
+	return n, err
+}
+
+// stdioRecorder is a child process's stdio recording a session run over it.
+type stdioRecorder struct {
+	*stdioTransport
+	log *captureLog
+}
+
+func (r *stdioRecorder) Read(p []byte) (int, error) {
+	n, err := r.stdioTransport.Read(p)
+	r.log.add(true, p[:n])
+	return n, err
+}
+
+func (r *stdioRecorder) Write(p []byte) (int, error) {
+	n, err := r.stdioTransport.Write(p)
+	r.log.add(false, p[:n])
+	return n, err
+}
+
+// recordCapture returns conn, recording the session a test runs over it as
+// testdata/capture-style NAME.zcap in $ZMODEM_CAPTURE_DIR when that is set
+// and the test passes. send and cfg are the Session's, as NewSession gets it.
+// To add a capture, run the live test with the variable set, then move the
+// file into testdata/capture with a comment saying what it shows:
+//
+//	ZMODEM_CAPTURE_DIR=/tmp/zcap go test -run TestLrzszA1 .
+func recordCapture(t *testing.T, conn net.Conn, name string, send bool, cfg *Config) net.Conn {
+	t.Helper()
+	if l := newCaptureLog(t, name, send, cfg); l != nil {
+		return &captureRecorder{Conn: conn, log: l}
+	}
+	return conn
+}
+
+// recordStdioCapture is recordCapture for a peer on a child process's stdio,
+// as sexyz is run.
+func recordStdioCapture(t *testing.T, tr *stdioTransport, name string, send bool, cfg *Config) io.ReadWriteCloser {
+	t.Helper()
+	if l := newCaptureLog(t, name, send, cfg); l != nil {
+		return &stdioRecorder{stdioTransport: tr, log: l}
+	}
+	return tr
+}
+
+// newCaptureLog starts a recording to be written as NAME.zcap when the test
+// passes, or returns nil if $ZMODEM_CAPTURE_DIR is not set.
+func newCaptureLog(t *testing.T, name string, send bool, cfg *Config) *captureLog {
+	t.Helper()
+	dir := os.Getenv("ZMODEM_CAPTURE_DIR")
+	if dir == "" {
+		return nil
+	}
+	l := &captureLog{start: time.Now()}
+	t.Cleanup(func() {
+		if t.Failed() {
+			return
+		}
+		if err := os.WriteFile(filepath.Join(dir, name+".zcap"), l.marshal(t.Name(), send, cfg), 0o644); err != nil {
+			t.Error(err)
+		}
+	})
+	return l
+}
+
+// marshal formats the recording as a capture file.
+func (l *captureLog) marshal(test string, send bool, cfg *Config) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "# Recorded by %s.\n\n", test)
+	if send {
+		b.WriteString("session send\n")
+	} else {
+		b.WriteString("session receive\n")
+	}
+	b.WriteString("config")
+	if cfg.Use32BitCRC {
+		b.WriteString(" use32")
+	}
+	if cfg.MaxBlockSize > 0 {
+		fmt.Fprintf(&b, " block=%d", cfg.MaxBlockSize)
+	}
+	if cfg.WindowSize > 0 {
+		fmt.Fprintf(&b, " window=%d", cfg.WindowSize)
+	}
+	if cfg.RecvTimeout > 0 {
+		fmt.Fprintf(&b, " recvtimeout=%v", cfg.RecvTimeout)
+	}
+	b.WriteString("\n\n")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, ch := range l.chunks {
+		dir := ">"
+		if ch.peer {
+			dir = "<"
+		}
+		fmt.Fprintf(&b, "%.6f %s %s\n", ch.at.Seconds(), dir, quoteBytes(ch.data))
+	}
+	return b.Bytes()
+}
+
+// quoteBytes quotes p as a Go string literal byte for byte, where
+// strconv.Quote would take it for UTF-8.
+func quoteBytes(p []byte) string {
+	b := []byte{'"'}
+	for _, c := range p {
+		switch {
+		case c == '"' || c == '\\':
+			b = append(b, '\\', c)
+		case c == '\r':
+			b = append(b, `\r`...)
+		case c == '\n':
+			b = append(b, `\n`...)
+		case c >= ' ' && c < 0x7f:
+			b = append(b, c)
+		default:
+			b = fmt.Appendf(b, `\x%02x`, c)
+		}
+	}
+	return string(append(b, '"'))
+}
@@ -0,0 +1,128 @@
+package zmodem
+
+import "time"
+
+const (
+	defaultMinCheckpointInterval = 8
+	defaultMaxCheckpointInterval = 256
+
+	// checkpointRTTs is how many round trips' worth of sending go between
+	// two checkpoints. The sender waits out each ZCRCQ's round trip, so this
+	// keeps the wait near 1/17 of the time on any link.
+	checkpointRTTs = 16
+
+	// maxCheckpointSpan caps the data between two checkpoints, whatever the
+	// link. The sender only reads the reverse channel at a checkpoint, so a
+	// receiver that hits an error must skip the rest of the span as stale
+	// before the sender hears its ZRPOS. Ours, in its default count-based
+	// recovery, gives up after about 30 KB of that. A larger
+	// MinCheckpointInterval still wins over the cap.
+	maxCheckpointSpan = 16 << 10
+)
+
+// checkpointPacer spaces a streaming sender's ZCRCQ checkpoints by the link's
+// measured round trip. Each answered ZCRCQ or ZCRCW gives a round-trip
+// sample, and the data sent since the previous answer a send-rate sample;
+// the spacing is then checkpointRTTs round trips of data at that rate, in
+// subpackets of the current size, at most maxCheckpointSpan bytes and within
+// [min, max]. Until the first measurement it is min, the old fixed spacing.
+//
+// Growth is TCP's: the spacing at most doubles per answer until the first
+// error recovery, which sends it back to min and remembers half the spacing
+// it had reached; past that it grows by one subpacket per answer. Every
+// error costs the sender what it sent before the ZRPOS got back: a round
+// trip of data, or, as the sender stops at each checkpoint, at most about a
+// span. Wider spacing on a long link thus resends more per error as the price
+// of waiting less, and on a link that keeps losing data the spacing stays
+// close to min.
+//
+// It belongs to the Session, so what one file measured carries over to the
+// next.
+type checkpointPacer struct {
+	min, max int           // Config.MinCheckpointInterval, MaxCheckpointInterval
+	interval int           // current spacing, in subpackets
+	ceiling  int           // spacing past which growth is linear; 0 until an error recovery
+	srtt     time.Duration // smoothed round trip; 0 until measured
+	rate     float64       // smoothed send rate, bytes per second; 0 until measured
+	start    time.Time     // when sending resumed after the last answer
+	sent     int64         // data bytes sent since start
+	asked    time.Time     // when the outstanding checkpoint went out; zero if none or resent
+	now      func() time.Time
+}
+
+func newCheckpointPacer(minInterval, maxInterval int) checkpointPacer {
+	return checkpointPacer{min: minInterval, max: maxInterval, interval: minInterval, now: time.Now}
+}
+
+// resume starts timing a run of data, at the start of a frame or after an
+// answer.
+func (p *checkpointPacer) resume() {
+	p.start = p.now()
+	p.sent = 0
+	p.asked = time.Time{}
+}
+
+// sentData counts n bytes of data sent.
+func (p *checkpointPacer) sentData(n int) {
+	p.sent += int64(n)
+}
+
+// ask notes that a ZCRCQ or ZCRCW just went out and the sender is about to
+// wait for its answer. The run of data since resume is a send-rate sample.
+func (p *checkpointPacer) ask() {
+	p.asked = p.now()
+	if elapsed := p.asked.Sub(p.start); p.sent > 0 && elapsed > 0 {
+		sample := float64(p.sent) / elapsed.Seconds()
+		if p.rate == 0 {
+			p.rate = sample
+		} else {
+			p.rate += (sample - p.rate) / 4
+		}
+	}
+}
+
+// resent notes that the checkpoint went out again after a timeout. Its
+// answer cannot be matched to either copy, so it is not a sample (Karn).
+func (p *checkpointPacer) resent() {
+	p.asked = time.Time{}
+}
+
+// answered takes the round-trip sample for an answered checkpoint, respaces
+// the checkpoints for blocks of blockSize and starts timing the next run.
+func (p *checkpointPacer) answered(blockSize int) {
+	if !p.asked.IsZero() {
+		sample := p.now().Sub(p.asked)
+		if p.srtt == 0 {
+			p.srtt = sample
+		} else {
+			p.srtt += (sample - p.srtt) / 8
+		}
+		p.respace(blockSize)
+	}
+	p.resume()
+}
+
+// reset drops back to the minimum spacing after an error recovery (a ZRPOS
+// or a reconnect), so a sender on a troubled link hears from the receiver
+// often until answers come back again.
+func (p *checkpointPacer) reset() {
+	p.ceiling = max(p.interval/2, p.min)
+	p.interval = p.min
+}
+
+func (p *checkpointPacer) respace(blockSize int) {
+	if p.srtt <= 0 || p.rate <= 0 || blockSize <= 0 {
+		return
+	}
+	n := p.rate * p.srtt.Seconds() * checkpointRTTs / float64(blockSize)
+	grow := 2 * p.interval
+	if p.ceiling > 0 {
+		if p.interval >= p.ceiling {
+			grow = p.interval + 1
+		} else {
+			grow = min(grow, p.ceiling)
+		}
+	}
+	n = min(n, float64(maxCheckpointSpan/blockSize), float64(grow))
+	p.interval = int(min(max(n, float64(p.min)), float64(p.max)))
+}
@@ -0,0 +1,87 @@
+package zmodem
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckpointPacer(t *testing.T) {
+	clock := time.Unix(1700000000, 0)
+	p := newCheckpointPacer(8, 256)
+	p.now = func() time.Time { return clock }
+
+	// checkpoint sends sent bytes over sending, then waits rtt for the answer.
+	checkpoint := func(sent int, sending, rtt time.Duration, block int) {
+		p.resume()
+		p.sentData(sent)
+		clock = clock.Add(sending)
+		p.ask()
+		clock = clock.Add(rtt)
+		p.answered(block)
+	}
+
+	if p.interval != 8 {
+		t.Fatalf("interval before any answer = %d, want the minimum 8", p.interval)
+	}
+	// 8 KB sent in 80 ms (100 KB/s), answered 50 ms later.
+	checkpoint(8000, 80*time.Millisecond, 50*time.Millisecond, 1000)
+	if p.srtt != 50*time.Millisecond {
+		t.Fatalf("srtt = %v, want the first sample", p.srtt)
+	}
+	// 16 RTTs of 100 KB/s is 80 blocks, but the spacing at most doubles.
+	if p.interval != 16 {
+		t.Fatalf("interval = %d, want 16", p.interval)
+	}
+	// ... and never spans more than maxCheckpointSpan.
+	checkpoint(16000, 160*time.Millisecond, 50*time.Millisecond, 1000)
+	if want := maxCheckpointSpan / 1000; p.interval != want {
+		t.Fatalf("interval = %d, want %d", p.interval, want)
+	}
+
+	// A resent checkpoint's answer is no sample.
+	p.resume()
+	p.sentData(1000)
+	p.ask()
+	clock = clock.Add(10 * time.Second)
+	p.resent()
+	p.answered(1000)
+	if p.srtt != 50*time.Millisecond {
+		t.Fatalf("srtt = %v after a resent checkpoint, want it unchanged", p.srtt)
+	}
+
+	// A slow link: 16 RTTs of 2 KB/s at 50 ms is 1.6 KB, under the minimum.
+	checkpoint(2000, time.Second, 50*time.Millisecond, 1000)
+	for range 20 {
+		checkpoint(200, 100*time.Millisecond, 50*time.Millisecond, 1000)
+	}
+	if p.interval != 8 {
+		t.Fatalf("interval on a slow link = %d, want the minimum 8", p.interval)
+	}
+
+	// An error recovery goes back to the minimum at once ...
+	p.interval = 40
+	p.reset()
+	if p.interval != 8 {
+		t.Fatalf("interval after reset = %d, want 8", p.interval)
+	}
+	// ... then doubles up to half the spacing it had, and creeps past it.
+	for _, want := range []int{16, 20, 21, 22} {
+		checkpoint(100000, 100*time.Millisecond, 50*time.Millisecond, 100)
+		if p.interval != want {
+			t.Fatalf("interval after an error recovery = %d, want %d", p.interval, want)
+		}
+	}
+
+	// Equal bounds fix the spacing, even past maxCheckpointSpan.
+	fixed := newCheckpointPacer(64, 64)
+	fixed.now = p.now
+	fixed.resume()
+	fixed.sentData(64000)
+	clock = clock.Add(time.Millisecond)
+	fixed.ask()
+	clock = clock.Add(time.Millisecond)
+	fixed.answered(1024)
+	if fixed.interval != 64 {
+		t.Fatalf("fixed interval = %d, want 64", fixed.interval)
+	}
+}
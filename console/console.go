@@ -0,0 +1,365 @@
+// Package console shows the progress of ZMODEM transfers on a terminal, as
+// sz and rz do on stderr.
+//
+// A ProgressDisplay wraps the zmodem.FileHandler a program already has and
+// passes every call on to it, drawing what it learns on the way: one line per
+// file with its name, percentage, rate and time left, and a summary of the
+// batch at the end. On a terminal each file's line is redrawn in place; to a
+// file or pipe it logs a line every LogInterval instead, so a log does not
+// fill with carriage returns.
+//
+//	d := console.NewProgressDisplay(os.Stderr, handler)
+//	d.Transport = os.Stdout // the transfer goes over stdout
+//	err := zmodem.NewSession(conn, d, cfg).Send(ctx)
+//	d.Finish()
+package console
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	zmodem "github.com/xx25/go-zmodem"
+)
+
+// DefaultLogInterval is how often a file's progress is logged when the
+// output is not a terminal.
+const DefaultLogInterval = 10 * time.Second
+
+// redrawInterval is how often a terminal line is redrawn.
+const redrawInterval = 100 * time.Millisecond
+
+// ProgressDisplay is a zmodem.FileHandler that shows transfer progress and
+// passes every call on to the handler it wraps. It implements
+// zmodem.ProgressHandler, so the Session gives it the bytes moved in this
+// session as well as the file offset; a wrapped handler that does not
+// implement it gets FileProgress as before.
+type ProgressDisplay struct {
+	// Terminal redraws each file's line in place. NewProgressDisplay sets
+	// it when the output is a character device.
+	Terminal bool
+	// LogInterval is how often a file's progress is logged when Terminal
+	// is not set; 0 means DefaultLogInterval.
+	LogInterval time.Duration
+	// Transport is the file the transfer goes over, if it is one: os.Stdout
+	// for a program run as the far end of sz or rz. The display writes
+	// nothing when its output is that same file (stderr sent to stdout with
+	// 2>&1, or both the one terminal), where its lines would land in the
+	// middle of the transfer.
+	Transport *os.File
+
+	w       io.Writer
+	handler zmodem.FileHandler
+	now     func() time.Time
+
+	mu      sync.Mutex
+	checked bool // silent has been worked out
+	silent  bool
+	cur     *fileState
+	drawn   int // length of the terminal line drawn, 0 for none
+	batch   batchState
+}
+
+// fileState is the file in progress.
+type fileState struct {
+	name  string
+	size  int64
+	start time.Time
+	shown time.Time            // when its line was last drawn or logged
+	from  int64                // the offset the transfer began at
+	at    int64                // the offset reached
+	moved int64                // bytes moved in this session
+	rate  zmodem.RateEstimator // its rate and time left
+	rated bool                 // rate has the transfer's beginning
+}
+
+// batchState sums up the files so far.
+type batchState struct {
+	start   time.Time
+	files   int
+	skipped int
+	failed  int
+	bytes   int64
+}
+
+// NewProgressDisplay returns a ProgressDisplay drawing to w and passing every
+// call on to handler.
+func NewProgressDisplay(w io.Writer, handler zmodem.FileHandler) *ProgressDisplay {
+	return &ProgressDisplay{
+		Terminal: isTerminal(w),
+		w:        w,
+		handler:  handler,
+		now:      time.Now,
+	}
+}
+
+// NextFile passes the call on, and starts a file's line for the offer.
+func (d *ProgressDisplay) NextFile() *zmodem.FileOffer {
+	offer := d.handler.NextFile()
+	if offer != nil {
+		d.mu.Lock()
+		d.begin(offer.Name, offer.Size)
+		d.mu.Unlock()
+	}
+	return offer
+}
+
+// AcceptFile passes the call on, and starts a file's line when the handler
+// takes the file.
+func (d *ProgressDisplay) AcceptFile(info zmodem.FileInfo) (io.WriteCloser, int64, error) {
+	w, offset, err := d.handler.AcceptFile(info)
+	if err == nil {
+		d.mu.Lock()
+		d.begin(info.Name, info.Size)
+		d.mu.Unlock()
+	}
+	return w, offset, err
+}
+
+// FileProgress passes the call on. A Session gives a ProgressDisplay
+// TransferProgress instead; this is for callers driving it by hand.
+func (d *ProgressDisplay) FileProgress(info zmodem.FileInfo, bytesTransferred int64) {
+	d.handler.FileProgress(info, bytesTransferred)
+	d.update(info, zmodem.Progress{Offset: bytesTransferred, SessionBytes: bytesTransferred})
+}
+
+// TransferProgress passes the call on, as TransferProgress or FileProgress
+// depending on what the wrapped handler implements, and redraws the file's
+// line.
+func (d *ProgressDisplay) TransferProgress(info zmodem.FileInfo, p zmodem.Progress) {
+	if ph, ok := d.handler.(zmodem.ProgressHandler); ok {
+		ph.TransferProgress(info, p)
+	} else {
+		d.handler.FileProgress(info, p.Offset)
+	}
+	d.update(info, p)
+}
+
+// FileCompleted passes the call on, and ends the file's line with how it
+// went.
+func (d *ProgressDisplay) FileCompleted(info zmodem.FileInfo, bytesTransferred int64, err error) {
+	d.handler.FileCompleted(info, bytesTransferred, err)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f := d.file(info)
+	f.at = bytesTransferred
+	now := d.now()
+	var line string
+	switch {
+	case errors.Is(err, zmodem.ErrSkip), errors.Is(err, zmodem.ErrSkippedByRemote):
+		d.batch.skipped++
+		line = f.name + "  skipped"
+	case err != nil:
+		d.batch.failed++
+		line = fmt.Sprintf("%s  failed at %s: %v", f.name, formatBytes(f.at), err)
+	default:
+		f.moved = max(f.moved, bytesTransferred-f.from)
+		d.batch.files++
+		d.batch.bytes += f.moved
+		elapsed := now.Sub(f.start)
+		line = fmt.Sprintf("%s  %s  %s  done in %s", f.name, formatBytes(f.at), formatRate(f.moved, elapsed), formatDuration(elapsed))
+	}
+	d.cur = nil
+	d.finishLine(line)
+}
+
+// Finish writes the summary of the batch. Call it once Send or Receive has
+// returned.
+func (d *ProgressDisplay) Finish() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cur != nil { // a file whose end was never reported
+		d.finishLine(d.progressLine(d.cur, d.now()))
+		d.cur = nil
+	}
+	b := d.batch
+	elapsed := time.Duration(0)
+	if !b.start.IsZero() {
+		elapsed = d.now().Sub(b.start)
+	}
+	line := fmt.Sprintf("%d %s, %s in %s, %s", b.files, plural(b.files, "file"),
+		formatBytes(b.bytes), formatDuration(elapsed), formatRate(b.bytes, elapsed))
+	if b.skipped > 0 {
+		line += fmt.Sprintf(", %d skipped", b.skipped)
+	}
+	if b.failed > 0 {
+		line += fmt.Sprintf(", %d failed", b.failed)
+	}
+	d.finishLine(line)
+}
+
+// begin starts the line of a file the session is about to move.
+func (d *ProgressDisplay) begin(name string, size int64) {
+	now := d.now()
+	if d.batch.start.IsZero() {
+		d.batch.start = now
+	}
+	d.cur = &fileState{name: name, size: size, start: now, shown: now}
+}
+
+// file returns the file in progress, started for info if there is none.
+func (d *ProgressDisplay) file(info zmodem.FileInfo) *fileState {
+	if d.cur == nil {
+		d.begin(info.Name, info.Size)
+	}
+	return d.cur
+}
+
+// update records a file's progress and shows it when its line is due.
+func (d *ProgressDisplay) update(info zmodem.FileInfo, p zmodem.Progress) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	f := d.file(info)
+	now := d.now()
+	if !f.rated {
+		// The transfer began with the file, at its start offset.
+		f.rated = true
+		f.rate.Observe(p.StartOffset, f.start)
+	}
+	f.rate.Observe(p.Offset, now)
+	f.from, f.at, f.moved = p.StartOffset, p.Offset, p.SessionBytes
+	every := redrawInterval
+	if !d.Terminal {
+		every = d.LogInterval
+		if every <= 0 {
+			every = DefaultLogInterval
+		}
+	}
+	if now.Sub(f.shown) < every {
+		return
+	}
+	f.shown = now
+	line := d.progressLine(f, now)
+	if d.Terminal {
+		d.draw(line)
+	} else {
+		d.write(line + "\n")
+	}
+}
+
+// progressLine describes a file in progress as of now, its rate the
+// instant one:
+//
+//	notes.bin   45%  8.8 KiB/19.5 KiB  2.2 KiB/s  ETA 0:05
+func (d *ProgressDisplay) progressLine(f *fileState, now time.Time) string {
+	var b strings.Builder
+	b.WriteString(f.name)
+	if f.size > 0 {
+		fmt.Fprintf(&b, "  %3d%%  %s/%s", min(f.at*100/f.size, 100), formatBytes(f.at), formatBytes(f.size))
+	} else {
+		fmt.Fprintf(&b, "  %s", formatBytes(f.at))
+	}
+	f.rate.Observe(f.at, now)
+	rate, _ := f.rate.Rate()
+	if rate > 0 {
+		fmt.Fprintf(&b, "  %s/s", formatBytes(int64(rate)))
+	} else {
+		b.WriteString("  - B/s")
+	}
+	if left := f.rate.ETA(f.size); f.size > f.at && left >= 0 {
+		fmt.Fprintf(&b, "  ETA %s", formatDuration(left))
+	}
+	return b.String()
+}
+
+// draw redraws the terminal line in place.
+func (d *ProgressDisplay) draw(line string) {
+	pad := max(d.drawn-len(line), 0)
+	d.write("\r" + line + strings.Repeat(" ", pad))
+	d.drawn = len(line)
+}
+
+// finishLine writes a line that stays, over the terminal line if one is
+// drawn.
+func (d *ProgressDisplay) finishLine(line string) {
+	if d.Terminal && d.drawn > 0 {
+		d.draw(line)
+		d.drawn = 0
+		d.write("\n")
+		return
+	}
+	d.write(line + "\n")
+}
+
+// write writes to the output unless it is the transport. A failed write is
+// dropped: the display does not get to fail a transfer.
+func (d *ProgressDisplay) write(s string) {
+	if !d.checked {
+		d.checked = true
+		d.silent = d.Transport != nil && sameFile(d.w, d.Transport)
+	}
+	if !d.silent {
+		io.WriteString(d.w, s)
+	}
+}
+
+// isTerminal reports whether w is a character device.
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
+
+// sameFile reports whether w writes to the file t.
+func sameFile(w io.Writer, t *os.File) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	if f == t {
+		return true
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	ti, err := t.Stat()
+	return err == nil && os.SameFile(fi, ti)
+}
+
+// formatBytes formats a byte count in binary units: 512 B, 19.5 KiB.
+func formatBytes(n int64) string {
+	if n < 1024 {
+		return fmt.Sprintf("%d B", n)
+	}
+	v := float64(n) / 1024
+	for _, unit := range []string{"KiB", "MiB", "GiB"} {
+		if v < 1024 {
+			return fmt.Sprintf("%.1f %s", v, unit)
+		}
+		v /= 1024
+	}
+	return fmt.Sprintf("%.1f TiB", v)
+}
+
+// formatRate formats n bytes over elapsed as a rate.
+func formatRate(n int64, elapsed time.Duration) string {
+	if elapsed <= 0 {
+		return "- B/s"
+	}
+	return formatBytes(int64(float64(n)/elapsed.Seconds())) + "/s"
+}
+
+// formatDuration formats d to the second as m:ss, or h:mm:ss.
+func formatDuration(d time.Duration) string {
+	secs := int64(d.Round(time.Second) / time.Second)
+	if secs >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", secs/3600, secs/60%60, secs%60)
+	}
+	return fmt.Sprintf("%d:%02d", secs/60, secs%60)
+}
+
+func plural(n int, word string) string {
+	if n == 1 {
+		return word
+	}
+	return word + "s"
+}
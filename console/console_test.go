@@ -0,0 +1,309 @@
+package console
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	zmodem "github.com/xx25/go-zmodem"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// recorder is a FileHandler that logs every call it gets.
+type recorder struct {
+	calls  []string
+	offers []*zmodem.FileOffer
+	skip   map[string]bool
+}
+
+func (r *recorder) NextFile() *zmodem.FileOffer {
+	r.calls = append(r.calls, "NextFile")
+	if len(r.offers) == 0 {
+		return nil
+	}
+	offer := r.offers[0]
+	r.offers = r.offers[1:]
+	return offer
+}
+
+func (r *recorder) AcceptFile(info zmodem.FileInfo) (io.WriteCloser, int64, error) {
+	r.calls = append(r.calls, "AcceptFile "+info.Name)
+	if r.skip[info.Name] {
+		return nil, 0, zmodem.ErrSkip
+	}
+	return nopCloser{io.Discard}, 0, nil
+}
+
+func (r *recorder) FileProgress(info zmodem.FileInfo, n int64) {
+	r.calls = append(r.calls, fmt.Sprintf("FileProgress %s %d", info.Name, n))
+}
+
+func (r *recorder) FileCompleted(info zmodem.FileInfo, n int64, err error) {
+	r.calls = append(r.calls, fmt.Sprintf("FileCompleted %s %d %v", info.Name, n, err))
+}
+
+// progressRecorder also implements zmodem.ProgressHandler.
+type progressRecorder struct{ recorder }
+
+func (r *progressRecorder) TransferProgress(info zmodem.FileInfo, p zmodem.Progress) {
+	r.calls = append(r.calls, fmt.Sprintf("TransferProgress %s %+v", info.Name, p))
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// fakeClock is a clock the test moves by hand.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) now() time.Time          { return c.t }
+func (c *fakeClock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// batch plays a receive of three files through d: one that arrives, one
+// the handler skips and one that fails half way. Then a send of a file
+// resumed at 8 KiB.
+func batch(d *ProgressDisplay, clock *fakeClock) {
+	notes := zmodem.FileInfo{Name: "notes.bin", Size: 20000}
+	d.AcceptFile(notes)
+	for _, at := range []int64{1024, 2048, 4096, 8192, 12288, 16384, 20000} {
+		clock.advance(700 * time.Millisecond)
+		d.TransferProgress(notes, zmodem.Progress{Offset: at, SessionBytes: at})
+	}
+	clock.advance(50 * time.Millisecond)
+	d.FileCompleted(notes, 20000, nil)
+
+	dup := zmodem.FileInfo{Name: "dup.txt", Size: 5}
+	d.AcceptFile(dup)
+	d.FileCompleted(dup, 0, zmodem.ErrSkip)
+
+	big := zmodem.FileInfo{Name: "big.iso", Size: 3 << 30}
+	d.AcceptFile(big)
+	for i := range 4 {
+		clock.advance(5 * time.Second)
+		at := int64(i+1) * 50 << 20
+		d.TransferProgress(big, zmodem.Progress{Offset: at, SessionBytes: at})
+	}
+	d.FileCompleted(big, 200<<20, errors.New("zmodem: carrier lost"))
+
+	d.NextFile()
+	resumed := zmodem.FileInfo{Name: "resume.dat", Size: 32768}
+	for _, at := range []int64{16384, 24576, 32768} {
+		clock.advance(4 * time.Second)
+		d.TransferProgress(resumed, zmodem.Progress{Offset: at, StartOffset: 8192, SessionBytes: at - 8192})
+	}
+	d.FileCompleted(resumed, 32768, nil)
+	d.NextFile()
+	d.Finish()
+}
+
+// TestGolden checks the output of one batch, on a terminal and logged,
+// against testdata/*.golden; -update rewrites them.
+func TestGolden(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		terminal bool
+	}{
+		{"terminal", true},
+		{"log", false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var out bytes.Buffer
+			clock := &fakeClock{t: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+			h := &recorder{offers: []*zmodem.FileOffer{{Name: "resume.dat", Size: 32768}}}
+			d := NewProgressDisplay(&out, h)
+			d.now = clock.now
+			d.Terminal = tc.terminal
+			d.LogInterval = 3 * time.Second
+			batch(d, clock)
+
+			path := filepath.Join("testdata", tc.name+".golden")
+			if *update {
+				if err := os.WriteFile(path, out.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			want, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := out.String(); got != string(want) {
+				t.Errorf("got:\n%s\nwant:\n%s", strings.ReplaceAll(got, "\r", "\\r\n"), strings.ReplaceAll(string(want), "\r", "\\r\n"))
+			}
+		})
+	}
+}
+
+// TestDelegates: every call reaches the wrapped handler unchanged, progress
+// as TransferProgress when it implements ProgressHandler and as
+// FileProgress when it does not.
+func TestDelegates(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		progress string // the progress call the handler gets
+	}{
+		{"FileProgress", "FileProgress notes.bin 20000"},
+		{"TransferProgress", "TransferProgress notes.bin {Offset:20000 StartOffset:0 SessionBytes:20000}"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := &recorder{}
+			var h zmodem.FileHandler = rec
+			if tc.name == "TransferProgress" {
+				pr := &progressRecorder{}
+				h, rec = pr, &pr.recorder
+			}
+			rec.skip = map[string]bool{"dup.txt": true}
+
+			d := NewProgressDisplay(io.Discard, h)
+			notes := zmodem.FileInfo{Name: "notes.bin", Size: 20000}
+			d.AcceptFile(notes)
+			d.TransferProgress(notes, zmodem.Progress{Offset: 20000, SessionBytes: 20000})
+			d.FileCompleted(notes, 20000, nil)
+			dup := zmodem.FileInfo{Name: "dup.txt", Size: 5}
+			if _, _, err := d.AcceptFile(dup); !errors.Is(err, zmodem.ErrSkip) {
+				t.Fatalf("AcceptFile error %v, want the handler's ErrSkip", err)
+			}
+			d.FileCompleted(dup, 0, zmodem.ErrSkip)
+			d.NextFile()
+
+			want := []string{
+				"AcceptFile notes.bin",
+				tc.progress,
+				"FileCompleted notes.bin 20000 <nil>",
+				"AcceptFile dup.txt",
+				"FileCompleted dup.txt 0 " + zmodem.ErrSkip.Error(),
+				"NextFile",
+			}
+			if !slices.Equal(rec.calls, want) {
+				t.Fatalf("calls %q,\nwant %q", rec.calls, want)
+			}
+		})
+	}
+}
+
+// TestSilentOnTransport: a display writing to the file the transfer goes
+// over, under another name or not, writes nothing.
+func TestSilentOnTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "line")
+	transport, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+	other, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+
+	for _, w := range []*os.File{transport, other} {
+		d := NewProgressDisplay(w, &recorder{})
+		d.Transport = transport
+		notes := zmodem.FileInfo{Name: "notes.bin", Size: 10}
+		d.AcceptFile(notes)
+		d.FileCompleted(notes, 10, nil)
+		d.Finish()
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 0 {
+		t.Fatalf("display wrote %d bytes to the transport (%v)", fi.Size(), err)
+	}
+
+	var out bytes.Buffer
+	d := NewProgressDisplay(&out, &recorder{})
+	d.Transport = transport
+	d.Finish()
+	if out.Len() == 0 {
+		t.Fatal("display silent on an output that is not the transport")
+	}
+}
+
+// TestLoopback shows a real transfer: the Session's progress reaches the
+// display, and the file lines and summary are written.
+func TestLoopback(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	r1, w1, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, w2, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r1.Close()
+	defer r2.Close()
+	sendH := &recorder{offers: []*zmodem.FileOffer{{Name: "data.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}}
+	var out bytes.Buffer
+	d := NewProgressDisplay(&out, sendH)
+	d.LogInterval = time.Nanosecond // a line for every report
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer w1.Close()
+		sendErr = zmodem.NewSession(struct {
+			io.Reader
+			io.Writer
+		}{r2, w1}, d, nil).Send(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		defer w2.Close()
+		recvErr = zmodem.NewSession(struct {
+			io.Reader
+			io.Writer
+		}{r1, w2}, &recorder{}, nil).Receive(ctx)
+	}()
+	wg.Wait()
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+	d.Finish()
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	for _, re := range []string{
+		`^data\.bin +\d+%  [\d.]+ KiB/64\.0 KiB  .*/s`,
+		`^data\.bin  64\.0 KiB  .*/s  done in \d:\d\d$`,
+		`^1 file, 64\.0 KiB in \d:\d\d, .*/s$`,
+	} {
+		if !slices.ContainsFunc(lines, regexp.MustCompile(re).MatchString) {
+			t.Errorf("no line matches %s in:\n%s", re, out.String())
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	for _, tc := range []struct {
+		got, want string
+	}{
+		{formatBytes(0), "0 B"},
+		{formatBytes(1023), "1023 B"},
+		{formatBytes(1024), "1.0 KiB"},
+		{formatBytes(20000), "19.5 KiB"},
+		{formatBytes(3 << 30), "3.0 GiB"},
+		{formatBytes(5 << 40), "5.0 TiB"},
+		{formatRate(2048, time.Second), "2.0 KiB/s"},
+		{formatRate(2048, 0), "- B/s"},
+		{formatDuration(0), "0:00"},
+		{formatDuration(65*time.Second + 400*time.Millisecond), "1:05"},
+		{formatDuration(3*time.Hour + 2*time.Minute + time.Second), "3:02:01"},
+	} {
+		if tc.got != tc.want {
+			t.Errorf("got %q, want %q", tc.got, tc.want)
+		}
+	}
+}
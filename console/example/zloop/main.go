@@ -0,0 +1,127 @@
+// Command zloop sends files to itself over a pipe, paced like a modem line,
+// and shows the progress on stderr as a console.ProgressDisplay draws it.
+// The files are read but not written anywhere.
+//
+//	zloop -baud 115200 notes.txt data.bin
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	zmodem "github.com/xx25/go-zmodem"
+	"github.com/xx25/go-zmodem/console"
+)
+
+func main() {
+	baud := flag.Int("baud", 57600, "line `rate` to pace the transfer at, 0 for full speed")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: zloop [flags] file...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := loop(ctx, *baud, flag.Args()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func loop(ctx context.Context, baud int, paths []string) error {
+	sendR, sendW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	recvR, recvW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	send := &sender{paths: paths}
+	defer send.close()
+	display := console.NewProgressDisplay(os.Stderr, send)
+	sess := zmodem.NewSession(struct {
+		io.Reader
+		io.Writer
+	}{recvR, sendW}, display, &zmodem.Config{Use32BitCRC: true, EmulatedBaud: baud})
+
+	recvErr := make(chan error, 1)
+	go func() {
+		defer recvW.Close()
+		recvErr <- zmodem.NewSession(struct {
+			io.Reader
+			io.Writer
+		}{sendR, recvW}, discard{}, nil).Receive(ctx)
+	}()
+	err = sess.Send(ctx)
+	sendW.Close()
+	display.Finish()
+	return errors.Join(err, <-recvErr)
+}
+
+// sender offers the files named on the command line.
+type sender struct {
+	paths []string
+	open  *os.File
+}
+
+func (s *sender) NextFile() *zmodem.FileOffer {
+	s.close()
+	for len(s.paths) > 0 {
+		path := s.paths[0]
+		s.paths = s.paths[1:]
+		f, err := os.Open(path)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		fi, err := f.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			log.Printf("%s: not a regular file", path)
+			f.Close()
+			continue
+		}
+		s.open = f
+		return &zmodem.FileOffer{Name: filepath.Base(path), Size: fi.Size(), ModTime: fi.ModTime(), Reader: f}
+	}
+	return nil
+}
+
+func (s *sender) close() {
+	if s.open != nil {
+		s.open.Close()
+		s.open = nil
+	}
+}
+
+func (s *sender) AcceptFile(zmodem.FileInfo) (io.WriteCloser, int64, error) {
+	return nil, 0, zmodem.ErrSkip
+}
+func (s *sender) FileProgress(zmodem.FileInfo, int64)         {}
+func (s *sender) FileCompleted(zmodem.FileInfo, int64, error) {}
+
+// discard receives every file into nothing.
+type discard struct{}
+
+func (discard) NextFile() *zmodem.FileOffer { return nil }
+func (discard) AcceptFile(zmodem.FileInfo) (io.WriteCloser, int64, error) {
+	return nopCloser{io.Discard}, 0, nil
+}
+func (discard) FileProgress(zmodem.FileInfo, int64)         {}
+func (discard) FileCompleted(zmodem.FileInfo, int64, error) {}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
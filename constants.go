@@ -1,5 +1,7 @@
 package zmodem
 
+import "strconv"
+
 // Frame encoding types
 const (
 	ZPAD  = 0x2a // '*' — pad character, begins frames
@@ -87,6 +89,19 @@ const (
 	ESC8    = 0x80 // Expects 8th bit escaped
 )
 
+// canLargeBlocks is a ZRINIT ZF1 flag private to this library: the receiver
+// takes data subpackets up to maxLargeBlockSize (Config.LargeBlocks). No other
+// implementation sets it, and those that read ZF1 (lrzsz, for CANVHDR 0x01)
+// ignore the bits they do not know.
+const canLargeBlocks = 0x80
+
+// Block size limits: ZMODEM (ZedZap) tops out at 8 KB, and the large-block
+// extension at 64 KB.
+const (
+	maxBlockSize      = 8192
+	maxLargeBlockSize = 65536
+)
+
 // ZFILE conversion options (ZF0)
 const (
 	ZCBIN   = 1 // Binary transfer
@@ -132,12 +147,37 @@ type EscapeMode int
 const (
 	EscapeStandard EscapeMode = iota // Standard ZMODEM/ZedZap (default)
 	EscapeAll                        // Escape all control chars (hostile transports)
-	EscapeMinimal                    // DirZap: escape only ZDLE (0x18)
+	EscapeMinimal                    // DirZap: escape only ZDLE, XON and XOFF (and their 0x80 forms)
+)
+
+func (m EscapeMode) String() string {
+	switch m {
+	case EscapeStandard:
+		return "standard"
+	case EscapeAll:
+		return "all"
+	case EscapeMinimal:
+		return "minimal"
+	}
+	return "EscapeMode(" + strconv.Itoa(int(m)) + ")"
+}
+
+// SizeOverrunPolicy says what a receiver does with data a sender streams past
+// the size its ZFILE declared (a file that grew after it was offered, or a
+// peer that lies). Files offered without a size are exempt.
+type SizeOverrunPolicy int
+
+const (
+	OverrunTruncate SizeOverrunPolicy = iota // Write up to the declared size, discard the rest (default)
+	OverrunAccept                            // Write everything the sender sends
 )
 
 // CAN is the cancel character; 5 consecutive CANs abort a session.
 const CAN = 0x18
 
+// backspace follows the CANs of the abort sequence, erasing them on a terminal.
+const backspace = 0x08
+
 // abortSequence is 8x CAN + 10x BS per spec.
 var abortSequence = []byte{
 	0x18, 0x18, 0x18, 0x18, 0x18, 0x18, 0x18, 0x18,
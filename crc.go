@@ -70,6 +70,12 @@ func crc16Update(crc uint16, data []byte) uint16 {
 	return crc
 }
 
+// crc16UpdateByte is crc16Update for a single byte (a subpacket's end type),
+// without a slice to carry it.
+func crc16UpdateByte(crc uint16, b byte) uint16 {
+	return updcrc16(b, crc)
+}
+
 // crc16Finalize applies the two-zero-byte finalization to a running CRC-16.
 func crc16Finalize(crc uint16) uint16 {
 	return updcrc16(0, updcrc16(0, crc))
@@ -96,6 +102,14 @@ func crc32Update(crc uint32, data []byte) uint32 {
 	return crc32.Update(crc, crc32.IEEETable, data)
 }
 
+// crc32UpdateByte is crc32Update for a single byte, without a slice to carry
+// it: the IEEE table step between the pre- and post-inversion crc32.Update
+// applies.
+func crc32UpdateByte(crc uint32, b byte) uint32 {
+	crc = ^crc
+	return ^(crc32.IEEETable[byte(crc)^b] ^ crc>>8)
+}
+
 // crc32VerifyMagic is the expected result when feeding data+CRC32 through crc32.ChecksumIEEE.
 // lrzsz checks raw CRC against 0xDEBB20E3 (no final XOR). Go's ChecksumIEEE applies
 // final XOR (^0xFFFFFFFF), so the magic becomes 0xDEBB20E3 ^ 0xFFFFFFFF = 0x2144DF1C.
@@ -2,6 +2,7 @@ package zmodem
 
 import (
 	"encoding/binary"
+	"math/rand/v2"
 	"testing"
 )
 
@@ -76,3 +77,89 @@ func TestCRC32Incremental(t *testing.T) {
 		t.Errorf("incremental CRC-32 mismatch: got 0x%08x, want 0x%08x", crc, expected)
 	}
 }
+
+func TestCRCUpdateByte(t *testing.T) {
+	data := []byte("Hello, ZMODEM!\x00\x18\xff")
+	var c16 uint16
+	var c32 uint32
+	for i, b := range data {
+		c16 = crc16UpdateByte(c16, b)
+		c32 = crc32UpdateByte(c32, b)
+		if want := crc16Update(0, data[:i+1]); c16 != want {
+			t.Fatalf("crc16UpdateByte after %d bytes = 0x%04x, want 0x%04x", i+1, c16, want)
+		}
+		if want := crc32Update(0, data[:i+1]); c32 != want {
+			t.Fatalf("crc32UpdateByte after %d bytes = 0x%08x, want 0x%08x", i+1, c32, want)
+		}
+	}
+}
+
+// updcrc16Bitwise is Forsberg's original bit-at-a-time updcrc, the reference
+// the lrzsz table formula in updcrc16 replaces.
+func updcrc16Bitwise(c byte, crc uint16) uint16 {
+	cc := uint16(c)
+	for range 8 {
+		cc <<= 1
+		top := crc & 0x8000
+		crc = crc<<1 | cc>>8&1
+		if top != 0 {
+			crc ^= 0x1021
+		}
+	}
+	return crc
+}
+
+func TestCRC16TableMatchesBitwise(t *testing.T) {
+	for crc := range 1 << 16 {
+		for _, b := range []byte{0x00, 0x01, 0x18, 0x7f, 0x80, 0xa5, 0xff} {
+			if got, want := updcrc16(b, uint16(crc)), updcrc16Bitwise(b, uint16(crc)); got != want {
+				t.Fatalf("updcrc16(0x%02x, 0x%04x) = 0x%04x, bitwise 0x%04x", b, crc, got, want)
+			}
+		}
+	}
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 200 {
+		data := make([]byte, rng.IntN(1024))
+		for i := range data {
+			data[i] = byte(rng.Uint32())
+		}
+		var want uint16
+		for _, b := range data {
+			want = updcrc16Bitwise(b, want)
+		}
+		want = updcrc16Bitwise(0, updcrc16Bitwise(0, want))
+		if got := crc16Calc(data); got != want {
+			t.Fatalf("crc16Calc over %d bytes = 0x%04x, bitwise 0x%04x", len(data), got, want)
+		}
+		if !crc16Verify(appendCRC16(data, want)) {
+			t.Fatalf("crc16Verify rejects a bitwise CRC over %d bytes", len(data))
+		}
+	}
+}
+
+// crc16Data is an 8 KB subpacket's worth of data for the CRC benchmarks.
+func crc16Data(b *testing.B) []byte {
+	data := make([]byte, 8192)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	b.SetBytes(int64(len(data)))
+	return data
+}
+
+func BenchmarkCRC16(b *testing.B) {
+	data := crc16Data(b)
+	for b.Loop() {
+		crc16Update(0, data)
+	}
+}
+
+func BenchmarkCRC16Bitwise(b *testing.B) {
+	data := crc16Data(b)
+	for b.Loop() {
+		var crc uint16
+		for _, c := range data {
+			crc = updcrc16Bitwise(c, crc)
+		}
+	}
+}
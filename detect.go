@@ -0,0 +1,133 @@
+package zmodem
+
+import (
+	"bytes"
+)
+
+// hexHeaderStart opens every hex header after its first ZPAD.
+var hexHeaderStart = []byte{ZPAD, ZDLE, ZHEX}
+
+// hexHeaderDigits is the length of a hex header's digits: type, four data
+// bytes and the CRC-16.
+const hexHeaderDigits = 14
+
+// Detection is a ZMODEM session start found by a Detector.
+type Detection struct {
+	// Type is the announcing header's: ZRQINIT from a sender (sz), which
+	// wants us to receive, or ZRINIT from a receiver (rz), which wants files.
+	Type byte
+	// Offset is the position in the stream, counting every byte written to
+	// the Detector, of the header's first ZPAD. The rz\r trigger sz sends in
+	// front of it is not part of the session.
+	Offset int64
+	// Data holds the stream from Offset on: the header and whatever followed
+	// it in the writes so far. It belongs to the ZMODEM session and is to be
+	// read by the Session before the rest of the transport, as in
+	// io.MultiReader(bytes.NewReader(d.Data), conn).
+	Data []byte
+}
+
+// Detector spots the start of a ZMODEM session in an interactive byte stream
+// — a terminal or telnet session passing through a proxy, say — so the
+// connection can be handed to a Session. Feed it the stream with Write, in
+// pieces of any size; it holds back nothing and changes nothing, only
+// watching for a ZRQINIT or ZRINIT hex header. A header counts only when its
+// CRC is right, so runs of '*' in ANSI art or a shell that echoes "rz" do
+// not set it off.
+//
+// Once a header is found, every later Write is added to the Detection's
+// Data, until Reset.
+type Detector struct {
+	onDetect func(Detection)
+	held     []byte // the stream's tail that may start a header
+	offset   int64  // bytes written before held[0]
+	found    bool
+	det      Detection
+}
+
+// NewDetector returns a Detector that calls onDetect, if it is not nil, from
+// the Write that completes an announcement.
+func NewDetector(onDetect func(Detection)) *Detector {
+	return &Detector{onDetect: onDetect}
+}
+
+// Write scans p for an announcement. It never fails.
+func (d *Detector) Write(p []byte) (int, error) {
+	if d.found {
+		d.det.Data = append(d.det.Data, p...)
+		return len(p), nil
+	}
+	d.held = append(d.held, p...)
+	for i := 0; ; {
+		j := bytes.Index(d.held[i:], hexHeaderStart)
+		if j < 0 {
+			// Keep what could begin a header, and a ZPAD before it.
+			d.keep(max(len(d.held)-len(hexHeaderStart), 0))
+			break
+		}
+		j += i
+		end := j + len(hexHeaderStart) + hexHeaderDigits
+		if end > len(d.held) {
+			d.keep(max(j-1, 0))
+			break
+		}
+		if typ, ok := parseAnnouncement(d.held[j+len(hexHeaderStart) : end]); ok {
+			start := j
+			if j > 0 && d.held[j-1] == ZPAD {
+				start--
+			}
+			d.found = true
+			d.det = Detection{Type: typ, Offset: d.offset + int64(start), Data: bytes.Clone(d.held[start:])}
+			d.held = nil
+			if d.onDetect != nil {
+				d.onDetect(d.det)
+			}
+			break
+		}
+		i = j + 1
+	}
+	return len(p), nil
+}
+
+// keep drops held[:n].
+func (d *Detector) keep(n int) {
+	d.offset += int64(n)
+	d.held = append(d.held[:0], d.held[n:]...)
+}
+
+// Detected returns the announcement found, if there is one.
+func (d *Detector) Detected() (Detection, bool) {
+	return d.det, d.found
+}
+
+// Reset forgets any announcement found, to watch the stream again after the
+// session it started. The stream offset keeps counting.
+func (d *Detector) Reset() {
+	if d.found {
+		d.offset = d.det.Offset + int64(len(d.det.Data))
+	}
+	d.found = false
+	d.det = Detection{}
+	d.held = d.held[:0]
+}
+
+// parseAnnouncement decodes the digits of a hex header, reporting its type if
+// it is a ZRQINIT or ZRINIT with a good CRC.
+func parseAnnouncement(digits []byte) (byte, bool) {
+	var raw [hexHeaderDigits / 2]byte
+	for i := range raw {
+		hi, ok1 := hexVal(digits[2*i])
+		lo, ok2 := hexVal(digits[2*i+1])
+		if !ok1 || !ok2 {
+			return 0, false
+		}
+		raw[i] = hi<<4 | lo
+	}
+	if raw[0] != ZRQINIT && raw[0] != ZRINIT {
+		return 0, false
+	}
+	if !crc16Verify(raw[:]) {
+		return 0, false
+	}
+	return raw[0], true
+}
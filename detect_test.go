@@ -0,0 +1,161 @@
+package zmodem
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Terminal sessions as a proxy sees them, server to client.
+const (
+	// lrzsz sz: the shell echoes the command, then sz sends rz\r and its
+	// ZRQINIT, ended CR, LF with the high bit set, XON.
+	termSz = "user@host:~$ sz notes.txt\r\n" +
+		"rz\r**\x18B00000000000000\r\x8a\x11"
+	// lrzsz rz: its banner, then ZRINIT offering CANFDX|CANOVIO|CANFC32.
+	termRz = "user@host:~$ rz\r\n" +
+		"rz waiting to receive.**\x18B0100000023be50\r\x8a\x11"
+	// A BBS menu drawn with ANSI colour and runs of '*'.
+	termANSIArt = "\x1b[2J\x1b[1;33m********************************\r\n" +
+		"\x1b[1;36m**\x1b[0m  WELCOME TO THE BOARD  \x1b[1;36m**\r\n" +
+		"***\x18\x1b[0m *B* ***B00000000000000\r\n" +
+		"\x1b[1;33m********************************\x1b[0m\r\n" +
+		"Select: "
+)
+
+func TestDetectorAnnouncements(t *testing.T) {
+	tests := []struct {
+		name   string
+		stream string
+		typ    byte
+		at     int // offset of the header's first ZPAD
+	}{
+		{"sz", termSz, ZRQINIT, strings.Index(termSz, "**")},
+		{"rz", termRz, ZRINIT, strings.Index(termRz, "**")},
+		{"after ANSI art", termANSIArt + termSz, ZRQINIT, len(termANSIArt) + strings.Index(termSz, "**")},
+		{"uppercase digits", "C:\\>DSZ sz FILE.ZIP\r\n*\x18B0100000023BE50\r", ZRINIT, len("C:\\>DSZ sz FILE.ZIP\r\n")},
+		{"after ZPAD run", "*****\x18B00000000000000\r\n", ZRQINIT, 3},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			// Every way of cutting the stream in two, and byte by byte.
+			var splits [][]string
+			for i := 0; i <= len(tc.stream); i++ {
+				splits = append(splits, []string{tc.stream[:i], tc.stream[i:]})
+			}
+			splits = append(splits, strings.Split(tc.stream, ""))
+			for _, parts := range splits {
+				var calls int
+				d := NewDetector(func(Detection) { calls++ })
+				for _, part := range parts {
+					if n, err := d.Write([]byte(part)); n != len(part) || err != nil {
+						t.Fatalf("Write = %d, %v", n, err)
+					}
+				}
+				det, ok := d.Detected()
+				if !ok || calls != 1 {
+					t.Fatalf("split %q: detected %v, %d callbacks", parts[0], ok, calls)
+				}
+				if det.Type != tc.typ || det.Offset != int64(tc.at) {
+					t.Fatalf("split %q: got %s at %d, want %s at %d", parts[0],
+						frameTypeName(det.Type), det.Offset, frameTypeName(tc.typ), tc.at)
+				}
+				if want := tc.stream[tc.at:]; string(det.Data) != want {
+					t.Fatalf("split %q: Data = %q, want %q", parts[0], det.Data, want)
+				}
+			}
+		})
+	}
+}
+
+func TestDetectorDecoys(t *testing.T) {
+	for name, stream := range map[string]string{
+		"ANSI art":       termANSIArt,
+		"rz echoed":      "user@host:~$ rz\r\nbash: rz: command not found\r\n",
+		"bad CRC":        "**\x18B00000000000001\r\n",
+		"not hex":        "**\x18B00000000zz0000\r\n",
+		"other frame":    "**\x18B0800000000022d\r\n", // ZFIN, good CRC
+		"truncated":      "**\x18B0100000023be",
+		"binary ZRQINIT": "*\x18A\x00\x00\x00\x00\x00\x00\x00",
+	} {
+		t.Run(name, func(t *testing.T) {
+			d := NewDetector(func(Detection) { t.Fatal("callback called") })
+			d.Write([]byte(stream))
+			if det, ok := d.Detected(); ok {
+				t.Fatalf("detected %s at %d", frameTypeName(det.Type), det.Offset)
+			}
+		})
+	}
+}
+
+// TestDetectorAfterDetection: once an announcement is found, later writes
+// belong to the session; Reset watches the stream again, offsets running on.
+func TestDetectorAfterDetection(t *testing.T) {
+	d := NewDetector(nil)
+	d.Write([]byte(termSz))
+	d.Write([]byte("*\x18C\x0a"))
+	det, _ := d.Detected()
+	if want := termSz[det.Offset:] + "*\x18C\x0a"; string(det.Data) != want {
+		t.Fatalf("Data = %q, want %q", det.Data, want)
+	}
+
+	d.Reset()
+	if _, ok := d.Detected(); ok {
+		t.Fatal("still detected after Reset")
+	}
+	before := len(termSz) + 4
+	d.Write([]byte(termRz))
+	det, ok := d.Detected()
+	if !ok || det.Type != ZRINIT {
+		t.Fatalf("second announcement: %v, %s", ok, frameTypeName(det.Type))
+	}
+	if want := int64(before + strings.Index(termRz, "**")); det.Offset != want {
+		t.Fatalf("second Offset = %d, want %d", det.Offset, want)
+	}
+}
+
+// TestDetectorHandsOverToAuto: the detected bytes, read before the rest of
+// the connection, start a session that Auto answers.
+func TestDetectorHandsOverToAuto(t *testing.T) {
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+	content := []byte("handed over by the detector")
+	senderHandler := newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{{Name: "det.txt", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	sender := NewSession(senderT, senderHandler, &Config{Logger: discardLogger()})
+
+	sendErr := make(chan error, 1)
+	go func() {
+		defer senderClose()
+		sendErr <- sender.Send(t.Context())
+	}()
+
+	// The proxy reads the sender's output until the detector fires.
+	d := NewDetector(nil)
+	buf := make([]byte, 64)
+	for {
+		n, err := receiverT.Read(buf)
+		if err != nil {
+			t.Fatalf("read before detection: %v", err)
+		}
+		d.Write(buf[:n])
+		if _, ok := d.Detected(); ok {
+			break
+		}
+	}
+	det, _ := d.Detected()
+	handler := newTestHandler()
+	conn := &pipeReadWriter{Reader: io.MultiReader(bytes.NewReader(det.Data), receiverT), Writer: receiverT}
+	auto := NewSession(conn, handler, &Config{Logger: discardLogger()})
+	err := auto.Auto(t.Context())
+	receiverClose()
+	if err != nil {
+		t.Fatalf("Auto: %v", err)
+	}
+	if err := <-sendErr; err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if got := handler.receivedFiles["det.txt"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("det.txt not received intact")
+	}
+}
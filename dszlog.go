@@ -0,0 +1,81 @@
+package zmodem
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+)
+
+// DSZLOG status letters, the first field of a DSZLOG line. A file
+// transferred whole is logged with the protocol's letter, upper case for a
+// receive (an upload to the BBS) and lower case for a send (a download); BBS
+// software credits it to the matching side of the caller's ratio. A file
+// logged with E or L is not credited.
+const (
+	dszReceived = 'Z' // the file was received whole
+	dszSent     = 'z' // the file was sent whole
+	dszErr      = 'E' // the transfer failed, or the file was skipped
+	dszLost     = 'L' // the connection was lost
+)
+
+// logDSZ writes a file's DSZLOG line to Config.DSZLog, if set.
+func (s *Session) logDSZ(info FileInfo, n int64, err error, elapsed time.Duration) {
+	if s.cfg.DSZLog == nil {
+		return
+	}
+	if _, werr := io.WriteString(s.cfg.DSZLog, s.dszLine(info, n, err, elapsed)); werr != nil {
+		s.logger.Warn("writing DSZLOG", "err", werr)
+	}
+}
+
+// dszLine formats a file's DSZLOG line, as DSZ appends one to the file its
+// DSZLOG environment variable names:
+//
+//	Z  46532  2400 bps  239 cps   0 errors     0 1024 DSZ.ZIP -1
+//
+// The fields are the status letter (by the session's direction, see
+// dszReceived); the bytes the file ended at; the line
+// rate (Config.EmulatedBaud, or ten bits a byte of the measured rate when it
+// is not set); the characters per second moved in this session; the error
+// recoveries (ZRPOS) during the file; the XOFF pauses; the last data block's
+// length; the file's name as sent; and the sender's serial number, which
+// ZMODEM does not carry (-1).
+func (s *Session) dszLine(info FileInfo, n int64, err error, elapsed time.Duration) string {
+	status := byte(dszReceived)
+	switch {
+	case err == nil:
+		if s.logRun.role == roleSend {
+			status = dszSent
+		}
+	case isLostConnection(err):
+		status = dszLost
+	default:
+		status = dszErr
+	}
+	moved := s.fileMoved(n, err)
+	var cps int64
+	if secs := elapsed.Seconds(); secs > 0 {
+		cps = int64(float64(moved) / secs)
+	} else {
+		cps = moved
+	}
+	bps := int64(s.cfg.EmulatedBaud)
+	if bps <= 0 {
+		bps = cps * 10
+	}
+	var xoffs int64
+	if s.flow != nil {
+		xoffs = s.flow.pauses.Load() - s.fileXoffs
+	}
+	return fmt.Sprintf("%c %6d %5d bps %4d cps %3d errors %5d %4d %s -1\n",
+		status, n, bps, cps, s.fileErrors, xoffs, s.blockLen, info.Name)
+}
+
+// isLostConnection reports whether err is the transport going away rather
+// than the transfer failing over it.
+func isLostConnection(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) || errors.Is(err, net.ErrClosed)
+}
@@ -0,0 +1,150 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestDSZLine checks each field of the line and the spacing between them,
+// for files received unless role says otherwise.
+func TestDSZLine(t *testing.T) {
+	tests := []struct {
+		name     string
+		role     string
+		baud     int
+		start    int64 // resume offset
+		n        int64
+		errs     int
+		block    int
+		elapsed  time.Duration
+		err      error
+		fileName string
+		want     string
+	}{
+		{"slow line", "", 2400, 0, 46532, 0, 1024, 46532 * time.Second / 239, nil, "DSZ.ZIP",
+			"Z  46532  2400 bps  239 cps   0 errors     0 1024 DSZ.ZIP -1\n"},
+		{"measured rate", "", 0, 0, 1 << 20, 3, 8192, 2 * time.Second, nil, "big.bin",
+			"Z 1048576 5242880 bps 524288 cps   3 errors     0 8192 big.bin -1\n"},
+		{"resumed", "", 0, 1000, 3000, 0, 1024, time.Second, nil, "resume.dat",
+			"Z   3000 20000 bps 2000 cps   0 errors     0 1024 resume.dat -1\n"},
+		{"skipped", "", 0, 0, 0, 0, 0, time.Second, ErrSkip, "dup.txt",
+			"E      0     0 bps    0 cps   0 errors     0    0 dup.txt -1\n"},
+		{"skipped by remote", "", 0, 0, 0, 0, 0, time.Second, ErrSkippedByRemote, "dup.txt",
+			"E      0     0 bps    0 cps   0 errors     0    0 dup.txt -1\n"},
+		{"failed", "", 9600, 0, 5120, 10, 256, 10 * time.Second, errors.New("zmodem: max retries exceeded during data transfer"), "noisy.txt",
+			"E   5120  9600 bps  512 cps  10 errors     0  256 noisy.txt -1\n"},
+		{"sent", roleSend, 0, 0, 4096, 0, 1024, time.Second, nil, "down.zip",
+			"z   4096 40960 bps 4096 cps   0 errors     0 1024 down.zip -1\n"},
+		{"send failed", roleSend, 0, 0, 1024, 0, 1024, time.Second, ErrLocalAbort, "down.zip",
+			"E   1024 10240 bps 1024 cps   0 errors     0 1024 down.zip -1\n"},
+		{"carrier lost", "", 0, 0, 2048, 1, 1024, time.Second, fmt.Errorf("zmodem: recvHeader: %w", io.EOF), "cut.bin",
+			"L   2048 20480 bps 2048 cps   1 errors     0 1024 cut.bin -1\n"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := NewSession(&pipeReadWriter{}, newTestHandler(), &Config{EmulatedBaud: tc.baud})
+			s.logRun.role = tc.role
+			s.fileStart = tc.start
+			s.fileErrors = tc.errs
+			s.blockLen = tc.block
+			got := s.dszLine(FileInfo{Name: tc.fileName}, tc.n, tc.err, tc.elapsed)
+			if got != tc.want {
+				t.Fatalf("got  %q\nwant %q", got, tc.want)
+			}
+		})
+	}
+}
+
+// TestDSZLogSession: both ends of a batch log a line per file, with the
+// status letter of their direction, and the size and block length the
+// transfer had.
+func TestDSZLogSession(t *testing.T) {
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+	small := []byte("a small file")
+	big := randomContent(10000)
+	senderHandler := newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{
+		{Name: "small.txt", Size: int64(len(small)), Reader: bytes.NewReader(small)},
+		{Name: "skip.txt", Size: 5, Reader: strings.NewReader("skip!")},
+		{Name: "big.bin", Size: int64(len(big)), Reader: bytes.NewReader(big)},
+	}
+	receiverHandler := newTestHandler()
+	receiverHandler.skipFiles = map[string]bool{"skip.txt": true}
+
+	var sendLog, recvLog bytes.Buffer
+	sender := NewSession(senderT, senderHandler,
+		&Config{Use32BitCRC: true, MaxBlockSize: 1024, DSZLog: &sendLog, Logger: discardLogger()})
+	receiver := NewSession(receiverT, receiverHandler,
+		&Config{Use32BitCRC: true, DSZLog: &recvLog, Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer senderClose()
+		sendErr = sender.Send(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		defer receiverClose()
+		recvErr = receiver.Receive(ctx)
+	}()
+	wg.Wait()
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+
+	want := []struct {
+		status byte
+		size   int64
+		block  int
+		name   string
+	}{
+		{'Z', int64(len(small)), len(small), "small.txt"},
+		{'E', 0, 0, "skip.txt"},
+		{'Z', int64(len(big)), 1024, "big.bin"},
+	}
+	for side, log := range map[string]string{"sender": sendLog.String(), "receiver": recvLog.String()} {
+		// The receiver logs an upload, the sender a download.
+		ok := byte('Z')
+		if side == "sender" {
+			ok = 'z'
+		}
+		lines := strings.Split(strings.TrimSuffix(log, "\n"), "\n")
+		if len(lines) != len(want) {
+			t.Fatalf("%s logged %d lines, want %d:\n%s", side, len(lines), len(want), log)
+		}
+		for i, line := range lines {
+			var status byte
+			var size, bps, cps int64
+			var errs, xoffs, block, serial int
+			var name string
+			if _, err := fmt.Sscanf(line, "%c %d %d bps %d cps %d errors %d %d %s %d",
+				&status, &size, &bps, &cps, &errs, &xoffs, &block, &name, &serial); err != nil {
+				t.Fatalf("%s line %q: %v", side, line, err)
+			}
+			w := want[i]
+			if w.status == 'Z' {
+				w.status = ok
+			}
+			if status != w.status || size != w.size || name != w.name || errs != 0 || serial != -1 {
+				t.Errorf("%s line %q: want %c %d ... %s", side, line, w.status, w.size, w.name)
+			}
+			// The sender's last block of big.bin is its short tail, the
+			// receiver's too; small.txt is one block either way.
+			if w.name != "big.bin" && block != w.block {
+				t.Errorf("%s line %q: block %d, want %d", side, line, block, w.block)
+			}
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"context"
 	"errors"
+	"sync"
 	"testing"
 	"time"
 )
@@ -254,3 +255,62 @@ func TestReceiverFailsFastOnEOFBelowOffsetWhenSizeUnknown(t *testing.T) {
 		t.Fatalf("FileCompleted err = %v, want errOverwritePastEOF", e)
 	}
 }
+
+// TestLoopbackSizeOverrun: an offer whose Reader yields more than its Size (a
+// file that grew after it was offered) completes on the receiver with
+// ErrSizeOverrun, holding the declared size under OverrunTruncate and all of
+// it under OverrunAccept. A file without a size is exempt.
+func TestLoopbackSizeOverrun(t *testing.T) {
+	const size = 5000
+	content := randomContent(size + 3000)
+	for _, tc := range []struct {
+		name     string
+		policy   SizeOverrunPolicy
+		declared int64
+		wantLen  int
+		overrun  bool
+	}{
+		{"truncate", OverrunTruncate, size, size, true},
+		{"accept", OverrunAccept, size, len(content), true},
+		{"unknown size", OverrunTruncate, 0, len(content), false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			senderT, receiverT, senderClose, receiverClose := newTestTransports()
+			sh := newTestHandler()
+			sh.filesToSend = []*FileOffer{
+				{Name: "grown.log", Size: tc.declared, Reader: bytes.NewReader(content)},
+				{Name: "next.txt", Size: 4, Reader: bytes.NewReader([]byte("next"))},
+			}
+			rh := newTestHandler()
+			sender := NewSession(senderT, sh, &Config{Logger: discardLogger()})
+			receiver := NewSession(receiverT, rh, &Config{SizeOverrunPolicy: tc.policy, Logger: discardLogger()})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			var wg sync.WaitGroup
+			var sendErr, recvErr error
+			wg.Add(2)
+			go func() { defer wg.Done(); defer senderClose(); sendErr = sender.Send(ctx) }()
+			go func() { defer wg.Done(); defer receiverClose(); recvErr = receiver.Receive(ctx) }()
+			wg.Wait()
+
+			if sendErr != nil || recvErr != nil {
+				t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+			}
+			got := rh.receivedFiles["grown.log"]
+			if got == nil || !bytes.Equal(got.Bytes(), content[:tc.wantLen]) {
+				t.Fatalf("grown.log: received %d bytes, want the first %d sent", got.Len(), tc.wantLen)
+			}
+			err := rh.completedFiles["grown.log"]
+			if tc.overrun && !errors.Is(err, ErrSizeOverrun) {
+				t.Fatalf("FileCompleted(grown.log) = %v, want ErrSizeOverrun", err)
+			}
+			if !tc.overrun && err != nil {
+				t.Fatalf("FileCompleted(grown.log) = %v, want nil", err)
+			}
+			if err, ok := rh.completedFiles["next.txt"]; !ok || err != nil {
+				t.Fatalf("FileCompleted(next.txt) = %v (reported %v), want nil", err, ok)
+			}
+		})
+	}
+}
@@ -7,13 +7,36 @@ const (
 	escIfAtCR = 2 // escape only if preceded by '@' (CR protection)
 )
 
+// escapeTables holds the lookup table for each EscapeMode, built once at
+// init: switching a writer's mode repoints it at another table instead of
+// rebuilding one, which may happen mid-session (ZSINIT, ESCCTL).
+var escapeTables = [...][256]byte{
+	EscapeStandard: buildEscapeTable(EscapeStandard),
+	EscapeAll:      buildEscapeTable(EscapeAll),
+	EscapeMinimal:  buildEscapeTable(EscapeMinimal),
+}
+
+// escapeTableFor returns the shared table for mode. Like buildEscapeTable it
+// treats an unknown mode as EscapeStandard. The table must not be modified.
+func escapeTableFor(mode EscapeMode) *[256]byte {
+	if mode < 0 || int(mode) >= len(escapeTables) {
+		mode = EscapeStandard
+	}
+	return &escapeTables[mode]
+}
+
 // buildEscapeTable builds the ZDLE escape lookup table for the given mode.
 func buildEscapeTable(mode EscapeMode) [256]byte {
 	var table [256]byte
 
 	if mode == EscapeMinimal {
-		// DirZap: escape only ZDLE itself
-		table[ZDLE] = escMust // 0x18
+		// DirZap: ZDLE itself, and the flow-control bytes, which are never
+		// safe on a path a modem or terminal server may flow-control. All
+		// in both parities.
+		for _, b := range []byte{ZDLE, XON, XOFF} {
+			table[b] = escMust
+			table[b|0x80] = escMust
+		}
 		return table
 	}
 
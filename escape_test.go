@@ -1,7 +1,14 @@
 package zmodem
 
 import (
+	"bytes"
+	"context"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestBuildEscapeTable(t *testing.T) {
@@ -53,14 +60,17 @@ func TestBuildEscapeTableAll(t *testing.T) {
 func TestBuildEscapeTableMinimal(t *testing.T) {
 	table := buildEscapeTable(EscapeMinimal)
 
-	// Only ZDLE should be escMust
-	if table[ZDLE] != escMust {
-		t.Errorf("ZDLE (0x18) should be escMust, got %d", table[ZDLE])
+	// ZDLE, XON and XOFF, in both parities, are escMust
+	must := []byte{ZDLE, XON, XOFF, ZDLE | 0x80, XON | 0x80, XOFF | 0x80}
+	for _, b := range must {
+		if table[b] != escMust {
+			t.Errorf("byte 0x%02x should be escMust in minimal mode, got %d", b, table[b])
+		}
 	}
 
 	// Everything else should be escSend (no escaping)
 	for i := 0; i < 256; i++ {
-		if byte(i) == ZDLE {
+		if bytes.IndexByte(must, byte(i)) >= 0 {
 			continue
 		}
 		if table[i] != escSend {
@@ -109,3 +119,271 @@ func TestEscapeRoundTrip(t *testing.T) {
 		}
 	}
 }
+
+func TestEscapeTablesShared(t *testing.T) {
+	for _, mode := range []EscapeMode{EscapeStandard, EscapeAll, EscapeMinimal} {
+		if *escapeTableFor(mode) != buildEscapeTable(mode) {
+			t.Errorf("mode %d: cached table differs from a fresh build", mode)
+		}
+	}
+	if escapeTableFor(EscapeMode(7)) != escapeTableFor(EscapeStandard) {
+		t.Error("unknown mode should use the standard table")
+	}
+
+	tw := newTransportWriter(&bytes.Buffer{}, EscapeStandard)
+	if n := testing.AllocsPerRun(100, func() {
+		tw.setEscapeMode(EscapeAll)
+		tw.setEscapeMode(EscapeStandard)
+	}); n != 0 {
+		t.Errorf("%v allocations per mode switch", n)
+	}
+}
+
+// TestEscapeModeToggledBetweenSubpackets switches mode before every subpacket
+// of a stream and checks each decodes intact and is escaped as its own mode
+// requires. The reader keeps raw XON/XOFF as data, as EscapeMinimal's does.
+func TestEscapeModeToggledBetweenSubpackets(t *testing.T) {
+	var buf bytes.Buffer
+	s := &Session{
+		tw:       newTransportWriter(&buf, EscapeStandard),
+		tr:       newTransportReader(&buf, 1200, 0, false, slog.Default()),
+		logger:   slog.Default(),
+		useCRC32: true,
+	}
+	rng := rand.New(rand.NewPCG(11, 12))
+	modes := []EscapeMode{EscapeStandard, EscapeAll, EscapeMinimal, EscapeAll}
+	for i := range 300 {
+		mode := modes[i%len(modes)]
+		data := make([]byte, 64+rng.IntN(512))
+		for j := range data {
+			data[j] = byte(rng.Uint32())
+		}
+		data = append(data, '@', '\r', 0xc0, 0x8d)
+
+		s.tw.setEscapeMode(mode)
+		if err := s.sendSubpacket(data, ZCRCG); err != nil {
+			t.Fatal(err)
+		}
+		if mode == EscapeAll {
+			// CR keeps its escape-after-'@' rule in every mode.
+			for _, b := range buf.Bytes() {
+				if b < 0x20 && b != ZDLE && b != '\r' {
+					t.Fatalf("subpacket %d: raw control byte 0x%02x under EscapeAll", i, b)
+				}
+			}
+		}
+		got, end, err := s.recvSubpacket(1024)
+		if err != nil || end != ZCRCG || !bytes.Equal(got, data) {
+			t.Fatalf("subpacket %d (mode %d): got %d bytes end 0x%02x, %v; want %d bytes back",
+				i, mode, len(got), end, err, len(data))
+		}
+	}
+}
+
+func TestEscapeModeSwitchKeepsLastSent(t *testing.T) {
+	var buf bytes.Buffer
+	tw := newTransportWriter(&buf, EscapeMinimal)
+	tw.writeEscaped([]byte("@"))
+	tw.setEscapeMode(EscapeStandard)
+	tw.writeEscapedByte('\r')
+	tw.w.Flush()
+	if want := []byte{'@', ZDLE, '\r' ^ 0x40}; !bytes.Equal(buf.Bytes(), want) {
+		t.Fatalf("wire = % x, want % x (CR after '@' escaped across the switch)", buf.Bytes(), want)
+	}
+}
+
+func BenchmarkSetEscapeMode(b *testing.B) {
+	tw := newTransportWriter(&bytes.Buffer{}, EscapeStandard)
+	for b.Loop() {
+		tw.setEscapeMode(EscapeAll)
+		tw.setEscapeMode(EscapeStandard)
+	}
+}
+
+// teeWriter copies everything written to w into log.
+type teeWriter struct {
+	w   io.Writer
+	mu  sync.Mutex
+	log bytes.Buffer
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	t.log.Write(p)
+	t.mu.Unlock()
+	return t.w.Write(p)
+}
+
+// TestLoopbackEscapeModes sends every byte value in each escape mode, with an
+// attention sequence so the ZSINIT subpacket goes out under its temporary
+// EscapeAll. The sender's wire must follow the mode's table: in every mode
+// flow-control bytes appear raw only as framing, and under EscapeAll no
+// other control byte appears raw either. (The XON that follows a hex header or a ZCRCW
+// subpacket is framing, not data.)
+func TestLoopbackEscapeModes(t *testing.T) {
+	var content []byte
+	for range 32 {
+		for b := range 256 {
+			content = append(content, byte(b))
+		}
+	}
+	attn := []byte{0x05}
+	for _, mode := range []EscapeMode{EscapeStandard, EscapeAll, EscapeMinimal} {
+		r1, w1 := bufferedPipe(256)
+		r2, w2 := bufferedPipe(256)
+		wire := &teeWriter{w: w1}
+		sh := newTestHandler()
+		sh.filesToSend = []*FileOffer{{Name: "modes.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+		rh := newTestHandler()
+		sender := NewSession(&pipeReadWriter{Reader: r2, Writer: wire}, sh,
+			&Config{EscapeMode: mode, AttnSequence: attn, Logger: discardLogger()})
+		receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, rh,
+			&Config{EscapeMode: mode, Logger: discardLogger()})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		var wg sync.WaitGroup
+		var sendErr, recvErr error
+		wg.Add(2)
+		go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+		go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+		wg.Wait()
+		cancel()
+
+		if sendErr != nil || recvErr != nil {
+			t.Fatalf("mode %d: send=%v recv=%v", mode, sendErr, recvErr)
+		}
+		if got := rh.receivedFiles["modes.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+			t.Fatalf("mode %d: content mismatch", mode)
+		}
+		if !bytes.Equal(receiver.attnSeq, attn) {
+			t.Fatalf("mode %d: attention sequence %x, want %x", mode, receiver.attnSeq, attn)
+		}
+		out := wire.log.Bytes()
+		if !bytes.Contains(out, []byte{ZDLE, 0x05 ^ 0x40}) {
+			t.Errorf("mode %d: ZSINIT's 0x05 not escaped", mode)
+		}
+		rawFlow := 0
+		for i, b := range out {
+			switch {
+			case b&0x7f == XON || b&0x7f == XOFF:
+				if b == XON && (i > 0 && out[i-1] == '\n' || i+1 < len(out) && out[i+1] == ZPAD) {
+					continue // the XON after a hex header or a ZCRCW subpacket
+				}
+				rawFlow++
+			case mode == EscapeAll && b < 0x20 && b != ZDLE && b != '\r' && b != '\n':
+				t.Fatalf("mode %d: raw control byte 0x%02x at %d", mode, b, i)
+			}
+		}
+		if rawFlow != 0 {
+			t.Errorf("mode %d: %d raw XON/XOFF data bytes on the wire", mode, rawFlow)
+		}
+	}
+}
+
+// flowEater drops raw XON/XOFF on their way to w, as a flow-controlled modem
+// or terminal server does.
+type flowEater struct{ w io.Writer }
+
+func (f flowEater) Write(p []byte) (int, error) {
+	kept := make([]byte, 0, len(p))
+	for _, b := range p {
+		if b&0x7f != XON && b&0x7f != XOFF {
+			kept = append(kept, b)
+		}
+	}
+	_, err := f.w.Write(kept)
+	return len(p), err
+}
+
+// TestLoopbackMinimalSurvivesFlowControl sends data dense in XON/XOFF in
+// EscapeMinimal across a link that swallows them. DirZap escapes them, so
+// nothing is lost; escaping only ZDLE lost every one.
+func TestLoopbackMinimalSurvivesFlowControl(t *testing.T) {
+	content := bytes.Repeat([]byte{'a', XON, 'b', XOFF, XON | 0x80, XOFF | 0x80, ZDLE | 0x80}, 4096)
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+	sh := newTestHandler()
+	sh.filesToSend = []*FileOffer{{Name: "flow.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	rh := newTestHandler()
+	cfg := Config{EscapeMode: EscapeMinimal, MaxBlockSize: 8192, Logger: discardLogger()}
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: flowEater{w1}}, sh, &cfg)
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, rh, &cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send=%v recv=%v", sendErr, recvErr)
+	}
+	if got := rh.receivedFiles["flow.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("flow.bin not received intact")
+	}
+}
+
+// TestLoopbackEscapeAllNegotiated: one side configured for EscapeAll, the
+// other left at the default, and both directions end up escaped. A sender
+// says so in ZSINIT (TESCCTL), a receiver in ZRINIT (ESCCTL); the reader
+// decodes an escaped stream in any mode.
+func TestLoopbackEscapeAllNegotiated(t *testing.T) {
+	var content []byte
+	for range 16 {
+		for b := range 256 {
+			content = append(content, byte(b))
+		}
+	}
+	for _, tc := range []struct {
+		name           string
+		sender, recver EscapeMode
+	}{
+		{"sender escapes", EscapeAll, EscapeStandard},
+		{"receiver escapes", EscapeStandard, EscapeAll},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r1, w1 := bufferedPipe(256)
+			r2, w2 := bufferedPipe(256)
+			toRecv, toSend := &teeWriter{w: w1}, &teeWriter{w: w2}
+			sh := newTestHandler()
+			sh.filesToSend = []*FileOffer{{Name: "neg.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+			rh := newTestHandler()
+			sender := NewSession(&pipeReadWriter{Reader: r2, Writer: toRecv}, sh,
+				&Config{EscapeMode: tc.sender, Logger: discardLogger()})
+			receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: toSend}, rh,
+				&Config{EscapeMode: tc.recver, Logger: discardLogger()})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			var wg sync.WaitGroup
+			var sendErr, recvErr error
+			wg.Add(2)
+			go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+			go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+			wg.Wait()
+
+			if sendErr != nil || recvErr != nil {
+				t.Fatalf("send=%v recv=%v", sendErr, recvErr)
+			}
+			if got := rh.receivedFiles["neg.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+				t.Fatal("content mismatch")
+			}
+			if sender.tw.escapeMode != EscapeAll || receiver.tw.escapeMode != EscapeAll {
+				t.Fatalf("escape modes after the session: sender %d, receiver %d, want both EscapeAll",
+					sender.tw.escapeMode, receiver.tw.escapeMode)
+			}
+			// CR, LF and XON appear raw as hex-header framing (ZDLE too);
+			// every other control byte in either direction is escaped.
+			for dir, w := range map[string]*teeWriter{"sender": toRecv, "receiver": toSend} {
+				for i, b := range w.log.Bytes() {
+					if b < 0x20 && b != ZDLE && b != '\r' && b != '\n' && b != XON {
+						t.Fatalf("%s: raw control byte 0x%02x at %d", dir, b, i)
+					}
+				}
+			}
+		})
+	}
+}
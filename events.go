@@ -0,0 +1,215 @@
+package zmodem
+
+// DefaultEventBuffer is the capacity of the channel Events returns when
+// Config.EventBuffer is not set.
+const DefaultEventBuffer = 64
+
+// EventPolicy says what a session does with an event when the channel
+// Events returned is full (Config.EventPolicy).
+type EventPolicy int
+
+const (
+	// EventsDropOldest drops the oldest event in the channel to make room:
+	// the session never waits for its reader, and a slow reader sees the
+	// latest events. SessionEndedEvent.Dropped counts what was lost.
+	EventsDropOldest EventPolicy = iota
+	// EventsBlock waits for the reader to make room, holding up the
+	// transfer, and its end. The wait ends if the run's context is done,
+	// and the event then drops the oldest one, as EventsDropOldest would.
+	EventsBlock
+)
+
+// Event is something that happened in a session, as Events delivers it:
+// one of the *Event types below.
+type Event interface{ event() }
+
+// SessionStartedEvent begins a Send, Receive or Auto.
+type SessionStartedEvent struct {
+	// ID is the session ID the run's log records carry (see
+	// Config.Logger).
+	ID string
+}
+
+// NegotiatedEvent says how the ends will transfer: on a sender once the
+// receiver's first ZRINIT is in, on a receiver when the first file is
+// offered.
+type NegotiatedEvent struct {
+	// Flags and Window are the receiver's ZRINIT capabilities (CANFDX,
+	// CANFC32, ...) and buffer size, 0 for streaming; zero on a receiver.
+	Flags  byte
+	Window int
+	// CRC32 reports whether data goes with 32-bit CRCs.
+	CRC32 bool
+}
+
+// FileOfferedEvent is a file offered: by the sender's ZFILE, sent or
+// received.
+type FileOfferedEvent struct{ Info FileInfo }
+
+// FileStartedEvent is the data of a file about to move from Offset, past 0
+// when it resumes.
+type FileStartedEvent struct {
+	Info   FileInfo
+	Offset int64
+}
+
+// ProgressEvent is a file's progress, as often as the handler's
+// FileProgress or TransferProgress is called.
+type ProgressEvent struct {
+	Info     FileInfo
+	Progress Progress
+}
+
+// RetryEvent is an error recovery: the transfer of a file going back to
+// Offset, asked for by the receiver's ZRPOS.
+type RetryEvent struct {
+	Info   FileInfo
+	Offset int64
+}
+
+// CRCErrorEvent is a header or subpacket read whose CRC did not match.
+type CRCErrorEvent struct{ Err error }
+
+// FileCompletedEvent is a file's end, as FileCompleted is told of it.
+type FileCompletedEvent struct{ Result TransferResult }
+
+// SessionEndedEvent is the last event of a run, with the error Send,
+// Receive or Auto returns.
+type SessionEndedEvent struct {
+	Err error
+	// Dropped is the events of the run dropped from a full channel.
+	Dropped int
+}
+
+func (SessionStartedEvent) event() {}
+func (NegotiatedEvent) event()     {}
+func (FileOfferedEvent) event()    {}
+func (FileStartedEvent) event()    {}
+func (ProgressEvent) event()       {}
+func (RetryEvent) event()          {}
+func (CRCErrorEvent) event()       {}
+func (FileCompletedEvent) event()  {}
+func (SessionEndedEvent) event()   {}
+
+// eventStream is the channel Events returned and what feeds it. Only the
+// goroutine running the session sends on it and closes it.
+type eventStream struct {
+	ch      chan Event
+	block   bool
+	dropped int
+}
+
+// Events returns a channel of the session's events, in the order they
+// happen, from now until the end of the running Send, Receive or Auto, or of
+// the next one if none is running. The channel is closed after that run's
+// SessionEndedEvent; call Events again for the run after it. Every call
+// until then returns the same channel. Its capacity is Config.EventBuffer;
+// Config.EventPolicy says what happens when the reader falls behind.
+func (s *Session) Events() <-chan Event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if es := s.events.Load(); es != nil {
+		return es.ch
+	}
+	n := s.cfg.EventBuffer
+	if n <= 0 {
+		n = DefaultEventBuffer
+	}
+	es := &eventStream{ch: make(chan Event, n), block: s.cfg.EventPolicy == EventsBlock}
+	s.events.Store(es)
+	return es.ch
+}
+
+// emit sends e on the session's event stream.
+func (s *Session) emit(es *eventStream, e Event) {
+	if es.block {
+		select {
+		case es.ch <- e:
+			return
+		case <-s.ctx.Done():
+		}
+	}
+	for {
+		select {
+		case es.ch <- e:
+			return
+		default:
+		}
+		select {
+		case <-es.ch:
+			es.dropped++
+		default:
+		}
+	}
+}
+
+// endEvents sends the SessionEndedEvent of a run and closes its stream, if
+// there is one.
+func (s *Session) endEvents(err error) {
+	s.mu.Lock()
+	es := s.events.Swap(nil)
+	s.mu.Unlock()
+	if es == nil {
+		return
+	}
+	defer close(es.ch)
+	if es.block {
+		select {
+		case es.ch <- SessionEndedEvent{Err: err, Dropped: es.dropped}:
+			return
+		case <-s.ctx.Done():
+		}
+	}
+	// The end is never dropped: it takes the oldest event's place, counted
+	// with the rest.
+	for len(es.ch) == cap(es.ch) {
+		select {
+		case <-es.ch:
+			es.dropped++
+		default:
+		}
+	}
+	es.ch <- SessionEndedEvent{Err: err, Dropped: es.dropped}
+}
+
+// The emit* methods send an event when there is a stream to send it on.
+// They build it only then: a session nobody listens to pays nothing.
+
+func (s *Session) emitStarted() {
+	if es := s.events.Load(); es != nil {
+		s.emit(es, SessionStartedEvent{ID: string(s.logRun.id[:])})
+	}
+}
+
+func (s *Session) emitNegotiated(flags byte, window int, crc32 bool) {
+	if es := s.events.Load(); es != nil {
+		s.emit(es, NegotiatedEvent{Flags: flags, Window: window, CRC32: crc32})
+	}
+}
+
+func (s *Session) emitOffered(info FileInfo) {
+	if es := s.events.Load(); es != nil {
+		s.emit(es, FileOfferedEvent{Info: info})
+	}
+}
+
+func (s *Session) emitProgress(info FileInfo, p Progress) {
+	if es := s.events.Load(); es != nil {
+		s.emit(es, ProgressEvent{Info: info, Progress: p})
+	}
+}
+
+func (s *Session) emitCRCError(err error) {
+	if es := s.events.Load(); es != nil {
+		s.emit(es, CRCErrorEvent{Err: err})
+	}
+}
+
+// startFile records the offset a file's data starts from, once both ends
+// have agreed on it.
+func (s *Session) startFile(offset int64) {
+	s.fileStart = offset
+	if es := s.events.Load(); es != nil {
+		s.emit(es, FileStartedEvent{Info: s.fileInfo, Offset: offset})
+	}
+}
@@ -0,0 +1,250 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// eventTrace renders events for comparison, a run of progress events on a
+// file as one.
+func eventTrace(events []Event) []string {
+	var trace []string
+	for _, ev := range events {
+		var s string
+		switch ev := ev.(type) {
+		case SessionStartedEvent:
+			s = "started"
+		case NegotiatedEvent:
+			s = fmt.Sprintf("negotiated crc32=%v", ev.CRC32)
+		case FileOfferedEvent:
+			s = "offered " + ev.Info.Name
+		case FileStartedEvent:
+			s = fmt.Sprintf("file %s from %d", ev.Info.Name, ev.Offset)
+		case ProgressEvent:
+			s = "progress " + ev.Info.Name
+		case RetryEvent:
+			s = "retry " + ev.Info.Name
+		case CRCErrorEvent:
+			s = "crc error"
+		case FileCompletedEvent:
+			s = fmt.Sprintf("completed %s %d skipped=%v err=%v", ev.Result.Info.Name, ev.Result.Bytes, ev.Result.Skipped(), ev.Result.Err != nil)
+		case SessionEndedEvent:
+			s = fmt.Sprintf("ended err=%v", ev.Err)
+		}
+		if len(trace) > 0 && trace[len(trace)-1] == s && s[:8] == "progress" {
+			continue
+		}
+		trace = append(trace, s)
+	}
+	return trace
+}
+
+// collectEvents reads ch until it is closed.
+func collectEvents(ch <-chan Event, wg *sync.WaitGroup) *[]Event {
+	var events []Event
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for ev := range ch {
+			events = append(events, ev)
+		}
+	}()
+	return &events
+}
+
+// TestEventsBatchWithSkip: both ends of a two-file batch whose second file
+// the receiver skips deliver the session's events in order, the last a
+// SessionEndedEvent, and close the channel; the next run gets a new one.
+func TestEventsBatchWithSkip(t *testing.T) {
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+	first := randomContent(20000)
+	senderHandler := newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{
+		{Name: "first.bin", Size: int64(len(first)), Reader: bytes.NewReader(first)},
+		{Name: "second.bin", Size: 100, Reader: bytes.NewReader(randomContent(100))},
+	}
+	receiverHandler := newTestHandler()
+	receiverHandler.skipFiles["second.bin"] = true
+	sender := NewSession(senderT, senderHandler, &Config{Use32BitCRC: true, Logger: discardLogger()})
+	receiver := NewSession(receiverT, receiverHandler, &Config{Use32BitCRC: true, Logger: discardLogger()})
+
+	sendCh, recvCh := sender.Events(), receiver.Events()
+	if sender.Events() != sendCh {
+		t.Fatal("Events returned another channel before the run")
+	}
+	var readers sync.WaitGroup
+	sent, received := collectEvents(sendCh, &readers), collectEvents(recvCh, &readers)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer senderClose(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer receiverClose(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+	readers.Wait()
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+
+	want := []string{
+		"started",
+		"negotiated crc32=true",
+		"offered first.bin",
+		"file first.bin from 0",
+		"progress first.bin",
+		"completed first.bin 20000 skipped=false err=false",
+		"offered second.bin",
+		"completed second.bin 0 skipped=true err=true",
+		"ended err=<nil>",
+	}
+	for _, side := range []struct {
+		name   string
+		events []Event
+	}{{"sender", *sent}, {"receiver", *received}} {
+		if got := eventTrace(side.events); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("%s events:\n%q\nwant\n%q", side.name, got, want)
+		}
+	}
+	if id := (*sent)[0].(SessionStartedEvent).ID; id != string(sender.logRun.id[:]) {
+		t.Errorf("started with ID %q, want the run's %q", id, sender.logRun.id)
+	}
+	if sender.Events() == sendCh {
+		t.Error("Events returned the closed channel after the run")
+	}
+}
+
+// TestEventsDropOldest: a reader that does not keep up loses the oldest
+// events, never the run's end, and is told how many it lost.
+func TestEventsDropOldest(t *testing.T) {
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+	content := randomContent(20000)
+	senderHandler := newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{{Name: "dropped.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	sender := NewSession(senderT, senderHandler, &Config{EventBuffer: 4, Logger: discardLogger()})
+	receiver := NewSession(receiverT, newTestHandler(), &Config{Logger: discardLogger()})
+	events := sender.Events()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var recvErr error
+	wg.Add(1)
+	go func() { defer wg.Done(); defer receiverClose(); recvErr = receiver.Receive(ctx) }()
+	sendErr := sender.Send(ctx)
+	senderClose()
+	wg.Wait()
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+
+	var got []Event
+	for ev := range events {
+		got = append(got, ev)
+	}
+	if len(got) != 4 {
+		t.Fatalf("%d events kept, want the buffer's 4", len(got))
+	}
+	end, ok := got[3].(SessionEndedEvent)
+	if !ok || end.Err != nil || end.Dropped == 0 {
+		t.Fatalf("last event %#v, want a clean end counting dropped events", got[3])
+	}
+	if fc, ok := got[2].(FileCompletedEvent); !ok || fc.Result.Err != nil {
+		t.Errorf("events %v, want the file's completion before the end", eventTrace(got))
+	}
+}
+
+// TestEventsBlock: with EventsBlock a slow reader holds up the transfer but
+// loses nothing, the recovery from a corrupt subpacket included; a reader
+// that stops reading holds it up until the context ends, and the channel
+// still ends with SessionEndedEvent.
+func TestEventsBlock(t *testing.T) {
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+	content := randomContent(16384)
+	senderHandler := newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{{Name: "blocked.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	cfg := Config{MaxBlockSize: 512, Use32BitCRC: true, EventBuffer: 1, EventPolicy: EventsBlock, Logger: discardLogger()}
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: &corruptingWriter{w: w1, targetCount: 3}}, senderHandler, &cfg)
+	receiverHandler := newTestHandler()
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, receiverHandler, &cfg)
+
+	slowly := func(ch <-chan Event, wg *sync.WaitGroup) *[]Event {
+		var events []Event
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ev := range ch {
+				time.Sleep(time.Millisecond)
+				events = append(events, ev)
+			}
+		}()
+		return &events
+	}
+	var readers sync.WaitGroup
+	sent, received := slowly(sender.Events(), &readers), slowly(receiver.Events(), &readers)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+	readers.Wait()
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+	has := func(events []Event, want string) bool {
+		for _, s := range eventTrace(events) {
+			if s == want {
+				return true
+			}
+		}
+		return false
+	}
+	for _, side := range []struct {
+		name, want string
+		events     []Event
+	}{{"sender", "retry blocked.bin", *sent}, {"receiver", "crc error", *received}} {
+		trace := eventTrace(side.events)
+		if end, ok := side.events[len(side.events)-1].(SessionEndedEvent); !ok || end.Dropped != 0 {
+			t.Errorf("%s: events %q, want all of them", side.name, trace)
+		}
+		if !has(side.events, side.want) || !has(side.events, "completed blocked.bin 16384 skipped=false err=false") {
+			t.Errorf("%s: events %q, want %q and the file", side.name, trace, side.want)
+		}
+	}
+
+	// Nobody reads: the sender waits on its first event past the buffer
+	// until the context ends.
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+	senderHandler = newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{{Name: "stuck.bin", Size: 1000, Reader: bytes.NewReader(randomContent(1000))}}
+	sender = NewSession(senderT, senderHandler, &Config{EventBuffer: 2, EventPolicy: EventsBlock, Logger: discardLogger()})
+	receiver = NewSession(receiverT, newTestHandler(), &Config{Logger: discardLogger()})
+	events := sender.Events()
+	ctx, cancel = context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	wg.Add(1)
+	go func() { defer wg.Done(); defer receiverClose(); _ = receiver.Receive(ctx) }()
+	sendErr = sender.Send(ctx)
+	senderClose()
+	wg.Wait()
+	if sendErr == nil {
+		t.Fatal("Send finished with nobody reading its events")
+	}
+	var got []Event
+	for ev := range events {
+		got = append(got, ev)
+	}
+	if end, ok := got[len(got)-1].(SessionEndedEvent); !ok || end.Err != sendErr {
+		t.Errorf("events %q, want Send's error %v last", eventTrace(got), sendErr)
+	}
+}
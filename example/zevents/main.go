@@ -0,0 +1,185 @@
+// Command zevents sends files to itself over a pipe and prints the events of
+// both ends as Session.Events delivers them, one select loop reading the two
+// streams until both are closed. The files are read but not written
+// anywhere; name one twice to see the receiver skip the second offer.
+//
+//	zevents notes.txt data.bin notes.txt
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+
+	zmodem "github.com/xx25/go-zmodem"
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: zevents file...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := loop(ctx, flag.Args()); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func loop(ctx context.Context, paths []string) error {
+	sendR, sendW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	recvR, recvW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+
+	send := &sender{paths: paths}
+	defer send.close()
+	sendSess := zmodem.NewSession(struct {
+		io.Reader
+		io.Writer
+	}{recvR, sendW}, send, &zmodem.Config{Use32BitCRC: true})
+	recvSess := zmodem.NewSession(struct {
+		io.Reader
+		io.Writer
+	}{sendR, recvW}, &discard{seen: map[string]bool{}}, &zmodem.Config{Use32BitCRC: true})
+
+	// Ask for the streams before the runs start, so that they begin with
+	// SessionStartedEvent.
+	sendEvents, recvEvents := sendSess.Events(), recvSess.Events()
+	sendErr, recvErr := make(chan error, 1), make(chan error, 1)
+	go func() {
+		defer sendW.Close()
+		sendErr <- sendSess.Send(ctx)
+	}()
+	go func() {
+		defer recvW.Close()
+		recvErr <- recvSess.Receive(ctx)
+	}()
+
+	// Each stream ends with a SessionEndedEvent and is then closed, however
+	// its run ends: read until both are.
+	for sendEvents != nil || recvEvents != nil {
+		select {
+		case ev, ok := <-sendEvents:
+			if !ok {
+				sendEvents = nil
+				continue
+			}
+			show("send", ev)
+		case ev, ok := <-recvEvents:
+			if !ok {
+				recvEvents = nil
+				continue
+			}
+			show("recv", ev)
+		}
+	}
+	return errors.Join(<-sendErr, <-recvErr)
+}
+
+// show prints an event of the end named role.
+func show(role string, ev zmodem.Event) {
+	switch ev := ev.(type) {
+	case zmodem.SessionStartedEvent:
+		fmt.Printf("%s: session %s started\n", role, ev.ID)
+	case zmodem.NegotiatedEvent:
+		fmt.Printf("%s: negotiated flags %#02x window %d CRC-32 %v\n", role, ev.Flags, ev.Window, ev.CRC32)
+	case zmodem.FileOfferedEvent:
+		fmt.Printf("%s: %s offered, %d bytes\n", role, ev.Info.Name, ev.Info.Size)
+	case zmodem.FileStartedEvent:
+		fmt.Printf("%s: %s started at %d\n", role, ev.Info.Name, ev.Offset)
+	case zmodem.ProgressEvent:
+		fmt.Printf("%s: %s at %d\n", role, ev.Info.Name, ev.Progress.Offset)
+	case zmodem.RetryEvent:
+		fmt.Printf("%s: %s back to %d\n", role, ev.Info.Name, ev.Offset)
+	case zmodem.CRCErrorEvent:
+		fmt.Printf("%s: %v\n", role, ev.Err)
+	case zmodem.FileCompletedEvent:
+		r := ev.Result
+		switch {
+		case r.Skipped():
+			fmt.Printf("%s: %s skipped\n", role, r.Info.Name)
+		case r.Err != nil:
+			fmt.Printf("%s: %s failed at %d: %v\n", role, r.Info.Name, r.Bytes, r.Err)
+		default:
+			fmt.Printf("%s: %s done, %d bytes in %v\n", role, r.Info.Name, r.Bytes, r.Duration)
+		}
+	case zmodem.SessionEndedEvent:
+		fmt.Printf("%s: session ended: %v (%d events dropped)\n", role, ev.Err, ev.Dropped)
+	}
+}
+
+// sender offers the files named on the command line.
+type sender struct {
+	paths []string
+	open  *os.File
+}
+
+func (s *sender) NextFile() *zmodem.FileOffer {
+	s.close()
+	for len(s.paths) > 0 {
+		path := s.paths[0]
+		s.paths = s.paths[1:]
+		f, err := os.Open(path)
+		if err != nil {
+			log.Print(err)
+			continue
+		}
+		fi, err := f.Stat()
+		if err != nil || !fi.Mode().IsRegular() {
+			log.Printf("%s: not a regular file", path)
+			f.Close()
+			continue
+		}
+		s.open = f
+		return &zmodem.FileOffer{Name: filepath.Base(path), Size: fi.Size(), ModTime: fi.ModTime(), Reader: f}
+	}
+	return nil
+}
+
+func (s *sender) close() {
+	if s.open != nil {
+		s.open.Close()
+		s.open = nil
+	}
+}
+
+func (s *sender) AcceptFile(zmodem.FileInfo) (io.WriteCloser, int64, error) {
+	return nil, 0, zmodem.ErrSkip
+}
+func (s *sender) FileProgress(zmodem.FileInfo, int64)         {}
+func (s *sender) FileCompleted(zmodem.FileInfo, int64, error) {}
+
+// discard receives every file into nothing, skipping a name it has had.
+type discard struct{ seen map[string]bool }
+
+func (d *discard) NextFile() *zmodem.FileOffer { return nil }
+func (d *discard) AcceptFile(info zmodem.FileInfo) (io.WriteCloser, int64, error) {
+	if d.seen[info.Name] {
+		return nil, 0, zmodem.ErrSkip
+	}
+	d.seen[info.Name] = true
+	return nopCloser{io.Discard}, 0, nil
+}
+func (d *discard) FileProgress(zmodem.FileInfo, int64)         {}
+func (d *discard) FileCompleted(zmodem.FileInfo, int64, error) {}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
@@ -0,0 +1,91 @@
+package zmodem
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// defaultFileBufferSize is the receive-side buffer in front of the handler's
+// writer when Config.FileBufferSize is left at zero.
+const defaultFileBufferSize = 64 << 10
+
+// fileBuffer batches the data subpackets written to the handler's receive
+// writer, so an unbuffered *os.File (or a pipe, or a file on a network
+// filesystem) sees a few large writes instead of one per subpacket. The
+// receiver flushes it at ZCRCW and ZCRCE, where the sender waits on us or the
+// frame ends; Close flushes before closing the handler's writer and reports
+// the first error of the two.
+//
+// It doubles as the write-ahead space for data subpackets: each is decoded
+// straight into the buffer's free space (see recvDataSubpacket) and committed
+// by the Write that follows a good CRC, which copies it onto itself. A
+// subpacket that fails its CRC is never written, so the next one overwrites
+// it and the handler's writer never sees it. The buffer is therefore sized
+// for at least one whole subpacket, and the session needs no second buffer
+// of a block's size to decode into.
+type fileBuffer struct {
+	*bufio.Writer
+	wc io.WriteCloser
+}
+
+func (f *fileBuffer) Close() error {
+	err := f.Flush()
+	if cerr := f.wc.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// bufferFile wraps w in the Session's file buffer, which is allocated once and
+// reused for every file. A negative Config.FileBufferSize leaves w as it is.
+func (s *Session) bufferFile(w io.WriteCloser) io.WriteCloser {
+	if s.cfg.FileBufferSize < 0 {
+		return w
+	}
+	if size := max(s.cfg.FileBufferSize, s.dataSubpacketLimit()); s.fileBuf == nil || s.fileBuf.Size() < size {
+		s.fileBuf = bufio.NewWriterSize(w, size)
+	} else {
+		s.fileBuf.Reset(w)
+	}
+	return &fileBuffer{Writer: s.fileBuf, wc: w}
+}
+
+// flushFile pushes whatever the file buffer holds (if w has one) through to
+// the handler's writer.
+func flushFile(w io.Writer) error {
+	if f, ok := w.(*fileBuffer); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// recvDataSubpacket reads a data subpacket bound for w. When w is a file
+// buffer the subpacket is decoded into its free space, flushing what it holds
+// first if the largest subpacket might not fit; otherwise it goes to the
+// session's receive buffer, as recvSubpacket does. Either way the data is
+// valid only until the next call.
+func (s *Session) recvDataSubpacket(w io.Writer) ([]byte, byte, error) {
+	maxLen := s.dataSubpacketLimit()
+	f, ok := w.(*fileBuffer)
+	if !ok || f.Size() < maxLen {
+		return s.recvSubpacket(maxLen)
+	}
+	if f.Available() < maxLen {
+		if err := f.Flush(); err != nil {
+			return nil, 0, fmt.Errorf("zmodem: file write error: %w", err)
+		}
+	}
+	fr := FrameReader{tr: s.tr}
+	crc32 := subpacketCRC32(s.rxEnc, s.useCRC32)
+	data, end, err := fr.readSubpacket(f.AvailableBuffer(), maxLen, crc32)
+	if s.cfg.FrameTrace != nil {
+		s.traceReceived(s.rxHdr, len(data), end, err)
+	}
+	if err != nil {
+		s.readError(err)
+		return nil, 0, err
+	}
+	s.subpacketRead(data, end, crc32)
+	return data, end, nil
+}
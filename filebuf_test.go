@@ -0,0 +1,328 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sinkWriter is a receive writer that counts its Write calls and notes the
+// largest, optionally costs some time per call (an unbuffered file on a slow
+// filesystem), and can fail its Close.
+type sinkWriter struct {
+	buf      bytes.Buffer
+	writes   int
+	maxWrite int
+	cost     time.Duration
+	closeErr error
+}
+
+func (w *sinkWriter) Write(p []byte) (int, error) {
+	w.writes++
+	w.maxWrite = max(w.maxWrite, len(p))
+	if w.cost > 0 {
+		time.Sleep(w.cost)
+	}
+	return w.buf.Write(p)
+}
+
+func (w *sinkWriter) Close() error { return w.closeErr }
+
+// sinkHandler receives into a sinkWriter.
+type sinkHandler struct {
+	*testFileHandler
+	sink *sinkWriter
+}
+
+func (h *sinkHandler) AcceptFile(FileInfo) (io.WriteCloser, int64, error) {
+	return h.sink, 0, nil
+}
+
+// receiveInto sends content to a receiver whose AcceptFile hands back sink
+// and returns the receiver's handler once both sides are done.
+func receiveInto(tb testing.TB, content []byte, sink *sinkWriter, sendCfg, recvCfg *Config) *sinkHandler {
+	tb.Helper()
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+	sh := newTestHandler()
+	sh.filesToSend = []*FileOffer{{Name: "buf.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	rh := &sinkHandler{testFileHandler: newTestHandler(), sink: sink}
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, sh, sendCfg)
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, rh, recvCfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+	if sendErr != nil || recvErr != nil {
+		tb.Fatalf("send=%v recv=%v", sendErr, recvErr)
+	}
+	return rh
+}
+
+func randomContent(n int) []byte {
+	content := make([]byte, n)
+	rng := rand.New(rand.NewPCG(9, 10))
+	for i := range content {
+		content[i] = byte(rng.Uint32())
+	}
+	return content
+}
+
+func TestFileBufferBatchesWrites(t *testing.T) {
+	content := randomContent(256<<10 + 100)
+	for _, tc := range []struct {
+		name      string
+		size      int
+		maxWrites int
+	}{
+		// 257 subpackets of 1 KB land in a handful of 64 KB writes.
+		{"default", 0, 8},
+		// Unbuffered, every subpacket is a write of its own.
+		{"off", -1, 1 << 20},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sink := &sinkWriter{}
+			rh := receiveInto(t, content, sink, &Config{Logger: discardLogger()},
+				&Config{FileBufferSize: tc.size, Logger: discardLogger()})
+			if !bytes.Equal(sink.buf.Bytes(), content) {
+				t.Fatalf("received %d bytes, want the %d sent", sink.buf.Len(), len(content))
+			}
+			if err := rh.completedFiles["buf.bin"]; err != nil {
+				t.Fatalf("FileCompleted err = %v", err)
+			}
+			if sink.writes > tc.maxWrites {
+				t.Fatalf("%d writes to the receive writer, want at most %d", sink.writes, tc.maxWrites)
+			}
+			if tc.size < 0 && sink.writes < 257 {
+				t.Fatalf("%d writes unbuffered, want one per subpacket", sink.writes)
+			}
+		})
+	}
+}
+
+func TestFileBufferCloseErrorReported(t *testing.T) {
+	errQuota := errors.New("quota exceeded")
+	content := randomContent(10 << 10)
+	sink := &sinkWriter{closeErr: errQuota}
+	rh := receiveInto(t, content, sink, &Config{Logger: discardLogger()}, &Config{Logger: discardLogger()})
+	if !bytes.Equal(sink.buf.Bytes(), content) {
+		t.Fatalf("received %d bytes, want the %d sent", sink.buf.Len(), len(content))
+	}
+	if err := rh.completedFiles["buf.bin"]; !errors.Is(err, errQuota) {
+		t.Fatalf("FileCompleted err = %v, want %v", err, errQuota)
+	}
+}
+
+// TestCloseErrorJoinedWithTransferError: a file that fails mid-transfer and
+// then fails to Close reports both errors.
+func TestCloseErrorJoinedWithTransferError(t *testing.T) {
+	errQuota := errors.New("quota exceeded")
+	r1, w1 := bufferedPipe(256) // peer -> receiver
+	r2, w2 := bufferedPipe(256) // receiver -> peer
+	rh := &sinkHandler{testFileHandler: newTestHandler(), sink: &sinkWriter{closeErr: errQuota}}
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, rh, &Config{Logger: discardLogger()})
+	peer := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, newTestHandler(), &Config{Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer w2.Close()
+		_ = receiver.Receive(ctx)
+	}()
+
+	mustRecvType(t, peer, ZRINIT, "initial ZRINIT")
+	if err := peer.sendBinHeader(makeHeader(ZFILE)); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.sendSubpacket(marshalFileInfo(&FileOffer{Name: "buf.bin", Size: 100}, 0, 0), ZCRCW); err != nil {
+		t.Fatal(err)
+	}
+	mustRecvType(t, peer, ZRPOS, "ZRPOS for buf.bin")
+	if err := peer.sendBinHeader(makePosHeader(ZDATA, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.sendSubpacket(make([]byte, 40), ZCRCE); err != nil {
+		t.Fatal(err)
+	}
+	// The session ends before the file does.
+	if err := peer.sendHexHeader(makeHeader(ZFIN)); err != nil {
+		t.Fatal(err)
+	}
+	mustRecvType(t, peer, ZFIN, "receiver ZFIN")
+	_ = peer.tw.writeRaw([]byte("OO"))
+	_ = peer.tw.Flush()
+	w1.Close()
+	<-done
+
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	err := rh.completedFiles["buf.bin"]
+	if !errors.Is(err, errQuota) || !strings.Contains(err.Error(), "session ended prematurely") {
+		t.Fatalf("FileCompleted err = %v, want the premature end joined with %v", err, errQuota)
+	}
+}
+
+// TestCloseErrorZFERR: with CloseErrorZFERR a receiver whose writer fails to
+// Close answers ZEOF with ZFERR, so the sender reports the file failed and
+// the batch stops there.
+func TestCloseErrorZFERR(t *testing.T) {
+	errQuota := errors.New("quota exceeded")
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+	sh := newTestHandler()
+	for _, name := range []string{"a.bin", "b.bin"} {
+		content := randomContent(3000)
+		sh.filesToSend = append(sh.filesToSend, &FileOffer{Name: name, Size: int64(len(content)), Reader: bytes.NewReader(content)})
+	}
+	rh := &sinkHandler{testFileHandler: newTestHandler(), sink: &sinkWriter{closeErr: errQuota}}
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, sh, &Config{Logger: discardLogger()})
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, rh,
+		&Config{CloseErrorZFERR: true, Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+
+	if !errors.Is(sendErr, ErrRemoteFileError) {
+		t.Fatalf("Send = %v, want ErrRemoteFileError", sendErr)
+	}
+	if !errors.Is(recvErr, errQuota) {
+		t.Fatalf("Receive = %v, want %v", recvErr, errQuota)
+	}
+	if err := sh.completedFiles["a.bin"]; !errors.Is(err, ErrRemoteFileError) {
+		t.Fatalf("sender FileCompleted(a.bin) = %v, want ErrRemoteFileError", err)
+	}
+	if err := rh.completedFiles["a.bin"]; !errors.Is(err, errQuota) {
+		t.Fatalf("receiver FileCompleted(a.bin) = %v, want %v", err, errQuota)
+	}
+	if _, ok := rh.completedFiles["b.bin"]; ok {
+		t.Fatal("b.bin was offered after the receiver failed to store a.bin")
+	}
+}
+
+// BenchmarkReceiveSlowSink receives into a writer that costs 50µs per call,
+// with and without the file buffer.
+func BenchmarkReceiveSlowSink(b *testing.B) {
+	content := randomContent(256 << 10)
+	for _, tc := range []struct {
+		name string
+		size int
+	}{{"buffered", 0}, {"unbuffered", -1}} {
+		b.Run(tc.name, func(b *testing.B) {
+			b.SetBytes(int64(len(content)))
+			for b.Loop() {
+				receiveInto(b, content, &sinkWriter{cost: 50 * time.Microsecond},
+					&Config{Logger: discardLogger()}, &Config{FileBufferSize: tc.size, Logger: discardLogger()})
+			}
+		})
+	}
+}
+
+// flipWriter flips one bit in each of the bytes at the given stream offsets
+// on their way to w.
+type flipWriter struct {
+	w       io.Writer
+	at      []int64 // ascending
+	written int64
+}
+
+func (f *flipWriter) Write(p []byte) (int, error) {
+	buf := p
+	for len(f.at) > 0 && f.at[0] < f.written+int64(len(p)) {
+		if &buf[0] == &p[0] {
+			buf = bytes.Clone(p)
+		}
+		buf[f.at[0]-f.written] ^= 0x04
+		f.at = f.at[1:]
+	}
+	f.written += int64(len(p))
+	return f.w.Write(buf)
+}
+
+// checkingWriter fails the test the moment a Write carries bytes that differ
+// from want at the offset they land on.
+type checkingWriter struct {
+	t    *testing.T
+	want []byte
+	off  int
+}
+
+func (c *checkingWriter) Write(p []byte) (int, error) {
+	if c.off+len(p) > len(c.want) || !bytes.Equal(p, c.want[c.off:c.off+len(p)]) {
+		c.t.Errorf("receive writer got %d bytes at offset %d that were not sent there", len(p), c.off)
+	}
+	c.off += len(p)
+	return len(p), nil
+}
+
+func (c *checkingWriter) Close() error { return nil }
+
+type checkingHandler struct {
+	*testFileHandler
+	w *checkingWriter
+}
+
+func (h *checkingHandler) AcceptFile(FileInfo) (io.WriteCloser, int64, error) { return h.w, 0, nil }
+
+// TestFileBufferHoldsBackBadSubpackets sends 64 KB blocks with data bytes
+// damaged on the wire. Each subpacket is decoded into the file buffer, but
+// only one with a good CRC is committed, so the receive writer never sees a
+// damaged byte. The session decodes into no buffer of its own, and the file
+// buffer grows just enough to hold one block.
+func TestFileBufferHoldsBackBadSubpackets(t *testing.T) {
+	content := randomContent(1 << 20)
+	// A recovery skips up to a block of stale data while hunting for the
+	// next header, more than the default garbage allowance.
+	cfg := Config{MaxBlockSize: 64 << 10, LargeBlocks: true, Use32BitCRC: true, GarbageThreshold: 128 << 10, Logger: discardLogger()}
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+	sh := newTestHandler()
+	sh.filesToSend = []*FileOffer{{Name: "spool.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	rh := &checkingHandler{testFileHandler: newTestHandler(), w: &checkingWriter{t: t, want: content}}
+	flips := &flipWriter{w: w1, at: []int64{100 << 10, 300 << 10, 301 << 10, 700 << 10}}
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: flips}, sh, &cfg)
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, rh, &cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send=%v recv=%v", sendErr, recvErr)
+	}
+	if rh.w.off != len(content) {
+		t.Fatalf("receive writer got %d bytes, want %d", rh.w.off, len(content))
+	}
+	if len(flips.at) > 0 || sender.Stats().RetransmitWritten == 0 {
+		t.Fatal("no damaged subpacket was resent; the test damaged nothing")
+	}
+	if got, want := receiver.fileBuf.Size(), receiver.dataSubpacketLimit(); got != want {
+		t.Errorf("file buffer %d bytes, want one subpacket's %d", got, want)
+	}
+	if c := cap(receiver.rxBuf); c >= 1<<10 {
+		t.Errorf("receive buffer grew to %d; data subpackets belong in the file buffer", c)
+	}
+}
@@ -0,0 +1,102 @@
+package zmodem
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// defaultFileCRCBufferSize is the read size for ZCRC answers when
+// Config.FileCRCBufferSize is left at zero.
+const defaultFileCRCBufferSize = 256 << 10
+
+// fileCRCCache holds the CRCs computed for ZCRC requests on one offer. A
+// receiver may ask more than once — for the whole file, then for the part it
+// already has — so each answer is kept by prefix length, and a longer prefix
+// is computed on from the longest shorter one.
+type fileCRCCache struct {
+	offer  *FileOffer
+	prefix map[int64]uint32 // CRC-32 of the first n bytes
+	size   int64            // file length once read to EOF; -1 until then
+}
+
+// computeFileCRC computes the CRC-32 of a file up to byteCount bytes.
+// byteCount == 0 means the entire file. The reader is left where it was
+// found, whatever the outcome, since the sender goes on sending from there.
+func (s *Session) computeFileCRC(ctx context.Context, offer *FileOffer, byteCount int64) (_ uint32, err error) {
+	if byteCount == 0 && offer.CRC32 != nil {
+		return *offer.CRC32, nil
+	}
+
+	c := &s.fileCRC
+	if c.offer != offer {
+		*c = fileCRCCache{offer: offer, prefix: map[int64]uint32{0: 0}, size: -1}
+	}
+	// Past EOF every request is for the whole file.
+	if c.size >= 0 && (byteCount == 0 || byteCount > c.size) {
+		byteCount = c.size
+	}
+	if crc, ok := c.prefix[byteCount]; ok && (byteCount > 0 || c.size == 0) {
+		return crc, nil
+	}
+
+	seeker, ok := offer.Reader.(io.ReadSeeker)
+	if !ok {
+		return 0, fmt.Errorf("reader does not implement io.ReadSeeker for ZCRC")
+	}
+
+	curPos, err := seeker.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		if _, serr := seeker.Seek(curPos, io.SeekStart); serr != nil && err == nil {
+			err = serr
+		}
+	}()
+
+	// Start from the longest prefix already known.
+	var totalRead int64
+	for n := range c.prefix {
+		if n > totalRead && (byteCount == 0 || n < byteCount) {
+			totalRead = n
+		}
+	}
+	crc := c.prefix[totalRead]
+	if _, err := seeker.Seek(totalRead, io.SeekStart); err != nil {
+		return 0, err
+	}
+
+	buf := make([]byte, s.cfg.FileCRCBufferSize)
+	eof := false
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		toRead := int64(len(buf))
+		if byteCount > 0 && totalRead+toRead > byteCount {
+			toRead = byteCount - totalRead
+		}
+		if toRead <= 0 {
+			break
+		}
+		n, err := offer.Reader.Read(buf[:toRead])
+		if n > 0 {
+			crc = crc32Update(crc, buf[:n])
+			totalRead += int64(n)
+		}
+		if err == io.EOF {
+			eof = true
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	c.prefix[totalRead] = crc
+	if eof {
+		c.size = totalRead
+	}
+	return crc, nil
+}
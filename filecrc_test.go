@@ -0,0 +1,157 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// countingSeeker is an io.ReadSeeker that counts the bytes read through it.
+type countingSeeker struct {
+	io.ReadSeeker
+	read int64
+}
+
+func (c *countingSeeker) Read(p []byte) (int, error) {
+	n, err := c.ReadSeeker.Read(p)
+	c.read += int64(n)
+	return n, err
+}
+
+func newCRCSession(cfg *Config) *Session {
+	return NewSession(&pipeReadWriter{Reader: &bytes.Buffer{}, Writer: io.Discard}, newTestHandler(), cfg)
+}
+
+func TestComputeFileCRC(t *testing.T) {
+	content := randomContent(100 << 10)
+	r := &countingSeeker{ReadSeeker: bytes.NewReader(content)}
+	offer := &FileOffer{Name: "crc.bin", Size: int64(len(content)), Reader: r}
+	s := newCRCSession(&Config{FileCRCBufferSize: 4096, Logger: discardLogger()})
+	r.Seek(500, io.SeekStart) // mid-transfer position, restored after each scan
+
+	for _, tc := range []struct {
+		name      string
+		byteCount int64
+		want      uint32
+		reads     int64 // bytes the scan may read
+	}{
+		{"prefix", 10 << 10, crc32.ChecksumIEEE(content[:10<<10]), 10 << 10},
+		{"same prefix again", 10 << 10, crc32.ChecksumIEEE(content[:10<<10]), 0},
+		{"longer prefix", 30 << 10, crc32.ChecksumIEEE(content[:30<<10]), 20 << 10},
+		{"shorter prefix", 1000, crc32.ChecksumIEEE(content[:1000]), 1000},
+		{"whole file", 0, crc32.ChecksumIEEE(content), 70 << 10},
+		{"whole file again", 0, crc32.ChecksumIEEE(content), 0},
+		{"prefix past EOF", 1 << 30, crc32.ChecksumIEEE(content), 0},
+	} {
+		before := r.read
+		got, err := s.computeFileCRC(context.Background(), offer, tc.byteCount)
+		if err != nil || got != tc.want {
+			t.Fatalf("%s: CRC %08x, %v; want %08x", tc.name, got, err, tc.want)
+		}
+		if n := r.read - before; n != tc.reads {
+			t.Errorf("%s: read %d bytes, want %d", tc.name, n, tc.reads)
+		}
+		if pos, _ := r.Seek(0, io.SeekCurrent); pos != 500 {
+			t.Fatalf("%s: reader left at %d, want 500", tc.name, pos)
+		}
+	}
+
+	// A new offer starts a new cache.
+	other := bytes.Repeat([]byte{7}, 300)
+	got, err := s.computeFileCRC(context.Background(), &FileOffer{Reader: bytes.NewReader(other)}, 0)
+	if err != nil || got != crc32.ChecksumIEEE(other) {
+		t.Fatalf("next offer: CRC %08x, %v; want %08x", got, err, crc32.ChecksumIEEE(other))
+	}
+}
+
+func TestComputeFileCRCFromOffer(t *testing.T) {
+	content := randomContent(10 << 10)
+	r := &countingSeeker{ReadSeeker: bytes.NewReader(content)}
+	known := uint32(0x5eed1234) // deliberately not the real CRC: it must be trusted as is
+	offer := &FileOffer{Reader: r, CRC32: &known}
+	s := newCRCSession(&Config{Logger: discardLogger()})
+
+	if got, err := s.computeFileCRC(context.Background(), offer, 0); err != nil || got != known {
+		t.Fatalf("whole file: CRC %08x, %v; want the offer's %08x", got, err, known)
+	}
+	if r.read != 0 {
+		t.Fatalf("read %d bytes for a CRC the offer supplied", r.read)
+	}
+	if got, err := s.computeFileCRC(context.Background(), offer, 4096); err != nil || got != crc32.ChecksumIEEE(content[:4096]) {
+		t.Fatalf("prefix: CRC %08x, %v; want it computed", got, err)
+	}
+
+	// No seeking needed either: a plain io.Reader will do.
+	plain := &FileOffer{Reader: bytes.NewBuffer(content), CRC32: &known}
+	if got, err := s.computeFileCRC(context.Background(), plain, 0); err != nil || got != known {
+		t.Fatalf("plain reader: CRC %08x, %v; want %08x", got, err, known)
+	}
+}
+
+func TestComputeFileCRCCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s := newCRCSession(&Config{Logger: discardLogger()})
+	offer := &FileOffer{Reader: bytes.NewReader(randomContent(1 << 20))}
+	if _, err := s.computeFileCRC(ctx, offer, 0); !errors.Is(err, context.Canceled) {
+		t.Fatalf("computeFileCRC = %v, want context.Canceled", err)
+	}
+}
+
+// BenchmarkComputeFileCRC scans a 100 MB sparse file from scratch each
+// iteration, at the old fixed 8 KB read size and at the default.
+func BenchmarkComputeFileCRC(b *testing.B) {
+	f, err := os.Create(filepath.Join(b.TempDir(), "sparse.bin"))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	const size = 100 << 20
+	if err := f.Truncate(size); err != nil {
+		b.Fatal(err)
+	}
+	for _, bufSize := range []int{8 << 10, defaultFileCRCBufferSize} {
+		b.Run(fmt.Sprintf("buf=%dK", bufSize>>10), func(b *testing.B) {
+			s := newCRCSession(&Config{FileCRCBufferSize: bufSize, Logger: discardLogger()})
+			b.SetBytes(size)
+			for b.Loop() {
+				s.fileCRC = fileCRCCache{}
+				if _, err := s.computeFileCRC(context.Background(), &FileOffer{Reader: f}, 0); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// failingSeeker fails every Read after the first limit bytes.
+type failingSeeker struct {
+	*bytes.Reader
+	limit int64
+}
+
+func (f *failingSeeker) Read(p []byte) (int, error) {
+	pos, _ := f.Seek(0, io.SeekCurrent)
+	if pos >= f.limit {
+		return 0, errors.New("disk error")
+	}
+	return f.Reader.Read(p[:min(int64(len(p)), f.limit-pos)])
+}
+
+func TestComputeFileCRCRestoresPosition(t *testing.T) {
+	s := newCRCSession(&Config{FileCRCBufferSize: 1024, Logger: discardLogger()})
+	r := &failingSeeker{Reader: bytes.NewReader(randomContent(64 << 10)), limit: 8 << 10}
+	r.Seek(4096, io.SeekStart)
+	if _, err := s.computeFileCRC(context.Background(), &FileOffer{Reader: r}, 0); err == nil {
+		t.Fatal("computeFileCRC succeeded past a read error")
+	}
+	if pos, _ := r.Seek(0, io.SeekCurrent); pos != 4096 {
+		t.Fatalf("reader left at %d after a read error, want 4096", pos)
+	}
+}
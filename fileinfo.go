@@ -2,30 +2,83 @@ package zmodem
 
 import (
 	"fmt"
+	"io/fs"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
+// maxModTime is the latest ZFILE modification time parseFileInfo accepts
+// (2200-01-01 UTC); anything later is a broken or hostile sender.
+var maxModTime = time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC).Unix()
+
+// Unix st_mode bits of the ZFILE mode field.
+const (
+	modePerm    = 07777   // permissions, with setuid, setgid and sticky
+	modeRegular = 0100000 // S_IFREG
+	modeSetuid  = 04000
+	modeSetgid  = 02000
+	modeSticky  = 01000
+)
+
+// Permissions returns the permission bits (0777) of the sender's mode, fit
+// for os.Chmod or os.OpenFile. File type, setuid, setgid and sticky bits are
+// dropped; 0 means the sender gave no mode.
+func (fi FileInfo) Permissions() fs.FileMode {
+	return fs.FileMode(fi.Mode & 0777)
+}
+
+// PermissionsWithSpecial is Permissions with the sender's setuid, setgid and
+// sticky bits kept, for a receiver that chooses to honour them.
+func (fi FileInfo) PermissionsWithSpecial() fs.FileMode {
+	m := fi.Permissions()
+	if fi.Mode&modeSetuid != 0 {
+		m |= fs.ModeSetuid
+	}
+	if fi.Mode&modeSetgid != 0 {
+		m |= fs.ModeSetgid
+	}
+	if fi.Mode&modeSticky != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
+
+// wireSize is the size the receiver holds a file's data to: Size, or 0
+// (unknown) for a text-mode file, whose converted data on the wire is longer
+// than the size declared.
+func (fi FileInfo) wireSize() int64 {
+	if fi.Text {
+		return 0
+	}
+	return fi.Size
+}
+
 // marshalFileInfo encodes file metadata for a ZFILE data subpacket.
 // Format: <filename>\0<size> <modtime> <mode> <serial> <files_remaining> <bytes_remaining>\0
 func marshalFileInfo(offer *FileOffer, filesRemaining int, bytesRemaining int64) []byte {
 	// Filename: lowercase, forward slashes only
-	name := strings.ToLower(offer.Name)
-	name = strings.ReplaceAll(name, "\\", "/")
+	name := strings.ReplaceAll(asciiLower(offer.Name), "\\", "/")
 
 	// Build the metadata string after the null
 	var meta strings.Builder
 	meta.WriteString(fmt.Sprintf("%d", offer.Size))
 
-	if !offer.ModTime.IsZero() {
+	// 0 means "unknown"; a pre-1970 time would print as a signed octal
+	// number that receivers misread, so it is sent as unknown too.
+	if !offer.ModTime.IsZero() && offer.ModTime.Unix() > 0 {
 		meta.WriteString(fmt.Sprintf(" %o", offer.ModTime.Unix()))
 	} else {
 		meta.WriteString(" 0")
 	}
 
-	meta.WriteString(fmt.Sprintf(" %o", offer.Mode))
+	mode := offer.Mode
+	if mode != 0 {
+		mode = mode&modePerm | modeRegular
+	}
+	meta.WriteString(fmt.Sprintf(" %o", mode))
 	meta.WriteString(" 0") // serial number, always 0
 
 	if filesRemaining > 0 {
@@ -44,9 +97,31 @@ func marshalFileInfo(offer *FileOffer, filesRemaining int, bytesRemaining int64)
 	return result
 }
 
+// asciiLower lowercases the ASCII letters of name and leaves every other byte
+// as it is. strings.ToLower would rewrite a name that is not valid UTF-8 (a
+// CP437 or Latin-1 one) with U+FFFD, and change the length of some UTF-8 ones;
+// terminals then save the file under a garbled name.
+func asciiLower(name string) string {
+	b := []byte(name)
+	for i, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			b[i] = c + 'a' - 'A'
+		}
+	}
+	return string(b)
+}
+
+// maxFileInfoFields bounds the space-separated fields after the filename.
+// lrzsz sends six; a couple of extras are tolerated and ignored.
+const maxFileInfoFields = 8
+
 // parseFileInfo parses a ZFILE data subpacket into FileInfo.
 // Format: <filename>\0<size> <modtime> <mode> <serial> <files_remaining> <bytes_remaining>\0
-// All fields after filename are optional.
+// All fields after filename are optional. A name in double quotes is taken
+// without them (see unquoteName). A missing or blank name, a size or
+// remaining count that is negative, malformed or out of range, or too many
+// fields is an error matching ErrBadFileInfo; the info parsed so far is
+// returned with it. A bad modtime, mode or serial is ignored.
 func parseFileInfo(data []byte) (FileInfo, error) {
 	var info FileInfo
 
@@ -59,10 +134,13 @@ func parseFileInfo(data []byte) (FileInfo, error) {
 		}
 	}
 	if nullIdx < 0 {
-		return info, fmt.Errorf("zmodem: file info missing null terminator")
+		return info, fmt.Errorf("%w: missing null terminator", ErrBadFileInfo)
 	}
 
-	info.Name = string(data[:nullIdx])
+	info.Name = unquoteName(string(data[:nullIdx]))
+	if strings.TrimSpace(info.Name) == "" {
+		return info, fmt.Errorf("%w: empty filename", ErrBadFileInfo)
+	}
 
 	// Parse space-separated fields after the filename NUL
 	rest := data[nullIdx+1:]
@@ -76,26 +154,31 @@ func parseFileInfo(data []byte) (FileInfo, error) {
 	}
 
 	fields := strings.Fields(string(rest))
+	if len(fields) > maxFileInfoFields {
+		return info, fmt.Errorf("%w: %d fields, at most %d allowed", ErrBadFileInfo, len(fields), maxFileInfoFields)
+	}
 
-	// Field 0: size (decimal)
+	// Field 0: size (decimal, unsigned, fits in int64)
 	if len(fields) > 0 {
-		size, err := strconv.ParseInt(fields[0], 10, 64)
-		if err == nil {
-			info.Size = size
+		size, err := strconv.ParseUint(fields[0], 10, 63)
+		if err != nil {
+			return info, fmt.Errorf("%w: bad size %q", ErrBadFileInfo, fields[0])
 		}
+		info.Size = int64(size)
 	}
 
-	// Field 1: modtime (octal, seconds since Unix epoch)
+	// Field 1: modtime (octal, seconds since Unix epoch). Values outside
+	// 1970..maxModTime are left as "unknown" rather than applied.
 	if len(fields) > 1 {
 		modtime, err := strconv.ParseInt(fields[1], 8, 64)
-		if err == nil && modtime > 0 {
+		if err == nil && modtime > 0 && modtime <= maxModTime {
 			info.ModTime = time.Unix(modtime, 0)
 		}
 	}
 
-	// Field 2: mode (octal)
+	// Field 2: mode (octal, masked to 32 bits)
 	if len(fields) > 2 {
-		mode, err := strconv.ParseUint(fields[2], 8, 32)
+		mode, err := strconv.ParseUint(fields[2], 8, 64)
 		if err == nil {
 			info.Mode = uint32(mode)
 		}
@@ -103,28 +186,114 @@ func parseFileInfo(data []byte) (FileInfo, error) {
 
 	// Field 3: serial (ignored, always 0)
 
-	// Field 4: files remaining (decimal)
+	// Field 4: files remaining (decimal, non-negative)
 	if len(fields) > 4 {
-		fr, err := strconv.Atoi(fields[4])
-		if err == nil {
-			info.FilesRemaining = fr
+		fr, err := strconv.ParseUint(fields[4], 10, 31)
+		if err != nil {
+			return info, fmt.Errorf("%w: bad files remaining %q", ErrBadFileInfo, fields[4])
 		}
+		info.FilesRemaining = int(fr)
 	}
 
-	// Field 5: bytes remaining (decimal)
+	// Field 5: bytes remaining (decimal, non-negative)
 	if len(fields) > 5 {
-		br, err := strconv.ParseInt(fields[5], 10, 64)
-		if err == nil {
-			info.BytesRemaining = br
+		br, err := strconv.ParseUint(fields[5], 10, 63)
+		if err != nil {
+			return info, fmt.Errorf("%w: bad bytes remaining %q", ErrBadFileInfo, fields[5])
 		}
+		info.BytesRemaining = int64(br)
 	}
 
 	return info, nil
 }
 
+// unquoteName strips the double quotes some Windows senders (the ExtraPuTTY
+// and KiTTY ZMODEM plugins) put around a filename with spaces in it, as they
+// would quote it on a command line. A quote can be in no Windows filename, so
+// a quoted name is never the file's real one.
+func unquoteName(name string) string {
+	if len(name) >= 2 && name[0] == '"' && name[len(name)-1] == '"' {
+		return name[1 : len(name)-1]
+	}
+	return name
+}
+
 // SanitizeFilename returns a safe filename by stripping directory components.
-// Rejects path traversal sequences. Returns filepath.Base(name).
+// Rejects path traversal sequences. See SanitizeFilenameStrict for the rest of
+// the clean-up it applies.
 func SanitizeFilename(name string) string {
+	clean, _ := SanitizeFilenameStrict(name)
+	return clean
+}
+
+// unnamedFile replaces an incoming filename that has nothing usable left.
+const unnamedFile = "unnamed"
+
+// maxFilenameBytes bounds a sanitized filename; most filesystems allow 255.
+const maxFilenameBytes = 255
+
+// SanitizeFilenameStrict returns a filename that is safe to create in a
+// receive directory on any common filesystem, and whether it differs from
+// name. It keeps only the last path element (filepath.Base, then what
+// follows the last backslash and any drive letter, for DOS senders such as
+// Mystic BBS that send the full path, C:\FILES\FOO.ZIP), maps an empty,
+// "." or ".." result to "unnamed", strips trailing dots and spaces, prefixes
+// Windows device names (CON, PRN, AUX, NUL, COM1-9, LPT1-9, any case, with or
+// without extension) with "_", and truncates to 255 bytes, keeping a short
+// extension. Ordinary names come back unchanged.
+func SanitizeFilenameStrict(name string) (string, bool) {
 	// filepath.Base handles "../" and returns the last element
-	return filepath.Base(name)
+	clean := filepath.Base(name)
+	if i := strings.LastIndexByte(clean, '\\'); i >= 0 {
+		clean = clean[i+1:]
+	}
+	if len(clean) >= 2 && clean[1] == ':' && isDriveLetter(clean[0]) {
+		clean = clean[2:]
+	}
+	clean = strings.TrimRight(clean, ". ")
+	if clean == "" || clean == string(filepath.Separator) {
+		clean = unnamedFile
+	}
+	if isWindowsDeviceName(clean) {
+		clean = "_" + clean
+	}
+	if len(clean) > maxFilenameBytes {
+		clean = truncateFilename(clean, maxFilenameBytes)
+	}
+	return clean, clean != name
+}
+
+// isDriveLetter reports whether c can name a DOS drive, as in "C:".
+func isDriveLetter(c byte) bool {
+	return c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z'
+}
+
+// isWindowsDeviceName reports whether Windows would open a device for name:
+// the part before the first dot, less trailing spaces, is a reserved name.
+func isWindowsDeviceName(name string) bool {
+	stem, _, _ := strings.Cut(name, ".")
+	stem = strings.ToUpper(strings.TrimRight(stem, " "))
+	switch stem {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	if len(stem) == 4 && (strings.HasPrefix(stem, "COM") || strings.HasPrefix(stem, "LPT")) {
+		return stem[3] >= '1' && stem[3] <= '9'
+	}
+	return false
+}
+
+// truncateFilename cuts name to at most max bytes on a UTF-8 boundary,
+// keeping its extension when that is short.
+func truncateFilename(name string, max int) string {
+	ext := filepath.Ext(name)
+	if len(ext) > 16 {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	n := max - len(ext)
+	for n > 0 && !utf8.RuneStart(stem[n]) {
+		n--
+	}
+	return strings.TrimRight(stem[:n], ". ") + ext
 }
@@ -1,8 +1,17 @@
 package zmodem
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 func TestMarshalParseFileInfoRoundTrip(t *testing.T) {
@@ -29,8 +38,8 @@ func TestMarshalParseFileInfoRoundTrip(t *testing.T) {
 	if info.ModTime.Unix() != 1234567890 {
 		t.Errorf("modtime = %d, want %d", info.ModTime.Unix(), 1234567890)
 	}
-	if info.Mode != 0644 {
-		t.Errorf("mode = 0%o, want 0644", info.Mode)
+	if info.Mode != 0100644 || info.Permissions() != 0644 {
+		t.Errorf("mode = 0%o (permissions %v), want 0100644 (lrzsz form)", info.Mode, info.Permissions())
 	}
 	if info.FilesRemaining != 3 {
 		t.Errorf("filesRemaining = %d, want 3", info.FilesRemaining)
@@ -40,6 +49,40 @@ func TestMarshalParseFileInfoRoundTrip(t *testing.T) {
 	}
 }
 
+// TestFileModeBits: the mode goes out in lrzsz's form, marked as a regular
+// file, and an incoming one is reduced to permission bits unless setuid,
+// setgid and sticky are asked for.
+func TestFileModeBits(t *testing.T) {
+	for _, tc := range []struct {
+		offer   uint32
+		wire    string
+		perm    fs.FileMode
+		special fs.FileMode
+	}{
+		{0, " 0 0\x00", 0, 0},
+		{0644, " 100644 0\x00", 0644, 0644},
+		{0100644, " 100644 0\x00", 0644, 0644},
+		{04755, " 104755 0\x00", 0755, 0755 | fs.ModeSetuid},
+		{07777, " 107777 0\x00", 0777, 0777 | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky},
+		{040755, " 100755 0\x00", 0755, 0755}, // never sent as a directory
+	} {
+		data := marshalFileInfo(&FileOffer{Name: "f", Mode: tc.offer}, 0, 0)
+		if !strings.HasSuffix(string(data), tc.wire) {
+			t.Errorf("mode 0%o marshalled as %q, want suffix %q", tc.offer, data, tc.wire)
+		}
+		info, err := parseFileInfo(data)
+		if err != nil {
+			t.Fatalf("parseFileInfo(%q): %v", data, err)
+		}
+		if got := info.Permissions(); got != tc.perm {
+			t.Errorf("mode 0%o: Permissions = %v, want %v", tc.offer, got, tc.perm)
+		}
+		if got := info.PermissionsWithSpecial(); got != tc.special {
+			t.Errorf("mode 0%o: PermissionsWithSpecial = %v, want %v", tc.offer, got, tc.special)
+		}
+	}
+}
+
 func TestParseFileInfoMinimal(t *testing.T) {
 	// Just filename and null
 	data := []byte("hello.bin\x00")
@@ -106,21 +149,252 @@ func TestMarshalFileInfoBackslash(t *testing.T) {
 }
 
 func TestSanitizeFilename(t *testing.T) {
+	long := strings.Repeat("a", 300)
+	longUTF8 := strings.Repeat("é", 200) // 400 bytes
 	tests := []struct {
 		input    string
 		expected string
+		altered  bool
+	}{
+		{"test.txt", "test.txt", false},
+		{"README", "README", false},
+		{".profile", ".profile", false},
+		{"archive.tar.gz", "archive.tar.gz", false},
+		{"console.log", "console.log", false},
+		{"com10.txt", "com10.txt", false},
+		{"lpt0", "lpt0", false},
+		{"../../../etc/passwd", "passwd", true},
+		{"/absolute/path/file.dat", "file.dat", true},
+		{"path/to/file.bin", "file.bin", true},
+		{`C:\MYSTIC\FILES\UPLOAD.ZIP`, "UPLOAD.ZIP", true},
+		{`..\..\boot.ini`, "boot.ini", true},
+		{`mixed/dos\name.txt`, "name.txt", true},
+		{"C:FOO.ZIP", "FOO.ZIP", true},
+		{`D:\`, "unnamed", true},
+		{"", "unnamed", true},
+		{".", "unnamed", true},
+		{"..", "unnamed", true},
+		{"/", "unnamed", true},
+		{"dir/..", "unnamed", true},
+		{"...", "unnamed", true},
+		{"foo.", "foo", true},
+		{"foo. . ", "foo", true},
+		{"name   ", "name", true},
+		{"con", "_con", true},
+		{"CON", "_CON", true},
+		{"NUL.txt", "_NUL.txt", true},
+		{"aux.tar.gz", "_aux.tar.gz", true},
+		{"Prn", "_Prn", true},
+		{"com1", "_com1", true},
+		{"COM9.log", "_COM9.log", true},
+		{"lpt3.", "_lpt3", true},
+		{"con .txt", "_con .txt", true},
+		{long, long[:255], true},
+		{long + ".txt", long[:251] + ".txt", true},
+		{longUTF8, strings.Repeat("é", 127), true},
+	}
+
+	for _, tc := range tests {
+		got, altered := SanitizeFilenameStrict(tc.input)
+		if got != tc.expected || altered != tc.altered {
+			t.Errorf("SanitizeFilenameStrict(%q) = %q, %v, want %q, %v", tc.input, got, altered, tc.expected, tc.altered)
+		}
+		if plain := SanitizeFilename(tc.input); plain != got {
+			t.Errorf("SanitizeFilename(%q) = %q, want %q", tc.input, plain, got)
+		}
+		if len(got) > maxFilenameBytes || !utf8.ValidString(got) {
+			t.Errorf("SanitizeFilenameStrict(%q) = %q: too long or not UTF-8", tc.input, got)
+		}
+	}
+}
+
+func TestFileInfoModTimeRange(t *testing.T) {
+	tests := []struct {
+		name    string
+		modTime time.Time
+		want    int64 // 0 = ModTime left zero
+	}{
+		{"pre-epoch", time.Date(1969, 7, 20, 20, 17, 0, 0, time.UTC), 0},
+		{"epoch", time.Unix(0, 0), 0},
+		{"zero", time.Time{}, 0},
+		{"normal", time.Unix(1234567890, 0), 1234567890},
+		{"2199", time.Date(2199, 12, 31, 0, 0, 0, 0, time.UTC), time.Date(2199, 12, 31, 0, 0, 0, 0, time.UTC).Unix()},
+		{"far future", time.Date(2500, 1, 1, 0, 0, 0, 0, time.UTC), 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			data := marshalFileInfo(&FileOffer{Name: "old.txt", Size: 1, ModTime: tc.modTime}, 0, 0)
+			if bytes.Contains(data, []byte("-")) {
+				t.Fatalf("marshalled %q contains a minus sign", data)
+			}
+			info, err := parseFileInfo(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tc.want == 0 {
+				if !info.ModTime.IsZero() {
+					t.Fatalf("ModTime = %v, want zero", info.ModTime)
+				}
+				return
+			}
+			if info.ModTime.Unix() != tc.want {
+				t.Fatalf("ModTime = %d, want %d", info.ModTime.Unix(), tc.want)
+			}
+		})
+	}
+}
+
+func TestParseFileInfoWildModTime(t *testing.T) {
+	for _, field := range []string{"-1", "-17777", "777777777777777", "7777777777777777777777"} {
+		info, err := parseFileInfo([]byte("f.bin\x00100 " + field + " 644\x00"))
+		if err != nil {
+			t.Fatalf("modtime %s: %v", field, err)
+		}
+		if !info.ModTime.IsZero() {
+			t.Errorf("modtime %s parsed as %v, want zero", field, info.ModTime)
+		}
+		if info.Size != 100 || info.Mode != 0644 {
+			t.Errorf("modtime %s: size %d mode %o, other fields lost", field, info.Size, info.Mode)
+		}
+	}
+}
+
+func TestParseFileInfoMalformed(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
 	}{
-		{"test.txt", "test.txt"},
-		{"../../../etc/passwd", "passwd"},
-		{"/absolute/path/file.dat", "file.dat"},
-		{"path/to/file.bin", "file.bin"},
-		{"", "."},
+		{"no terminator", "file.bin"},
+		{"empty name", "\x00100\x00"},
+		{"blank name", "  \x00100\x00"},
+		{"empty quoted name", "\"\"\x00100\x00"},
+		{"negative size", "f.bin\x00-1 0 644\x00"},
+		{"size not a number", "f.bin\x00abc\x00"},
+		{"size beyond int64", "f.bin\x009223372036854775808\x00"},
+		{"negative files remaining", "f.bin\x00100 0 644 0 -3 500\x00"},
+		{"negative bytes remaining", "f.bin\x00100 0 644 0 3 -500\x00"},
+		{"bytes remaining beyond int64", "f.bin\x00100 0 644 0 3 99999999999999999999\x00"},
+		{"too many fields", "f.bin\x001 2 3 4 5 6 7 8 9\x00"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parseFileInfo([]byte(tc.data))
+			if !errors.Is(err, ErrBadFileInfo) {
+				t.Fatalf("parseFileInfo(%q) = %v, want ErrBadFileInfo", tc.data, err)
+			}
+			if !errors.Is(err, ErrSkip) {
+				t.Fatalf("error %v does not match ErrSkip", err)
+			}
+		})
 	}
+}
 
+func TestParseFileInfoLenient(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want FileInfo
+	}{
+		{"largest size", "f.bin\x009223372036854775807\x00",
+			FileInfo{Name: "f.bin", Size: 1<<63 - 1}},
+		{"mode wider than 32 bits", "f.bin\x0010 0 7700000100644\x00",
+			FileInfo{Name: "f.bin", Size: 10, Mode: 0100644}},
+		{"bad mode ignored", "f.bin\x0010 0 9x9\x00",
+			FileInfo{Name: "f.bin", Size: 10}},
+		{"extra fields tolerated", "f.bin\x0010 0 644 0 2 20 7 x\x00",
+			FileInfo{Name: "f.bin", Size: 10, Mode: 0644, FilesRemaining: 2, BytesRemaining: 20}},
+		{"quoted name", "\"my file.txt\"\x0010\x00",
+			FileInfo{Name: "my file.txt", Size: 10}},
+		{"lone quote kept", "\"f.bin\x0010\x00",
+			FileInfo{Name: "\"f.bin", Size: 10}},
+	}
 	for _, tc := range tests {
-		got := SanitizeFilename(tc.input)
-		if got != tc.expected {
-			t.Errorf("SanitizeFilename(%q) = %q, want %q", tc.input, got, tc.expected)
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseFileInfo([]byte(tc.data))
+			if err != nil {
+				t.Fatalf("parseFileInfo(%q): %v", tc.data, err)
+			}
+			if got != tc.want {
+				t.Fatalf("parseFileInfo(%q) = %+v, want %+v", tc.data, got, tc.want)
+			}
+		})
+	}
+}
+
+// FuzzParseFileInfo checks that parseFileInfo never panics and that whatever
+// it accepts is sane: a non-blank name and non-negative sizes and counts.
+func FuzzParseFileInfo(f *testing.F) {
+	f.Add(marshalFileInfo(&FileOffer{Name: "test.txt", Size: 12345, ModTime: time.Unix(1234567890, 0), Mode: 0644}, 3, 50000))
+	f.Add([]byte("hello.bin\x00"))
+	f.Add([]byte("\x00-1 -1 -1 -1 -1 -1\x00"))
+	f.Add([]byte("f\x0099999999999999999999 77777777777777777777777\x00"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		info, err := parseFileInfo(data)
+		if err != nil {
+			if !errors.Is(err, ErrBadFileInfo) {
+				t.Fatalf("error %v does not match ErrBadFileInfo", err)
+			}
+			return
+		}
+		if strings.TrimSpace(info.Name) == "" {
+			t.Fatalf("accepted blank name in %q", data)
+		}
+		if info.Size < 0 || info.FilesRemaining < 0 || info.BytesRemaining < 0 {
+			t.Fatalf("accepted negative value %+v from %q", info, data)
+		}
+		if !info.ModTime.IsZero() && (info.ModTime.Unix() <= 0 || info.ModTime.Unix() > maxModTime) {
+			t.Fatalf("accepted out-of-range modtime %v from %q", info.ModTime, data)
+		}
+	})
+}
+
+// TestReceivedModeNeverSetuid: a sender's setuid, setgid and sticky bits do not
+// reach a file written with FileInfo.Permissions.
+func TestReceivedModeNeverSetuid(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("payload")
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+	sender := NewSession(senderT, newLrzszSendHandler([]*FileOffer{
+		{Name: "suid.bin", Size: int64(len(content)), Mode: 07755, Reader: bytes.NewReader(content)},
+	}), &Config{Logger: discardLogger()})
+	receiver := NewSession(receiverT, newLrzszRecvHandler(dir), &Config{Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer senderClose(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer receiverClose(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+
+	fi, err := os.Stat(filepath.Join(dir, "suid.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&(fs.ModeSetuid|fs.ModeSetgid|fs.ModeSticky) != 0 || fi.Mode().Perm() != 0755 {
+		t.Fatalf("stored mode %v, want -rwxr-xr-x", fi.Mode())
+	}
+}
+
+// TestMarshalFileInfoKeepsNonASCIIName pins that only ASCII letters are
+// lowercased: a CP437 or UTF-8 name reaches the receiver byte for byte.
+func TestMarshalFileInfoKeepsNonASCIIName(t *testing.T) {
+	for _, tc := range []struct{ name, want string }{
+		{"R\x8eSUM\x90.TXT", "r\x8esum\x90.txt"}, // CP437, not valid UTF-8
+		{"Ärger.TXT", "Ärger.txt"},
+		{"Kelvin.dat", "Kelvin.dat"}, // KELVIN SIGN lowercases to a shorter "k"
+	} {
+		info, err := parseFileInfo(marshalFileInfo(&FileOffer{Name: tc.name, Size: 1}, 0, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Name != tc.want {
+			t.Errorf("name %q sent as %q, want %q", tc.name, info.Name, tc.want)
 		}
 	}
 }
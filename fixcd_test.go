@@ -2,6 +2,8 @@ package zmodem
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"io"
 	"log/slog"
 	"testing"
@@ -67,7 +69,8 @@ func (r *infiniteReader) SetReadDeadline(t time.Time) error {
 }
 
 func TestReadByteAppliesPhaseTimeout(t *testing.T) {
-	// Control phase: the first read (buffer empty) sets a ~4s deadline.
+	// Control phase: the first read (buffer empty) sets a deadline between 4s
+	// and 4.5s out (see armIdle).
 	ctl := &infiniteReader{}
 	trCtl := newTransportReader(ctl, 1200, 4*time.Second, true, discardLogger())
 	trCtl.dataTimeout = 40 * time.Second
@@ -75,11 +78,11 @@ func TestReadByteAppliesPhaseTimeout(t *testing.T) {
 	if _, err := trCtl.readByte(); err != nil {
 		t.Fatalf("control readByte: %v", err)
 	}
-	if gap := ctl.lastDeadline.Sub(before); gap < 3*time.Second || gap > 6*time.Second {
-		t.Fatalf("control-phase deadline gap = %v, want ~4s", gap)
+	if gap := ctl.lastDeadline.Sub(before); gap < 4*time.Second || gap > 4600*time.Millisecond {
+		t.Fatalf("control-phase deadline gap = %v, want 4s-4.5s", gap)
 	}
 
-	// Data phase: the first read sets the longer ~40s deadline.
+	// Data phase: the first read sets the longer 40s-45s deadline.
 	data := &infiniteReader{}
 	trData := newTransportReader(data, 1200, 4*time.Second, true, discardLogger())
 	trData.dataTimeout = 40 * time.Second
@@ -88,8 +91,8 @@ func TestReadByteAppliesPhaseTimeout(t *testing.T) {
 	if _, err := trData.readByte(); err != nil {
 		t.Fatalf("data readByte: %v", err)
 	}
-	if gap := data.lastDeadline.Sub(before); gap < 38*time.Second || gap > 42*time.Second {
-		t.Fatalf("data-phase deadline gap = %v, want ~40s", gap)
+	if gap := data.lastDeadline.Sub(before); gap < 40*time.Second || gap > 46*time.Second {
+		t.Fatalf("data-phase deadline gap = %v, want 40s-45s", gap)
 	}
 }
 
@@ -181,3 +184,20 @@ func TestSendAttnPauses(t *testing.T) {
 		t.Fatalf("sendAttn wrote %v, want [A B] (pause byte must not appear literally)", out.Bytes())
 	}
 }
+
+// TestSendAttnPauseCancelled: the sender's ZSINIT can ask for minutes of
+// AttnPause; cancelling the session cuts them short.
+func TestSendAttnPauseCancelled(t *testing.T) {
+	var out bytes.Buffer
+	s := newAttnSession(&out, bytes.Repeat([]byte{AttnPause}, 255))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	s.ctx = ctx
+	start := time.Now()
+	if err := s.sendAttn(); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("sendAttn: %v, want context.DeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("sendAttn took %v after cancel", elapsed)
+	}
+}
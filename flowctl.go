@@ -0,0 +1,264 @@
+package zmodem
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultMaxXoffPause bounds an outbound XOFF pause when
+// Config.SoftwareFlowControl is set without an explicit Config.MaxXoffPause.
+const defaultMaxXoffPause = 10 * time.Second
+
+// flowControl is the outbound XON/XOFF state shared by the input side (which
+// observes the remote's flow-control bytes) and the wireWriter (which pauses
+// before writing while the remote has asserted XOFF).
+type flowControl struct {
+	xoff     atomic.Bool
+	pauses   atomic.Int64  // times output has waited on an XOFF
+	changed  chan struct{} // capacity 1: "xoff may have changed"
+	maxPause time.Duration
+	logger   *slog.Logger
+}
+
+func newFlowControl(maxPause time.Duration, logger *slog.Logger) *flowControl {
+	return &flowControl{
+		changed:  make(chan struct{}, 1),
+		maxPause: maxPause,
+		logger:   logger,
+	}
+}
+
+// observe updates the flow state from raw inbound bytes. The last XON/XOFF
+// (or parity variant) in p wins. Any ZMODEM data byte equal to XON/XOFF is
+// ZDLE-escaped on the wire, so a raw one is always flow control.
+func (f *flowControl) observe(p []byte) {
+	seen := false
+	var off bool
+	for _, b := range p {
+		switch b & 0x7f {
+		case XOFF:
+			seen, off = true, true
+		case XON:
+			seen, off = true, false
+		}
+	}
+	if !seen {
+		return
+	}
+	f.xoff.Store(off)
+	select {
+	case f.changed <- struct{}{}:
+	default:
+	}
+}
+
+// wait blocks while the remote has asserted XOFF, for at most maxPause. A
+// device that loses the XON would otherwise deadlock the session, so once the
+// pause expires the XOFF is forgotten and output resumes. It returns ctx's
+// error if the session is cancelled during the pause.
+func (f *flowControl) wait(ctx context.Context) error {
+	if !f.xoff.Load() {
+		return nil
+	}
+	f.pauses.Add(1)
+	timer := time.NewTimer(f.maxPause)
+	defer timer.Stop()
+	for f.xoff.Load() {
+		select {
+		case <-f.changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-timer.C:
+			f.logger.Debug("XOFF pause expired without XON, resuming output", "pause", f.maxPause)
+			f.xoff.Store(false)
+			return nil
+		}
+	}
+	return nil
+}
+
+// pumpReader reads the transport on its own goroutine so inbound bytes are
+// observed as soon as they arrive, not only when the state machine next reads —
+// a streaming sender does not read at all between checkpoints, so it would
+// never see an XOFF in time. Reads by the session are served from the pumped
+// chunks; SetReadDeadline is emulated with a timer, so the transportReader's
+// idle timeout keeps working whether or not the transport has deadlines.
+//
+// The goroutine reads only while a session may need it: it starts with the
+// pump and again with each Send or Receive, and stop ends it when they
+// return, so the caller's shell or terminal gets the line back. A transport
+// with read deadlines is interrupted at once; on one without, the Read in
+// progress cannot be, and the goroutine ends when it returns. Bytes pumped but
+// not consumed are kept for the next Send or Receive on the same Session, as
+// the session's own read-ahead is.
+type pumpReader struct {
+	src     io.Reader
+	ds      deadlineSetter // src's, to interrupt the goroutine's Read; nil if it has none
+	restore time.Time      // read deadline left on src by stop (Config.RestoreDeadline)
+	inspect func([]byte)
+
+	arrived chan struct{} // capacity 1: the queue grew, or err was set
+	taken   chan struct{} // capacity 1: the queue shrank, or stop was called
+	pending []byte        // rest of the chunk Read is serving
+
+	mu       sync.Mutex
+	queue    [][]byte // chunks pumped and not yet read
+	err      error    // src's error; ends the pump for good
+	deadline time.Time
+	running  bool          // a goroutine is reading src
+	stopping bool          // the goroutine is to end after its current Read
+	exited   chan struct{} // closed when the running goroutine returns
+}
+
+// pumpQueue bounds the chunks a pump holds before it stops reading, so a
+// session that falls behind pushes back on the transport.
+const pumpQueue = 64
+
+func newPumpReader(r io.Reader, inspect func([]byte)) *pumpReader {
+	p := &pumpReader{
+		src:     r,
+		inspect: inspect,
+		arrived: make(chan struct{}, 1),
+		taken:   make(chan struct{}, 1),
+	}
+	p.ds, _ = r.(deadlineSetter)
+	p.start()
+	return p
+}
+
+func signal(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// start has the goroutine read the transport, unless it already is or the
+// transport has failed. One that stop could not interrupt carries on.
+func (p *pumpReader) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopping = false
+	if p.running || p.err != nil {
+		return
+	}
+	p.running = true
+	p.exited = make(chan struct{})
+	go p.run(p.exited)
+}
+
+// stop ends the goroutine: at once on a transport with read deadlines, after
+// its current Read otherwise.
+func (p *pumpReader) stop() {
+	p.mu.Lock()
+	if !p.running {
+		p.mu.Unlock()
+		return
+	}
+	p.stopping = true
+	exited := p.exited
+	p.mu.Unlock()
+	signal(p.taken)
+	if p.ds == nil {
+		return
+	}
+	p.ds.SetReadDeadline(time.Now())
+	<-exited
+	p.ds.SetReadDeadline(p.restore)
+}
+
+func (p *pumpReader) run(exited chan struct{}) {
+	defer close(exited)
+	for {
+		buf := make([]byte, 4096)
+		n, err := p.src.Read(buf)
+		if n > 0 && p.inspect != nil {
+			p.inspect(buf[:n])
+		}
+		p.mu.Lock()
+		if n > 0 {
+			p.queue = append(p.queue, buf[:n])
+		}
+		if err != nil && !(p.stopping && isTimeout(err)) {
+			p.err = err
+		}
+		for len(p.queue) >= pumpQueue && !p.stopping {
+			p.mu.Unlock()
+			<-p.taken
+			p.mu.Lock()
+		}
+		done := p.stopping || p.err != nil
+		if done {
+			p.running = false
+		}
+		p.mu.Unlock()
+		signal(p.arrived)
+		if done {
+			return
+		}
+	}
+}
+
+// SetReadDeadline sets the emulated read deadline; the zero value clears it.
+func (p *pumpReader) SetReadDeadline(t time.Time) error {
+	p.mu.Lock()
+	p.deadline = t
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *pumpReader) Read(b []byte) (int, error) {
+	return p.readContext(context.Background(), b)
+}
+
+// readContext is Read that also stops waiting when ctx is cancelled.
+func (p *pumpReader) readContext(ctx context.Context, b []byte) (int, error) {
+	for len(p.pending) == 0 {
+		p.mu.Lock()
+		if len(p.queue) > 0 {
+			p.pending = p.queue[0]
+			p.queue[0] = nil
+			p.queue = p.queue[1:]
+			p.mu.Unlock()
+			signal(p.taken)
+			break
+		}
+		err, dl := p.err, p.deadline
+		p.mu.Unlock()
+		if err != nil {
+			return 0, err
+		}
+
+		var expired <-chan time.Time
+		var timer *time.Timer
+		if !dl.IsZero() {
+			d := time.Until(dl)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(d)
+			expired = timer.C
+		}
+		select {
+		case <-p.arrived:
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		case <-ctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return 0, ctx.Err()
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+	n := copy(b, p.pending)
+	p.pending = p.pending[n:]
+	return n, nil
+}
@@ -0,0 +1,242 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// lockedBuffer is a concurrency-safe write sink.
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *lockedBuffer) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *lockedBuffer) Bytes() []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]byte(nil), l.buf.Bytes()...)
+}
+
+// newFlowSession builds a flow-controlled Session whose input is fed through
+// in and whose output is collected in out.
+func newFlowSession(maxPause time.Duration) (*Session, *chanWriter, *lockedBuffer) {
+	r, in := bufferedPipe(16)
+	out := &lockedBuffer{}
+	s := NewSession(&pipeReadWriter{Reader: r, Writer: out}, newTestHandler(),
+		&Config{SoftwareFlowControl: true, MaxXoffPause: maxPause, Logger: discardLogger()})
+	return s, in, out
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestXoffStallsAndXonResumesOutput(t *testing.T) {
+	s, in, out := newFlowSession(10 * time.Second)
+	defer in.Close()
+
+	s.tw.writeRaw([]byte("AAAA"))
+	if err := s.tw.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	in.Write([]byte{XOFF})
+	waitFor(t, "XOFF observed", s.tw.wire.flow.xoff.Load)
+
+	done := make(chan error, 1)
+	go func() {
+		s.tw.writeRaw([]byte("BBBB"))
+		done <- s.tw.Flush()
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if got := out.Bytes(); !bytes.Equal(got, []byte("AAAA")) {
+		t.Fatalf("output during XOFF = %q, want it stalled at %q", got, "AAAA")
+	}
+
+	in.Write([]byte{XON | 0x80}) // parity variant counts too
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Flush after XON: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("output did not resume after XON")
+	}
+	if got := out.Bytes(); !bytes.Equal(got, []byte("AAAABBBB")) {
+		t.Fatalf("output = %q, want %q", got, "AAAABBBB")
+	}
+}
+
+func TestXoffPauseBounded(t *testing.T) {
+	s, in, out := newFlowSession(150 * time.Millisecond)
+	defer in.Close()
+
+	in.Write([]byte{XOFF})
+	waitFor(t, "XOFF observed", s.tw.wire.flow.xoff.Load)
+
+	start := time.Now()
+	s.tw.writeRaw([]byte("data"))
+	if err := s.tw.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < 140*time.Millisecond {
+		t.Fatalf("write went out after %v, want a ~150ms pause", elapsed)
+	}
+	if s.tw.wire.flow.xoff.Load() {
+		t.Fatal("expired XOFF not forgotten; every later write would pause again")
+	}
+	if !bytes.Equal(out.Bytes(), []byte("data")) {
+		t.Fatalf("output = %q, want %q", out.Bytes(), "data")
+	}
+}
+
+func TestPumpReaderDeadline(t *testing.T) {
+	r, w := bufferedPipe(1)
+	defer w.Close()
+	p := newPumpReader(r, nil)
+	p.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	if _, err := p.Read(make([]byte, 1)); !isTimeout(err) {
+		t.Fatalf("Read = %v, want a deadline timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("emulated deadline took %v", elapsed)
+	}
+}
+
+func TestXoffPauseEndsWithContext(t *testing.T) {
+	s, in, _ := newFlowSession(10 * time.Second)
+	defer in.Close()
+
+	in.Write([]byte{XOFF})
+	waitFor(t, "XOFF observed", s.tw.wire.flow.xoff.Load)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.tw.wire.ctx = ctx
+	time.AfterFunc(50*time.Millisecond, cancel)
+	start := time.Now()
+	s.tw.writeRaw([]byte("data"))
+	if err := s.tw.Flush(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("Flush = %v, want context.Canceled", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("cancelled write returned after %v, want it to leave the XOFF pause at once", elapsed)
+	}
+}
+
+// TestAbortWhileXoffHeld: Abort ends a session whose output is held by XOFF
+// at once, the abort sequence going out through the hold.
+func TestAbortWhileXoffHeld(t *testing.T) {
+	s, in, out := newFlowSession(10 * time.Second)
+	defer in.Close()
+
+	done := make(chan error, 1)
+	go func() { done <- s.Send(context.Background()) }()
+	waitFor(t, "ZRQINIT sent", func() bool { return len(out.Bytes()) > 0 })
+	in.Write([]byte{XOFF})
+	waitFor(t, "XOFF observed", s.tw.wire.flow.xoff.Load)
+
+	start := time.Now()
+	if err := s.Abort(); err != nil {
+		t.Fatalf("Abort = %v", err)
+	}
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrLocalAbort) {
+			t.Fatalf("Send = %v, want ErrLocalAbort", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Send still running 2s after Abort")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("abort took %v behind the XOFF", elapsed)
+	}
+	if got := out.Bytes(); !bytes.HasSuffix(got, abortSequence) {
+		t.Fatalf("output ends %q, want the abort sequence", got[max(0, len(got)-len(abortSequence)):])
+	}
+}
+
+// TestPumpReaderStop checks the pump gives the line back when stopped: bytes
+// arriving afterwards are the caller's, not swallowed by the goroutine.
+func TestPumpReaderStop(t *testing.T) {
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	p := newPumpReader(local, nil)
+
+	go remote.Write([]byte("zmodem"))
+	buf := make([]byte, 16)
+	n, err := p.Read(buf)
+	if err != nil || string(buf[:n]) != "zmodem" {
+		t.Fatalf("pumped Read = %q, %v; want %q", buf[:n], err, "zmodem")
+	}
+
+	p.stop()
+	go remote.Write([]byte("shell"))
+	local.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err = local.Read(buf)
+	if err != nil || string(buf[:n]) != "shell" {
+		t.Fatalf("transport Read after stop = %q, %v; want %q", buf[:n], err, "shell")
+	}
+	local.SetReadDeadline(time.Time{})
+
+	p.start()
+	go remote.Write([]byte("again"))
+	p.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err = p.Read(buf)
+	if err != nil || string(buf[:n]) != "again" {
+		t.Fatalf("pumped Read after restart = %q, %v; want %q", buf[:n], err, "again")
+	}
+	p.stop()
+}
+
+func TestLoopbackSoftwareFlowControl(t *testing.T) {
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+
+	content := bytes.Repeat([]byte("flow controlled \x11\x13 payload\n"), 2000)
+	sh := newTestHandler()
+	sh.filesToSend = []*FileOffer{{Name: "flow.txt", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	rh := newTestHandler()
+
+	cfg := &Config{SoftwareFlowControl: true, Logger: discardLogger()}
+	sender := NewSession(senderT, sh, cfg)
+	receiver := NewSession(receiverT, rh, cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer senderClose(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer receiverClose(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send=%v recv=%v", sendErr, recvErr)
+	}
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	if got := rh.receivedFiles["flow.txt"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("content mismatch")
+	}
+}
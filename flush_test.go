@@ -0,0 +1,227 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flushRecorder is a flushing transport that records how much had been
+// written at each Flush.
+type flushRecorder struct {
+	bytes.Buffer
+	flushedAt []int
+}
+
+func (f *flushRecorder) Read([]byte) (int, error) { return 0, io.EOF }
+
+func (f *flushRecorder) Flush() error {
+	f.flushedAt = append(f.flushedAt, f.Len())
+	return nil
+}
+
+func TestTransportFlushAtFrameBoundaries(t *testing.T) {
+	rec := &flushRecorder{}
+	s := NewSession(rec, newTestHandler(), &Config{Logger: discardLogger()})
+	data := []byte("payload")
+
+	steps := []struct {
+		name    string
+		send    func() error
+		flushes int
+	}{
+		{"hex header", func() error { return s.sendHexHeader(makeHeader(ZRINIT)) }, 1},
+		{"bin header", func() error { return s.sendBinHeader(makePosHeader(ZACK, 0)) }, 2},
+		// ZDATA and its ZCRCG subpackets wait in the buffer for the next
+		// frame boundary.
+		{"ZDATA header", func() error { return s.sendBinHeader(makePosHeader(ZDATA, 0)) }, 2},
+		{"ZCRCG subpacket", func() error { return s.sendSubpacket(data, ZCRCG) }, 2},
+		{"ZCRCQ subpacket", func() error { return s.sendSubpacket(data, ZCRCQ) }, 3},
+		{"ZCRCW subpacket", func() error { return s.sendSubpacket(data, ZCRCW) }, 4},
+		{"ZCRCE subpacket", func() error { return s.sendSubpacket(data, ZCRCE) }, 5},
+	}
+	for _, st := range steps {
+		if err := st.send(); err != nil {
+			t.Fatalf("%s: %v", st.name, err)
+		}
+		if len(rec.flushedAt) != st.flushes {
+			t.Fatalf("after %s: %d transport flushes, want %d", st.name, len(rec.flushedAt), st.flushes)
+		}
+		// A flush must come after the frame's bytes reached the transport.
+		if last := rec.flushedAt[len(rec.flushedAt)-1]; st.name != "ZDATA header" && st.name != "ZCRCG subpacket" && last != rec.Len() {
+			t.Fatalf("after %s: flushed at %d of %d written bytes", st.name, last, rec.Len())
+		}
+	}
+}
+
+func TestTransportFlushDisabled(t *testing.T) {
+	rec := &flushRecorder{}
+	s := NewSession(rec, newTestHandler(), &Config{DisableTransportFlush: true, Logger: discardLogger()})
+	if err := s.sendHexHeader(makeHeader(ZRINIT)); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.sendSubpacket([]byte("x"), ZCRCW); err != nil {
+		t.Fatal(err)
+	}
+	if len(rec.flushedAt) != 0 {
+		t.Fatalf("%d transport flushes with DisableTransportFlush", len(rec.flushedAt))
+	}
+	if rec.Len() == 0 {
+		t.Fatal("nothing written")
+	}
+}
+
+// nagleWriter holds written bytes until Flush or until delay has passed since
+// the first unsent byte, like a transport coalescing small writes.
+type nagleWriter struct {
+	mu      sync.Mutex
+	w       io.Writer
+	delay   time.Duration
+	pending []byte
+	timer   *time.Timer
+}
+
+func (n *nagleWriter) Write(p []byte) (int, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.pending = append(n.pending, p...)
+	if n.timer == nil {
+		n.timer = time.AfterFunc(n.delay, func() { n.Flush() })
+	}
+	return len(p), nil
+}
+
+func (n *nagleWriter) Flush() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.timer != nil {
+		n.timer.Stop()
+		n.timer = nil
+	}
+	if len(n.pending) == 0 {
+		return nil
+	}
+	_, err := n.w.Write(n.pending)
+	n.pending = nil
+	return err
+}
+
+type nagleTransport struct {
+	io.Reader
+	*nagleWriter
+}
+
+// nagleTransfer sends a small file over Nagle-style links in both directions
+// and returns how long the whole session took.
+func nagleTransfer(t *testing.T, disableFlush bool) time.Duration {
+	t.Helper()
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+	const delay = 40 * time.Millisecond
+	sw := &nagleWriter{w: w1, delay: delay}
+	rw := &nagleWriter{w: w2, delay: delay}
+
+	content := []byte("a handshake-dominated small file")
+	sh := newTestHandler()
+	sh.filesToSend = []*FileOffer{{Name: "small.txt", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	rh := newTestHandler()
+	cfg := &Config{DisableTransportFlush: disableFlush, Logger: discardLogger()}
+	sender := NewSession(&nagleTransport{Reader: r2, nagleWriter: sw}, sh, cfg)
+	receiver := NewSession(&nagleTransport{Reader: r1, nagleWriter: rw}, rh, cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	start := time.Now()
+	wg.Add(2)
+	go func() { defer wg.Done(); defer w1.Close(); defer sw.Flush(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer w2.Close(); defer rw.Flush(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+	elapsed := time.Since(start)
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send=%v recv=%v", sendErr, recvErr)
+	}
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	if got := rh.receivedFiles["small.txt"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("content mismatch")
+	}
+	return elapsed
+}
+
+func TestTransportFlushHandshakeLatency(t *testing.T) {
+	flushed := nagleTransfer(t, false)
+	held := nagleTransfer(t, true)
+	t.Logf("session time over a 40ms Nagle link: %v with frame flushes, %v without", flushed, held)
+	if flushed*2 > held {
+		t.Fatalf("frame flushes did not cut handshake latency: %v vs %v", flushed, held)
+	}
+}
+
+// latencyWriter charges a fixed cost per Write, like a syscall and a packet
+// on a TCP link, and counts the writes.
+type latencyWriter struct {
+	w      io.Writer
+	cost   time.Duration
+	writes int
+}
+
+func (l *latencyWriter) Write(p []byte) (int, error) {
+	l.writes++
+	time.Sleep(l.cost)
+	return l.w.Write(p)
+}
+
+// streamTransfer sends a 256 KB file in 1 KB blocks over a link with a per-write
+// cost and returns the sender's write count and the session time.
+func streamTransfer(t *testing.T, batch bool) (int, time.Duration) {
+	t.Helper()
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+	lw := &latencyWriter{w: w1, cost: 100 * time.Microsecond}
+
+	content := make([]byte, 256*1024)
+	for i := range content {
+		content[i] = byte(i * 13)
+	}
+	sh := newTestHandler()
+	sh.filesToSend = []*FileOffer{{Name: "stream.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	rh := newTestHandler()
+	cfg := &Config{MaxBlockSize: 1024, Logger: discardLogger()}
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: lw}, sh, cfg)
+	sender.tw.batchData = batch
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, rh, cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	start := time.Now()
+	wg.Add(2)
+	go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+	elapsed := time.Since(start)
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send=%v recv=%v", sendErr, recvErr)
+	}
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	if got := rh.receivedFiles["stream.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("content mismatch")
+	}
+	return lw.writes, elapsed
+}
+
+func TestZCRCGBatchedWrites(t *testing.T) {
+	batched, batchedTime := streamTransfer(t, true)
+	single, singleTime := streamTransfer(t, false)
+	t.Logf("sender writes: %d batched (%v), %d flushing every subpacket (%v)", batched, batchedTime, single, singleTime)
+	if batched*2 > single {
+		t.Fatalf("batching left %d writes against %d", batched, single)
+	}
+}
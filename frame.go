@@ -1,8 +1,11 @@
 package zmodem
 
 import (
+	"context"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"log/slog"
 )
 
 // Header represents a ZMODEM frame header.
@@ -53,15 +56,66 @@ func makePosHeader(frameType byte, pos int64) Header {
 	return h
 }
 
+// FrameWriter encodes ZMODEM frame headers and data subpackets onto an
+// io.Writer. It is the encoder a Session itself uses, exposed for protocol
+// tooling (analyzers, conformance drivers) that needs to put individual frames
+// on the wire. Each Write method hands its whole frame to the underlying
+// writer before returning. A FrameWriter is not safe for concurrent use.
+type FrameWriter struct {
+	tw *transportWriter
+}
+
+// NewFrameWriter returns a FrameWriter that writes to w, escaping control
+// characters according to mode.
+func NewFrameWriter(w io.Writer, mode EscapeMode) *FrameWriter {
+	return &FrameWriter{tw: newTransportWriter(w, mode)}
+}
+
+// FrameReader decodes ZMODEM frame headers and data subpackets from an
+// io.Reader. It is the decoder a Session itself uses: it skips line noise
+// before a header (up to the default GarbageThreshold), drops XON/XOFF unless
+// built for EscapeMinimal, and reports a peer's CAN abort sequence as
+// ErrAborted. Reads are buffered, so it may consume input beyond the frame it
+// returns. A FrameReader is not safe for concurrent use.
+type FrameReader struct {
+	tr *transportReader
+}
+
+// NewFrameReader returns a FrameReader that reads from r, expecting the
+// peer's escaping to follow mode.
+func NewFrameReader(r io.Reader, mode EscapeMode) *FrameReader {
+	var c Config
+	c.defaults()
+	return &FrameReader{tr: newTransportReader(r, c.GarbageThreshold, 0, mode != EscapeMinimal, slog.New(slog.DiscardHandler))}
+}
+
 // sendHexHeader sends a HEX-encoded frame header.
-// Format: ZPAD ZPAD ZDLE ZHEX <type> <data[0..3]> <crc16> CR LF [XON]
-// All values as 2 lowercase hex digits. Always CRC-16.
 func (s *Session) sendHexHeader(hdr Header) error {
-	s.logger.Debug("send hex header", "type", frameTypeName(hdr.Type), "data", fmt.Sprintf("%v", hdr.Data))
+	if s.debug() {
+		s.logger.Debug("send hex header", "type", frameTypeName(hdr.Type), "data", fmt.Sprintf("%v", hdr.Data))
+	}
+	s.txEnc = ZHEX
+	hdr.Encoding = ZHEX
+	s.txHdr = hdr
+	fw := FrameWriter{tw: s.tw}
+	err := fw.WriteHexHeader(hdr)
+	if s.cfg.FrameTrace != nil {
+		s.traceSent(hdr, -1, 0, err)
+	}
+	return err
+}
+
+// hexHeaderPrefix starts every hex header. A package-level slice, so writing
+// it allocates nothing.
+var hexHeaderPrefix = []byte{ZPAD, ZPAD, ZDLE, ZHEX}
 
-	tw := s.tw
+// WriteHexHeader writes a HEX-encoded frame header.
+// Format: ZPAD ZPAD ZDLE ZHEX <type> <data[0..3]> <crc16> CR LF [XON]
+// All values as 2 lowercase hex digits. Always CRC-16.
+func (fw *FrameWriter) WriteHexHeader(hdr Header) error {
+	tw := fw.tw
 	// Header prefix
-	if err := tw.writeRaw([]byte{ZPAD, ZPAD, ZDLE, ZHEX}); err != nil {
+	if err := tw.writeRaw(hexHeaderPrefix); err != nil {
 		return err
 	}
 
@@ -103,27 +157,47 @@ func (s *Session) sendHexHeader(hdr Header) error {
 		}
 	}
 
-	return tw.Flush()
+	return tw.flushFrame()
 }
 
 // sendBinHeader sends a binary frame header (ZBIN or ZBIN32 depending on session CRC mode).
-// Format: ZPAD ZDLE <enc> <type-escaped> <data[0..3]-escaped> <crc-escaped>
 func (s *Session) sendBinHeader(hdr Header) error {
-	s.logger.Debug("send bin header", "type", frameTypeName(hdr.Type),
-		"data", fmt.Sprintf("%v", hdr.Data), "crc32", s.useCRC32)
+	if s.debug() {
+		s.logger.Debug("send bin header", "type", frameTypeName(hdr.Type),
+			"data", fmt.Sprintf("%v", hdr.Data), "crc32", s.useCRC32)
+	}
+	s.txEnc = ZBIN
+	if s.useCRC32 {
+		s.txEnc = ZBIN32
+	}
+	hdr.Encoding = s.txEnc
+	s.txHdr = hdr
+	fw := FrameWriter{tw: s.tw}
+	err := fw.WriteBinHeader(hdr, s.useCRC32)
+	if s.cfg.FrameTrace != nil {
+		s.traceSent(hdr, -1, 0, err)
+	}
+	return err
+}
 
-	tw := s.tw
+// WriteBinHeader writes a binary frame header, ZBIN32 (CRC-32) if crc32 is
+// set and ZBIN (CRC-16) otherwise.
+// Format: ZPAD ZDLE <enc> <type-escaped> <data[0..3]-escaped> <crc-escaped>
+func (fw *FrameWriter) WriteBinHeader(hdr Header, crc32 bool) error {
+	tw := fw.tw
 
 	var enc byte
-	if s.useCRC32 {
+	if crc32 {
 		enc = ZBIN32
 	} else {
 		enc = ZBIN
 	}
 
 	// Header prefix (not escaped)
-	if err := tw.writeRaw([]byte{ZPAD, ZDLE, enc}); err != nil {
-		return err
+	for _, b := range [...]byte{ZPAD, ZDLE, enc} {
+		if err := tw.writeByte(b); err != nil {
+			return err
+		}
 	}
 
 	// Build the 5-byte payload: type + data[0..3]
@@ -131,24 +205,26 @@ func (s *Session) sendBinHeader(hdr Header) error {
 	payload[0] = hdr.Type
 	copy(payload[1:], hdr.Data[:])
 
-	if s.useCRC32 {
-		crc := crc32Calc(payload[:])
-		// Write payload escaped
-		if err := tw.writeEscaped(payload[:]); err != nil {
+	// Write payload escaped. Byte by byte: a slice of payload handed to the
+	// buffered writer would move it to the heap.
+	for _, b := range payload {
+		if err := tw.writeEscapedByte(b); err != nil {
 			return err
 		}
+	}
+
+	if crc32 {
+		// Byte-wise too: crc32Calc would move payload to the heap.
+		var crc uint32
+		for _, b := range payload {
+			crc = crc32UpdateByte(crc, b)
+		}
 		// Write CRC-32 escaped (little-endian)
-		var crcBuf [4]byte
-		binary.LittleEndian.PutUint32(crcBuf[:], crc)
-		if err := tw.writeEscaped(crcBuf[:]); err != nil {
+		if err := tw.writeEscapedCRC32(crc); err != nil {
 			return err
 		}
 	} else {
 		crc := crc16Calc(payload[:])
-		// Write payload escaped
-		if err := tw.writeEscaped(payload[:]); err != nil {
-			return err
-		}
 		// Write CRC-16 escaped (big-endian: high byte first)
 		if err := tw.writeEscapedByte(byte(crc >> 8)); err != nil {
 			return err
@@ -158,7 +234,23 @@ func (s *Session) sendBinHeader(hdr Header) error {
 		}
 	}
 
-	return tw.Flush()
+	// A header that introduces a data subpacket goes out in the same Write as
+	// (the start of) that subpacket, which flushes them both: a Session never
+	// sends one without the other, and a middlebox cannot split them.
+	if (tw.asm != nil || tw.batchData) && headerCarriesData(hdr.Type) {
+		return nil
+	}
+	return tw.flushFrame()
+}
+
+// headerCarriesData reports whether a frame type is always followed by a data
+// subpacket.
+func headerCarriesData(frameType byte) bool {
+	switch frameType {
+	case ZSINIT, ZFILE, ZDATA, ZCOMMAND:
+		return true
+	}
+	return false
 }
 
 // sendBinHeaderWithZnulls sends Znulls null bytes then a binary header.
@@ -174,57 +266,90 @@ func (s *Session) sendBinHeaderWithZnulls(hdr Header) error {
 }
 
 // recvHeader receives and decodes a frame header.
-// Auto-detects HEX/ZBIN/ZBIN32 encoding.
 func (s *Session) recvHeader() (Header, error) {
-	enc, err := s.tr.scanForPad()
+	if s.pending != nil {
+		hdr := *s.pending
+		s.pending = nil
+		s.rxEnc = hdr.Encoding
+		s.rxHdr = hdr
+		return hdr, nil
+	}
+	// Streamed subpackets may still be buffered (see WriteSubpacket): they go
+	// out before we wait for the peer, which may be waiting for them.
+	if s.tw.buffered() > 0 {
+		if err := s.tw.Flush(); err != nil {
+			return Header{}, err
+		}
+	}
+	fr := FrameReader{tr: s.tr}
+	hdr, err := fr.ReadHeader()
+	if s.cfg.FrameTrace != nil {
+		s.traceReceived(hdr, -1, 0, err)
+	}
 	if err != nil {
+		s.readError(err)
 		return Header{}, err
 	}
+	s.rxEnc = hdr.Encoding
+	s.rxHdr = hdr
 
-	var hdr Header
-	hdr.Encoding = enc
+	if s.debug() {
+		s.logger.Debug("recv header", "type", frameTypeName(hdr.Type),
+			"data", fmt.Sprintf("%v", hdr.Data), "encoding", fmt.Sprintf("0x%02x", hdr.Encoding))
+	}
 
+	// Warn about HyperTerminal extended types
+	if hdr.Type > ZSTDERR && hdr.Type <= maxFrameType {
+		s.logger.Warn("received HyperTerminal extended frame type",
+			"type", frameTypeName(hdr.Type), "code", hdr.Type)
+	}
+
+	return hdr, nil
+}
+
+// ReadHeader skips input up to the next frame start and decodes the header
+// that follows, auto-detecting HEX/ZBIN/ZBIN32 encoding (Header.Encoding).
+func (fr *FrameReader) ReadHeader() (Header, error) {
+	enc, err := fr.tr.scanForPad()
+	if err != nil {
+		return Header{}, err
+	}
+
+	var hdr Header
 	switch enc {
 	case ZHEX:
-		hdr, err = s.recvHexHeader()
+		hdr, err = fr.readHexHeader()
 	case ZBIN:
-		hdr, err = s.recvBinHeader(false)
+		hdr, err = fr.readBinHeader(false)
 	case ZBIN32:
-		hdr, err = s.recvBinHeader(true)
+		hdr, err = fr.readBinHeader(true)
 	default:
 		return Header{}, fmt.Errorf("%w: 0x%02x", errUnsupportedEnc, enc)
 	}
-
 	if err != nil {
 		return Header{}, err
 	}
 
-	s.tr.resetGarbage()
-	s.logger.Debug("recv header", "type", frameTypeName(hdr.Type),
-		"data", fmt.Sprintf("%v", hdr.Data), "encoding", fmt.Sprintf("0x%02x", enc))
-
-	// Warn about HyperTerminal extended types
-	if hdr.Type > ZSTDERR && hdr.Type <= maxFrameType {
-		s.logger.Warn("received HyperTerminal extended frame type",
-			"type", frameTypeName(hdr.Type), "code", hdr.Type)
-	}
-
+	fr.tr.resetGarbage()
 	return hdr, nil
 }
 
-// recvHexHeader reads a HEX-encoded header (after ZPAD ZPAD ZDLE ZHEX consumed).
-func (s *Session) recvHexHeader() (Header, error) {
+// readHexHeader reads a HEX-encoded header (after ZPAD ZPAD ZDLE ZHEX consumed).
+func (fr *FrameReader) readHexHeader() (Header, error) {
 	var hdr Header
 	hdr.Encoding = ZHEX
 
-	// Read type + 4 data bytes + 2 CRC bytes = 7 hex-encoded bytes
+	// Read type + 4 data bytes + 2 CRC bytes = 7 hex-encoded bytes, in one
+	// pass if the whole header is buffered.
 	var raw [7]byte
-	for i := range raw {
-		b, err := s.tr.readHex()
-		if err != nil {
-			return Header{}, fmt.Errorf("hex header read: %w", err)
+	if !fr.tr.peekHex(raw[:]) {
+		for i := range raw {
+			b, err := fr.tr.readHex()
+			if err != nil {
+				return Header{}, fmt.Errorf("hex header read: %w", err)
+			}
+			raw[i] = b
 		}
-		raw[i] = b
 	}
 
 	hdr.Type = raw[0]
@@ -232,44 +357,76 @@ func (s *Session) recvHexHeader() (Header, error) {
 
 	// Verify CRC-16 (includes finalization)
 	if !crc16Verify(raw[:]) {
-		return Header{}, fmt.Errorf("zmodem: hex header CRC error for %s", frameTypeName(hdr.Type))
+		return Header{}, fmt.Errorf("zmodem: hex header %w for %s", errBadCRC, frameTypeName(hdr.Type))
 	}
 
-	// Read CR LF terminator (strip parity bits)
-	cr, err := s.tr.readByte()
-	if err != nil {
-		return Header{}, err
-	}
-	if cr&0x7f != 0x0d {
-		// Some implementations may send LF only
-		if cr&0x7f == 0x0a {
-			return hdr, nil
+	fr.readHexTerminator(hdr)
+
+	// XON may follow (except for ZACK/ZFIN) — consume if present.
+	// Only attempt if data is already buffered to avoid blocking.
+	if hdr.Type != ZACK && hdr.Type != ZFIN && fr.tr.r.Buffered() > 0 {
+		peek, err := fr.tr.r.Peek(1)
+		if err == nil && len(peek) > 0 && (peek[0]&0x7f) == XON {
+			_, _ = fr.tr.readByte() // consume XON
 		}
-		return Header{}, fmt.Errorf("zmodem: expected CR after hex header, got 0x%02x", cr)
 	}
 
-	lf, err := s.tr.readByte()
-	if err != nil {
-		return Header{}, err
+	return hdr, nil
+}
+
+// readHexTerminator consumes the line ending of a hex header whose CRC has
+// already verified. CR LF is standard (lrzsz sends CR LF|0x80), but old
+// implementations end the line with a bare CR or LF, or not at all, and go
+// straight on to the next frame; the header is good either way, so the
+// terminator is taken as far as it is there and anything else is left for the
+// next header hunt. Only the first byte is waited for; the rest is taken if
+// already buffered, and a straggler is skipped by the next hunt.
+func (fr *FrameReader) readHexTerminator(hdr Header) {
+	tr := fr.tr
+	b, ok := tr.peekLine(true)
+	if !ok {
+		// A read timeout or EOF: the header stands, the next read reports it.
+		return
 	}
-	if lf&0x7f != 0x0a {
-		return Header{}, fmt.Errorf("zmodem: expected LF after hex header CR, got 0x%02x", lf)
+	switch b & 0x7f {
+	case '\r':
+		tr.r.Discard(1)
+	case '\n':
+		tr.r.Discard(1)
+		fr.logTerminator(hdr, "bare LF")
+		return
+	default:
+		fr.logTerminator(hdr, "none")
+		return
 	}
 
-	// XON may follow (except for ZACK/ZFIN) — consume if present.
-	// Only attempt if data is already buffered to avoid blocking.
-	if hdr.Type != ZACK && hdr.Type != ZFIN && s.tr.r.Buffered() > 0 {
-		peek, err := s.tr.r.Peek(1)
-		if err == nil && len(peek) > 0 && (peek[0]&0x7f) == XON {
-			_, _ = s.tr.readByte() // consume XON
+	b, ok = tr.peekLine(false)
+	switch {
+	case !ok:
+		// The LF, if any, is still on its way.
+	case b&0x7f == '\n':
+		tr.r.Discard(1)
+	case b == 0:
+		// A telnet link not in binary mode sends a bare CR as CR NUL (RFC 854),
+		// which some servers apply to the header's CR whatever follows it: the
+		// terminator arrives as CR NUL, or CR NUL LF.
+		tr.r.Discard(1)
+		if b, ok = tr.peekLine(false); ok && b&0x7f == '\n' {
+			tr.r.Discard(1)
 		}
+	default:
+		fr.logTerminator(hdr, "bare CR")
 	}
+}
 
-	return hdr, nil
+func (fr *FrameReader) logTerminator(hdr Header, form string) {
+	if fr.tr.logger.Enabled(context.Background(), slog.LevelDebug) {
+		fr.tr.logger.Debug("nonstandard hex header terminator", "type", frameTypeName(hdr.Type), "terminator", form)
+	}
 }
 
-// recvBinHeader reads a binary-encoded header (after ZPAD ZDLE ZBIN/ZBIN32 consumed).
-func (s *Session) recvBinHeader(crc32mode bool) (Header, error) {
+// readBinHeader reads a binary-encoded header (after ZPAD ZDLE ZBIN/ZBIN32 consumed).
+func (fr *FrameReader) readBinHeader(crc32mode bool) (Header, error) {
 	var hdr Header
 	if crc32mode {
 		hdr.Encoding = ZBIN32
@@ -280,7 +437,7 @@ func (s *Session) recvBinHeader(crc32mode bool) (Header, error) {
 	// Read type + 4 data bytes via ZDLE decoding
 	var payload [5]byte
 	for i := range payload {
-		b, frameEnd, err := s.tr.zdlRead()
+		b, frameEnd, err := fr.tr.zdlRead()
 		if err != nil {
 			return Header{}, fmt.Errorf("bin header read: %w", err)
 		}
@@ -297,7 +454,7 @@ func (s *Session) recvBinHeader(crc32mode bool) (Header, error) {
 		// Read 4-byte CRC-32
 		var crcBuf [4]byte
 		for i := range crcBuf {
-			b, frameEnd, err := s.tr.zdlRead()
+			b, frameEnd, err := fr.tr.zdlRead()
 			if err != nil {
 				return Header{}, fmt.Errorf("bin32 header CRC read: %w", err)
 			}
@@ -311,13 +468,13 @@ func (s *Session) recvBinHeader(crc32mode bool) (Header, error) {
 		copy(all[:5], payload[:])
 		copy(all[5:], crcBuf[:])
 		if !crc32Verify(all[:]) {
-			return Header{}, fmt.Errorf("zmodem: bin32 header CRC error for %s", frameTypeName(hdr.Type))
+			return Header{}, fmt.Errorf("zmodem: bin32 header %w for %s", errBadCRC, frameTypeName(hdr.Type))
 		}
 	} else {
 		// Read 2-byte CRC-16 (big-endian)
 		var crcBuf [2]byte
 		for i := range crcBuf {
-			b, frameEnd, err := s.tr.zdlRead()
+			b, frameEnd, err := fr.tr.zdlRead()
 			if err != nil {
 				return Header{}, fmt.Errorf("bin header CRC read: %w", err)
 			}
@@ -332,7 +489,7 @@ func (s *Session) recvBinHeader(crc32mode bool) (Header, error) {
 		all[5] = crcBuf[0]
 		all[6] = crcBuf[1]
 		if !crc16Verify(all[:]) {
-			return Header{}, fmt.Errorf("zmodem: bin header CRC error for %s", frameTypeName(hdr.Type))
+			return Header{}, fmt.Errorf("zmodem: bin header %w for %s", errBadCRC, frameTypeName(hdr.Type))
 		}
 	}
 
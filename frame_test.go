@@ -2,8 +2,15 @@ package zmodem
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"math/rand/v2"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 func TestHexHeaderRoundTrip(t *testing.T) {
@@ -190,3 +197,453 @@ func TestHexHeaderLowercaseDigits(t *testing.T) {
 		}
 	}
 }
+
+func TestFrameWriterReaderHeaderRoundTrip(t *testing.T) {
+	// The public frame layer over a plain pipe: what FrameWriter writes,
+	// FrameReader decodes, in every header encoding and escape mode.
+	hdrs := []Header{
+		makeHeader(ZRQINIT),
+		makePosHeader(ZRINIT, 0),
+		makePosHeader(ZRPOS, 0x12345678),
+		makePosHeader(ZDATA, 0x18131191), // every byte needs escaping
+		makeHeader(ZFIN),
+	}
+	encodings := []struct {
+		name  string
+		enc   byte
+		write func(*FrameWriter, Header) error
+	}{
+		{"hex", ZHEX, (*FrameWriter).WriteHexHeader},
+		{"bin16", ZBIN, func(fw *FrameWriter, h Header) error { return fw.WriteBinHeader(h, false) }},
+		{"bin32", ZBIN32, func(fw *FrameWriter, h Header) error { return fw.WriteBinHeader(h, true) }},
+	}
+	for _, mode := range []EscapeMode{EscapeStandard, EscapeAll, EscapeMinimal} {
+		for _, e := range encodings {
+			t.Run(fmt.Sprintf("%s/mode%d", e.name, mode), func(t *testing.T) {
+				pr, pw := io.Pipe()
+				fw := NewFrameWriter(pw, mode)
+				fr := NewFrameReader(pr, mode)
+				go func() {
+					for _, h := range hdrs {
+						if err := e.write(fw, h); err != nil {
+							pw.CloseWithError(err)
+							return
+						}
+					}
+					pw.Close()
+				}()
+				for _, want := range hdrs {
+					got, err := fr.ReadHeader()
+					if err != nil {
+						t.Fatalf("ReadHeader(%s): %v", want, err)
+					}
+					if got.Type != want.Type || got.Data != want.Data || got.Encoding != e.enc {
+						t.Fatalf("got %s enc 0x%02x, want %s enc 0x%02x", got, got.Encoding, want, e.enc)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestFrameReaderSkipsNoiseAndSeesAbort(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString("login: rz\r\n")
+	NewFrameWriter(&buf, EscapeStandard).WriteHexHeader(makeHeader(ZRINIT))
+	buf.Write(abortSequence)
+
+	fr := NewFrameReader(&buf, EscapeStandard)
+	if got, err := fr.ReadHeader(); err != nil || got.Type != ZRINIT {
+		t.Fatalf("ReadHeader = %s, %v; want ZRINIT", got, err)
+	}
+	if _, err := fr.ReadHeader(); !errors.Is(err, ErrAborted) {
+		t.Fatalf("ReadHeader after abort sequence = %v, want ErrAborted", err)
+	}
+}
+
+func TestHexHeaderTelnetCRNUL(t *testing.T) {
+	// Telnet in non-binary mode turns a bare CR into CR NUL (RFC 854); some
+	// servers do it to the hex header's CR LF too.
+	for _, tc := range []struct {
+		name string
+		term string
+	}{
+		{"CR NUL", "\r\x00"},
+		{"CR NUL LF", "\r\x00\n"},
+		{"CR NUL LF XON", "\r\x00\n\x11"},
+		{"CR NUL XON", "\r\x00\x11"},
+		{"parity CR NUL", "\x8d\x00"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var hdr bytes.Buffer
+			NewFrameWriter(&hdr, EscapeStandard).WriteHexHeader(makePosHeader(ZRPOS, 4096))
+			raw := bytes.TrimRight(hdr.Bytes(), "\r\n\x11")
+
+			var buf bytes.Buffer
+			for range 2 {
+				buf.Write(raw)
+				buf.WriteString(tc.term)
+			}
+			fr := NewFrameReader(&buf, EscapeStandard)
+			for i := range 2 {
+				got, err := fr.ReadHeader()
+				if err != nil || got.Type != ZRPOS || got.Position() != 4096 {
+					t.Fatalf("header %d: %s, %v; want ZRPOS 4096", i, got, err)
+				}
+			}
+			if fr.tr.garbageCount != 0 {
+				t.Errorf("terminator charged %d garbage bytes", fr.tr.garbageCount)
+			}
+			if buf.Len() != 0 || fr.tr.r.Buffered() != 0 {
+				t.Errorf("%d terminator bytes left unread", buf.Len()+fr.tr.r.Buffered())
+			}
+		})
+	}
+}
+
+func TestScanForPadSkipsNULPadding(t *testing.T) {
+	// NULs, with or without parity, are padding and cost nothing wherever
+	// they fall; anything else is noise. The input holds two bytes of noise,
+	// so a budget of two finds the frame and a budget of one does not.
+	const in = "\x00x\x00\x80y\x00\x00*\x18A"
+	tr := newTransportReader(strings.NewReader(in), 2, 0, true, slog.Default())
+	if enc, err := tr.scanForPad(); err != nil || enc != ZBIN {
+		t.Fatalf("scanForPad = 0x%02x, %v; want ZBIN", enc, err)
+	}
+	tr = newTransportReader(strings.NewReader(in), 1, 0, true, slog.Default())
+	if _, err := tr.scanForPad(); !errors.Is(err, errGarbageOverflow) {
+		t.Fatalf("scanForPad with budget 1 = %v, want errGarbageOverflow", err)
+	}
+
+	// Past maxPadding a hunt, NULs are charged like any other byte.
+	flood := strings.Repeat("\x00", maxPadding+10) + "*\x18A"
+	tr = newTransportReader(strings.NewReader(flood), 5, 0, true, slog.Default())
+	if _, err := tr.scanForPad(); !errors.Is(err, errGarbageOverflow) {
+		t.Fatalf("scanForPad over %d NULs = %v, want errGarbageOverflow", maxPadding+10, err)
+	}
+}
+
+// TestHexHeaderPeekMatchesIncremental parses generated hex headers, intact and
+// mangled, once fully buffered (the Peek fast path) and once delivered a byte
+// at a time (digit by digit), and requires the same header or error from both.
+func TestHexHeaderPeekMatchesIncremental(t *testing.T) {
+	rng := rand.New(rand.NewPCG(13, 14))
+	mangle := []struct {
+		name string
+		f    func(wire []byte) []byte
+	}{
+		{"intact", func(w []byte) []byte { return w }},
+		{"uppercase", func(w []byte) []byte { return bytes.ToUpper(w) }},
+		{"parity", func(w []byte) []byte {
+			w[4+rng.IntN(14)] |= 0x80
+			return w
+		}},
+		{"bad digit", func(w []byte) []byte {
+			w[4+rng.IntN(14)] = byte(rng.IntN(256))
+			return w
+		}},
+		{"CRC error", func(w []byte) []byte {
+			i := 4 + rng.IntN(14)
+			w[i] = "0123456789abcdef"[(strings.IndexByte("0123456789abcdef", w[i])+1)%16]
+			return w
+		}},
+		{"XON in digits", func(w []byte) []byte {
+			i := 4 + rng.IntN(14)
+			return append(w[:i:i], append([]byte{XON}, w[i:]...)...)
+		}},
+		{"CAN in digits", func(w []byte) []byte {
+			w[4+rng.IntN(14)] = CAN
+			return w
+		}},
+		{"CR NUL", func(w []byte) []byte { return append(w[:18:18], '\r', 0) }},
+		{"LF only", func(w []byte) []byte { return append(w[:18:18], '\n') }},
+		{"bad terminator", func(w []byte) []byte { return append(w[:18:18], 'x', 'y') }},
+		{"truncated", func(w []byte) []byte { return w[:4+rng.IntN(16)] }},
+	}
+	for _, m := range mangle {
+		for i := range 200 {
+			hdr := Header{Type: byte(rng.IntN(20))}
+			for j := range hdr.Data {
+				hdr.Data[j] = byte(rng.Uint32())
+			}
+			var buf bytes.Buffer
+			if err := NewFrameWriter(&buf, EscapeStandard).WriteHexHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			wire := m.f(buf.Bytes())
+
+			fast, fastErr := NewFrameReader(bytes.NewReader(wire), EscapeStandard).ReadHeader()
+			slow, slowErr := NewFrameReader(iotest.OneByteReader(bytes.NewReader(wire)), EscapeStandard).ReadHeader()
+			if fast != slow || fmt.Sprint(fastErr) != fmt.Sprint(slowErr) {
+				t.Fatalf("%s #%d % x:\n fast %+v, %v\n slow %+v, %v", m.name, i, wire, fast, fastErr, slow, slowErr)
+			}
+			if m.name == "intact" && (fastErr != nil || fast.Type != hdr.Type || fast.Data != hdr.Data) {
+				t.Fatalf("intact #%d: got %+v, %v; want %+v", i, fast, fastErr, hdr)
+			}
+		}
+	}
+}
+
+func TestPeekHexNeedsWholeHeader(t *testing.T) {
+	digits := "0a000000001234"
+	var raw [7]byte
+	for _, tc := range []struct {
+		in   string
+		want bool
+	}{
+		{digits + "\r\n", true},
+		{digits + "\r", false},         // terminator not here yet
+		{digits[:13] + "g\r\n", false}, // left to readHex to report
+	} {
+		tr := newTransportReader(strings.NewReader(tc.in), 1200, 0, true, slog.Default())
+		tr.r.Peek(len(tc.in))
+		if got := tr.peekHex(raw[:]); got != tc.want {
+			t.Errorf("%q: peekHex = %v, want %v", tc.in, got, tc.want)
+		}
+		if !tc.want && tr.r.Buffered() != len(tc.in) {
+			t.Errorf("%q: consumed input without decoding it", tc.in)
+		}
+	}
+	if raw != [7]byte{0x0a, 0, 0, 0, 0, 0x12, 0x34} {
+		t.Errorf("decoded % x", raw)
+	}
+}
+
+// TestHeaderDebugLogs checks the header trace a Debug logger gets, and that
+// nothing is logged without one.
+func TestHeaderDebugLogs(t *testing.T) {
+	for _, level := range []slog.Level{slog.LevelDebug, slog.LevelInfo} {
+		var wire, logs bytes.Buffer
+		logger := slog.New(slog.NewTextHandler(&logs, &slog.HandlerOptions{
+			Level: level,
+			ReplaceAttr: func(_ []string, a slog.Attr) slog.Attr {
+				if a.Key == slog.TimeKey {
+					return slog.Attr{}
+				}
+				return a
+			},
+		}))
+		s := &Session{
+			tw:     newTransportWriter(&wire, EscapeStandard),
+			tr:     newTransportReader(&wire, 1200, 0, true, logger),
+			logger: logger,
+		}
+		if err := s.sendHexHeader(makePosHeader(ZRPOS, 1234)); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.sendBinHeader(makePosHeader(ZDATA, 1234)); err != nil {
+			t.Fatal(err)
+		}
+		for range 2 {
+			if _, err := s.recvHeader(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		want := ""
+		if level == slog.LevelDebug {
+			want = `level=DEBUG msg="send hex header" type=ZRPOS data="[210 4 0 0]"
+level=DEBUG msg="send bin header" type=ZDATA data="[210 4 0 0]" crc32=false
+level=DEBUG msg="recv header" type=ZRPOS data="[210 4 0 0]" encoding=0x42
+level=DEBUG msg="recv header" type=ZDATA data="[210 4 0 0]" encoding=0x41
+`
+		}
+		if logs.String() != want {
+			t.Errorf("level %v: logged\n%s\nwant\n%s", level, logs.String(), want)
+		}
+	}
+}
+
+// TestZRINITWindowMatchesLrzsz pins the ZRINIT that lrzsz's rz emits for a
+// 4096-byte receive buffer with CRC-32 (ZP0=0x00 ZP1=0x10, ZF0=CANFC32|
+// CANFDX|CANOVIO): the sender must read the window from it, and our receiver
+// must put the window in the same bytes.
+func TestZRINITWindowMatchesLrzsz(t *testing.T) {
+	lrzsz := []byte("**\x18B0100100023fd33\r\x8a\x11")
+
+	var buf bytes.Buffer
+	buf.Write(lrzsz)
+	s := NewSession(&buf, nil, &Config{WindowSize: 4096, Use32BitCRC: true})
+	hdr, err := s.recvHeader()
+	if err != nil {
+		t.Fatalf("recvHeader: %v", err)
+	}
+	if hdr.Type != ZRINIT {
+		t.Fatalf("type = %s, want ZRINIT", frameTypeName(hdr.Type))
+	}
+	s.processZRINIT(hdr)
+	if s.remoteWindowSize != 4096 {
+		t.Errorf("remote window = %d, want 4096", s.remoteWindowSize)
+	}
+	if s.remoteFlags != CANFC32|CANFDX|CANOVIO {
+		t.Errorf("remote flags = 0x%02x, want 0x%02x", s.remoteFlags, CANFC32|CANFDX|CANOVIO)
+	}
+
+	buf.Reset()
+	if err := s.sendZRINIT(); err != nil {
+		t.Fatalf("sendZRINIT: %v", err)
+	}
+	// Everything up to and including the CRC is fixed; the line ending is
+	// CR LF here and CR LF|0x80 from lrzsz, which both sides accept.
+	const hdrLen = 4 + 10 + 4
+	if got := buf.Bytes(); !bytes.Equal(got[:hdrLen], lrzsz[:hdrLen]) {
+		t.Errorf("ZRINIT = %q, lrzsz sends %q", got[:hdrLen], lrzsz[:hdrLen])
+	}
+}
+
+// hexHeaderBytes returns a hex header up to and including its CRC digits,
+// with the line ending left to the caller.
+func hexHeaderBytes(t *testing.T, hdr Header) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := NewFrameWriter(&buf, EscapeStandard).WriteHexHeader(hdr); err != nil {
+		t.Fatalf("WriteHexHeader: %v", err)
+	}
+	return buf.Bytes()[:4+14]
+}
+
+// TestHexHeaderTerminators: a header whose CRC verified is kept whatever line
+// ending follows it, and the next frame is read intact after it.
+func TestHexHeaderTerminators(t *testing.T) {
+	first := makePosHeader(ZRPOS, 4096)
+	second := makePosHeader(ZACK, 77)
+	for _, tc := range []struct {
+		name string
+		term string
+	}{
+		{"CR LF", "\r\n"},
+		{"CR LF|0x80", "\r\x8a"},
+		{"CR LF XON", "\r\n\x11"},
+		{"bare CR", "\r"},
+		{"bare CR with parity", "\x8d"},
+		{"bare LF", "\n"},
+		{"none", ""},
+		{"bare CR then XON", "\r\x11"},
+		{"CR NUL LF", "\r\x00\n"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var wire bytes.Buffer
+			wire.Write(hexHeaderBytes(t, first))
+			wire.WriteString(tc.term)
+			wire.Write(hexHeaderBytes(t, second))
+			wire.WriteString("\r\n")
+
+			fr := NewFrameReader(&wire, EscapeStandard)
+			for _, want := range []Header{first, second} {
+				got, err := fr.ReadHeader()
+				if err != nil {
+					t.Fatalf("ReadHeader: %v", err)
+				}
+				if got.Type != want.Type || got.Data != want.Data {
+					t.Fatalf("got %s %v, want %s %v", frameTypeName(got.Type), got.Data, frameTypeName(want.Type), want.Data)
+				}
+			}
+			if n := fr.tr.r.Buffered(); n != 0 || wire.Len() != 0 {
+				t.Fatalf("%d bytes left unread", n+wire.Len())
+			}
+		})
+	}
+}
+
+// TestHexHeaderTerminatorNotAwaited: a header ending in a bare CR with nothing
+// behind it is returned at once; the reader does not wait for an LF.
+func TestHexHeaderTerminatorNotAwaited(t *testing.T) {
+	r, w := bufferedPipe(4)
+	defer w.Close()
+	w.Write(append(hexHeaderBytes(t, makeHeader(ZRINIT)), '\r'))
+
+	fr := NewFrameReader(r, EscapeStandard)
+	done := make(chan error, 1)
+	go func() {
+		_, err := fr.ReadHeader()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("ReadHeader: %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("ReadHeader waited for a line feed that never comes")
+	}
+}
+
+// TestHexHeaderFlowControlInDigits: an XON or XOFF (with or without parity) a
+// modem slips in anywhere among the digits or the line ending is skipped.
+func TestHexHeaderFlowControlInDigits(t *testing.T) {
+	hdr := makePosHeader(ZRPOS, 0x12345678)
+	next := makePosHeader(ZACK, 1)
+	body := append(hexHeaderBytes(t, hdr), '\r', '\n')
+	for _, flow := range []byte{XON, XOFF, XON | 0x80, XOFF | 0x80} {
+		// After the ZPAD ZPAD ZDLE 'B' lead-in: every digit and the CR.
+		for pos := 4; pos <= len(body)-1; pos++ {
+			var wire bytes.Buffer
+			wire.Write(body[:pos])
+			wire.WriteByte(flow)
+			wire.Write(body[pos:])
+			wire.Write(hexHeaderBytes(t, next))
+			wire.WriteString("\r\n")
+
+			fr := NewFrameReader(&wire, EscapeStandard)
+			for _, want := range []Header{hdr, next} {
+				got, err := fr.ReadHeader()
+				if err != nil {
+					t.Fatalf("0x%02x before byte %d: %v", flow, pos, err)
+				}
+				if got.Type != want.Type || got.Data != want.Data {
+					t.Fatalf("0x%02x before byte %d: got %s %v, want %s %v", flow, pos,
+						frameTypeName(got.Type), got.Data, frameTypeName(want.Type), want.Data)
+				}
+			}
+		}
+	}
+}
+
+// FuzzReadHeader reads headers from arbitrary input, in arbitrary read
+// chunks, until it runs out: it must not panic or stall, and every header it
+// returns must come back unchanged through the writer for its encoding.
+func FuzzReadHeader(f *testing.F) {
+	var enc bytes.Buffer
+	fw := NewFrameWriter(&enc, EscapeStandard)
+	fw.WriteHexHeader(makePosHeader(ZRINIT, 0x23000400))
+	fw.WriteBinHeader(makePosHeader(ZDATA, 0x18131191), false)
+	fw.WriteBinHeader(makePosHeader(ZEOF, 0x7fffffff), true)
+	fw.WriteHexHeader(Header{Type: ZFIN})
+	f.Add(enc.Bytes(), uint8(255))
+	f.Add(enc.Bytes(), uint8(0))
+	f.Add([]byte("noise**\x18B0100000023be50\r\x8a\x11**\x18C\x0a\x00\x00\x00\x00"), uint8(3))
+	f.Add([]byte("**\x18B0800000000022d\r\n**\x18A\x18\x18\x18\x18\x18\x08\x08"), uint8(1))
+	f.Add([]byte("*\x00*\x18B\x11ff\x91ffffffffffff\r\x00\n"), uint8(6))
+	f.Add([]byte("**\x18Z**\x18B"), uint8(2))
+
+	f.Fuzz(func(t *testing.T, stream []byte, chunk uint8) {
+		fr := NewFrameReader(&chunkReader{r: bytes.NewReader(stream), n: int(chunk) + 1}, EscapeStandard)
+		for range len(stream) + 1 {
+			hdr, err := fr.ReadHeader()
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrAborted) {
+				return
+			}
+			if err != nil {
+				continue
+			}
+
+			var out bytes.Buffer
+			fw := NewFrameWriter(&out, EscapeStandard)
+			switch hdr.Encoding {
+			case ZHEX:
+				err = fw.WriteHexHeader(hdr)
+			case ZBIN, ZBIN32:
+				err = fw.WriteBinHeader(hdr, hdr.Encoding == ZBIN32)
+			default:
+				t.Fatalf("header %s with encoding 0x%02x", frameTypeName(hdr.Type), hdr.Encoding)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := NewFrameReader(&out, EscapeStandard).ReadHeader()
+			if err != nil || got != hdr {
+				t.Fatalf("read %+v, written back it reads as %+v, %v", hdr, got, err)
+			}
+		}
+		t.Fatalf("%d bytes read as more than %d headers", len(stream), len(stream))
+	})
+}
@@ -0,0 +1,148 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fuzzConn plays fixed bytes to a Session and swallows what it writes. Once
+// the bytes run out every read times out at once, so a Session that keeps
+// waiting spends its retries rather than the fuzzer's time.
+type fuzzConn struct {
+	r        *bytes.Reader
+	deadline bool
+}
+
+func (c *fuzzConn) Read(p []byte) (int, error) {
+	if c.r.Len() == 0 && c.deadline {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return c.r.Read(p)
+}
+
+func (c *fuzzConn) SetReadDeadline(t time.Time) error {
+	c.deadline = !t.IsZero()
+	return nil
+}
+
+func (c *fuzzConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// countingHandler accepts every file and counts the bytes written to them.
+type countingHandler struct {
+	*testFileHandler
+	written int64
+}
+
+func (h *countingHandler) AcceptFile(info FileInfo) (io.WriteCloser, int64, error) {
+	return h, 0, nil
+}
+
+func (h *countingHandler) Write(p []byte) (int, error) {
+	h.written += int64(len(p))
+	return len(p), nil
+}
+
+func (h *countingHandler) Close() error { return nil }
+
+// senderStream returns the bytes a Session sends offers with cfg to a
+// receiving Session.
+func senderStream(tb testing.TB, cfg *Config, offers []*FileOffer) []byte {
+	tb.Helper()
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+	var sent bytes.Buffer
+	handler := newTestHandler()
+	handler.filesToSend = offers
+	cfg.Logger = discardLogger()
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: io.MultiWriter(&sent, w1)}, handler, cfg)
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(), &Config{Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+	if sendErr != nil || recvErr != nil {
+		tb.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+	return sent.Bytes()
+}
+
+// FuzzReceive runs Receive against arbitrary peer input: it must not panic,
+// must return soon after the input runs out, must not write more file data
+// than the input holds and must not allocate without bound.
+func FuzzReceive(f *testing.F) {
+	small := []byte("a small file\r\n")
+	big := randomContent(5000)
+	f.Add(senderStream(f, &Config{}, []*FileOffer{
+		{Name: "small.txt", Size: int64(len(small)), Reader: bytes.NewReader(small)},
+	}), uint8(0))
+	f.Add(senderStream(f, &Config{Use32BitCRC: true, MaxBlockSize: 1024, WindowSize: 2048, AttnSequence: []byte("\x03")}, []*FileOffer{
+		{Name: "small.txt", Size: int64(len(small)), ModTime: time.Unix(1700000000, 0), Mode: 0644, Reader: bytes.NewReader(small)},
+		{Name: "big.bin", Size: int64(len(big)), Reader: bytes.NewReader(big)},
+	}), uint8(1))
+	paths, _ := filepath.Glob("testdata/capture/*.zcap")
+	for _, path := range paths {
+		c := parseCapture(f, path)
+		if c.send {
+			continue
+		}
+		var peer []byte
+		for _, ch := range c.chunks {
+			if ch.peer {
+				peer = append(peer, ch.data...)
+			}
+		}
+		f.Add(peer, uint8(1))
+	}
+
+	f.Fuzz(func(t *testing.T, stream []byte, flags uint8) {
+		handler := &countingHandler{testFileHandler: newTestHandler()}
+		cfg := &Config{
+			Use32BitCRC:  flags&1 != 0,
+			LargeBlocks:  flags&2 != 0,
+			RecvTimeout:  10 * time.Millisecond,
+			MaxRetries:   3,
+			DataRetries:  3,
+			FileWaitIdle: 10 * time.Millisecond,
+			Logger:       discardLogger(),
+		}
+		if flags&4 != 0 {
+			cfg.EscapeMode = EscapeMinimal
+		}
+		s := NewSession(&fuzzConn{r: bytes.NewReader(stream)}, handler, cfg)
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			s.Receive(ctx)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Receive still running 5s into %d bytes of input", len(stream))
+		}
+		runtime.ReadMemStats(&after)
+
+		if handler.written > int64(len(stream)) {
+			t.Fatalf("wrote %d bytes of file data from %d bytes of input", handler.written, len(stream))
+		}
+		if n := after.TotalAlloc - before.TotalAlloc; n > 16<<20+64*uint64(len(stream)) {
+			t.Fatalf("allocated %d bytes for %d bytes of input", n, len(stream))
+		}
+	})
+}
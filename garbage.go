@@ -0,0 +1,62 @@
+package zmodem
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// defaultGarbageSinkLimit caps Config.GarbageSink when no
+// Config.GarbageSinkLimit is given.
+const defaultGarbageSinkLimit = 64 << 10
+
+// garbageCapture hands the bytes scanForPad skips to Config.GarbageSink and
+// keeps the ends of the current header hunt's noise for the overflow error.
+type garbageCapture struct {
+	sink  io.Writer
+	left  int     // bytes the sink may still receive
+	one   [1]byte // write buffer for sink
+	n     int     // bytes skipped in this hunt
+	first []byte  // the hunt's first 32 skipped bytes
+	last  [32]byte
+}
+
+func newGarbageCapture(sink io.Writer, limit int) *garbageCapture {
+	return &garbageCapture{sink: sink, left: limit, first: make([]byte, 0, 32)}
+}
+
+// hunt starts a new header hunt.
+func (g *garbageCapture) hunt() {
+	g.n = 0
+	g.first = g.first[:0]
+}
+
+func (g *garbageCapture) add(b byte) {
+	if g.left > 0 {
+		g.left--
+		g.one[0] = b
+		_, _ = g.sink.Write(g.one[:])
+	}
+	if len(g.first) < cap(g.first) {
+		g.first = append(g.first, b)
+	}
+	g.last[g.n%len(g.last)] = b
+	g.n++
+}
+
+func (g *garbageCapture) addPads(n int) {
+	for range n {
+		g.add(ZPAD)
+	}
+}
+
+// summary describes the hunt's noise: how much, and how it began and ended.
+func (g *garbageCapture) summary() string {
+	k := min(g.n, len(g.last))
+	last := make([]byte, k)
+	for i := range last {
+		last[i] = g.last[(g.n-k+i)%len(g.last)]
+	}
+	return fmt.Sprintf("%d bytes skipped, first %d: %s, last %d: %s",
+		g.n, len(g.first), hex.EncodeToString(g.first), k, hex.EncodeToString(last))
+}
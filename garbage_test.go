@@ -0,0 +1,219 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGarbageSinkCapturesNoise(t *testing.T) {
+	senderTransport, receiverTransport, senderClose, receiverClose := newTestTransports()
+
+	// A login banner ahead of the session, as a terminal server would send.
+	junk := []byte("Welcome to the BBS!\r\nlast login: never\r\n")
+	noisy := &pipeReadWriter{
+		Reader: io.MultiReader(bytes.NewReader(junk), receiverTransport),
+		Writer: receiverTransport,
+	}
+
+	content := bytes.Repeat([]byte("noise "), 500)
+	senderHandler := newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{{
+		Name: "a.txt", Size: int64(len(content)), ModTime: time.Now(), Reader: bytes.NewReader(content),
+	}}
+	receiverHandler := newTestHandler()
+
+	var sink bytes.Buffer
+	sender := NewSession(senderTransport, senderHandler, &Config{})
+	receiver := NewSession(noisy, receiverHandler, &Config{GarbageSink: &sink})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer senderClose()
+		sendErr = sender.Send(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		defer receiverClose()
+		recvErr = receiver.Receive(ctx)
+	}()
+	wg.Wait()
+
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+	// The sender's own rz\r preamble is noise to the receiver as well; the
+	// XON trailing a hex header is flow control, not noise.
+	want := append(append([]byte{}, junk...), AutoDownloadString...)
+	if got := sink.Bytes(); !bytes.Equal(got, want) {
+		t.Fatalf("sink = %q, want %q", got, want)
+	}
+}
+
+func TestGarbageOverflowSummarizesNoise(t *testing.T) {
+	noise := bytes.Repeat([]byte{0xAA}, 100)
+	copy(noise, "HEAD")
+	copy(noise[len(noise)-4:], "TAIL")
+
+	var sink bytes.Buffer
+	tr := newTransportReader(bytes.NewReader(noise), 50, 0, true, slog.Default())
+	tr.capture = newGarbageCapture(&sink, 60)
+
+	_, err := tr.scanForPad()
+	if !errors.Is(err, errGarbageOverflow) {
+		t.Fatalf("scanForPad = %v, want errGarbageOverflow", err)
+	}
+	if msg := err.Error(); !strings.Contains(msg, "51 bytes skipped") || !strings.Contains(msg, "first 32: 48454144aaaa") {
+		t.Errorf("error %q lacks the noise summary", msg)
+	}
+
+	// The next hunt runs into the end of the input; the sink stopped at its
+	// limit partway through.
+	if _, err = tr.scanForPad(); !errors.Is(err, io.EOF) {
+		t.Fatalf("second scanForPad = %v, want EOF", err)
+	}
+	if sink.Len() != 60 {
+		t.Errorf("sink got %d bytes, want the 60-byte limit", sink.Len())
+	}
+	if !bytes.Equal(sink.Bytes(), noise[:60]) {
+		t.Errorf("sink = %x, want the first 60 noise bytes", sink.Bytes())
+	}
+}
+
+func TestGarbageOverflowPlainWithoutSink(t *testing.T) {
+	tr := newTransportReader(bytes.NewReader(bytes.Repeat([]byte{0xAA}, 100)), 50, 0, true, slog.Default())
+	if _, err := tr.scanForPad(); err != errGarbageOverflow {
+		t.Fatalf("scanForPad = %v, want bare errGarbageOverflow", err)
+	}
+}
+
+// xonFlood writes n XONs after every Write, as a modem asserting flow control
+// between frames would.
+type xonFlood struct {
+	w io.Writer
+	n int
+}
+
+func (x *xonFlood) Write(p []byte) (int, error) {
+	n, err := x.w.Write(p)
+	if err == nil {
+		_, err = x.w.Write(bytes.Repeat([]byte{XON, XOFF | 0x80, XON | 0x80}, x.n/3))
+	}
+	return n, err
+}
+
+// TestFlowControlBetweenFramesIsNotGarbage: thousands of XON/XOFF bytes
+// between the frames of a batch, in both directions, never count toward a
+// small garbage threshold.
+func TestFlowControlBetweenFramesIsNotGarbage(t *testing.T) {
+	r1, w1 := bufferedPipe(1024)
+	r2, w2 := bufferedPipe(1024)
+	senderT := &pipeReadWriter{Reader: r2, Writer: &xonFlood{w: w1, n: 300}}
+	receiverT := &pipeReadWriter{Reader: r1, Writer: &xonFlood{w: w2, n: 300}}
+
+	senderHandler := newTestHandler()
+	var files [][]byte
+	for i := range 4 {
+		content := bytes.Repeat([]byte{byte('a' + i)}, 5000)
+		files = append(files, content)
+		senderHandler.filesToSend = append(senderHandler.filesToSend, &FileOffer{
+			Name: string(rune('a'+i)) + ".txt", Size: int64(len(content)), Reader: bytes.NewReader(content),
+		})
+	}
+	receiverHandler := newTestHandler()
+	cfg := &Config{GarbageThreshold: 100, Logger: discardLogger()}
+	sender := NewSession(senderT, senderHandler, cfg)
+	receiver := NewSession(receiverT, receiverHandler, cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer w1.Close()
+		sendErr = sender.Send(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		defer w2.Close()
+		recvErr = receiver.Receive(ctx)
+	}()
+	wg.Wait()
+
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+	for i, want := range files {
+		name := string(rune('a'+i)) + ".txt"
+		if got := receiverHandler.receivedFiles[name]; got == nil || !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("%s not received intact", name)
+		}
+	}
+}
+
+// TestZnullsPaddingIsNotGarbage: a sender padding every ZDATA header with
+// far more NULs than the receiver's garbage threshold (sz -N, Config.Znulls)
+// still gets a windowed batch through, many ZDATA frames later.
+func TestZnullsPaddingIsNotGarbage(t *testing.T) {
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+
+	senderHandler := newTestHandler()
+	var files [][]byte
+	for i := range 3 {
+		content := bytes.Repeat([]byte{byte('a' + i)}, 6000)
+		files = append(files, content)
+		senderHandler.filesToSend = append(senderHandler.filesToSend, &FileOffer{
+			Name: string(rune('a'+i)) + ".txt", Size: int64(len(content)), Reader: bytes.NewReader(content),
+		})
+	}
+	receiverHandler := newTestHandler()
+	sender := NewSession(senderT, senderHandler, &Config{
+		MaxBlockSize: 512, Znulls: 1500, Logger: discardLogger(),
+	})
+	receiver := NewSession(receiverT, receiverHandler, &Config{
+		MaxBlockSize: 512, WindowSize: 2048, GarbageThreshold: 100, Logger: discardLogger(),
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer senderClose()
+		sendErr = sender.Send(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		defer receiverClose()
+		recvErr = receiver.Receive(ctx)
+	}()
+	wg.Wait()
+
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+	for i, want := range files {
+		name := string(rune('a'+i)) + ".txt"
+		if got := receiverHandler.receivedFiles[name]; got == nil || !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("%s not received intact", name)
+		}
+	}
+}
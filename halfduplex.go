@@ -0,0 +1,65 @@
+package zmodem
+
+import (
+	"fmt"
+	"io"
+)
+
+// HalfDuplex is an optional transport interface for links whose transmitter
+// must be keyed to send and released to listen, such as half-duplex radio
+// modems and RS-485. A Session whose transport implements it turns the line
+// around at the protocol's natural turnaround points.
+//
+// A receiver on a HalfDuplex transport does not advertise full-duplex or
+// overlapped I/O in its ZRINIT, and a sender on one does not solicit ZACKs
+// mid-stream, so the peer never answers while the other side is keyed; set
+// Config.WindowSize on the receiver to have the sender stream in ZCRCW-ended
+// segments.
+type HalfDuplex interface {
+	// BeginTransmit keys the transmitter. It is called before the first byte
+	// written after the session has been reading.
+	BeginTransmit() error
+	// EndTransmit releases the line. It is called after the last byte of a
+	// transmission has been flushed, before the session next reads; and when
+	// Send or Receive returns with the transmitter keyed.
+	EndTransmit() error
+}
+
+// turnaround tracks the direction of a HalfDuplex transport. It is shared by
+// the wire reader and writer, which switch it lazily: the first write after a
+// read keys the transmitter, the first transport read after a write releases
+// it. Everything the session sends is flushed before it waits for an answer,
+// so no output is still buffered when the line is released.
+type turnaround struct {
+	hd           HalfDuplex
+	transmitting bool
+}
+
+func newTurnaround(rw io.ReadWriter) *turnaround {
+	if hd, ok := rw.(HalfDuplex); ok {
+		return &turnaround{hd: hd}
+	}
+	return nil
+}
+
+func (t *turnaround) transmit() error {
+	if t.transmitting {
+		return nil
+	}
+	if err := t.hd.BeginTransmit(); err != nil {
+		return fmt.Errorf("zmodem: begin transmit: %w", err)
+	}
+	t.transmitting = true
+	return nil
+}
+
+func (t *turnaround) receive() error {
+	if !t.transmitting {
+		return nil
+	}
+	if err := t.hd.EndTransmit(); err != nil {
+		return fmt.Errorf("zmodem: end transmit: %w", err)
+	}
+	t.transmitting = false
+	return nil
+}
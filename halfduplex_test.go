@@ -0,0 +1,129 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// halfDuplexMock is a HalfDuplex transport that records its turnaround calls
+// and flags any read while keyed, write while not keyed, or unbalanced
+// Begin/EndTransmit.
+type halfDuplexMock struct {
+	r io.Reader
+	w io.Writer
+
+	mu         sync.Mutex
+	keyed      bool
+	events     []string // "TX" per BeginTransmit, "RX" per EndTransmit
+	violations []string
+}
+
+func (m *halfDuplexMock) violate(format string, args ...any) {
+	if len(m.violations) < 10 {
+		m.violations = append(m.violations, fmt.Sprintf(format, args...))
+	}
+}
+
+func (m *halfDuplexMock) BeginTransmit() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.keyed {
+		m.violate("BeginTransmit while already keyed")
+	}
+	m.keyed = true
+	m.events = append(m.events, "TX")
+	return nil
+}
+
+func (m *halfDuplexMock) EndTransmit() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.keyed {
+		m.violate("EndTransmit while not keyed")
+	}
+	m.keyed = false
+	m.events = append(m.events, "RX")
+	return nil
+}
+
+func (m *halfDuplexMock) Read(p []byte) (int, error) {
+	m.mu.Lock()
+	if m.keyed {
+		m.violate("Read while keyed (event %d)", len(m.events))
+	}
+	m.mu.Unlock()
+	return m.r.Read(p)
+}
+
+func (m *halfDuplexMock) Write(p []byte) (int, error) {
+	m.mu.Lock()
+	if !m.keyed {
+		m.violate("Write of %d bytes while not keyed (event %d)", len(p), len(m.events))
+	}
+	m.mu.Unlock()
+	return m.w.Write(p)
+}
+
+func TestHalfDuplexTurnaroundBracketsDirectionChanges(t *testing.T) {
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+	senderT := &halfDuplexMock{r: r2, w: w1}
+	receiverT := &halfDuplexMock{r: r1, w: w2}
+
+	content := bytes.Repeat([]byte("half-duplex segment "), 1000) // 20 KB
+	sh := newTestHandler()
+	sh.filesToSend = []*FileOffer{{Name: "radio.txt", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	rh := newTestHandler()
+
+	sender := NewSession(senderT, sh, &Config{Logger: discardLogger()})
+	receiver := NewSession(receiverT, rh, &Config{WindowSize: 4096, Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send=%v recv=%v", sendErr, recvErr)
+	}
+	rh.mu.Lock()
+	got := rh.receivedFiles["radio.txt"]
+	rh.mu.Unlock()
+	if got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("content mismatch")
+	}
+	if sender.remoteFlags&(CANFDX|CANOVIO) != 0 {
+		t.Fatalf("half-duplex receiver advertised ZRINIT flags %#x", sender.remoteFlags)
+	}
+
+	for name, m := range map[string]*halfDuplexMock{"sender": senderT, "receiver": receiverT} {
+		m.mu.Lock()
+		if len(m.violations) > 0 {
+			t.Errorf("%s: %v", name, m.violations)
+		}
+		if m.keyed {
+			t.Errorf("%s: transmitter still keyed after the session", name)
+		}
+		// Events alternate TX, RX, TX, RX, ... ending with RX.
+		for i, ev := range m.events {
+			if want := [2]string{"TX", "RX"}[i%2]; ev != want {
+				t.Errorf("%s: event %d = %s, want %s (%v)", name, i, ev, want, m.events)
+				break
+			}
+		}
+		// Handshake, ZFILE/ZRPOS, one turnaround per 4 KB window, ZEOF, ZFIN.
+		if turns := len(m.events) / 2; turns < 8 {
+			t.Errorf("%s: only %d turnarounds for a windowed transfer", name, turns)
+		}
+		m.mu.Unlock()
+	}
+}
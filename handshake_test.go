@@ -3,8 +3,13 @@ package zmodem
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"slices"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -364,3 +369,1227 @@ func TestSenderTurnaroundZFINBounded(t *testing.T) {
 		t.Fatal("sender accepted unbounded turnaround ZFINs; want a clean error after maxSkipFin")
 	}
 }
+
+// TestReceiverRetryBudgetsPerFile: recoveries spent on one file's data phase
+// must not come out of the next file's negotiation. File one ends after eight
+// corrupt ZEOFs, each answered with ZRPOS; three corrupt headers before the
+// second ZFILE would then exhaust a shared ten-retry budget.
+func TestReceiverRetryBudgetsPerFile(t *testing.T) {
+	r1, w1 := bufferedPipe(256) // peer -> receiver
+	r2, w2 := bufferedPipe(256) // receiver -> peer
+
+	receiverT := &pipeReadWriter{Reader: r1, Writer: w2}
+	peerT := &pipeReadWriter{Reader: r2, Writer: w1}
+
+	recvHandler := newTestHandler()
+	receiver := NewSession(receiverT, recvHandler, &Config{MaxBlockSize: 1024, Logger: discardLogger()})
+	peer := NewSession(peerT, newTestHandler(), &Config{MaxBlockSize: 1024})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var recvErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer w2.Close()
+		recvErr = receiver.Receive(ctx)
+	}()
+
+	writeCorrupt := func(frameType byte) {
+		t.Helper()
+		if err := peer.tw.writeRaw(corruptHexHeader(frameType)); err != nil {
+			t.Fatalf("write corrupt header: %v", err)
+		}
+		if err := peer.tw.Flush(); err != nil {
+			t.Fatalf("flush corrupt header: %v", err)
+		}
+	}
+
+	mustRecvType(t, peer, ZRINIT, "initial ZRINIT")
+
+	first := []byte("the noisy first file")
+	fh := makeHeader(ZFILE)
+	fh.SetZF0(ZCBIN)
+	if err := peer.sendBinHeader(fh); err != nil {
+		t.Fatalf("send ZFILE: %v", err)
+	}
+	if err := peer.sendSubpacket(marshalFileInfo(&FileOffer{Name: "noisy.txt", Size: int64(len(first))}, 0, 0), ZCRCW); err != nil {
+		t.Fatalf("send ZFILE metadata: %v", err)
+	}
+	mustRecvType(t, peer, ZRPOS, "ZRPOS for noisy.txt")
+	if err := peer.sendBinHeaderWithZnulls(makePosHeader(ZDATA, 0)); err != nil {
+		t.Fatalf("send ZDATA: %v", err)
+	}
+	if err := peer.sendSubpacket(first, ZCRCE); err != nil {
+		t.Fatalf("send data subpacket: %v", err)
+	}
+	for i := 0; i < 8; i++ {
+		writeCorrupt(ZEOF)
+		mustRecvType(t, peer, ZRPOS, "ZRPOS after corrupt ZEOF")
+	}
+	if err := peer.sendHexHeader(makePosHeader(ZEOF, int64(len(first)))); err != nil {
+		t.Fatalf("send ZEOF: %v", err)
+	}
+	mustRecvType(t, peer, ZRINIT, "ZRINIT after noisy.txt")
+
+	for i := 0; i < 3; i++ {
+		writeCorrupt(ZFILE)
+		mustRecvType(t, peer, ZRINIT, "ZRINIT after corrupt ZFILE")
+	}
+	second := []byte("the clean second file")
+	peerSendOneFile(t, peer, "clean.txt", second)
+
+	if err := peer.sendHexHeader(makeHeader(ZFIN)); err != nil {
+		t.Fatalf("send ZFIN: %v", err)
+	}
+	mustRecvType(t, peer, ZFIN, "receiver ZFIN")
+	_ = peer.tw.writeRaw([]byte("OO"))
+	_ = peer.tw.Flush()
+
+	<-done
+	w1.Close()
+
+	if recvErr != nil {
+		t.Fatalf("receiver returned error: %v", recvErr)
+	}
+	for name, want := range map[string][]byte{"noisy.txt": first, "clean.txt": second} {
+		if got := recvHandler.receivedFiles[name]; got == nil || !bytes.Equal(got.Bytes(), want) {
+			t.Errorf("%s not received intact", name)
+		}
+	}
+}
+
+// TestSenderResendsZRQINITOnZNAK: a receiver that got our ZRQINIT garbled
+// answers ZNAK; the sender sends ZRQINIT again instead of failing.
+func TestSenderResendsZRQINITOnZNAK(t *testing.T) {
+	r1, w1 := bufferedPipe(256) // sender -> peer
+	r2, w2 := bufferedPipe(256) // peer -> sender
+
+	content := []byte("sent after a garbled ZRQINIT")
+	sendHandler := newTestHandler()
+	sendHandler.filesToSend = []*FileOffer{
+		{Name: "znak.txt", Size: int64(len(content)), Reader: bytes.NewReader(content)},
+	}
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, sendHandler, &Config{MaxBlockSize: 1024})
+	peer := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(), &Config{MaxBlockSize: 1024})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var sendErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer w1.Close()
+		sendErr = sender.Send(ctx)
+	}()
+
+	mustRecvType(t, peer, ZRQINIT, "first ZRQINIT")
+	if err := peer.sendHexHeader(makeHeader(ZNAK)); err != nil {
+		t.Fatalf("send ZNAK: %v", err)
+	}
+	mustRecvType(t, peer, ZRQINIT, "ZRQINIT resend after ZNAK")
+	if err := peer.sendZRINIT(); err != nil {
+		t.Fatalf("send ZRINIT: %v", err)
+	}
+	if _, data := peerReceiveOneFile(t, peer); !bytes.Equal(data, content) {
+		t.Fatalf("content mismatch: got %q, want %q", data, content)
+	}
+	mustRecvType(t, peer, ZFIN, "sender ZFIN")
+	if err := peer.sendHexHeader(makeHeader(ZFIN)); err != nil {
+		t.Fatalf("send teardown ZFIN: %v", err)
+	}
+
+	<-done
+	w2.Close()
+	if sendErr != nil {
+		t.Fatalf("sender returned error: %v", sendErr)
+	}
+}
+
+// TestSenderSkipsEchoBeforeZRINIT: a terminal echoing a long line back, more
+// than the garbage threshold, and our own ZRQINIT with it, costs the sender
+// no retries while it waits for the receiver's first ZRINIT.
+func TestSenderSkipsEchoBeforeZRINIT(t *testing.T) {
+	r1, w1 := bufferedPipe(256) // sender -> peer
+	r2, w2 := bufferedPipe(256) // peer -> sender
+
+	content := []byte("sent through the echo")
+	sendHandler := newTestHandler()
+	sendHandler.filesToSend = []*FileOffer{
+		{Name: "echo.txt", Size: int64(len(content)), Reader: bytes.NewReader(content)},
+	}
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, sendHandler,
+		&Config{GarbageThreshold: 16, MaxRetries: 1, RecvTimeout: 5 * time.Second, Logger: discardLogger()})
+	peer := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(), &Config{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var sendErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer w1.Close()
+		sendErr = sender.Send(ctx)
+	}()
+
+	mustRecvType(t, peer, ZRQINIT, "ZRQINIT")
+	echo := append([]byte(strings.Repeat("user typed this first ", 10)+"rz\r"), "**\x18B00000000000000\r\n\x11"...)
+	if err := peer.tw.writeRaw(echo); err != nil {
+		t.Fatal(err)
+	}
+	if err := peer.sendZRINIT(); err != nil {
+		t.Fatalf("send ZRINIT: %v", err)
+	}
+	if _, data := peerReceiveOneFile(t, peer); !bytes.Equal(data, content) {
+		t.Fatalf("content mismatch: got %q, want %q", data, content)
+	}
+	mustRecvType(t, peer, ZFIN, "sender ZFIN")
+	if err := peer.sendHexHeader(makeHeader(ZFIN)); err != nil {
+		t.Fatalf("send teardown ZFIN: %v", err)
+	}
+
+	<-done
+	w2.Close()
+	if sendErr != nil {
+		t.Fatalf("sender returned error: %v", sendErr)
+	}
+}
+
+// TestSenderZNAKBounded: ZNAKs to ZRQINIT count against MaxRetries.
+func TestSenderZNAKBounded(t *testing.T) {
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+
+	sendHandler := newTestHandler()
+	sendHandler.filesToSend = []*FileOffer{{Name: "never.txt", Size: 1, Reader: bytes.NewReader([]byte("x"))}}
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, sendHandler, &Config{MaxRetries: 3})
+	peer := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var sendErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer w1.Close()
+		sendErr = sender.Send(ctx)
+	}()
+
+	for {
+		hdr, err := peer.recvHeader()
+		if err != nil {
+			break // the sender gave up and closed its side
+		}
+		if hdr.Type == ZRQINIT {
+			if err := peer.sendHexHeader(makeHeader(ZNAK)); err != nil {
+				t.Fatalf("send ZNAK: %v", err)
+			}
+		}
+	}
+	<-done
+	w2.Close()
+	if sendErr == nil {
+		t.Fatal("Send succeeded against a receiver that only ever sends ZNAK")
+	}
+}
+
+// TestSenderZSINITResentOnZNAK: a ZNAK to ZSINIT brings the header back with
+// its attention-string subpacket.
+func TestSenderZSINITResentOnZNAK(t *testing.T) {
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+
+	content := []byte("after ZSINIT")
+	sendHandler := newTestHandler()
+	sendHandler.filesToSend = []*FileOffer{
+		{Name: "attn.txt", Size: int64(len(content)), Reader: bytes.NewReader(content)},
+	}
+	attn := []byte{0x03, 0x8e}
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, sendHandler, &Config{AttnSequence: attn})
+	peer := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var sendErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer w1.Close()
+		sendErr = sender.Send(ctx)
+	}()
+
+	mustRecvType(t, peer, ZRQINIT, "ZRQINIT")
+	if err := peer.sendZRINIT(); err != nil {
+		t.Fatalf("send ZRINIT: %v", err)
+	}
+	for i, what := range []string{"ZSINIT", "ZSINIT resend"} {
+		mustRecvType(t, peer, ZSINIT, what)
+		data, _, err := peer.recvSubpacket(256)
+		if err != nil {
+			t.Fatalf("%s subpacket: %v", what, err)
+		}
+		if want := append(bytes.Clone(attn), 0); !bytes.Equal(data, want) {
+			t.Fatalf("%s subpacket = %x, want %x", what, data, want)
+		}
+		reply := makeHeader(ZNAK)
+		if i == 1 {
+			reply = makePosHeader(ZACK, 0)
+		}
+		if err := peer.sendHexHeader(reply); err != nil {
+			t.Fatalf("answer %s: %v", what, err)
+		}
+	}
+	if _, data := peerReceiveOneFile(t, peer); !bytes.Equal(data, content) {
+		t.Fatalf("content mismatch: got %q, want %q", data, content)
+	}
+	mustRecvType(t, peer, ZFIN, "sender ZFIN")
+	if err := peer.sendHexHeader(makeHeader(ZFIN)); err != nil {
+		t.Fatalf("send teardown ZFIN: %v", err)
+	}
+
+	<-done
+	w2.Close()
+	if sendErr != nil {
+		t.Fatalf("sender returned error: %v", sendErr)
+	}
+}
+
+// TestSenderWithBareCRReceiver models a receiver firmware that ends every hex
+// header with a bare CR and then waits: each header must be taken the first
+// time, so the sender sends ZRQINIT once and the file goes through with no
+// retries.
+func TestSenderWithBareCRReceiver(t *testing.T) {
+	r1, rawW1 := bufferedPipe(256) // sender -> peer
+	r2, w2 := bufferedPipe(256)    // peer -> sender
+	rec := &recordWriter{w: rawW1}
+
+	content := []byte("sent to a bare-CR receiver")
+	sendHandler := newTestHandler()
+	sendHandler.filesToSend = []*FileOffer{
+		{Name: "cr.txt", Size: int64(len(content)), Reader: bytes.NewReader(content)},
+	}
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: rec}, sendHandler, &Config{RecvTimeout: 5 * time.Second})
+	peer := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var sendErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer rawW1.Close()
+		sendErr = sender.Send(ctx)
+	}()
+
+	sendBareCR := func(hdr Header) {
+		t.Helper()
+		if err := peer.tw.writeRaw(append(hexHeaderBytes(t, hdr), '\r')); err != nil {
+			t.Fatalf("write %s: %v", frameTypeName(hdr.Type), err)
+		}
+		if err := peer.tw.Flush(); err != nil {
+			t.Fatalf("flush %s: %v", frameTypeName(hdr.Type), err)
+		}
+	}
+
+	start := time.Now()
+	mustRecvType(t, peer, ZRQINIT, "ZRQINIT")
+	zrinit := makeHeader(ZRINIT)
+	zrinit.SetZF0(CANFDX | CANOVIO)
+	sendBareCR(zrinit)
+
+	mustRecvType(t, peer, ZFILE, "ZFILE")
+	if _, _, err := peer.recvSubpacket(2048); err != nil {
+		t.Fatalf("ZFILE metadata: %v", err)
+	}
+	sendBareCR(makePosHeader(ZRPOS, 0))
+	mustRecvType(t, peer, ZDATA, "ZDATA")
+	var got []byte
+	for {
+		sub, end, err := peer.recvSubpacket(2048)
+		if err != nil {
+			t.Fatalf("data subpacket: %v", err)
+		}
+		got = append(got, sub...)
+		if end == ZCRCE {
+			break
+		}
+	}
+	mustRecvType(t, peer, ZEOF, "ZEOF")
+	sendBareCR(zrinit)
+	mustRecvType(t, peer, ZFIN, "ZFIN")
+	sendBareCR(makeHeader(ZFIN))
+
+	<-done
+	w2.Close()
+	if sendErr != nil {
+		t.Fatalf("sender returned error: %v", sendErr)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatalf("content mismatch: got %q, want %q", got, content)
+	}
+	zrqinit := []byte{ZPAD, ZPAD, ZDLE, ZHEX, '0', '0'}
+	if n := bytes.Count(rec.snapshot(), zrqinit); n != 1 {
+		t.Fatalf("ZRQINIT sent %d times, want once", n)
+	}
+	if took := time.Since(start); took > 2*time.Second {
+		t.Fatalf("exchange took %v: a header waited for its line feed", took)
+	}
+}
+
+// TestReceiverSkipsMalformedZFILE: a ZFILE whose file info is malformed is
+// answered with ZSKIP and reported to FileCompleted, and the batch goes on.
+func TestReceiverSkipsMalformedZFILE(t *testing.T) {
+	r1, w1 := bufferedPipe(256) // peer -> receiver
+	r2, w2 := bufferedPipe(256) // receiver -> peer
+
+	recvHandler := newTestHandler()
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, recvHandler,
+		&Config{MaxBlockSize: 1024, Logger: discardLogger()})
+	peer := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, newTestHandler(), &Config{MaxBlockSize: 1024})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var recvErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer w2.Close()
+		recvErr = receiver.Receive(ctx)
+	}()
+
+	mustRecvType(t, peer, ZRINIT, "initial ZRINIT")
+
+	for _, meta := range []string{"neg.bin\x00-5 0 644\x00", "\x00100\x00"} {
+		fh := makeHeader(ZFILE)
+		fh.SetZF0(ZCBIN)
+		if err := peer.sendBinHeader(fh); err != nil {
+			t.Fatalf("send ZFILE: %v", err)
+		}
+		if err := peer.sendSubpacket([]byte(meta), ZCRCW); err != nil {
+			t.Fatalf("send ZFILE metadata: %v", err)
+		}
+		mustRecvType(t, peer, ZSKIP, "ZSKIP for malformed ZFILE")
+	}
+
+	content := []byte("the file after two bad offers")
+	peerSendOneFile(t, peer, "good.txt", content)
+
+	if err := peer.sendHexHeader(makeHeader(ZFIN)); err != nil {
+		t.Fatalf("send ZFIN: %v", err)
+	}
+	mustRecvType(t, peer, ZFIN, "receiver ZFIN")
+	_ = peer.tw.writeRaw([]byte("OO"))
+	_ = peer.tw.Flush()
+
+	<-done
+	w1.Close()
+
+	if recvErr != nil {
+		t.Fatalf("receiver returned error: %v", recvErr)
+	}
+	recvHandler.mu.Lock()
+	defer recvHandler.mu.Unlock()
+	if err := recvHandler.completedFiles["neg.bin"]; !errors.Is(err, ErrBadFileInfo) {
+		t.Errorf("neg.bin completed with %v, want ErrBadFileInfo", err)
+	}
+	if _, ok := recvHandler.receivedFiles["neg.bin"]; ok {
+		t.Error("AcceptFile was asked for neg.bin")
+	}
+	if got := recvHandler.receivedFiles["good.txt"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Error("good.txt not received intact")
+	}
+}
+
+// TestReceiverZFILEDuringData: a retransmitted ZFILE for the file being
+// received is answered with ZRPOS at the write offset; a ZFILE for another file
+// (the sender gave up on a ZEOF we never saw) ends the current file — with an
+// error if it is short, cleanly if it is complete — and takes the new offer.
+func TestReceiverZFILEDuringData(t *testing.T) {
+	r1, w1 := bufferedPipe(256) // peer -> receiver
+	r2, w2 := bufferedPipe(256) // receiver -> peer
+
+	recvHandler := newTestHandler()
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, recvHandler,
+		&Config{MaxBlockSize: 1024, Logger: discardLogger()})
+	peer := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, newTestHandler(), &Config{MaxBlockSize: 1024})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var recvErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer w2.Close()
+		recvErr = receiver.Receive(ctx)
+	}()
+
+	offer := func(name string, size int) {
+		t.Helper()
+		fh := makeHeader(ZFILE)
+		fh.SetZF0(ZCBIN)
+		if err := peer.sendBinHeader(fh); err != nil {
+			t.Fatalf("send ZFILE: %v", err)
+		}
+		if err := peer.sendSubpacket(marshalFileInfo(&FileOffer{Name: name, Size: int64(size)}, 0, 0), ZCRCW); err != nil {
+			t.Fatalf("send ZFILE metadata: %v", err)
+		}
+	}
+	sendData := func(pos int, data []byte) {
+		t.Helper()
+		if err := peer.sendBinHeaderWithZnulls(makePosHeader(ZDATA, int64(pos))); err != nil {
+			t.Fatalf("send ZDATA: %v", err)
+		}
+		if err := peer.sendSubpacket(data, ZCRCE); err != nil {
+			t.Fatalf("send data subpacket: %v", err)
+		}
+	}
+	expectPos := func(want int64, what string) {
+		t.Helper()
+		if hdr := mustRecvType(t, peer, ZRPOS, what); hdr.Position() != want {
+			t.Fatalf("%s: ZRPOS %d, want %d", what, hdr.Position(), want)
+		}
+	}
+
+	short := []byte("0123456789abcdefghij")
+	whole := []byte("complete")
+	last := []byte("last file")
+
+	mustRecvType(t, peer, ZRINIT, "initial ZRINIT")
+
+	offer("short.bin", len(short))
+	expectPos(0, "ZRPOS for short.bin")
+	sendData(0, short[:10])
+
+	// Same file again: our ZRPOS was lost, so resend it at the write offset.
+	offer("short.bin", len(short))
+	expectPos(10, "ZRPOS for retransmitted short.bin")
+
+	// Next file before short.bin's ZEOF: short.bin ends truncated.
+	offer("whole.bin", len(whole))
+	expectPos(0, "ZRPOS for whole.bin")
+	sendData(0, whole)
+
+	// Next file with whole.bin fully received but its ZEOF lost.
+	offer("last.bin", len(last))
+	expectPos(0, "ZRPOS for last.bin")
+	sendData(0, last)
+	if err := peer.sendHexHeader(makePosHeader(ZEOF, int64(len(last)))); err != nil {
+		t.Fatalf("send ZEOF: %v", err)
+	}
+	mustRecvType(t, peer, ZRINIT, "ZRINIT after ZEOF for last.bin")
+
+	if err := peer.sendHexHeader(makeHeader(ZFIN)); err != nil {
+		t.Fatalf("send ZFIN: %v", err)
+	}
+	mustRecvType(t, peer, ZFIN, "receiver ZFIN")
+	_ = peer.tw.writeRaw([]byte("OO"))
+	_ = peer.tw.Flush()
+
+	<-done
+	w1.Close()
+
+	if recvErr != nil {
+		t.Fatalf("receiver returned error: %v", recvErr)
+	}
+	recvHandler.mu.Lock()
+	defer recvHandler.mu.Unlock()
+	if err := recvHandler.completedFiles["short.bin"]; !errors.Is(err, errZEOFLost) {
+		t.Errorf("short.bin completed with %v, want errZEOFLost", err)
+	}
+	if got := recvHandler.receivedFiles["short.bin"]; got == nil || !bytes.Equal(got.Bytes(), short[:10]) {
+		t.Errorf("short.bin holds %q, want %q", got, short[:10])
+	}
+	for name, content := range map[string][]byte{"whole.bin": whole, "last.bin": last} {
+		if err := recvHandler.completedFiles[name]; err != nil {
+			t.Errorf("%s completed with %v, want success", name, err)
+		}
+		if got := recvHandler.receivedFiles[name]; got == nil || !bytes.Equal(got.Bytes(), content) {
+			t.Errorf("%s not received intact", name)
+		}
+	}
+}
+
+// TestSenderFileEndedMidData: a ZSKIP or ZRINIT answering a ZCRCW or ZCRCQ —
+// at a full window, after a ZRPOS resync, or at a checkpoint — ends the file
+// being sent and the batch goes on with the next one.
+func TestSenderFileEndedMidData(t *testing.T) {
+	halfDuplexWindow := makeHeader(ZRINIT) // no CANFDX, 1 KB window: ZCRCW at the window
+	halfDuplexWindow.SetZF0(CANOVIO)
+	halfDuplexWindow.Data[1] = 1024 >> 8
+	fullDuplex := makeHeader(ZRINIT) // CANFDX, no window: ZCRCQ checkpoints
+	fullDuplex.SetZF0(CANFDX | CANOVIO)
+
+	tests := []struct {
+		name   string
+		zrinit Header
+		resync bool // answer the first window ZCRCW with ZRPOS, end at the flush ZCRCW
+		wait   byte // the subpacket end that is answered
+		answer byte
+	}{
+		{"ZSKIP at window", halfDuplexWindow, false, ZCRCW, ZSKIP},
+		{"ZSKIP at resync flush", halfDuplexWindow, true, ZCRCW, ZSKIP},
+		{"ZSKIP at checkpoint", fullDuplex, false, ZCRCQ, ZSKIP},
+		{"ZRINIT at window", halfDuplexWindow, false, ZCRCW, ZRINIT},
+		{"ZRINIT at checkpoint", fullDuplex, false, ZCRCQ, ZRINIT},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r1, w1 := bufferedPipe(256) // sender -> peer
+			r2, w2 := bufferedPipe(256) // peer -> sender
+
+			big := bytes.Repeat([]byte("x"), 64<<10)
+			next := []byte("the next file")
+			sendHandler := newTestHandler()
+			sendHandler.filesToSend = []*FileOffer{
+				{Name: "big.bin", Size: int64(len(big)), Reader: bytes.NewReader(big)},
+				{Name: "next.txt", Size: int64(len(next)), Reader: bytes.NewReader(next)},
+			}
+			sender := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, sendHandler,
+				&Config{MaxBlockSize: 1024, MaxRetries: 3, Logger: discardLogger()})
+			peer := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(), &Config{MaxBlockSize: 1024})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			var sendErr error
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				defer w1.Close()
+				sendErr = sender.Send(ctx)
+			}()
+
+			mustRecvType(t, peer, ZRQINIT, "ZRQINIT")
+			if err := peer.sendHexHeader(tc.zrinit); err != nil {
+				t.Fatalf("send ZRINIT: %v", err)
+			}
+			mustRecvType(t, peer, ZFILE, "ZFILE for big.bin")
+			if _, _, err := peer.recvSubpacket(2048); err != nil {
+				t.Fatalf("read ZFILE metadata: %v", err)
+			}
+			if err := peer.sendHexHeader(makePosHeader(ZRPOS, 0)); err != nil {
+				t.Fatalf("send ZRPOS: %v", err)
+			}
+
+			// readUntil reads a ZDATA frame up to the first subpacket ending
+			// with end.
+			readUntil := func(end byte) {
+				t.Helper()
+				if zd := mustRecvType(t, peer, ZDATA, "ZDATA"); zd.Encoding == ZBIN32 {
+					peer.useCRC32 = true
+				}
+				for {
+					_, endType, err := peer.recvSubpacket(4096)
+					if err != nil {
+						t.Fatalf("read data subpacket: %v", err)
+					}
+					if endType == end {
+						return
+					}
+					if endType == ZCRCE || endType == ZCRCW {
+						t.Fatalf("frame ended with %#x before %#x", endType, end)
+					}
+				}
+			}
+
+			readUntil(tc.wait)
+			if tc.resync {
+				if err := peer.sendHexHeader(makePosHeader(ZRPOS, 512)); err != nil {
+					t.Fatalf("send ZRPOS: %v", err)
+				}
+				readUntil(ZCRCW)
+			}
+			answer := makeHeader(tc.answer)
+			if tc.answer == ZRINIT {
+				answer = tc.zrinit
+			}
+			if err := peer.sendHexHeader(answer); err != nil {
+				t.Fatalf("send %s: %v", frameTypeName(tc.answer), err)
+			}
+
+			if _, data := peerReceiveOneFile(t, peer); !bytes.Equal(data, next) {
+				t.Fatalf("next.txt: got %q, want %q", data, next)
+			}
+			mustRecvType(t, peer, ZFIN, "sender ZFIN")
+			if err := peer.sendHexHeader(makeHeader(ZFIN)); err != nil {
+				t.Fatalf("send teardown ZFIN: %v", err)
+			}
+
+			<-done
+			w2.Close()
+			if sendErr != nil {
+				t.Fatalf("sender returned error: %v", sendErr)
+			}
+			sendHandler.mu.Lock()
+			defer sendHandler.mu.Unlock()
+			err := sendHandler.completedFiles["big.bin"]
+			switch {
+			case tc.answer == ZSKIP && !errors.Is(err, ErrSkippedByRemote):
+				t.Errorf("big.bin completed with %v, want ErrSkippedByRemote", err)
+			case tc.answer == ZRINIT && (err == nil || errors.Is(err, ErrSkip)):
+				t.Errorf("big.bin completed with %v, want a mid-file ZRINIT error", err)
+			}
+			if err := sendHandler.completedFiles["next.txt"]; err != nil {
+				t.Errorf("next.txt completed with %v", err)
+			}
+		})
+	}
+}
+
+// negotiationRecorder notes the sender's negotiated window and CRC mode each
+// time it asks for the next file, i.e. after every ZRINIT but the first.
+type negotiationRecorder struct {
+	*testFileHandler
+	s       *Session
+	windows []int
+	crc32   []bool
+}
+
+func (h *negotiationRecorder) NextFile() *FileOffer {
+	h.windows = append(h.windows, h.s.remoteWindowSize)
+	h.crc32 = append(h.crc32, h.s.useCRC32)
+	return h.testFileHandler.NextFile()
+}
+
+// TestSenderInconsistentZRINITs: a receiver whose between-files ZRINITs drop
+// the window or CANFC32 does not switch the sender to unlimited streaming or
+// CRC-16; a changed non-zero window is taken, unless StickyNegotiation.
+func TestSenderInconsistentZRINITs(t *testing.T) {
+	type zrinit struct {
+		crc32  bool
+		window int
+	}
+	// The first ZRINIT, then the one after each of the three files.
+	sent := []zrinit{{true, 4096}, {false, 0}, {true, 2048}, {false, 0}}
+
+	tests := []struct {
+		name    string
+		sticky  bool
+		windows []int
+	}{
+		{"conservative", false, []int{4096, 4096, 2048, 2048}},
+		{"sticky", true, []int{4096, 4096, 4096, 4096}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r1, w1 := bufferedPipe(256) // sender -> peer
+			r2, w2 := bufferedPipe(256) // peer -> sender
+
+			var contents [][]byte
+			handler := &negotiationRecorder{testFileHandler: newTestHandler()}
+			for i := range 3 {
+				c := []byte(fmt.Sprintf("file %d of an inconsistent batch", i))
+				contents = append(contents, c)
+				handler.filesToSend = append(handler.filesToSend,
+					&FileOffer{Name: fmt.Sprintf("f%d.txt", i), Size: int64(len(c)), Reader: bytes.NewReader(c)})
+			}
+			sender := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, handler,
+				&Config{Use32BitCRC: true, StickyNegotiation: tc.sticky, Logger: discardLogger()})
+			handler.s = sender
+			peer := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(), nil)
+			setZRINIT := func(z zrinit) {
+				peer.cfg.Use32BitCRC = z.crc32
+				peer.cfg.WindowSize = z.window
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			var sendErr error
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				defer w1.Close()
+				sendErr = sender.Send(ctx)
+			}()
+
+			mustRecvType(t, peer, ZRQINIT, "ZRQINIT")
+			setZRINIT(sent[0])
+			if err := peer.sendZRINIT(); err != nil {
+				t.Fatalf("send ZRINIT: %v", err)
+			}
+			for i, want := range contents {
+				setZRINIT(sent[i+1]) // answers this file's ZEOF
+				if _, data := peerReceiveOneFile(t, peer); !bytes.Equal(data, want) {
+					t.Fatalf("file %d: got %q, want %q", i, data, want)
+				}
+			}
+			mustRecvType(t, peer, ZFIN, "sender ZFIN")
+			if err := peer.sendHexHeader(makeHeader(ZFIN)); err != nil {
+				t.Fatalf("send teardown ZFIN: %v", err)
+			}
+
+			<-done
+			w2.Close()
+			if sendErr != nil {
+				t.Fatalf("sender returned error: %v", sendErr)
+			}
+			if !slices.Equal(handler.windows, tc.windows) {
+				t.Errorf("windows after each ZRINIT = %v, want %v", handler.windows, tc.windows)
+			}
+			if slices.Contains(handler.crc32, false) {
+				t.Errorf("CRC-32 after each ZRINIT = %v, want it kept throughout", handler.crc32)
+			}
+		})
+	}
+}
+
+// TestReceiverMixedFrameEncodings: a sender that offers the file in a ZBIN32
+// frame and sends its data in ZBIN frames has each subpacket checked with the
+// CRC its own frame calls for.
+func TestReceiverMixedFrameEncodings(t *testing.T) {
+	r1, w1 := bufferedPipe(256) // peer -> receiver
+	r2, w2 := bufferedPipe(256) // receiver -> peer
+
+	recvHandler := newTestHandler()
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, recvHandler,
+		&Config{Use32BitCRC: true, MaxRetries: 3, Logger: discardLogger()})
+	peer := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, newTestHandler(), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var recvErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer w2.Close()
+		recvErr = receiver.Receive(ctx)
+	}()
+
+	content := []byte("CRC-16 data after a CRC-32 file offer")
+	mustRecvType(t, peer, ZRINIT, "initial ZRINIT")
+
+	peer.useCRC32 = true
+	fh := makeHeader(ZFILE)
+	fh.SetZF0(ZCBIN)
+	if err := peer.sendBinHeader(fh); err != nil {
+		t.Fatalf("send ZFILE: %v", err)
+	}
+	if err := peer.sendSubpacket(marshalFileInfo(&FileOffer{Name: "mixed.bin", Size: int64(len(content))}, 0, 0), ZCRCW); err != nil {
+		t.Fatalf("send ZFILE metadata: %v", err)
+	}
+	mustRecvType(t, peer, ZRPOS, "ZRPOS")
+
+	peer.useCRC32 = false
+	if err := peer.sendBinHeader(makePosHeader(ZDATA, 0)); err != nil {
+		t.Fatalf("send ZDATA: %v", err)
+	}
+	if err := peer.sendSubpacket(content, ZCRCE); err != nil {
+		t.Fatalf("send data subpacket: %v", err)
+	}
+	if err := peer.sendHexHeader(makePosHeader(ZEOF, int64(len(content)))); err != nil {
+		t.Fatalf("send ZEOF: %v", err)
+	}
+	mustRecvType(t, peer, ZRINIT, "ZRINIT after ZEOF")
+
+	if err := peer.sendHexHeader(makeHeader(ZFIN)); err != nil {
+		t.Fatalf("send ZFIN: %v", err)
+	}
+	mustRecvType(t, peer, ZFIN, "receiver ZFIN")
+	_ = peer.tw.writeRaw([]byte("OO"))
+	_ = peer.tw.Flush()
+
+	<-done
+	w1.Close()
+
+	if recvErr != nil {
+		t.Fatalf("receiver returned error: %v", recvErr)
+	}
+	recvHandler.mu.Lock()
+	defer recvHandler.mu.Unlock()
+	if got := recvHandler.receivedFiles["mixed.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("mixed.bin not received intact")
+	}
+}
+
+// TestReceiverAfterZCRCE: what follows a frame ended with ZCRCE. A ZDATA at
+// the write offset or below it (an overlap) and a ZEOF at the write offset
+// are taken without a ZRPOS; a ZDATA ahead of it or any other frame is a
+// recovery — a ZRPOS, charged to DataRetries.
+func TestReceiverAfterZCRCE(t *testing.T) {
+	content := []byte("0123456789abcdefghijklmnopqrstuvwxyz")
+
+	type peerScript struct {
+		t    *testing.T
+		peer *Session
+	}
+	data := func(p peerScript, pos, end int, endType byte) {
+		p.t.Helper()
+		if err := p.peer.sendBinHeader(makePosHeader(ZDATA, int64(pos))); err != nil {
+			p.t.Fatalf("send ZDATA: %v", err)
+		}
+		if err := p.peer.sendSubpacket(content[pos:end], endType); err != nil {
+			p.t.Fatalf("send subpacket: %v", err)
+		}
+	}
+	eof := func(p peerScript, pos int) {
+		p.t.Helper()
+		if err := p.peer.sendHexHeader(makePosHeader(ZEOF, int64(pos))); err != nil {
+			p.t.Fatalf("send ZEOF: %v", err)
+		}
+	}
+	expectPos := func(p peerScript, want int) {
+		p.t.Helper()
+		if hdr := mustRecvType(p.t, p.peer, ZRPOS, "recovery ZRPOS"); hdr.Position() != int64(want) {
+			p.t.Fatalf("ZRPOS %d, want %d", hdr.Position(), want)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		script func(p peerScript)
+	}{
+		{"ZDATA at the offset", func(p peerScript) {
+			data(p, 0, 10, ZCRCE)
+			data(p, 10, len(content), ZCRCE)
+			eof(p, len(content))
+		}},
+		{"ZDATA below the offset", func(p peerScript) {
+			data(p, 0, 20, ZCRCE)
+			data(p, 12, len(content), ZCRCE)
+			eof(p, len(content))
+		}},
+		{"ZEOF at the offset", func(p peerScript) {
+			data(p, 0, len(content), ZCRCE)
+			eof(p, len(content))
+		}},
+		{"ZDATA ahead of the offset", func(p peerScript) {
+			data(p, 0, 10, ZCRCE)
+			data(p, 20, len(content), ZCRCE)
+			expectPos(p, 10)
+			data(p, 10, len(content), ZCRCE)
+			eof(p, len(content))
+		}},
+		{"another frame", func(p peerScript) {
+			data(p, 0, 10, ZCRCE)
+			if err := p.peer.sendHexHeader(makePosHeader(ZACK, 10)); err != nil {
+				p.t.Fatalf("send ZACK: %v", err)
+			}
+			expectPos(p, 10)
+			data(p, 10, len(content), ZCRCE)
+			eof(p, len(content))
+		}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r1, w1 := bufferedPipe(256) // peer -> receiver
+			r2, w2 := bufferedPipe(256) // receiver -> peer
+
+			recvHandler := newTestHandler()
+			receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, recvHandler,
+				&Config{Logger: discardLogger()})
+			peer := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, newTestHandler(), nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			var recvErr error
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				defer w2.Close()
+				recvErr = receiver.Receive(ctx)
+			}()
+
+			mustRecvType(t, peer, ZRINIT, "initial ZRINIT")
+			fh := makeHeader(ZFILE)
+			fh.SetZF0(ZCBIN)
+			if err := peer.sendBinHeader(fh); err != nil {
+				t.Fatalf("send ZFILE: %v", err)
+			}
+			if err := peer.sendSubpacket(marshalFileInfo(&FileOffer{Name: "frames.bin", Size: int64(len(content))}, 0, 0), ZCRCW); err != nil {
+				t.Fatalf("send ZFILE metadata: %v", err)
+			}
+			mustRecvType(t, peer, ZRPOS, "ZRPOS")
+
+			tc.script(peerScript{t, peer})
+			// Any ZRPOS the script did not expect shows up here instead.
+			mustRecvType(t, peer, ZRINIT, "ZRINIT after ZEOF")
+
+			if err := peer.sendHexHeader(makeHeader(ZFIN)); err != nil {
+				t.Fatalf("send ZFIN: %v", err)
+			}
+			mustRecvType(t, peer, ZFIN, "receiver ZFIN")
+			_ = peer.tw.writeRaw([]byte("OO"))
+			_ = peer.tw.Flush()
+
+			<-done
+			w1.Close()
+			if recvErr != nil {
+				t.Fatalf("receiver returned error: %v", recvErr)
+			}
+			recvHandler.mu.Lock()
+			defer recvHandler.mu.Unlock()
+			if got := recvHandler.receivedFiles["frames.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+				t.Fatalf("frames.bin = %q, want %q", got, content)
+			}
+		})
+	}
+}
+
+// TestReceiverZDATAAheadBounded: a sender that keeps re-offering a frame
+// ahead of the write offset runs out the data retry budget.
+func TestReceiverZDATAAheadBounded(t *testing.T) {
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+
+	recvHandler := newTestHandler()
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, recvHandler,
+		&Config{DataRetries: 3, Logger: discardLogger()})
+	peer := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, newTestHandler(), nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var recvErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer w2.Close()
+		recvErr = receiver.Receive(ctx)
+	}()
+
+	mustRecvType(t, peer, ZRINIT, "initial ZRINIT")
+	fh := makeHeader(ZFILE)
+	fh.SetZF0(ZCBIN)
+	if err := peer.sendBinHeader(fh); err != nil {
+		t.Fatalf("send ZFILE: %v", err)
+	}
+	if err := peer.sendSubpacket(marshalFileInfo(&FileOffer{Name: "stuck.bin", Size: 100}, 0, 0), ZCRCW); err != nil {
+		t.Fatalf("send ZFILE metadata: %v", err)
+	}
+	mustRecvType(t, peer, ZRPOS, "ZRPOS")
+
+	rpos := 0
+	for {
+		if err := peer.sendBinHeader(makePosHeader(ZDATA, 50)); err != nil {
+			break
+		}
+		if err := peer.sendSubpacket(make([]byte, 50), ZCRCE); err != nil {
+			break
+		}
+		hdr, err := peer.recvHeader()
+		if err != nil {
+			break // the receiver gave up and closed its side
+		}
+		if hdr.Type != ZRPOS || hdr.Position() != 0 {
+			t.Fatalf("got %s %d, want ZRPOS 0", frameTypeName(hdr.Type), hdr.Position())
+		}
+		rpos++
+		if rpos > 10 {
+			t.Fatal("receiver keeps re-requesting past its DataRetries budget")
+		}
+	}
+	<-done
+	w1.Close()
+	if recvErr == nil {
+		t.Fatal("Receive succeeded against a stuck sender")
+	}
+	if rpos != 3 {
+		t.Errorf("%d ZRPOS before giving up, want 3", rpos)
+	}
+	recvHandler.mu.Lock()
+	defer recvHandler.mu.Unlock()
+	if err, ok := recvHandler.completedFiles["stuck.bin"]; !ok || err == nil {
+		t.Errorf("stuck.bin completed with %v (reported %v), want an error", err, ok)
+	}
+}
+
+// TestSenderZFINRetried: a receiver answering ZFIN with anything but ZFIN has
+// not taken it in. The sender asks again a bounded number of times, and ends
+// with ErrCloseIncomplete rather than success if the answer never comes.
+func TestSenderZFINRetried(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		zrinits int // ZFINs answered with ZRINIT before the peer cooperates
+		want    error
+	}{
+		{"cooperates after one ZRINIT", 1, nil},
+		{"never cooperates", 100, ErrCloseIncomplete},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r1, w1 := bufferedPipe(256) // sender -> peer
+			r2, w2 := bufferedPipe(256) // peer -> sender
+			sender := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, newTestHandler(),
+				&Config{RecvTimeout: 2 * time.Second, Logger: discardLogger()})
+			peer := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(), &Config{})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+
+			var sendErr error
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				defer w1.Close()
+				sendErr = sender.Send(ctx)
+			}()
+
+			mustRecvType(t, peer, ZRQINIT, "ZRQINIT")
+			if err := peer.sendZRINIT(); err != nil {
+				t.Fatalf("send ZRINIT: %v", err)
+			}
+			fins := 0
+			for {
+				hdr, err := peer.recvHeader()
+				if err != nil {
+					break // the sender has given up and gone
+				}
+				if hdr.Type != ZFIN {
+					t.Fatalf("got %s, want ZFIN", frameTypeName(hdr.Type))
+				}
+				fins++
+				if fins <= tc.zrinits {
+					if err := peer.sendZRINIT(); err != nil {
+						t.Fatalf("send ZRINIT: %v", err)
+					}
+					continue
+				}
+				if err := peer.sendHexHeader(makeHeader(ZFIN)); err != nil {
+					t.Fatalf("send ZFIN: %v", err)
+				}
+				break
+			}
+			<-done
+			w2.Close()
+
+			if !errors.Is(sendErr, tc.want) {
+				t.Fatalf("Send = %v, want %v", sendErr, tc.want)
+			}
+			if wantFins := min(tc.zrinits, maxFinResends) + 1; fins != wantFins {
+				t.Fatalf("sender sent %d ZFINs, want %d", fins, wantFins)
+			}
+		})
+	}
+}
+
+// goneWriter fails every write once gone is set, as a transport does after
+// the peer has closed it.
+type goneWriter struct {
+	w    io.Writer
+	gone atomic.Bool
+}
+
+func (g *goneWriter) Write(p []byte) (int, error) {
+	if g.gone.Load() {
+		return 0, io.ErrClosedPipe
+	}
+	return g.w.Write(p)
+}
+
+// TestSenderOOAfterPeerGone: a receiver that exits on sending its ZFIN may
+// close the connection before the sender's OO. The session is complete by
+// then, so Send succeeds.
+func TestSenderOOAfterPeerGone(t *testing.T) {
+	r1, w1 := bufferedPipe(256) // sender -> peer
+	r2, w2 := bufferedPipe(256) // peer -> sender
+	out := &goneWriter{w: w1}
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: out}, newTestHandler(),
+		&Config{RecvTimeout: 2 * time.Second, Logger: discardLogger()})
+	peer := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(), &Config{})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var sendErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer w1.Close()
+		sendErr = sender.Send(ctx)
+	}()
+
+	mustRecvType(t, peer, ZRQINIT, "ZRQINIT")
+	if err := peer.sendZRINIT(); err != nil {
+		t.Fatalf("send ZRINIT: %v", err)
+	}
+	mustRecvType(t, peer, ZFIN, "ZFIN")
+	out.gone.Store(true)
+	if err := peer.sendHexHeader(makeHeader(ZFIN)); err != nil {
+		t.Fatalf("send ZFIN: %v", err)
+	}
+	<-done
+	w2.Close()
+
+	if sendErr != nil {
+		t.Fatalf("Send = %v, want nil", sendErr)
+	}
+}
+
+// TestSenderCRC16OnlyReceiverAfterReceive: a Session that received from a
+// CRC-32 sender then sends to a receiver without CANFC32, as an old rz build
+// is. Every binary header it sends must be ZBIN with CRC-16 subpackets; the
+// CRC-32 the Receive negotiated used to carry over and put the ZFILE out as
+// ZBIN32, which such a receiver NAKs until the session fails.
+func TestSenderCRC16OnlyReceiverAfterReceive(t *testing.T) {
+	r1, rawW1 := bufferedPipe(256) // session -> peer
+	r2, w2 := bufferedPipe(256)    // peer -> session
+	rec := &recordWriter{w: rawW1}
+
+	handler := newTestHandler()
+	session := NewSession(&pipeReadWriter{Reader: r2, Writer: rec}, handler,
+		&Config{Use32BitCRC: true, MaxBlockSize: 1024, Logger: discardLogger()})
+
+	// Phase 1: a CRC-32 sender delivers a file to the session.
+	first := []byte("received with CRC-32")
+	modern := newTestHandler()
+	modern.filesToSend = []*FileOffer{{Name: "in.txt", Size: int64(len(first)), Reader: bytes.NewReader(first)}}
+	other := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, modern,
+		&Config{Use32BitCRC: true, MaxBlockSize: 1024, Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); sendErr = other.Send(ctx) }()
+	go func() { defer wg.Done(); recvErr = session.Receive(ctx) }()
+	wg.Wait()
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("phase 1: send=%v recv=%v", sendErr, recvErr)
+	}
+	phase2 := len(rec.snapshot())
+
+	// Phase 2: the same session sends to a CRC-16-only receiver.
+	content := []byte("sent with CRC-16 only")
+	handler.filesToSend = []*FileOffer{{Name: "out.txt", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	legacy := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(), &Config{MaxBlockSize: 1024})
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sendErr = session.Send(ctx)
+	}()
+
+	mustRecvType(t, legacy, ZRQINIT, "ZRQINIT")
+	if err := legacy.sendZRINIT(); err != nil { // no CANFC32
+		t.Fatalf("send ZRINIT: %v", err)
+	}
+	info, data := peerReceiveOneFile(t, legacy)
+	if info.Name != "out.txt" || !bytes.Equal(data, content) {
+		t.Fatalf("received %q = %q, want out.txt = %q", info.Name, data, content)
+	}
+	mustRecvType(t, legacy, ZFIN, "sender ZFIN")
+	if err := legacy.sendHexHeader(makeHeader(ZFIN)); err != nil {
+		t.Fatalf("send ZFIN: %v", err)
+	}
+	<-done
+	if sendErr != nil {
+		t.Fatalf("phase 2: Send = %v", sendErr)
+	}
+	if legacy.useCRC32 {
+		t.Error("the sender used a ZBIN32 frame with a CRC-16-only receiver")
+	}
+	if bytes.Contains(rec.snapshot()[phase2:], []byte{ZPAD, ZDLE, ZBIN32}) {
+		t.Error("ZBIN32 header on the wire to a CRC-16-only receiver")
+	}
+}
@@ -0,0 +1,61 @@
+package zmodem
+
+import (
+	"bytes"
+	"testing"
+)
+
+// largeBlockTransfer sends 1 MB between the two configs, writing each received
+// subpacket straight to the sink, and returns the largest block that arrived.
+func largeBlockTransfer(t *testing.T, sendCfg, recvCfg Config) int {
+	t.Helper()
+	content := randomContent(1 << 20)
+	sink := &sinkWriter{}
+	sendCfg.Use32BitCRC, sendCfg.Logger = true, discardLogger()
+	recvCfg.Use32BitCRC, recvCfg.Logger, recvCfg.FileBufferSize = true, discardLogger(), -1
+	receiveInto(t, content, sink, &sendCfg, &recvCfg)
+	if !bytes.Equal(sink.buf.Bytes(), content) {
+		t.Fatalf("received %d bytes, want the %d sent", sink.buf.Len(), len(content))
+	}
+	return sink.maxWrite
+}
+
+func TestLargeBlocksLoopback(t *testing.T) {
+	for _, size := range []int{32 << 10, 64 << 10} {
+		cfg := Config{MaxBlockSize: size, LargeBlocks: true}
+		if got := largeBlockTransfer(t, cfg, cfg); got != size {
+			t.Errorf("MaxBlockSize %d: largest block %d", size, got)
+		}
+	}
+}
+
+func TestLargeBlocksNeedBothEnds(t *testing.T) {
+	large := Config{MaxBlockSize: 64 << 10, LargeBlocks: true}
+	for _, tc := range []struct {
+		name             string
+		sendCfg, recvCfg Config
+	}{
+		{"receiver without", large, Config{MaxBlockSize: 8192}},
+		{"sender without", Config{MaxBlockSize: 64 << 10}, large},
+	} {
+		if got := largeBlockTransfer(t, tc.sendCfg, tc.recvCfg); got != 8192 {
+			t.Errorf("%s: largest block %d, want 8192", tc.name, got)
+		}
+	}
+}
+
+func TestLargeBlocksDefaultsClamp(t *testing.T) {
+	for _, tc := range []struct {
+		cfg  Config
+		want int
+	}{
+		{Config{MaxBlockSize: 1 << 20}, 8192},
+		{Config{MaxBlockSize: 1 << 20, LargeBlocks: true}, 65536},
+		{Config{MaxBlockSize: 16 << 10, LargeBlocks: true}, 16 << 10},
+	} {
+		tc.cfg.defaults()
+		if tc.cfg.MaxBlockSize != tc.want {
+			t.Errorf("LargeBlocks=%v: MaxBlockSize %d, want %d", tc.cfg.LargeBlocks, tc.cfg.MaxBlockSize, tc.want)
+		}
+	}
+}
@@ -4,12 +4,16 @@ import (
 	"bytes"
 	"context"
 	"crypto/rand"
+	"errors"
 	"io"
 	"net"
+	"os"
+	"slices"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
+	"testing/iotest"
 	"time"
 )
 
@@ -179,17 +183,18 @@ func TestLoopbackSingleFile(t *testing.T) {
 	// Run sender and receiver concurrently
 	var wg sync.WaitGroup
 	var sendErr, recvErr error
+	var sent, received []TransferResult
 
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
 		defer senderClose()
-		sendErr = sender.Send(ctx)
+		sent, sendErr = sender.SendResult(ctx)
 	}()
 	go func() {
 		defer wg.Done()
 		defer receiverClose()
-		recvErr = receiver.Receive(ctx)
+		received, recvErr = receiver.ReceiveResult(ctx)
 	}()
 
 	wg.Wait()
@@ -201,33 +206,39 @@ func TestLoopbackSingleFile(t *testing.T) {
 		t.Fatalf("receiver error: %v", recvErr)
 	}
 
+	// Both ends report the one file, whole
+	for _, side := range []struct {
+		name    string
+		results []TransferResult
+	}{{"sender", sent}, {"receiver", received}} {
+		if len(side.results) != 1 {
+			t.Fatalf("%s results %+v, want one file", side.name, side.results)
+		}
+		r := side.results[0]
+		if r.Info.Name != "test.txt" || r.Bytes != int64(len(testContent)) || r.StartOffset != 0 || r.Err != nil {
+			t.Errorf("%s result %+v, want test.txt whole", side.name, r)
+		}
+	}
+
 	// Verify received file
 	receiverHandler.mu.Lock()
 	defer receiverHandler.mu.Unlock()
 
-	received, ok := receiverHandler.receivedFiles["test.txt"]
+	data, ok := receiverHandler.receivedFiles["test.txt"]
 	if !ok {
 		t.Fatal("file 'test.txt' not received")
 	}
 
-	if !bytes.Equal(received.Bytes(), testContent) {
-		t.Errorf("received content mismatch: got %d bytes, want %d bytes", received.Len(), len(testContent))
-	}
-
-	// Check completion
-	if err, ok := receiverHandler.completedFiles["test.txt"]; !ok {
-		t.Error("file not marked as completed")
-	} else if err != nil {
-		t.Errorf("file completed with error: %v", err)
+	if !bytes.Equal(data.Bytes(), testContent) {
+		t.Errorf("received content mismatch: got %d bytes, want %d bytes", data.Len(), len(testContent))
 	}
 }
 
 // TestLoopbackDirZap exercises DirZap mode: 8192-byte subpackets with minimal
-// ZDLE escaping (only 0x18 escaped) and no XON/XOFF stripping on receive. The
-// payload deliberately contains XON (0x11), XOFF (0x13), and ZDLE (0x18) bytes
-// in bulk — in DirZap these are data, not flow control, so they must survive a
-// round trip untouched. If stripXonXoff were left enabled, the 0x11/0x13 bytes
-// would be silently dropped and the content check below would fail.
+// ZDLE escaping (only ZDLE, XON and XOFF escaped) and no XON/XOFF stripping on
+// receive. The payload deliberately contains XON (0x11), XOFF (0x13), and ZDLE
+// (0x18) bytes in bulk — in DirZap these are data, not flow control, so they
+// must survive a round trip untouched.
 func TestLoopbackDirZap(t *testing.T) {
 	senderTransport, receiverTransport, senderClose, receiverClose := newTestTransports()
 
@@ -378,6 +389,7 @@ func TestLoopbackBatchFiles(t *testing.T) {
 }
 
 func TestLoopbackSkipFile(t *testing.T) {
+	const keepContent = "keep this file content - it should be received"
 	senderTransport, receiverTransport, senderClose, receiverClose := newTestTransports()
 
 	senderHandler := newTestHandler()
@@ -390,7 +402,7 @@ func TestLoopbackSkipFile(t *testing.T) {
 		{
 			Name:   "keep_me.txt",
 			Size:   50,
-			Reader: bytes.NewReader([]byte("keep this file content - it should be received")),
+			Reader: strings.NewReader(keepContent),
 		},
 	}
 
@@ -405,17 +417,18 @@ func TestLoopbackSkipFile(t *testing.T) {
 
 	var wg sync.WaitGroup
 	var sendErr, recvErr error
+	var sent, received []TransferResult
 
 	wg.Add(2)
 	go func() {
 		defer wg.Done()
 		defer senderClose()
-		sendErr = sender.Send(ctx)
+		sent, sendErr = sender.SendResult(ctx)
 	}()
 	go func() {
 		defer wg.Done()
 		defer receiverClose()
-		recvErr = receiver.Receive(ctx)
+		received, recvErr = receiver.ReceiveResult(ctx)
 	}()
 
 	wg.Wait()
@@ -427,17 +440,21 @@ func TestLoopbackSkipFile(t *testing.T) {
 		t.Fatalf("receiver error: %v", recvErr)
 	}
 
-	receiverHandler.mu.Lock()
-	defer receiverHandler.mu.Unlock()
-
-	// skip_me.txt should not be in receivedFiles
-	if _, ok := receiverHandler.receivedFiles["skip_me.txt"]; ok {
-		t.Error("skip_me.txt should not have been received")
-	}
-
-	// keep_me.txt should be received
-	if _, ok := receiverHandler.receivedFiles["keep_me.txt"]; !ok {
-		t.Error("keep_me.txt should have been received")
+	// skip_me.txt is skipped at both ends, keep_me.txt received whole
+	for _, side := range []struct {
+		name    string
+		results []TransferResult
+	}{{"sender", sent}, {"receiver", received}} {
+		if len(side.results) != 2 {
+			t.Fatalf("%s results %+v, want two files", side.name, side.results)
+		}
+		skipped, kept := side.results[0], side.results[1]
+		if skipped.Info.Name != "skip_me.txt" || !skipped.Skipped() {
+			t.Errorf("%s: %+v, want skip_me.txt skipped", side.name, skipped)
+		}
+		if kept.Info.Name != "keep_me.txt" || kept.Skipped() || kept.Err != nil || kept.Bytes != int64(len(keepContent)) {
+			t.Errorf("%s: %+v, want keep_me.txt whole", side.name, kept)
+		}
 	}
 }
 
@@ -621,13 +638,14 @@ func TestLoopbackCRC32(t *testing.T) {
 type corruptingWriter struct {
 	w            io.Writer
 	targetCount  int   // which subpacket to corrupt (1-based)
+	every        int   // if > 0, also corrupt every every-th ZCRCG after targetCount
 	currentCount int32 // atomic counter for ZCRCG sequences seen
 	prev         byte  // previous byte for ZDLE detection
 	corrupted    atomic.Bool
 }
 
 func (cw *corruptingWriter) Write(p []byte) (int, error) {
-	if cw.corrupted.Load() {
+	if cw.corrupted.Load() && cw.every == 0 {
 		return cw.w.Write(p)
 	}
 
@@ -638,7 +656,8 @@ func (cw *corruptingWriter) Write(p []byte) (int, error) {
 	for i := 0; i < len(buf); i++ {
 		if cw.prev == ZDLE && buf[i] == ZCRCG {
 			cw.currentCount++
-			if int(cw.currentCount) == cw.targetCount {
+			n := int(cw.currentCount)
+			if n == cw.targetCount || cw.every > 0 && n > cw.targetCount && (n-cw.targetCount)%cw.every == 0 {
 				// Corrupt the CRC bytes that follow this ZCRCG.
 				// They may be in this write or a subsequent one.
 				// Corrupt what we can in this buffer.
@@ -760,12 +779,10 @@ func TestRecvTimeoutDeadlineCapableTransport(t *testing.T) {
 		t.Fatal("expected timeout error, got nil")
 	}
 
-	// The error surfaces as max retries exceeded (each retry triggers a deadline timeout)
-	// or as a direct timeout error — either is acceptable.
-	errStr := err.Error()
-	if !strings.Contains(errStr, "timeout") && !strings.Contains(errStr, "deadline") &&
-		!strings.Contains(errStr, "i/o timeout") && !strings.Contains(errStr, "max retries") {
-		t.Fatalf("expected timeout or max retries error, got: %v", err)
+	// The error surfaces as max retries exceeded (each retry triggers a deadline
+	// timeout), wrapping the last read's typed timeout.
+	if !errors.Is(err, ErrTimeout) {
+		t.Fatalf("expected an ErrTimeout, got: %v", err)
 	}
 
 	// Should complete within a reasonable time (retries * timeout + overhead).
@@ -776,9 +793,98 @@ func TestRecvTimeoutDeadlineCapableTransport(t *testing.T) {
 	if elapsed > maxExpected {
 		t.Errorf("took too long: %v (max expected %v)", elapsed, maxExpected)
 	}
+	// Reused deadlines may let a timeout run late, never early: each of the
+	// MaxRetries waits for ZFILE lasted at least RecvTimeout.
+	if minExpected := time.Duration(session.cfg.MaxRetries) * cfg.RecvTimeout; elapsed < minExpected {
+		t.Errorf("timed out after %v, want at least %v", elapsed, minExpected)
+	}
 	t.Logf("completed in %v with error: %v", elapsed, err)
 }
 
+// deadlineRecorder is a deadline-capable transport that records every read
+// deadline the session applies. Reads come from r, or time out at once.
+type deadlineRecorder struct {
+	r         io.Reader
+	deadlines []time.Time
+}
+
+func (d *deadlineRecorder) Read(p []byte) (int, error) {
+	if d.r == nil {
+		return 0, os.ErrDeadlineExceeded
+	}
+	return d.r.Read(p)
+}
+
+func (d *deadlineRecorder) Write(p []byte) (int, error) { return len(p), nil }
+func (d *deadlineRecorder) SetReadDeadline(t time.Time) error {
+	d.deadlines = append(d.deadlines, t)
+	return nil
+}
+
+func TestRecvDeadlineRestoredOnExit(t *testing.T) {
+	callerDeadline := time.Now().Add(time.Hour)
+	for _, tc := range []struct {
+		name string
+		cfg  *Config
+		want time.Time
+	}{
+		{"cleared by default", &Config{RecvTimeout: 5 * time.Millisecond, MaxRetries: 2}, time.Time{}},
+		{"RestoreDeadline", &Config{RecvTimeout: 5 * time.Millisecond, MaxRetries: 2, RestoreDeadline: callerDeadline}, callerDeadline},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := &deadlineRecorder{}
+			tc.cfg.Logger = discardLogger()
+			if err := NewSession(rec, newTestHandler(), tc.cfg).Receive(context.Background()); !errors.Is(err, ErrTimeout) {
+				t.Fatalf("Receive = %v, want an ErrTimeout", err)
+			}
+			if len(rec.deadlines) < 2 {
+				t.Fatalf("deadlines = %v, want the session's own and a final one", rec.deadlines)
+			}
+			if last := rec.deadlines[len(rec.deadlines)-1]; !last.Equal(tc.want) {
+				t.Fatalf("final read deadline = %v, want %v", last, tc.want)
+			}
+		})
+	}
+}
+
+// TestRecvDeadlineArmedOncePerTimeoutSlice reads a trickle of bytes, each
+// arriving on its own and so each found with the buffer empty: the idle
+// deadline is set once for all of them, not per byte.
+func TestRecvDeadlineArmedOncePerTimeoutSlice(t *testing.T) {
+	rec := &deadlineRecorder{r: iotest.OneByteReader(bytes.NewReader(make([]byte, 1000)))}
+	tr := newTransportReader(rec, 1200, 10*time.Second, true, discardLogger())
+	for range 1000 {
+		if _, err := tr.readByte(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(rec.deadlines) != 1 {
+		t.Fatalf("%d read deadlines set for 1000 single-byte reads, want 1", len(rec.deadlines))
+	}
+
+	// A phase change re-arms at once for the other timeout.
+	tr.dataTimeout = time.Minute
+	tr.setDataPhase(true)
+	tr.wire.r = iotest.OneByteReader(bytes.NewReader([]byte{1}))
+	if _, err := tr.readByte(); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(rec.deadlines); n != 2 || rec.deadlines[1].Sub(rec.deadlines[0]) < 49*time.Second {
+		t.Fatalf("deadlines after entering the data phase = %v, want a second, a minute out", rec.deadlines)
+	}
+}
+
+func TestRecvDeadlineUntouchedWhenDisabled(t *testing.T) {
+	r1, w1 := bufferedPipe(256)
+	w1.Close()
+	rec := &deadlineRecorder{r: r1}
+	cfg := &Config{RecvTimeout: 0, RestoreDeadline: time.Now(), Logger: discardLogger()}
+	NewSession(rec, newTestHandler(), cfg).Receive(context.Background())
+	if len(rec.deadlines) != 0 {
+		t.Fatalf("session with RecvTimeout 0 set read deadlines %v", rec.deadlines)
+	}
+}
+
 // TestLoopbackZCRCQCheckpoints tests that ZCRCQ checkpoints are emitted during
 // streaming when the receiver advertises CANFDX.
 func TestLoopbackZCRCQCheckpoints(t *testing.T) {
@@ -933,6 +1039,300 @@ func TestLoopbackWindowFlowControl(t *testing.T) {
 	}
 }
 
+// TestLoopbackWindowProbesOncePerWindow: a receiver without CANFDX and with a
+// window gets one ZCRCW per window of data. The ZACK that answers it carries
+// over into the ZDATA frame restarted after it, so
+// the window is never counted full twice for the same data.
+func TestLoopbackWindowProbesOncePerWindow(t *testing.T) {
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+
+	var zcrcwCount atomic.Int32
+	snoopW := &snoopingWriter{w: w1, onByte: func(prev, cur byte) {
+		if prev == ZDLE && cur == ZCRCW {
+			zcrcwCount.Add(1)
+		}
+	}}
+	senderT := &pipeReadWriter{Reader: r2, Writer: snoopW}
+	receiverT := &halfDuplexMock{r: r1, w: w2} // no CANFDX in its ZRINIT
+
+	const window = 4096
+	testContent := make([]byte, 64*1024)
+	rand.Read(testContent)
+
+	senderHandler := newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{
+		{Name: "probes.bin", Size: int64(len(testContent)), Reader: bytes.NewReader(testContent)},
+	}
+	receiverHandler := newTestHandler()
+
+	sender := NewSession(senderT, senderHandler, &Config{MaxBlockSize: 1024, Logger: discardLogger()})
+	receiver := NewSession(receiverT, receiverHandler, &Config{WindowSize: window, Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer w1.Close()
+		sendErr = sender.Send(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		defer w2.Close()
+		recvErr = receiver.Receive(ctx)
+	}()
+	wg.Wait()
+
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+	receiverHandler.mu.Lock()
+	received := receiverHandler.receivedFiles["probes.bin"]
+	receiverHandler.mu.Unlock()
+	if received == nil || !bytes.Equal(received.Bytes(), testContent) {
+		t.Fatal("probes.bin not received intact")
+	}
+
+	// One probe per full window; the ZFILE metadata subpacket ends with a
+	// ZCRCW too.
+	want := len(testContent)/window + 1
+	if got := int(zcrcwCount.Load()); got < want-1 || got > want+want/4 {
+		t.Errorf("sent %d ZCRCW, want about %d (one per %d-byte window)", got, want, window)
+	}
+}
+
+// emptyCheckpoints decodes a sender's output and counts the zero-length ZCRCQ
+// and ZCRCW subpackets in its ZDATA frames.
+func emptyCheckpoints(t *testing.T, stream []byte) (empty, data int) {
+	t.Helper()
+	s := &Session{
+		tw:     newTransportWriter(io.Discard, EscapeStandard),
+		tr:     newTransportReader(bytes.NewReader(stream), 1<<20, 0, true, discardLogger()),
+		logger: discardLogger(),
+	}
+	for {
+		hdr, err := s.recvHeader()
+		if err != nil {
+			return empty, data
+		}
+		if hdr.Type != ZDATA {
+			continue
+		}
+		for {
+			sub, end, err := s.recvSubpacket(1 << 16)
+			if err != nil {
+				t.Fatalf("decoding sender output: %v", err)
+			}
+			data += len(sub)
+			if len(sub) == 0 && (end == ZCRCQ || end == ZCRCW) {
+				empty++
+			}
+			if end == ZCRCE || end == ZCRCW {
+				break
+			}
+		}
+	}
+}
+
+// TestLoopbackWindowNoEmptyCheckpoints: a windowed transfer asks for its
+// ZACKs on data subpackets, never with a zero-length ZCRCQ or ZCRCW.
+func TestLoopbackWindowNoEmptyCheckpoints(t *testing.T) {
+	for _, tc := range []struct {
+		name       string
+		halfDuplex bool // no CANFDX: ZCRCW at each window, else sliding ZCRCQs
+	}{
+		{"full duplex", false},
+		{"half duplex", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r1, w1 := bufferedPipe(256)
+			r2, w2 := bufferedPipe(256)
+
+			rec := &recordWriter{w: w1}
+			senderT := &pipeReadWriter{Reader: r2, Writer: rec}
+			var receiverT io.ReadWriter = &pipeReadWriter{Reader: r1, Writer: w2}
+			if tc.halfDuplex {
+				receiverT = &halfDuplexMock{r: r1, w: w2}
+			}
+
+			testContent := make([]byte, 48*1024+100)
+			rand.Read(testContent)
+			senderHandler := newTestHandler()
+			senderHandler.filesToSend = []*FileOffer{
+				{Name: "nozero.bin", Size: int64(len(testContent)), Reader: bytes.NewReader(testContent)},
+			}
+			receiverHandler := newTestHandler()
+
+			sender := NewSession(senderT, senderHandler, &Config{MaxBlockSize: 1024, Logger: discardLogger()})
+			receiver := NewSession(receiverT, receiverHandler, &Config{WindowSize: 4096, Logger: discardLogger()})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			defer cancel()
+
+			var wg sync.WaitGroup
+			var sendErr, recvErr error
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				defer w1.Close()
+				sendErr = sender.Send(ctx)
+			}()
+			go func() {
+				defer wg.Done()
+				defer w2.Close()
+				recvErr = receiver.Receive(ctx)
+			}()
+			wg.Wait()
+
+			if sendErr != nil || recvErr != nil {
+				t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+			}
+			receiverHandler.mu.Lock()
+			received := receiverHandler.receivedFiles["nozero.bin"]
+			receiverHandler.mu.Unlock()
+			if received == nil || !bytes.Equal(received.Bytes(), testContent) {
+				t.Fatal("nozero.bin not received intact")
+			}
+			empty, data := emptyCheckpoints(t, rec.snapshot())
+			if data != len(testContent) {
+				t.Fatalf("decoded %d data bytes from the sender, want %d", data, len(testContent))
+			}
+			if empty != 0 {
+				t.Errorf("sender emitted %d zero-length checkpoints", empty)
+			}
+		})
+	}
+}
+
+// TestLoopbackWindowCapsBlockSize: a receiver buffer smaller than the
+// sender's block size caps the blocks, as lrzsz caps blklen at Rxbuflen; a
+// block larger than the window would overrun the buffer it was sized for.
+func TestLoopbackWindowCapsBlockSize(t *testing.T) {
+	const window = 1000
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+
+	testContent := make([]byte, 256*1024)
+	rand.Read(testContent)
+	senderHandler := newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{
+		{Name: "capped.bin", Size: int64(len(testContent)), Reader: bytes.NewReader(testContent)},
+	}
+	receiverHandler := newTestHandler()
+
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, senderHandler,
+		&Config{MaxBlockSize: 8192, Logger: discardLogger()})
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, receiverHandler,
+		&Config{MaxBlockSize: 8192, WindowSize: window, Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer w1.Close()
+		sendErr = sender.Send(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		defer w2.Close()
+		recvErr = receiver.Receive(ctx)
+	}()
+	wg.Wait()
+
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+	receiverHandler.mu.Lock()
+	received := receiverHandler.receivedFiles["capped.bin"]
+	receiverHandler.mu.Unlock()
+	if received == nil || !bytes.Equal(received.Bytes(), testContent) {
+		t.Fatal("capped.bin not received intact")
+	}
+	if got := receiver.Stats().MaxSubpacketRead; got > window {
+		t.Errorf("largest subpacket %d bytes, want at most the %d-byte window", got, window)
+	}
+	if got := sender.Stats().RetransmitWritten; got != 0 {
+		t.Errorf("retransmitted %d bytes on a clean link", got)
+	}
+}
+
+// zackDropper passes a receiver's output on, but for its first drop ZACKs.
+type zackDropper struct {
+	w    io.Writer
+	drop int
+}
+
+func (d *zackDropper) Write(p []byte) (int, error) {
+	if d.drop > 0 && bytes.Contains(p, []byte("**\x18B03")) {
+		d.drop--
+		return len(p), nil
+	}
+	return d.w.Write(p)
+}
+
+// TestLoopbackLostZACKProbes: when the answer to a ZCRCQ is lost, the sender
+// asks again after RecvTimeout with a zero-length ZCRCQ, the one case besides
+// a file's end where it sends an empty subpacket: once in the wait for a full
+// window, and once after a checkpoint without a window.
+func TestLoopbackLostZACKProbes(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		window int
+		drop   int // the ZACKs lost: enough to leave the sender waiting
+	}{
+		{"window wait", 4096, 4},
+		{"checkpoint", 0, 1},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r1, w1 := bufferedPipe(256)
+			r2, w2 := bufferedPipe(256)
+			rec := &recordWriter{w: w1}
+			senderT := &deadlineRW{pumpReader: newPumpReader(r2, nil), Writer: rec} // RecvTimeout needs read deadlines
+			receiverT := &pipeReadWriter{Reader: r1, Writer: &zackDropper{w: w2, drop: tc.drop}}
+
+			testContent := make([]byte, 48*1024+100)
+			rand.Read(testContent)
+			senderHandler := newTestHandler()
+			senderHandler.filesToSend = []*FileOffer{
+				{Name: "lost.bin", Size: int64(len(testContent)), Reader: bytes.NewReader(testContent)},
+			}
+			receiverHandler := newTestHandler()
+			sender := NewSession(senderT, senderHandler, &Config{MaxBlockSize: 1024, RecvTimeout: 200 * time.Millisecond, Logger: discardLogger()})
+			receiver := NewSession(receiverT, receiverHandler, &Config{WindowSize: tc.window, Logger: discardLogger()})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 15*time.Second)
+			defer cancel()
+			var wg sync.WaitGroup
+			var sendErr, recvErr error
+			wg.Add(2)
+			go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+			go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+			wg.Wait()
+
+			if sendErr != nil || recvErr != nil {
+				t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+			}
+			receiverHandler.mu.Lock()
+			received := receiverHandler.receivedFiles["lost.bin"]
+			receiverHandler.mu.Unlock()
+			if received == nil || !bytes.Equal(received.Bytes(), testContent) {
+				t.Fatal("lost.bin not received intact")
+			}
+			if empty, _ := emptyCheckpoints(t, rec.snapshot()); empty != 1 {
+				t.Errorf("sender emitted %d zero-length checkpoints, want 1 for the lost ZACK", empty)
+			}
+		})
+	}
+}
+
 func TestLoopbackResume(t *testing.T) {
 	senderTransport, receiverTransport, senderClose, receiverClose := newTestTransports()
 
@@ -1065,6 +1465,12 @@ func TestLoopbackMaxFileSize(t *testing.T) {
 	if _, ok := receiverHandler.receivedFiles["big.bin"]; ok {
 		t.Error("big.bin should not have been received (exceeds MaxFileSize)")
 	}
+	// ...but the receiver's handler hears it was refused
+	if err, ok := receiverHandler.completedFiles["big.bin"]; !ok {
+		t.Error("receiver handler saw no completion for big.bin")
+	} else if !errors.Is(err, ErrFileTooLarge) || !errors.Is(err, ErrSkip) {
+		t.Errorf("receiver completion for big.bin = %v, want ErrFileTooLarge (an ErrSkip)", err)
+	}
 
 	// Sender should see ErrSkip for big file
 	senderHandler.mu.Lock()
@@ -1074,6 +1480,76 @@ func TestLoopbackMaxFileSize(t *testing.T) {
 	}
 }
 
+// TestLoopbackCheckFile: CheckFile sees every offer, including one
+// MaxFileSize would refuse, and its error reaches FileCompleted.
+func TestLoopbackCheckFile(t *testing.T) {
+	senderTransport, receiverTransport, senderClose, receiverClose := newTestTransports()
+
+	okContent := []byte("allowed")
+	bigContent := make([]byte, 5000)
+	senderHandler := newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{
+		{Name: "blocked.exe", Size: 3, Reader: bytes.NewReader([]byte("MZ!"))},
+		{Name: "big.bin", Size: int64(len(bigContent)), Reader: bytes.NewReader(bigContent)},
+		{Name: "ok.txt", Size: int64(len(okContent)), Reader: bytes.NewReader(okContent)},
+	}
+
+	errBlocked := errors.New("executables not accepted")
+	var checked []string
+	receiverHandler := newTestHandler()
+	receiver := NewSession(receiverTransport, receiverHandler, &Config{
+		MaxFileSize: 1000,
+		CheckFile: func(info FileInfo) error {
+			checked = append(checked, info.Name)
+			if strings.HasSuffix(info.Name, ".exe") {
+				return errBlocked
+			}
+			return nil
+		},
+	})
+	sender := NewSession(senderTransport, senderHandler, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer senderClose()
+		sendErr = sender.Send(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		defer receiverClose()
+		recvErr = receiver.Receive(ctx)
+	}()
+	wg.Wait()
+
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+	if want := []string{"blocked.exe", "big.bin", "ok.txt"}; !slices.Equal(checked, want) {
+		t.Errorf("CheckFile saw %v, want %v", checked, want)
+	}
+
+	receiverHandler.mu.Lock()
+	defer receiverHandler.mu.Unlock()
+	if err := receiverHandler.completedFiles["blocked.exe"]; err != errBlocked {
+		t.Errorf("blocked.exe completed with %v, want the CheckFile error", err)
+	}
+	if err := receiverHandler.completedFiles["big.bin"]; !errors.Is(err, ErrFileTooLarge) {
+		t.Errorf("big.bin completed with %v, want ErrFileTooLarge", err)
+	}
+	if _, ok := receiverHandler.receivedFiles["blocked.exe"]; ok {
+		t.Error("AcceptFile was asked for blocked.exe")
+	}
+	if got := receiverHandler.receivedFiles["ok.txt"]; got == nil || !bytes.Equal(got.Bytes(), okContent) {
+		t.Error("ok.txt not received intact")
+	}
+}
+
 // readOnly wraps a reader to strip io.ReadSeeker, exposing only io.Reader.
 type readOnly struct{ io.Reader }
 
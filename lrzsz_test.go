@@ -10,6 +10,7 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -192,6 +193,12 @@ func (h *lrzszFileHandler) AcceptFile(info FileInfo) (io.WriteCloser, int64, err
 	if err != nil {
 		return nil, 0, err
 	}
+	if perm := info.Permissions(); perm != 0 {
+		if err := f.Chmod(perm); err != nil {
+			f.Close()
+			return nil, 0, err
+		}
+	}
 	return f, 0, nil
 }
 
@@ -220,10 +227,11 @@ func TestLrzszA1_SendSmallCRC16(t *testing.T) {
 		},
 	})
 
-	session := NewSession(conn, handler, &Config{
+	cfg := &Config{
 		Use32BitCRC:  false,
 		MaxBlockSize: 1024,
-	})
+	}
+	session := NewSession(recordCapture(t, conn, "lrzsz-send-small-crc16", true, cfg), handler, cfg)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -508,10 +516,11 @@ func TestLrzszB2_RecvCRC32(t *testing.T) {
 	defer conn.Close()
 
 	handler := newLrzszRecvHandler(recvDir)
-	session := NewSession(conn, handler, &Config{
+	cfg := &Config{
 		Use32BitCRC:  true,
 		MaxBlockSize: 1024,
-	})
+	}
+	session := NewSession(recordCapture(t, conn, "lrzsz-recv-crc32", false, cfg), handler, cfg)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -631,6 +640,8 @@ func TestLrzszB5_RecvBinary256(t *testing.T) {
 	verifyFile(t, filepath.Join(recvDir, "allbytes.bin"), content)
 }
 
+// TestLrzszB6_RecvEscapeAll: sz -e announces its escaping in ZSINIT; a
+// default receiver decodes it and escapes its own headers from then on.
 func TestLrzszB6_RecvEscapeAll(t *testing.T) {
 	srcDir := t.TempDir()
 	recvDir := t.TempDir()
@@ -641,10 +652,7 @@ func TestLrzszB6_RecvEscapeAll(t *testing.T) {
 	defer conn.Close()
 
 	handler := newLrzszRecvHandler(recvDir)
-	session := NewSession(conn, handler, &Config{
-		EscapeMode:   EscapeAll,
-		MaxBlockSize: 1024,
-	})
+	session := NewSession(conn, handler, &Config{MaxBlockSize: 1024})
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -661,6 +669,39 @@ func TestLrzszB6_RecvEscapeAll(t *testing.T) {
 	verifyFile(t, filepath.Join(recvDir, "escaped.bin"), content)
 }
 
+// TestLrzszB12_RecvEscapeAllAdvertised is B6's mirror: our receiver's ZRINIT
+// asks for escaping (ESCCTL) and sz escapes every control byte without -e.
+func TestLrzszB12_RecvEscapeAllAdvertised(t *testing.T) {
+	srcDir := t.TempDir()
+	recvDir := t.TempDir()
+	content := bytes.Repeat([]byte("\x00\x01\x02\x03\x10\x11\x13\x1a\x7f\x80\x8d\x91\x93"), 200)
+	srcPath := createTestFile(t, srcDir, "asked.bin", content)
+
+	rawConn, cmd := startSzSender(t, []string{srcPath}, nil)
+	defer rawConn.Close()
+	conn := &frameEndConn{Conn: rawConn}
+
+	handler := newLrzszRecvHandler(recvDir)
+	session := NewSession(conn, handler, &Config{EscapeMode: EscapeAll, MaxBlockSize: 1024})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := session.Receive(ctx); err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	conn.Close()
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("sz exit error: %v", err)
+	}
+
+	verifyFile(t, filepath.Join(recvDir, "asked.bin"), content)
+	if conn.inCtl != 0 {
+		t.Errorf("sz sent %d raw control bytes, want all escaped", conn.inCtl)
+	}
+}
+
 // ==== Group A: Additional Tests ====
 
 func TestLrzszA8_SendResume(t *testing.T) {
@@ -688,7 +729,8 @@ func TestLrzszA8_SendResume(t *testing.T) {
 		},
 	})
 
-	session := NewSession(conn, handler, &Config{MaxBlockSize: 1024})
+	cfg := &Config{MaxBlockSize: 1024}
+	session := NewSession(recordCapture(t, conn, "lrzsz-send-resume", true, cfg), handler, cfg)
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
@@ -760,3 +802,520 @@ func TestLrzszB7_RecvSkipInBatch(t *testing.T) {
 		t.Errorf("expected ErrSkip for skip_me.txt, got: %v", err)
 	}
 }
+
+// TestLrzszA9_SendLargeBlocksCapped: with LargeBlocks and a 64 KiB
+// MaxBlockSize, a send to rz still uses standard 8 KB blocks.
+func TestLrzszA9_SendLargeBlocksCapped(t *testing.T) {
+	recvDir := t.TempDir()
+
+	content := make([]byte, 256*1024)
+	rand.Read(content)
+
+	conn, cmd := startRzReceiver(t, recvDir, nil)
+	defer conn.Close()
+
+	handler := newLrzszSendHandler([]*FileOffer{
+		{
+			Name:    "large.bin",
+			Size:    int64(len(content)),
+			ModTime: time.Now(),
+			Mode:    0644,
+			Reader:  bytes.NewReader(content),
+		},
+	})
+
+	session := NewSession(conn, handler, &Config{MaxBlockSize: 65536, LargeBlocks: true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	if err := session.Send(ctx); err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	conn.Close()
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("rz exit error: %v", err)
+	}
+	if session.sendBlockLimit != 8192 {
+		t.Fatalf("send block limit = %d with rz, want 8192", session.sendBlockLimit)
+	}
+
+	verifyFile(t, filepath.Join(recvDir, "large.bin"), content)
+}
+
+// TestLrzszB8_RecvLargeBlocks: sz ignores the large-block ZRINIT flag and
+// sends as usual.
+func TestLrzszB8_RecvLargeBlocks(t *testing.T) {
+	srcDir := t.TempDir()
+	recvDir := t.TempDir()
+
+	content := make([]byte, 256*1024)
+	rand.Read(content)
+	srcPath := createTestFile(t, srcDir, "large.bin", content)
+
+	conn, cmd := startSzSender(t, []string{srcPath}, nil)
+	defer conn.Close()
+
+	handler := newLrzszRecvHandler(recvDir)
+	session := NewSession(conn, handler, &Config{MaxBlockSize: 65536, LargeBlocks: true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	if err := session.Receive(ctx); err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	conn.Close()
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("sz exit error: %v", err)
+	}
+
+	verifyFile(t, filepath.Join(recvDir, "large.bin"), content)
+}
+
+// frameEndConn counts the bytes and the ZCRCQ and ZCRCW subpacket ends
+// passing through a connection in each direction, and the raw control bytes
+// read other than ZDLE and the CR, LF and XON framing hex headers. ZDLE
+// followed by 'j' or 'k' only ever ends a subpacket: escaping never produces
+// either byte.
+type frameEndConn struct {
+	net.Conn
+	lastOut, lastIn   byte
+	outBytes, inBytes int
+	outCRCQ, outCRCW  int
+	inCRCQ, inCRCW    int
+	inCtl             int
+}
+
+func (c *frameEndConn) Write(p []byte) (int, error) {
+	c.outBytes += len(p)
+	for _, b := range p {
+		if c.lastOut == ZDLE {
+			switch b {
+			case ZCRCQ:
+				c.outCRCQ++
+			case ZCRCW:
+				c.outCRCW++
+			}
+		}
+		c.lastOut = b
+	}
+	return c.Conn.Write(p)
+}
+
+func (c *frameEndConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.inBytes += n
+	for _, b := range p[:n] {
+		if c.lastIn == ZDLE {
+			switch b {
+			case ZCRCQ:
+				c.inCRCQ++
+			case ZCRCW:
+				c.inCRCW++
+			}
+		}
+		if b < 0x20 && b != ZDLE && b != '\r' && b != '\n' && b != XON {
+			c.inCtl++
+		}
+		c.lastIn = b
+	}
+	return n, err
+}
+
+// TestLrzszA10_SendToWindowedRz: rz with a 4 KiB window advertises it in
+// ZRINIT ZP0/ZP1, and our sender checkpoints at least once per window.
+func TestLrzszA10_SendToWindowedRz(t *testing.T) {
+	recvDir := t.TempDir()
+
+	const window = 4096
+	content := make([]byte, 64*1024)
+	rand.Read(content)
+
+	rawConn, cmd := startRzReceiver(t, recvDir, []string{"-w", fmt.Sprint(window)})
+	defer rawConn.Close()
+	conn := &frameEndConn{Conn: rawConn}
+
+	handler := newLrzszSendHandler([]*FileOffer{
+		{
+			Name:    "window.bin",
+			Size:    int64(len(content)),
+			ModTime: time.Now(),
+			Mode:    0644,
+			Reader:  bytes.NewReader(content),
+		},
+	})
+
+	session := NewSession(conn, handler, &Config{MaxBlockSize: 1024})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	if err := session.Send(ctx); err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	conn.Close()
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("rz exit error: %v", err)
+	}
+	verifyFile(t, filepath.Join(recvDir, "window.bin"), content)
+
+	if session.remoteWindowSize == 0 {
+		t.Skip("this rz build does not advertise a receive window")
+	}
+	if session.remoteWindowSize != window {
+		t.Fatalf("remote window = %d, want %d", session.remoteWindowSize, window)
+	}
+	want := len(content) / window
+	if got := conn.outCRCQ + conn.outCRCW; got < want {
+		t.Errorf("sent %d ZCRCQ/ZCRCW checkpoints, want at least %d (one per window)", got, want)
+	}
+	// A window is never probed twice: at most one ZCRCW per window (and the
+	// ZFILE's), whether the sender slides or stops at each one.
+	if conn.outCRCW > want+want/4+1 {
+		t.Errorf("sent %d ZCRCW, want about %d (one per window)", conn.outCRCW, want)
+	}
+}
+
+// TestLrzszB9_RecvWindowHonoredBySz: sz reads our ZRINIT window and stops
+// for a ZACK at least once per window.
+func TestLrzszB9_RecvWindowHonoredBySz(t *testing.T) {
+	srcDir := t.TempDir()
+	recvDir := t.TempDir()
+
+	const window = 4096
+	content := make([]byte, 64*1024)
+	rand.Read(content)
+	srcPath := createTestFile(t, srcDir, "window.bin", content)
+
+	rawConn, cmd := startSzSender(t, []string{srcPath}, nil)
+	defer rawConn.Close()
+	conn := &frameEndConn{Conn: rawConn}
+
+	handler := newLrzszRecvHandler(recvDir)
+	session := NewSession(conn, handler, &Config{WindowSize: window})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+
+	if err := session.Receive(ctx); err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	conn.Close()
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("sz exit error: %v", err)
+	}
+	verifyFile(t, filepath.Join(recvDir, "window.bin"), content)
+
+	// A sz reading the window from the wrong bytes would see either 0 (never
+	// stop) or a huge window; either way far fewer ZCRCW.
+	if want := len(content) / window; conn.inCRCW < want {
+		t.Errorf("sz sent %d ZCRCW, want at least %d (one per window)", conn.inCRCW, want)
+	}
+}
+
+// TestLrzszA11_SendModeToRz: rz applies the mode we send, which it only does
+// for a mode marked as a regular file.
+func TestLrzszA11_SendModeToRz(t *testing.T) {
+	recvDir := t.TempDir()
+	content := []byte("private")
+
+	conn, cmd := startRzReceiver(t, recvDir, nil)
+	defer conn.Close()
+
+	handler := newLrzszSendHandler([]*FileOffer{
+		{Name: "private.txt", Size: int64(len(content)), Mode: 0600, Reader: bytes.NewReader(content)},
+	})
+	session := NewSession(conn, handler, &Config{MaxBlockSize: 1024})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := session.Send(ctx); err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	conn.Close()
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("rz exit error: %v", err)
+	}
+
+	path := filepath.Join(recvDir, "private.txt")
+	verifyFile(t, path, content)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := fi.Mode().Perm(); got != 0600 {
+		t.Fatalf("rz stored mode %v, want -rw-------", got)
+	}
+}
+
+// TestLrzszB10_RecvSetuidStripped: sz sends a setuid file's full st_mode; what
+// reaches disk through FileInfo.Permissions has the permissions and nothing
+// else.
+func TestLrzszB10_RecvSetuidStripped(t *testing.T) {
+	srcDir := t.TempDir()
+	recvDir := t.TempDir()
+	content := []byte("#!/bin/sh\necho hi\n")
+	srcPath := createTestFile(t, srcDir, "tool.sh", content)
+	if err := os.Chmod(srcPath, 0750|os.ModeSetuid); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, cmd := startSzSender(t, []string{srcPath}, nil)
+	defer conn.Close()
+
+	handler := newLrzszRecvHandler(recvDir)
+	session := NewSession(conn, handler, &Config{MaxBlockSize: 1024})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := session.Receive(ctx); err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	conn.Close()
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("sz exit error: %v", err)
+	}
+
+	path := filepath.Join(recvDir, "tool.sh")
+	verifyFile(t, path, content)
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode() != 0750 {
+		t.Fatalf("stored mode %v, want -rwxr-x--- without setuid", fi.Mode())
+	}
+}
+
+// ==== Windowed mode (rz -w / sz -w) ====
+
+// TestLrzszA12_SendToRzWindow2048 runs a 1 MiB file through rz's 2 KiB
+// receive window: hundreds of window cycles, each needing its ZACK before the
+// sender goes on.
+func TestLrzszA12_SendToRzWindow2048(t *testing.T) {
+	recvDir := t.TempDir()
+
+	const window = 2048
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+
+	rawConn, cmd := startRzReceiver(t, recvDir, []string{"-w", fmt.Sprint(window)})
+	defer rawConn.Close()
+	conn := &frameEndConn{Conn: rawConn}
+
+	handler := newLrzszSendHandler([]*FileOffer{
+		{Name: "window2k.bin", Size: int64(len(content)), ModTime: time.Now(), Mode: 0644, Reader: bytes.NewReader(content)},
+	})
+	session := NewSession(conn, handler, &Config{Use32BitCRC: true, MaxBlockSize: 1024})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+	if err := session.Send(ctx); err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	conn.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("rz exit error: %v", err)
+	}
+	verifyFile(t, filepath.Join(recvDir, "window2k.bin"), content)
+
+	if session.remoteWindowSize == 0 {
+		t.Skip("this rz build does not advertise a receive window")
+	}
+	if session.remoteWindowSize != window {
+		t.Fatalf("remote window = %d, want %d", session.remoteWindowSize, window)
+	}
+	cycles := len(content) / window
+	if got := conn.outCRCQ + conn.outCRCW; got < cycles {
+		t.Errorf("sent %d ZCRCQ/ZCRCW, want at least %d (one per window)", got, cycles)
+	}
+	// Stop-and-wait at each boundary costs a ZACK, not a restarted window:
+	// anything resent shows up as wire bytes well over the payload.
+	if limit := len(content) + len(content)/4; conn.outBytes > limit {
+		t.Errorf("sent %d bytes for a %d-byte file, want at most %d", conn.outBytes, len(content), limit)
+	}
+	if st := session.Stats(); st.RetransmitWritten != 0 {
+		t.Errorf("retransmitted %d bytes on a clean link", st.RetransmitWritten)
+	}
+}
+
+// TestLrzszB11_RecvFromSzWindow2048: sz -w 2048 keeps at most 2 KiB
+// unacknowledged, asking for our ZACK with ZCRCQ, while we advertise the same
+// window.
+func TestLrzszB11_RecvFromSzWindow2048(t *testing.T) {
+	srcDir := t.TempDir()
+	recvDir := t.TempDir()
+
+	const window = 2048
+	content := make([]byte, 1<<20)
+	rand.Read(content)
+	srcPath := createTestFile(t, srcDir, "window2k.bin", content)
+
+	rawConn, cmd := startSzSender(t, []string{srcPath}, []string{"-w", fmt.Sprint(window)})
+	defer rawConn.Close()
+	conn := &frameEndConn{Conn: rawConn}
+
+	handler := newLrzszRecvHandler(recvDir)
+	session := NewSession(conn, handler, &Config{Use32BitCRC: true, WindowSize: window})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+	if err := session.Receive(ctx); err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	conn.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("sz exit error: %v", err)
+	}
+	verifyFile(t, filepath.Join(recvDir, "window2k.bin"), content)
+
+	cycles := len(content) / window
+	if got := conn.inCRCQ + conn.inCRCW; got < cycles {
+		t.Errorf("sz sent %d ZCRCQ/ZCRCW, want at least %d (one per window)", got, cycles)
+	}
+	// A ZRPOS resync would have sz resend data we already had.
+	if limit := len(content) + len(content)/4; conn.inBytes > limit {
+		t.Errorf("received %d bytes for a %d-byte file, want at most %d", conn.inBytes, len(content), limit)
+	}
+	if st := session.Stats(); st.PayloadRead != int64(len(content)) {
+		t.Errorf("received %d bytes of data for a %d-byte file", st.PayloadRead, len(content))
+	}
+}
+
+// ==== Text mode (sz -a / rz -a) ====
+
+var textModeFiles = []struct{ name, content, want string }{
+	{"lf.txt", "alpha\nbeta\ngamma\n", "alpha\nbeta\ngamma\n"},
+	{"crlf.txt", "alpha\r\nbeta\r\ngamma\r\n", "alpha\nbeta\ngamma\n"},
+	{"mixed.txt", "alpha\r\nbeta\ngamma\r\n", "alpha\nbeta\ngamma\n"},
+}
+
+// TestLrzszB13_RecvTextMode: sz -a offers each file with ZCNL; we store it
+// with LF line ends and report no size mismatch for the CRs dropped.
+func TestLrzszB13_RecvTextMode(t *testing.T) {
+	srcDir := t.TempDir()
+	recvDir := t.TempDir()
+	var paths []string
+	for _, f := range textModeFiles {
+		paths = append(paths, createTestFile(t, srcDir, f.name, []byte(f.content)))
+	}
+
+	conn, cmd := startSzSender(t, paths, []string{"-a"})
+	defer conn.Close()
+
+	handler := newLrzszRecvHandler(recvDir)
+	session := NewSession(conn, handler, &Config{MaxBlockSize: 1024})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := session.Receive(ctx); err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	conn.Close()
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("sz exit error: %v", err)
+	}
+
+	for _, f := range textModeFiles {
+		verifyFile(t, filepath.Join(recvDir, f.name), []byte(f.want))
+		if err := handler.completed[f.name]; err != nil {
+			t.Errorf("%s: FileCompleted error %v", f.name, err)
+		}
+	}
+}
+
+// TestLrzszA13_SendTextMode: TextMode offers each file with ZCNL and rz -a
+// stores it with its own (LF) line ends.
+func TestLrzszA13_SendTextMode(t *testing.T) {
+	recvDir := t.TempDir()
+
+	conn, cmd := startRzReceiverWithBaseFlags(t, recvDir, []string{"-Z", "-q", "-O"}, []string{"-a"})
+	defer conn.Close()
+
+	var offers []*FileOffer
+	for _, f := range textModeFiles {
+		offers = append(offers, &FileOffer{
+			Name:    f.name,
+			Size:    int64(len(f.content)),
+			ModTime: time.Now(),
+			Mode:    0644,
+			Reader:  strings.NewReader(f.content),
+		})
+	}
+	handler := newLrzszSendHandler(offers)
+	session := NewSession(conn, handler, &Config{TextMode: true, MaxBlockSize: 1024})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := session.Send(ctx); err != nil {
+		t.Fatalf("Send error: %v", err)
+	}
+	conn.Close()
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("rz exit error: %v", err)
+	}
+
+	for _, f := range textModeFiles {
+		verifyFile(t, filepath.Join(recvDir, f.name), []byte(f.want))
+	}
+}
+
+// ==== CRC-16-only peers ====
+
+// TestLrzszB14_RecvBatchCRC16Forced: sz -o keeps to CRC-16 although our
+// ZRINIT offers CRC-32 (CANFC32); each frame is checked with the CRC its
+// header encoding names. (rz has no switch to drop CANFC32; the CRC-16-only
+// receiver is covered by TestSenderCRC16OnlyReceiverAfterReceive.)
+func TestLrzszB14_RecvBatchCRC16Forced(t *testing.T) {
+	srcDir := t.TempDir()
+	recvDir := t.TempDir()
+
+	files := []struct {
+		name    string
+		content []byte
+	}{
+		{"crc16a.txt", []byte("CRC-16 batch file 1")},
+		{"crc16b.bin", make([]byte, 20000)},
+	}
+	rand.Read(files[1].content)
+
+	var paths []string
+	for _, f := range files {
+		paths = append(paths, createTestFile(t, srcDir, f.name, f.content))
+	}
+
+	conn, cmd := startSzSender(t, paths, []string{"-o"})
+	defer conn.Close()
+
+	handler := newLrzszRecvHandler(recvDir)
+	session := NewSession(conn, handler, &Config{Use32BitCRC: true, MaxBlockSize: 1024})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	if err := session.Receive(ctx); err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	conn.Close()
+
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("sz exit error: %v", err)
+	}
+
+	for _, f := range files {
+		verifyFile(t, filepath.Join(recvDir, f.name), f.content)
+	}
+}
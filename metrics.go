@@ -0,0 +1,236 @@
+package zmodem
+
+import (
+	"context"
+	"errors"
+	"maps"
+	"sync"
+	"sync/atomic"
+)
+
+// Collector gathers metrics from many Sessions at once: a Config shared by
+// the sessions of a server, or the Configs of each given the same Collector,
+// report into it as they run. Its methods are called by the goroutines
+// running Send, Receive or Auto, concurrently when sessions overlap, and
+// must not block. Metrics is one, kept in memory.
+type Collector interface {
+	// SessionStarted is called when a Send, Receive or Auto begins.
+	SessionStarted()
+	// SessionEnded is called when it returns, with the Stats of that run
+	// alone and the error it returned.
+	SessionEnded(stats Stats, err error)
+	// FileCompleted is called with each file's FileCompleted result: the
+	// bytes of it moved in this session, and the error.
+	FileCompleted(info FileInfo, moved int64, err error)
+	// Retransmit is called for each error recovery: a ZRPOS the receiver
+	// sends after a bad subpacket, or one the sender rewinds for.
+	Retransmit()
+	// CRCError is called for each header or subpacket read whose CRC does
+	// not match.
+	CRCError()
+	// GarbageOverflow is called when more line noise than
+	// Config.MaxGarbageCount arrives without a header in it.
+	GarbageOverflow()
+}
+
+// Session outcomes, as SessionOutcome classifies the error a Send, Receive or
+// Auto returned.
+const (
+	OutcomeOK             = "ok"
+	OutcomeRemoteAbort    = "remote abort"    // ErrAborted
+	OutcomeLocalAbort     = "local abort"     // ErrLocalAbort
+	OutcomeCanceled       = "canceled"        // the context was cancelled, or expired
+	OutcomeTimeout        = "timeout"         // ErrTimeout, ErrWriteTimeout
+	OutcomeLostConnection = "lost connection" // the transport closed or failed
+	OutcomeGarbage        = "garbage"         // too much line noise
+	OutcomeError          = "error"           // anything else
+)
+
+// SessionOutcome classifies the error a Send, Receive or Auto returned as one
+// of the Outcome constants, for counting sessions by how they ended.
+func SessionOutcome(err error) string {
+	switch {
+	case err == nil:
+		return OutcomeOK
+	case errors.Is(err, ErrAborted):
+		return OutcomeRemoteAbort
+	case errors.Is(err, ErrLocalAbort):
+		return OutcomeLocalAbort
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return OutcomeCanceled
+	case errors.Is(err, ErrTimeout), errors.Is(err, ErrWriteTimeout), isTimeout(err):
+		return OutcomeTimeout
+	case isLostConnection(err):
+		return OutcomeLostConnection
+	case errors.Is(err, errGarbageOverflow):
+		return OutcomeGarbage
+	}
+	return OutcomeError
+}
+
+// Metrics is a Collector that sums what its sessions report with atomic
+// counters. Snapshot reads them; publish one with expvar, say:
+//
+//	var metrics zmodem.Metrics
+//	expvar.Publish("zmodem", expvar.Func(func() any { return metrics.Snapshot() }))
+//
+// The zero value is ready to use.
+type Metrics struct {
+	active, started                            atomic.Int64
+	bytesRead, bytesWritten                    atomic.Int64
+	payloadRead, payloadWritten, retransmitted atomic.Int64
+	filesOK, filesSkipped, filesFailed         atomic.Int64
+	fileBytes                                  atomic.Int64
+	retransmits, crcErrors, garbage            atomic.Int64
+
+	mu       sync.Mutex
+	outcomes map[string]int64
+}
+
+// MetricsSnapshot is what a Metrics has counted.
+type MetricsSnapshot struct {
+	// ActiveSessions is the sessions running now; StartedSessions, every
+	// one begun.
+	ActiveSessions  int64
+	StartedSessions int64
+	// Outcomes counts the sessions ended, by SessionOutcome.
+	Outcomes map[string]int64
+
+	// The sums of the ended sessions' Stats fields of the same names.
+	BytesRead         int64
+	BytesWritten      int64
+	PayloadRead       int64
+	PayloadWritten    int64
+	RetransmitWritten int64
+
+	// FilesCompleted is the files moved whole, FilesSkipped those skipped
+	// by either end, FilesFailed the rest. FileBytes is the bytes of them
+	// all moved.
+	FilesCompleted int64
+	FilesSkipped   int64
+	FilesFailed    int64
+	FileBytes      int64
+
+	// Retransmits, CRCErrors and GarbageOverflows count the Collector
+	// events of those names.
+	Retransmits      int64
+	CRCErrors        int64
+	GarbageOverflows int64
+}
+
+// RetransmitRate is the part of the file data sent that was sent again: 0
+// on a clean line, 0.5 when every block had to go twice.
+func (s MetricsSnapshot) RetransmitRate() float64 {
+	if s.PayloadWritten == 0 {
+		return 0
+	}
+	return float64(s.RetransmitWritten) / float64(s.PayloadWritten)
+}
+
+// Snapshot returns the counts so far. Each counter is read atomically, but
+// not all of them at one instant: sessions still running may have moved on
+// between two.
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	m.mu.Lock()
+	outcomes := maps.Clone(m.outcomes)
+	m.mu.Unlock()
+	if outcomes == nil {
+		outcomes = map[string]int64{}
+	}
+	return MetricsSnapshot{
+		ActiveSessions:    m.active.Load(),
+		StartedSessions:   m.started.Load(),
+		Outcomes:          outcomes,
+		BytesRead:         m.bytesRead.Load(),
+		BytesWritten:      m.bytesWritten.Load(),
+		PayloadRead:       m.payloadRead.Load(),
+		PayloadWritten:    m.payloadWritten.Load(),
+		RetransmitWritten: m.retransmitted.Load(),
+		FilesCompleted:    m.filesOK.Load(),
+		FilesSkipped:      m.filesSkipped.Load(),
+		FilesFailed:       m.filesFailed.Load(),
+		FileBytes:         m.fileBytes.Load(),
+		Retransmits:       m.retransmits.Load(),
+		CRCErrors:         m.crcErrors.Load(),
+		GarbageOverflows:  m.garbage.Load(),
+	}
+}
+
+func (m *Metrics) SessionStarted() {
+	m.started.Add(1)
+	m.active.Add(1)
+}
+
+func (m *Metrics) SessionEnded(stats Stats, err error) {
+	m.bytesRead.Add(stats.BytesRead)
+	m.bytesWritten.Add(stats.BytesWritten)
+	m.payloadRead.Add(stats.PayloadRead)
+	m.payloadWritten.Add(stats.PayloadWritten)
+	m.retransmitted.Add(stats.RetransmitWritten)
+	m.mu.Lock()
+	if m.outcomes == nil {
+		m.outcomes = make(map[string]int64)
+	}
+	m.outcomes[SessionOutcome(err)]++
+	m.mu.Unlock()
+	m.active.Add(-1)
+}
+
+func (m *Metrics) FileCompleted(_ FileInfo, moved int64, err error) {
+	switch {
+	case err == nil:
+		m.filesOK.Add(1)
+	case errors.Is(err, ErrSkip):
+		m.filesSkipped.Add(1)
+	default:
+		m.filesFailed.Add(1)
+	}
+	m.fileBytes.Add(moved)
+}
+
+func (m *Metrics) Retransmit()      { m.retransmits.Add(1) }
+func (m *Metrics) CRCError()        { m.crcErrors.Add(1) }
+func (m *Metrics) GarbageOverflow() { m.garbage.Add(1) }
+
+// collectRun reports the start of a run to Config.Collector, and returns
+// what reports its end.
+func (s *Session) collectRun() func(err error) {
+	c := s.cfg.Collector
+	c.SessionStarted()
+	before := s.Stats()
+	return func(err error) {
+		c.SessionEnded(s.Stats().since(before), err)
+	}
+}
+
+// readError counts a header or subpacket read error in the session's Stats
+// and reports it to Config.Collector and the session's events, if it is one
+// they count.
+func (s *Session) readError(err error) {
+	c := s.cfg.Collector
+	switch {
+	case errors.Is(err, errBadCRC):
+		s.stats.CRCErrors++
+		if c != nil {
+			c.CRCError()
+		}
+		s.emitCRCError(err)
+	case errors.Is(err, errGarbageOverflow):
+		if c != nil {
+			c.GarbageOverflow()
+		}
+	}
+}
+
+// errorRecovery counts a resend from offset, an earlier one, asked for by
+// the receiver with a ZRPOS: for the file's DSZLOG line, for
+// Config.Collector and the session's events.
+func (s *Session) errorRecovery(offset int64) {
+	s.fileErrors++
+	if s.cfg.Collector != nil {
+		s.cfg.Collector.Retransmit()
+	}
+	if es := s.events.Load(); es != nil {
+		s.emit(es, RetryEvent{Info: s.fileInfo, Offset: offset})
+	}
+}
@@ -0,0 +1,198 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// abortingHandler aborts its session when offered a file.
+type abortingHandler struct {
+	*testFileHandler
+	sess *Session
+}
+
+func (h *abortingHandler) AcceptFile(info FileInfo) (io.WriteCloser, int64, error) {
+	h.sess.Abort()
+	return nil, 0, ErrSkip
+}
+
+// metricsEnd is one session of TestMetricsConcurrentSessions and what it
+// found out for itself.
+type metricsEnd struct {
+	sess    *Session
+	handler *testFileHandler
+	dszlog  bytes.Buffer
+	crcErrs int
+	err     error
+}
+
+func (e *metricsEnd) config(m *Metrics) *Config {
+	return &Config{
+		MaxBlockSize: 512,
+		Use32BitCRC:  true,
+		Collector:    m,
+		DSZLog:       &e.dszlog,
+		Logger:       discardLogger(),
+		FrameTrace: func(dir Direction, _ Header, _ int, _ byte, err error) {
+			if dir == FrameReceived && errors.Is(err, errBadCRC) {
+				e.crcErrs++
+			}
+		},
+	}
+}
+
+// TestMetricsConcurrentSessions runs transfers side by side into one
+// Metrics: a clean one, one over a line that corrupts subpackets, one
+// where the receiver skips a file and one it aborts. The totals are what
+// each session's own Stats, error, DSZLOG and trace add up to.
+func TestMetricsConcurrentSessions(t *testing.T) {
+	var m Metrics
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	var ends []*metricsEnd
+	var wg sync.WaitGroup
+	for pair := range 4 {
+		r1, w1 := bufferedPipe(256)
+		r2, w2 := bufferedPipe(256)
+		var senderOut io.Writer = w1
+		if pair == 1 {
+			senderOut = &corruptingWriter{w: w1, targetCount: 3}
+		}
+		send, recv := &metricsEnd{handler: newTestHandler()}, &metricsEnd{handler: newTestHandler()}
+		for i, size := range []int{16384, 3000} {
+			content := randomContent(size)
+			name := fmt.Sprintf("pair%d-%d.bin", pair, i)
+			send.handler.filesToSend = append(send.handler.filesToSend,
+				&FileOffer{Name: name, Size: int64(size), Reader: bytes.NewReader(content)})
+			if pair == 2 && i == 0 {
+				recv.handler.skipFiles[name] = true
+			}
+		}
+		send.sess = NewSession(&pipeReadWriter{Reader: r2, Writer: senderOut}, send.handler, send.config(&m))
+		var h FileHandler = recv.handler
+		var aborting *abortingHandler
+		if pair == 3 {
+			aborting = &abortingHandler{testFileHandler: recv.handler}
+			h = aborting
+		}
+		recv.sess = NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, h, recv.config(&m))
+		if aborting != nil {
+			aborting.sess = recv.sess
+		}
+		ends = append(ends, send, recv)
+
+		wg.Add(2)
+		go func() { defer wg.Done(); defer w1.Close(); send.err = send.sess.Send(ctx) }()
+		go func() { defer wg.Done(); defer w2.Close(); recv.err = recv.sess.Receive(ctx) }()
+	}
+	wg.Wait()
+
+	want := MetricsSnapshot{StartedSessions: int64(len(ends)), Outcomes: map[string]int64{}}
+	for _, e := range ends {
+		want.Outcomes[SessionOutcome(e.err)]++
+		st := e.sess.Stats()
+		want.BytesRead += st.BytesRead
+		want.BytesWritten += st.BytesWritten
+		want.PayloadRead += st.PayloadRead
+		want.PayloadWritten += st.PayloadWritten
+		want.RetransmitWritten += st.RetransmitWritten
+		want.CRCErrors += int64(e.crcErrs)
+
+		// Z  16384  ... cps   2 errors ... name -1
+		for _, line := range strings.Split(strings.TrimSpace(e.dszlog.String()), "\n") {
+			if line == "" {
+				continue
+			}
+			f := strings.Fields(line)
+			n, _ := strconv.ParseInt(f[1], 10, 64)
+			recoveries, _ := strconv.ParseInt(f[6], 10, 64)
+			want.Retransmits += recoveries
+			switch err := e.handler.completedFiles[f[10]]; {
+			case err == nil:
+				want.FilesCompleted++
+				want.FileBytes += n
+			case errors.Is(err, ErrSkip):
+				want.FilesSkipped++
+			default:
+				want.FilesFailed++
+				want.FileBytes += n
+			}
+		}
+	}
+
+	got := m.Snapshot()
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("snapshot\n%+v\nwant\n%+v", got, want)
+	}
+	for _, e := range ends[:6] {
+		if e.err != nil {
+			t.Errorf("session error: %v", e.err)
+		}
+	}
+	if got.CRCErrors == 0 || got.Retransmits == 0 || got.RetransmitWritten == 0 {
+		t.Errorf("the corrupting line caused no CRC errors or retransmits: %+v", got)
+	}
+	if got.FilesSkipped == 0 || got.Outcomes[OutcomeLocalAbort] != 1 {
+		t.Errorf("no skip or local abort counted: %+v", got)
+	}
+	if rate := got.RetransmitRate(); rate <= 0 || rate >= 1 {
+		t.Errorf("RetransmitRate %v", rate)
+	}
+}
+
+// TestMetricsSessionRunsApart: a Session run twice reports each run's own
+// bytes, not the Stats it has accumulated.
+func TestMetricsSessionRunsApart(t *testing.T) {
+	var m Metrics
+	transport := struct {
+		io.Reader
+		io.Writer
+	}{strings.NewReader(""), io.Discard}
+	sess := NewSession(transport, newTestHandler(), &Config{Collector: &m, Logger: discardLogger(), RecvTimeout: 10 * time.Millisecond, MaxRetries: 1})
+	for range 2 {
+		if err := sess.Receive(context.Background()); err == nil {
+			t.Fatal("Receive over an empty transport succeeded")
+		}
+	}
+	got := m.Snapshot()
+	if got.StartedSessions != 2 || got.ActiveSessions != 0 {
+		t.Fatalf("started %d, active %d", got.StartedSessions, got.ActiveSessions)
+	}
+	if total := sess.Stats().BytesWritten; got.BytesWritten != total {
+		t.Errorf("BytesWritten %d, want the session's %d", got.BytesWritten, total)
+	}
+}
+
+func TestSessionOutcome(t *testing.T) {
+	for _, tc := range []struct {
+		err  error
+		want string
+	}{
+		{nil, OutcomeOK},
+		{errAbortReceived, OutcomeRemoteAbort},
+		{ErrLocalAbort, OutcomeLocalAbort},
+		{fmt.Errorf("waiting: %w", context.Canceled), OutcomeCanceled},
+		{ErrTimeout, OutcomeTimeout},
+		{ErrWriteTimeout, OutcomeTimeout},
+		{os.ErrDeadlineExceeded, OutcomeTimeout},
+		{io.EOF, OutcomeLostConnection},
+		{net.ErrClosed, OutcomeLostConnection},
+		{errGarbageOverflow, OutcomeGarbage},
+		{ErrCannotDetermineRole, OutcomeError},
+	} {
+		if got := SessionOutcome(tc.err); got != tc.want {
+			t.Errorf("SessionOutcome(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package zmodem
+
+import "time"
+
+// mysticFileWaitIdle is MysticCompat's FileWaitIdle. Mystic's sender can sit
+// for several seconds between the files of an upload batch while it opens the
+// next one; a ZRINIT re-prompt landing in that pause makes it abort.
+const mysticFileWaitIdle = 30 * time.Second
+
+// MysticCompat returns a Config for transfers with Mystic BBS's built-in
+// ZMODEM (mutil and the file areas). As a receiver it waits out the pauses
+// Mystic's sender makes between files (FileWaitIdle) instead of re-prompting
+// it. Mystic sends each upload's full DOS path, C:\MYSTIC\UPLOADS\FOO.ZIP;
+// SanitizeFilename reduces it to FOO.ZIP, so AcceptFile should use it as
+// usual. Adjust the returned Config as needed; it is the caller's own.
+func MysticCompat() *Config {
+	return &Config{
+		Use32BitCRC:  true,
+		RecvTimeout:  DefaultRecvTimeout,
+		FileWaitIdle: mysticFileWaitIdle,
+	}
+}
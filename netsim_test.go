@@ -0,0 +1,460 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"io"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+var updateNetsim = flag.Bool("update-netsim", false, "rewrite "+netsimBaselineFile+" from this run")
+
+const netsimBaselineFile = "testdata/netsim_baseline.json"
+
+// simConfig describes one direction of a simulated link.
+type simConfig struct {
+	Delay     time.Duration // one-way propagation delay
+	Jitter    time.Duration // extra delay, uniform in [0, Jitter); never reorders
+	Bandwidth int           // bytes per second; 0 = unlimited
+	Corrupt   float64       // probability that a byte arrives with one bit flipped
+	Seed      uint64        // corruption and jitter are deterministic per seed
+}
+
+type simChunk struct {
+	data []byte
+	at   time.Time // arrival at the far end
+}
+
+// simLink is one direction of a simulated link. A Write occupies the line
+// for its serialization time at Bandwidth, blocking the writer like a UART
+// with no FIFO to speak of, and arrives Delay plus jitter later. Reads honour
+// SetReadDeadline, so the session's idle timeouts fire as they would on a
+// net.Conn.
+type simLink struct {
+	cfg simConfig
+
+	wmu       sync.Mutex
+	rng       *rand.Rand
+	busyUntil time.Time // end of the last write's serialization
+	lastAt    time.Time // arrival of the last write
+	corrupted int       // bytes flipped so far
+
+	ch chan simChunk
+
+	// Reader side: only the goroutine reading the link touches these.
+	held     *simChunk // taken from ch, not yet arrived
+	pending  []byte
+	dmu      sync.Mutex
+	deadline time.Time
+}
+
+func newSimLink(cfg simConfig) *simLink {
+	return &simLink{
+		cfg: cfg,
+		rng: rand.New(rand.NewPCG(cfg.Seed, 0x5eed)),
+		ch:  make(chan simChunk, 1024),
+	}
+}
+
+func (l *simLink) Write(p []byte) (int, error) {
+	l.wmu.Lock()
+	defer l.wmu.Unlock()
+	data := bytes.Clone(p)
+	if l.cfg.Corrupt > 0 {
+		for i := range data {
+			if l.rng.Float64() < l.cfg.Corrupt {
+				data[i] ^= 1 << l.rng.IntN(8)
+				l.corrupted++
+			}
+		}
+	}
+	l.busyUntil = later(time.Now(), l.busyUntil)
+	if l.cfg.Bandwidth > 0 {
+		l.busyUntil = l.busyUntil.Add(time.Duration(len(data)) * time.Second / time.Duration(l.cfg.Bandwidth))
+	}
+	at := l.busyUntil.Add(l.cfg.Delay)
+	if l.cfg.Jitter > 0 {
+		at = at.Add(time.Duration(l.rng.Int64N(int64(l.cfg.Jitter))))
+	}
+	l.lastAt = later(at, l.lastAt)
+	l.ch <- simChunk{data: data, at: l.lastAt}
+	time.Sleep(time.Until(l.busyUntil))
+	return len(p), nil
+}
+
+// Close ends the stream; the far end reads io.EOF once everything written
+// before it has arrived.
+func (l *simLink) Close() error {
+	close(l.ch)
+	return nil
+}
+
+func (l *simLink) SetReadDeadline(t time.Time) error {
+	l.dmu.Lock()
+	l.deadline = t
+	l.dmu.Unlock()
+	return nil
+}
+
+func (l *simLink) Read(b []byte) (int, error) {
+	if len(l.pending) == 0 {
+		l.dmu.Lock()
+		dl := l.deadline
+		l.dmu.Unlock()
+		var expired <-chan time.Time
+		if !dl.IsZero() {
+			d := time.Until(dl)
+			if d <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			t := time.NewTimer(d)
+			defer t.Stop()
+			expired = t.C
+		}
+		if l.held == nil {
+			select {
+			case c, ok := <-l.ch:
+				if !ok {
+					return 0, io.EOF
+				}
+				l.held = &c
+			case <-expired:
+				return 0, os.ErrDeadlineExceeded
+			}
+		}
+		if d := time.Until(l.held.at); d > 0 {
+			t := time.NewTimer(d)
+			defer t.Stop()
+			select {
+			case <-t.C:
+			case <-expired:
+				return 0, os.ErrDeadlineExceeded
+			}
+		}
+		l.pending, l.held = l.held.data, nil
+	}
+	n := copy(b, l.pending)
+	l.pending = l.pending[n:]
+	return n, nil
+}
+
+func later(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+	return b
+}
+
+// simEnd is one endpoint of a simulated link pair.
+type simEnd struct {
+	in, out *simLink
+}
+
+func (e simEnd) Read(p []byte) (int, error)        { return e.in.Read(p) }
+func (e simEnd) Write(p []byte) (int, error)       { return e.out.Write(p) }
+func (e simEnd) SetReadDeadline(t time.Time) error { return e.in.SetReadDeadline(t) }
+
+// netsimScenario is a link and a transfer across it. The same link settings
+// apply in both directions, with different corruption seeds.
+type netsimScenario struct {
+	name     string
+	link     simConfig
+	size     int
+	sendCfg  Config
+	recvCfg  Config
+	deadline time.Duration
+}
+
+// netsimResult is what a scenario records, and what the baseline file holds.
+type netsimResult struct {
+	Throughput float64       `json:"throughput"` // file bytes per second, wall clock
+	Retransmit int64         `json:"retransmit"` // Stats.RetransmitWritten
+	rtt        time.Duration // Stats.RTT, not recorded
+}
+
+var netsimScenarios = []netsimScenario{
+	{
+		// 10 Mbit/s Ethernet, so the link and not the CPU sets the pace.
+		name: "lan",
+		link: simConfig{Delay: 200 * time.Microsecond, Bandwidth: 1 << 20},
+		size: 1 << 20,
+	},
+	{
+		// Geostationary: 600 ms RTT at 2 Mbit/s.
+		name: "satellite",
+		link: simConfig{Delay: 300 * time.Millisecond, Jitter: 20 * time.Millisecond, Bandwidth: 250 << 10},
+		size: 128 << 10,
+	},
+	{
+		// 200 ms RTT with 1 byte in 20000 damaged.
+		name:    "lossy-wan",
+		link:    simConfig{Delay: 100 * time.Millisecond, Jitter: 10 * time.Millisecond, Bandwidth: 128 << 10, Corrupt: 5e-5, Seed: 1},
+		size:    128 << 10,
+		sendCfg: Config{RecvTimeout: 2 * time.Second},
+		recvCfg: Config{RecvTimeout: 2 * time.Second},
+	},
+	{
+		// 9600 8N1 with a bad line: 1 byte in 2000 damaged.
+		name:    "noisy-9600",
+		link:    simConfig{Delay: 5 * time.Millisecond, Bandwidth: 960, Corrupt: 5e-4, Seed: 2},
+		size:    4 << 10,
+		sendCfg: Config{MaxBlockSize: 256, RecvTimeout: time.Second},
+		recvCfg: Config{RecvTimeout: time.Second},
+	},
+}
+
+// runNetsim sends one file across the scenario's link and reports the
+// sender's throughput and retransmitted bytes.
+func runNetsim(tb testing.TB, sc netsimScenario) netsimResult {
+	tb.Helper()
+	content := randomContent(sc.size)
+	up, down := sc.link, sc.link
+	down.Seed += 1000
+	toRecv, toSend := newSimLink(up), newSimLink(down)
+
+	sh := newTestHandler()
+	sh.filesToSend = []*FileOffer{{Name: "sim.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	rh := newTestHandler()
+	sendCfg, recvCfg := sc.sendCfg, sc.recvCfg
+	sendCfg.Logger, recvCfg.Logger = discardLogger(), discardLogger()
+	sender := NewSession(simEnd{in: toSend, out: toRecv}, sh, &sendCfg)
+	receiver := NewSession(simEnd{in: toRecv, out: toSend}, rh, &recvCfg)
+
+	deadline := sc.deadline
+	if deadline == 0 {
+		deadline = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), deadline)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	start := time.Now()
+	wg.Add(2)
+	go func() { defer wg.Done(); defer toRecv.Close(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer toSend.Close(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+	elapsed := time.Since(start)
+	if sendErr != nil || recvErr != nil {
+		tb.Fatalf("%s: send=%v recv=%v", sc.name, sendErr, recvErr)
+	}
+	if got := rh.receivedFiles["sim.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		tb.Fatalf("%s: received file differs from the one sent", sc.name)
+	}
+	tb.Logf("%s: %d bytes in %v, %d bytes corrupted on the way", sc.name, sc.size,
+		elapsed.Round(time.Millisecond), toRecv.corrupted+toSend.corrupted)
+	return netsimResult{
+		Throughput: float64(sc.size) / elapsed.Seconds(),
+		Retransmit: sender.Stats().RetransmitWritten,
+		rtt:        sender.Stats().RTT,
+	}
+}
+
+// Tolerances against the baseline. Wall-clock throughput varies with machine
+// load even on a simulated link, so only a large drop fails; retransmits are
+// near-deterministic per seed but shift with timing on lossy links.
+const (
+	netsimMinThroughput = 0.6  // fraction of the baseline
+	netsimMaxRetransmit = 1.5  // multiple of the baseline
+	netsimRetransmitPad = 8192 // bytes allowed on top, so a zero baseline has room
+)
+
+// TestNetsimRegression runs each scenario and compares it with the checked-in
+// baseline. After a change meant to move the numbers, rerun with
+// -update-netsim and commit the new baseline along with the change; cite the
+// before and after lines logged with -v.
+func TestNetsimRegression(t *testing.T) {
+	if testing.Short() {
+		t.Skip("simulated links run in real time")
+	}
+	baseline := map[string]netsimResult{}
+	if data, err := os.ReadFile(netsimBaselineFile); err == nil {
+		if err := json.Unmarshal(data, &baseline); err != nil {
+			t.Fatalf("%s: %v", netsimBaselineFile, err)
+		}
+	} else if !*updateNetsim {
+		t.Fatalf("no baseline (%v); run with -update-netsim to record one", err)
+	}
+
+	// The links spend their time waiting, not computing, so the scenarios
+	// run side by side without disturbing each other's numbers much.
+	var mu sync.Mutex
+	results := map[string]netsimResult{}
+	t.Run("scenarios", func(t *testing.T) {
+		for _, sc := range netsimScenarios {
+			t.Run(sc.name, func(t *testing.T) {
+				t.Parallel()
+				got := runNetsim(t, sc)
+				mu.Lock()
+				results[sc.name] = got
+				mu.Unlock()
+				base, ok := baseline[sc.name]
+				t.Logf("%s: %.0f B/s, %d bytes retransmitted (baseline %.0f B/s, %d)",
+					sc.name, got.Throughput, got.Retransmit, base.Throughput, base.Retransmit)
+				if *updateNetsim {
+					return
+				}
+				if !ok {
+					t.Fatalf("no baseline for %s; run with -update-netsim to record one", sc.name)
+				}
+				if got.Throughput < base.Throughput*netsimMinThroughput {
+					t.Errorf("throughput %.0f B/s, below %.0f%% of the baseline %.0f B/s",
+						got.Throughput, netsimMinThroughput*100, base.Throughput)
+				}
+				if limit := int64(float64(base.Retransmit)*netsimMaxRetransmit) + netsimRetransmitPad; got.Retransmit > limit {
+					t.Errorf("%d bytes retransmitted, over the limit of %d (baseline %d)",
+						got.Retransmit, limit, base.Retransmit)
+				}
+			})
+		}
+	})
+
+	if *updateNetsim && !t.Failed() {
+		data, err := json.MarshalIndent(results, "", "\t")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.MkdirAll(filepath.Dir(netsimBaselineFile), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(netsimBaselineFile, append(data, '\n'), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		t.Logf("wrote %s", netsimBaselineFile)
+	}
+}
+
+// TestCheckpointSpacingAdapts compares the adaptive ZCRCQ spacing with fixed
+// ones on a 10 ms and a 500 ms link. The fixed candidates are those the
+// adaptive spacing chooses between for 1 KB blocks: the old 8, and the
+// maxCheckpointSpan cap, past which a receiver's error recovery is at risk.
+//
+// The adaptive spacing is allowed what its design costs against the best
+// fixed one in hindsight: the first span, at the minimum spacing, is sent
+// before there is a measurement, which costs one extra round trip; and the
+// spacing aims at checkpointRTTs round trips of data, so the waits take up to
+// 1/checkpointRTTs of the sending time where a wider fixed spacing waits less.
+// Measured on the simulated links: 2.28s against 2.24s at 10 ms, 6.80s
+// against 6.30s at 500 ms (exactly the one round trip).
+func TestCheckpointSpacingAdapts(t *testing.T) {
+	if testing.Short() {
+		t.Skip("simulated links run in real time")
+	}
+	for _, sc := range []netsimScenario{
+		{name: "rtt-10ms", link: simConfig{Delay: 5 * time.Millisecond, Bandwidth: 64 << 10}, size: 128 << 10},
+		{name: "rtt-500ms", link: simConfig{Delay: 250 * time.Millisecond, Bandwidth: 256 << 10}, size: 128 << 10},
+	} {
+		t.Run(sc.name, func(t *testing.T) {
+			rtt := 2 * sc.link.Delay
+			adaptive := runNetsim(t, sc)
+			if lo, hi := rtt-10*time.Millisecond, rtt+50*time.Millisecond; adaptive.rtt < lo || adaptive.rtt > hi {
+				t.Errorf("Stats.RTT = %v, want %v to %v", adaptive.rtt, lo, hi)
+			}
+			best := 0.0
+			for _, k := range []int{8, maxCheckpointSpan / 1024} {
+				fixed := sc
+				fixed.sendCfg.MinCheckpointInterval, fixed.sendCfg.MaxCheckpointInterval = k, k
+				r := runNetsim(t, fixed)
+				t.Logf("every %d subpackets: %.0f B/s", k, r.Throughput)
+				best = max(best, r.Throughput)
+			}
+			took := time.Duration(float64(sc.size) / adaptive.Throughput * float64(time.Second))
+			bestTook := time.Duration(float64(sc.size) / best * float64(time.Second))
+			allowed := bestTook + bestTook/checkpointRTTs + rtt
+			t.Logf("adaptive: %.0f B/s, RTT %v; %v against the best fixed %v, allowed %v",
+				adaptive.Throughput, adaptive.rtt, took.Round(time.Millisecond), bestTook.Round(time.Millisecond), allowed.Round(time.Millisecond))
+			if took > allowed {
+				t.Errorf("adaptive spacing took %v, want at most %v: the best fixed spacing's %v, 1/%d of it for the waits and one round trip to measure",
+					took, allowed, bestTook, checkpointRTTs)
+			}
+		})
+	}
+}
+
+// TestSlidingWindow checks that a receiver's window (Config.WindowSize) caps
+// a streaming sender at about a window per round trip, not half that: the
+// sender must keep sending while a checkpoint's answer is on its way back.
+// The rate is taken between a short and a long transfer, so the handshakes
+// both pay for — four round trips or so — drop out. With a checkpoint every
+// quarter window the sender stalls at most a quarter window per round trip;
+// it measures about 95% of window/RTT, and 90% is required.
+func TestSlidingWindow(t *testing.T) {
+	if testing.Short() {
+		t.Skip("simulated links run in real time")
+	}
+	const window = 16 << 10
+	sc := netsimScenario{
+		name:    "window-16k-rtt-200ms",
+		link:    simConfig{Delay: 100 * time.Millisecond, Bandwidth: 512 << 10},
+		recvCfg: Config{WindowSize: window},
+	}
+	took := func(size int) float64 {
+		sc.size = size
+		return float64(size) / runNetsim(t, sc).Throughput
+	}
+	short, long := 128<<10, 384<<10
+	rate := float64(long-short) / (took(long) - took(short))
+	limit := float64(window) / (2 * sc.link.Delay).Seconds()
+	t.Logf("%.0f B/s past the handshakes, window/RTT %.0f B/s (%.1f%%)", rate, limit, 100*rate/limit)
+	if rate < 0.9*limit {
+		t.Errorf("throughput %.0f B/s, want at least 90%% of window/RTT = %.0f B/s", rate, limit)
+	}
+}
+
+// TestSimLink checks the harness itself: delivery order, delay, the
+// bandwidth cap, seeded corruption and read deadlines.
+func TestSimLink(t *testing.T) {
+	l := newSimLink(simConfig{Delay: 30 * time.Millisecond, Bandwidth: 100 << 10})
+	start := time.Now()
+	go func() {
+		for i := range 10 {
+			l.Write(bytes.Repeat([]byte{byte(i)}, 1024)) // 10 ms each on the line
+		}
+		l.Close()
+	}()
+	got, err := io.ReadAll(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+	for i, b := range got {
+		if b != byte(i/1024) {
+			t.Fatalf("byte %d = %d, want %d: reordered", i, b, i/1024)
+		}
+	}
+	if len(got) != 10240 || elapsed < 130*time.Millisecond {
+		t.Fatalf("%d bytes in %v, want 10240 in at least 100 ms on the line + 30 ms delay", len(got), elapsed)
+	}
+
+	flips := func(seed uint64) []byte {
+		l := newSimLink(simConfig{Corrupt: 0.01, Seed: seed})
+		l.Write(make([]byte, 10000))
+		l.Close()
+		out, _ := io.ReadAll(l)
+		return out
+	}
+	a, b := flips(7), flips(7)
+	if !bytes.Equal(a, b) {
+		t.Fatal("same seed corrupted different bytes")
+	}
+	if n := len(a) - bytes.Count(a, []byte{0}); n < 50 || n > 200 {
+		t.Fatalf("%d of 10000 bytes corrupted at 1%%", n)
+	}
+
+	slow := newSimLink(simConfig{Delay: time.Second})
+	slow.Write([]byte("late"))
+	slow.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := slow.Read(make([]byte, 4)); !os.IsTimeout(err) {
+		t.Fatalf("Read before arrival = %v, want a timeout", err)
+	}
+	slow.SetReadDeadline(time.Time{})
+	if _, err := slow.Read(make([]byte, 4)); err != nil {
+		t.Fatalf("Read after the deadline cleared = %v", err)
+	}
+}
@@ -2,8 +2,10 @@ package zmodem
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -102,3 +104,111 @@ func TestRecoverDataLegacyCountAbort(t *testing.T) {
 		t.Fatalf("expected legacy count abort, got %v", err)
 	}
 }
+
+// TestRecoverDataConfiguredBudget: Config.DataRetries replaces the default
+// count.
+func TestRecoverDataConfiguredBudget(t *testing.T) {
+	base := time.Unix(1_700_000_000, 0)
+	s := newProbeSession(&bytes.Buffer{}, &Config{DataRetries: 3, Logger: discardLogger()}, func() time.Time { return base })
+
+	retries := 0
+	for i := 0; i < 3; i++ {
+		if err := s.recoverData(0, &retries); err != nil {
+			t.Fatalf("cycle %d aborted inside a budget of 3: %v", i, err)
+		}
+	}
+	if err := s.recoverData(0, &retries); err == nil || !strings.Contains(err.Error(), "max retries exceeded") {
+		t.Fatalf("fourth cycle = %v, want the count abort", err)
+	}
+}
+
+// progressRecorder is a testFileHandler that also implements ProgressHandler,
+// keeping every Progress reported.
+type progressRecorder struct {
+	*testFileHandler
+	reports []Progress
+}
+
+func (h *progressRecorder) TransferProgress(info FileInfo, p Progress) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.reports = append(h.reports, p)
+}
+
+// TestTransferProgressCounters: across a resume and a mid-stream ZRPOS, both
+// sides report the absolute offset and, apart from it, the resume point and
+// the bytes moved in this session, which a rewind never inflates.
+func TestTransferProgressCounters(t *testing.T) {
+	const size = 16384
+	content := randomContent(size)
+	for _, tc := range []struct {
+		name    string
+		resume  int64
+		corrupt bool // corrupt a subpacket, forcing a ZRPOS rewind
+	}{
+		{"resume", 4096, false},
+		{"mid-stream ZRPOS", 0, true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r1, w1 := bufferedPipe(256)
+			r2, w2 := bufferedPipe(256)
+			var out io.Writer = w1
+			cw := &corruptingWriter{w: w1, targetCount: 3}
+			if tc.corrupt {
+				out = cw
+			}
+			sh := &progressRecorder{testFileHandler: newTestHandler()}
+			sh.filesToSend = []*FileOffer{{Name: "p.bin", Size: size, Reader: bytes.NewReader(content)}}
+			rh := &progressRecorder{testFileHandler: newTestHandler()}
+			rh.acceptOffset = tc.resume
+			cfg := &Config{MaxBlockSize: 512, Use32BitCRC: true, Logger: discardLogger()}
+			sender := NewSession(&pipeReadWriter{Reader: r2, Writer: out}, sh, cfg)
+			receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, rh, cfg)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			var wg sync.WaitGroup
+			var sendErr, recvErr error
+			wg.Add(2)
+			go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+			go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+			wg.Wait()
+			if sendErr != nil || recvErr != nil {
+				t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+			}
+			if tc.corrupt && !cw.corrupted.Load() {
+				t.Fatal("no subpacket was corrupted")
+			}
+			if len(sh.progress) != 0 || len(rh.progress) != 0 {
+				t.Fatal("FileProgress called on a ProgressHandler")
+			}
+
+			for side, reports := range map[string][]Progress{"sender": sh.reports, "receiver": rh.reports} {
+				if len(reports) == 0 {
+					t.Fatalf("%s: no progress reported", side)
+				}
+				rewound := false
+				var prev Progress
+				for i, p := range reports {
+					if p.StartOffset != tc.resume {
+						t.Fatalf("%s report %d: StartOffset %d, want %d", side, i, p.StartOffset, tc.resume)
+					}
+					if p.SessionBytes < prev.SessionBytes || p.SessionBytes > size-tc.resume {
+						t.Fatalf("%s report %d: SessionBytes %d after %d", side, i, p.SessionBytes, prev.SessionBytes)
+					}
+					if p.SessionBytes < p.Offset-tc.resume {
+						t.Fatalf("%s report %d: SessionBytes %d behind offset %d", side, i, p.SessionBytes, p.Offset)
+					}
+					rewound = rewound || p.Offset < prev.Offset
+					prev = p
+				}
+				if want := (Progress{Offset: size, StartOffset: tc.resume, SessionBytes: size - tc.resume}); prev != want {
+					t.Fatalf("%s: last progress %+v, want %+v", side, prev, want)
+				}
+				if side == "sender" && tc.corrupt && !rewound {
+					t.Fatal("sender: the ZRPOS never rewound the offset")
+				}
+			}
+		})
+	}
+}
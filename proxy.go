@@ -0,0 +1,460 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// proxyHoldWait is how long a Proxy holds back the end of the interactive
+// stream when it could be the start of a ZMODEM header, waiting for the rest.
+const proxyHoldWait = 50 * time.Millisecond
+
+// proxyTrailWait is how long a Proxy waits after a transfer for the protocol
+// bytes that may trail it (the sender's OO, a repeated ZFIN) before the
+// interactive stream carries on; and, after a failed transfer, how long the
+// line must go quiet before what follows is taken for the interactive stream.
+const proxyTrailWait = 500 * time.Millisecond
+
+// Proxy carries an interactive session and the ZMODEM transfers started in it
+// over one connection, the zssh way: a shell on an SSH channel or a telnet
+// link, with sz and rz run in it now and then. Read returns what the remote
+// sends for the user's terminal. When a transfer starts there, Read runs it
+// (Auto, with the handler and Config given to NewProxy) on the connection and
+// then carries on with what the remote sends after it. None of the
+// transfer's bytes reach the interactive stream: not the frames, not the
+// rz\r trigger in front of them, not the OO or repeated frames behind them;
+// and none of what follows the transfer is lost to it.
+//
+// The Config's SoftwareFlowControl is not used: its reader could take bytes
+// past the end of a transfer.
+type Proxy struct {
+	// Status, if set, is given a line for the user at the start and end of
+	// each transfer and of each file in it, from the goroutine calling Read.
+	// Nothing is written to the connection or the interactive stream for it.
+	Status func(line string)
+
+	conn    io.ReadWriter
+	handler FileHandler
+	cfg     *Config
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	in      chan []byte // the reader goroutine's chunks of conn
+	readErr error       // why in was closed; read after it is
+	done    bool        // in is closed
+
+	det      *Detector
+	starting *Detection // a transfer found, to run once out is read
+	pending  []byte     // input not yet fed to det
+	fed      []byte     // fed to det and held back from out
+	out      []byte     // ready for Read
+
+	wmu     sync.Mutex // held by a transfer, keeping Write off the line
+	mu      sync.Mutex
+	session *Session // the transfer running, for Abort
+}
+
+// NewProxy returns a Proxy on conn, which it reads from then on. Transfers
+// use handler and cfg as NewSession would.
+func NewProxy(conn io.ReadWriter, handler FileHandler, cfg *Config) *Proxy {
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Proxy{
+		conn:    conn,
+		handler: handler,
+		cfg:     cfg,
+		ctx:     ctx,
+		cancel:  cancel,
+		in:      make(chan []byte, 16),
+		det:     NewDetector(nil),
+	}
+	go p.readLoop()
+	return p
+}
+
+// readLoop reads conn for the interactive stream and the transfers alike.
+func (p *Proxy) readLoop() {
+	defer close(p.in)
+	for {
+		buf := make([]byte, 4096)
+		n, err := p.conn.Read(buf)
+		if n > 0 {
+			select {
+			case p.in <- buf[:n]:
+			case <-p.ctx.Done():
+				p.readErr = net.ErrClosed
+				return
+			}
+		}
+		if err != nil {
+			p.readErr = err
+			return
+		}
+	}
+}
+
+// Read reads the interactive stream. It runs any transfer the stream starts
+// before returning what follows it, so a transfer lasts one Read call.
+func (p *Proxy) Read(b []byte) (int, error) {
+	for len(p.out) == 0 {
+		if p.done && p.starting == nil && len(p.pending) == 0 && len(p.fed) == 0 {
+			if p.readErr != nil {
+				return 0, p.readErr
+			}
+			return 0, io.EOF
+		}
+		p.step()
+	}
+	n := copy(b, p.out)
+	p.out = p.out[n:]
+	return n, nil
+}
+
+// step moves the next input towards out, running the transfer it starts.
+func (p *Proxy) step() {
+	if d := p.starting; d != nil {
+		p.starting = nil
+		p.transfer(*d)
+		return
+	}
+	chunk := p.pending
+	p.pending = nil
+	if len(chunk) == 0 {
+		wait := time.Duration(-1)
+		if len(p.fed) > 0 {
+			wait = proxyHoldWait
+		}
+		var ok bool
+		if chunk, ok = p.recv(wait); !ok {
+			// No header after all: what was held back is the user's.
+			p.out = append(p.out, p.fed...)
+			p.fed = nil
+			return
+		}
+	}
+	p.det.Write(chunk)
+	p.fed = append(p.fed, chunk...)
+	if d, ok := p.det.Detected(); ok {
+		user := p.fed[:max(len(p.fed)-len(d.Data), 0)]
+		p.out = append(p.out, bytes.TrimSuffix(user, []byte("rz\r"))...)
+		p.fed = nil
+		p.starting = &d
+		return
+	}
+	hold := holdLen(p.fed)
+	p.out = append(p.out, p.fed[:len(p.fed)-hold]...)
+	p.fed = bytes.Clone(p.fed[len(p.fed)-hold:])
+}
+
+// recv returns the next chunk of conn, waiting up to wait for it (forever if
+// wait is negative). It reports false if none came, or conn is done.
+func (p *Proxy) recv(wait time.Duration) ([]byte, bool) {
+	if p.done {
+		return nil, false
+	}
+	var expired <-chan time.Time
+	if wait >= 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case chunk, ok := <-p.in:
+		if !ok {
+			p.done = true
+		}
+		return chunk, ok
+	case <-expired:
+		return nil, false
+	}
+}
+
+// transfer runs the session d found, then gives back to the interactive
+// stream whatever the session read past its end, less the protocol bytes
+// that trail it.
+func (p *Proxy) transfer(d Detection) {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+
+	var cfg *Config
+	if p.cfg != nil {
+		c := *p.cfg
+		c.SoftwareFlowControl = false
+		cfg = &c
+	}
+	line := &proxyLine{p: p, buf: d.Data}
+	s := NewSession(line, p.handler, cfg)
+	s.fileDone = func(info FileInfo, n int64, err error) {
+		switch {
+		case err == nil:
+			p.status(fmt.Sprintf("zmodem: %s: %d bytes", info.Name, n))
+		case errors.Is(err, ErrSkip), errors.Is(err, ErrSkippedByRemote):
+			p.status(fmt.Sprintf("zmodem: %s: skipped", info.Name))
+		default:
+			p.status(fmt.Sprintf("zmodem: %s: %v", info.Name, err))
+		}
+	}
+	p.mu.Lock()
+	p.session = s
+	p.mu.Unlock()
+
+	if d.Type == ZRINIT {
+		p.status("zmodem: sending")
+	} else {
+		p.status("zmodem: receiving")
+	}
+	err := s.Auto(p.ctx)
+
+	p.mu.Lock()
+	p.session = nil
+	p.mu.Unlock()
+	unread, _ := s.tr.r.Peek(s.tr.r.Buffered())
+	p.pending = append(bytes.Clone(unread), line.buf...)
+	p.det.Reset()
+	if err != nil {
+		p.status(fmt.Sprintf("zmodem: transfer failed: %v", err))
+		p.skipQuiet()
+		return
+	}
+	p.status("zmodem: transfer complete")
+	p.skipTrailer()
+}
+
+func (p *Proxy) status(line string) {
+	if p.Status != nil {
+		p.Status(line)
+	}
+}
+
+// skipTrailer drops the protocol bytes that can follow a transfer from the
+// start of pending (see trailerLen), waiting up to proxyTrailWait for them
+// while pending holds nothing else.
+func (p *Proxy) skipTrailer() {
+	deadline := time.Now().Add(proxyTrailWait)
+	for {
+		n, more := trailerLen(p.pending)
+		p.pending = p.pending[n:]
+		if !more {
+			return
+		}
+		chunk, ok := p.recv(max(time.Until(deadline), 0))
+		if !ok {
+			return
+		}
+		p.pending = append(p.pending, chunk...)
+	}
+}
+
+// skipQuiet drops pending and what follows it until the line has been quiet
+// for proxyTrailWait: the rest of a failed transfer, which would otherwise
+// reach the terminal.
+func (p *Proxy) skipQuiet() {
+	p.pending = nil
+	for {
+		if _, ok := p.recv(proxyTrailWait); !ok {
+			return
+		}
+	}
+}
+
+// Write writes to the connection: the user's input for the remote. While a
+// transfer runs it waits for the transfer to end.
+func (p *Proxy) Write(b []byte) (int, error) {
+	p.wmu.Lock()
+	defer p.wmu.Unlock()
+	return p.conn.Write(b)
+}
+
+// Abort aborts the transfer running, if there is one, as Session.Abort does;
+// Read reports its end on the status line and goes on with the interactive
+// stream.
+func (p *Proxy) Abort() error {
+	p.mu.Lock()
+	s := p.session
+	p.mu.Unlock()
+	if s == nil {
+		return nil
+	}
+	return s.Abort()
+}
+
+// Close stops the Proxy, ending any transfer, and closes the connection if it
+// is an io.Closer.
+func (p *Proxy) Close() error {
+	p.cancel()
+	if c, ok := p.conn.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// proxyLine is a transfer's transport: the Proxy's connection, read through
+// the Proxy's reader with read deadlines, after the Detection's bytes.
+type proxyLine struct {
+	p   *Proxy
+	buf []byte
+
+	mu       sync.Mutex
+	deadline time.Time
+}
+
+func (l *proxyLine) Read(b []byte) (int, error) {
+	return l.readContext(context.Background(), b)
+}
+
+func (l *proxyLine) readContext(ctx context.Context, b []byte) (int, error) {
+	if len(l.buf) == 0 {
+		if l.p.done {
+			return 0, l.p.inErr()
+		}
+		l.mu.Lock()
+		deadline := l.deadline
+		l.mu.Unlock()
+		var expired <-chan time.Time
+		if !deadline.IsZero() {
+			timer := time.NewTimer(time.Until(deadline))
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case chunk, ok := <-l.p.in:
+			if !ok {
+				l.p.done = true
+				return 0, l.p.inErr()
+			}
+			l.buf = chunk
+		case <-expired:
+			return 0, os.ErrDeadlineExceeded
+		case <-ctx.Done():
+			return 0, context.Cause(ctx)
+		}
+	}
+	n := copy(b, l.buf)
+	l.buf = l.buf[n:]
+	return n, nil
+}
+
+func (l *proxyLine) SetReadDeadline(t time.Time) error {
+	l.mu.Lock()
+	l.deadline = t
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *proxyLine) Write(b []byte) (int, error) {
+	return l.p.conn.Write(b)
+}
+
+// inErr is why the Proxy's input ended.
+func (p *Proxy) inErr() error {
+	if p.readErr != nil {
+		return p.readErr
+	}
+	return io.EOF
+}
+
+// holdLen is the length of the longest tail of b that could be the start of
+// a hex header, which the Detector would find once the rest arrives.
+func holdLen(b []byte) int {
+	for i := max(len(b)-len(hexHeaderStart)-hexHeaderDigits, 0); i < len(b); i++ {
+		if b[i] != ZPAD {
+			continue
+		}
+		s := b[i:]
+		if len(s) > 1 && s[1] == ZPAD {
+			s = s[1:]
+		}
+		n := min(len(s), len(hexHeaderStart))
+		if !bytes.Equal(s[:n], hexHeaderStart[:n]) {
+			continue
+		}
+		if isHexDigits(s[n:]) {
+			return len(b) - i
+		}
+	}
+	return 0
+}
+
+// trailerLen is the length of the protocol bytes at the start of b that can
+// follow a transfer: the sender's OO, hex headers (a receiver repeating its
+// ZFIN), XON and XOFF, and an abort's CANs and backspaces. more reports
+// whether they may go on past the end of b: b ends with them, or part of one.
+func trailerLen(b []byte) (n int, more bool) {
+	for n < len(b) {
+		switch c := b[n]; {
+		case c == XON || c == XOFF || c == CAN:
+			n++
+		case c == '\b' && n > 0 && (b[n-1] == CAN || b[n-1] == '\b'):
+			n++
+		case c == 'O':
+			if n+1 == len(b) {
+				return n, true
+			}
+			if b[n+1] != 'O' {
+				return n, false
+			}
+			n += 2
+		case c == ZPAD:
+			l, whole := hexHeaderLen(b[n:])
+			if l == 0 {
+				return n, false
+			}
+			if !whole {
+				return n, true
+			}
+			n += l
+		default:
+			return n, false
+		}
+	}
+	return n, true
+}
+
+// hexHeaderLen is the length of the hex header b starts with, and whether b
+// holds it whole; 0 if b does not start with one or the start of one.
+func hexHeaderLen(b []byte) (int, bool) {
+	s := b
+	if len(s) > 1 && s[1] == ZPAD {
+		s = s[1:]
+	}
+	n := min(len(s), len(hexHeaderStart))
+	if !bytes.Equal(s[:n], hexHeaderStart[:n]) {
+		return 0, false
+	}
+	lead := len(b) - len(s) + len(hexHeaderStart)
+	digits := b[min(lead, len(b)):]
+	if len(digits) < hexHeaderDigits {
+		if isHexDigits(digits) {
+			return len(b), false
+		}
+		return 0, false
+	}
+	if !isHexDigits(digits[:hexHeaderDigits]) {
+		return 0, false
+	}
+	end := lead + hexHeaderDigits
+	// CR, then LF with or without its high bit, then XON, each optional.
+	for _, want := range []byte{'\r', '\n', XON} {
+		if end < len(b) && b[end]&0x7f == want {
+			end++
+		}
+	}
+	return end, true
+}
+
+// isHexDigits reports whether b is all hex digits.
+func isHexDigits(b []byte) bool {
+	for _, c := range b {
+		if _, ok := hexVal(c); !ok {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"testing"
+	"time"
+)
+
+// TestProxy runs shell traffic, a transfer and more shell traffic over one
+// pipe pair, each way round: the terminal sees the shell and nothing of the
+// transfer, and the Status lines tell of it.
+func TestProxy(t *testing.T) {
+	content := randomContent(20000)
+	tests := []struct {
+		name   string
+		before string // shell output up to the transfer
+		remote func(s *Session, ctx context.Context) error
+		status []string
+	}{
+		{"remote sends", "$ sz notes.bin\r\n", (*Session).Send,
+			[]string{"zmodem: receiving", "zmodem: notes.bin: 20000 bytes", "zmodem: transfer complete"}},
+		{"remote receives", "$ rz\r\n", (*Session).Receive,
+			[]string{"zmodem: sending", "zmodem: notes.bin: 20000 bytes", "zmodem: transfer complete"}},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			r1, w1 := bufferedPipe(1024) // remote -> local
+			r2, w2 := bufferedPipe(1024) // local -> remote
+			offer := func() []*FileOffer {
+				return []*FileOffer{{Name: "notes.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+			}
+
+			remoteHandler := newTestHandler()
+			localHandler := newTestHandler()
+			if tc.name == "remote sends" {
+				remoteHandler.filesToSend = offer()
+			} else {
+				localHandler.filesToSend = offer()
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			remoteErr := make(chan error, 1)
+			go func() {
+				defer w1.Close()
+				w1.Write([]byte(tc.before))
+				s := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, remoteHandler,
+					&Config{Use32BitCRC: true, RecvTimeout: 5 * time.Second, Logger: discardLogger()})
+				remoteErr <- tc.remote(s, ctx)
+				w1.Write([]byte("$ "))
+				w1.Write([]byte("exit\r\n"))
+			}()
+
+			p := NewProxy(&pipeReadWriter{Reader: r1, Writer: w2}, localHandler,
+				&Config{Use32BitCRC: true, Logger: discardLogger()})
+			defer p.Close()
+			var status []string
+			p.Status = func(line string) { status = append(status, line) }
+			terminal, err := io.ReadAll(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := <-remoteErr; err != nil {
+				t.Fatalf("remote: %v", err)
+			}
+
+			if want := tc.before + "$ exit\r\n"; string(terminal) != want {
+				t.Errorf("terminal got %q, want %q", terminal, want)
+			}
+			if !slices.Equal(status, tc.status) {
+				t.Errorf("status %q, want %q", status, tc.status)
+			}
+			got := localHandler.receivedFiles["notes.bin"]
+			if tc.name == "remote receives" {
+				got = remoteHandler.receivedFiles["notes.bin"]
+			}
+			if got == nil || !bytes.Equal(got.Bytes(), content) {
+				t.Error("notes.bin not transferred intact")
+			}
+		})
+	}
+}
+
+// TestProxyHoldsHeaderStart: the start of what may be a header waits for the
+// rest, and goes to the terminal once it turns out not to be one.
+func TestProxyHoldsHeaderStart(t *testing.T) {
+	r, w := bufferedPipe(16)
+	p := NewProxy(&pipeReadWriter{Reader: r, Writer: io.Discard}, newTestHandler(), nil)
+	defer p.Close()
+	w.Write([]byte("bold **\x18B0"))
+	buf := make([]byte, 64)
+	n, _ := p.Read(buf)
+	if got := string(buf[:n]); got != "bold " {
+		t.Fatalf("first Read %q, want %q", got, "bold ")
+	}
+	n, _ = p.Read(buf)
+	if got := string(buf[:n]); got != "**\x18B0" {
+		t.Fatalf("second Read %q, want the held bytes", got)
+	}
+}
+
+func TestTrailerLen(t *testing.T) {
+	zfin := "**\x18B0800000000022d\r\n"
+	tests := []struct {
+		in   string
+		n    int
+		more bool
+	}{
+		{"", 0, true},
+		{"OO", 2, true},
+		{"O", 0, true},
+		{"OOps", 2, false},
+		{"Ok", 0, false},
+		{"\x11OO$ ", 3, false},
+		{zfin + "OO$ ", len(zfin) + 2, false},
+		{"**\x18B0800000000022d\r\x8a$ ", len(zfin), false},
+		{zfin[:9], 0, true},
+		{"\x18\x18\x18\b\b\b$ ", 6, false},
+		{"\b$ ", 0, false},
+		{"**bold**", 0, false},
+	}
+	for _, tc := range tests {
+		n, more := trailerLen([]byte(tc.in))
+		if n != tc.n || more != tc.more {
+			t.Errorf("trailerLen(%q) = %d, %v, want %d, %v", tc.in, n, more, tc.n, tc.more)
+		}
+	}
+}
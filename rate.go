@@ -0,0 +1,92 @@
+package zmodem
+
+import (
+	"math"
+	"time"
+)
+
+// rateWindow is the time constant of RateEstimator's instant rate: a
+// sample's weight falls by e in this time.
+const rateWindow = 3 * time.Second
+
+// RateEstimator turns a file's progress, offsets at points in time, into a
+// transfer rate and the time left, as a progress display shows them. The
+// zero value is ready to use, for one file; it is not safe for concurrent
+// use.
+//
+// The instant rate is an average weighted to the last few seconds, so it
+// follows a change of line speed without jumping at every sample. It is the
+// rate data moves at, forward motion only: a rewind to an earlier offset (a
+// ZRPOS) moves the offset back without taking anything off, and the data sent
+// again counts as it goes. The time left is then from the offset reached,
+// rewound or not, and grows by the rewind rather than swinging with it.
+//
+// A stall shows when the offset it reached is observed again later, as a
+// display redrawing on a timer would: the instant rate decays toward zero and
+// the time left grows.
+type RateEstimator struct {
+	started bool
+	first   time.Time // the first observation
+	last    time.Time // the last one past first's time
+	offset  int64     // the last offset observed
+	moved   int64     // forward motion since first
+	pending int64     // forward motion not yet in the instant rate
+	ewma    float64   // the instant rate, before the early-samples correction
+}
+
+// Observe records that offset was reached at t. Offsets observed at one
+// instant are taken together with the next observation later than it.
+func (e *RateEstimator) Observe(offset int64, t time.Time) {
+	if !e.started {
+		e.started = true
+		e.first, e.last, e.offset = t, t, offset
+		return
+	}
+	if d := offset - e.offset; d > 0 {
+		e.moved += d
+		e.pending += d
+	}
+	e.offset = offset
+	dt := t.Sub(e.last).Seconds()
+	if dt <= 0 {
+		return
+	}
+	sample := float64(e.pending) / dt
+	e.ewma += (sample - e.ewma) * -math.Expm1(-dt/rateWindow.Seconds())
+	e.pending = 0
+	e.last = t
+}
+
+// Rate returns the instant rate, weighted to the last few seconds, and the
+// average since the first observation, both in bytes per second. They are 0
+// until time has passed between two observations.
+func (e *RateEstimator) Rate() (instant, average float64) {
+	elapsed := e.last.Sub(e.first).Seconds()
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	// The running average starts from zero: early on it has seen less than
+	// a window, and is scaled up to the samples it has, their plain average
+	// at first.
+	instant = e.ewma / -math.Expm1(-elapsed/rateWindow.Seconds())
+	return instant, float64(e.moved) / elapsed
+}
+
+// ETA returns the time left to reach total, the file's size, at the instant
+// rate: 0 once the offset observed has reached it, -1 while there is no rate
+// to go on.
+func (e *RateEstimator) ETA(total int64) time.Duration {
+	left := total - e.offset
+	if left <= 0 {
+		return 0
+	}
+	instant, _ := e.Rate()
+	if instant <= 0 {
+		return -1
+	}
+	secs := float64(left) / instant
+	if secs >= math.MaxInt64/float64(time.Second) {
+		return math.MaxInt64
+	}
+	return time.Duration(secs * float64(time.Second))
+}
@@ -0,0 +1,120 @@
+package zmodem
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+// rateSample is an offset observed at a time since the first sample.
+type rateSample struct {
+	at     time.Duration
+	offset int64
+}
+
+// steadySamples is from at from up to to, 100ms apart, at 10,000 bytes per
+// second.
+func steadySamples(from, to time.Duration, offset int64) []rateSample {
+	var s []rateSample
+	for at := from; at <= to; at += 100 * time.Millisecond {
+		s = append(s, rateSample{at, offset + int64((at-from)/time.Millisecond)*10})
+	}
+	return s
+}
+
+func concat(parts ...[]rateSample) []rateSample {
+	var s []rateSample
+	for _, p := range parts {
+		s = append(s, p...)
+	}
+	return s
+}
+
+// TestRateEstimator feeds synthetic progress to a RateEstimator and checks
+// its rates and time left, each to within 5% (a wanted ETA of -1 exactly).
+// No sample may give a negative rate.
+func TestRateEstimator(t *testing.T) {
+	for _, tc := range []struct {
+		name                 string
+		samples              []rateSample
+		instant, average     float64 // bytes per second
+		total                int64
+		eta                  time.Duration
+		instantMax, etaAtMin float64 // if set, bounds instead of instant and eta
+	}{
+		{
+			name:    "steady",
+			samples: steadySamples(0, 10*time.Second, 0),
+			instant: 10000, average: 10000,
+			total: 200000, eta: 10 * time.Second,
+		},
+		{
+			name:    "first samples",
+			samples: []rateSample{{0, 4096}, {500 * time.Millisecond, 5120}, {time.Second, 8192}},
+			instant: 4096, average: 4096,
+			total: 16384, eta: 2 * time.Second,
+		},
+		{
+			// A ZRPOS back 10,000 bytes: nothing is taken off, the data
+			// sent again counts, and the time left grows by the rewind.
+			name: "rewind",
+			samples: concat(
+				steadySamples(0, 5*time.Second, 0),
+				steadySamples(5100*time.Millisecond, 10*time.Second, 40000),
+			),
+			instant: 10000, average: 99000 / 10.0,
+			total: 100000, eta: 1100 * time.Millisecond,
+		},
+		{
+			// Observed at the same offset for 10s: the instant rate falls
+			// toward zero and the time left grows without bound.
+			name: "stall",
+			samples: concat(
+				steadySamples(0, 5*time.Second, 0),
+				[]rateSample{{6 * time.Second, 50000}, {10 * time.Second, 50000}, {15 * time.Second, 50000}},
+			),
+			average: 50000 / 15.0,
+			total:   100000, instantMax: 400, etaAtMin: 125,
+		},
+		{
+			name:    "one instant",
+			samples: []rateSample{{0, 0}, {0, 1024}, {0, 2048}},
+			total:   4096, eta: -1,
+		},
+		{
+			name:    "done",
+			samples: steadySamples(0, time.Second, 0),
+			instant: 10000, average: 10000,
+			total: 10000, eta: 0,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var e RateEstimator
+			base := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+			for _, s := range tc.samples {
+				e.Observe(s.offset, base.Add(s.at))
+				if instant, average := e.Rate(); instant < 0 || average < 0 {
+					t.Fatalf("at %v: rates %.0f, %.0f", s.at, instant, average)
+				}
+			}
+			instant, average := e.Rate()
+			eta := e.ETA(tc.total)
+			near := func(got, want float64) bool { return math.Abs(got-want) <= math.Abs(want)*0.05 }
+			if !near(average, tc.average) {
+				t.Errorf("average %.0f, want %.0f", average, tc.average)
+			}
+			if tc.instantMax > 0 {
+				if instant > tc.instantMax || eta.Seconds() < tc.etaAtMin {
+					t.Errorf("instant %.0f, ETA %v; want at most %.0f and at least %.0fs", instant, eta, tc.instantMax, tc.etaAtMin)
+				}
+				return
+			}
+			if !near(instant, tc.instant) {
+				t.Errorf("instant %.0f, want %.0f", instant, tc.instant)
+			}
+			if tc.eta < 0 && eta != tc.eta || tc.eta >= 0 && !near(eta.Seconds(), tc.eta.Seconds()) {
+				t.Errorf("ETA %v, want %v", eta, tc.eta)
+			}
+		})
+	}
+}
@@ -2,6 +2,7 @@ package zmodem
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -11,8 +12,11 @@ import (
 
 var (
 	errGarbageOverflow = errors.New("zmodem: garbage count exceeded threshold")
-	errAbortReceived   = errors.New("zmodem: session aborted by remote (5x CAN)")
+	errAbortReceived   = fmt.Errorf("%w (5x CAN)", ErrAborted)
 	errUnsupportedEnc  = errors.New("zmodem: unsupported frame encoding")
+	errReconnected     = errors.New("zmodem: transport replaced, resynchronizing")
+	errBadEscape       = errors.New("zmodem: invalid ZDLE escape")
+	errBadCRC          = errors.New("CRC error") // wrapped by header and subpacket CRC failures
 )
 
 // deadlineSetter is implemented by transports that support read deadlines (e.g. net.Conn).
@@ -20,25 +24,90 @@ type deadlineSetter interface {
 	SetReadDeadline(time.Time) error
 }
 
+// wireReader is the io.Reader beneath the bufio layer: every byte read from the
+// transport passes through it exactly once. Its running total gives the
+// absolute stream position of the bufio buffer (total - Buffered() is the
+// position of the next unread byte), which survives consumption by any read
+// path.
+type wireReader struct {
+	r     io.Reader
+	total int64       // bytes delivered from the transport into the bufio buffer
+	turn  *turnaround // HalfDuplex transport direction; nil = full duplex
+
+	// reconnect, if set, is offered every fatal (non-timeout) transport error.
+	// It returns nil once the transport has been replaced (see
+	// Session.SetTransport); the read then fails once with errReconnected so
+	// the state machine resynchronizes as after any other read error.
+	reconnect func(error) error
+
+	// ctx is the running Send or Receive's, Background outside one. A source
+	// that can (a contextReader) stops waiting when it is cancelled.
+	ctx context.Context
+
+	dump *wireDump // Config.WireDump; nil = off
+}
+
+func (wr *wireReader) Read(p []byte) (int, error) {
+	if wr.turn != nil {
+		if err := wr.turn.receive(); err != nil {
+			return 0, err
+		}
+	}
+	var n int
+	var err error
+	if cr, ok := wr.r.(contextReader); ok {
+		n, err = cr.readContext(wr.ctx, p)
+	} else {
+		n, err = wr.r.Read(p)
+	}
+	if err != nil && n == 0 && wr.ctx.Err() != nil {
+		return 0, err // a cancelled session is no reason to reconnect
+	}
+	wr.total += int64(n)
+	if wr.dump != nil {
+		wr.dump.dump(dumpReceived, p[:n])
+	}
+	if err != nil && n == 0 && wr.reconnect != nil && !isTimeout(err) {
+		if rerr := wr.reconnect(err); rerr != nil {
+			return 0, rerr
+		}
+		return 0, errReconnected
+	}
+	return n, err
+}
+
 // transportReader wraps an io.Reader with buffering, ZDLE decoding,
 // optional XON/XOFF stripping, and garbage counting.
 type transportReader struct {
-	r            *bufio.Reader
-	ds           deadlineSetter // nil if transport lacks deadline support
-	timeout      time.Duration  // idle timeout for control phases (Config.RecvTimeout)
-	dataTimeout  time.Duration  // idle timeout for the data phase (Config.DataRecvTimeout); 0 → use timeout
-	inDataPhase  bool           // true while receiving ZDATA subpackets; selects dataTimeout
-	garbageCount int
-	garbageMax   int
-	canCount     int // consecutive CAN characters seen
-	stripXonXoff bool
-	logger       *slog.Logger
-	now          func() time.Time // wall clock; overridable in tests for the deterministic progress-stall timer
+	r               *bufio.Reader
+	wire            *wireReader
+	peekScanned     int64          // stream position up to which peekForZPAD has examined input
+	ds              deadlineSetter // nil if transport lacks deadline support
+	armed           bool           // a read deadline has been set and must be restored on exit
+	idleUntil       time.Time      // idle deadline set by armIdle; zero once anything else sets one
+	restoreDeadline time.Time      // read deadline left on exit (Config.RestoreDeadline)
+	timeout         time.Duration  // idle timeout for control phases (Config.RecvTimeout)
+	dataTimeout     time.Duration  // idle timeout for the data phase (Config.DataRecvTimeout); 0 → use timeout
+	inDataPhase     bool           // true while receiving ZDATA subpackets; selects dataTimeout
+	purgeIdle       time.Duration  // line-idle window ending a timed purge (Config.PurgeIdle); 0 = buffered only
+	garbageCount    int
+	garbageTotal    int64 // garbage skipped in all, for Stats.GarbageRead
+	garbageMax      int
+	canCount        int   // consecutive CAN characters seen (see readByte)
+	abortTail       int   // bytes of a detected abort sequence still to skip
+	escapes         int64 // ZDLE escapes decoded (Stats.EscapeRead)
+	stripXonXoff    bool
+	lenientEscapes  bool            // Config.LenientEscapes: decode any ZDLE+X (X >= 0x40) as X^0x40
+	capture         *garbageCapture // Config.GarbageSink; nil = off
+	logger          *slog.Logger
+	now             func() time.Time // wall clock; overridable in tests for the deterministic progress-stall timer
 }
 
 func newTransportReader(r io.Reader, garbageMax int, timeout time.Duration, stripXonXoff bool, logger *slog.Logger) *transportReader {
+	wire := &wireReader{r: r, ctx: context.Background()}
 	tr := &transportReader{
-		r:            bufio.NewReaderSize(r, 4096),
+		r:            bufio.NewReaderSize(wire, 4096),
+		wire:         wire,
 		timeout:      timeout,
 		garbageMax:   garbageMax,
 		stripXonXoff: stripXonXoff,
@@ -51,6 +120,21 @@ func newTransportReader(r io.Reader, garbageMax int, timeout time.Duration, stri
 	return tr
 }
 
+// setSource points the reader at a replacement transport (Session.SetTransport).
+// Bytes already buffered from the old transport were genuinely received and
+// are kept.
+func (tr *transportReader) setSource(r io.Reader) {
+	tr.wire.r = r
+	tr.ds, _ = r.(deadlineSetter)
+	tr.armed = false
+	tr.idleUntil = time.Time{}
+}
+
+// pos is the stream position of the next unread byte.
+func (tr *transportReader) pos() int64 {
+	return tr.wire.total - int64(tr.r.Buffered())
+}
+
 // activeTimeout is the idle read timeout for the current phase: the longer
 // data-phase timeout while receiving ZDATA subpackets (if configured), else the
 // control-phase timeout.
@@ -65,14 +149,168 @@ func (tr *transportReader) activeTimeout() time.Duration {
 // selects the data-phase read timeout for subsequent blocking reads.
 func (tr *transportReader) setDataPhase(on bool) { tr.inDataPhase = on }
 
+// ErrTimeout is wrapped around a read that hit the session's idle timeout
+// (Config.RecvTimeout / Config.DataRecvTimeout) or a caller-set read deadline,
+// so errors.Is(err, ErrTimeout) identifies a silent peer whatever the
+// transport's own timeout error looks like. Errors that end a session after
+// repeated timeouts wrap the last one.
+var ErrTimeout = errors.New("zmodem: read timed out")
+
+// canAbortCount is how many consecutive CANs abort a session.
+const canAbortCount = 5
+
 // readByte reads one raw byte from the transport.
 // When the bufio buffer is empty and a deadline-capable transport is present,
 // sets an idle timeout before blocking on the underlying read.
+//
+// Every parser pulls its bytes through here, so this is where a remote abort
+// is detected: canAbortCount consecutive CANs return errAbortReceived whatever
+// was being read (header hunt, hex digits, binary header, subpacket data).
+// ZMODEM never sends two CANs in a row otherwise, since ZDLE-escaped data
+// never puts a CAN after a ZDLE. XON/XOFF interleaved by the line neither
+// break nor extend a run. The rest of the abort sequence (the remaining CANs
+// and the backspaces after them) is skipped by later reads instead of
+// surfacing as garbage.
 func (tr *transportReader) readByte() (byte, error) {
-	if to := tr.activeTimeout(); tr.r.Buffered() == 0 && tr.ds != nil && to > 0 {
-		tr.ds.SetReadDeadline(time.Now().Add(to))
+	for {
+		if tr.r.Buffered() == 0 {
+			tr.armIdle()
+		}
+		b, err := tr.r.ReadByte()
+		if err != nil {
+			if isTimeout(err) {
+				err = fmt.Errorf("%w: %w", ErrTimeout, err)
+			}
+			return 0, err
+		}
+		if tr.abortTail > 0 {
+			if b == CAN || b == backspace {
+				tr.abortTail--
+				continue
+			}
+			tr.abortTail = 0
+		}
+		if tr.countCAN(b) {
+			return 0, tr.abortReceived()
+		}
+		return b, nil
+	}
+}
+
+// countCAN counts b into the run of consecutive CANs and reports whether the
+// run has reached canAbortCount. XON and XOFF leave the run as it is.
+func (tr *transportReader) countCAN(b byte) bool {
+	switch {
+	case b == CAN:
+		tr.canCount++
+		return tr.canCount >= canAbortCount
+	case b&0x7f == XON, b&0x7f == XOFF:
+	default:
+		tr.canCount = 0
+	}
+	return false
+}
+
+// abortReceived ends a run of CANs that reached canAbortCount: the rest of
+// the abort sequence is drained, and errAbortReceived returned.
+func (tr *transportReader) abortReceived() error {
+	tr.canCount = 0
+	tr.abortTail = len(abortSequence) - canAbortCount
+	tr.drainAbortTail()
+	return errAbortReceived
+}
+
+// discard drops the next n buffered bytes unread, counting their CANs as
+// readByte does, so that an abort sequence among stale input still ends the
+// session: it returns errAbortReceived at the CAN that completes the run,
+// with what follows it left in the buffer.
+func (tr *transportReader) discard(n int) error {
+	p, _ := tr.r.Peek(n)
+	for i, b := range p {
+		if tr.countCAN(b) {
+			tr.r.Discard(i + 1)
+			return tr.abortReceived()
+		}
+	}
+	tr.r.Discard(len(p))
+	return nil
+}
+
+// armIdle sets the idle read deadline before a read that may block. readByte
+// gets here whenever the buffer runs dry — per byte on a link that delivers
+// them one at a time — and on many transports each SetReadDeadline is a
+// syscall, so the deadline is set 1/8 of the timeout beyond it and kept while
+// at least the full timeout remains: re-armed about once per eighth of the
+// timeout, not per read. A silent peer is then detected after between one and
+// 1.125 timeouts, never sooner than before.
+func (tr *transportReader) armIdle() {
+	to := tr.activeTimeout()
+	if tr.ds == nil || to <= 0 {
+		return
+	}
+	now := time.Now()
+	if left := tr.idleUntil.Sub(now); left >= to && left <= to+to/8 {
+		return
+	}
+	tr.idleUntil = now.Add(to + to/8)
+	tr.ds.SetReadDeadline(tr.idleUntil)
+	tr.armed = true
+}
+
+// setDeadline sets a read deadline other than the idle one (see armIdle).
+func (tr *transportReader) setDeadline(t time.Time) {
+	tr.ds.SetReadDeadline(t)
+	tr.armed = true
+	tr.idleUntil = time.Time{}
+}
+
+// abortDrainWait bounds the wait for the rest of an abort sequence once its
+// CANs have been seen.
+const abortDrainWait = 50 * time.Millisecond
+
+// drainAbortTail consumes the rest of a just-detected abort sequence — the
+// remaining CANs and the backspaces that erase them on a terminal — so it is
+// not left in the transport for whoever reads next: the caller's shell, or a
+// new session that would count it as garbage. Buffered bytes go at once; when
+// the session manages read deadlines it also waits up to abortDrainWait for
+// the rest. Anything still missing is skipped by readByte if it turns up.
+func (tr *transportReader) drainAbortTail() {
+	for tr.abortTail > 0 {
+		if tr.r.Buffered() == 0 {
+			if tr.ds == nil || tr.activeTimeout() <= 0 {
+				return
+			}
+			tr.setDeadline(time.Now().Add(abortDrainWait))
+			if _, err := tr.r.Peek(1); err != nil {
+				return
+			}
+		}
+		b, _ := tr.r.ReadByte()
+		if b != CAN && b != backspace {
+			_ = tr.r.UnreadByte()
+			tr.abortTail = 0
+			return
+		}
+		tr.abortTail--
 	}
-	return tr.r.ReadByte()
+}
+
+// finishCANRun is called when a parser finds a CAN where it expected
+// something else (a hex digit, say). It keeps reading while the CAN run lasts,
+// so an abort sequence arriving mid-field ends the session with
+// errAbortReceived rather than a parse error and a retry. The first byte
+// after a shorter run is left unread.
+func (tr *transportReader) finishCANRun() error {
+	for tr.canCount > 0 {
+		b, err := tr.readByte()
+		if err != nil {
+			return err
+		}
+		if b != CAN && b&0x7f != XON && b&0x7f != XOFF {
+			return tr.r.UnreadByte()
+		}
+	}
+	return nil
 }
 
 // readByteStrip reads one byte, optionally stripping XON/XOFF.
@@ -96,6 +334,19 @@ func (tr *transportReader) readByteStrip() (byte, error) {
 // zdlRead reads one ZDLE-decoded byte from the transport.
 // Returns (byte, frameEnd, error) where frameEnd is non-zero if a
 // subpacket end marker (ZCRCE/ZCRCG/ZCRCQ/ZCRCW) was encountered.
+//
+// ZDLE followed by a byte >= 0x40 is an escape only if it is a subpacket end,
+// ZRUB0/ZRUB1, or the image (X^0x40) of a control character — the bytes any
+// escaping mode can produce, and all lrzsz accepts. Anything else is a
+// corrupted escape and fails the frame (errBadEscape) for the usual recovery,
+// rather than decoding to a wrong byte the CRC may or may not catch; with
+// lenientEscapes set every such byte is decoded as X^0x40 instead.
+//
+// ZDLE followed by a raw control character is line noise: the pair is dropped
+// and decoding continues with the next byte. This is a flat loop, not a
+// recursion, and each dropped pair is charged against the garbage budget
+// (garbageCount/garbageMax, reset per header hunt), so a long noise run inside
+// a frame ends in errGarbageOverflow rather than growing the stack.
 func (tr *transportReader) zdlRead() (byte, byte, error) {
 	for {
 		b, err := tr.readByteStrip()
@@ -103,68 +354,103 @@ func (tr *transportReader) zdlRead() (byte, byte, error) {
 			return 0, 0, err
 		}
 
-		if b == ZDLE { // ZDLE == CAN == 0x18
-			tr.canCount++
-			if tr.canCount >= 5 {
-				return 0, 0, errAbortReceived
-			}
-			return tr.zdlEscape()
+		if b != ZDLE { // ZDLE == CAN == 0x18; runs of them abort in readByte
+			return b, 0, nil
 		}
 
-		tr.canCount = 0
-		return b, 0, nil
-	}
-}
+		// Process the byte after the ZDLE prefix.
+		c, err := tr.readByteStrip()
+		if err != nil {
+			return 0, 0, err
+		}
+		switch {
+		case c == ZCRCE, c == ZCRCG, c == ZCRCQ, c == ZCRCW:
+			// Subpacket end marker
+			return 0, c, nil
 
-// zdlEscape processes a byte after ZDLE prefix.
-func (tr *transportReader) zdlEscape() (byte, byte, error) {
-	c, err := tr.readByteStrip()
-	if err != nil {
-		return 0, 0, err
-	}
-	switch {
-	case c == ZCRCE, c == ZCRCG, c == ZCRCQ, c == ZCRCW:
-		// Subpacket end marker
-		tr.canCount = 0
-		return 0, c, nil
+		case c == ZRUB0:
+			tr.escapes++
+			return 0x7f, 0, nil
 
-	case c == ZRUB0:
-		tr.canCount = 0
-		return 0x7f, 0, nil
+		case c == ZRUB1:
+			tr.escapes++
+			return 0xff, 0, nil
 
-	case c == ZRUB1:
-		tr.canCount = 0
-		return 0xff, 0, nil
+		case c&0x60 == 0x40, c >= 0x40 && tr.lenientEscapes:
+			// Standard escape: XOR with 0x40 to recover original
+			tr.escapes++
+			return c ^ 0x40, 0, nil
 
-	case c >= 0x40:
-		// Standard escape: XOR with 0x40 to recover original
-		tr.canCount = 0
-		return c ^ 0x40, 0, nil
+		case c >= 0x40:
+			return 0, 0, fmt.Errorf("%w: 0x%02x", errBadEscape, c)
+		}
 
-	default:
 		// ZDLE followed by raw control char — noise/garbage.
-		if c == CAN {
-			tr.canCount++ // ZDLE already counted; CAN adds another
-			if tr.canCount >= 5 {
-				return 0, 0, errAbortReceived
-			}
+		if tr.logger.Enabled(context.Background(), slog.LevelDebug) {
+			tr.logger.Debug("ZDLE noise: discarding", "byte", fmt.Sprintf("0x%02x", c))
 		}
-		tr.logger.Debug("ZDLE noise: discarding", "byte", fmt.Sprintf("0x%02x", c))
-		return tr.zdlRead() // recurse to read next valid byte
+		tr.garbageCount++
+		tr.garbageTotal++
+		if tr.garbageCount > tr.garbageMax {
+			return 0, 0, errGarbageOverflow
+		}
+	}
+}
+
+// slowByte marks the bytes readClean leaves to readByte/zdlRead: ZDLE (which
+// is also CAN) and XON/XOFF with or without parity. Every other byte is data
+// that zdlRead would return unchanged.
+var slowByte = func() (t [256]bool) {
+	for _, b := range []byte{ZDLE, XON, XOFF, XON | 0x80, XOFF | 0x80} {
+		t[b] = true
+	}
+	return t
+}()
+
+// readClean is the bulk fast path of ZDLE decoding. It appends to dst the
+// longest run of already-buffered bytes, at most limit, that contains no
+// slowByte, and consumes it — exactly what that many zdlRead calls would
+// return, minus the per-byte calls. It never blocks or refills the buffer.
+// Since the run holds no CAN, it ends any CAN run, as readByte would.
+func (tr *transportReader) readClean(dst []byte, limit int) []byte {
+	n := tr.r.Buffered()
+	if n == 0 || limit <= 0 || tr.abortTail > 0 {
+		return dst
+	}
+	if n > limit {
+		n = limit
+	}
+	buf, _ := tr.r.Peek(n)
+	i := 0
+	for i < len(buf) && !slowByte[buf[i]] {
+		i++
 	}
+	if i == 0 {
+		return dst
+	}
+	dst = append(dst, buf[:i]...)
+	tr.r.Discard(i)
+	tr.canCount = 0
+	return dst
 }
 
 // readHex reads two hex digits and returns the byte value.
-// Strips parity bit (mask 0x7F) per lrzsz noxrd7() convention.
+// Strips parity bit (mask 0x7F) per lrzsz noxrd7() convention, and skips
+// XON/XOFF a modem inserts between the digits, as binary headers do.
 func (tr *transportReader) readHex() (byte, error) {
-	hi, err := tr.readByte()
+	hi, err := tr.readByteStrip()
 	if err != nil {
 		return 0, err
 	}
-	lo, err := tr.readByte()
+	lo, err := tr.readByteStrip()
 	if err != nil {
 		return 0, err
 	}
+	if hi == CAN || lo == CAN {
+		if err := tr.finishCANRun(); err != nil {
+			return 0, err
+		}
+	}
 	hi &= 0x7f // strip parity
 	lo &= 0x7f
 	h, ok1 := hexVal(hi)
@@ -175,6 +461,53 @@ func (tr *transportReader) readHex() (byte, error) {
 	return (h << 4) | l, nil
 }
 
+// peekLine returns the next byte of a hex header's line ending without
+// consuming it, skipping XON/XOFF as readByteStrip does. With wait it blocks
+// for the first byte; otherwise it only looks at what is already buffered. It
+// reports false if there is no byte to be had.
+func (tr *transportReader) peekLine(wait bool) (byte, bool) {
+	for {
+		if !wait && tr.r.Buffered() == 0 {
+			return 0, false
+		}
+		peek, err := tr.r.Peek(1)
+		if err != nil {
+			return 0, false
+		}
+		if b := peek[0] & 0x7f; tr.stripXonXoff && (b == XON || b == XOFF) {
+			tr.r.Discard(1)
+			wait = false
+			continue
+		}
+		return peek[0], true
+	}
+}
+
+// peekHex is the buffered fast path of readHex: when the 2*len(dst) digits
+// plus the two terminator bytes behind them are already buffered, it decodes
+// them into dst in one pass over a Peek and consumes the digits, without a
+// readByte call per digit. It reports false, consuming nothing, when they are
+// not all there, an abort tail is being skipped, or any digit is not hex —
+// the cases readHex handles (or reports) byte by byte.
+func (tr *transportReader) peekHex(dst []byte) bool {
+	n := 2 * len(dst)
+	if tr.abortTail > 0 || tr.r.Buffered() < n+2 {
+		return false
+	}
+	digits, _ := tr.r.Peek(n)
+	for i := range dst {
+		h, ok1 := hexVal(digits[2*i] & 0x7f) // strip parity
+		l, ok2 := hexVal(digits[2*i+1] & 0x7f)
+		if !ok1 || !ok2 {
+			return false
+		}
+		dst[i] = h<<4 | l
+	}
+	tr.r.Discard(n)
+	tr.canCount = 0 // as readByte leaves it after a hex digit
+	return true
+}
+
 func hexVal(b byte) (byte, bool) {
 	switch {
 	case b >= '0' && b <= '9':
@@ -189,11 +522,14 @@ func hexVal(b byte) (byte, bool) {
 	}
 }
 
+// maxPadding bounds the NUL padding scanForPad skips in one header hunt
+// without charging it to the garbage budget: far more than any Znulls.
+const maxPadding = 8192
+
 // scanForPad scans input for a frame start (ZPAD + ZDLE + encoding byte).
 // Returns the encoding type byte (ZBIN, ZHEX, ZBIN32, etc.).
 // Tracks garbage count and returns error if threshold exceeded.
 func (tr *transportReader) scanForPad() (byte, error) {
-	tr.canCount = 0
 	// garbageMax is the budget for ONE header hunt, not a session lifetime
 	// total. Resetting it here lets each scan skip up to garbageMax bytes of
 	// noise looking for a frame start. Without this reset the counter latches
@@ -203,43 +539,53 @@ func (tr *transportReader) scanForPad() (byte, error) {
 	// receiver's retry budget is spent in milliseconds instead of spanning the
 	// round-trips the drain actually needs.
 	tr.garbageCount = 0
+	if tr.capture != nil {
+		tr.capture.hunt()
+	}
 
+	padding := 0
 	for {
 		b, err := tr.readByte()
 		if err != nil {
 			return 0, err
 		}
 
-		// Track CAN for abort detection
-		if b == CAN {
-			tr.canCount++
-			if tr.canCount >= 5 {
-				return 0, errAbortReceived
+		if b != ZPAD {
+			// Flow control between frames — a modem's XON/XOFF, or the XON
+			// trailing a hex header looped back on a half-duplex rig — is
+			// not noise: skip it as readByteStrip does, free of charge.
+			if tr.stripXonXoff && (b&0x7f == XON || b&0x7f == XOFF) {
+				continue
 			}
-			tr.garbageCount++
-			if tr.garbageCount > tr.garbageMax {
-				return 0, errGarbageOverflow
+			// Nor is padding: the NULs a sender puts before a ZDATA header
+			// (Config.Znulls, sz -N), with or without parity, or a telnet
+			// CR NUL's tail (see readHexHeader). Up to maxPadding a hunt are
+			// skipped free; a line that only ever yields NULs is still caught.
+			if b&0x7f == 0 && padding < maxPadding {
+				padding++
+				continue
 			}
-			continue
-		}
-		tr.canCount = 0
-
-		if b != ZPAD {
 			// Not a pad character — garbage
+			if tr.capture != nil {
+				tr.capture.add(b)
+			}
 			tr.garbageCount++
+			tr.garbageTotal++
 			if tr.garbageCount > tr.garbageMax {
-				return 0, errGarbageOverflow
+				return 0, tr.garbageOverflow()
 			}
 			continue
 		}
 
 		// Got ZPAD. May have a second ZPAD (optional).
+		pads := 1
 		b, err = tr.readByte()
 		if err != nil {
 			return 0, err
 		}
 		if b == ZPAD {
 			// Second ZPAD — read next
+			pads++
 			b, err = tr.readByte()
 			if err != nil {
 				return 0, err
@@ -247,9 +593,14 @@ func (tr *transportReader) scanForPad() (byte, error) {
 		}
 
 		if b != ZDLE {
+			if tr.capture != nil {
+				tr.capture.addPads(pads)
+				tr.capture.add(b)
+			}
 			tr.garbageCount++
+			tr.garbageTotal++
 			if tr.garbageCount > tr.garbageMax {
-				return 0, errGarbageOverflow
+				return 0, tr.garbageOverflow()
 			}
 			continue
 		}
@@ -267,58 +618,300 @@ func (tr *transportReader) scanForPad() (byte, error) {
 		case ZBINR32, ZVBIN, ZVHEX, ZVBIN32, ZVBINR32:
 			return 0, fmt.Errorf("%w: 0x%02x", errUnsupportedEnc, enc)
 		default:
+			if tr.capture != nil {
+				tr.capture.addPads(pads)
+				tr.capture.add(ZDLE)
+				tr.capture.add(enc)
+			}
 			tr.garbageCount++
+			tr.garbageTotal++
 			if tr.garbageCount > tr.garbageMax {
-				return 0, errGarbageOverflow
+				return 0, tr.garbageOverflow()
 			}
 			continue
 		}
 	}
 }
 
+// garbageOverflow is the error ending a header hunt that found only noise,
+// describing the noise when it is being captured (Config.GarbageSink).
+func (tr *transportReader) garbageOverflow() error {
+	if tr.capture == nil {
+		return errGarbageOverflow
+	}
+	return fmt.Errorf("%w (%s)", errGarbageOverflow, tr.capture.summary())
+}
+
 // resetGarbage resets the garbage counter (after successful frame).
 func (tr *transportReader) resetGarbage() {
 	tr.garbageCount = 0
 }
 
-// peekForZPAD scans all currently buffered bytes for a ZPAD or CAN character.
-// Returns true if a frame start or abort might be pending.
+// peekForZPAD reports whether the buffered input holds a ZPAD or CAN character
+// not examined by an earlier call — a frame start or abort that might be
+// pending. Each buffered byte is inspected at most once: a watermark in stream
+// coordinates records how far previous calls scanned, and a reported byte
+// counts as examined, so a CAN already dismissed does not trigger another
+// header read on the next subpacket.
 // This is purely opportunistic — it does not block or issue I/O.
 func (tr *transportReader) peekForZPAD() bool {
 	n := tr.r.Buffered()
 	if n == 0 {
 		return false
 	}
+	head := tr.wire.total - int64(n) // stream position of the first buffered byte
+	start := 0
+	if tr.peekScanned > head {
+		start = int(tr.peekScanned - head)
+	}
+	if start >= n {
+		return false
+	}
 	peek, err := tr.r.Peek(n)
 	if err != nil {
 		return false
 	}
-	for _, b := range peek {
+	for i, b := range peek[start:] {
 		if b == ZPAD || b == CAN {
+			tr.peekScanned = head + int64(start+i) + 1
 			return true
 		}
 	}
+	tr.peekScanned = head + int64(n)
 	return false
 }
 
-// clearDeadline removes any read deadline set on the transport.
-// Called on session exit so callers can reuse the transport without stale deadlines.
+// pollWait is how long poll gives the transport to hand over input. It has to
+// be positive: a read past its deadline fails at once, even with input waiting.
+const pollWait = 100 * time.Microsecond
+
+// poll pulls input that has already arrived into the buffer without waiting
+// for more, so peekForZPAD can see a header that came in while the sender was
+// writing. It only reads when the session manages read deadlines; otherwise a
+// read could block, and only what is already buffered can be seen. The idle
+// deadline is re-armed by the next readByte on an empty buffer.
+func (tr *transportReader) poll() {
+	if tr.ds == nil || tr.activeTimeout() <= 0 || tr.r.Buffered() == tr.r.Size() {
+		return
+	}
+	tr.setDeadline(time.Now().Add(pollWait))
+	_, _ = tr.r.Peek(tr.r.Buffered() + 1)
+}
+
+// awaitInput waits up to d for input, reporting whether any arrived. Without
+// read deadlines the wait cannot be bounded, so it reports true at once and
+// leaves the next read to block as usual. The idle deadline is re-armed by the
+// next readByte on an empty buffer.
+func (tr *transportReader) awaitInput(d time.Duration) bool {
+	if tr.r.Buffered() > 0 || tr.ds == nil || tr.activeTimeout() <= 0 {
+		return true
+	}
+	tr.setDeadline(time.Now().Add(d))
+	_, err := tr.r.Peek(1)
+	return err == nil || !isTimeout(err)
+}
+
+// clearDeadline hands the read deadline back to the caller on session exit:
+// if the session set one, it is replaced by restoreDeadline (zero unless
+// Config.RestoreDeadline is set), so the transport can be reused without a
+// stale session deadline. A session that never set a deadline (RecvTimeout
+// == 0) leaves the caller's untouched.
 func (tr *transportReader) clearDeadline() {
-	if tr.ds != nil {
-		_ = tr.ds.SetReadDeadline(time.Time{})
+	if tr.armed {
+		_ = tr.ds.SetReadDeadline(tr.restoreDeadline)
+		tr.armed = false
+		tr.idleUntil = time.Time{}
+	}
+}
+
+// purgeMaxBytes bounds one timed purge (see purge) so a peer that never pauses
+// cannot hold the receiver in the drain indefinitely.
+const purgeMaxBytes = 64 * 1024
+
+// purge discards stale transport data before sending ZRPOS in error recovery.
+// It always drops the bytes currently sitting in the bufio buffer. When a purge
+// idle window is configured (Config.PurgeIdle) and the session manages read
+// deadlines, it then keeps reading and discarding until the line has been idle
+// for that window (or purgeMaxBytes have been dropped), so data the sender
+// already had in flight — socket and modem buffers — does not arrive after our
+// ZRPOS as a fresh burst of garbage and errors. Without deadline support only
+// the buffered bytes can be dropped (a blocking read cannot be bounded).
+//
+// The discarded counts are logged so a frame trace can show whether a recovery
+// cycle dropped a fresh inbound header or left stale in-flight bytes behind —
+// the otherwise-invisible signal needed to diagnose a resync loop.
+//
+// An abort sequence among the discarded bytes is not lost with them: purge
+// returns errAbortReceived.
+func (tr *transportReader) purge() error {
+	n := tr.r.Buffered()
+	if err := tr.discard(n); err != nil {
+		return err
+	}
+	drained := 0
+	if tr.purgeIdle > 0 && tr.ds != nil && tr.activeTimeout() > 0 {
+		var err error
+		if drained, err = tr.drainUntilIdle(); err != nil {
+			return err
+		}
+	}
+	tr.logger.Debug("purge: discarded buffered bytes", "count", n, "drained", drained)
+	return nil
+}
+
+// skipToFrameStart is the targeted alternative to purge after a data error:
+// it discards input only up to the next frame start (ZPAD [ZPAD] ZDLE and a
+// header encoding), leaving that frame unread so the header already on its
+// way — the sender's ZEOF, or the ZDATA of its resync — is not thrown away
+// with the stale subpackets ahead of it. It looks through the buffered bytes
+// and, when a timed purge could run (Config.PurgeIdle with read deadlines),
+// at most frameStartBudget more arriving within purgeIdle of each other.
+// It reports false when no frame start turned up; the caller then purges.
+// An abort sequence in the skipped input returns errAbortReceived.
+func (tr *transportReader) skipToFrameStart() (bool, error) {
+	timed := tr.purgeIdle > 0 && tr.ds != nil && tr.activeTimeout() > 0
+	skipped := 0
+	for {
+		peek, _ := tr.r.Peek(tr.r.Buffered())
+		i, found := frameStart(peek, tr.stripXonXoff)
+		if err := tr.discard(i); err != nil {
+			return false, err
+		}
+		skipped += i
+		if found {
+			tr.logger.Debug("resync: skipped to frame start", "count", skipped)
+			return true, nil
+		}
+		if !timed || skipped >= frameStartBudget {
+			return false, nil
+		}
+		tr.setDeadline(time.Now().Add(tr.purgeIdle))
+		if _, err := tr.r.Peek(tr.r.Buffered() + 1); err != nil {
+			return false, nil
+		}
+	}
+}
+
+// frameStartBudget bounds the arriving input skipToFrameStart examines: about
+// one maximal subpacket with escapes.
+const frameStartBudget = 16 * 1024
+
+// frameStart returns the offset of the first frame start in p and true, or,
+// if there is none, how many leading bytes of p cannot begin one and false
+// (a trailing ZPAD, say, may yet turn out to be a frame start). A candidate
+// whose header is in p must pass its CRC: under EscapeAll a data '*' before
+// 0x01-0x03 goes out as '*' ZDLE 'A'-'C', the very shape of a frame start, and
+// skipping to one of those lands mid-subpacket. A candidate cut off by the end
+// of p is taken on trust. strip drops XON/XOFF as the header reader would.
+func frameStart(p []byte, strip bool) (int, bool) {
+	for i, b := range p {
+		if b != ZPAD {
+			continue
+		}
+		j := i + 1
+		if j < len(p) && p[j] == ZPAD {
+			j++
+		}
+		switch {
+		case j == len(p):
+			return i, false
+		case p[j] != ZDLE:
+			continue
+		case j+1 == len(p):
+			return i, false
+		}
+		switch p[j+1] {
+		case ZBIN, ZHEX, ZBIN32:
+			if headerPlausible(p[j+2:], p[j+1], strip) {
+				return i, true
+			}
+		}
+	}
+	return len(p), false
+}
+
+// headerPlausible reports whether p, the bytes after ZDLE and the encoding
+// byte enc, can begin a header: false only if the header is all there and
+// fails to decode or its CRC does not match.
+func headerPlausible(p []byte, enc byte, strip bool) bool {
+	var raw [9]byte
+	n := 7
+	if enc == ZBIN32 {
+		n = 9
+	}
+	got := 0
+	for k := 0; k < len(p) && got < n; k++ {
+		b := p[k]
+		if strip {
+			switch b & 0x7f {
+			case XON, XOFF:
+				continue
+			}
+		}
+		if enc == ZHEX {
+			h, ok1 := hexVal(b & 0x7f)
+			if k+1 == len(p) {
+				return ok1
+			}
+			l, ok2 := hexVal(p[k+1] & 0x7f)
+			if !ok1 || !ok2 {
+				return false
+			}
+			k++
+			raw[got] = h<<4 | l
+			got++
+			continue
+		}
+		if b == ZDLE {
+			if k+1 == len(p) {
+				return true
+			}
+			k++
+			switch c := p[k]; {
+			case c == ZRUB0:
+				b = 0x7f
+			case c == ZRUB1:
+				b = 0xff
+			case c >= 0x40 && c != ZCRCE && c != ZCRCG && c != ZCRCQ && c != ZCRCW:
+				b = c ^ 0x40
+			default:
+				return false
+			}
+		}
+		raw[got] = b
+		got++
+	}
+	switch {
+	case got < n:
+		return true
+	case enc == ZBIN32:
+		return crc32Verify(raw[:n])
+	default:
+		return crc16Verify(raw[:n])
 	}
 }
 
-// purge discards the bytes currently sitting in the bufio buffer to clear stale
-// transport data before sending ZRPOS in error recovery. It only drops what is
-// already buffered (it does not, and cannot non-blockingly, drain the OS/modem
-// serial buffer), and it logs the discarded byte count so a frame trace can show
-// whether a recovery cycle dropped a fresh inbound header or left stale in-flight
-// bytes behind — the otherwise-invisible signal needed to diagnose a resync loop.
-func (tr *transportReader) purge() {
+// drainUntilIdle reads and discards input until a read sees purgeIdle of
+// silence, an error, or purgeMaxBytes, or until the input it discards
+// completes an abort sequence (errAbortReceived). The deadline it leaves
+// behind is re-armed by the next readByte, which always arms one on an empty
+// buffer.
+func (tr *transportReader) drainUntilIdle() (int, error) {
+	total := 0
+	for total < purgeMaxBytes {
+		tr.setDeadline(time.Now().Add(tr.purgeIdle))
+		if _, err := tr.r.Peek(1); err != nil {
+			break
+		}
+		n := tr.r.Buffered()
+		if err := tr.discard(n); err != nil {
+			return total, err
+		}
+		total += n
+	}
 	n := tr.r.Buffered()
-	if n > 0 {
-		tr.r.Discard(n)
+	if err := tr.discard(n); err != nil {
+		return total, err
 	}
-	tr.logger.Debug("purge: discarded buffered bytes", "count", n)
+	return total + n, nil
 }
@@ -0,0 +1,433 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// TestZdlReadNoisePairsAbortFast: 100 KB of ZDLE+0x01 pairs must fail fast.
+// The pairs are not a CAN run (no two CANs are adjacent), so each is dropped
+// as noise and the garbage budget ends the read after garbageMax pairs
+// without the decoder descending into the rest of the run.
+func TestZdlReadNoisePairsAbortFast(t *testing.T) {
+	noise := bytes.Repeat([]byte{ZDLE, 0x01}, 50*1024)
+	buf := bytes.NewBuffer(noise)
+	tr := newTransportReader(buf, 1200, 0, true, discardLogger())
+
+	_, _, err := tr.zdlRead()
+	if !errors.Is(err, errGarbageOverflow) {
+		t.Fatalf("zdlRead = %v, want garbage overflow", err)
+	}
+	consumed := len(noise) - buf.Len() - tr.r.Buffered()
+	if consumed > 4096 {
+		t.Fatalf("decoder consumed %d noise bytes before failing", consumed)
+	}
+}
+
+// TestRecvSubpacketNoiseChargesGarbage: noise pairs interleaved with data bytes
+// (so the CAN run keeps resetting) are charged against the garbage budget and
+// end the subpacket with errGarbageOverflow.
+func TestRecvSubpacketNoiseChargesGarbage(t *testing.T) {
+	var stream []byte
+	for i := 0; i < 100*1024/3; i++ {
+		stream = append(stream, ZDLE, 0x01, 'x')
+	}
+	buf := bytes.NewBuffer(stream)
+	s := &Session{
+		tr:     newTransportReader(buf, 1200, 0, true, discardLogger()),
+		logger: discardLogger(),
+	}
+
+	_, _, err := s.recvSubpacket(1 << 20)
+	if !errors.Is(err, errGarbageOverflow) {
+		t.Fatalf("recvSubpacket = %v, want errGarbageOverflow", err)
+	}
+}
+
+// newDeadlineReader returns a transportReader over r with emulated read
+// deadlines, so timed paths can be tested over in-memory pipes.
+func newDeadlineReader(r io.Reader, timeout, purgeIdle time.Duration) *transportReader {
+	tr := newTransportReader(newPumpReader(r, nil), 1200, timeout, true, discardLogger())
+	tr.purgeIdle = purgeIdle
+	return tr
+}
+
+// purgeScenario delivers a first stale burst, purges, and reports the first
+// byte read once a fresh frame start has been sent after the purge. Further
+// stale bursts keep arriving (closer together than the idle window) while the
+// purge runs.
+func purgeScenario(t *testing.T, purgeIdle time.Duration) byte {
+	r, w := bufferedPipe(64)
+	defer w.Close()
+	tr := newDeadlineReader(r, time.Second, purgeIdle)
+
+	stale := bytes.Repeat([]byte{0xAA}, 1000)
+	w.Write(stale)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 3; i++ {
+			time.Sleep(10 * time.Millisecond)
+			w.Write(stale)
+		}
+	}()
+	if _, err := tr.readByte(); err != nil {
+		t.Fatalf("readByte: %v", err)
+	}
+	tr.purge()
+	<-done // every stale burst has been sent before the frame start
+	w.Write([]byte{ZPAD, ZDLE, ZHEX})
+	b, err := tr.readByte()
+	if err != nil {
+		t.Fatalf("readByte after purge: %v", err)
+	}
+	return b
+}
+
+func TestPurgeDrainsInFlightUntilIdle(t *testing.T) {
+	if b := purgeScenario(t, 150*time.Millisecond); b != ZPAD {
+		t.Fatalf("first byte after timed purge = 0x%02x, want ZPAD (stale bursts drained)", b)
+	}
+}
+
+func TestPurgeBufferedOnlyWhenIdleUnset(t *testing.T) {
+	if b := purgeScenario(t, 0); b != 0xAA {
+		t.Fatalf("first byte after buffered-only purge = 0x%02x, want stale 0xAA", b)
+	}
+}
+
+// deadlineRW is an in-memory transport with emulated read deadlines.
+type deadlineRW struct {
+	*pumpReader
+	io.Writer
+}
+
+// zrposCounter counts the hex ZRPOS headers a receiver writes.
+type zrposCounter struct {
+	io.Writer
+	n int
+}
+
+func (c *zrposCounter) Write(p []byte) (int, error) {
+	c.n += bytes.Count(p, []byte{ZPAD, ZPAD, ZDLE, ZHEX, '0', '9'})
+	return c.Writer.Write(p)
+}
+
+// TestLoopbackMidStreamZRPOSWithTimedPurge streams 256 KB through a pipe that
+// holds far more than the receiver's buffer, as socket and modem buffers do,
+// with every 64th subpacket damaged. Without the timed purge the backlog
+// arriving after each ZRPOS sets off further errors; with it the receiver
+// needs a fraction of the recovery cycles and retransmits.
+func TestLoopbackMidStreamZRPOSWithTimedPurge(t *testing.T) {
+	content := randomContent(256 << 10)
+	transfer := func(purgeIdle time.Duration) (zrpos int, retransmit int64) {
+		r1, w1 := bufferedPipe(256)
+		r2, w2 := bufferedPipe(256)
+		sh := newTestHandler()
+		sh.filesToSend = []*FileOffer{{Name: "purge.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+		rh := newTestHandler()
+
+		senderT := &pipeReadWriter{Reader: r2, Writer: &corruptingWriter{w: w1, targetCount: 64, every: 64}}
+		answers := &zrposCounter{Writer: w2}
+		receiverT := &deadlineRW{pumpReader: newPumpReader(r1, nil), Writer: answers}
+
+		sender := NewSession(senderT, sh, &Config{Logger: discardLogger()})
+		receiver := NewSession(receiverT, rh, &Config{RecvTimeout: 2 * time.Second, PurgeIdle: purgeIdle, Logger: discardLogger()})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		var wg sync.WaitGroup
+		var sendErr, recvErr error
+		wg.Add(2)
+		go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+		go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+		wg.Wait()
+
+		if sendErr != nil || recvErr != nil {
+			t.Fatalf("PurgeIdle %v: send=%v recv=%v", purgeIdle, sendErr, recvErr)
+		}
+		rh.mu.Lock()
+		defer rh.mu.Unlock()
+		if got := rh.receivedFiles["purge.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+			t.Fatalf("PurgeIdle %v: content mismatch", purgeIdle)
+		}
+		return answers.n, sender.Stats().RetransmitWritten
+	}
+
+	bufferedZRPOS, bufferedResent := transfer(0)
+	timedZRPOS, timedResent := transfer(50 * time.Millisecond)
+	t.Logf("buffered-only purge: %d ZRPOS, %d bytes resent; timed purge: %d ZRPOS, %d bytes resent",
+		bufferedZRPOS, bufferedResent, timedZRPOS, timedResent)
+	if timedZRPOS*2 > bufferedZRPOS {
+		t.Errorf("timed purge needed %d ZRPOS against %d without, want at most half", timedZRPOS, bufferedZRPOS)
+	}
+	if timedResent*2 > bufferedResent {
+		t.Errorf("timed purge resent %d bytes against %d without, want at most half", timedResent, bufferedResent)
+	}
+}
+
+// fillBuffer makes the transportReader buffer everything data holds.
+func fillBuffer(t *testing.T, tr *transportReader, n int) {
+	t.Helper()
+	if _, err := tr.r.Peek(n); err != nil {
+		t.Fatalf("Peek(%d): %v", n, err)
+	}
+}
+
+func TestPeekForZPADExaminesEachByteOnce(t *testing.T) {
+	var in bytes.Buffer
+	in.Write([]byte("noise"))
+	in.WriteByte(CAN)
+	in.Write([]byte("more"))
+	tr := newTransportReader(&in, 1200, 0, true, discardLogger())
+	fillBuffer(t, tr, 10)
+
+	if !tr.peekForZPAD() {
+		t.Fatal("first peek missed the buffered CAN")
+	}
+	if tr.peekForZPAD() {
+		t.Fatal("second peek re-reported the already-examined CAN")
+	}
+
+	// Consuming bytes must not confuse the watermark.
+	for i := 0; i < 3; i++ {
+		tr.readByte()
+	}
+	if tr.peekForZPAD() {
+		t.Fatal("peek after consumption re-reported examined bytes")
+	}
+
+	// A ZPAD arriving later is new input and is reported.
+	in.Write([]byte{'x', ZPAD})
+	fillBuffer(t, tr, tr.r.Buffered()+2)
+	if !tr.peekForZPAD() {
+		t.Fatal("peek missed a newly arrived ZPAD")
+	}
+	if tr.peekForZPAD() {
+		t.Fatal("peek re-reported the ZPAD")
+	}
+}
+
+func TestPeekForZPADEmptyBuffer(t *testing.T) {
+	tr := newTransportReader(&bytes.Buffer{}, 1200, 0, true, discardLogger())
+	if tr.peekForZPAD() {
+		t.Fatal("peek on empty buffer reported a frame")
+	}
+}
+
+// BenchmarkPeekForZPAD models a full 4 KB buffer of pending reverse-channel
+// bytes with no frame start, sampled once per subpacket.
+func BenchmarkPeekForZPAD(b *testing.B) {
+	tr := newTransportReader(bytes.NewReader(bytes.Repeat([]byte{'.'}, 4096)), 1200, 0, true, discardLogger())
+	tr.r.Peek(4096)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tr.peekForZPAD()
+	}
+}
+
+// TestAbortDetectedOnEveryReadPath injects the standard abort sequence at each
+// point a parser can be reading and expects a prompt ErrAborted, not a parse
+// error.
+func TestAbortDetectedOnEveryReadPath(t *testing.T) {
+	abort := string(abortSequence)
+	cases := []struct {
+		name string
+		wire string
+		read func(*Session) error
+	}{
+		{"header hunt", "line noise" + abort, func(s *Session) error {
+			_, err := s.recvHeader()
+			return err
+		}},
+		{"hex digits", "**\x18B01" + abort, func(s *Session) error {
+			_, err := s.recvHeader()
+			return err
+		}},
+		{"binary header", "*\x18A\x0a" + abort, func(s *Session) error {
+			_, err := s.recvHeader()
+			return err
+		}},
+		{"subpacket data", "some file data" + abort, func(s *Session) error {
+			_, _, err := s.recvSubpacket(1024)
+			return err
+		}},
+		{"with XON interleaved", "**\x18B0" + "\x18\x18\x11\x18\x18\x13\x18", func(s *Session) error {
+			_, err := s.recvHeader()
+			return err
+		}},
+		{"skip to frame start", "stale data" + abort + "**\x18B01", func(s *Session) error {
+			s.tr.r.Peek(1) // buffer the input
+			_, err := s.tr.skipToFrameStart()
+			return err
+		}},
+		{"purge", "stale data" + abort, func(s *Session) error {
+			s.tr.r.Peek(1)
+			return s.tr.purge()
+		}},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			in := &pipeReadWriter{Reader: strings.NewReader(tc.wire), Writer: io.Discard}
+			s := NewSession(in, newTestHandler(), &Config{Logger: discardLogger()})
+			if err := tc.read(s); !errors.Is(err, ErrAborted) {
+				t.Fatalf("got %v, want ErrAborted", err)
+			}
+		})
+	}
+}
+
+// TestAbortSeenByTimedPurge: an abort sequence arriving while a timed purge
+// drains stale input ends the purge with ErrAborted, not discarded with the
+// rest.
+func TestAbortSeenByTimedPurge(t *testing.T) {
+	r, w := bufferedPipe(64)
+	defer w.Close()
+	tr := newDeadlineReader(r, time.Second, 150*time.Millisecond)
+	w.Write(bytes.Repeat([]byte{0xAA}, 1000))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		w.Write(append(bytes.Repeat([]byte{0xAA}, 100), abortSequence...))
+	}()
+	if _, err := tr.readByte(); err != nil {
+		t.Fatalf("readByte: %v", err)
+	}
+	if err := tr.purge(); !errors.Is(err, ErrAborted) {
+		t.Fatalf("purge = %v, want ErrAborted", err)
+	}
+}
+
+// TestAbortTailSwallowed: after an abort is detected, the rest of the abort
+// sequence (three more CANs and ten backspaces) must not reach the next
+// session on the same Session as garbage.
+func TestAbortTailSwallowed(t *testing.T) {
+	wire := string(abortSequence) + "**\x18B0100000000" // then a ZRINIT hex header
+	in := &pipeReadWriter{Reader: strings.NewReader(wire), Writer: io.Discard}
+	s := NewSession(in, newTestHandler(), &Config{Logger: discardLogger()})
+	if _, err := s.recvHeader(); !errors.Is(err, ErrAborted) {
+		t.Fatalf("first read = %v, want ErrAborted", err)
+	}
+	if _, err := s.tr.scanForPad(); err != nil {
+		t.Fatalf("scan after abort: %v", err)
+	}
+	if s.tr.garbageCount != 0 {
+		t.Fatalf("abort tail counted as %d garbage bytes", s.tr.garbageCount)
+	}
+}
+
+// TestAbortTailDrainedFromWire: the backspaces of an abort sequence usually
+// arrive after its CANs. They must be read off the transport with the abort,
+// not left for a new session on the same transport to trip over as garbage.
+func TestAbortTailDrainedFromWire(t *testing.T) {
+	r, w := bufferedPipe(8)
+	defer w.Close()
+	transport := &deadlineRW{pumpReader: newPumpReader(r, nil), Writer: io.Discard}
+
+	s := NewSession(transport, newTestHandler(), &Config{RecvTimeout: time.Second, Logger: discardLogger()})
+	w.Write(abortSequence[:canAbortCount])
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		time.Sleep(10 * time.Millisecond)
+		w.Write(abortSequence[canAbortCount:])
+	}()
+	if _, err := s.recvHeader(); !errors.Is(err, ErrAborted) {
+		t.Fatalf("recvHeader = %v, want ErrAborted", err)
+	}
+	<-sent
+	if n := s.tr.r.Buffered(); n != 0 {
+		t.Fatalf("%d bytes left buffered after the abort", n)
+	}
+
+	var noise bytes.Buffer
+	next := NewSession(transport, newTestHandler(), &Config{RecvTimeout: time.Second, GarbageSink: &noise, Logger: discardLogger()})
+	NewFrameWriter(w, EscapeStandard).WriteHexHeader(makeHeader(ZRINIT))
+	if hdr, err := next.recvHeader(); err != nil || hdr.Type != ZRINIT {
+		t.Fatalf("next session: recvHeader = %s, %v; want ZRINIT", hdr, err)
+	}
+	if noise.Len() != 0 {
+		t.Fatalf("next session skipped %q as garbage", noise.Bytes())
+	}
+}
+
+func TestReadTimeoutTyped(t *testing.T) {
+	r, w := bufferedPipe(1)
+	defer w.Close()
+	tr := newTransportReader(newPumpReader(r, nil), 1200, 30*time.Millisecond, true, discardLogger())
+	if _, err := tr.readByte(); !errors.Is(err, ErrTimeout) || !isTimeout(err) {
+		t.Fatalf("readByte on a silent line = %v, want ErrTimeout wrapping the deadline error", err)
+	}
+
+	broken := newTransportReader(iotest.ErrReader(io.ErrClosedPipe), 1200, 30*time.Millisecond, true, discardLogger())
+	if _, err := broken.readByte(); errors.Is(err, ErrTimeout) || !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("readByte on a closed transport = %v, want io.ErrClosedPipe and no ErrTimeout", err)
+	}
+}
+
+// TestZdlReadEscapePairs enumerates ZDLE+X for every X from 0x40 up. In both
+// modes subpacket ends, ZRUB0/ZRUB1 and the images of control characters
+// decode; the rest fail with errBadEscape by default and decode as X^0x40
+// when lenient. (XON and XOFF with parity are flow control, skipped anywhere.)
+func TestZdlReadEscapePairs(t *testing.T) {
+	for _, lenient := range []bool{false, true} {
+		for c := 0x40; c <= 0xff; c++ {
+			if c == XON|0x80 || c == XOFF|0x80 {
+				continue
+			}
+			tr := newTransportReader(bytes.NewReader([]byte{ZDLE, byte(c)}), 1200, 0, true, discardLogger())
+			tr.lenientEscapes = lenient
+			b, end, err := tr.zdlRead()
+
+			switch {
+			case c >= ZCRCE && c <= ZCRCW:
+				if err != nil || end != byte(c) {
+					t.Errorf("lenient=%v ZDLE 0x%02x: end=0x%02x err=%v, want a subpacket end", lenient, c, end, err)
+				}
+			case c == ZRUB0 || c == ZRUB1:
+				want := byte(0x7f)
+				if c == ZRUB1 {
+					want = 0xff
+				}
+				if err != nil || b != want {
+					t.Errorf("lenient=%v ZDLE 0x%02x = 0x%02x, %v; want 0x%02x", lenient, c, b, err, want)
+				}
+			case c&0x60 == 0x40 || lenient:
+				if err != nil || end != 0 || b != byte(c)^0x40 {
+					t.Errorf("lenient=%v ZDLE 0x%02x = 0x%02x end 0x%02x, %v; want 0x%02x", lenient, c, b, end, err, c^0x40)
+				}
+			default:
+				if !errors.Is(err, errBadEscape) {
+					t.Errorf("lenient=%v ZDLE 0x%02x = 0x%02x, %v; want errBadEscape", lenient, c, b, err)
+				}
+			}
+		}
+	}
+}
+
+// TestBadEscapeFailsSubpacket: a corrupted escape byte inside a subpacket
+// fails it, as a CRC error would, in place of decoding a wrong byte.
+func TestBadEscapeFailsSubpacket(t *testing.T) {
+	var enc bytes.Buffer
+	fw := NewFrameWriter(&enc, EscapeStandard)
+	if err := fw.WriteSubpacket([]byte{'a', XON, 'b'}, ZCRCW, false); err != nil {
+		t.Fatalf("WriteSubpacket: %v", err)
+	}
+	wire := enc.Bytes()
+	i := bytes.IndexByte(wire, ZDLE)
+	if i < 0 || wire[i+1] != XON^0x40 {
+		t.Fatalf("no escaped XON in %q", wire)
+	}
+	wire[i+1] ^= 0x20 // one bit flipped: 0x51 becomes 0x71
+
+	_, _, err := NewFrameReader(bytes.NewReader(wire), EscapeStandard).ReadSubpacket(1024, false)
+	if !errors.Is(err, errBadEscape) {
+		t.Fatalf("ReadSubpacket = %v, want errBadEscape", err)
+	}
+}
@@ -1,7 +1,9 @@
 package zmodem
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"time"
@@ -21,33 +23,83 @@ const (
 	srxDone                            // Session complete
 )
 
-// dataRetryBudget is the maximum number of consecutive data-phase recovery
-// cycles (each a purge + single ZRPOS) tolerated before aborting "max retries
-// exceeded during data transfer". It is the abort criterion ONLY when
-// Config.DataStallTimeout == 0 (the legacy count-based mode). Higher than the
-// file-wait MaxRetries because a single mid-stream data error must be
-// recoverable: a valid subpacket resets the counter, so this only trips on a run
-// of consecutive errors with no good data in between. When DataStallTimeout > 0
-// the progress-aware abort supersedes this count (see recoverData).
+// dataRetryBudget is the default Config.DataRetries: the number of consecutive
+// data-phase recovery cycles (each a purge + single ZRPOS) tolerated before
+// aborting "max retries exceeded during data transfer". It is the abort
+// criterion ONLY when Config.DataStallTimeout == 0 (the legacy count-based
+// mode). Higher than the file-wait MaxRetries because a single mid-stream data
+// error must be recoverable: a valid subpacket resets the counter, so this only
+// trips on a run of consecutive errors with no good data in between. When
+// DataStallTimeout > 0 the progress-aware abort supersedes this count (see
+// recoverData).
 const dataRetryBudget = 25
 
+// zfileCrossing is how soon after the ZRPOS accepting a file a repeat of its
+// ZFILE counts as having crossed that ZRPOS on the line. Senders that re-offer
+// a file every second while AcceptFile is busy (Synchronet's sexyz) leave such
+// repeats queued behind the first; answering each with another ZRPOS would
+// restart their data again and again. A repeat arriving later means the ZRPOS
+// was lost and is answered.
+const zfileCrossing = 500 * time.Millisecond
+
+// zrinitRepeatWait is how long the receiver waits after answering a ZEOF with
+// ZRINIT before sending that ZRINIT again, unless Config.FileWaitIdle says
+// otherwise. Senders that purge their input after ZEOF (the ExtraPuTTY and
+// KiTTY ZMODEM plugins) can throw the first one away and then wait for it
+// without ever repeating their ZEOF; the full RecvTimeout re-prompt comes too
+// late for them.
+const zrinitRepeatWait = 2 * time.Second
+
 // runReceiver implements the receiver state machine.
-func (s *Session) runReceiver(ctx context.Context) error {
+func (s *Session) runReceiver(ctx context.Context) (err error) {
 	state := srxInit
+	if s.pending != nil {
+		// Auto has read the sender's opening frame: ZRQINIT is answered
+		// with ZRINIT there, ZFILE taken as it stands.
+		state = srxFileWait
+	}
 	var (
 		curInfo        FileInfo
 		curWriter      io.WriteCloser
 		fileOffset     int64
 		incomingPos    int64 // position of the incoming byte stream (see srxData)
 		bytesReceived  int64
-		retries        int
-		consecutiveErr int // errors outside ZDATA
+		sizeErr        error     // ErrSizeOverrun for the file at its ZEOF (see srxEOF)
+		acceptedAt     time.Time // ZRPOS accepting the file sent; zero once its ZDATA arrives
+		betweenFiles   bool      // a file just ended; wait quietly for the next (see zrinitRepeatWait)
+		consecutiveErr int       // errors outside ZDATA
+
+		// Two separate retry budgets, so one phase cannot spend the other's.
+		// negRetries counts failed reads while waiting for a ZFILE, against
+		// MaxRetries; it is reset by every ZFILE received, so each file's
+		// negotiation starts afresh whatever came before. dataRetries counts
+		// data-phase recovery cycles, against DataRetries; it is reset when a
+		// file is accepted and by every valid data subpacket.
+		negRetries  int
+		dataRetries int
+
+		negotiated bool // a ZFILE has come, telling how the sender sends
 	)
 
 	const maxConsecutiveErr = 15
 
+	// A dead transport ends the session; the file being received did not
+	// complete. (Every other exit mid-file reports it itself.) Any other exit
+	// with a file still open — a cancelled context — leaves the writer to the
+	// handler, but not before the bytes we buffered for it have reached it.
+	defer func() {
+		if err != nil && curWriter != nil && s.tw.err() != nil {
+			s.completeFile(curInfo, bytesReceived, closeWriter(curWriter, err))
+		} else if curWriter != nil {
+			_ = flushFile(curWriter)
+		}
+	}()
+
 	for state != srxDone {
-		if err := ctx.Err(); err != nil {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if err := s.tw.err(); err != nil {
 			return err
 		}
 
@@ -62,15 +114,24 @@ func (s *Session) runReceiver(ctx context.Context) error {
 			// Control phase: revert to the (shorter) control-phase read timeout
 			// after any preceding data phase.
 			s.tr.setDataPhase(false)
+			if betweenFiles {
+				betweenFiles = false
+				if !s.tr.awaitInput(s.fileWaitIdle()) {
+					s.logger.Debug("no next file, resending ZRINIT")
+					if err := s.sendZRINIT(); err != nil {
+						return err
+					}
+				}
+			}
 			hdr, err := s.recvHeader()
 			if err != nil {
 				consecutiveErr++
 				if consecutiveErr >= maxConsecutiveErr {
-					return fmt.Errorf("zmodem: %d consecutive errors, peer likely not ZMODEM", consecutiveErr)
+					return fmt.Errorf("zmodem: %d consecutive errors, peer likely not ZMODEM: %w", consecutiveErr, err)
 				}
-				retries++
-				if retries >= s.cfg.MaxRetries {
-					return fmt.Errorf("zmodem: max retries exceeded waiting for ZFILE")
+				negRetries++
+				if negRetries >= s.cfg.MaxRetries {
+					return fmt.Errorf("zmodem: max retries exceeded waiting for ZFILE: %w", err)
 				}
 				// Re-prompt the sender with ZRINIT, not ZNAK. While waiting
 				// for the first ZFILE we hold no accepted file, so the
@@ -101,10 +162,6 @@ func (s *Session) runReceiver(ctx context.Context) error {
 				}
 
 			case ZSINIT:
-				// Enable CRC-32 if sender used ZBIN32 encoding
-				if hdr.Encoding == ZBIN32 {
-					s.useCRC32 = true
-				}
 				// Sender wants to set attention string
 				data, _, err := s.recvSubpacket(256)
 				if err != nil {
@@ -114,7 +171,7 @@ func (s *Session) runReceiver(ctx context.Context) error {
 				for len(data) > 0 && data[len(data)-1] == 0 {
 					data = data[:len(data)-1]
 				}
-				s.attnSeq = data
+				s.attnSeq = bytes.Clone(data)
 
 				// Process ZSINIT flags
 				if (hdr.ZF0() & TESCCTL) != 0 {
@@ -127,34 +184,47 @@ func (s *Session) runReceiver(ctx context.Context) error {
 				}
 
 			case ZFILE:
-				// Enable CRC-32 if sender used ZBIN32 encoding
-				if hdr.Encoding == ZBIN32 {
-					s.useCRC32 = true
-				}
+				// A fresh negotiation budget for the next file, refused or not.
+				negRetries = 0
 				// Parse file metadata from data subpacket
 				data, _, err := s.recvSubpacket(2048)
 				if err != nil {
 					return fmt.Errorf("zmodem: ZFILE data error: %w", err)
 				}
 
-				info, err := parseFileInfo(data)
-				if err != nil {
-					return fmt.Errorf("zmodem: parse file info: %w", err)
+				if !negotiated {
+					negotiated = true
+					s.emitNegotiated(0, 0, subpacketCRC32(s.rxEnc, s.useCRC32))
 				}
+				info, err := parseFileInfo(data)
+				info.Text = hdr.ZF0() == ZCNL
 				curInfo = info
-
-				// Check MaxFileSize
-				if s.cfg.MaxFileSize > 0 && curInfo.Size > s.cfg.MaxFileSize {
-					s.logger.Warn("file exceeds MaxFileSize, skipping",
-						"file", curInfo.Name, "size", curInfo.Size, "max", s.cfg.MaxFileSize)
+				s.beginFile(curInfo)
+				if refused := s.refuseOffer(curInfo, err); refused != nil {
 					if err := s.sendHexHeader(makeHeader(ZSKIP)); err != nil {
 						return err
 					}
+					s.completeFile(curInfo, 0, refused)
+					betweenFiles = s.cfg.FileWaitIdle > 0
 					continue
 				}
 
 				state = srxFileAccept
 
+			case ZEOF:
+				// The last file's ZEOF again: our ZRINIT answering it was lost
+				// or is still on its way (DSZ and GSZ repeat ZEOF quickly).
+				// Answer it again, as rz does, rather than leave the sender
+				// waiting; the error bound still stops a sender stuck on it.
+				consecutiveErr++
+				if consecutiveErr >= maxConsecutiveErr {
+					return fmt.Errorf("zmodem: %d consecutive errors, peer repeating ZEOF", consecutiveErr)
+				}
+				s.logger.Debug("repeated ZEOF, resending ZRINIT", "pos", hdr.Position())
+				if err := s.sendZRINIT(); err != nil {
+					return err
+				}
+
 			case ZFIN:
 				state = srxFin
 
@@ -187,17 +257,25 @@ func (s *Session) runReceiver(ctx context.Context) error {
 					if err := s.sendHexHeader(makeHeader(ZSKIP)); err != nil {
 						return err
 					}
-					s.handler.FileCompleted(curInfo, 0, ErrSkip)
+					s.completeFile(curInfo, 0, ErrSkip)
+					betweenFiles = s.cfg.FileWaitIdle > 0
 					state = srxFileWait
 					continue
 				}
 				return fmt.Errorf("zmodem: AcceptFile error: %w", err)
 			}
 
-			curWriter = writer
+			s.filePath = writerPath(writer)
+			if curInfo.Text {
+				writer = newTextWriter(writer)
+			}
+			curWriter = s.bufferFile(writer)
 			fileOffset = offset
 			bytesReceived = offset
-			retries = 0
+			s.startFile(offset)
+			// A fresh data budget per file: the last file's recoveries are
+			// not this one's.
+			dataRetries = 0
 			// Start the progress-stall clock at data-phase entry so the first
 			// stall window (Config.DataStallTimeout) is measured from here.
 			s.lastProgressAt = s.tr.now()
@@ -206,6 +284,7 @@ func (s *Session) runReceiver(ctx context.Context) error {
 			if err := s.sendHexHeader(makePosHeader(ZRPOS, fileOffset)); err != nil {
 				return err
 			}
+			acceptedAt = s.tr.now()
 			// Entering the data phase: subsequent blocking reads use the
 			// (possibly longer) data-phase read timeout.
 			s.tr.setDataPhase(true)
@@ -215,9 +294,11 @@ func (s *Session) runReceiver(ctx context.Context) error {
 			hdr, err := s.recvHeader()
 			if err != nil {
 				consecutiveErr++
-				if rerr := s.recoverData(fileOffset, &retries); rerr != nil {
-					closeWriter(curWriter)
-					s.handler.FileCompleted(curInfo, bytesReceived, rerr)
+				if rerr := s.recoverData(fileOffset, &dataRetries); rerr != nil {
+					rerr = fmt.Errorf("%w: %w", rerr, err)
+					ferr := closeWriter(curWriter, rerr)
+					curWriter = nil
+					s.completeFile(curInfo, bytesReceived, ferr)
 					return rerr
 				}
 				continue
@@ -226,10 +307,7 @@ func (s *Session) runReceiver(ctx context.Context) error {
 
 			switch hdr.Type {
 			case ZDATA:
-				// Enable CRC-32 if sender used ZBIN32 encoding
-				if hdr.Encoding == ZBIN32 {
-					s.useCRC32 = true
-				}
+				acceptedAt = time.Time{}
 				dataPos := hdr.Position()
 				switch {
 				case dataPos > fileOffset:
@@ -238,11 +316,17 @@ func (s *Session) runReceiver(ctx context.Context) error {
 					// a plain io.WriteCloser with no seek/truncate contract),
 					// so we cannot leave a hole and fill it later. Re-ask the
 					// peer to resume exactly at our write position.
+					// This is a recovery like any other, charged to the
+					// data budget: a peer that keeps re-offering the frame
+					// cannot hold the session forever.
 					s.logger.Warn("ZDATA position ahead of write offset, re-requesting",
 						"expected", fileOffset, "got", dataPos)
-					s.tr.purge()
-					if err := s.sendHexHeader(makePosHeader(ZRPOS, fileOffset)); err != nil {
-						return err
+					if rerr := s.recoverData(fileOffset, &dataRetries); rerr != nil {
+						rerr = fmt.Errorf("%w: ZDATA at %d, expected %d", rerr, dataPos, fileOffset)
+						ferr := closeWriter(curWriter, rerr)
+						curWriter = nil
+						s.completeFile(curInfo, bytesReceived, ferr)
+						return rerr
 					}
 					continue
 				case dataPos < fileOffset:
@@ -259,24 +343,35 @@ func (s *Session) runReceiver(ctx context.Context) error {
 					// so this is safe against the append-only writer. incomingPos
 					// is the separate cursor that tracks the incoming stream so
 					// we know how much of each subpacket is duplicate.
-					s.logger.Debug("ZDATA position behind write offset, discarding overlap",
-						"writeOffset", fileOffset, "got", dataPos)
+					if s.debug() {
+						s.logger.Debug("ZDATA position behind write offset, discarding overlap",
+							"writeOffset", fileOffset, "got", dataPos)
+					}
 					incomingPos = dataPos
 				default:
 					incomingPos = fileOffset
 				}
 
 				// Receive data subpackets
-				if err := s.receiveDataSubpackets(ctx, curWriter, &curInfo, &fileOffset, &incomingPos, &bytesReceived, &retries); err != nil {
+				if err := s.receiveDataSubpackets(ctx, curWriter, &curInfo, &fileOffset, &incomingPos, &bytesReceived, &dataRetries); err != nil {
 					if err == errEOFReceived {
 						state = srxEOF
 						continue
 					}
+					if errors.Is(err, ErrAborted) {
+						// The sender cancelled mid-subpacket: nothing to recover.
+						ferr := closeWriter(curWriter, err)
+						curWriter = nil
+						s.completeFile(curInfo, bytesReceived, ferr)
+						return err
+					}
 					// CRC error / read timeout / other mid-stream fault: recover.
 					s.logger.Debug("data error, sending ZRPOS", "err", err, "offset", fileOffset)
-					if rerr := s.recoverData(fileOffset, &retries); rerr != nil {
-						closeWriter(curWriter)
-						s.handler.FileCompleted(curInfo, bytesReceived, rerr)
+					if rerr := s.recoverData(fileOffset, &dataRetries); rerr != nil {
+						rerr = fmt.Errorf("%w: %w", rerr, err)
+						ferr := closeWriter(curWriter, rerr)
+						curWriter = nil
+						s.completeFile(curInfo, bytesReceived, ferr)
 						return rerr
 					}
 				}
@@ -297,11 +392,20 @@ func (s *Session) runReceiver(ctx context.Context) error {
 						// then forces a truncate-to-zero re-fetch anyway. Fail the
 						// file fast instead: the partial is retained and the next
 						// call resumes (or cleanly restarts) without the stall.
-						closeWriter(curWriter)
+						ferr := closeWriter(curWriter, errOverwritePastEOF)
 						curWriter = nil
-						s.handler.FileCompleted(curInfo, bytesReceived, errOverwritePastEOF)
+						s.completeFile(curInfo, bytesReceived, ferr)
 						return errOverwritePastEOF
 					}
+					if size := curInfo.wireSize(); size > 0 && fileOffset == size {
+						// Everything declared is written and the clamp
+						// discarded the rest: the file outgrew its offer.
+						sizeErr = fmt.Errorf("%w: declared %d, sent %d, kept %d",
+							ErrSizeOverrun, curInfo.Size, eofPos, fileOffset)
+						s.logger.Warn("file larger than declared, truncated", "sent", eofPos)
+						state = srxEOF
+						continue
+					}
 					// eofPos > fileOffset: a premature/stale ZEOF ahead of our
 					// data. IGNORE it (spec revision 07-31-1987) and keep
 					// receiving; the real ZEOF at our offset will follow.
@@ -309,6 +413,12 @@ func (s *Session) runReceiver(ctx context.Context) error {
 						"expected", fileOffset, "got", eofPos)
 					continue
 				}
+				if size := curInfo.wireSize(); size > 0 && fileOffset > size {
+					// Only OverrunAccept writes past the declared size.
+					sizeErr = fmt.Errorf("%w: declared %d, sent %d",
+						ErrSizeOverrun, curInfo.Size, fileOffset)
+					s.logger.Warn("file larger than declared", "sent", fileOffset)
+				}
 				state = srxEOF
 
 			case ZNAK:
@@ -318,40 +428,102 @@ func (s *Session) runReceiver(ctx context.Context) error {
 				}
 
 			case ZFILE:
-				// Duplicate ZFILE — resend ZRPOS
-				// This can happen if our ZRPOS was lost
-				data, _, _ := s.recvSubpacket(2048) // consume the data subpacket
-				_ = data
-				if err := s.sendHexHeader(makePosHeader(ZRPOS, fileOffset)); err != nil {
-					return err
+				data, _, serr := s.recvSubpacket(2048)
+				info, perr := parseFileInfo(data)
+				info.Text = hdr.ZF0() == ZCNL
+				if serr != nil || perr != nil || sameOffer(info, curInfo) {
+					if !acceptedAt.IsZero() && s.tr.now().Sub(acceptedAt) < zfileCrossing {
+						s.logger.Debug("ZFILE repeat crossed our ZRPOS, ignoring")
+						continue
+					}
+					// Duplicate ZFILE — resend ZRPOS
+					// This can happen if our ZRPOS was lost
+					if err := s.sendHexHeader(makePosHeader(ZRPOS, fileOffset)); err != nil {
+						return err
+					}
+					if !acceptedAt.IsZero() {
+						acceptedAt = s.tr.now()
+					}
+					continue
+				}
+
+				// A different file: the sender timed out waiting for our
+				// answer to a ZEOF we never saw and moved on. End the
+				// current file where it stands and take the new offer.
+				var ferr error
+				if bytesReceived != curInfo.wireSize() {
+					ferr = fmt.Errorf("%w: file truncated at offset %d", errZEOFLost, bytesReceived)
 				}
+				ferr = closeWriter(curWriter, ferr)
+				curWriter = nil
+				s.logger.Warn("ZFILE for another file during data, ending current file",
+					"offset", bytesReceived, "next", info.Name)
+				s.completeFile(curInfo, bytesReceived, ferr)
+				s.tr.setDataPhase(false)
+
+				negRetries = 0
+				curInfo = info
+				s.beginFile(curInfo)
+				if refused := s.refuseOffer(curInfo, nil); refused != nil {
+					if err := s.sendHexHeader(makeHeader(ZSKIP)); err != nil {
+						return err
+					}
+					s.completeFile(curInfo, 0, refused)
+					betweenFiles = s.cfg.FileWaitIdle > 0
+					state = srxFileWait
+					continue
+				}
+				state = srxFileAccept
 
 			case ZFIN:
 				// Session ending prematurely
-				closeWriter(curWriter)
-				s.handler.FileCompleted(curInfo, bytesReceived, fmt.Errorf("session ended prematurely"))
+				ferr := closeWriter(curWriter, fmt.Errorf("session ended prematurely"))
+				curWriter = nil
+				s.completeFile(curInfo, bytesReceived, ferr)
 				state = srxFin
 
 			case ZSKIP:
 				// Sender cannot fulfil our ZRPOS (e.g. non-seekable reader).
-				closeWriter(curWriter)
+				ferr := closeWriter(curWriter, ErrSkip)
 				curWriter = nil
-				s.handler.FileCompleted(curInfo, bytesReceived, ErrSkip)
+				s.completeFile(curInfo, bytesReceived, ferr)
+				betweenFiles = s.cfg.FileWaitIdle > 0
 				state = srxFileWait
 
 			default:
+				// Neither data nor the end of it: whatever the sender is
+				// doing, ask again for the data at our offset.
 				s.logger.Warn("unexpected frame in data state", "type", frameTypeName(hdr.Type))
+				if rerr := s.recoverData(fileOffset, &dataRetries); rerr != nil {
+					rerr = fmt.Errorf("%w: unexpected %s", rerr, frameTypeName(hdr.Type))
+					ferr := closeWriter(curWriter, rerr)
+					curWriter = nil
+					s.completeFile(curInfo, bytesReceived, ferr)
+					return rerr
+				}
 			}
 
 		case srxEOF:
-			closeWriter(curWriter)
+			// Close flushes the file buffer: a failure there means the tail
+			// of the file never reached the writer.
+			// closeWriter hands sizeErr back unchanged unless Close failed.
+			ferr := closeWriter(curWriter, sizeErr)
+			closeFailed := ferr != sizeErr
 			curWriter = nil
-			s.handler.FileCompleted(curInfo, bytesReceived, nil)
+			sizeErr = nil
+			s.completeFile(curInfo, bytesReceived, ferr)
+			if closeFailed && s.cfg.CloseErrorZFERR {
+				if err := s.sendHexHeader(makeHeader(ZFERR)); err != nil {
+					return err
+				}
+				return ferr
+			}
 
 			// Send ZRINIT for next file
 			if err := s.sendZRINIT(); err != nil {
 				return err
 			}
+			betweenFiles = true
 			state = srxFileWait
 
 		case srxFin:
@@ -378,7 +550,8 @@ func (s *Session) runReceiver(ctx context.Context) error {
 // peer's resync at fileOffset) or a non-nil error to abort the transfer.
 //
 // The strategy is the conformant one used by the reference ZMODEM mailers
-// (lrzsz, qico, FTNd): purge the stale in-flight bytes and send ONE ZRPOS at the
+// (lrzsz, qico, FTNd): skip the stale in-flight bytes — up to the next frame
+// start if one is already buffered, else purge them — and send ONE ZRPOS at the
 // write offset immediately, then let the outer loop read the sender's re-framed
 // ZDATA under the data-phase read timeout. A conformant sender samples the
 // reverse channel after every subpacket, so the leading ZPAD of our ZRPOS
@@ -391,23 +564,38 @@ func (s *Session) runReceiver(ctx context.Context) error {
 //     made no progress (no valid data subpacket) for the whole window. A
 //     noisy-but-advancing link keeps going indefinitely because each good
 //     subpacket refreshes lastProgressAt; a genuinely stuck transfer aborts.
-//   - DataStallTimeout == 0 (legacy): abort after dataRetryBudget consecutive
-//     recovery cycles (a valid subpacket resets the counter).
+//   - DataStallTimeout == 0 (legacy): abort after Config.DataRetries
+//     consecutive recovery cycles (a valid subpacket resets the counter).
 //
 // The maxConsecutiveErr guard in runReceiver is the pure-garbage backstop in
 // both modes (a peer that never emits a valid subpacket never refreshes either).
 func (s *Session) recoverData(fileOffset int64, retries *int) error {
+	// A failed transport cannot carry the ZRPOS; don't spend a retry or a
+	// purge finding that out.
+	if err := s.tw.err(); err != nil {
+		return err
+	}
 	*retries++
+	s.errorRecovery(fileOffset)
 
 	if s.cfg.DataStallTimeout > 0 {
 		if s.tr.now().Sub(s.lastProgressAt) >= s.cfg.DataStallTimeout {
 			return fmt.Errorf("zmodem: data transfer stalled: no progress for %s", s.cfg.DataStallTimeout)
 		}
-	} else if *retries > dataRetryBudget {
+	} else if *retries > s.cfg.DataRetries {
 		return fmt.Errorf("zmodem: max retries exceeded during data transfer")
 	}
 
-	s.tr.purge()
+	// Keep a frame start already in the buffer (the sender's ZEOF, or its
+	// resync ZDATA); only without one is everything stale. A remote abort
+	// in what is dropped ends the transfer.
+	found, err := s.tr.skipToFrameStart()
+	if err == nil && !found {
+		err = s.tr.purge()
+	}
+	if err != nil {
+		return err
+	}
 	// Interrupt a streaming sender with the attention sequence if one is set
 	// (no-op by default); the ZPAD-prefixed ZRPOS below is itself the interrupt a
 	// conformant sender catches.
@@ -417,13 +605,6 @@ func (s *Session) recoverData(fileOffset int64, retries *int) error {
 	return s.sendHexHeader(makePosHeader(ZRPOS, fileOffset))
 }
 
-// breakSender is an optional transport capability: a serial transport that can
-// assert a line BREAK. Used to honour an AttnBreak meta-byte in the attention
-// sequence; transports without it simply skip the break.
-type breakSender interface {
-	SendBreak() error
-}
-
 // sendAttn transmits the attention sequence to interrupt a streaming sender
 // before a data-phase ZRPOS. The sequence is raw (un-framed) bytes carrying two
 // meta-characters: AttnBreak asserts a line break if the transport supports it
@@ -438,10 +619,10 @@ func (s *Session) sendAttn() error {
 	for _, b := range s.attnSeq {
 		switch b {
 		case AttnBreak:
-			if err := s.tw.Flush(); err != nil {
+			if err := s.tw.flushFrame(); err != nil {
 				return err
 			}
-			if bs, ok := s.transport.(breakSender); ok {
+			if bs, ok := s.transport.(BreakSender); ok {
 				if err := bs.SendBreak(); err != nil {
 					return err
 				}
@@ -449,17 +630,65 @@ func (s *Session) sendAttn() error {
 				s.logger.Debug("attn: transport cannot assert break, skipping AttnBreak")
 			}
 		case AttnPause:
-			if err := s.tw.Flush(); err != nil {
+			if err := s.tw.flushFrame(); err != nil {
+				return err
+			}
+			if err := s.attnPause(); err != nil {
 				return err
 			}
-			time.Sleep(time.Second)
 		default:
 			if err := s.tw.writeRaw([]byte{b}); err != nil {
 				return err
 			}
 		}
 	}
-	return s.tw.Flush()
+	return s.tw.flushFrame()
+}
+
+// attnPause is the one-second pause of an AttnPause. The sequence comes from
+// the sender's ZSINIT, up to 256 bytes of it, so the pause ends early when the
+// session is cancelled.
+func (s *Session) attnPause() error {
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	t := time.NewTimer(time.Second)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// refuseOffer returns why an offered file is skipped before AcceptFile is
+// asked for a writer: malformed info (perr from parseFileInfo), then
+// Config.CheckFile, then Config.MaxFileSize. It returns nil to go ahead.
+func (s *Session) refuseOffer(info FileInfo, perr error) error {
+	if perr != nil {
+		s.logger.Warn("malformed ZFILE info, skipping", "err", perr)
+		return perr
+	}
+	if s.cfg.CheckFile != nil {
+		if err := s.cfg.CheckFile(info); err != nil {
+			s.logger.Info("file refused by CheckFile, skipping", "err", err)
+			return err
+		}
+	}
+	if s.cfg.MaxFileSize > 0 && info.Size > s.cfg.MaxFileSize {
+		s.logger.Warn("file exceeds MaxFileSize, skipping", "max", s.cfg.MaxFileSize)
+		return ErrFileTooLarge
+	}
+	return nil
+}
+
+// sameOffer reports whether two ZFILE offers describe the same file, telling a
+// retransmitted ZFILE from the offer of the next one. The remaining-files and
+// remaining-bytes fields are not compared: they change between offers.
+func sameOffer(a, b FileInfo) bool {
+	return a.Name == b.Name && a.Size == b.Size && a.ModTime.Equal(b.ModTime)
 }
 
 // errEOFReceived is a sentinel used internally to signal ZEOF during data reception.
@@ -477,6 +706,10 @@ var errMergeSuspected = fmt.Errorf("zmodem: suspected merged (lost-ZDLE) subpack
 // retains the partial; the next call resumes or cleanly restarts.
 var errOverwritePastEOF = fmt.Errorf("zmodem: received past declared end of file")
 
+// errZEOFLost completes a file whose ZEOF never arrived: the sender offered
+// the next file while we were still receiving this one.
+var errZEOFLost = fmt.Errorf("zmodem: ZEOF lost, next file offered")
+
 // receiveDataSubpackets reads data subpackets until ZCRCE or error.
 //
 // offset is the append-only write position (advances only by bytes actually
@@ -490,11 +723,11 @@ func (s *Session) receiveDataSubpackets(ctx context.Context, w io.Writer, info *
 	offset *int64, incomingPos *int64, received *int64, retries *int) error {
 
 	for {
-		if err := ctx.Err(); err != nil {
-			return err
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
 		}
 
-		data, endType, err := s.recvSubpacket(s.cfg.MaxBlockSize + 256)
+		data, endType, err := s.recvDataSubpacket(w)
 		if err != nil {
 			return err
 		}
@@ -509,6 +742,10 @@ func (s *Session) receiveDataSubpackets(ctx context.Context, w io.Writer, info *
 		// it is meant to enable.
 		*retries = 0
 		s.lastProgressAt = s.tr.now()
+		s.stats.PayloadRead += int64(len(data))
+		if len(data) > 0 {
+			s.blockLen = len(data)
+		}
 
 		// Lost-ZDLE merge guard (CRC-16 only — CRC-32's frame residue differs,
 		// so a merge fails the outer CRC and never reaches here). A merged
@@ -519,7 +756,7 @@ func (s *Session) receiveDataSubpackets(ctx context.Context, w io.Writer, info *
 		// happen to look like an embedded frame) re-sends identical bytes and
 		// trips again at the same offset; accept it the second time so a rare
 		// coincidence costs one round-trip instead of stalling the transfer.
-		if s.cfg.DetectMergedSubpackets && !s.useCRC32 {
+		if s.cfg.DetectMergedSubpackets && !subpacketCRC32(s.rxEnc, s.useCRC32) {
 			if sp := detectMergedSubpacketCRC16(data); sp >= 0 {
 				if s.mergeSuspectOffset != *offset {
 					s.logger.Debug("merged subpacket suspected, re-getting",
@@ -567,14 +804,15 @@ func (s *Session) receiveDataSubpackets(ctx context.Context, w io.Writer, info *
 		// lands exactly on info.Size, the ZEOF matches, and the file completes
 		// (a corrupt body is then caught downstream by the TIC CRC-32 and
 		// re-requested — never silently delivered). Only applied when the size
-		// is known (>0); a sender that omits it keeps the unclamped behaviour.
-		if info.Size > 0 && len(writeData) > 0 {
-			if room := info.Size - *offset; room < int64(len(writeData)) {
+		// is known (>0); a sender that omits it keeps the unclamped behaviour,
+		// as does every sender under OverrunAccept.
+		if size := info.wireSize(); size > 0 && len(writeData) > 0 && s.cfg.SizeOverrunPolicy != OverrunAccept {
+			if room := size - *offset; room < int64(len(writeData)) {
 				if room < 0 {
 					room = 0
 				}
 				s.logger.Warn("subpacket overruns announced file size, clamping",
-					"offset", *offset, "size", info.Size, "subpacketTail", len(writeData), "kept", room)
+					"offset", *offset, "subpacketTail", len(writeData), "kept", room)
 				writeData = writeData[:room]
 			}
 		}
@@ -588,7 +826,7 @@ func (s *Session) receiveDataSubpackets(ctx context.Context, w io.Writer, info *
 			*received = *offset
 
 			// Progress callback
-			s.handler.FileProgress(*info, *received)
+			s.progress(*info, *received, *received)
 		}
 
 		// ZACK reports the incoming-stream position (= what the peer has sent),
@@ -607,7 +845,11 @@ func (s *Session) receiveDataSubpackets(ctx context.Context, w io.Writer, info *
 			continue
 
 		case ZCRCW:
-			// Send ZACK, then wait for next frame
+			// Send ZACK, then wait for next frame. The sender is idle until
+			// it arrives, which makes this the time to flush the file buffer.
+			if err := flushFile(w); err != nil {
+				return fmt.Errorf("zmodem: file write error: %w", err)
+			}
 			if err := s.sendHexHeader(makePosHeader(ZACK, *incomingPos)); err != nil {
 				return err
 			}
@@ -615,27 +857,51 @@ func (s *Session) receiveDataSubpackets(ctx context.Context, w io.Writer, info *
 
 		case ZCRCE:
 			// End of frame — next should be ZEOF or ZDATA
+			if err := flushFile(w); err != nil {
+				return fmt.Errorf("zmodem: file write error: %w", err)
+			}
 			return nil
 		}
 	}
 }
 
+// fileWaitIdle is how long the receiver waits between files before
+// re-prompting the sender: Config.FileWaitIdle, or zrinitRepeatWait.
+func (s *Session) fileWaitIdle() time.Duration {
+	if s.cfg.FileWaitIdle > 0 {
+		return s.cfg.FileWaitIdle
+	}
+	return zrinitRepeatWait
+}
+
 // sendZRINIT sends a ZRINIT header with our capabilities.
 func (s *Session) sendZRINIT() error {
 	hdr := makeHeader(ZRINIT)
 
-	// Set capabilities
+	// Set capabilities. A half-duplex link can neither receive while sending
+	// nor take an answer mid-stream.
 	caps := byte(CANFDX | CANOVIO)
+	if s.turn != nil {
+		caps = 0
+	}
 	if s.cfg.Use32BitCRC {
 		caps |= CANFC32
 	}
-	if s.cfg.EscapeMode == EscapeAll {
+	// Escape-all from Config, or since a ZSINIT asked for it: a sender that
+	// escapes expects the same of every ZRINIT it gets.
+	if s.tw.escapeMode == EscapeAll {
 		caps |= ESCCTL
 	}
 	caps |= s.cfg.Capabilities
 	hdr.SetZF0(caps)
+	if s.cfg.LargeBlocks {
+		hdr.SetZF1(canLargeBlocks)
+	}
 
-	// ZF1: buffer size (0 = full streaming)
+	// ZP0/ZP1: buffer size, low byte first (0 = full streaming). The
+	// position bytes sit opposite the flag bytes, so these are Data[0] and
+	// Data[1] while ZF0/ZF1 are Data[3] and Data[2] — where lrzsz's sz
+	// reads Rxbuflen from.
 	if s.cfg.WindowSize > 0 {
 		hdr.Data[0] = byte(s.cfg.WindowSize & 0xff)
 		hdr.Data[1] = byte((s.cfg.WindowSize >> 8) & 0xff)
@@ -644,8 +910,37 @@ func (s *Session) sendZRINIT() error {
 	return s.sendHexHeader(hdr)
 }
 
-func closeWriter(w io.WriteCloser) {
-	if w != nil {
-		_ = w.Close()
+// recvBlockLimit is the largest data subpacket the receiver accepts: its own
+// MaxBlockSize, or the whole large-block range once it has advertised it, as
+// the sender then picks the size.
+func (s *Session) recvBlockLimit() int {
+	if s.cfg.LargeBlocks {
+		return maxLargeBlockSize
+	}
+	return s.cfg.MaxBlockSize
+}
+
+// dataSubpacketLimit is the longest data subpacket the receiver accepts: a
+// block with room to spare for a sender that rounds up.
+func (s *Session) dataSubpacketLimit() int {
+	return s.recvBlockLimit() + 256
+}
+
+// closeWriter closes the receive writer and returns the file's outcome: err,
+// the transfer's own error if any, joined with a Close failure. Close is where
+// a buffered or networked writer reports short writes and quota errors, so a
+// file it fails was not stored, however well the transfer went.
+func closeWriter(w io.WriteCloser, err error) error {
+	if w == nil {
+		return err
+	}
+	cerr := w.Close()
+	if cerr == nil {
+		return err
+	}
+	cerr = fmt.Errorf("zmodem: file write error: %w", cerr)
+	if err == nil {
+		return cerr
 	}
+	return errors.Join(err, cerr)
 }
@@ -0,0 +1,444 @@
+package zmodem
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// ==== Replay scripts ====
+//
+// A replay script (testdata/replay/*.replay) plays one peer of a ZMODEM
+// session against a Session, step by step, as written down from a wire
+// capture: the peer's frames byte-exact where their form matters (a quirky
+// hex header), and ours as the frame types and offsets a capture shows. Our
+// bytes are not compared, so a script survives changes in block sizing or
+// escaping that any peer would accept. One step per line; # starts a comment.
+//
+//	config OPTION...                     Session Config: use32, block=N, window=N,
+//	                                     recvtimeout=DUR (default: no timeout),
+//	                                     filewaitidle=DUR; mystic starts from
+//	                                     MysticCompat, so comes first; auto runs
+//	                                     Auto in place of Send or Receive
+//	offer NAME "DATA"                    the Session sends this file
+//	want NAME "DATA"                     file content the receiving end must end up with
+//	< raw "BYTES"                        bytes from the peer (a Go string literal)
+//	< hex TYPE ARG [upper] [cr] [noxon]  a peer hex header; ARG is an offset, or
+//	                                     flags=0xNN for ZF0; upper, cr and noxon
+//	                                     give uppercase digits, a bare CR ending
+//	                                     and no XON after it
+//	< bin TYPE ARG | < bin32 TYPE ARG    a peer binary header
+//	< info NAME SIZE                     a ZFILE subpacket (ZCRCW), NAME as given
+//	< sub END "DATA"                     a data subpacket ended ZCRCG/ZCRCQ/ZCRCW/ZCRCE
+//	> TYPE [OFFSET]                      the next header from the Session; a ZFILE's
+//	                                     subpacket is read with it
+//	>data OFFSET                         a ZDATA frame from the Session, read to its
+//	                                     end and kept as the current file's content
+//	pause DUR                            the peer says nothing for DUR; whatever the
+//	                                     Session sends meanwhile meets the next > step
+//
+// The Session sends if the script offers files and receives otherwise, or
+// with config auto leaves that to Auto; it must return without error.
+
+// replayStep is one line of a replay script.
+type replayStep struct {
+	line int
+	op   string
+	args []string
+}
+
+func parseReplay(t *testing.T, path string) (cfg Config, auto bool, offers []*FileOffer, want map[string]string, steps []replayStep) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cfg.Logger = discardLogger()
+	want = make(map[string]string)
+	sc := bufio.NewScanner(f)
+	for n := 1; sc.Scan(); n++ {
+		args, err := splitReplayLine(sc.Text())
+		if err != nil {
+			t.Fatalf("%s:%d: %v", path, n, err)
+		}
+		if len(args) == 0 {
+			continue
+		}
+		switch op := args[0]; op {
+		case "config":
+			for _, opt := range args[1:] {
+				if opt == "auto" {
+					auto = true
+				} else if !setReplayConfig(&cfg, opt) {
+					t.Fatalf("%s:%d: unknown config %q", path, n, opt)
+				}
+			}
+		case "offer":
+			offers = append(offers, &FileOffer{Name: args[1], Size: int64(len(args[2])),
+				Reader: strings.NewReader(args[2])})
+		case "want":
+			want[args[1]] = args[2]
+		case "<", ">", ">data", "pause":
+			steps = append(steps, replayStep{line: n, op: op, args: args[1:]})
+		default:
+			t.Fatalf("%s:%d: unknown step %q", path, n, op)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return cfg, auto, offers, want, steps
+}
+
+// setReplayConfig applies a config option other than auto to cfg, reporting
+// whether it knew the option.
+func setReplayConfig(cfg *Config, opt string) bool {
+	switch key, val, _ := strings.Cut(opt, "="); key {
+	case "use32":
+		cfg.Use32BitCRC = true
+	case "block":
+		cfg.MaxBlockSize, _ = strconv.Atoi(val)
+	case "window":
+		cfg.WindowSize, _ = strconv.Atoi(val)
+	case "recvtimeout":
+		cfg.RecvTimeout, _ = time.ParseDuration(val)
+	case "filewaitidle":
+		cfg.FileWaitIdle, _ = time.ParseDuration(val)
+	case "mystic":
+		logger := cfg.Logger
+		*cfg = *MysticCompat()
+		cfg.Logger = logger
+	default:
+		return false
+	}
+	return true
+}
+
+// splitReplayLine splits a script line into words, a double-quoted word
+// taken as a Go string literal.
+func splitReplayLine(line string) ([]string, error) {
+	var words []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" || line[0] == '#' {
+			return words, nil
+		}
+		if line[0] == '"' {
+			lit, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, err
+			}
+			s, _ := strconv.Unquote(lit)
+			words = append(words, s)
+			line = line[len(lit):]
+			continue
+		}
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			end = len(line)
+		}
+		words = append(words, line[:end])
+		line = line[end:]
+	}
+}
+
+// replayFrameTypes maps the frame type names a script uses to their codes.
+var replayFrameTypes = func() map[string]byte {
+	m := make(map[string]byte)
+	for t := byte(0); t <= ZSTDERR; t++ {
+		m[frameTypeName(t)] = t
+	}
+	return m
+}()
+
+var replayEnds = map[string]byte{"ZCRCE": ZCRCE, "ZCRCG": ZCRCG, "ZCRCQ": ZCRCQ, "ZCRCW": ZCRCW}
+
+// replayHeader builds the header a script step names: TYPE, then an offset or
+// flags=0xNN for ZF0.
+func replayHeader(args []string) (Header, error) {
+	if len(args) < 2 {
+		return Header{}, fmt.Errorf("want TYPE ARG")
+	}
+	typ, ok := replayFrameTypes[args[0]]
+	if !ok {
+		return Header{}, fmt.Errorf("unknown frame type %q", args[0])
+	}
+	if flags, ok := strings.CutPrefix(args[1], "flags="); ok {
+		f, err := strconv.ParseUint(flags, 0, 8)
+		if err != nil {
+			return Header{}, err
+		}
+		hdr := makeHeader(typ)
+		hdr.SetZF0(byte(f))
+		return hdr, nil
+	}
+	pos, err := strconv.ParseInt(args[1], 10, 64)
+	if err != nil {
+		return Header{}, err
+	}
+	return makePosHeader(typ, pos), nil
+}
+
+// writeQuirkyHexHeader writes hdr as a hex header the way an old
+// implementation might: uppercase digits, a bare CR, no XON.
+func writeQuirkyHexHeader(tw *transportWriter, hdr Header, upper, crOnly, noXON bool) error {
+	payload := []byte{hdr.Type, hdr.Data[0], hdr.Data[1], hdr.Data[2], hdr.Data[3]}
+	crc := crc16Calc(payload)
+	digits := fmt.Sprintf("%x%04x", payload, crc)
+	if upper {
+		digits = strings.ToUpper(digits)
+	}
+	out := append([]byte{ZPAD, ZPAD, ZDLE, ZHEX}, digits...)
+	out = append(out, '\r')
+	if !crOnly {
+		out = append(out, '\n')
+	}
+	if !noXON && hdr.Type != ZACK && hdr.Type != ZFIN {
+		out = append(out, XON)
+	}
+	if err := tw.writeRaw(out); err != nil {
+		return err
+	}
+	return tw.flushFrame()
+}
+
+// replayReader is the Session's end of a bufferedPipe, with read deadlines so
+// a script can exercise the Session's timed waits.
+type replayReader struct {
+	*chanReader
+	deadline time.Time
+}
+
+func (r *replayReader) SetReadDeadline(t time.Time) error {
+	r.deadline = t
+	return nil
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	if len(r.buf) > 0 || r.deadline.IsZero() {
+		return r.chanReader.Read(p)
+	}
+	timer := time.NewTimer(time.Until(r.deadline))
+	defer timer.Stop()
+	select {
+	case data, ok := <-r.ch:
+		if !ok {
+			return 0, io.EOF
+		}
+		n := copy(p, data)
+		r.buf = data[n:]
+		return n, nil
+	case <-timer.C:
+		return 0, os.ErrDeadlineExceeded
+	}
+}
+
+type replayTransport struct {
+	*replayReader
+	io.Writer
+}
+
+func runReplay(t *testing.T, path string) {
+	cfg, auto, offers, want, steps := parseReplay(t, path)
+
+	r1, w1 := bufferedPipe(256) // session -> peer
+	r2, w2 := bufferedPipe(256) // peer -> session
+	handler := newTestHandler()
+	handler.filesToSend = offers
+	session := NewSession(&replayTransport{&replayReader{chanReader: r2}, w1}, handler, &cfg)
+	peer := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(),
+		&Config{MaxBlockSize: 8192, Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var runErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer w1.Close()
+		if auto {
+			runErr = session.Auto(ctx)
+		} else if len(offers) > 0 {
+			runErr = session.Send(ctx)
+		} else {
+			runErr = session.Receive(ctx)
+		}
+	}()
+
+	peerGot := make(map[string][]byte) // what the peer received, per file
+	var curName string
+	for _, st := range steps {
+		where := fmt.Sprintf("%s:%d", filepath.Base(path), st.line)
+		if err := replayStepRun(t, peer, st, peerGot, &curName); err != nil {
+			t.Fatalf("%s: %v", where, err)
+		}
+	}
+	<-done
+	w2.Close()
+	if runErr != nil {
+		t.Fatalf("session: %v", runErr)
+	}
+
+	for name, content := range want {
+		var got []byte
+		if len(offers) > 0 {
+			got = peerGot[name]
+		} else if b := handler.receivedFiles[name]; b != nil {
+			got = b.Bytes()
+		}
+		if string(got) != content {
+			t.Errorf("%s: got %q, want %q", name, got, content)
+		}
+	}
+}
+
+func replayStepRun(t *testing.T, peer *Session, st replayStep, peerGot map[string][]byte, curName *string) error {
+	t.Helper()
+	args := st.args
+	switch st.op {
+	case "<":
+		if len(args) == 0 {
+			return fmt.Errorf("empty < step")
+		}
+		switch kind := args[0]; kind {
+		case "raw":
+			if err := peer.tw.writeRaw([]byte(args[1])); err != nil {
+				return err
+			}
+			return peer.tw.flushFrame()
+		case "hex":
+			hdr, err := replayHeader(args[1:])
+			if err != nil {
+				return err
+			}
+			var upper, cr, noxon bool
+			for _, m := range args[3:] {
+				switch m {
+				case "upper":
+					upper = true
+				case "cr":
+					cr = true
+				case "noxon":
+					noxon = true
+				default:
+					return fmt.Errorf("unknown hex modifier %q", m)
+				}
+			}
+			return writeQuirkyHexHeader(peer.tw, hdr, upper, cr, noxon)
+		case "bin", "bin32":
+			hdr, err := replayHeader(args[1:])
+			if err != nil {
+				return err
+			}
+			peer.useCRC32 = kind == "bin32"
+			return peer.sendBinHeader(hdr)
+		case "info":
+			size, err := strconv.ParseInt(args[2], 10, 64)
+			if err != nil {
+				return err
+			}
+			// The name goes out as written: marshalFileInfo would lowercase it.
+			return peer.sendSubpacket(fmt.Appendf(nil, "%s\x00%d\x00", args[1], size), ZCRCW)
+		case "sub":
+			end, ok := replayEnds[args[1]]
+			if !ok {
+				return fmt.Errorf("unknown subpacket end %q", args[1])
+			}
+			return peer.sendSubpacket([]byte(args[2]), end)
+		default:
+			return fmt.Errorf("unknown < step %q", kind)
+		}
+
+	case ">":
+		typ, ok := replayFrameTypes[args[0]]
+		if !ok {
+			return fmt.Errorf("unknown frame type %q", args[0])
+		}
+		hdr, err := peer.recvHeader()
+		if err != nil {
+			return fmt.Errorf("want %s: %w", args[0], err)
+		}
+		if hdr.Type != typ {
+			return fmt.Errorf("got %s, want %s", frameTypeName(hdr.Type), args[0])
+		}
+		if len(args) > 1 {
+			if pos, _ := strconv.ParseInt(args[1], 10, 64); hdr.Position() != pos {
+				return fmt.Errorf("%s at %d, want %d", args[0], hdr.Position(), pos)
+			}
+		}
+		if typ == ZFILE {
+			data, _, err := peer.recvSubpacket(2048)
+			if err != nil {
+				return fmt.Errorf("ZFILE subpacket: %w", err)
+			}
+			info, err := parseFileInfo(data)
+			if err != nil {
+				return err
+			}
+			*curName = info.Name
+		}
+
+	case ">data":
+		pos, err := strconv.ParseInt(args[0], 10, 64)
+		if err != nil {
+			return err
+		}
+		hdr, err := peer.recvHeader()
+		if err != nil {
+			return fmt.Errorf("want ZDATA: %w", err)
+		}
+		if hdr.Type != ZDATA || hdr.Position() != pos {
+			return fmt.Errorf("got %s at %d, want ZDATA at %d", frameTypeName(hdr.Type), hdr.Position(), pos)
+		}
+		got := peerGot[*curName]
+		if int64(len(got)) < pos {
+			return fmt.Errorf("ZDATA at %d past the %d bytes received", pos, len(got))
+		}
+		got = got[:pos]
+		for {
+			data, end, err := peer.recvSubpacket(peer.cfg.MaxBlockSize + 256)
+			if err != nil {
+				return fmt.Errorf("data subpacket: %w", err)
+			}
+			got = append(got, data...)
+			if end == ZCRCE || end == ZCRCW {
+				break
+			}
+		}
+		peerGot[*curName] = bytes.Clone(got)
+
+	case "pause":
+		d, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		time.Sleep(d)
+	}
+	return nil
+}
+
+// TestReplayScripts runs every script in testdata/replay.
+func TestReplayScripts(t *testing.T) {
+	paths, err := filepath.Glob(filepath.Join("testdata", "replay", "*.replay"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no replay scripts")
+	}
+	for _, path := range paths {
+		t.Run(strings.TrimSuffix(filepath.Base(path), ".replay"), func(t *testing.T) {
+			runReplay(t, path)
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package zmodem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// TransferResult is how one file of a session went: what FileCompleted was
+// told, with the rest of what the session knows about the file.
+type TransferResult struct {
+	Info FileInfo
+	// Bytes is the offset the file ended at: its size when it went whole,
+	// where it stopped when it did not.
+	Bytes int64
+	// StartOffset is where the transfer began, past zero for a resumed file.
+	StartOffset int64
+	// Duration is from the file's offer to its end.
+	Duration time.Duration
+	// Err is nil for a file moved whole. A skipped file's wraps ErrSkip,
+	// whichever end skipped it; see Skipped.
+	Err error
+	// Path is the name of the writer the receiving handler's AcceptFile
+	// returned, when it has a Name method as an *os.File does: where the
+	// file was stored. It is empty for a sent file.
+	Path string
+}
+
+// Skipped reports whether either end skipped the file.
+func (r TransferResult) Skipped() bool { return errors.Is(r.Err, ErrSkip) }
+
+// SendResult is Send, returning a TransferResult for each file it finished,
+// in order, as well as Send's error. There is one for each FileCompleted
+// call: a file that error cut short has one, unless Abort or the context
+// stopped it, as they leave it to the handler.
+func (s *Session) SendResult(ctx context.Context) ([]TransferResult, error) {
+	return s.runResult(ctx, roleSend, s.runSender)
+}
+
+// ReceiveResult is Receive, returning a TransferResult for each file offered,
+// in order, as well as Receive's error.
+func (s *Session) ReceiveResult(ctx context.Context) ([]TransferResult, error) {
+	return s.runResult(ctx, roleReceive, s.runReceiver)
+}
+
+// AutoResult is Auto, returning a TransferResult for each file sent or
+// received, in order, as well as Auto's error.
+func (s *Session) AutoResult(ctx context.Context) ([]TransferResult, error) {
+	return s.runResult(ctx, roleAuto, s.runAuto)
+}
+
+// runResult runs a state machine as run does, collecting the files it
+// completes.
+func (s *Session) runResult(ctx context.Context, role string, machine func(context.Context) error) ([]TransferResult, error) {
+	var results []TransferResult
+	err := s.run(ctx, role, func(ctx context.Context) error {
+		s.results = &results
+		defer func() { s.results = nil }()
+		return machine(ctx)
+	})
+	return results, err
+}
+
+// beginFile starts the per-file accounting for a file now being offered or
+// accepted: its clock, start offset, error count and flow-control pauses, and
+// its logger. The offer goes to the session's events.
+func (s *Session) beginFile(info FileInfo) {
+	s.logFile(info)
+	s.fileInfo = info
+	s.summary.FilesAttempted++
+	s.fileBegan = time.Now()
+	s.fileStart = 0
+	s.filePath = ""
+	s.fileErrors = 0
+	s.blockLen = 0
+	if s.flow != nil {
+		s.fileXoffs = s.flow.pauses.Load()
+	}
+	s.emitOffered(info)
+}
+
+// completeFile ends a file: it is counted in the run's summary, logged to
+// Config.DSZLog, if set, and reported to Config.Collector, the
+// TransferResults being collected, the session's events, fileDone and the
+// handler's FileCompleted.
+func (s *Session) completeFile(info FileInfo, n int64, err error) {
+	defer s.endLogFile()
+	s.summary.fileEnded(err)
+	elapsed := time.Since(s.fileBegan)
+	s.logDSZ(info, n, err, elapsed)
+	if s.cfg.Collector != nil {
+		s.cfg.Collector.FileCompleted(info, s.fileMoved(n, err), err)
+	}
+	es := s.events.Load()
+	if s.results != nil || es != nil {
+		r := TransferResult{
+			Info:        info,
+			Bytes:       n,
+			StartOffset: s.fileStart,
+			Duration:    elapsed,
+			Err:         err,
+			Path:        s.filePath,
+		}
+		if s.results != nil {
+			*s.results = append(*s.results, r)
+		}
+		if es != nil {
+			s.emit(es, FileCompletedEvent{Result: r})
+		}
+	}
+	if s.fileDone != nil {
+		s.fileDone(info, n, err)
+	}
+	s.handler.FileCompleted(info, n, err)
+}
+
+// fileMoved returns the bytes of a file that ended at n with err moved in
+// this session: none for a skipped file.
+func (s *Session) fileMoved(n int64, err error) int64 {
+	if errors.Is(err, ErrSkip) {
+		return 0
+	}
+	return max(n-s.fileStart, 0)
+}
+
+// writerPath returns the name of a file's writer, if it has one.
+func writerPath(w io.Writer) string {
+	if n, ok := w.(interface{ Name() string }); ok {
+		return n.Name()
+	}
+	return ""
+}
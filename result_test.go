@@ -0,0 +1,121 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// dirHandler receives files into dir, resuming each at offset.
+type dirHandler struct {
+	*testFileHandler
+	dir    string
+	offset int64
+}
+
+func (h *dirHandler) AcceptFile(info FileInfo) (io.WriteCloser, int64, error) {
+	f, err := os.OpenFile(filepath.Join(h.dir, info.Name), os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, err := f.Seek(h.offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, h.offset, nil
+}
+
+// TestTransferResultResumedToFile: a file resumed into an *os.File has its
+// start offset at both ends, and the path it was stored at on the receiver.
+func TestTransferResultResumedToFile(t *testing.T) {
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+	content := randomContent(6000)
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "resume.bin"), content[:2048], 0o644); err != nil {
+		t.Fatal(err)
+	}
+	senderHandler := newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{{Name: "resume.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	sender := NewSession(senderT, senderHandler, &Config{Logger: discardLogger()})
+	receiver := NewSession(receiverT, &dirHandler{testFileHandler: newTestHandler(), dir: dir, offset: 2048}, &Config{Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sent, received []TransferResult
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer senderClose(); sent, sendErr = sender.SendResult(ctx) }()
+	go func() { defer wg.Done(); defer receiverClose(); received, recvErr = receiver.ReceiveResult(ctx) }()
+	wg.Wait()
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+
+	path := filepath.Join(dir, "resume.bin")
+	for _, side := range []struct {
+		name     string
+		results  []TransferResult
+		wantPath string
+	}{{"sender", sent, ""}, {"receiver", received, path}} {
+		if len(side.results) != 1 {
+			t.Fatalf("%s results %+v, want one file", side.name, side.results)
+		}
+		r := side.results[0]
+		if r.Err != nil || r.Bytes != int64(len(content)) || r.StartOffset != 2048 || r.Path != side.wantPath || r.Duration <= 0 {
+			t.Errorf("%s result %+v, want resume.bin whole from 2048, path %q", side.name, r, side.wantPath)
+		}
+	}
+	if got, err := os.ReadFile(path); err != nil || !bytes.Equal(got, content) {
+		t.Errorf("stored file: %d bytes (%v), want the %d sent", len(got), err, len(content))
+	}
+}
+
+// TestTransferResultFailed: a file whose writer fails has a result with the
+// error, and the results are collected only during the run.
+func TestTransferResultFailed(t *testing.T) {
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+	content := randomContent(64 << 10)
+	senderHandler := newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{{Name: "fail.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	sender := NewSession(senderT, senderHandler, &Config{Logger: discardLogger()})
+	receiver := NewSession(receiverT, failingHandler{newTestHandler()}, &Config{Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sent, received []TransferResult
+	wg.Add(2)
+	go func() { defer wg.Done(); defer senderClose(); sent, _ = sender.SendResult(ctx) }()
+	go func() { defer wg.Done(); defer receiverClose(); received, _ = receiver.ReceiveResult(ctx) }()
+	wg.Wait()
+	for _, side := range []struct {
+		name    string
+		results []TransferResult
+	}{{"sender", sent}, {"receiver", received}} {
+		if len(side.results) != 1 || side.results[0].Err == nil || side.results[0].Skipped() || side.results[0].Bytes >= int64(len(content)) {
+			t.Errorf("%s results %+v, want fail.bin failed part way", side.name, side.results)
+		}
+	}
+	if receiver.results != nil || sender.results != nil {
+		t.Error("results still collected after the run")
+	}
+}
+
+// failingHandler accepts files into a writer that fails.
+type failingHandler struct{ *testFileHandler }
+
+func (failingHandler) AcceptFile(FileInfo) (io.WriteCloser, int64, error) {
+	return failingWriter{}, 0, nil
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
+func (failingWriter) Close() error              { return nil }
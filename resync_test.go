@@ -2,9 +2,12 @@ package zmodem
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"log/slog"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -133,3 +136,175 @@ func TestDefaultRecvTimeout(t *testing.T) {
 		t.Fatalf("explicit RecvTimeout:0 = %v, want 0 (disabled)", s2.cfg.RecvTimeout)
 	}
 }
+
+// TestRecoverDataKeepsBufferedFrameStart: after a CRC error the stale
+// subpackets behind the bad one are skipped only up to the next frame start,
+// so a header already buffered behind them — here the sender's resync ZDATA,
+// followed by the rest of the file and its ZEOF — survives the recovery. A
+// blanket purge threw it away with the stale bytes and left the receiver
+// waiting on a sender that had nothing more to say.
+func TestRecoverDataKeepsBufferedFrameStart(t *testing.T) {
+	r1, w1 := bufferedPipe(256) // peer -> receiver
+	r2, w2 := bufferedPipe(256) // receiver -> peer
+	receiverT := &pipeReadWriter{Reader: r1, Writer: w2}
+	peerT := &pipeReadWriter{Reader: r2, Writer: w1}
+
+	recvHandler := newTestHandler()
+	receiver := NewSession(receiverT, recvHandler, &Config{MaxBlockSize: 1024, Logger: discardLogger()})
+	peer := NewSession(peerT, newTestHandler(), &Config{MaxBlockSize: 1024, Logger: discardLogger()})
+
+	const sub = 200
+	content := bytes.Repeat([]byte("abcdefghij"), 3*sub/10)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	go func() { <-ctx.Done(); w1.Close() }() // unblocks a receiver left waiting
+	var recvErr error
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer w2.Close()
+		recvErr = receiver.Receive(ctx)
+	}()
+
+	mustRecvType(t, peer, ZRINIT, "initial ZRINIT")
+	fh := makeHeader(ZFILE)
+	fh.SetZF0(ZCBIN)
+	if err := peer.sendBinHeader(fh); err != nil {
+		t.Fatalf("send ZFILE: %v", err)
+	}
+	if err := peer.sendSubpacket(marshalFileInfo(&FileOffer{Name: "resync.bin", Size: int64(len(content))}, 0, 0), ZCRCW); err != nil {
+		t.Fatalf("send ZFILE metadata: %v", err)
+	}
+	mustRecvType(t, peer, ZRPOS, "ZRPOS after ZFILE")
+
+	// One burst, so it is all buffered when the bad subpacket is found:
+	// ZDATA(0) A B* C, then ZDATA(len A) B C ZEOF.
+	var burst bytes.Buffer
+	fw := NewFrameWriter(&burst, EscapeStandard)
+	a, b, c := content[:sub], content[sub:2*sub], content[2*sub:]
+	fw.WriteBinHeader(makePosHeader(ZDATA, 0), false)
+	fw.WriteSubpacket(a, ZCRCG, false)
+	bad := burst.Len() + sub/2
+	fw.WriteSubpacket(b, ZCRCG, false)
+	fw.WriteSubpacket(c, ZCRCE, false)
+	fw.WriteBinHeader(makePosHeader(ZDATA, sub), false)
+	fw.WriteSubpacket(b, ZCRCG, false)
+	fw.WriteSubpacket(c, ZCRCE, false)
+	fw.WriteHexHeader(makePosHeader(ZEOF, int64(len(content))))
+	burst.Bytes()[bad] ^= 0x01
+	if _, err := w1.Write(burst.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+
+	if zr := mustRecvType(t, peer, ZRPOS, "ZRPOS after the CRC error"); zr.Position() != sub {
+		t.Fatalf("ZRPOS pos=%d, want %d", zr.Position(), sub)
+	}
+	mustRecvType(t, peer, ZRINIT, "ZRINIT after ZEOF")
+	if err := peer.sendHexHeader(makeHeader(ZFIN)); err != nil {
+		t.Fatalf("send ZFIN: %v", err)
+	}
+	mustRecvType(t, peer, ZFIN, "receiver ZFIN")
+	_ = peer.tw.writeRaw([]byte("OO"))
+	_ = peer.tw.Flush()
+	<-done
+
+	if recvErr != nil {
+		t.Fatalf("receiver returned error: %v", recvErr)
+	}
+	if got := recvHandler.receivedFiles["resync.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("resync.bin not received intact")
+	}
+}
+
+func TestSkipToFrameStart(t *testing.T) {
+	var hdr bytes.Buffer
+	NewFrameWriter(&hdr, EscapeStandard).WriteHexHeader(makePosHeader(ZRPOS, 1024))
+	zrpos := hdr.String()
+	for _, tc := range []struct {
+		name  string
+		in    string
+		found bool
+		left  string // unread after the skip
+	}{
+		{"bin header", "stale*x\x18X*\x18Cdata", true, "*\x18Cdata"},
+		{"hex header", "stale**\x18B01", true, "**\x18B01"},
+		{"third pad", "***\x18B01", true, "**\x18B01"},
+		{"escaped data only", "ab*\x18Xcd", false, ""},
+		{"trailing pad kept", "abc**\x18", false, "**\x18"},
+		{"header CRC checked", "*\x18Aabcdefg" + zrpos, true, zrpos},
+		{"hex CRC checked", "**\x18B01000000000000\r\n" + zrpos, true, zrpos},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tr := newTransportReader(strings.NewReader(tc.in), 1200, 0, true, discardLogger())
+			tr.r.Peek(1) // buffer the input
+			if got, err := tr.skipToFrameStart(); got != tc.found || err != nil {
+				t.Fatalf("skipToFrameStart = %v, %v; want %v", got, err, tc.found)
+			}
+			left, _ := io.ReadAll(tr.r)
+			if string(left) != tc.left {
+				t.Fatalf("left %q, want %q", left, tc.left)
+			}
+		})
+	}
+}
+
+// TestFalseFrameStartsCostNoRoundTrips sends content dense in '*' 0x01 pairs,
+// which EscapeAll puts on the wire as '*' ZDLE 'A' — a frame start to a plain
+// pattern match. Skipping to one after a CRC error resumed decoding inside the
+// stale subpackets and cost a further ZRPOS per false start; with the header
+// CRC checked the recovery needs no more round trips than for content without
+// them.
+func TestFalseFrameStartsCostNoRoundTrips(t *testing.T) {
+	transfer := func(content []byte) int {
+		r1, w1 := bufferedPipe(256)
+		r2, w2 := bufferedPipe(256)
+		sh := newTestHandler()
+		sh.filesToSend = []*FileOffer{{Name: "stars.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+		rh := newTestHandler()
+
+		senderT := &pipeReadWriter{Reader: r2, Writer: &corruptingWriter{w: w1, targetCount: 16, every: 16}}
+		answers := &zrposCounter{Writer: w2}
+		receiverT := &pipeReadWriter{Reader: r1, Writer: answers}
+
+		cfg := Config{EscapeMode: EscapeAll, Logger: discardLogger()}
+		sender := NewSession(senderT, sh, &cfg)
+		receiver := NewSession(receiverT, rh, &cfg)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+		defer cancel()
+		var wg sync.WaitGroup
+		var sendErr, recvErr error
+		wg.Add(2)
+		go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+		go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+		wg.Wait()
+
+		if sendErr != nil || recvErr != nil {
+			t.Fatalf("send=%v recv=%v", sendErr, recvErr)
+		}
+		rh.mu.Lock()
+		defer rh.mu.Unlock()
+		if got := rh.receivedFiles["stars.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+			t.Fatal("content mismatch")
+		}
+		return answers.n
+	}
+
+	plain := randomContent(256 << 10)
+	for i := range plain {
+		if plain[i] == ZPAD {
+			plain[i] = 'x'
+		}
+	}
+	stars := bytes.Clone(plain)
+	for i := 0; i+1 < len(stars); i += 61 {
+		stars[i], stars[i+1] = ZPAD, 0x01
+	}
+
+	plainZRPOS, starsZRPOS := transfer(plain), transfer(stars)
+	t.Logf("ZRPOS: %d without false frame starts, %d with one every 61 bytes", plainZRPOS, starsZRPOS)
+	if starsZRPOS > plainZRPOS {
+		t.Errorf("false frame starts cost %d ZRPOS against %d without, want no more", starsZRPOS, plainZRPOS)
+	}
+}
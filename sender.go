@@ -5,6 +5,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"time"
 )
 
 // testKittenStreamRecovery, when true, keeps the sender streaming after a ZRPOS
@@ -33,8 +34,19 @@ const (
 // bforce's ZRXSKIPFIN ("Don't believe first ZFIN on outgoing calls").
 const maxSkipFin = 2
 
+// maxFinResends bounds how many times the sender re-sends ZFIN to a receiver
+// that answers it with something other than ZFIN before giving up with
+// ErrCloseIncomplete.
+const maxFinResends = 3
+
+// reversePoll is how often a full-duplex streaming sender pulls in the reverse
+// channel between checkpoints, so a receiver's ZRPOS is heard when it arrives
+// rather than at the next checkpoint, with the rest of the span sent for
+// nothing. Each poll can wait pollWait, so this keeps the cost near 1%.
+const reversePoll = 10 * time.Millisecond
+
 // runSender implements the sender state machine.
-func (s *Session) runSender(ctx context.Context) error {
+func (s *Session) runSender(ctx context.Context) (err error) {
 	state := stxInit
 	var (
 		curOffer     *FileOffer
@@ -50,15 +62,46 @@ func (s *Session) runSender(ctx context.Context) error {
 		zcrcwRetries int
 		filesLeft    int
 		bytesLeft    int64
-		autoDLSent   bool // AutoDownloadString (rz\r) emitted once, not per ZRQINIT
-		skipFin      int  // tolerated turnaround ZFINs (see maxSkipFin)
+		autoDLSent   bool      // AutoDownloadString (rz\r) emitted once, not per ZRQINIT
+		announce     = true    // stxInit sends ZRQINIT; off to wait on after its echo
+		echoGrace    time.Time // until then, echo before the first ZRINIT is free (see recvInitHeader)
+		skipFin      int       // tolerated turnaround ZFINs (see maxSkipFin)
+		finResends   int       // ZFINs re-sent for unexpected answers (see maxFinResends)
+		sentHigh     int64     // highest file offset sent; data below it is a retransmit
+		// lastAckOffset is the receiver's acknowledged position, what its
+		// window (ZRINIT ZP0/ZP1) counts from. It outlives each ZDATA frame:
+		// a ZCRCW restart keeps what its ZACK said, a ZRPOS resets it.
+		lastAckOffset int64
+		inFlight      bool // curOffer was offered and FileCompleted not yet called
 	)
 
+	// Any error ends the session with the file being sent incomplete: a dead
+	// transport, a failed seek, a cancelled context, a protocol violation.
+	// Every exit that reports the file itself clears inFlight first.
+	defer func() {
+		if err != nil && inFlight {
+			s.completeFile(curInfo, bytesSent, err)
+		}
+	}()
+
+	// CRC-32 only once this receiver's ZRINIT offers it: a Receive on the
+	// same Session may have left it on, and a receiver without CANFC32 (old
+	// rz builds, embedded ones) NAKs every ZBIN32 frame.
+	s.zrinitSeen = false
+	s.useCRC32 = false
 	blockSize = 256
 	goodNeeded = 8
+	// One data buffer for the session: every ZDATA frame (re)started by a
+	// ZCRCW or ZRPOS reads into it, sliced to the current block size, which
+	// never exceeds MaxBlockSize. Only file data passes through it; headers
+	// read off the reverse channel land in the transport reader's own buffer.
+	buf := make([]byte, s.cfg.MaxBlockSize)
 
 	for state != stxDone {
-		if err := ctx.Err(); err != nil {
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		if err := s.tw.err(); err != nil {
 			return err
 		}
 
@@ -67,19 +110,27 @@ func (s *Session) runSender(ctx context.Context) error {
 			// Send the auto-download trigger (rz\r) exactly once. Re-entering
 			// stxInit to tolerate a turnaround ZFIN (see the ZFIN arm below)
 			// must re-send only the ZRQINIT header, not the rz\r preamble.
-			if !autoDLSent {
+			// Auto has read the receiver's ZRINIT already, and nothing is
+			// sent to ask for it.
+			if !autoDLSent && s.pending == nil {
 				if err := s.tw.writeRaw(AutoDownloadString); err != nil {
 					return err
 				}
 				autoDLSent = true
 			}
-			hdr := makeHeader(ZRQINIT)
-			if err := s.sendHexHeader(hdr); err != nil {
-				return err
+			if s.pending == nil && announce {
+				hdr := makeHeader(ZRQINIT)
+				if err := s.sendHexHeader(hdr); err != nil {
+					return err
+				}
+			}
+			announce = true
+			if echoGrace.IsZero() && s.cfg.RecvTimeout > 0 {
+				echoGrace = time.Now().Add(time.Duration(s.cfg.MaxRetries) * s.cfg.RecvTimeout)
 			}
 
 			// Wait for ZRINIT
-			rxHdr, err := s.recvHeaderRetry(ctx, &retries)
+			rxHdr, err := s.recvInitHeader(ctx, &retries, echoGrace)
 			if err != nil {
 				return err
 			}
@@ -87,7 +138,10 @@ func (s *Session) runSender(ctx context.Context) error {
 			switch rxHdr.Type {
 			case ZRINIT:
 				s.processZRINIT(rxHdr)
-				if len(s.cfg.AttnSequence) > 0 {
+				// ZSINIT carries the attention string, and tells a receiver
+				// that did not ask for it that we escape control characters,
+				// so it escapes its own answers too (as sz -e does).
+				if len(s.cfg.AttnSequence) > 0 || (s.cfg.EscapeMode == EscapeAll && !s.remoteEscAll) {
 					state = stxSInit
 				} else {
 					state = stxNextFile
@@ -99,6 +153,19 @@ func (s *Session) runSender(ctx context.Context) error {
 					return err
 				}
 				// Stay in stxInit to wait for ZRINIT
+			case ZNAK:
+				// The receiver got our ZRQINIT garbled. Loop back into
+				// stxInit to send it again, against the retry budget.
+				retries++
+			case ZRQINIT:
+				// Our own ZRQINIT, echoed by the terminal along with rz\r
+				// (see recvInitHeader): no answer. Wait on without sending
+				// it again, which would only be echoed in turn; like the
+				// rest of the echo it is free until echoGrace.
+				if !time.Now().Before(echoGrace) {
+					retries++
+				}
+				announce = false
 			case ZFIN:
 				// Tolerate a spurious turnaround ZFIN. In a WaZOO session
 				// turnaround the answerer runs a complete receive batch and
@@ -124,7 +191,7 @@ func (s *Session) runSender(ctx context.Context) error {
 			}
 
 		case stxSInit:
-			// Send ZSINIT with attention sequence
+			// Send ZSINIT with attention sequence and escape flag
 			hdr := makeHeader(ZSINIT)
 			if s.cfg.EscapeMode == EscapeAll {
 				hdr.SetZF0(TESCCTL)
@@ -149,8 +216,15 @@ func (s *Session) runSender(ctx context.Context) error {
 			}
 			s.tw.setEscapeMode(oldMode)
 
-			// Wait for ZACK
+			// Wait for ZACK. A ZRINIT first is the receiver's answer to our
+			// ZRQINIT, sent after the ZRINIT it opened with and overtaken by
+			// the ZSINIT; resending ZSINIT for it would earn a second ZACK
+			// that arrives in place of the ZFILE's answer.
 			rxHdr, err := s.recvHeaderRetry(ctx, &retries)
+			for err == nil && rxHdr.Type == ZRINIT && retries < s.cfg.MaxRetries {
+				retries++
+				rxHdr, err = s.recvHeaderRetry(ctx, &retries)
+			}
 			if err != nil {
 				return err
 			}
@@ -159,7 +233,8 @@ func (s *Session) runSender(ctx context.Context) error {
 				state = stxNextFile
 			case ZNAK:
 				retries++
-				// Retry ZSINIT (stay in stxSInit)
+				// Retry ZSINIT: staying in stxSInit resends the header and
+				// its attention-string subpacket both.
 			default:
 				return fmt.Errorf("zmodem: sender expected ZACK for ZSINIT, got %s", frameTypeName(rxHdr.Type))
 			}
@@ -175,9 +250,13 @@ func (s *Session) runSender(ctx context.Context) error {
 				Size:    curOffer.Size,
 				ModTime: curOffer.ModTime,
 				Mode:    curOffer.Mode,
+				Text:    s.cfg.TextMode,
 			}
+			inFlight = true
 			fileOffset = 0
 			bytesSent = 0
+			sentHigh = 0
+			s.beginFile(curInfo)
 			retries = 0
 			goodBlocks = 0
 			zcrcwNext = false
@@ -187,6 +266,9 @@ func (s *Session) runSender(ctx context.Context) error {
 		case stxFileInfo:
 			hdr := makeHeader(ZFILE)
 			hdr.SetZF0(ZCBIN) // binary transfer
+			if curInfo.Text {
+				hdr.SetZF0(ZCNL) // the receiver converts line ends
+			}
 
 			if err := s.sendBinHeader(hdr); err != nil {
 				return err
@@ -214,25 +296,29 @@ func (s *Session) runSender(ctx context.Context) error {
 				}
 				if fileOffset > 0 {
 					if err := s.seekFile(curOffer, fileOffset); err != nil {
-						s.logger.Warn("cannot seek for resume, skipping", "file", curOffer.Name, "err", err)
+						s.logger.Warn("cannot seek for resume, skipping", "err", err)
 						skipHdr := makeHeader(ZSKIP)
 						if err := s.sendHexHeader(skipHdr); err != nil {
 							return err
 						}
-						s.handler.FileCompleted(curInfo, 0, errors.New("cannot resume: reader not seekable"))
+						s.completeFile(curInfo, 0, errors.New("cannot resume: reader not seekable"))
+						inFlight = false
 						state = stxNextFile
 						continue
 					}
 				}
 				bytesSent = fileOffset
+				lastAckOffset = fileOffset
+				s.startFile(fileOffset)
 				state = stxData
 
 			case ZSKIP:
-				s.handler.FileCompleted(curInfo, 0, ErrSkip)
+				s.completeFile(curInfo, 0, ErrSkip)
+				inFlight = false
 				state = stxNextFile
 
 			case ZCRC:
-				crcVal, err := s.computeFileCRC(curOffer, rxHdr.Position())
+				crcVal, err := s.computeFileCRC(ctx, curOffer, rxHdr.Position())
 				if err != nil {
 					return err
 				}
@@ -263,19 +349,70 @@ func (s *Session) runSender(ctx context.Context) error {
 			}
 
 			// Data transmission loop with reverse channel sampling
-			buf := make([]byte, s.cfg.MaxBlockSize)
-			lastAckOffset := fileOffset
 			var subpacketCount int
-			canFDX := (s.remoteFlags & CANFDX) != 0
-			const zcrcqInterval = 8
+			lastCheckpoint := 0 // subpacketCount at the last ZCRCQ
+			// A ZCRCQ answer would collide with our own transmission on a
+			// half-duplex link, whatever the receiver advertises.
+			canFDX := (s.remoteFlags&CANFDX) != 0 && s.turn == nil
+			s.ckpt.resume()
+			// Within a receiver's window a full-duplex sender slides: it ends
+			// a subpacket with ZCRCQ every quarter window and keeps sending
+			// while the answer is on its way, stopping only when the window is
+			// full. That sustains about 95% of window/RTT, against 92% with a
+			// ZCRCQ every half window (TestSlidingWindow).
+			sliding := s.remoteWindowSize > 0 && canFDX
+			checkpointOffset := fileOffset // end of the last ZCRCQ while sliding
+			sampleOffset := int64(-1)      // ZACK position that ends the pacer's RTT sample; -1 if none
+			var polled time.Time           // last reverse-channel poll between checkpoints
+			// acked moves the window up to a ZACK's position; a stale one
+			// (from before a resync, or overtaken) moves nothing.
+			acked := func(pos int64) {
+				if pos <= lastAckOffset || pos > fileOffset {
+					return
+				}
+				lastAckOffset = pos
+				if sampleOffset >= 0 && pos >= sampleOffset {
+					s.ckpt.answered(blockSize)
+					sampleOffset = -1
+				}
+			}
 
 			sendLoop := false // true means break inner loop
+			// endedByRemote ends the file on a ZSKIP or ZRINIT received
+			// mid-data: the receiver gave up on it (rz does at a ZCRCW when
+			// its user cancels the file), or restarted and wants the next
+			// one. A ZRINIT after every byte counts as the file accepted.
+			endedByRemote := func(hdr Header) {
+				var ferr error
+				if hdr.Type == ZSKIP {
+					ferr = ErrSkippedByRemote
+				} else {
+					s.processZRINIT(hdr)
+					if bytesSent != curOffer.Size {
+						ferr = fmt.Errorf("zmodem: receiver sent ZRINIT mid-file at offset %d", bytesSent)
+					}
+				}
+				s.logger.Info("receiver ended the file during data", "frame", frameTypeName(hdr.Type), "offset", bytesSent)
+				s.completeFile(curInfo, bytesSent, ferr)
+				inFlight = false
+				state = stxNextFile
+				sendLoop = true
+			}
 			for !sendLoop {
-				if err := ctx.Err(); err != nil {
-					return err
+				if ctx.Err() != nil {
+					return context.Cause(ctx)
 				}
 
-				// Check reverse channel (opportunistic, non-blocking)
+				// Check reverse channel (opportunistic, non-blocking). With a
+				// checkpoint unanswered a sliding sender also takes in what has
+				// arrived, so the answer opens the window while it sends; any
+				// full-duplex sender does every reversePoll, to hear a ZRPOS.
+				if sliding && lastAckOffset < checkpointOffset {
+					s.tr.poll()
+				} else if now := time.Now(); canFDX && now.Sub(polled) >= reversePoll {
+					s.tr.poll()
+					polled = now
+				}
 				if s.tr.peekForZPAD() {
 					rxHdr, err := s.recvHeader()
 					if err != nil {
@@ -287,29 +424,37 @@ func (s *Session) runSender(ctx context.Context) error {
 						switch rxHdr.Type {
 						case ZRPOS:
 							newPos := rxHdr.Position()
+							s.errorRecovery(newPos)
 							if err := s.seekFile(curOffer, newPos); err != nil {
 								return err
 							}
 							fileOffset = newPos
+							lastAckOffset = newPos
 							bytesSent = newPos
 							blockSize = max(blockSize/4, 32)
 							goodBlocks = 0
 							unreliable = true
+							s.ckpt.reset()
 							zcrcwNext = !testKittenStreamRecovery
 							zcrcwRetries = 0
 							state = stxData
 							sendLoop = true
 							continue
 						case ZACK:
-							lastAckOffset = rxHdr.Position()
+							acked(rxHdr.Position())
+						case ZSKIP, ZRINIT:
+							endedByRemote(rxHdr)
+							continue
 						default:
 							s.logger.Debug("unexpected reverse channel frame", "type", frameTypeName(rxHdr.Type))
 						}
 					}
 				}
 
-				// Window flow control: block when window is full
-				if s.remoteWindowSize > 0 && (fileOffset-lastAckOffset) >= int64(s.remoteWindowSize) {
+				// Window flow control: block when window is full, unless all
+				// the file's data is out and only its empty ZCRCE is left.
+				if s.remoteWindowSize > 0 && (fileOffset-lastAckOffset) >= int64(s.remoteWindowSize) &&
+					(curOffer.Size <= 0 || fileOffset < curOffer.Size) {
 					// ZCRCQ is only valid when receiver advertises CANFDX (spec).
 					// Without CANFDX, fall back to ZCRCW (force response before next frame).
 					windowEndType := byte(ZCRCQ)
@@ -317,27 +462,40 @@ func (s *Session) runSender(ctx context.Context) error {
 						windowEndType = ZCRCW
 					}
 
-					// Solicit ZACK/ZRPOS with a zero-length subpacket.
-					if err := s.sendSubpacket(nil, windowEndType); err != nil {
-						return err
-					}
+					// Nothing is sent to ask for the ZACK: a sliding sender
+					// has a ZCRCQ out for the window already, and the data
+					// subpacket that fills a non-sliding sender's window ends
+					// with ZCRCW and has had its answer (see below).
 					windowRetries := 0
 					for {
 						rxHdr, err := s.recvHeader()
 						if err != nil {
+							if ctx.Err() != nil {
+								return context.Cause(ctx)
+							}
 							windowRetries++
 							if windowRetries >= s.cfg.MaxRetries {
 								return fmt.Errorf("zmodem: window flow control timeout after %d retries", windowRetries)
 							}
-							// Resend zero-length subpacket.
+							// The ZCRCQ was lost, or its answer was. Ask again
+							// with a zero-length subpacket: its data cannot be
+							// sent again in this frame, where subpackets carry
+							// no offset and the receiver would take it twice.
+							// Only a RecvTimeout of silence comes to this.
 							if err := s.sendSubpacket(nil, windowEndType); err != nil {
 								return err
 							}
+							s.ckpt.resent()
+							checkpointOffset = fileOffset
 							continue
 						}
 						switch rxHdr.Type {
 						case ZACK:
-							lastAckOffset = rxHdr.Position()
+							acked(rxHdr.Position())
+							if sliding {
+								break
+							}
+							s.ckpt.answered(blockSize)
 							if windowEndType == ZCRCW {
 								// ZCRCW ends the current data frame. Restart with a new ZDATA header.
 								state = stxData
@@ -345,18 +503,23 @@ func (s *Session) runSender(ctx context.Context) error {
 							}
 						case ZRPOS:
 							newPos := rxHdr.Position()
+							s.errorRecovery(newPos)
 							if err := s.seekFile(curOffer, newPos); err != nil {
 								return err
 							}
 							fileOffset = newPos
+							lastAckOffset = newPos
 							bytesSent = newPos
 							blockSize = max(blockSize/4, 32)
 							goodBlocks = 0
 							unreliable = true
+							s.ckpt.reset()
 							zcrcwNext = !testKittenStreamRecovery
 							zcrcwRetries = 0
 							state = stxData
 							sendLoop = true
+						case ZSKIP, ZRINIT:
+							endedByRemote(rxHdr)
 						default:
 							s.logger.Debug("unexpected frame in window wait", "type", frameTypeName(rxHdr.Type))
 							if windowEndType == ZCRCW {
@@ -376,8 +539,17 @@ func (s *Session) runSender(ctx context.Context) error {
 					}
 				}
 
-				// Read file data
-				n, readErr := curOffer.Reader.Read(buf[:blockSize])
+				// Read file data. No subpacket takes the unacknowledged data
+				// past the receiver's buffer, so none is larger than it (lrzsz
+				// caps its block length at Rxbuflen too). Without CANFDX a
+				// window is filled exactly, and its last subpacket ends with
+				// ZCRCW.
+				readLen := blockSize
+				windowed := s.remoteWindowSize > 0 && !sliding
+				if s.remoteWindowSize > 0 {
+					readLen = min(readLen, int(int64(s.remoteWindowSize)-(fileOffset-lastAckOffset)))
+				}
+				n, readErr := curOffer.Reader.Read(buf[:readLen])
 				if n > 0 {
 					atEOF := readErr == io.EOF
 
@@ -388,8 +560,21 @@ func (s *Session) runSender(ctx context.Context) error {
 						endType = ZCRCW
 					case atEOF:
 						endType = ZCRCE
-					case canFDX && subpacketCount > 0 && subpacketCount%zcrcqInterval == 0:
+					case windowed && fileOffset+int64(n)-lastAckOffset >= int64(s.remoteWindowSize) &&
+						(curOffer.Size <= 0 || fileOffset+int64(n) < curOffer.Size):
+						// The window is full: this subpacket waits for the ZACK
+						// rather than a zero-length probe after it. The last
+						// one of the file needs none; ZEOF is answered anyway.
+						endType = ZCRCW
+					case sliding:
+						if fileOffset+int64(n)-checkpointOffset >= int64(s.remoteWindowSize/4) {
+							endType = ZCRCQ
+						} else {
+							endType = ZCRCG
+						}
+					case canFDX && subpacketCount-lastCheckpoint >= s.ckpt.interval:
 						endType = ZCRCQ
+						lastCheckpoint = subpacketCount
 					default:
 						endType = ZCRCG
 					}
@@ -397,16 +582,49 @@ func (s *Session) runSender(ctx context.Context) error {
 					if err := s.sendSubpacket(buf[:n], endType); err != nil {
 						return err
 					}
+					s.stats.PayloadWritten += int64(n)
+					if n > 0 {
+						s.blockLen = n
+					}
+					s.ckpt.sentData(n)
+					switch {
+					case sliding && endType == ZCRCQ:
+						checkpointOffset = fileOffset + int64(n)
+						if sampleOffset < 0 {
+							s.ckpt.ask()
+							sampleOffset = checkpointOffset
+						}
+					case endType == ZCRCQ || endType == ZCRCW:
+						s.ckpt.ask()
+					}
+					if fileOffset < sentHigh {
+						s.stats.RetransmitWritten += min(int64(n), sentHigh-fileOffset)
+					}
 					fileOffset += int64(n)
+					sentHigh = max(sentHigh, fileOffset)
 					bytesSent = fileOffset
 					subpacketCount++
 					goodBlocks++
 
+					if s.tw.wire.reconnected {
+						// The transport was replaced mid-frame (Config.ReconnectWait);
+						// open a fresh frame on the new one. The receiver answers
+						// with ZRPOS for whatever the old link lost.
+						s.tw.wire.reconnected = false
+						s.ckpt.reset()
+						state = stxData
+						sendLoop = true
+						continue
+					}
+
 					// If ZCRCW (post-ZRPOS flush), wait for ZACK then restart frame
 					if endType == ZCRCW {
 						for {
 							rxHdr, err := s.recvHeader()
 							if err != nil {
+								if ctx.Err() != nil {
+									return context.Cause(ctx)
+								}
 								if err == errAbortReceived {
 									return err
 								}
@@ -431,20 +649,26 @@ func (s *Session) runSender(ctx context.Context) error {
 									continue
 								}
 								lastAckOffset = ackPos
+								s.ckpt.answered(blockSize)
 								zcrcwNext = false
 								zcrcwRetries = 0
 							case ZRPOS:
 								newPos := rxHdr.Position()
+								s.errorRecovery(newPos)
 								if err := s.seekFile(curOffer, newPos); err != nil {
 									return err
 								}
 								fileOffset = newPos
+								lastAckOffset = newPos
 								bytesSent = newPos
 								blockSize = max(blockSize/4, 32)
 								goodBlocks = 0
 								unreliable = true
+								s.ckpt.reset()
 								zcrcwNext = !testKittenStreamRecovery
 								zcrcwRetries = 0
+							case ZSKIP, ZRINIT:
+								endedByRemote(rxHdr)
 							default:
 								s.logger.Debug("unexpected ZCRCW response", "type", frameTypeName(rxHdr.Type))
 								zcrcwRetries++
@@ -455,45 +679,60 @@ func (s *Session) runSender(ctx context.Context) error {
 							}
 							break
 						}
+						if state == stxNextFile {
+							continue
+						}
 						// ZCRCW ends the frame; restart with fresh ZDATA header
 						state = stxData
 						sendLoop = true
 						continue
 					}
 
-					// If ZCRCQ, read ZACK/ZRPOS response (bounded by RecvTimeout)
-					if endType == ZCRCQ {
+					// If ZCRCQ, read ZACK/ZRPOS response (bounded by RecvTimeout).
+					// A sliding sender takes it from the reverse channel instead.
+					if endType == ZCRCQ && !sliding {
 						zcrcqRetries := 0
 						for {
 							rxHdr, err := s.recvHeader()
 							if err != nil {
+								if ctx.Err() != nil {
+									return context.Cause(ctx)
+								}
 								zcrcqRetries++
 								if zcrcqRetries >= s.cfg.MaxRetries {
 									return fmt.Errorf("zmodem: ZCRCQ response timeout after %d retries", zcrcqRetries)
 								}
-								// Solicit again with zero-length ZCRCQ
+								// Ask again with a zero-length ZCRCQ, for the
+								// reason the window wait above does.
 								if err := s.sendSubpacket(nil, ZCRCQ); err != nil {
 									return err
 								}
+								s.ckpt.resent()
 								continue
 							}
 							switch rxHdr.Type {
 							case ZACK:
-								lastAckOffset = rxHdr.Position()
+								acked(rxHdr.Position())
+								s.ckpt.answered(blockSize)
 							case ZRPOS:
 								newPos := rxHdr.Position()
+								s.errorRecovery(newPos)
 								if err := s.seekFile(curOffer, newPos); err != nil {
 									return err
 								}
 								fileOffset = newPos
+								lastAckOffset = newPos
 								bytesSent = newPos
 								blockSize = max(blockSize/4, 32)
 								goodBlocks = 0
 								unreliable = true
+								s.ckpt.reset()
 								zcrcwNext = !testKittenStreamRecovery
 								zcrcwRetries = 0
 								state = stxData
 								sendLoop = true
+							case ZSKIP, ZRINIT:
+								endedByRemote(rxHdr)
 							default:
 								s.logger.Debug("unexpected ZCRCQ response", "type", frameTypeName(rxHdr.Type))
 							}
@@ -509,16 +748,16 @@ func (s *Session) runSender(ctx context.Context) error {
 					if unreliable {
 						adaptNeeded = 16
 					}
-					if goodBlocks >= adaptNeeded && blockSize < s.cfg.MaxBlockSize {
+					if goodBlocks >= adaptNeeded && blockSize < s.sendBlockLimit {
 						blockSize *= 2
-						if blockSize > s.cfg.MaxBlockSize {
-							blockSize = s.cfg.MaxBlockSize
+						if blockSize > s.sendBlockLimit {
+							blockSize = s.sendBlockLimit
 						}
 						goodBlocks = 0
 					}
 
 					// Progress callback
-					s.handler.FileProgress(curInfo, bytesSent)
+					s.progress(curInfo, bytesSent, sentHigh)
 
 					if atEOF {
 						state = stxEOF
@@ -556,28 +795,43 @@ func (s *Session) runSender(ctx context.Context) error {
 			switch rxHdr.Type {
 			case ZRINIT:
 				// File accepted, move to next
-				s.handler.FileCompleted(curInfo, bytesSent, nil)
+				s.completeFile(curInfo, bytesSent, nil)
+				inFlight = false
 				s.processZRINIT(rxHdr)
 				state = stxNextFile
 			case ZRPOS:
 				newPos := rxHdr.Position()
+				s.errorRecovery(newPos)
 				if err := s.seekFile(curOffer, newPos); err != nil {
 					return err
 				}
 				fileOffset = newPos
+				lastAckOffset = newPos
 				bytesSent = newPos
 				blockSize = max(blockSize/4, 32)
 				goodBlocks = 0
 				unreliable = true
+				s.ckpt.reset()
 				zcrcwNext = !testKittenStreamRecovery
 				zcrcwRetries = 0
 				state = stxData
 			case ZNAK:
 				retries++
 				state = stxEOF
+			case ZACK:
+				// A late answer to an earlier ZCRCQ (e.g. one orphaned by a
+				// resync); lrzsz skips these here too. Keep waiting.
+				s.logger.Debug("stale ZACK after ZEOF, ignoring", "pos", rxHdr.Position())
 			case ZSKIP:
-				s.handler.FileCompleted(curInfo, bytesSent, ErrSkip)
+				s.completeFile(curInfo, bytesSent, ErrSkip)
+				inFlight = false
 				state = stxNextFile
+			case ZFERR:
+				// The receiver could not store the file and is ending the
+				// session (Config.CloseErrorZFERR).
+				s.completeFile(curInfo, bytesSent, ErrRemoteFileError)
+				inFlight = false
+				return ErrRemoteFileError
 			default:
 				return fmt.Errorf("zmodem: sender expected ZRINIT after ZEOF, got %s", frameTypeName(rxHdr.Type))
 			}
@@ -599,19 +853,32 @@ func (s *Session) runSender(ctx context.Context) error {
 
 			switch rxHdr.Type {
 			case ZFIN:
-				// Send "OO" per protocol
-				if err := s.tw.writeRaw([]byte("OO")); err != nil {
-					return err
+				// Send "OO" per protocol. The receiver's ZFIN completes the
+				// session, and a receiver that exits on sending it (closing
+				// an SSH channel or a socket) may be gone before the OO is
+				// written; that is no failure.
+				err := s.tw.writeRaw([]byte("OO"))
+				if err == nil {
+					err = s.tw.flushFrame()
 				}
-				if err := s.tw.Flush(); err != nil {
-					return err
+				if err != nil {
+					s.logger.Debug("OO not delivered", "err", err)
 				}
 				state = stxDone
 			case ZNAK:
 				retries++
 				state = stxFin
 			default:
-				state = stxDone
+				// Not the end of the session: a receiver still answering
+				// something else (a repeated ZRINIT, a retransmitted request)
+				// has not seen ZFIN, and left now it would wait out its whole
+				// retry budget. Ask again, a few times.
+				s.logger.Warn("unexpected frame answering ZFIN", "type", frameTypeName(rxHdr.Type))
+				if finResends >= maxFinResends {
+					return fmt.Errorf("%w: %s answering ZFIN", ErrCloseIncomplete, frameTypeName(rxHdr.Type))
+				}
+				finResends++
+				state = stxFin
 			}
 		}
 
@@ -622,10 +889,46 @@ func (s *Session) runSender(ctx context.Context) error {
 
 // processZRINIT processes receiver's ZRINIT flags.
 func (s *Session) processZRINIT(hdr Header) {
+	// Receiver buffer size (ZP0 = Data[0], ZP1 = Data[1])
+	window := int(hdr.Data[0]) | int(hdr.Data[1])<<8
+
+	// Renegotiation is conservative: a receiver whose later ZRINITs omit the
+	// buffer size or CANFC32 has not changed its mind, it sends a sloppier
+	// frame. CRC-32 and escape-all only ever turn on (below); a window
+	// dropping to 0 is kept.
+	if s.zrinitSeen {
+		if s.cfg.StickyNegotiation {
+			if s.debug() {
+				s.logger.Debug("ignoring later ZRINIT (StickyNegotiation)",
+					"flags", hdr.ZF0(), "window", window)
+			}
+			return
+		}
+		switch {
+		case window == s.remoteWindowSize:
+		case window == 0:
+			s.logger.Warn("later ZRINIT has no window, keeping it", "window", s.remoteWindowSize)
+			window = s.remoteWindowSize
+		default:
+			s.logger.Info("receiver changed its window", "from", s.remoteWindowSize, "to", window)
+		}
+		if dropped := s.remoteFlags &^ hdr.ZF0() & (CANFC32 | ESCCTL); dropped != 0 && s.debug() {
+			s.logger.Debug("later ZRINIT drops flags, keeping CRC and escape modes", "flags", dropped)
+		}
+	}
+	first := !s.zrinitSeen
+	if first {
+		s.logPeer(hdr.ZF0(), window, hdr.ZF1()&canLargeBlocks != 0)
+	}
+	s.zrinitSeen = true
 	s.remoteFlags = hdr.ZF0()
+	s.remoteWindowSize = window
 
-	// Receiver buffer size (ZP0 = Data[0], ZP1 = Data[1])
-	s.remoteWindowSize = int(hdr.Data[0]) | int(hdr.Data[1])<<8
+	// Blocks over 8 KB only for a receiver that said it takes them.
+	s.sendBlockLimit = min(s.cfg.MaxBlockSize, maxBlockSize)
+	if hdr.ZF1()&canLargeBlocks != 0 {
+		s.sendBlockLimit = s.cfg.MaxBlockSize
+	}
 
 	// CRC-32 negotiation
 	if s.cfg.Use32BitCRC && (s.remoteFlags&CANFC32) != 0 {
@@ -637,6 +940,10 @@ func (s *Session) processZRINIT(hdr Header) {
 		s.remoteEscAll = true
 		s.tw.setEscapeMode(EscapeAll)
 	}
+
+	if first {
+		s.emitNegotiated(s.remoteFlags, window, s.useCRC32)
+	}
 }
 
 // recvHeaderRetry receives a header with retry logic.
@@ -645,8 +952,8 @@ func (s *Session) recvHeaderRetry(ctx context.Context, retries *int) (Header, er
 		if *retries >= s.cfg.MaxRetries {
 			return Header{}, fmt.Errorf("zmodem: max retries (%d) exceeded", s.cfg.MaxRetries)
 		}
-		if err := ctx.Err(); err != nil {
-			return Header{}, err
+		if ctx.Err() != nil {
+			return Header{}, context.Cause(ctx)
 		}
 
 		hdr, err := s.recvHeader()
@@ -661,61 +968,50 @@ func (s *Session) recvHeaderRetry(ctx context.Context, retries *int) (Header, er
 	}
 }
 
-// seekFile seeks a FileOffer's reader to the given offset.
-func (s *Session) seekFile(offer *FileOffer, offset int64) error {
-	seeker, ok := offer.Reader.(io.ReadSeeker)
-	if !ok {
-		return fmt.Errorf("reader does not implement io.ReadSeeker")
-	}
-	_, err := seeker.Seek(offset, io.SeekStart)
-	return err
-}
-
-// computeFileCRC computes the CRC-32 of a file up to byteCount bytes.
-// byteCount == 0 means the entire file.
-func (s *Session) computeFileCRC(offer *FileOffer, byteCount int64) (uint32, error) {
-	seeker, ok := offer.Reader.(io.ReadSeeker)
-	if !ok {
-		return 0, fmt.Errorf("reader does not implement io.ReadSeeker for ZCRC")
-	}
-
-	curPos, err := seeker.Seek(0, io.SeekCurrent)
-	if err != nil {
-		return 0, err
-	}
-
-	if _, err := seeker.Seek(0, io.SeekStart); err != nil {
-		return 0, err
-	}
-
-	var crc uint32
-	buf := make([]byte, 8192)
-	var totalRead int64
-
+// recvInitHeader is recvHeaderRetry for the wait for the receiver's first
+// ZRINIT, where a terminal may answer before rz does. Minicom, starting rz on
+// our rz\r, echoes that line back, after whatever the user had typed on it,
+// and rz may start only once our ZRQINIT has gone by. Input that yields no
+// header is skipped without spending a retry until grace (none if zero): the
+// budget is time, not bytes of echo. A timeout spends a retry and announces
+// ZRQINIT again, so a receiver that started late and waits for one still
+// catches the session.
+func (s *Session) recvInitHeader(ctx context.Context, retries *int, grace time.Time) (Header, error) {
 	for {
-		toRead := int64(len(buf))
-		if byteCount > 0 && totalRead+toRead > byteCount {
-			toRead = byteCount - totalRead
+		if *retries >= s.cfg.MaxRetries {
+			return Header{}, fmt.Errorf("zmodem: max retries (%d) exceeded", s.cfg.MaxRetries)
 		}
-		if toRead <= 0 {
-			break
+		if ctx.Err() != nil {
+			return Header{}, context.Cause(ctx)
+		}
+
+		before := s.tr.pos()
+		hdr, err := s.recvHeader()
+		if err == nil {
+			return hdr, nil
 		}
-		n, err := offer.Reader.Read(buf[:toRead])
-		if n > 0 {
-			crc = crc32Update(crc, buf[:n])
-			totalRead += int64(n)
+		if !errors.Is(err, ErrTimeout) && s.tr.pos() > before && time.Now().Before(grace) {
+			s.logger.Debug("skipping input before ZRINIT", "err", err)
+			continue
 		}
-		if err == io.EOF {
-			break
+		*retries++
+		if *retries >= s.cfg.MaxRetries {
+			return Header{}, fmt.Errorf("zmodem: max retries exceeded: %w", err)
 		}
-		if err != nil {
-			return 0, err
+		if errors.Is(err, ErrTimeout) {
+			if err := s.sendHexHeader(makeHeader(ZRQINIT)); err != nil {
+				return Header{}, err
+			}
 		}
 	}
+}
 
-	if _, err := seeker.Seek(curPos, io.SeekStart); err != nil {
-		return 0, err
+// seekFile seeks a FileOffer's reader to the given offset.
+func (s *Session) seekFile(offer *FileOffer, offset int64) error {
+	seeker, ok := offer.Reader.(io.ReadSeeker)
+	if !ok {
+		return fmt.Errorf("reader does not implement io.ReadSeeker")
 	}
-
-	return crc, nil
+	_, err := seeker.Seek(offset, io.SeekStart)
+	return err
 }
@@ -0,0 +1,121 @@
+package zmodem
+
+import (
+	"context"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// BreakSender is an optional transport interface for serial lines that can
+// assert a BREAK. A receiver sends one for each AttnBreak in its attention
+// sequence; on a transport without it the AttnBreak is skipped.
+type BreakSender interface {
+	SendBreak() error
+}
+
+// Drainer is an optional transport interface for serial lines, whose driver
+// queues written bytes for the UART. Drain returns once the queue has been
+// transmitted. A Session drains its transport when Send or Receive returns,
+// so a port closed straight after does not cut off the session's last bytes
+// (the final "OO", or the abort sequence) in the driver.
+type Drainer interface {
+	Drain() error
+}
+
+// ReadTimeoutSetter is an optional transport interface for ports whose read
+// timeout applies to each Read rather than ending at a point in time, as with
+// go.bug.st/serial: after SetReadTimeout(d) a Read returns within d of its
+// start, with 0 and a nil error if nothing arrived; a negative d waits for
+// data indefinitely. A Session reads such a transport, when it has no
+// SetReadDeadline, through an emulation of read deadlines, so RecvTimeout and
+// the other timeouts work as on a net.Conn. The port's read timeout is left
+// as the session last set it; set it again after Send or Receive if it
+// matters.
+type ReadTimeoutSetter interface {
+	SetReadTimeout(time.Duration) error
+}
+
+// readTimeoutSlice is the longest read timeout a timeoutReader gives its
+// port while the session can be cancelled or a deadline is set, and so how
+// long a cancellation or a deadline moved earlier can take to be noticed.
+const readTimeoutSlice = 100 * time.Millisecond
+
+// timeoutReader gives a ReadTimeoutSetter port read deadlines. Each Read of
+// the port waits at most until the deadline, and a Read that comes back empty
+// before it is retried, so the port's per-read timeouts never surface as
+// empty reads. While the session can be cancelled the port is read in slices
+// of readTimeoutSlice, the context checked between them.
+type timeoutReader struct {
+	src io.Reader
+	rts ReadTimeoutSetter
+	cur time.Duration // the port's read timeout as last set; 0 = not yet set
+
+	mu       sync.Mutex // SetReadDeadline may come from another goroutine (pumpReader.stop)
+	deadline time.Time
+}
+
+func newTimeoutReader(r io.Reader, rts ReadTimeoutSetter) *timeoutReader {
+	return &timeoutReader{src: r, rts: rts}
+}
+
+// SetReadDeadline sets the deadline for reads; the zero time means none. A
+// read already waiting sees it within readTimeoutSlice.
+func (r *timeoutReader) SetReadDeadline(t time.Time) error {
+	r.mu.Lock()
+	r.deadline = t
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *timeoutReader) Read(p []byte) (int, error) {
+	return r.readContext(context.Background(), p)
+}
+
+func (r *timeoutReader) readContext(ctx context.Context, p []byte) (int, error) {
+	for {
+		if err := ctx.Err(); err != nil {
+			return 0, err
+		}
+		r.mu.Lock()
+		deadline := r.deadline
+		r.mu.Unlock()
+
+		wait := time.Duration(-1)
+		if !deadline.IsZero() {
+			left := time.Until(deadline)
+			if left <= 0 {
+				return 0, os.ErrDeadlineExceeded
+			}
+			wait = min(left, readTimeoutSlice)
+		} else if ctx.Done() != nil {
+			wait = readTimeoutSlice
+		}
+		if wait != r.cur {
+			if err := r.rts.SetReadTimeout(wait); err != nil {
+				return 0, err
+			}
+			r.cur = wait
+		}
+		n, err := r.src.Read(p)
+		if n > 0 || err != nil {
+			return n, err
+		}
+	}
+}
+
+// drainOutput waits, on a Drainer transport, for the driver to transmit what
+// the session wrote. Send or Receive has its result by then, so a failure is
+// only logged.
+func (s *Session) drainOutput() {
+	s.mu.Lock()
+	d, ok := s.transport.(Drainer)
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	if err := d.Drain(); err != nil {
+		s.logger.Debug("draining transport output", "err", err)
+	}
+}
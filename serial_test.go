@@ -0,0 +1,140 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// perReadPort is a serial port as go.bug.st/serial presents one: no read
+// deadlines, a read timeout applied to each Read (0, nil when it passes),
+// and a Drain that counts its calls.
+type perReadPort struct {
+	in      chan []byte
+	out     *chanWriter
+	buf     []byte
+	timeout time.Duration // negative: none
+	drains  atomic.Int32
+	mu      sync.Mutex
+}
+
+func (p *perReadPort) Read(b []byte) (int, error) {
+	if len(p.buf) > 0 {
+		n := copy(b, p.buf)
+		p.buf = p.buf[n:]
+		return n, nil
+	}
+	p.mu.Lock()
+	timeout := p.timeout
+	p.mu.Unlock()
+	var expired <-chan time.Time
+	if timeout >= 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case data, ok := <-p.in:
+		if !ok {
+			return 0, errors.New("port closed")
+		}
+		n := copy(b, data)
+		p.buf = data[n:]
+		return n, nil
+	case <-expired:
+		return 0, nil
+	}
+}
+
+func (p *perReadPort) Write(b []byte) (int, error) { return p.out.Write(b) }
+
+func (p *perReadPort) SetReadTimeout(d time.Duration) error {
+	p.mu.Lock()
+	p.timeout = d
+	p.mu.Unlock()
+	return nil
+}
+
+func (p *perReadPort) Drain() error {
+	p.drains.Add(1)
+	return nil
+}
+
+// perReadPorts returns two ports joined by a null-modem cable. Neither has
+// a read timeout to begin with.
+func perReadPorts() (a, b *perReadPort) {
+	ab, ba := make(chan []byte, 256), make(chan []byte, 256)
+	a = &perReadPort{in: ba, out: &chanWriter{ch: ab}, timeout: -1}
+	b = &perReadPort{in: ab, out: &chanWriter{ch: ba}, timeout: -1}
+	return a, b
+}
+
+// TestPerReadTimeoutPort: a session over a port with per-read timeouts
+// transfers a file, and drains the port when it ends.
+func TestPerReadTimeoutPort(t *testing.T) {
+	a, b := perReadPorts()
+	content := randomContent(50000)
+	sendHandler := newTestHandler()
+	sendHandler.filesToSend = []*FileOffer{{Name: "port.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	recvHandler := newTestHandler()
+	cfg := &Config{RecvTimeout: 2 * time.Second, Logger: discardLogger()}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		sendErr = NewSession(a, sendHandler, cfg).Send(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		recvErr = NewSession(b, recvHandler, cfg).Receive(ctx)
+	}()
+	wg.Wait()
+
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+	if got := recvHandler.receivedFiles["port.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("port.bin not received intact")
+	}
+	if a.drains.Load() != 1 || b.drains.Load() != 1 {
+		t.Fatalf("drains: sender %d, receiver %d; want 1 each", a.drains.Load(), b.drains.Load())
+	}
+}
+
+// TestPerReadTimeoutPortSilent: RecvTimeout and cancellation both end a wait
+// on a silent port, whose own read timeout starts out as none.
+func TestPerReadTimeoutPortSilent(t *testing.T) {
+	t.Run("RecvTimeout", func(t *testing.T) {
+		p, _ := perReadPorts()
+		s := NewSession(p, newTestHandler(),
+			&Config{RecvTimeout: 50 * time.Millisecond, MaxRetries: 2, Logger: discardLogger()})
+		start := time.Now()
+		if err := s.Receive(context.Background()); !errors.Is(err, ErrTimeout) {
+			t.Fatalf("Receive = %v, want ErrTimeout", err)
+		}
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Fatalf("timed out after %v", elapsed)
+		}
+	})
+	t.Run("cancel", func(t *testing.T) {
+		p, _ := perReadPorts()
+		s := NewSession(p, newTestHandler(), &Config{Logger: discardLogger()})
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		if err := s.Receive(ctx); !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("Receive = %v, want context.DeadlineExceeded", err)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("cancelled after %v", elapsed)
+		}
+	})
+}
@@ -0,0 +1,15 @@
+module github.com/xx25/go-zmodem/serialport
+
+go 1.25.4
+
+require (
+	github.com/xx25/go-zmodem v0.0.0-00010101000000-000000000000
+	go.bug.st/serial v1.6.4
+)
+
+require (
+	github.com/creack/goselect v0.1.2 // indirect
+	golang.org/x/sys v0.19.0 // indirect
+)
+
+replace github.com/xx25/go-zmodem => ../
@@ -0,0 +1,152 @@
+// Package serialport adapts a serial port (go.bug.st/serial) into a transport
+// for zmodem.NewSession.
+//
+// A Port takes everything a Session can use from a serial line: the port's
+// per-read timeout, which the Session turns into the read deadlines its
+// timeouts need (zmodem.ReadTimeoutSetter); a BREAK for each AttnBreak in a
+// receiver's attention sequence (zmodem.BreakSender); and a drain of the
+// UART's transmit queue when the session ends (zmodem.Drainer), so closing
+// the port after Send or Receive does not cut off the final "OO".
+//
+// go.bug.st/serial cannot have the driver do RTS/CTS flow control. With
+// CTSFlow set, Port does the sending half itself: it holds writes while the
+// modem drops CTS, bounded by the write deadline.
+package serialport
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"go.bug.st/serial"
+)
+
+// DefaultBreak is how long SendBreak holds the line in BREAK.
+const DefaultBreak = 250 * time.Millisecond
+
+// ctsPoll is how often a write held by CTS checks it again.
+const ctsPoll = 5 * time.Millisecond
+
+// ctsChunk is the most Port writes to the driver at a time with CTSFlow set,
+// so a modem dropping CTS stops the output within about that many bytes.
+const ctsChunk = 64
+
+// Port is a serial port as a Session transport. Create it with New or Open.
+type Port struct {
+	port serial.Port
+
+	// BreakDuration is how long SendBreak holds the line in BREAK; 0 means
+	// DefaultBreak.
+	BreakDuration time.Duration
+
+	// CTSFlow holds writes while CTS is low, for a modem that uses it to
+	// pause the output. Leave it off on a three-wire line, where CTS floats.
+	CTSFlow bool
+
+	mu            sync.Mutex
+	writeDeadline time.Time
+}
+
+// New returns p as a Port.
+func New(p serial.Port) *Port {
+	return &Port{port: p}
+}
+
+// Open opens the named serial port in mode, as serial.Open does.
+func Open(name string, mode *serial.Mode) (*Port, error) {
+	p, err := serial.Open(name, mode)
+	if err != nil {
+		return nil, err
+	}
+	return New(p), nil
+}
+
+// Serial returns the underlying port, for settings Port does not cover.
+func (p *Port) Serial() serial.Port {
+	return p.port
+}
+
+// Read reads from the port. Past its read timeout it returns 0 and a nil
+// error, as the port does; a Session handles that.
+func (p *Port) Read(b []byte) (int, error) {
+	return p.port.Read(b)
+}
+
+// SetReadTimeout sets the port's per-read timeout; serial.NoTimeout (or any
+// negative duration) means none.
+func (p *Port) SetReadTimeout(d time.Duration) error {
+	if d < 0 {
+		d = serial.NoTimeout
+	}
+	return p.port.SetReadTimeout(d)
+}
+
+// Write writes b to the port. With CTSFlow set it writes only while CTS is
+// high, and a write still held by CTS at the write deadline returns what was
+// written so far and os.ErrDeadlineExceeded.
+func (p *Port) Write(b []byte) (int, error) {
+	if !p.CTSFlow {
+		return p.port.Write(b)
+	}
+	p.mu.Lock()
+	deadline := p.writeDeadline
+	p.mu.Unlock()
+	written := 0
+	for written < len(b) {
+		if err := p.awaitCTS(deadline); err != nil {
+			return written, err
+		}
+		n, err := p.port.Write(b[written:min(written+ctsChunk, len(b))])
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// awaitCTS waits for CTS to be high, until deadline if it is not zero.
+func (p *Port) awaitCTS(deadline time.Time) error {
+	for {
+		bits, err := p.port.GetModemStatusBits()
+		if err != nil {
+			return err
+		}
+		if bits.CTS {
+			return nil
+		}
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			return os.ErrDeadlineExceeded
+		}
+		time.Sleep(ctsPoll)
+	}
+}
+
+// SetWriteDeadline sets the deadline for a Write held by CTS; the zero time
+// means none. Without CTSFlow it has no effect.
+func (p *Port) SetWriteDeadline(t time.Time) error {
+	p.mu.Lock()
+	p.writeDeadline = t
+	p.mu.Unlock()
+	return nil
+}
+
+// SendBreak holds the line in BREAK for BreakDuration.
+func (p *Port) SendBreak() error {
+	d := p.BreakDuration
+	if d <= 0 {
+		d = DefaultBreak
+	}
+	return p.port.Break(d)
+}
+
+// Drain waits for the port to transmit everything written to it.
+func (p *Port) Drain() error {
+	return p.port.Drain()
+}
+
+// Close closes the port. Whatever the driver has not yet transmitted may be
+// lost; a Session drains the port before Send or Receive returns.
+func (p *Port) Close() error {
+	return p.port.Close()
+}
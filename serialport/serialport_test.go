@@ -0,0 +1,278 @@
+package serialport
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	zmodem "github.com/xx25/go-zmodem"
+	"go.bug.st/serial"
+)
+
+// mockPort is a serial.Port on one end of a simulated null-modem cable, with
+// the driver's per-read timeout and a CTS line the test controls.
+type mockPort struct {
+	in  chan []byte
+	out chan []byte
+	buf []byte
+
+	mu      sync.Mutex
+	timeout time.Duration
+
+	cts    atomic.Bool
+	breaks []time.Duration
+	drains atomic.Int32
+}
+
+// mockPorts returns the two ends of a cable, CTS high on both.
+func mockPorts() (a, b *mockPort) {
+	ab, ba := make(chan []byte, 1024), make(chan []byte, 1024)
+	a = &mockPort{in: ba, out: ab, timeout: serial.NoTimeout}
+	b = &mockPort{in: ab, out: ba, timeout: serial.NoTimeout}
+	a.cts.Store(true)
+	b.cts.Store(true)
+	return a, b
+}
+
+func (m *mockPort) Read(p []byte) (int, error) {
+	if len(m.buf) > 0 {
+		n := copy(p, m.buf)
+		m.buf = m.buf[n:]
+		return n, nil
+	}
+	m.mu.Lock()
+	timeout := m.timeout
+	m.mu.Unlock()
+	var expired <-chan time.Time
+	if timeout != serial.NoTimeout {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case data := <-m.in:
+		n := copy(p, data)
+		m.buf = data[n:]
+		return n, nil
+	case <-expired:
+		return 0, nil
+	}
+}
+
+func (m *mockPort) Write(p []byte) (int, error) {
+	m.out <- bytes.Clone(p)
+	return len(p), nil
+}
+
+func (m *mockPort) SetReadTimeout(t time.Duration) error {
+	m.mu.Lock()
+	m.timeout = t
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *mockPort) GetModemStatusBits() (*serial.ModemStatusBits, error) {
+	return &serial.ModemStatusBits{CTS: m.cts.Load(), DSR: true, DCD: true}, nil
+}
+
+func (m *mockPort) Break(d time.Duration) error {
+	m.mu.Lock()
+	m.breaks = append(m.breaks, d)
+	m.mu.Unlock()
+	return nil
+}
+
+func (m *mockPort) Drain() error {
+	m.drains.Add(1)
+	return nil
+}
+
+func (m *mockPort) Close() error               { return nil }
+func (m *mockPort) SetMode(*serial.Mode) error { return nil }
+func (m *mockPort) ResetInputBuffer() error    { return nil }
+func (m *mockPort) ResetOutputBuffer() error   { return nil }
+func (m *mockPort) SetDTR(bool) error          { return nil }
+func (m *mockPort) SetRTS(bool) error          { return nil }
+
+// fileHandler sends offers and keeps what it receives.
+type fileHandler struct {
+	mu       sync.Mutex
+	offers   []*zmodem.FileOffer
+	received map[string]*bytes.Buffer
+}
+
+func newFileHandler(offers ...*zmodem.FileOffer) *fileHandler {
+	return &fileHandler{offers: offers, received: make(map[string]*bytes.Buffer)}
+}
+
+func (h *fileHandler) NextFile() *zmodem.FileOffer {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.offers) == 0 {
+		return nil
+	}
+	o := h.offers[0]
+	h.offers = h.offers[1:]
+	return o
+}
+
+func (h *fileHandler) AcceptFile(info zmodem.FileInfo) (io.WriteCloser, int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b := new(bytes.Buffer)
+	h.received[info.Name] = b
+	return nopCloser{b}, 0, nil
+}
+
+func (h *fileHandler) FileProgress(zmodem.FileInfo, int64)         {}
+func (h *fileHandler) FileCompleted(zmodem.FileInfo, int64, error) {}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+// transfer sends content from a to b and fails the test unless it arrives.
+func transfer(t *testing.T, a, b *Port, cfg *zmodem.Config, content []byte) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	remote := newFileHandler()
+	var wg sync.WaitGroup
+	var recvErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		recvErr = zmodem.NewSession(b, remote, cfg).Receive(ctx)
+	}()
+	h := newFileHandler(&zmodem.FileOffer{Name: "serial.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)})
+	sendErr := zmodem.NewSession(a, h, cfg).Send(ctx)
+	wg.Wait()
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+	if got := remote.received["serial.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("serial.bin not received intact")
+	}
+}
+
+func config() *zmodem.Config {
+	return &zmodem.Config{
+		Use32BitCRC: true,
+		RecvTimeout: 5 * time.Second,
+		SendTimeout: 5 * time.Second,
+	}
+}
+
+// TestTransfer: a session runs over the port's per-read timeouts, and drains
+// the port at its end.
+func TestTransfer(t *testing.T) {
+	ma, mb := mockPorts()
+	transfer(t, New(ma), New(mb), config(), bytes.Repeat([]byte("serial line "), 10000))
+	if ma.drains.Load() != 1 || mb.drains.Load() != 1 {
+		t.Fatalf("drains: %d, %d; want 1 each", ma.drains.Load(), mb.drains.Load())
+	}
+}
+
+// TestRecvTimeout: RecvTimeout ends the wait on a silent line.
+func TestRecvTimeout(t *testing.T) {
+	ma, _ := mockPorts()
+	cfg := config()
+	cfg.RecvTimeout = 50 * time.Millisecond
+	cfg.MaxRetries = 2
+	start := time.Now()
+	err := zmodem.NewSession(New(ma), newFileHandler(), cfg).Receive(context.Background())
+	if !errors.Is(err, zmodem.ErrTimeout) {
+		t.Fatalf("Receive = %v, want ErrTimeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("timed out after %v", elapsed)
+	}
+}
+
+func TestSendBreak(t *testing.T) {
+	ma, _ := mockPorts()
+	p := New(ma)
+	if err := p.SendBreak(); err != nil {
+		t.Fatal(err)
+	}
+	p.BreakDuration = time.Second
+	if err := p.SendBreak(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []time.Duration{DefaultBreak, time.Second}; !slices.Equal(ma.breaks, want) {
+		t.Fatalf("breaks = %v, want %v", ma.breaks, want)
+	}
+}
+
+// TestCTSFlow: with CTSFlow a write waits while CTS is low, and fails at the
+// write deadline if it stays low.
+func TestCTSFlow(t *testing.T) {
+	ma, mb := mockPorts()
+	p := New(ma)
+	p.CTSFlow = true
+	ma.cts.Store(false)
+
+	p.SetWriteDeadline(time.Now().Add(50 * time.Millisecond))
+	if n, err := p.Write([]byte("held")); n != 0 || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write = %d, %v; want 0, os.ErrDeadlineExceeded", n, err)
+	}
+
+	p.SetWriteDeadline(time.Time{})
+	time.AfterFunc(50*time.Millisecond, func() { ma.cts.Store(true) })
+	start := time.Now()
+	if _, err := p.Write([]byte("released")); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) < 40*time.Millisecond {
+		t.Fatal("Write did not wait for CTS")
+	}
+	if got := string(<-mb.in); got != "released" {
+		t.Fatalf("line carried %q", got)
+	}
+}
+
+// TestLoopbackCable runs a transfer over two real ports joined by a
+// null-modem cable, named in ZMODEM_SERIAL_PAIR as "PORT1,PORT2" (and
+// ZMODEM_SERIAL_BAUD, default 115200).
+func TestLoopbackCable(t *testing.T) {
+	pair := os.Getenv("ZMODEM_SERIAL_PAIR")
+	if pair == "" {
+		t.Skip("set ZMODEM_SERIAL_PAIR=PORT1,PORT2 to run over a null-modem cable")
+	}
+	name1, name2, ok := strings.Cut(pair, ",")
+	if !ok {
+		t.Fatalf("ZMODEM_SERIAL_PAIR=%q: want PORT1,PORT2", pair)
+	}
+	baud := 115200
+	if s := os.Getenv("ZMODEM_SERIAL_BAUD"); s != "" {
+		if _, err := fmt.Sscan(s, &baud); err != nil {
+			t.Fatalf("ZMODEM_SERIAL_BAUD=%q: %v", s, err)
+		}
+	}
+	mode := &serial.Mode{BaudRate: baud}
+	a, err := Open(name1, mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	b, err := Open(name2, mode)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	content := make([]byte, 64<<10)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	transfer(t, a, b, config(), content)
+}
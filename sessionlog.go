@@ -0,0 +1,160 @@
+package zmodem
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+)
+
+// Roles a run's log records carry.
+const (
+	roleSend    = "send"
+	roleReceive = "recv"
+	roleAuto    = "auto" // until Auto learns which it is
+)
+
+// ZRINIT capability flags by name, for the peer attribute.
+var zrinitFlagNames = []struct {
+	flag byte
+	name string
+}{
+	{CANFDX, "CANFDX"},
+	{CANOVIO, "CANOVIO"},
+	{CANBRK, "CANBRK"},
+	{CANCRY, "CANCRY"},
+	{CANLZW, "CANLZW"},
+	{CANFC32, "CANFC32"},
+	{ESCCTL, "ESCCTL"},
+	{ESC8, "ESC8"},
+}
+
+// runAttrs is what the log records of a run carry: its session ID and role,
+// the receiver's capabilities once known, and the file in progress.
+type runAttrs struct {
+	id   [8]byte // hex
+	role string
+
+	peer       bool
+	peerFlags  byte
+	peerWindow int
+	peerLarge  bool
+
+	file     bool
+	fileName string
+	fileSize int64
+}
+
+// runHandler adds a run's attributes to each record, before the record's
+// own, as a logger derived with With would. They are added as the record is
+// handled rather than derived per file: a file then costs nothing to log
+// unless something is logged. The attributes are the session's, updated by
+// the goroutine running it, which is the one logging.
+type runHandler struct {
+	inner slog.Handler
+	run   *runAttrs
+}
+
+func (h *runHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.inner.Enabled(ctx, level)
+}
+
+func (h *runHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	out.AddAttrs(slog.String("session", string(h.run.id[:])), slog.String("role", h.run.role))
+	if h.run.peer {
+		out.AddAttrs(slog.Group("peer", "flags", flagNames(h.run.peerFlags), "window", h.run.peerWindow, "large_blocks", h.run.peerLarge))
+	}
+	if h.run.file {
+		out.AddAttrs(slog.String("file", h.run.fileName), slog.Int64("size", h.run.fileSize))
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(a)
+		return true
+	})
+	return h.inner.Handle(ctx, out)
+}
+
+func (h *runHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &runHandler{inner: h.inner.WithAttrs(attrs), run: h.run}
+}
+
+func (h *runHandler) WithGroup(name string) slog.Handler {
+	return &runHandler{inner: h.inner.WithGroup(name), run: h.run}
+}
+
+// newSessionID returns a short random ID telling one run's log records from
+// another's, in hex.
+func newSessionID() (id [8]byte) {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	hex.Encode(id[:], b[:])
+	return id
+}
+
+// flagNames names the ZRINIT capability flags set in flags: CANFDX|CANFC32.
+func flagNames(flags byte) string {
+	var names []string
+	for _, f := range zrinitFlagNames {
+		if flags&f.flag != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return strings.Join(names, "|")
+}
+
+// beginLog derives the logger of a run from the session's: every record
+// carries a new session ID and the role. It returns what puts the session's
+// own logger back.
+func (s *Session) beginLog(role string) func() {
+	base := s.logger
+	s.logRun = runAttrs{id: newSessionID(), role: role}
+	s.logHandler = runHandler{inner: base.Handler(), run: &s.logRun}
+	s.setLogger(slog.New(&s.logHandler))
+	s.logBase = base
+	return func() {
+		s.setLogger(base)
+		s.logBase = nil
+	}
+}
+
+// setRole sets the role the run's records carry, as Auto learns it.
+func (s *Session) setRole(role string) {
+	s.logRun.role = role
+}
+
+// logPeer adds what the receiver's first ZRINIT said it can do to the
+// run's records.
+func (s *Session) logPeer(flags byte, window int, largeBlocks bool) {
+	if s.logBase == nil {
+		return
+	}
+	s.logRun.peer = true
+	s.logRun.peerFlags = flags
+	s.logRun.peerWindow = window
+	s.logRun.peerLarge = largeBlocks
+}
+
+// logFile adds a file's name and size to the run's records, from its offer
+// to its end.
+func (s *Session) logFile(info FileInfo) {
+	s.logRun.file = true
+	s.logRun.fileName = info.Name
+	s.logRun.fileSize = info.Size
+}
+
+// endLogFile drops the file from the run's records once it has ended.
+func (s *Session) endLogFile() {
+	s.logRun.file = false
+}
+
+// setLogger sets the logger of the session and of the layers that log on
+// its behalf.
+func (s *Session) setLogger(l *slog.Logger) {
+	s.logger = l
+	s.tr.logger = l
+	if s.flow != nil {
+		s.flow.logger = l
+	}
+}
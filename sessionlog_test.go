@@ -0,0 +1,199 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+)
+
+// capturedRecord is a log record with the attributes of its logger and its
+// own, flattened to strings.
+type capturedRecord struct {
+	msg   string
+	attrs map[string]string
+}
+
+// captureHandler is a slog.Handler keeping every record.
+type captureHandler struct {
+	mu      *sync.Mutex
+	records *[]capturedRecord
+	attrs   []slog.Attr
+}
+
+func newCaptureHandler() *captureHandler {
+	return &captureHandler{mu: new(sync.Mutex), records: new([]capturedRecord)}
+}
+
+func (h *captureHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *captureHandler) Handle(_ context.Context, r slog.Record) error {
+	rec := capturedRecord{msg: r.Message, attrs: map[string]string{}}
+	add := func(a slog.Attr) bool {
+		flattenAttr(rec.attrs, "", a)
+		return true
+	}
+	for _, a := range h.attrs {
+		add(a)
+	}
+	r.Attrs(add)
+	h.mu.Lock()
+	*h.records = append(*h.records, rec)
+	h.mu.Unlock()
+	return nil
+}
+
+func (h *captureHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	c := *h
+	c.attrs = append(append([]slog.Attr(nil), h.attrs...), attrs...)
+	return &c
+}
+
+func (h *captureHandler) WithGroup(string) slog.Handler { panic("WithGroup not used") }
+
+// all returns the records so far.
+func (h *captureHandler) all() []capturedRecord {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]capturedRecord(nil), *h.records...)
+}
+
+func flattenAttr(m map[string]string, prefix string, a slog.Attr) {
+	if a.Value.Kind() == slog.KindGroup {
+		for _, g := range a.Value.Group() {
+			flattenAttr(m, prefix+a.Key+".", g)
+		}
+		return
+	}
+	m[prefix+a.Key] = a.Value.String()
+}
+
+// TestSessionLogAttrs: over a line that corrupts a subpacket, the records
+// of the data phase, the recovery included, carry the session's ID and role
+// and the file's name and size; the sender's carry the receiver's
+// capabilities once its ZRINIT is in. Outside a run the session logs as
+// configured.
+func TestSessionLogAttrs(t *testing.T) {
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+	content := randomContent(16384)
+	senderHandler := newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{{Name: "logged.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	sendLog, recvLog := newCaptureHandler(), newCaptureHandler()
+	sendLogger, recvLogger := slog.New(sendLog), slog.New(recvLog)
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: &corruptingWriter{w: w1, targetCount: 3}}, senderHandler,
+		&Config{MaxBlockSize: 512, Use32BitCRC: true, Logger: sendLogger})
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(),
+		&Config{MaxBlockSize: 512, Use32BitCRC: true, Logger: recvLogger})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+	if sender.logger != sendLogger || receiver.logger != recvLogger || receiver.tr.logger != recvLogger {
+		t.Error("the configured logger was not put back after the run")
+	}
+
+	var recovery, zdata bool
+	for _, side := range []struct {
+		name, role string
+		log        *captureHandler
+	}{{"sender", roleSend, sendLog}, {"receiver", roleReceive, recvLog}} {
+		ids := map[string]bool{}
+		for _, r := range side.log.all() {
+			ids[r.attrs["session"]] = true
+			if r.attrs["role"] != side.role {
+				t.Errorf("%s: %q has role %q", side.name, r.msg, r.attrs["role"])
+			}
+			data := r.msg == "data error, sending ZRPOS" || r.attrs["type"] == "ZDATA"
+			if data && (r.attrs["file"] != "logged.bin" || r.attrs["size"] != "16384") {
+				t.Errorf("%s: data-phase record %q %v lacks the file", side.name, r.msg, r.attrs)
+			}
+			recovery = recovery || r.msg == "data error, sending ZRPOS"
+			zdata = zdata || data
+			if side.role == roleSend && r.attrs["type"] == "ZDATA" && r.attrs["peer.flags"] != "CANFDX|CANOVIO|CANFC32" {
+				t.Errorf("sender: ZDATA record %v lacks the peer's capabilities", r.attrs)
+			}
+		}
+		if len(ids) != 1 || ids[""] {
+			t.Errorf("%s: session IDs %v, want one", side.name, ids)
+		}
+	}
+	if !recovery || !zdata {
+		t.Fatalf("no data-phase records to check (recovery %v, ZDATA %v)", recovery, zdata)
+	}
+}
+
+// TestSessionLogConcurrent: two transfers logging to one handler at once
+// can be told apart, each session's records by its ID, and every file
+// record belongs to the transfer of that file.
+func TestSessionLogConcurrent(t *testing.T) {
+	log := newCaptureHandler()
+	logger := slog.New(log)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for pair := range 2 {
+		senderT, receiverT, senderClose, receiverClose := newTestTransports()
+		content := randomContent(8192)
+		senderHandler := newTestHandler()
+		senderHandler.filesToSend = []*FileOffer{{Name: fmt.Sprintf("pair%d.bin", pair), Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+		sender := NewSession(senderT, senderHandler, &Config{Logger: logger})
+		receiver := NewSession(receiverT, newTestHandler(), &Config{Logger: logger})
+		wg.Add(2)
+		go func() { defer wg.Done(); defer senderClose(); errs[2*pair] = sender.Send(ctx) }()
+		go func() { defer wg.Done(); defer receiverClose(); errs[2*pair+1] = receiver.Receive(ctx) }()
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each session ID has one role and one file.
+	type stream struct{ role, file string }
+	streams := map[string]*stream{}
+	for _, r := range log.all() {
+		id := r.attrs["session"]
+		if id == "" {
+			t.Errorf("record %q %v has no session", r.msg, r.attrs)
+			continue
+		}
+		st := streams[id]
+		if st == nil {
+			st = &stream{role: r.attrs["role"]}
+			streams[id] = st
+		}
+		if r.attrs["role"] != st.role {
+			t.Errorf("session %s logs as %s and %s", id, st.role, r.attrs["role"])
+		}
+		if f := r.attrs["file"]; f != "" {
+			if st.file != "" && f != st.file {
+				t.Errorf("session %s logs files %s and %s", id, st.file, f)
+			}
+			st.file = f
+		}
+	}
+	roles := map[string]int{}
+	files := map[string]int{}
+	for _, st := range streams {
+		roles[st.role]++
+		files[st.file]++
+	}
+	if len(streams) != 4 || roles[roleSend] != 2 || roles[roleReceive] != 2 || files["pair0.bin"] != 2 || files["pair1.bin"] != 2 {
+		t.Errorf("%d streams: roles %v, files %v; want 4, a sender and a receiver of each file", len(streams), roles, files)
+	}
+}
@@ -0,0 +1,267 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ==== Synchronet sexyz ====
+//
+// The integration tests drive sexyz in stdio mode when it is on PATH; the
+// scripted tests after them replay the sexyz behaviours that differ from lrzsz
+// with a peer session, so they run everywhere. Run with $ZMODEM_CAPTURE_DIR
+// set, the integration tests record their sessions as sexyz-*.zcap captures
+// (see recordCapture) for TestCaptures to play without the binary.
+
+// stdioTransport is a child process's stdout and stdin as a transport.
+type stdioTransport struct {
+	io.Reader
+	io.WriteCloser
+}
+
+// startSexyz runs sexyz with args in dir, talking ZMODEM on its stdin and
+// stdout.
+func startSexyz(t *testing.T, dir string, args ...string) (*stdioTransport, *exec.Cmd) {
+	t.Helper()
+	path := findBinary(t, "sexyz")
+
+	cmd := exec.Command(path, args...)
+	cmd.Dir = dir
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatalf("sexyz stdin: %v", err)
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatalf("sexyz stdout: %v", err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("sexyz start: %v", err)
+	}
+	t.Cleanup(func() {
+		if cmd.Process != nil {
+			cmd.Process.Kill()
+		}
+	})
+	return &stdioTransport{Reader: stdout, WriteCloser: stdin}, cmd
+}
+
+// TestSexyzS1_Send sends a batch to sexyz rz, with CRC-32 and with CRC-16
+// (sexyz -o).
+func TestSexyzS1_Send(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		flags []string
+	}{
+		{"crc32", nil},
+		{"crc16", []string{"-o"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			recvDir := t.TempDir()
+			one := randomContent(70 << 10)
+			two := []byte("second file of the batch")
+
+			args := append(append([]string{}, tc.flags...), "-y", "rz", recvDir+string(filepath.Separator))
+			tr, cmd := startSexyz(t, recvDir, args...)
+			handler := newLrzszSendHandler([]*FileOffer{
+				{Name: "one.bin", Size: int64(len(one)), ModTime: time.Now(), Mode: 0644, Reader: bytes.NewReader(one)},
+				{Name: "two.txt", Size: int64(len(two)), ModTime: time.Now(), Mode: 0644, Reader: bytes.NewReader(two)},
+			})
+			cfg := &Config{Use32BitCRC: true, MaxBlockSize: 8192}
+			session := NewSession(recordStdioCapture(t, tr, "sexyz-send-"+tc.name, true, cfg), handler, cfg)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+			defer cancel()
+			if err := session.Send(ctx); err != nil {
+				t.Fatalf("Send error: %v", err)
+			}
+			tr.Close()
+			if err := cmd.Wait(); err != nil {
+				t.Fatalf("sexyz exit error: %v", err)
+			}
+
+			verifyFile(t, filepath.Join(recvDir, "one.bin"), one)
+			verifyFile(t, filepath.Join(recvDir, "two.txt"), two)
+		})
+	}
+}
+
+// TestSexyzR1_Recv receives a batch from sexyz sz.
+func TestSexyzR1_Recv(t *testing.T) {
+	srcDir := t.TempDir()
+	recvDir := t.TempDir()
+	one := randomContent(70 << 10)
+	two := []byte("second file of the batch")
+	onePath := createTestFile(t, srcDir, "one.bin", one)
+	twoPath := createTestFile(t, srcDir, "two.txt", two)
+
+	tr, cmd := startSexyz(t, srcDir, "sz", onePath, twoPath)
+	handler := newLrzszRecvHandler(recvDir)
+	cfg := &Config{Use32BitCRC: true, MaxBlockSize: 1024}
+	session := NewSession(recordStdioCapture(t, tr, "sexyz-recv-batch", false, cfg), handler, cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := session.Receive(ctx); err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	tr.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("sexyz exit error: %v", err)
+	}
+
+	verifyFile(t, filepath.Join(recvDir, "one.bin"), one)
+	verifyFile(t, filepath.Join(recvDir, "two.txt"), two)
+}
+
+// TestSexyzR2_RecvResume resumes a file from sexyz sz at a non-zero offset.
+func TestSexyzR2_RecvResume(t *testing.T) {
+	srcDir := t.TempDir()
+	content := randomContent(40 << 10)
+	srcPath := createTestFile(t, srcDir, "resume.bin", content)
+
+	tr, cmd := startSexyz(t, srcDir, "sz", srcPath)
+	handler := newTestHandler()
+	handler.acceptOffset = 16 << 10
+	cfg := &Config{Use32BitCRC: true, MaxBlockSize: 1024}
+	session := NewSession(recordStdioCapture(t, tr, "sexyz-recv-resume", false, cfg), handler, cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := session.Receive(ctx); err != nil {
+		t.Fatalf("Receive error: %v", err)
+	}
+	tr.Close()
+	if err := cmd.Wait(); err != nil {
+		t.Fatalf("sexyz exit error: %v", err)
+	}
+
+	got := handler.receivedFiles["resume.bin"]
+	if got == nil || !bytes.Equal(got.Bytes(), content[16<<10:]) {
+		t.Fatal("resume.bin: the tail from the resume offset was not received intact")
+	}
+}
+
+// sexyzPeer is a scripted sexyz sender facing a receiver session.
+type sexyzPeer struct {
+	t    *testing.T
+	peer *Session
+}
+
+func (p *sexyzPeer) offer(name string, size int) {
+	p.t.Helper()
+	fh := makeHeader(ZFILE)
+	fh.SetZF0(ZCBIN)
+	if err := p.peer.sendBinHeader(fh); err != nil {
+		p.t.Fatalf("send ZFILE: %v", err)
+	}
+	if err := p.peer.sendSubpacket(marshalFileInfo(&FileOffer{Name: name, Size: int64(size)}, 0, 0), ZCRCW); err != nil {
+		p.t.Fatalf("send ZFILE metadata: %v", err)
+	}
+}
+
+// sendZCRCW sends data the way sexyz often frames it: each subpacket in a
+// ZDATA frame of its own, ended ZCRCW and acknowledged before the next.
+func (p *sexyzPeer) sendZCRCW(data []byte, block int) {
+	p.t.Helper()
+	for off := 0; off < len(data); off += block {
+		end := min(off+block, len(data))
+		if err := p.peer.sendBinHeader(makePosHeader(ZDATA, int64(off))); err != nil {
+			p.t.Fatalf("send ZDATA: %v", err)
+		}
+		if err := p.peer.sendSubpacket(data[off:end], ZCRCW); err != nil {
+			p.t.Fatalf("send subpacket: %v", err)
+		}
+		if ack := mustRecvType(p.t, p.peer, ZACK, "ZACK for ZCRCW"); ack.Position() != int64(end) {
+			p.t.Fatalf("ZACK at %d, want %d", ack.Position(), end)
+		}
+	}
+}
+
+func (p *sexyzPeer) finish(size int) {
+	p.t.Helper()
+	if err := p.peer.sendHexHeader(makePosHeader(ZEOF, int64(size))); err != nil {
+		p.t.Fatalf("send ZEOF: %v", err)
+	}
+	mustRecvType(p.t, p.peer, ZRINIT, "ZRINIT after ZEOF")
+	if err := p.peer.sendHexHeader(makeHeader(ZFIN)); err != nil {
+		p.t.Fatalf("send ZFIN: %v", err)
+	}
+	mustRecvType(p.t, p.peer, ZFIN, "receiver ZFIN")
+	_ = p.peer.tw.writeRaw([]byte("OO"))
+	_ = p.peer.tw.Flush()
+}
+
+// TestSexyzQuirkZFILERepeats: sexyz re-offers a file every second until it
+// sees our ZRPOS, and opens with ZRQINIT repeated. Repeats queued behind the
+// ZFILE we answered get no second ZRPOS (each would restart its data); a
+// repeat arriving well after the ZRPOS, as when it was lost, is answered. The
+// data comes ZCRCW-framed.
+func TestSexyzQuirkZFILERepeats(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		late bool // the repeat arrives after zfileCrossing
+	}{
+		{"crossing", false},
+		{"after lost ZRPOS", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r1, w1 := bufferedPipe(256) // peer -> receiver
+			r2, w2 := bufferedPipe(256) // receiver -> peer
+			handler := newTestHandler()
+			receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, handler,
+				&Config{Use32BitCRC: true, Logger: discardLogger()})
+			var skew atomic.Int64
+			receiver.tr.now = func() time.Time { return time.Now().Add(time.Duration(skew.Load())) }
+			p := &sexyzPeer{t: t, peer: NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, newTestHandler(), &Config{})}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			var recvErr error
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				defer w2.Close()
+				recvErr = receiver.Receive(ctx)
+			}()
+
+			mustRecvType(t, p.peer, ZRINIT, "initial ZRINIT")
+			for range 3 {
+				if err := p.peer.sendHexHeader(makeHeader(ZRQINIT)); err != nil {
+					t.Fatalf("send ZRQINIT: %v", err)
+				}
+				mustRecvType(t, p.peer, ZRINIT, "ZRINIT for ZRQINIT")
+			}
+
+			content := randomContent(5000)
+			p.offer("sexyz.bin", len(content))
+			mustRecvType(t, p.peer, ZRPOS, "ZRPOS")
+			if tc.late {
+				skew.Store(int64(2 * zfileCrossing))
+			}
+			p.offer("sexyz.bin", len(content))
+			if tc.late {
+				mustRecvType(t, p.peer, ZRPOS, "ZRPOS for the repeat")
+			}
+			p.sendZCRCW(content, 1024)
+			p.finish(len(content))
+			<-done
+			w1.Close()
+
+			if recvErr != nil {
+				t.Fatalf("Receive = %v", recvErr)
+			}
+			if got := handler.receivedFiles["sexyz.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+				t.Fatal("sexyz.bin not received intact")
+			}
+		})
+	}
+}
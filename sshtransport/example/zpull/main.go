@@ -0,0 +1,147 @@
+// Command zpull fetches files from an SSH server running sz, in the manner of
+// zssh: it runs "sz -q FILE..." on the server and receives into the current
+// directory.
+//
+//	zpull -i ~/.ssh/id_ed25519 user@host:22 notes.txt data.bin
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+
+	zmodem "github.com/xx25/go-zmodem"
+	"github.com/xx25/go-zmodem/sshtransport"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func main() {
+	home, _ := os.UserHomeDir()
+	keyFile := flag.String("i", filepath.Join(home, ".ssh", "id_ed25519"), "private key `file`")
+	hostsFile := flag.String("known-hosts", filepath.Join(home, ".ssh", "known_hosts"), "known hosts `file`")
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "usage: zpull [flags] user@host:port file...")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() < 2 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	user, addr, ok := strings.Cut(flag.Arg(0), "@")
+	if !ok {
+		log.Fatalf("%s: want user@host:port", flag.Arg(0))
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	if err := pull(ctx, user, addr, *keyFile, *hostsFile, flag.Args()[1:]); err != nil {
+		log.Fatal(err)
+	}
+}
+
+func pull(ctx context.Context, user, addr, keyFile, hostsFile string, files []string) error {
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return err
+	}
+	signer, err := ssh.ParsePrivateKey(key)
+	if err != nil {
+		return err
+	}
+	hostKeys, err := knownhosts.New(hostsFile)
+	if err != nil {
+		return err
+	}
+	client, err := ssh.Dial("tcp", addr, &ssh.ClientConfig{
+		User:            user,
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(signer)},
+		HostKeyCallback: hostKeys,
+	})
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	// A session channel opened directly, rather than through client.NewSession,
+	// is an ssh.Channel the adapter can take whole.
+	ch, reqs, err := client.OpenChannel("session", nil)
+	if err != nil {
+		return err
+	}
+	status := make(chan error, 1)
+	go func() {
+		var err error
+		for req := range reqs {
+			if req.Type == "exit-status" && len(req.Payload) == 4 {
+				if code := binary.BigEndian.Uint32(req.Payload); code != 0 {
+					err = fmt.Errorf("sz exited with status %d", code)
+				}
+			}
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+		status <- err
+	}()
+	go io.Copy(os.Stderr, ch.Stderr()) // keep the window open
+
+	quoted := make([]string, len(files))
+	for i, f := range files {
+		quoted[i] = "'" + strings.ReplaceAll(f, "'", `'\''`) + "'"
+	}
+	cmd := "sz -q " + strings.Join(quoted, " ")
+	ok, err := ch.SendRequest("exec", true, ssh.Marshal(struct{ Command string }{cmd}))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("server refused to run sz")
+	}
+
+	conn := sshtransport.New(ch)
+	err = zmodem.NewSession(conn, &saver{}, &zmodem.Config{Use32BitCRC: true}).Receive(ctx)
+	if cerr := conn.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	return <-status
+}
+
+// saver writes received files to the current directory.
+type saver struct{}
+
+func (*saver) NextFile() *zmodem.FileOffer { return nil }
+
+func (*saver) AcceptFile(info zmodem.FileInfo) (io.WriteCloser, int64, error) {
+	name := filepath.Base(info.Name)
+	if name == "." || name == ".." || name == string(filepath.Separator) {
+		return nil, 0, zmodem.ErrSkip
+	}
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return nil, 0, err
+	}
+	return f, 0, nil
+}
+
+func (*saver) FileProgress(zmodem.FileInfo, int64) {}
+
+func (*saver) FileCompleted(info zmodem.FileInfo, n int64, err error) {
+	if err != nil {
+		log.Printf("%s: %v", info.Name, err)
+		return
+	}
+	log.Printf("%s: %d bytes", info.Name, n)
+}
@@ -0,0 +1,12 @@
+module github.com/xx25/go-zmodem/sshtransport
+
+go 1.25.4
+
+require (
+	github.com/xx25/go-zmodem v0.0.0-00010101000000-000000000000
+	golang.org/x/crypto v0.54.0
+)
+
+require golang.org/x/sys v0.47.0 // indirect
+
+replace github.com/xx25/go-zmodem => ../
@@ -0,0 +1,247 @@
+// Package sshtransport adapts an SSH channel (golang.org/x/crypto/ssh) into a
+// transport for zmodem.NewSession.
+//
+// An ssh.Channel has no deadlines, so a Session over it could never time out
+// a silent peer: Config.RecvTimeout and Config.SendTimeout would do nothing.
+// Conn gives it read and write deadlines, emulated with a goroutine and a
+// timer, and a Close that lets the session's last frames reach the remote
+// program before the channel goes.
+//
+// The remote program's stderr arrives on the channel's Stderr(), which Conn
+// does not read. Extended data counts against the same SSH window as the
+// data, so drain it (io.Copy(io.Discard, ch.Stderr())) or ask the remote
+// program to be quiet (sz -q), or a chatty one stalls the transfer.
+package sshtransport
+
+import (
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// DefaultCloseWait is how long Close waits for the remote end to close its
+// side of the channel.
+const DefaultCloseWait = 2 * time.Second
+
+// readChunk is the most one read of the channel takes.
+const readChunk = 32 << 10
+
+// errClosed is returned by the reads and writes of a closed Conn.
+var errClosed = errors.New("sshtransport: use of closed connection")
+
+// readResult is one read of the channel, made by the reader goroutine.
+type readResult struct {
+	data []byte
+	err  error
+}
+
+// Conn is an ssh.Channel with read and write deadlines. Create it with New;
+// it then owns the channel's data stream, which is read from a goroutine.
+type Conn struct {
+	ch ssh.Channel
+
+	// CloseWait bounds Close's wait for the remote end; 0 means
+	// DefaultCloseWait. Set it before Close.
+	CloseWait time.Duration
+
+	reads   chan readResult // filled by the reader goroutine, one read ahead
+	rest    []byte          // what the last chunk held beyond the caller's buffer
+	readErr error           // the channel's read error once seen (io.EOF at its end)
+	done    chan struct{}   // closed by Close
+
+	mu            sync.Mutex
+	readDeadline  time.Time
+	writeDeadline time.Time
+
+	wmu      sync.Mutex // serializes Write
+	writeErr error      // sticky: a write that timed out may still be in progress
+	closed   bool
+}
+
+// New returns ch as a Conn, and starts reading it.
+func New(ch ssh.Channel) *Conn {
+	c := &Conn{
+		ch:    ch,
+		reads: make(chan readResult, 1),
+		done:  make(chan struct{}),
+	}
+	go c.readLoop()
+	return c
+}
+
+// readLoop reads the channel until it ends. It stays one read ahead of the
+// caller: the channel's window only opens as far as its data is consumed.
+func (c *Conn) readLoop() {
+	for {
+		buf := make([]byte, readChunk)
+		n, err := c.ch.Read(buf)
+		if n > 0 {
+			select {
+			case c.reads <- readResult{data: buf[:n]}:
+			case <-c.done:
+				return
+			}
+		}
+		if err != nil {
+			select {
+			case c.reads <- readResult{err: err}:
+			case <-c.done:
+			}
+			return
+		}
+	}
+}
+
+// Read reads from the channel, waiting no later than the read deadline: a read
+// that passes it returns os.ErrDeadlineExceeded, and no data is lost to it.
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.rest) > 0 {
+		n := copy(p, c.rest)
+		c.rest = c.rest[n:]
+		return n, nil
+	}
+	if c.readErr != nil {
+		return 0, c.readErr
+	}
+	c.mu.Lock()
+	deadline := c.readDeadline
+	c.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case r := <-c.reads:
+		if r.err != nil {
+			c.readErr = r.err
+			return 0, r.err
+		}
+		n := copy(p, r.data)
+		c.rest = r.data[n:]
+		return n, nil
+	case <-timeout:
+		return 0, os.ErrDeadlineExceeded
+	case <-c.done:
+		return 0, errClosed
+	}
+}
+
+// SetReadDeadline sets the deadline for Read; the zero time means none. It
+// applies to the next Read, not to one already waiting.
+func (c *Conn) SetReadDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.readDeadline = t
+	return nil
+}
+
+// Write writes p to the channel. A write blocks while the remote window is
+// full; one still blocked at the write deadline returns
+// os.ErrDeadlineExceeded. How much of it the channel took is then unknown,
+// so every later Write fails too: the Session has already given up.
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.writeErr != nil {
+		return 0, c.writeErr
+	}
+	c.mu.Lock()
+	deadline := c.writeDeadline
+	c.mu.Unlock()
+	if deadline.IsZero() {
+		n, err := c.ch.Write(p)
+		if err != nil {
+			c.writeErr = err
+		}
+		return n, err
+	}
+	wait := time.Until(deadline)
+	if wait <= 0 {
+		return 0, os.ErrDeadlineExceeded
+	}
+
+	type writeResult struct {
+		n   int
+		err error
+	}
+	result := make(chan writeResult, 1)
+	go func() {
+		n, err := c.ch.Write(p)
+		result <- writeResult{n, err}
+	}()
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case r := <-result:
+		if r.err != nil {
+			c.writeErr = r.err
+		}
+		return r.n, r.err
+	case <-timer.C:
+		c.writeErr = os.ErrDeadlineExceeded
+		return 0, c.writeErr
+	}
+}
+
+// SetWriteDeadline sets the deadline for Write; the zero time means none.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.writeDeadline = t
+	return nil
+}
+
+// Flush does nothing: the channel sends each Write as it is made, so no bytes
+// wait for it. It is there so a Session's per-frame flush has a target.
+func (c *Conn) Flush() error {
+	return nil
+}
+
+// Close closes the channel once the remote program has had the session's last
+// frames. It sends EOF, so the program reads our ZFIN or OO and then the end
+// of its input, and waits up to CloseWait for the remote end to close its
+// side, reading and dropping anything it still sends, before closing the
+// channel. Closing at once could cut off those frames' delivery to a program
+// that is still reading, and have it report a failed transfer.
+func (c *Conn) Close() error {
+	c.wmu.Lock()
+	if c.closed {
+		c.wmu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.wmu.Unlock()
+
+	_ = c.ch.CloseWrite()
+	wait := c.CloseWait
+	if wait <= 0 {
+		wait = DefaultCloseWait
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for c.readErr == nil {
+		select {
+		case r := <-c.reads:
+			c.readErr = r.err
+		case <-timer.C:
+			c.readErr = errClosed
+		}
+	}
+	close(c.done)
+	err := c.ch.Close()
+	if errors.Is(err, io.EOF) {
+		err = nil // the remote end closed it first
+	}
+	return err
+}
@@ -0,0 +1,312 @@
+package sshtransport
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	zmodem "github.com/xx25/go-zmodem"
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an in-process SSH server. Each exec request runs handle with
+// the command and the session channel as a Conn; the channel is closed, with
+// an exit status, when handle returns.
+func testServer(t *testing.T, handle func(cmd string, c *Conn) error) *ssh.Client {
+	t.Helper()
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(signer)
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		serverSide, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		_, chans, reqs, err := ssh.NewServerConn(serverSide, cfg)
+		if err != nil {
+			return
+		}
+		go ssh.DiscardRequests(reqs)
+		for nc := range chans {
+			if nc.ChannelType() != "session" {
+				nc.Reject(ssh.UnknownChannelType, "session only")
+				continue
+			}
+			ch, chReqs, err := nc.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				for req := range chReqs {
+					if req.Type != "exec" || len(req.Payload) < 4 {
+						req.Reply(false, nil)
+						continue
+					}
+					req.Reply(true, nil)
+					cmd := string(req.Payload[4:])
+					go func() {
+						status := uint32(0)
+						if err := handle(cmd, New(ch)); err != nil {
+							t.Logf("server %q: %v", cmd, err)
+							status = 1
+						}
+						ch.SendRequest("exit-status", false, binary.BigEndian.AppendUint32(nil, status))
+						ch.Close()
+					}()
+				}
+			}()
+		}
+	}()
+
+	client, err := ssh.Dial("tcp", ln.Addr().String(), &ssh.ClientConfig{
+		User:            "test",
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// exec starts cmd on the server and returns the session's channel as a Conn.
+func exec(t *testing.T, client *ssh.Client, cmd string) (*Conn, *ssh.Session) {
+	t.Helper()
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdin, err := sess.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := sess.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sess.Start(cmd); err != nil {
+		t.Fatal(err)
+	}
+	return New(&sessionChannel{Reader: stdout, WriteCloser: stdin, sess: sess}), sess
+}
+
+// sessionChannel is an ssh.Session's stdio as an ssh.Channel: the client API
+// does not hand out the session's channel itself.
+type sessionChannel struct {
+	io.Reader
+	io.WriteCloser
+	sess *ssh.Session
+}
+
+func (s *sessionChannel) CloseWrite() error                              { return s.WriteCloser.Close() }
+func (s *sessionChannel) Close() error                                   { return s.sess.Close() }
+func (s *sessionChannel) Stderr() io.ReadWriter                          { return nil }
+func (s *sessionChannel) SendRequest(string, bool, []byte) (bool, error) { return false, nil }
+
+// fileHandler sends offers and keeps what it receives.
+type fileHandler struct {
+	mu       sync.Mutex
+	offers   []*zmodem.FileOffer
+	received map[string]*bytes.Buffer
+}
+
+func newFileHandler(offers ...*zmodem.FileOffer) *fileHandler {
+	return &fileHandler{offers: offers, received: make(map[string]*bytes.Buffer)}
+}
+
+func (h *fileHandler) NextFile() *zmodem.FileOffer {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.offers) == 0 {
+		return nil
+	}
+	o := h.offers[0]
+	h.offers = h.offers[1:]
+	return o
+}
+
+func (h *fileHandler) AcceptFile(info zmodem.FileInfo) (io.WriteCloser, int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	b := new(bytes.Buffer)
+	h.received[info.Name] = b
+	return nopCloser{b}, 0, nil
+}
+
+func (h *fileHandler) FileProgress(zmodem.FileInfo, int64)         {}
+func (h *fileHandler) FileCompleted(zmodem.FileInfo, int64, error) {}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
+
+func randomData(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func config() *zmodem.Config {
+	return &zmodem.Config{
+		Use32BitCRC:  true,
+		MaxBlockSize: 8192,
+		RecvTimeout:  5 * time.Second,
+		SendTimeout:  5 * time.Second,
+	}
+}
+
+// TestPull receives a file from a server running a sender, more than the
+// SSH window holds.
+func TestPull(t *testing.T) {
+	content := randomData(t, 3<<20)
+	client := testServer(t, func(cmd string, c *Conn) error {
+		h := newFileHandler(&zmodem.FileOffer{Name: "pull.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)})
+		return zmodem.NewSession(c, h, config()).Send(context.Background())
+	})
+
+	c, sess := exec(t, client, "sz pull.bin")
+	h := newFileHandler()
+	if err := zmodem.NewSession(c, h, config()).Receive(context.Background()); err != nil {
+		t.Fatalf("Receive: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := sess.Wait(); err != nil {
+		t.Fatalf("remote sender: %v", err)
+	}
+	if got := h.received["pull.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("pull.bin not received intact")
+	}
+}
+
+// TestPush sends a file to a server running a receiver, which must see the
+// session through to its end: Close does not cut off our last frames.
+func TestPush(t *testing.T) {
+	content := randomData(t, 1<<20)
+	remote := newFileHandler()
+	client := testServer(t, func(cmd string, c *Conn) error {
+		return zmodem.NewSession(c, remote, config()).Receive(context.Background())
+	})
+
+	c, sess := exec(t, client, "rz")
+	h := newFileHandler(&zmodem.FileOffer{Name: "push.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)})
+	if err := zmodem.NewSession(c, h, config()).Send(context.Background()); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := sess.Wait(); err != nil {
+		t.Fatalf("remote receiver: %v", err)
+	}
+	remote.mu.Lock()
+	defer remote.mu.Unlock()
+	if got := remote.received["push.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("push.bin not received intact")
+	}
+}
+
+// TestReadDeadline: a read past its deadline fails with
+// os.ErrDeadlineExceeded and loses nothing.
+func TestReadDeadline(t *testing.T) {
+	release := make(chan struct{})
+	client := testServer(t, func(cmd string, c *Conn) error {
+		<-release
+		_, err := c.Write([]byte("late"))
+		return err
+	})
+	c, _ := exec(t, client, "wait")
+	defer c.Close()
+
+	c.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	start := time.Now()
+	if _, err := c.Read(make([]byte, 16)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read = %v, want os.ErrDeadlineExceeded", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("deadline hit after %v", elapsed)
+	}
+
+	close(release)
+	c.SetReadDeadline(time.Time{})
+	buf := make([]byte, 16)
+	n, err := c.Read(buf)
+	if err != nil || string(buf[:n]) != "late" {
+		t.Fatalf("Read = %q, %v; want %q", buf[:n], err, "late")
+	}
+}
+
+// TestWriteDeadline: a write blocked on a full SSH window fails at its
+// deadline, and so does every write after it.
+func TestWriteDeadline(t *testing.T) {
+	release := make(chan struct{})
+	client := testServer(t, func(cmd string, c *Conn) error {
+		<-release // never reads
+		return nil
+	})
+	defer close(release)
+	c, _ := exec(t, client, "stall")
+
+	c.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	chunk := make([]byte, 64<<10)
+	var err error
+	for range 1024 { // far beyond any window
+		if _, err = c.Write(chunk); err != nil {
+			break
+		}
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write = %v, want os.ErrDeadlineExceeded", err)
+	}
+	c.SetWriteDeadline(time.Time{})
+	if _, err := c.Write([]byte("x")); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write after a timeout = %v, want the timeout again", err)
+	}
+}
+
+// TestSessionTimeout: RecvTimeout works over a channel, which has no
+// deadlines of its own.
+func TestSessionTimeout(t *testing.T) {
+	release := make(chan struct{})
+	client := testServer(t, func(cmd string, c *Conn) error {
+		<-release
+		return nil
+	})
+	c, _ := exec(t, client, "silent")
+	defer c.Close()
+	defer close(release) // before Close, which waits for the server to end
+
+	cfg := config()
+	cfg.RecvTimeout = 50 * time.Millisecond
+	cfg.MaxRetries = 2
+	err := zmodem.NewSession(c, newFileHandler(), cfg).Receive(context.Background())
+	if !errors.Is(err, zmodem.ErrTimeout) {
+		t.Fatalf("Receive = %v, want ErrTimeout", err)
+	}
+}
@@ -0,0 +1,116 @@
+package zmodem
+
+import "time"
+
+// Stats is a snapshot of a Session's wire-level byte accounting, cumulative
+// over every Send and Receive on the Session. Comparing EscapeWritten with
+// PayloadWritten shows what ZDLE escaping costs on a given link, e.g. to choose
+// EscapeStandard or EscapeAll per remote host.
+type Stats struct {
+	// BytesWritten is every byte sent to the transport, including bytes still
+	// queued in the session's output buffer.
+	BytesWritten int64
+	// PayloadWritten is file data sent in data subpackets, before escaping.
+	// Retransmitted data is counted again.
+	PayloadWritten int64
+	// EscapeWritten is the ZDLE bytes added by escaping data, headers and CRCs.
+	EscapeWritten int64
+	// RetransmitWritten is the part of PayloadWritten that had already been
+	// sent once and went out again after the receiver asked for an earlier
+	// offset (ZRPOS).
+	RetransmitWritten int64
+	// FramingWritten is everything else sent: headers, subpacket end markers,
+	// CRCs, XONs, ZFILE metadata and the like.
+	FramingWritten int64
+
+	// BytesRead is every byte read from the transport, including line noise.
+	BytesRead int64
+	// PayloadRead is file data received in good-CRC data subpackets, after
+	// unescaping. Data the receiver already had (an overlapping resend) counts.
+	PayloadRead int64
+	// EscapeRead is the ZDLE escapes removed while decoding.
+	EscapeRead int64
+	// MaxSubpacketRead is the largest subpacket received, in bytes after
+	// unescaping: the peer's block size, in practice, and what the session's
+	// receive buffer has grown to hold.
+	MaxSubpacketRead int
+	// MaxSubpacketWritten is the largest subpacket sent, in bytes before
+	// escaping: the block size the sender's adaptive sizing reached.
+	MaxSubpacketWritten int
+	// SubpacketsWritten and SubpacketsRead count the data subpackets sent
+	// and received with a good CRC, by end type.
+	SubpacketsWritten, SubpacketsRead SubpacketCounts
+	// CRCErrors counts the headers and subpackets received whose CRC did
+	// not match.
+	CRCErrors int64
+	// GarbageRead is the bytes read and skipped as line noise while looking
+	// for a header.
+	GarbageRead int64
+	// RTT is the sender's smoothed round trip from a ZCRCQ or ZCRCW checkpoint
+	// to the receiver's answer, zero until one has been answered. It sets the
+	// checkpoint spacing (Config.MinCheckpointInterval).
+	RTT time.Duration
+}
+
+// SubpacketCounts counts data subpackets by the end type that closed them.
+type SubpacketCounts struct {
+	ZCRCE, ZCRCG, ZCRCQ, ZCRCW int64
+}
+
+// add counts a subpacket ended by endType.
+func (c *SubpacketCounts) add(endType byte) {
+	switch endType {
+	case ZCRCE:
+		c.ZCRCE++
+	case ZCRCG:
+		c.ZCRCG++
+	case ZCRCQ:
+		c.ZCRCQ++
+	case ZCRCW:
+		c.ZCRCW++
+	}
+}
+
+// since returns the counts c has moved by from before.
+func (c SubpacketCounts) since(before SubpacketCounts) SubpacketCounts {
+	return SubpacketCounts{
+		ZCRCE: c.ZCRCE - before.ZCRCE,
+		ZCRCG: c.ZCRCG - before.ZCRCG,
+		ZCRCQ: c.ZCRCQ - before.ZCRCQ,
+		ZCRCW: c.ZCRCW - before.ZCRCW,
+	}
+}
+
+// Stats returns the session's byte accounting. The counters are plain
+// integers updated by the goroutine running Send or Receive, so call Stats
+// from that goroutine (a FileHandler callback, for instance) or after Send or
+// Receive has returned.
+func (s *Session) Stats() Stats {
+	st := s.stats
+	st.BytesWritten = s.tw.wire.total + int64(s.tw.buffered())
+	st.EscapeWritten = s.tw.escapes
+	st.FramingWritten = st.BytesWritten - st.PayloadWritten - st.EscapeWritten
+	st.BytesRead = s.tr.wire.total
+	st.EscapeRead = s.tr.escapes
+	st.GarbageRead = s.tr.garbageTotal
+	st.RTT = s.ckpt.srtt
+	return st
+}
+
+// since returns the counters st has moved by from before; the largest
+// subpackets and RTT are st's own.
+func (st Stats) since(before Stats) Stats {
+	st.BytesWritten -= before.BytesWritten
+	st.PayloadWritten -= before.PayloadWritten
+	st.EscapeWritten -= before.EscapeWritten
+	st.RetransmitWritten -= before.RetransmitWritten
+	st.FramingWritten -= before.FramingWritten
+	st.BytesRead -= before.BytesRead
+	st.PayloadRead -= before.PayloadRead
+	st.EscapeRead -= before.EscapeRead
+	st.SubpacketsWritten = st.SubpacketsWritten.since(before.SubpacketsWritten)
+	st.SubpacketsRead = st.SubpacketsRead.since(before.SubpacketsRead)
+	st.CRCErrors -= before.CRCErrors
+	st.GarbageRead -= before.GarbageRead
+	return st
+}
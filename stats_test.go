@@ -0,0 +1,109 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// transferForStats sends content over a loopback link (the sender writing
+// through wrap, if set) and returns both sessions once the transfer is done.
+func transferForStats(t *testing.T, content []byte, wrap func(io.Writer) io.Writer) (sender, receiver *Session) {
+	t.Helper()
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+	var out io.Writer = w1
+	if wrap != nil {
+		out = wrap(w1)
+	}
+
+	sh := newTestHandler()
+	sh.filesToSend = []*FileOffer{{Name: "stats.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	rh := newTestHandler()
+	sender = NewSession(&pipeReadWriter{Reader: r2, Writer: out}, sh, &Config{Logger: discardLogger()})
+	receiver = NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, rh, &Config{Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send=%v recv=%v", sendErr, recvErr)
+	}
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	if got := rh.receivedFiles["stats.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("content mismatch")
+	}
+	return sender, receiver
+}
+
+func TestStatsEscapeOverheadAllZDLE(t *testing.T) {
+	content := bytes.Repeat([]byte{ZDLE}, 64*1024)
+	sender, receiver := transferForStats(t, content, nil)
+
+	tx := sender.Stats()
+	if tx.PayloadWritten != int64(len(content)) {
+		t.Fatalf("PayloadWritten = %d, want %d", tx.PayloadWritten, len(content))
+	}
+	// Every data byte is escaped; headers and CRCs add only a few more.
+	if ratio := float64(tx.EscapeWritten) / float64(tx.PayloadWritten); ratio < 1.0 || ratio > 1.01 {
+		t.Fatalf("escape overhead = %.3f (%d escapes for %d payload bytes), want ≈ 1.0",
+			ratio, tx.EscapeWritten, tx.PayloadWritten)
+	}
+	if tx.BytesWritten != tx.PayloadWritten+tx.EscapeWritten+tx.FramingWritten {
+		t.Fatalf("BytesWritten %d != payload+escape+framing in %+v", tx.BytesWritten, tx)
+	}
+	if tx.RetransmitWritten != 0 {
+		t.Fatalf("RetransmitWritten = %d on a clean link", tx.RetransmitWritten)
+	}
+
+	rx := receiver.Stats()
+	if rx.PayloadRead != int64(len(content)) {
+		t.Fatalf("PayloadRead = %d, want %d", rx.PayloadRead, len(content))
+	}
+	if ratio := float64(rx.EscapeRead) / float64(rx.PayloadRead); ratio < 1.0 || ratio > 1.01 {
+		t.Fatalf("receive escape overhead = %.3f, want ≈ 1.0", ratio)
+	}
+	if rx.BytesRead < tx.PayloadWritten+tx.EscapeWritten {
+		t.Fatalf("BytesRead = %d, less than the %d escaped payload bytes sent", rx.BytesRead, tx.PayloadWritten+tx.EscapeWritten)
+	}
+}
+
+func TestStatsEscapeOverheadCleanASCII(t *testing.T) {
+	content := bytes.Repeat([]byte("plain ASCII text, nothing to escape here. "), 1500)
+	sender, receiver := transferForStats(t, content, nil)
+
+	tx := sender.Stats()
+	if ratio := float64(tx.EscapeWritten) / float64(tx.PayloadWritten); ratio > 0.001 {
+		t.Fatalf("escape overhead = %.4f (%d escapes), want ≈ 0", ratio, tx.EscapeWritten)
+	}
+	if framing := float64(tx.FramingWritten) / float64(tx.PayloadWritten); framing > 0.05 {
+		t.Fatalf("framing overhead = %.3f, want a few percent", framing)
+	}
+	if rx := receiver.Stats(); rx.EscapeRead > 64 {
+		t.Fatalf("EscapeRead = %d for clean ASCII", rx.EscapeRead)
+	}
+}
+
+func TestStatsRetransmitCounted(t *testing.T) {
+	content := bytes.Repeat([]byte("retransmit accounting "), 4000)
+	sender, _ := transferForStats(t, content, func(w io.Writer) io.Writer {
+		return &corruptingWriter{w: w, targetCount: 3}
+	})
+
+	tx := sender.Stats()
+	if tx.RetransmitWritten == 0 {
+		t.Fatal("RetransmitWritten = 0 after a corrupted subpacket forced a ZRPOS")
+	}
+	if got := tx.PayloadWritten - tx.RetransmitWritten; got != int64(len(content)) {
+		t.Fatalf("PayloadWritten-RetransmitWritten = %d, want the file size %d", got, len(content))
+	}
+}
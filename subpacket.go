@@ -5,17 +5,46 @@ import (
 	"fmt"
 )
 
-// sendSubpacket sends a data subpacket with the given end type.
-// CRC scope: CRC covers data bytes AND the end-type byte itself.
+// sendSubpacket sends a data subpacket with the session's CRC.
 func (s *Session) sendSubpacket(data []byte, endType byte) error {
-	tw := s.tw
+	fw := FrameWriter{tw: s.tw}
+	crc32 := subpacketCRC32(s.txEnc, s.useCRC32)
+	err := fw.WriteSubpacket(data, endType, crc32)
+	if s.cfg.FrameTrace != nil {
+		s.traceSent(s.txHdr, len(data), endType, err)
+	}
+	if err == nil {
+		s.stats.SubpacketsWritten.add(endType)
+		s.stats.MaxSubpacketWritten = max(s.stats.MaxSubpacketWritten, len(data))
+		s.runCRC32 = s.runCRC32 || crc32
+	}
+	return err
+}
+
+// subpacketCRC32 reports whether the subpackets of a frame whose header was
+// encoded as enc carry a CRC-32. The spec ties the CRC to each frame: ZBIN32
+// means CRC-32, ZBIN and ZHEX CRC-16, and senders do mix them (a ZBIN32
+// ZFILE, say, then a ZBIN ZDATA). Before any header (enc 0) it is the
+// session's negotiated mode.
+func subpacketCRC32(enc byte, negotiated bool) bool {
+	if enc == 0 {
+		return negotiated
+	}
+	return enc == ZBIN32
+}
 
-	if s.useCRC32 {
+// WriteSubpacket writes a data subpacket ended by endType (ZCRCE, ZCRCG,
+// ZCRCQ or ZCRCW) with a CRC-32 if crc32 is set and a CRC-16 otherwise.
+// CRC scope: CRC covers data bytes AND the end-type byte itself.
+func (fw *FrameWriter) WriteSubpacket(data []byte, endType byte, crc32 bool) error {
+	tw := fw.tw
+
+	if crc32 {
 		// CRC-32: data + endType byte
 		// Go's crc32.Update(0, table, data) handles init/final XOR internally,
 		// producing the same result as crc32.ChecksumIEEE for incremental use.
 		crc := crc32Update(0, data)
-		crc = crc32Update(crc, []byte{endType})
+		crc = crc32UpdateByte(crc, endType)
 
 		// Write escaped data
 		if err := tw.writeEscaped(data); err != nil {
@@ -31,15 +60,13 @@ func (s *Session) sendSubpacket(data []byte, endType byte) error {
 		}
 
 		// CRC-32 escaped (little-endian)
-		var crcBuf [4]byte
-		binary.LittleEndian.PutUint32(crcBuf[:], crc)
-		if err := tw.writeEscaped(crcBuf[:]); err != nil {
+		if err := tw.writeEscapedCRC32(crc); err != nil {
 			return err
 		}
 	} else {
 		// CRC-16: data + endType byte, then finalize
 		crc := crc16Update(0, data)
-		crc = crc16Update(crc, []byte{endType})
+		crc = crc16UpdateByte(crc, endType)
 		crc = crc16Finalize(crc)
 
 		// Write escaped data
@@ -71,18 +98,64 @@ func (s *Session) sendSubpacket(data []byte, endType byte) error {
 		}
 	}
 
-	return tw.Flush()
+	// ZCRCG continues the frame; every other end type is a point where the
+	// peer may answer or a new frame follows. A Session lets ZCRCG subpackets
+	// accumulate in its write buffer, so a stream goes out in buffer-sized
+	// writes rather than one per block; it flushes before it next reads.
+	if endType == ZCRCG {
+		if tw.batchData {
+			return nil
+		}
+		return tw.Flush()
+	}
+	return tw.flushFrame()
 }
 
-// recvSubpacket reads a data subpacket, returning data and end type.
-// maxLen limits the data size to prevent resource exhaustion.
+// recvSubpacket reads a data subpacket with the CRC of the frame it belongs to
+// (the last header received).
+//
+// The data is decoded into the session's receive buffer and is valid only
+// until the next call; copy what must be kept. The buffer grows to the
+// largest subpacket seen and is kept at that size, so a session holds what
+// its peer's block size needs rather than what MaxBlockSize would allow.
 func (s *Session) recvSubpacket(maxLen int) ([]byte, byte, error) {
-	var data []byte
+	fr := FrameReader{tr: s.tr}
+	crc32 := subpacketCRC32(s.rxEnc, s.useCRC32)
+	data, end, err := fr.readSubpacket(s.rxBuf[:0], maxLen, crc32)
+	if s.cfg.FrameTrace != nil {
+		s.traceReceived(s.rxHdr, len(data), end, err)
+	}
+	if err != nil {
+		s.readError(err)
+		return nil, 0, err
+	}
+	if cap(data) > cap(s.rxBuf) {
+		s.rxBuf = data[:0]
+	}
+	s.subpacketRead(data, end, crc32)
+	return data, end, nil
+}
+
+// subpacketRead counts a good subpacket received.
+func (s *Session) subpacketRead(data []byte, endType byte, crc32 bool) {
+	s.stats.SubpacketsRead.add(endType)
+	s.stats.MaxSubpacketRead = max(s.stats.MaxSubpacketRead, len(data))
+	s.runCRC32 = s.runCRC32 || crc32
+}
+
+// ReadSubpacket reads a data subpacket, returning its data and end type, and
+// checks its CRC-32 if crc32 is set, its CRC-16 otherwise. maxLen limits the
+// data size to prevent resource exhaustion.
+func (fr *FrameReader) ReadSubpacket(maxLen int, crc32 bool) ([]byte, byte, error) {
+	return fr.readSubpacket(nil, maxLen, crc32)
+}
 
-	if s.useCRC32 {
-		return s.recvSubpacketCRC32(maxLen)
+// readSubpacket is ReadSubpacket decoding into dst's spare capacity.
+func (fr *FrameReader) readSubpacket(dst []byte, maxLen int, crc32 bool) ([]byte, byte, error) {
+	if crc32 {
+		return fr.readSubpacketCRC32(dst, maxLen)
 	}
-	return s.recvSubpacketCRC16(data, maxLen)
+	return fr.readSubpacketCRC16(dst, maxLen)
 }
 
 // detectMergedSubpacketCRC16 scans an already-CRC-valid subpacket for an
@@ -123,43 +196,20 @@ func detectMergedSubpacketCRC16(data []byte) int {
 	return -1
 }
 
-func (s *Session) recvSubpacketCRC16(data []byte, maxLen int) ([]byte, byte, error) {
+// readSubpacketData decodes subpacket data up to its end marker, returning
+// the data and end type. Clean runs of already-buffered bytes are taken in
+// bulk (readClean); escapes, flow-control bytes, CANs and buffer refills go
+// through zdlRead one byte at a time.
+func (fr *FrameReader) readSubpacketData(data []byte, maxLen int) ([]byte, byte, error) {
 	for {
-		b, frameEnd, err := s.tr.zdlRead()
+		data = fr.tr.readClean(data, maxLen-len(data))
+		b, frameEnd, err := fr.tr.zdlRead()
 		if err != nil {
 			return nil, 0, fmt.Errorf("subpacket read: %w", err)
 		}
-
 		if frameEnd != 0 {
-			// Read 2-byte CRC (big-endian) via ZDLE decoding
-			crcHi, fe, err := s.tr.zdlRead()
-			if err != nil {
-				return nil, 0, fmt.Errorf("subpacket CRC read: %w", err)
-			}
-			if fe != 0 {
-				return nil, 0, fmt.Errorf("zmodem: unexpected frame end in subpacket CRC")
-			}
-			crcLo, fe, err := s.tr.zdlRead()
-			if err != nil {
-				return nil, 0, fmt.Errorf("subpacket CRC read: %w", err)
-			}
-			if fe != 0 {
-				return nil, 0, fmt.Errorf("zmodem: unexpected frame end in subpacket CRC")
-			}
-
-			// Verify CRC-16: data + endType byte
-			crc := crc16Update(0, data)
-			crc = crc16Update(crc, []byte{frameEnd})
-			crc = crc16Finalize(crc)
-
-			recvCRC := uint16(crcHi)<<8 | uint16(crcLo)
-			if crc != recvCRC {
-				return nil, 0, fmt.Errorf("zmodem: subpacket CRC-16 error (computed=0x%04x, received=0x%04x)", crc, recvCRC)
-			}
-
 			return data, frameEnd, nil
 		}
-
 		if len(data) >= maxLen {
 			return nil, 0, fmt.Errorf("zmodem: subpacket exceeds max length %d", maxLen)
 		}
@@ -167,44 +217,68 @@ func (s *Session) recvSubpacketCRC16(data []byte, maxLen int) ([]byte, byte, err
 	}
 }
 
-func (s *Session) recvSubpacketCRC32(maxLen int) ([]byte, byte, error) {
-	var data []byte
+func (fr *FrameReader) readSubpacketCRC16(data []byte, maxLen int) ([]byte, byte, error) {
+	data, frameEnd, err := fr.readSubpacketData(data, maxLen)
+	if err != nil {
+		return nil, 0, err
+	}
 
-	for {
-		b, frameEnd, err := s.tr.zdlRead()
-		if err != nil {
-			return nil, 0, fmt.Errorf("subpacket read: %w", err)
-		}
+	// Read 2-byte CRC (big-endian) via ZDLE decoding
+	crcHi, fe, err := fr.tr.zdlRead()
+	if err != nil {
+		return nil, 0, fmt.Errorf("subpacket CRC read: %w", err)
+	}
+	if fe != 0 {
+		return nil, 0, fmt.Errorf("zmodem: unexpected frame end in subpacket CRC")
+	}
+	crcLo, fe, err := fr.tr.zdlRead()
+	if err != nil {
+		return nil, 0, fmt.Errorf("subpacket CRC read: %w", err)
+	}
+	if fe != 0 {
+		return nil, 0, fmt.Errorf("zmodem: unexpected frame end in subpacket CRC")
+	}
 
-		if frameEnd != 0 {
-			// Read 4-byte CRC-32 (little-endian) via ZDLE decoding
-			var crcBuf [4]byte
-			for i := range crcBuf {
-				cb, fe, err := s.tr.zdlRead()
-				if err != nil {
-					return nil, 0, fmt.Errorf("subpacket CRC32 read: %w", err)
-				}
-				if fe != 0 {
-					return nil, 0, fmt.Errorf("zmodem: unexpected frame end in subpacket CRC32")
-				}
-				crcBuf[i] = cb
-			}
-
-			// Verify CRC-32: data + endType byte
-			crc := crc32Update(0, data)
-			crc = crc32Update(crc, []byte{frameEnd})
-
-			recvCRC := binary.LittleEndian.Uint32(crcBuf[:])
-			if crc != recvCRC {
-				return nil, 0, fmt.Errorf("zmodem: subpacket CRC-32 error (computed=0x%08x, received=0x%08x)", crc, recvCRC)
-			}
+	// Verify CRC-16: data + endType byte
+	crc := crc16Update(0, data)
+	crc = crc16UpdateByte(crc, frameEnd)
+	crc = crc16Finalize(crc)
 
-			return data, frameEnd, nil
-		}
+	recvCRC := uint16(crcHi)<<8 | uint16(crcLo)
+	if crc != recvCRC {
+		return nil, 0, fmt.Errorf("zmodem: subpacket %w (CRC-16 computed=0x%04x, received=0x%04x)", errBadCRC, crc, recvCRC)
+	}
 
-		if len(data) >= maxLen {
-			return nil, 0, fmt.Errorf("zmodem: subpacket exceeds max length %d", maxLen)
+	return data, frameEnd, nil
+}
+
+func (fr *FrameReader) readSubpacketCRC32(data []byte, maxLen int) ([]byte, byte, error) {
+	data, frameEnd, err := fr.readSubpacketData(data, maxLen)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Read 4-byte CRC-32 (little-endian) via ZDLE decoding
+	var crcBuf [4]byte
+	for i := range crcBuf {
+		cb, fe, err := fr.tr.zdlRead()
+		if err != nil {
+			return nil, 0, fmt.Errorf("subpacket CRC32 read: %w", err)
 		}
-		data = append(data, b)
+		if fe != 0 {
+			return nil, 0, fmt.Errorf("zmodem: unexpected frame end in subpacket CRC32")
+		}
+		crcBuf[i] = cb
+	}
+
+	// Verify CRC-32: data + endType byte
+	crc := crc32Update(0, data)
+	crc = crc32UpdateByte(crc, frameEnd)
+
+	recvCRC := binary.LittleEndian.Uint32(crcBuf[:])
+	if crc != recvCRC {
+		return nil, 0, fmt.Errorf("zmodem: subpacket %w (CRC-32 computed=0x%08x, received=0x%08x)", errBadCRC, crc, recvCRC)
 	}
+
+	return data, frameEnd, nil
 }
@@ -2,8 +2,16 @@ package zmodem
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log/slog"
+	"math/rand/v2"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSubpacketRoundTripCRC16(t *testing.T) {
@@ -42,6 +50,91 @@ func TestSubpacketRoundTripCRC16(t *testing.T) {
 	}
 }
 
+// TestSubpacketCRCFollowsFrame: each frame's subpackets carry the CRC its
+// header's encoding calls for, however the frames before it were encoded,
+// on both the sending and the receiving side.
+func TestSubpacketCRCFollowsFrame(t *testing.T) {
+	var buf bytes.Buffer
+	fw := NewFrameWriter(&buf, EscapeStandard)
+	type frame struct {
+		enc  byte
+		data string
+	}
+	frames := []frame{
+		{ZBIN32, "file.bin\x00123\x00"},
+		{ZBIN, "data after a ZBIN32 frame"},
+		{ZBIN32, "back to CRC-32"},
+		{ZHEX, "hex header, so CRC-16"},
+	}
+	for _, f := range frames {
+		var err error
+		if f.enc == ZHEX {
+			err = fw.WriteHexHeader(makeHeader(ZSINIT))
+		} else {
+			err = fw.WriteBinHeader(makeHeader(ZDATA), f.enc == ZBIN32)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := fw.WriteSubpacket([]byte(f.data), ZCRCW, f.enc == ZBIN32); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A receiver that saw CRC-32 first must not hold on to it.
+	s := &Session{
+		tw:       newTransportWriter(io.Discard, EscapeStandard),
+		tr:       newTransportReader(&buf, 1200, 0, true, slog.Default()),
+		logger:   discardLogger(),
+		useCRC32: true,
+	}
+	for i, f := range frames {
+		hdr, err := s.recvHeader()
+		if err != nil {
+			t.Fatalf("frame %d: header: %v", i, err)
+		}
+		if hdr.Encoding != f.enc {
+			t.Fatalf("frame %d: encoding %#x, want %#x", i, hdr.Encoding, f.enc)
+		}
+		data, _, err := s.recvSubpacket(1024)
+		if err != nil {
+			t.Fatalf("frame %d (encoding %#x): subpacket: %v", i, f.enc, err)
+		}
+		if string(data) != f.data {
+			t.Fatalf("frame %d: got %q, want %q", i, data, f.data)
+		}
+	}
+
+	// A sender's subpackets follow the header it sent, even if the
+	// negotiated mode changes in between.
+	var out bytes.Buffer
+	tx := &Session{
+		tw:     newTransportWriter(&out, EscapeStandard),
+		logger: discardLogger(),
+	}
+	if err := tx.sendBinHeader(makeHeader(ZDATA)); err != nil {
+		t.Fatal(err)
+	}
+	tx.useCRC32 = true
+	if err := tx.sendSubpacket([]byte("still CRC-16"), ZCRCE); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.tw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	rx := &Session{
+		tw:     newTransportWriter(io.Discard, EscapeStandard),
+		tr:     newTransportReader(&out, 1200, 0, true, slog.Default()),
+		logger: discardLogger(),
+	}
+	if _, err := rx.recvHeader(); err != nil {
+		t.Fatal(err)
+	}
+	if data, _, err := rx.recvSubpacket(1024); err != nil || string(data) != "still CRC-16" {
+		t.Fatalf("subpacket after a ZBIN header = %q, %v; want CRC-16 data", data, err)
+	}
+}
+
 func TestSubpacketRoundTripCRC32(t *testing.T) {
 	var buf bytes.Buffer
 
@@ -146,3 +239,323 @@ func frameEndName(et byte) string {
 		return "UNKNOWN"
 	}
 }
+
+func TestFrameWriterReaderSubpacketRoundTrip(t *testing.T) {
+	data := make([]byte, 256)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	for _, crc32 := range []bool{false, true} {
+		for _, et := range []byte{ZCRCE, ZCRCG, ZCRCQ, ZCRCW} {
+			t.Run(fmt.Sprintf("%s/crc32=%v", frameEndName(et), crc32), func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := NewFrameWriter(&buf, EscapeAll).WriteSubpacket(data, et, crc32); err != nil {
+					t.Fatalf("WriteSubpacket: %v", err)
+				}
+				got, gotEnd, err := NewFrameReader(&buf, EscapeAll).ReadSubpacket(1024, crc32)
+				if err != nil {
+					t.Fatalf("ReadSubpacket: %v", err)
+				}
+				if !bytes.Equal(got, data) || gotEnd != et {
+					t.Fatalf("got %d bytes end 0x%02x, want %d bytes end 0x%02x", len(got), gotEnd, len(data), et)
+				}
+			})
+		}
+	}
+}
+
+func TestFrameReaderSubpacketCRCMismatch(t *testing.T) {
+	// A CRC-16 subpacket read as CRC-32 (or vice versa) must not decode.
+	var buf bytes.Buffer
+	if err := NewFrameWriter(&buf, EscapeStandard).WriteSubpacket([]byte("payload"), ZCRCW, false); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := NewFrameReader(&buf, EscapeStandard).ReadSubpacket(1024, true); err == nil {
+		t.Fatal("CRC-16 subpacket accepted as CRC-32")
+	}
+}
+
+// readSubpacketDataPerByte is the reference decoder: one zdlRead per byte.
+func readSubpacketDataPerByte(fr *FrameReader, data []byte, maxLen int) ([]byte, byte, error) {
+	for {
+		b, frameEnd, err := fr.tr.zdlRead()
+		if err != nil {
+			return nil, 0, fmt.Errorf("subpacket read: %w", err)
+		}
+		if frameEnd != 0 {
+			return data, frameEnd, nil
+		}
+		if len(data) >= maxLen {
+			return nil, 0, fmt.Errorf("zmodem: subpacket exceeds max length %d", maxLen)
+		}
+		data = append(data, b)
+	}
+}
+
+// chunkReader returns at most n bytes per Read, so buffer refills land at
+// varying points of the stream.
+type chunkReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	return c.r.Read(p)
+}
+
+// decodeTrace decodes subpackets from stream until an error and records
+// every result plus the reader state the decoder leaves behind.
+func decodeTrace(stream []byte, chunk, maxLen int, strip bool,
+	decode func(*FrameReader, []byte, int) ([]byte, byte, error)) string {
+	tr := newTransportReader(&chunkReader{r: bytes.NewReader(stream), n: chunk}, 64, 0, strip, discardLogger())
+	fr := &FrameReader{tr: tr}
+	var out bytes.Buffer
+	for range 64 {
+		data, end, err := decode(fr, nil, maxLen)
+		fmt.Fprintf(&out, "%x %02x %v | esc=%d garbage=%d can=%d tail=%d\n",
+			data, end, err, tr.escapes, tr.garbageCount, tr.canCount, tr.abortTail)
+		if err != nil && (err == io.EOF || bytes.Contains([]byte(err.Error()), []byte("EOF"))) {
+			break
+		}
+	}
+	return out.String()
+}
+
+// FuzzSubpacketBulkDecode checks the bulk decoder against the per-byte
+// reference on arbitrary input: same data, end types, errors (garbage,
+// abort, overflow) and decoder state, whatever the read chunking.
+func FuzzSubpacketBulkDecode(f *testing.F) {
+	var enc bytes.Buffer
+	fw := NewFrameWriter(&enc, EscapeStandard)
+	fw.WriteSubpacket([]byte("hello\x18\x11\x13\x91\x7f\xff world"), ZCRCG, true)
+	fw.WriteSubpacket(bytes.Repeat([]byte{ZDLE}, 40), ZCRCW, false)
+	f.Add(enc.Bytes(), uint8(7), uint16(1024), true)
+	f.Add(append([]byte("data\x11more\x18\x18\x18\x18\x18\x18\x08\x08rest"), enc.Bytes()...), uint8(3), uint16(16), true)
+	f.Add([]byte("abc\x18\x01\x18\x02def\x18hxyz"), uint8(255), uint16(4), false)
+	f.Add(append(bytes.Repeat([]byte("z"), 300), abortSequence...), uint8(200), uint16(8192), true)
+
+	f.Fuzz(func(t *testing.T, stream []byte, chunk uint8, maxLen uint16, strip bool) {
+		n, limit := int(chunk)+1, int(maxLen)%9000
+		got := decodeTrace(stream, n, limit, strip, (*FrameReader).readSubpacketData)
+		want := decodeTrace(stream, n, limit, strip, readSubpacketDataPerByte)
+		if got != want {
+			t.Fatalf("bulk decoder diverges from per-byte reference\nbulk:\n%s\nper-byte:\n%s", got, want)
+		}
+	})
+}
+
+// FuzzReadSubpacket reads subpackets from arbitrary input in either CRC mode
+// until it runs out: it must not panic, return more than maxLen bytes or an
+// unknown end type, and every subpacket it accepts must come back unchanged
+// through WriteSubpacket.
+func FuzzReadSubpacket(f *testing.F) {
+	for _, crc32 := range []bool{false, true} {
+		var enc bytes.Buffer
+		fw := NewFrameWriter(&enc, EscapeStandard)
+		fw.WriteSubpacket(marshalFileInfo(&FileOffer{Name: "seed.bin", Size: 3000, ModTime: time.Unix(1700000000, 0), Mode: 0644}, 1, 3000), ZCRCW, crc32)
+		fw.WriteSubpacket(randomContent(256), ZCRCG, crc32)
+		fw.WriteSubpacket([]byte("\x18\x10\x11\x13\x90\x91\x93\r\x8d@\x7f\xff"), ZCRCQ, crc32)
+		fw.WriteSubpacket(nil, ZCRCE, crc32)
+		f.Add(enc.Bytes(), uint16(256), crc32)
+		f.Add(enc.Bytes(), uint16(7), crc32)
+	}
+	f.Add([]byte("abc\x18hxyz\x18\x18\x18\x18\x18"), uint16(8192), false)
+	f.Add([]byte("\x18l\x18m\x18\x7f\x18kA\x18\x09"), uint16(16), true)
+
+	f.Fuzz(func(t *testing.T, stream []byte, maxLen uint16, crc32 bool) {
+		limit := int(maxLen) % (maxLargeBlockSize + 1)
+		fr := NewFrameReader(bytes.NewReader(stream), EscapeStandard)
+		for range len(stream) + 1 {
+			data, end, err := fr.ReadSubpacket(limit, crc32)
+			if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, ErrAborted) {
+				return
+			}
+			if err != nil {
+				continue
+			}
+			if len(data) > limit {
+				t.Fatalf("%d bytes of data, limit %d", len(data), limit)
+			}
+			switch end {
+			case ZCRCE, ZCRCG, ZCRCQ, ZCRCW:
+			default:
+				t.Fatalf("end type 0x%02x", end)
+			}
+
+			var out bytes.Buffer
+			if err := NewFrameWriter(&out, EscapeStandard).WriteSubpacket(data, end, crc32); err != nil {
+				t.Fatal(err)
+			}
+			got, gotEnd, err := NewFrameReader(&out, EscapeStandard).ReadSubpacket(limit, crc32)
+			if err != nil || !bytes.Equal(got, data) || gotEnd != end {
+				t.Fatalf("read %x %02x, written back it reads as %x %02x, %v", data, end, got, gotEnd, err)
+			}
+		}
+		t.Fatalf("%d bytes read as more than %d subpackets", len(stream), len(stream))
+	})
+}
+
+// subpacketStream returns 1 MB of random data encoded as 1 KB CRC-32
+// subpackets.
+func subpacketStream(tb testing.TB) []byte {
+	rng := rand.New(rand.NewPCG(5, 6))
+	block := make([]byte, 1024)
+	var enc bytes.Buffer
+	fw := NewFrameWriter(&enc, EscapeStandard)
+	for range 1024 {
+		for i := range block {
+			block[i] = byte(rng.Uint32())
+		}
+		if err := fw.WriteSubpacket(block, ZCRCG, true); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return enc.Bytes()
+}
+
+func benchmarkSubpacketDecode(b *testing.B, decode func(*FrameReader, []byte, int) ([]byte, byte, error)) {
+	stream := subpacketStream(b)
+	b.SetBytes(1 << 20)
+	for b.Loop() {
+		fr := &FrameReader{tr: newTransportReader(bytes.NewReader(stream), 1200, 0, true, discardLogger())}
+		for range 1024 {
+			if _, _, err := decode(fr, nil, 1024); err != nil {
+				b.Fatal(err)
+			}
+			for range 4 { // skip the CRC-32
+				fr.tr.zdlRead()
+			}
+		}
+	}
+}
+
+func BenchmarkSubpacketDecode(b *testing.B) {
+	benchmarkSubpacketDecode(b, (*FrameReader).readSubpacketData)
+}
+
+func BenchmarkSubpacketDecodePerByte(b *testing.B) {
+	benchmarkSubpacketDecode(b, readSubpacketDataPerByte)
+}
+
+// TestSendPathAllocFree: streaming ZCRCG subpackets, and the headers between
+// them, must not allocate.
+func TestSendPathAllocFree(t *testing.T) {
+	block := make([]byte, 1024)
+	for i := range block {
+		block[i] = byte(i) // escapes included
+	}
+	for _, crc32 := range []bool{false, true} {
+		fw := NewFrameWriter(io.Discard, EscapeStandard)
+		if n := testing.AllocsPerRun(100, func() { fw.WriteSubpacket(block, ZCRCG, crc32) }); n != 0 {
+			t.Errorf("crc32=%v: %v allocations per ZCRCG subpacket", crc32, n)
+		}
+		if n := testing.AllocsPerRun(100, func() { fw.WriteBinHeader(makePosHeader(ZDATA, 0x18131191), crc32) }); n != 0 {
+			t.Errorf("crc32=%v: %v allocations per binary header", crc32, n)
+		}
+	}
+	fw := NewFrameWriter(io.Discard, EscapeStandard)
+	if n := testing.AllocsPerRun(100, func() { fw.WriteHexHeader(makePosHeader(ZRPOS, 1234)) }); n != 0 {
+		t.Errorf("%v allocations per hex header", n)
+	}
+}
+
+// TestSenderBufferReusedAcrossFrames sends 1 MB in 8 KB blocks to a
+// half-duplex receiver whose window is one block, so every block ends the
+// frame with ZCRCW and the sender restarts it with a fresh ZDATA. Against the
+// same transfer streamed in one frame, each restart may cost a header's worth
+// of allocations but not another data buffer.
+func TestSenderBufferReusedAcrossFrames(t *testing.T) {
+	const block = 8192
+	content := randomContent(1 << 20)
+	transfer := func(window int) (allocated uint64, restarts int) {
+		r1, w1 := bufferedPipe(256)
+		r2, w2 := bufferedPipe(256)
+		senderT := &halfDuplexMock{r: r2, w: w1}
+		sh := newTestHandler()
+		sh.filesToSend = []*FileOffer{{Name: "w.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+		sender := NewSession(senderT, sh, &Config{MaxBlockSize: block, Logger: discardLogger()})
+		receiver := NewSession(&halfDuplexMock{r: r1, w: w2}, newTestHandler(),
+			&Config{MaxBlockSize: block, WindowSize: window, Logger: discardLogger()})
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		var wg sync.WaitGroup
+		var sendErr, recvErr error
+		wg.Add(2)
+		go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+		go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+		wg.Wait()
+		runtime.ReadMemStats(&after)
+		if sendErr != nil || recvErr != nil {
+			t.Fatalf("window=%d: send=%v recv=%v", window, sendErr, recvErr)
+		}
+		// Each turnaround hands the line to the receiver for its answer.
+		return after.TotalAlloc - before.TotalAlloc, len(senderT.events) / 2
+	}
+
+	streamed, _ := transfer(0)
+	windowed, restarts := transfer(block)
+	if restarts < len(content)/block {
+		t.Fatalf("only %d turnarounds, want a ZCRCW restart per block", restarts)
+	}
+	perRestart := (int64(windowed) - int64(streamed)) / int64(restarts)
+	if perRestart >= block/2 {
+		t.Fatalf("%d bytes allocated per frame restart (%d restarts), want well under a %d-byte block",
+			perRestart, restarts, block)
+	}
+}
+
+// TestReceiveBufferSizedToPeer runs many sessions at once whose senders use
+// 256-byte blocks against receivers allowing 8 KB. Each receiver's buffer
+// should settle at the peer's block size, and receiving should not cost an
+// allocation per subpacket.
+func TestReceiveBufferSizedToPeer(t *testing.T) {
+	const sessions, block = 32, 256
+	content := randomContent(64 << 10)
+	receivers := make([]*Session, sessions)
+	errs := make([]error, 2*sessions)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	var wg sync.WaitGroup
+	for i := range receivers {
+		r1, w1 := bufferedPipe(256)
+		r2, w2 := bufferedPipe(256)
+		sh := newTestHandler()
+		sh.filesToSend = []*FileOffer{{Name: "peer.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+		// The summary each session logs as it ends is a cost per session,
+		// not per subpacket: left out of the count.
+		sender := NewSession(&pipeReadWriter{Reader: r2, Writer: w1}, sh, &Config{MaxBlockSize: block, Logger: discardLogger(), DisableSummaryLog: true})
+		receivers[i] = NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(),
+			&Config{MaxBlockSize: 8192, Logger: discardLogger(), DisableSummaryLog: true})
+		wg.Add(2)
+		go func() { defer wg.Done(); defer w1.Close(); errs[2*i] = sender.Send(ctx) }()
+		go func() { defer wg.Done(); defer w2.Close(); errs[2*i+1] = receivers[i].Receive(ctx) }()
+	}
+	wg.Wait()
+	runtime.ReadMemStats(&after)
+
+	for i, r := range receivers {
+		if errs[2*i] != nil || errs[2*i+1] != nil {
+			t.Fatalf("session %d: send=%v recv=%v", i, errs[2*i], errs[2*i+1])
+		}
+		if got := r.Stats().MaxSubpacketRead; got != block {
+			t.Errorf("session %d: MaxSubpacketRead = %d, want %d", i, got, block)
+		}
+		if c := cap(r.rxBuf); c > 2*block {
+			t.Errorf("session %d: receive buffer grew to %d for %d-byte blocks", i, c, block)
+		}
+	}
+	subpackets := uint64(len(content) / block)
+	if perSession := (after.Mallocs - before.Mallocs) / sessions; perSession >= subpackets {
+		t.Fatalf("%d allocations per session for %d subpackets, want fewer than one each", perSession, subpackets)
+	}
+}
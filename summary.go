@@ -0,0 +1,136 @@
+package zmodem
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// SessionSummary sums up one Send, Receive or Auto, as lrzsz does at exit.
+// The session logs it at Info as it ends ("session summary", unless
+// Config.DisableSummaryLog), and Session.Summary returns it.
+type SessionSummary struct {
+	// Role is "send" or "recv": the one Auto took, or "auto" if it never
+	// learned.
+	Role string
+	// Outcome is SessionOutcome(Err): "ok", "remote abort", "timeout", ...
+	Outcome string
+	Err     error
+	// Duration is from the start of the run to its end.
+	Duration time.Duration
+
+	// FilesAttempted counts the files offered. Each of them ended
+	// completed, skipped by either end, or failed, unless Abort or the
+	// context stopped it.
+	FilesAttempted, FilesCompleted, FilesSkipped, FilesFailed int
+
+	// Stats is the run's share of the session's Stats: payload and wire
+	// bytes both ways, subpackets by end type, data retransmitted, CRC
+	// errors and garbage.
+	Stats Stats
+
+	// CRC32 reports whether data subpackets went with 32-bit CRCs, 16-bit
+	// otherwise.
+	CRC32 bool
+	// EscapeMode is the escaping the run ended with: escape-all if the
+	// receiver asked for it.
+	EscapeMode EscapeMode
+	// BlockSize is the largest data subpacket sent or received.
+	BlockSize int
+	// Window is the receiver's buffer size, 0 for streaming: its ZRINIT's
+	// on a sender, Config.WindowSize on a receiver.
+	Window int
+}
+
+// Summary returns the summary of the last Send, Receive or Auto to end, the
+// zero SessionSummary before one has.
+func (s *Session) Summary() SessionSummary {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastSummary
+}
+
+// beginSummary starts the summary of a run, and returns what ends it with
+// the run's error.
+func (s *Session) beginSummary() func(err error) {
+	s.summary = SessionSummary{}
+	s.runCRC32 = false
+	before := s.Stats()
+	start := time.Now()
+	return func(err error) {
+		sum := s.summary
+		sum.Role = s.logRun.role
+		sum.Outcome = SessionOutcome(err)
+		sum.Err = err
+		sum.Duration = time.Since(start)
+		sum.Stats = s.Stats().since(before)
+		sum.CRC32 = s.runCRC32
+		sum.EscapeMode = s.tw.escapeMode
+		sum.BlockSize = max(sum.Stats.MaxSubpacketWritten, sum.Stats.MaxSubpacketRead)
+		switch sum.Role {
+		case roleSend:
+			sum.Window = s.remoteWindowSize
+		case roleReceive:
+			sum.Window = s.cfg.WindowSize
+		}
+		s.mu.Lock()
+		s.lastSummary = sum
+		s.mu.Unlock()
+		if !s.cfg.DisableSummaryLog {
+			s.endLogFile()
+			s.logSummary(&sum)
+		}
+	}
+}
+
+// fileEnded counts a file's end.
+func (sum *SessionSummary) fileEnded(err error) {
+	switch {
+	case err == nil:
+		sum.FilesCompleted++
+	case errors.Is(err, ErrSkip):
+		sum.FilesSkipped++
+	default:
+		sum.FilesFailed++
+	}
+}
+
+// logSummary logs a run's summary as one Info record.
+func (s *Session) logSummary(sum *SessionSummary) {
+	ctx := context.Background()
+	if !s.logger.Enabled(ctx, slog.LevelInfo) {
+		return
+	}
+	st := &sum.Stats
+	crc := 16
+	if sum.CRC32 {
+		crc = 32
+	}
+	s.logger.LogAttrs(ctx, slog.LevelInfo, "session summary",
+		slog.String("outcome", sum.Outcome),
+		slog.Any("err", sum.Err),
+		slog.Duration("duration", sum.Duration),
+		slog.Attr{Key: "files", Value: slog.GroupValue(
+			slog.Int("attempted", sum.FilesAttempted), slog.Int("completed", sum.FilesCompleted),
+			slog.Int("skipped", sum.FilesSkipped), slog.Int("failed", sum.FilesFailed))},
+		slog.Attr{Key: "payload", Value: slog.GroupValue(
+			slog.Int64("written", st.PayloadWritten), slog.Int64("read", st.PayloadRead))},
+		slog.Attr{Key: "wire", Value: slog.GroupValue(
+			slog.Int64("written", st.BytesWritten), slog.Int64("read", st.BytesRead))},
+		slog.Attr{Key: "subpackets_sent", Value: subpacketsValue(st.SubpacketsWritten)},
+		slog.Attr{Key: "subpackets_received", Value: subpacketsValue(st.SubpacketsRead)},
+		slog.Int64("retransmitted", st.RetransmitWritten),
+		slog.Int64("crc_errors", st.CRCErrors),
+		slog.Int64("garbage", st.GarbageRead),
+		slog.Int("crc", crc),
+		slog.String("escape", sum.EscapeMode.String()),
+		slog.Int("block_size", sum.BlockSize),
+		slog.Int("window", sum.Window),
+	)
+}
+
+func subpacketsValue(c SubpacketCounts) slog.Value {
+	return slog.GroupValue(slog.Int64("zcrce", c.ZCRCE), slog.Int64("zcrcg", c.ZCRCG),
+		slog.Int64("zcrcq", c.ZCRCQ), slog.Int64("zcrcw", c.ZCRCW))
+}
@@ -0,0 +1,90 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestSessionSummary: over a line that corrupts a subpacket, in a batch of
+// three files of which the receiver skips one, each end's summary counts the
+// files, the sender's the data it sent again and the receiver's the CRC
+// error, and it is logged as one Info record.
+func TestSessionSummary(t *testing.T) {
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+	senderHandler := newTestHandler()
+	for i, size := range []int{16384, 2000, 5000} {
+		content := randomContent(size)
+		senderHandler.filesToSend = append(senderHandler.filesToSend,
+			&FileOffer{Name: fmt.Sprintf("sum%d.bin", i), Size: int64(size), Reader: bytes.NewReader(content)})
+	}
+	receiverHandler := newTestHandler()
+	receiverHandler.skipFiles["sum1.bin"] = true
+	sendLog, recvLog := newCaptureHandler(), newCaptureHandler()
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: &corruptingWriter{w: w1, targetCount: 3}}, senderHandler,
+		&Config{MaxBlockSize: 512, Use32BitCRC: true, Logger: slog.New(sendLog)})
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, receiverHandler,
+		&Config{MaxBlockSize: 512, Use32BitCRC: true, Logger: slog.New(recvLog), DisableSummaryLog: true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+
+	sent, received := sender.Summary(), receiver.Summary()
+	for _, side := range []struct {
+		name, role string
+		sum        SessionSummary
+	}{{"sender", roleSend, sent}, {"receiver", roleReceive, received}} {
+		sum := side.sum
+		if sum.Role != side.role || sum.Outcome != OutcomeOK || sum.Err != nil || sum.Duration <= 0 {
+			t.Errorf("%s: role %q outcome %q err %v duration %v", side.name, sum.Role, sum.Outcome, sum.Err, sum.Duration)
+		}
+		if sum.FilesAttempted != 3 || sum.FilesCompleted != 2 || sum.FilesSkipped != 1 || sum.FilesFailed != 0 {
+			t.Errorf("%s: files %d attempted, %d completed, %d skipped, %d failed; want 3, 2, 1, 0", side.name,
+				sum.FilesAttempted, sum.FilesCompleted, sum.FilesSkipped, sum.FilesFailed)
+		}
+		if !sum.CRC32 || sum.BlockSize != 512 || sum.EscapeMode != EscapeStandard {
+			t.Errorf("%s: CRC-32 %v, block size %d, escape %v; want CRC-32 and 512-byte blocks", side.name, sum.CRC32, sum.BlockSize, sum.EscapeMode)
+		}
+	}
+	if st := sent.Stats; st.RetransmitWritten == 0 || st.SubpacketsWritten.ZCRCG == 0 || st.PayloadWritten <= 21384 || st.BytesWritten <= st.PayloadWritten {
+		t.Errorf("sender stats %+v, want data sent again, in ZCRCG subpackets", st)
+	}
+	if st := received.Stats; st.CRCErrors == 0 || st.SubpacketsRead.ZCRCG == 0 || st.PayloadRead < 21384 {
+		t.Errorf("receiver stats %+v, want a CRC error and the data", st)
+	}
+
+	var logged []capturedRecord
+	for _, r := range sendLog.all() {
+		if r.msg == "session summary" {
+			logged = append(logged, r)
+		}
+	}
+	if len(logged) != 1 {
+		t.Fatalf("%d summary records logged by the sender, want 1", len(logged))
+	}
+	a := logged[0].attrs
+	if a["outcome"] != OutcomeOK || a["role"] != roleSend || a["files.attempted"] != "3" || a["files.completed"] != "2" || a["files.skipped"] != "1" ||
+		a["retransmitted"] != strconv.FormatInt(sent.Stats.RetransmitWritten, 10) || a["crc"] != "32" || a["escape"] != "standard" || a["file"] != "" {
+		t.Errorf("summary record %v, want the sender's summary", a)
+	}
+	for _, r := range recvLog.all() {
+		if r.msg == "session summary" {
+			t.Error("the receiver logged a summary with DisableSummaryLog set")
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package zmodem
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Telnet protocol bytes (RFC 854, RFC 856, RFC 858).
+const (
+	telnetIAC  = 0xff // Interpret As Command
+	telnetDONT = 0xfe
+	telnetDO   = 0xfd
+	telnetWONT = 0xfc
+	telnetWILL = 0xfb
+	telnetSB   = 0xfa // subnegotiation begin
+	telnetSE   = 0xf0 // subnegotiation end
+
+	telnetOptBinary = 0x00 // TRANSMIT-BINARY
+	telnetOptSGA    = 0x03 // SUPPRESS-GO-AHEAD
+)
+
+type telnetState int
+
+const (
+	tnData   telnetState = iota // plain data
+	tnIAC                       // saw IAC
+	tnOption                    // saw IAC DO/DONT/WILL/WONT, option byte next
+	tnSB                        // inside IAC SB ... subnegotiation
+	tnSBIAC                     // saw IAC inside a subnegotiation
+)
+
+// telnetConn makes a raw telnet connection safe for ZMODEM. ZMODEM never
+// escapes 0xFF, so on write every IAC is doubled; on read IAC IAC collapses back
+// to one 0xFF and every other telnet command is removed from the byte stream
+// before the session's transportReader sees it. Commands therefore never reach
+// the ZDLE decoder or the garbage counter, no matter where a peer's telnet
+// server injects them.
+type telnetConn struct {
+	rw io.ReadWriter
+
+	// Read-side parser state; survives across Read calls so a command split
+	// over two reads is still recognized.
+	state  telnetState
+	verb   byte
+	rbuf   []byte
+	replyQ []byte // negotiation replies produced while parsing
+
+	// Option states, all disabled to begin with: local[opt] once we have
+	// agreed to WILL opt, remote[opt] once we have agreed to the peer's.
+	local, remote [256]bool
+
+	wmu  sync.Mutex // serializes data writes with negotiation replies
+	wbuf []byte
+}
+
+// telnetDeadlineConn is a telnetConn over a transport with read and write
+// deadlines (e.g. net.Conn); it passes them through so the session's deadline
+// handling keeps working.
+type telnetDeadlineConn struct {
+	*telnetConn
+	dl interface {
+		SetReadDeadline(time.Time) error
+		SetWriteDeadline(time.Time) error
+	}
+}
+
+func (c *telnetDeadlineConn) SetReadDeadline(t time.Time) error  { return c.dl.SetReadDeadline(t) }
+func (c *telnetDeadlineConn) SetWriteDeadline(t time.Time) error { return c.dl.SetWriteDeadline(t) }
+
+// NewTelnetTransport wraps a raw telnet connection for use with NewSession.
+//
+// Outgoing IAC (0xFF) bytes are doubled. Incoming IAC IAC becomes a single
+// 0xFF; IAC GA, IAC NOP and other two-byte commands and IAC SB ... IAC SE
+// subnegotiations are stripped. Option negotiations arriving mid-transfer are
+// answered so the peer does not wait on us: DO/WILL for TRANSMIT-BINARY and
+// SUPPRESS-GO-AHEAD are agreed to, any other DO is refused with WONT and any
+// other WILL with DONT, and DONT/WONT disable an option with WONT/DONT. As RFC
+// 854 asks, a request for the state an option is already in is not answered,
+// so a peer that echoes replies cannot start a negotiation loop.
+//
+// The returned transport supports SetReadDeadline/SetWriteDeadline exactly
+// when rw does.
+func NewTelnetTransport(rw io.ReadWriter) io.ReadWriter {
+	c := &telnetConn{rw: rw}
+	if dl, ok := rw.(interface {
+		SetReadDeadline(time.Time) error
+		SetWriteDeadline(time.Time) error
+	}); ok {
+		return &telnetDeadlineConn{telnetConn: c, dl: dl}
+	}
+	return c
+}
+
+// Read returns decoded data bytes. It never returns (0, nil): a read that
+// yields only telnet commands reads again.
+func (c *telnetConn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if cap(c.rbuf) < len(p) {
+		c.rbuf = make([]byte, len(p))
+	}
+	for {
+		n, err := c.rw.Read(c.rbuf[:len(p)])
+		out := c.decode(c.rbuf[:n], p)
+		if len(c.replyQ) > 0 {
+			reply := c.replyQ
+			c.replyQ = c.replyQ[:0]
+			if werr := c.writeRaw(reply); werr != nil && err == nil && out == 0 {
+				return 0, werr
+			}
+		}
+		if out > 0 || err != nil {
+			return out, err
+		}
+	}
+}
+
+// decode runs the telnet parser over in, writing data bytes to out (which is
+// at least as long as in) and returning how many were produced.
+func (c *telnetConn) decode(in, out []byte) int {
+	n := 0
+	for _, b := range in {
+		switch c.state {
+		case tnData:
+			if b == telnetIAC {
+				c.state = tnIAC
+				continue
+			}
+			out[n] = b
+			n++
+		case tnIAC:
+			switch b {
+			case telnetIAC:
+				out[n] = telnetIAC // escaped 0xFF data byte
+				n++
+				c.state = tnData
+			case telnetDO, telnetDONT, telnetWILL, telnetWONT:
+				c.verb = b
+				c.state = tnOption
+			case telnetSB:
+				c.state = tnSB
+			default:
+				// GA, NOP, DM, BRK, IP, AO, AYT, EC, EL, SE: strip.
+				c.state = tnData
+			}
+		case tnOption:
+			c.negotiate(c.verb, b)
+			c.state = tnData
+		case tnSB:
+			if b == telnetIAC {
+				c.state = tnSBIAC
+			}
+		case tnSBIAC:
+			if b == telnetSE {
+				c.state = tnData
+			} else {
+				c.state = tnSB
+			}
+		}
+	}
+	return n
+}
+
+// negotiate queues the reply to an option request, if it changes the
+// option's state: a DO or WILL we refuse leaves the option disabled and is
+// answered each time, anything else only on a transition.
+func (c *telnetConn) negotiate(verb, opt byte) {
+	agree := opt == telnetOptBinary || opt == telnetOptSGA
+	switch verb {
+	case telnetDO:
+		switch {
+		case !agree:
+			c.replyQ = append(c.replyQ, telnetIAC, telnetWONT, opt)
+		case !c.local[opt]:
+			c.local[opt] = true
+			c.replyQ = append(c.replyQ, telnetIAC, telnetWILL, opt)
+		}
+	case telnetDONT:
+		if c.local[opt] {
+			c.local[opt] = false
+			c.replyQ = append(c.replyQ, telnetIAC, telnetWONT, opt)
+		}
+	case telnetWILL:
+		switch {
+		case !agree:
+			c.replyQ = append(c.replyQ, telnetIAC, telnetDONT, opt)
+		case !c.remote[opt]:
+			c.remote[opt] = true
+			c.replyQ = append(c.replyQ, telnetIAC, telnetDO, opt)
+		}
+	case telnetWONT:
+		if c.remote[opt] {
+			c.remote[opt] = false
+			c.replyQ = append(c.replyQ, telnetIAC, telnetDONT, opt)
+		}
+	}
+}
+
+// Write sends p with every IAC doubled. It reports len(p) on success, not the
+// number of encoded bytes.
+func (c *telnetConn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	c.wbuf = c.wbuf[:0]
+	for _, b := range p {
+		if b == telnetIAC {
+			c.wbuf = append(c.wbuf, telnetIAC)
+		}
+		c.wbuf = append(c.wbuf, b)
+	}
+	if _, err := writeFull(context.Background(), c.rw, c.wbuf); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// writeRaw sends telnet command bytes unescaped.
+func (c *telnetConn) writeRaw(b []byte) error {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	_, err := writeFull(context.Background(), c.rw, b)
+	return err
+}
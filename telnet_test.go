@@ -0,0 +1,179 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestTelnetDecodeStripsCommands(t *testing.T) {
+	in := []byte{
+		'a', telnetIAC, telnetIAC, // escaped 0xFF
+		'b', telnetIAC, 0xf9, // IAC GA
+		'c', telnetIAC, 0xf1, // IAC NOP
+		'd', telnetIAC, telnetDO, 0x01, // IAC DO ECHO → WONT ECHO
+		'e', telnetIAC, telnetSB, 0x18, 0x01, telnetIAC, telnetSE, // IAC SB TTYPE SEND IAC SE
+		'f', telnetIAC, telnetWILL, telnetOptBinary, // IAC WILL BINARY → DO BINARY
+		'g', telnetIAC, telnetDONT, 0x01,
+	}
+	var out bytes.Buffer
+	tc := NewTelnetTransport(&pipeReadWriter{Reader: iotest.OneByteReader(bytes.NewReader(in)), Writer: &out})
+
+	got, err := io.ReadAll(tc)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	want := []byte{'a', 0xff, 'b', 'c', 'd', 'e', 'f', 'g'}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("decoded %v, want %v", got, want)
+	}
+	wantReplies := []byte{telnetIAC, telnetWONT, 0x01, telnetIAC, telnetDO, telnetOptBinary}
+	if !bytes.Equal(out.Bytes(), wantReplies) {
+		t.Fatalf("replies %v, want %v", out.Bytes(), wantReplies)
+	}
+}
+
+// TestTelnetNegotiationRepliesOnChange: a request for the state an option is
+// already in goes unanswered; a refusal is repeated, the option staying off.
+func TestTelnetNegotiationRepliesOnChange(t *testing.T) {
+	const echo = 0x01
+	in := []byte{
+		telnetIAC, telnetDO, telnetOptBinary, // → WILL BINARY
+		telnetIAC, telnetDO, telnetOptBinary, // already on
+		telnetIAC, telnetWILL, telnetOptSGA, // → DO SGA
+		telnetIAC, telnetWILL, telnetOptSGA, // already on
+		telnetIAC, telnetDO, echo, // → WONT ECHO
+		telnetIAC, telnetDO, echo, // → WONT ECHO again
+		telnetIAC, telnetWONT, echo, // never on
+		telnetIAC, telnetDONT, telnetOptBinary, // → WONT BINARY
+		telnetIAC, telnetDONT, telnetOptBinary, // already off
+		telnetIAC, telnetWONT, telnetOptSGA, // → DONT SGA
+		telnetIAC, telnetWONT, telnetOptSGA, // already off
+		telnetIAC, telnetDO, telnetOptBinary, // → WILL BINARY
+		'x',
+	}
+	var out bytes.Buffer
+	tc := NewTelnetTransport(&pipeReadWriter{Reader: bytes.NewReader(in), Writer: &out})
+	if got, err := io.ReadAll(tc); err != nil || string(got) != "x" {
+		t.Fatalf("ReadAll = %q, %v; want \"x\"", got, err)
+	}
+	want := []byte{
+		telnetIAC, telnetWILL, telnetOptBinary,
+		telnetIAC, telnetDO, telnetOptSGA,
+		telnetIAC, telnetWONT, echo,
+		telnetIAC, telnetWONT, echo,
+		telnetIAC, telnetWONT, telnetOptBinary,
+		telnetIAC, telnetDONT, telnetOptSGA,
+		telnetIAC, telnetWILL, telnetOptBinary,
+	}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("replies %v, want %v", out.Bytes(), want)
+	}
+}
+
+func TestTelnetWriteDoublesIAC(t *testing.T) {
+	var out bytes.Buffer
+	tc := NewTelnetTransport(&pipeReadWriter{Reader: &bytes.Buffer{}, Writer: &out})
+	n, err := tc.Write([]byte{0x01, 0xff, 0x02, 0xff, 0xff})
+	if err != nil || n != 5 {
+		t.Fatalf("Write = (%d, %v), want (5, nil)", n, err)
+	}
+	want := []byte{0x01, 0xff, 0xff, 0x02, 0xff, 0xff, 0xff, 0xff}
+	if !bytes.Equal(out.Bytes(), want) {
+		t.Fatalf("wire %v, want %v", out.Bytes(), want)
+	}
+}
+
+func TestTelnetDeadlinePassthrough(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+	if _, ok := NewTelnetTransport(c1).(deadlineSetter); !ok {
+		t.Fatal("telnet transport over net.Conn lost SetReadDeadline")
+	}
+	if _, ok := NewTelnetTransport(c1).(writeDeadlineSetter); !ok {
+		t.Fatal("telnet transport over net.Conn lost SetWriteDeadline")
+	}
+	plain := &pipeReadWriter{Reader: &bytes.Buffer{}, Writer: &bytes.Buffer{}}
+	if _, ok := NewTelnetTransport(plain).(deadlineSetter); ok {
+		t.Fatal("telnet transport claims deadline support the wrapped transport lacks")
+	}
+}
+
+// negotiationInjector models a telnet server that injects option negotiation
+// and NOPs between the data it relays.
+type negotiationInjector struct {
+	mu     sync.Mutex
+	w      io.Writer
+	writes int
+}
+
+func (n *negotiationInjector) Write(p []byte) (int, error) {
+	n.mu.Lock()
+	n.writes++
+	inject := n.writes%3 == 0
+	n.mu.Unlock()
+	if inject {
+		junk := []byte{telnetIAC, telnetDO, 0x01, telnetIAC, 0xf1, telnetIAC, telnetWILL, 0x1f,
+			telnetIAC, telnetSB, 0x1f, 0x00, 0x50, telnetIAC, telnetSE}
+		if _, err := n.w.Write(junk); err != nil {
+			return 0, err
+		}
+	}
+	return n.w.Write(p)
+}
+
+// TestTelnetLoopbackAllByteValues transfers every byte value over a telnet
+// link whose server injects negotiations mid-file in both directions.
+func TestTelnetLoopbackAllByteValues(t *testing.T) {
+	r1, w1 := bufferedPipe(1024)
+	r2, w2 := bufferedPipe(1024)
+
+	senderT := NewTelnetTransport(&pipeReadWriter{Reader: r2, Writer: &negotiationInjector{w: w1}})
+	receiverT := NewTelnetTransport(&pipeReadWriter{Reader: r1, Writer: &negotiationInjector{w: w2}})
+
+	var content []byte
+	for i := 0; i < 64; i++ {
+		for b := 0; b < 256; b++ {
+			content = append(content, byte(b))
+		}
+	}
+
+	sh := newTestHandler()
+	sh.filesToSend = []*FileOffer{{Name: "all256.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	rh := newTestHandler()
+
+	sender := NewSession(senderT, sh, &Config{Use32BitCRC: true, Logger: discardLogger()})
+	receiver := NewSession(receiverT, rh, &Config{Use32BitCRC: true, Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer w1.Close(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer w2.Close(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+
+	if sendErr != nil {
+		t.Fatalf("sender error: %v", sendErr)
+	}
+	if recvErr != nil {
+		t.Fatalf("receiver error: %v", recvErr)
+	}
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	got, ok := rh.receivedFiles["all256.bin"]
+	if !ok {
+		t.Fatal("all256.bin not received")
+	}
+	if !bytes.Equal(got.Bytes(), content) {
+		t.Fatalf("content mismatch: got %d bytes, want %d", got.Len(), len(content))
+	}
+}
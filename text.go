@@ -0,0 +1,51 @@
+package zmodem
+
+import (
+	"bytes"
+	"io"
+)
+
+// cpmEOF (^Z) ends a text file's data, as rz treats it: CP/M padded the last
+// record of a text file with it.
+const cpmEOF = 0x1a
+
+// textWriter stores a file received in text mode (ZCNL) the way rz does:
+// every CR is dropped, so CR LF line ends become LF, and nothing from a ^Z on
+// is kept.
+type textWriter struct {
+	w   io.WriteCloser
+	eof bool // ^Z seen
+}
+
+func newTextWriter(w io.WriteCloser) *textWriter {
+	return &textWriter{w: w}
+}
+
+// Write reports all of p written once the kept bytes are: the dropped ones
+// are the conversion's, not a short write.
+func (t *textWriter) Write(p []byte) (int, error) {
+	if t.eof {
+		return len(p), nil
+	}
+	data := p
+	if i := bytes.IndexByte(data, cpmEOF); i >= 0 {
+		data, t.eof = data[:i], true
+	}
+	for len(data) > 0 {
+		i := bytes.IndexByte(data, '\r')
+		if i < 0 {
+			i = len(data)
+		}
+		if i > 0 {
+			if _, err := t.w.Write(data[:i]); err != nil {
+				return 0, err
+			}
+		}
+		data = data[min(i+1, len(data)):]
+	}
+	return len(p), nil
+}
+
+func (t *textWriter) Close() error {
+	return t.w.Close()
+}
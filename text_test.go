@@ -0,0 +1,126 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTextWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := newTextWriter(&nopWriteCloser{&out})
+	for _, chunk := range []string{"one\r", "\ntwo\n", "\r\r\nthree\rfour", "\r\n\x1atrailing", " junk\r\n"} {
+		if n, err := w.Write([]byte(chunk)); n != len(chunk) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", chunk, n, err)
+		}
+	}
+	if want := "one\ntwo\n\nthreefour\n"; out.String() != want {
+		t.Fatalf("stored %q, want %q", out.String(), want)
+	}
+}
+
+// TestLoopbackTextMode sends LF, CR LF and mixed-ending files offered as text
+// (ZCNL): the receiver stores them with LF line ends, cut at a ^Z, and
+// reports none of them as a size mismatch. The last one is declared with the
+// size of its converted form, as a sender converting to CR LF does.
+func TestLoopbackTextMode(t *testing.T) {
+	files := []struct {
+		name, sent, want string
+		size             int // declared size, if not len(sent)
+	}{
+		{name: "lf.txt", sent: "alpha\nbeta\ngamma\n", want: "alpha\nbeta\ngamma\n"},
+		{name: "crlf.txt", sent: "alpha\r\nbeta\r\ngamma\r\n", want: "alpha\nbeta\ngamma\n"},
+		{name: "mixed.txt", sent: "alpha\r\nbeta\ngamma\r\n", want: "alpha\nbeta\ngamma\n"},
+		{name: "cpm.txt", sent: "alpha\r\n\x1a\x1a\x1a\x1a", want: "alpha\n"},
+		{name: "dos.txt", sent: string(bytes.Repeat([]byte("line\r\n"), 2000)),
+			want: string(bytes.Repeat([]byte("line\n"), 2000)), size: 5 * 2000},
+	}
+
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+	senderHandler := newTestHandler()
+	for _, f := range files {
+		size := f.size
+		if size == 0 {
+			size = len(f.sent)
+		}
+		senderHandler.filesToSend = append(senderHandler.filesToSend,
+			&FileOffer{Name: f.name, Size: int64(size), Reader: bytes.NewReader([]byte(f.sent))})
+	}
+	receiverHandler := newTestHandler()
+
+	sender := NewSession(senderT, senderHandler, &Config{TextMode: true, Logger: discardLogger()})
+	receiver := NewSession(receiverT, receiverHandler, &Config{Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer senderClose()
+		sendErr = sender.Send(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		defer receiverClose()
+		recvErr = receiver.Receive(ctx)
+	}()
+	wg.Wait()
+
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+	receiverHandler.mu.Lock()
+	defer receiverHandler.mu.Unlock()
+	for _, f := range files {
+		got := receiverHandler.receivedFiles[f.name]
+		if got == nil || got.String() != f.want {
+			t.Errorf("%s: stored %q, want %q", f.name, got, f.want)
+		}
+		if err := receiverHandler.completedFiles[f.name]; err != nil {
+			t.Errorf("%s: FileCompleted error %v", f.name, err)
+		}
+	}
+}
+
+// TestLoopbackBinaryNotConverted: without TextMode the same data is stored
+// byte for byte.
+func TestLoopbackBinaryNotConverted(t *testing.T) {
+	content := []byte("alpha\r\nbeta\x1a\r\n")
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+	senderHandler := newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{{Name: "bin.dat", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	receiverHandler := newTestHandler()
+
+	sender := NewSession(senderT, senderHandler, &Config{Logger: discardLogger()})
+	receiver := NewSession(receiverT, receiverHandler, &Config{Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		defer senderClose()
+		sendErr = sender.Send(ctx)
+	}()
+	go func() {
+		defer wg.Done()
+		defer receiverClose()
+		recvErr = receiver.Receive(ctx)
+	}()
+	wg.Wait()
+
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+	if got := receiverHandler.receivedFiles["bin.dat"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatalf("stored %q, want %q", got, content)
+	}
+}
@@ -0,0 +1,46 @@
+package zmodem
+
+import (
+	"context"
+	"errors"
+)
+
+// Direction tells which way a frame given to Config.FrameTrace went.
+type Direction int
+
+const (
+	FrameSent     Direction = iota // written by the session
+	FrameReceived                  // read by the session
+)
+
+func (d Direction) String() string {
+	if d == FrameSent {
+		return "sent"
+	}
+	return "received"
+}
+
+// traceSent reports a header (payloadLen -1) or subpacket the session wrote
+// to Config.FrameTrace.
+func (s *Session) traceSent(hdr Header, payloadLen int, endType byte, err error) {
+	s.cfg.FrameTrace(FrameSent, hdr, payloadLen, endType, err)
+}
+
+// traceReceived reports a header (payloadLen -1) or subpacket the session
+// read to Config.FrameTrace, or the error reading it when that was the
+// frame's fault rather than the line's.
+func (s *Session) traceReceived(hdr Header, payloadLen int, endType byte, err error) {
+	if err != nil && !frameError(err) {
+		return
+	}
+	s.cfg.FrameTrace(FrameReceived, hdr, payloadLen, endType, err)
+}
+
+// frameError reports whether a read error is a frame's: a CRC that does not
+// match, a header that does not parse, an abort. Waiting too long, losing
+// the line or wading through noise with no frame in it are not.
+func frameError(err error) bool {
+	return !isTimeout(err) && !isLostConnection(err) &&
+		!errors.Is(err, errReconnected) && !errors.Is(err, errGarbageOverflow) &&
+		!errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+}
@@ -0,0 +1,187 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// traceEvent is one Config.FrameTrace call.
+type traceEvent struct {
+	dir        Direction
+	hdr        Header
+	payloadLen int
+	endType    byte
+	err        error
+}
+
+func (e traceEvent) String() string {
+	if e.payloadLen < 0 {
+		return fmt.Sprintf("%s %s", e.dir, frameTypeName(e.hdr.Type))
+	}
+	return fmt.Sprintf("%s %s subpacket %d %s", e.dir, frameTypeName(e.hdr.Type), e.payloadLen, frameEndName(e.endType))
+}
+
+// traceRecorder collects a session's trace.
+type traceRecorder struct{ events []traceEvent }
+
+func (r *traceRecorder) trace(dir Direction, hdr Header, payloadLen int, endType byte, err error) {
+	r.events = append(r.events, traceEvent{dir, hdr, payloadLen, endType, err})
+}
+
+// headers returns the headers in the trace, as "sent ZFILE".
+func (r *traceRecorder) headers() []string {
+	var out []string
+	for _, e := range r.events {
+		if e.payloadLen < 0 {
+			out = append(out, e.String())
+		}
+	}
+	return out
+}
+
+// inOrder reports whether want appears in got in order, not necessarily
+// next to each other.
+func inOrder(got, want []string) bool {
+	i := 0
+	for _, g := range got {
+		if i < len(want) && g == want[i] {
+			i++
+		}
+	}
+	return i == len(want)
+}
+
+// TestFrameTraceLoopback records both ends of a transfer: each sees the
+// canonical exchange in order, its own frames as sent and the peer's as
+// received, and the subpackets carry the file.
+func TestFrameTraceLoopback(t *testing.T) {
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+	content := randomContent(5000)
+	senderHandler := newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{{Name: "trace.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+
+	var sendTrace, recvTrace traceRecorder
+	sender := NewSession(senderT, senderHandler,
+		&Config{Use32BitCRC: true, FrameTrace: sendTrace.trace, Logger: discardLogger()})
+	receiver := NewSession(receiverT, newTestHandler(),
+		&Config{Use32BitCRC: true, FrameTrace: recvTrace.trace, Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer senderClose(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer receiverClose(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+
+	canonical := []string{"ZRQINIT", "ZRINIT", "ZFILE", "ZRPOS", "ZDATA", "ZEOF", "ZRINIT", "ZFIN", "ZFIN"}
+	byReceiver := map[string]bool{"ZRINIT": true, "ZRPOS": true}
+	for _, side := range []struct {
+		name  string
+		trace *traceRecorder
+		dir   func(frame string, last bool) Direction
+	}{
+		{"sender", &sendTrace, func(frame string, last bool) Direction {
+			if byReceiver[frame] || last {
+				return FrameReceived
+			}
+			return FrameSent
+		}},
+		{"receiver", &recvTrace, func(frame string, last bool) Direction {
+			if byReceiver[frame] || last {
+				return FrameSent
+			}
+			return FrameReceived
+		}},
+	} {
+		var want []string
+		for i, frame := range canonical {
+			want = append(want, fmt.Sprintf("%s %s", side.dir(frame, i == len(canonical)-1), frame))
+		}
+		if got := side.trace.headers(); !inOrder(got, want) {
+			t.Errorf("%s trace %q\ndoes not have %q in order", side.name, got, want)
+		}
+
+		var data int
+		var zfile bool
+		for _, e := range side.trace.events {
+			if e.err != nil {
+				t.Errorf("%s: %v with error %v", side.name, e, e.err)
+			}
+			switch {
+			case e.payloadLen >= 0 && e.hdr.Type == ZDATA:
+				data += e.payloadLen
+			case e.payloadLen > 0 && e.hdr.Type == ZFILE:
+				zfile = e.endType == ZCRCW
+			case e.payloadLen < 0 && e.hdr.Type == ZDATA && e.hdr.Encoding != ZBIN32:
+				t.Errorf("%s: ZDATA header encoding 0x%02x, want ZBIN32", side.name, e.hdr.Encoding)
+			}
+		}
+		if data != len(content) || !zfile {
+			t.Errorf("%s: ZDATA subpackets carry %d bytes, want %d; ZFILE subpacket seen: %v", side.name, data, len(content), zfile)
+		}
+	}
+}
+
+// TestFrameTraceRejected: a header and a subpacket that fail their CRC are
+// traced with the error; the end of the input is not.
+func TestFrameTraceRejected(t *testing.T) {
+	var wire bytes.Buffer
+	fw := NewFrameWriter(&wire, EscapeStandard)
+	fw.WriteHexHeader(makeHeader(ZRQINIT))
+	garbled := bytes.Clone(wire.Bytes())
+	garbled[len(garbled)-4] ^= 1 // a CRC digit
+	wire.Reset()
+	wire.Write(garbled)
+	fw.WriteBinHeader(makeHeader(ZFILE), false)
+	var sub bytes.Buffer
+	NewFrameWriter(&sub, EscapeStandard).WriteSubpacket(marshalFileInfo(&FileOffer{Name: "x", Size: 1}, 0, 0), ZCRCW, false)
+	sub.Bytes()[0] ^= 1 // the name
+	wire.Write(sub.Bytes())
+
+	var trace traceRecorder
+	s := NewSession(&pipeReadWriter{Reader: &wire, Writer: io.Discard}, newTestHandler(),
+		&Config{FrameTrace: trace.trace, Logger: discardLogger()})
+	s.Receive(context.Background())
+
+	var received []traceEvent
+	for _, e := range trace.events {
+		if e.dir == FrameReceived {
+			received = append(received, e)
+		}
+	}
+	if len(received) != 3 {
+		t.Fatalf("received %v, want the bad header, ZFILE and its bad subpacket", received)
+	}
+	if e := received[0]; e.err == nil || e.hdr != (Header{}) || e.payloadLen != -1 {
+		t.Errorf("garbled header traced as %v, %v", e, e.err)
+	}
+	if e := received[1]; e.err != nil || e.hdr.Type != ZFILE || e.payloadLen != -1 {
+		t.Errorf("ZFILE traced as %v, %v", e, e.err)
+	}
+	if e := received[2]; e.err == nil || e.hdr.Type != ZFILE || e.payloadLen < 0 {
+		t.Errorf("bad ZFILE subpacket traced as %v, %v", e, e.err)
+	}
+}
+
+// TestFrameTraceNilAllocFree: with no FrameTrace, sending a subpacket and a
+// header through the session costs no allocation.
+func TestFrameTraceNilAllocFree(t *testing.T) {
+	s := NewSession(&pipeReadWriter{Reader: &bytes.Buffer{}, Writer: io.Discard}, newTestHandler(), &Config{Logger: discardLogger()})
+	block := make([]byte, 1024)
+	if n := testing.AllocsPerRun(100, func() {
+		s.sendBinHeader(makePosHeader(ZDATA, 0))
+		s.sendSubpacket(block, ZCRCG)
+	}); n != 0 {
+		t.Errorf("%v allocations per header and subpacket", n)
+	}
+}
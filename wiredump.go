@@ -0,0 +1,86 @@
+package zmodem
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Wire dump direction markers: bytes the session wrote, and read.
+const (
+	dumpSent     = ">>"
+	dumpReceived = "<<"
+)
+
+// dumpLineBytes is how many bytes one line of a wire dump shows.
+const dumpLineBytes = 16
+
+// wireDump writes Config.WireDump: every byte the session writes to or reads
+// from its transport, as the transport sees it (escaped, with the XONs, noise
+// and retransmits), one timestamped line of hex and ASCII per 16 bytes:
+//
+//	14:02:33.412 >> 2a 2a 18 42 30 31 30 30 30 30 30 30 32 33 62 65  |**.B0100000023be|
+//
+// Each transport read or write starts a new line, so the lines also show how
+// the bytes were chunked.
+type wireDump struct {
+	w    io.Writer
+	left int64 // bytes still to dump; < 0 for no limit
+	now  func() time.Time
+
+	mu   sync.Mutex
+	line []byte
+}
+
+func newWireDump(w io.Writer, limit int64) *wireDump {
+	left := limit
+	if limit <= 0 {
+		left = -1
+	}
+	return &wireDump{w: w, left: left, now: time.Now}
+}
+
+// dump writes p, moved in the direction marker gives. Once the limit is
+// reached it says so, and dumps nothing more. Write errors are ignored.
+func (d *wireDump) dump(marker string, p []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.left == 0 || len(p) == 0 {
+		return
+	}
+	stamp := d.now().Format("15:04:05.000")
+	if d.left > 0 && int64(len(p)) >= d.left {
+		p = p[:d.left]
+		defer func() {
+			fmt.Fprintf(d.w, "%s -- wire dump limit reached\n", stamp)
+		}()
+	}
+	if d.left > 0 {
+		d.left -= int64(len(p))
+	}
+	for len(p) > 0 {
+		chunk := p[:min(len(p), dumpLineBytes)]
+		p = p[len(chunk):]
+		line := append(d.line[:0], stamp...)
+		line = append(line, ' ')
+		line = append(line, marker...)
+		for i := range dumpLineBytes {
+			if i < len(chunk) {
+				line = fmt.Appendf(line, " %02x", chunk[i])
+			} else {
+				line = append(line, "   "...)
+			}
+		}
+		line = append(line, "  |"...)
+		for _, b := range chunk {
+			if b < 0x20 || b > 0x7e {
+				b = '.'
+			}
+			line = append(line, b)
+		}
+		line = append(line, "|\n"...)
+		d.line = line
+		_, _ = d.w.Write(line)
+	}
+}
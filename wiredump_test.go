@@ -0,0 +1,154 @@
+package zmodem
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// parseWireDump reads a Config.WireDump back into the bytes each way,
+// checking every line's form: the timestamp, the marker, the hex and the
+// ASCII column agreeing with it.
+func parseWireDump(r io.Reader) (sent, received []byte, err error) {
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		stamp, rest, ok := strings.Cut(line, " ")
+		if _, err := time.Parse("15:04:05.000", stamp); !ok || err != nil {
+			return nil, nil, fmt.Errorf("line %d: bad timestamp: %q", n, line)
+		}
+		if rest == "-- wire dump limit reached" {
+			continue
+		}
+		marker, rest, _ := strings.Cut(rest, " ")
+		hexCol, ascii, ok := strings.Cut(rest, "  |")
+		if !ok || !strings.HasSuffix(ascii, "|") || len(hexCol) != 3*dumpLineBytes-1 {
+			return nil, nil, fmt.Errorf("line %d: bad layout: %q", n, line)
+		}
+		b, err := hex.DecodeString(strings.ReplaceAll(strings.TrimRight(hexCol, " "), " ", ""))
+		if err != nil || len(b) == 0 {
+			return nil, nil, fmt.Errorf("line %d: bad hex: %q", n, line)
+		}
+		ascii = strings.TrimSuffix(ascii, "|")
+		for i, c := range b {
+			if c < 0x20 || c > 0x7e {
+				c = '.'
+			}
+			if i >= len(ascii) || ascii[i] != c {
+				return nil, nil, fmt.Errorf("line %d: ASCII column does not match the hex: %q", n, line)
+			}
+		}
+		switch marker {
+		case dumpSent:
+			sent = append(sent, b...)
+		case dumpReceived:
+			received = append(received, b...)
+		default:
+			return nil, nil, fmt.Errorf("line %d: bad marker %q", n, marker)
+		}
+	}
+	return sent, received, sc.Err()
+}
+
+func TestWireDumpFormat(t *testing.T) {
+	var out bytes.Buffer
+	d := newWireDump(&out, 0)
+	d.now = func() time.Time { return time.Date(2024, 3, 1, 14, 2, 33, 412e6, time.UTC) }
+	d.dump(dumpSent, []byte("**\x18B0100000023be50\r\x8a\x11"))
+	d.dump(dumpReceived, []byte("OO"))
+	want := "" +
+		"14:02:33.412 >> 2a 2a 18 42 30 31 30 30 30 30 30 30 32 33 62 65  |**.B0100000023be|\n" +
+		"14:02:33.412 >> 35 30 0d 8a 11                                   |50...|\n" +
+		"14:02:33.412 << 4f 4f                                            |OO|\n"
+	if out.String() != want {
+		t.Fatalf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
+
+// TestWireDumpLimit: the dump stops at WireDumpLimit bytes, saying so once.
+func TestWireDumpLimit(t *testing.T) {
+	var out bytes.Buffer
+	d := newWireDump(&out, 20)
+	block := bytes.Repeat([]byte{'z'}, 16)
+	for range 3 {
+		d.dump(dumpSent, block)
+	}
+	text := out.String()
+	sent, _, err := parseWireDump(strings.NewReader(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sent) != 20 {
+		t.Errorf("dumped %d bytes, limit 20", len(sent))
+	}
+	if n := strings.Count(text, "limit reached"); n != 1 {
+		t.Errorf("limit noted %d times:\n%s", n, text)
+	}
+}
+
+// TestWireDumpLoopback dumps the sender's side of a transfer and rebuilds
+// the exchange from the dump: every byte counted in Stats, the frames each
+// way and the file as it went over the wire.
+func TestWireDumpLoopback(t *testing.T) {
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+	content := randomContent(10000)
+	senderHandler := newTestHandler()
+	senderHandler.filesToSend = []*FileOffer{{Name: "dump.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+
+	var dump bytes.Buffer
+	sender := NewSession(senderT, senderHandler,
+		&Config{Use32BitCRC: true, WireDump: &dump, Logger: discardLogger()})
+	receiver := NewSession(receiverT, newTestHandler(), &Config{Use32BitCRC: true, Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer senderClose(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer receiverClose(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send: %v, receive: %v", sendErr, recvErr)
+	}
+
+	sent, received, err := parseWireDump(&dump)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stats := sender.Stats()
+	if int64(len(sent)) != stats.BytesWritten || int64(len(received)) != stats.BytesRead {
+		t.Errorf("dump has %d bytes sent, %d received; Stats %d, %d",
+			len(sent), len(received), stats.BytesWritten, stats.BytesRead)
+	}
+
+	sentHeaders, files, err := decodeCapture(sent)
+	if err != nil {
+		t.Fatalf("frames sent: %v", err)
+	}
+	receivedHeaders, _, err := decodeCapture(received)
+	if err != nil {
+		t.Fatalf("frames received: %v", err)
+	}
+	for _, tc := range []struct {
+		side      string
+		got, want []string
+	}{
+		{"sent", sentHeaders, []string{"ZRQINIT", "ZFILE", "ZDATA 0", "ZEOF 10000", "ZFIN"}},
+		{"received", receivedHeaders, []string{"ZRINIT", "ZRPOS 0", "ZRINIT", "ZFIN"}},
+	} {
+		if !inOrder(tc.got, tc.want) {
+			t.Errorf("frames %s %q, want %q in order", tc.side, tc.got, tc.want)
+		}
+	}
+	if len(files) != 1 || files[0].name != "dump.bin" || !bytes.Equal(files[0].data, content) {
+		t.Error("dump.bin not in the dump as sent")
+	}
+}
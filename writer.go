@@ -2,41 +2,394 @@ package zmodem
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net"
+	"os"
+	"time"
 )
 
 const writerBufSize = 4096
 
+// directSpanMin is the shortest escape-free run writeEscaped hands straight to
+// the transport when it does not fit in the write buffer, rather than copying
+// it through the buffer a piece at a time.
+const directSpanMin = 2048
+
+// ErrWriteTimeout is returned (wrapped around the transport's own error) when a
+// write to the transport does not complete within Config.SendTimeout — the peer
+// has stopped reading and the kernel/driver send buffer is full.
+var ErrWriteTimeout = errors.New("zmodem: transport write timed out")
+
+// writeDeadlineSetter is implemented by transports that support write deadlines (e.g. net.Conn).
+type writeDeadlineSetter interface {
+	SetWriteDeadline(time.Time) error
+}
+
+// flusher is implemented by transports that hold written bytes until told to
+// send them (SSH channels, websocket adapters, buffered serial wrappers).
+type flusher interface {
+	Flush() error
+}
+
+// wireWriter is the io.Writer beneath the bufio layer: every byte that reaches
+// the transport passes through its Write, so transport-boundary policy (write
+// deadlines, outbound flow control) lives here rather than in each
+// Flush/writeRaw call site. bufio may also write through directly (a raw write
+// larger than its free space), which is covered the same way.
+type wireWriter struct {
+	w               io.Writer
+	ds              writeDeadlineSetter // nil if transport lacks write-deadline support
+	fl              flusher             // nil if transport has no Flush
+	timeout         time.Duration       // per-write deadline (Config.SendTimeout); 0 = disabled
+	armed           bool                // a deadline has been set and must be cleared on exit
+	restoreDeadline time.Time           // deadline left on exit (Config.RestoreDeadline)
+	flow            *flowControl        // outbound XON/XOFF (Config.SoftwareFlowControl); nil = off
+	total           int64               // bytes accepted by the transport
+	turn            *turnaround         // HalfDuplex transport direction; nil = full duplex
+	err             error               // first transport failure, not a context's; sticky (see transportWriter.err)
+	ctx             context.Context     // running Send/Receive; Background outside one
+	pace            *pacer              // Config.EmulatedBaud; nil = full speed
+	chunk           int                 // largest single transport Write (Config.MaxWriteChunk); 0 = any
+	dump            *wireDump           // Config.WireDump; nil = off
+
+	// reconnect, if set, is offered every fatal (non-timeout) transport error;
+	// nil means the transport was replaced and the write continues on it.
+	// reconnected then tells the sender to restart its data frame.
+	reconnect   func(error) error
+	reconnected bool
+}
+
+func (ww *wireWriter) Write(p []byte) (int, error) {
+	if ww.err != nil {
+		return 0, ww.err
+	}
+	if ww.turn != nil {
+		if err := ww.turn.transmit(); err != nil {
+			ww.err = err
+			return 0, err
+		}
+	}
+	if ww.pace == nil && ww.chunk == 0 {
+		return ww.write(p)
+	}
+	chunk := len(p)
+	if ww.chunk > 0 {
+		chunk = min(chunk, ww.chunk)
+	}
+	if ww.pace != nil {
+		chunk = min(chunk, ww.pace.chunk)
+	}
+	n := 0
+	for n < len(p) {
+		if ww.pace != nil {
+			if err := ww.pace.wait(ww.ctx); err != nil {
+				return n, err
+			}
+		}
+		m, err := ww.write(p[n:min(len(p), n+chunk)])
+		if ww.pace != nil {
+			ww.pace.sent(m)
+		}
+		n += m
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// write hands p to the transport under the write deadline, outbound flow
+// control and reconnect policy.
+func (ww *wireWriter) write(p []byte) (int, error) {
+	if ww.flow != nil {
+		if err := ww.flow.wait(ww.ctx); err != nil {
+			return 0, err
+		}
+	}
+	if ww.ds != nil && ww.timeout > 0 {
+		ww.ds.SetWriteDeadline(time.Now().Add(ww.timeout))
+		ww.armed = true
+	}
+	n, err := writeFull(ww.ctx, ww.w, p)
+	ww.total += int64(n)
+	if ww.dump != nil {
+		ww.dump.dump(dumpSent, p[:n])
+	}
+	for err != nil && ww.reconnect != nil && !isTimeout(err) {
+		if rerr := ww.reconnect(err); rerr != nil {
+			ww.err = rerr
+			return n, rerr
+		}
+		// The bytes lost with the old link surface as a framing/CRC error at
+		// the peer; the rest of this write goes out on the new one.
+		ww.reconnected = true
+		var m int
+		m, err = writeFull(ww.ctx, ww.w, p[n:])
+		ww.total += int64(m)
+		if ww.dump != nil {
+			ww.dump.dump(dumpSent, p[n:n+m])
+		}
+		n += m
+	}
+	if err != nil && err != ww.ctx.Err() {
+		if isTimeout(err) {
+			err = fmt.Errorf("%w: %w", ErrWriteTimeout, err)
+		}
+		ww.err = err
+	}
+	return n, err
+}
+
+// writeNow hands p to the transport at once, past outbound flow control and
+// pacing, under the write deadline: the abort sequence, which has to get out
+// however long the line is held.
+func (ww *wireWriter) writeNow(p []byte) error {
+	if ww.turn != nil {
+		if err := ww.turn.transmit(); err != nil {
+			return err
+		}
+	}
+	if ww.ds != nil && ww.timeout > 0 {
+		ww.ds.SetWriteDeadline(time.Now().Add(ww.timeout))
+		ww.armed = true
+	}
+	n, err := writeFull(context.Background(), ww.w, p)
+	ww.total += int64(n)
+	if ww.dump != nil {
+		ww.dump.dump(dumpSent, p[:n])
+	}
+	if err != nil && isTimeout(err) {
+		err = fmt.Errorf("%w: %w", ErrWriteTimeout, err)
+	}
+	return err
+}
+
+// maxEmptyWrites is how many consecutive Writes may accept nothing, without
+// an error, before writeFull gives up with io.ErrNoProgress (as bufio does for
+// empty reads).
+const maxEmptyWrites = 100
+
+// writeFull writes all of p to a transport, retrying short writes. io.Writer
+// requires an error with n < len(p), but some transports (serial wrappers,
+// js/wasm connections) return short counts with a nil error. A wedged
+// transport cannot hold it forever: it stops when ctx is done, on the
+// transport's own error (a write deadline, say), or after maxEmptyWrites
+// writes in a row made no progress.
+func writeFull(ctx context.Context, w io.Writer, p []byte) (int, error) {
+	n, empty := 0, 0
+	for n < len(p) {
+		m, err := w.Write(p[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if n == len(p) {
+			break
+		}
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		if m > 0 {
+			empty = 0
+		} else if empty++; empty >= maxEmptyWrites {
+			return n, io.ErrNoProgress
+		}
+	}
+	return n, nil
+}
+
+// isTimeout reports whether err is a deadline expiration from the transport.
+func isTimeout(err error) bool {
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		return true
+	}
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
 // transportWriter wraps an io.Writer with buffering and ZDLE escaping.
 type transportWriter struct {
 	w          *bufio.Writer
-	table      [256]byte
+	wire       *wireWriter
+	table      *[256]byte // shared, see escapeTableFor
 	lastSent   byte
 	escapeMode EscapeMode
+	escapes    int64 // ZDLE prefixes added by escaping (Stats.EscapeWritten)
+
+	noTransportFlush bool            // Config.DisableTransportFlush
+	batchData        bool            // leave ZCRCG subpackets buffered (see WriteSubpacket)
+	asm              *frameAssembler // Config.AtomicFrames; nil = write through
 }
 
 func newTransportWriter(w io.Writer, mode EscapeMode) *transportWriter {
+	wire := &wireWriter{w: w, ctx: context.Background()}
+	if ds, ok := w.(writeDeadlineSetter); ok {
+		wire.ds = ds
+	}
+	if fl, ok := w.(flusher); ok {
+		wire.fl = fl
+	}
 	tw := &transportWriter{
-		w:          bufio.NewWriterSize(w, writerBufSize),
+		w:          bufio.NewWriterSize(wire, writerBufSize),
+		wire:       wire,
 		escapeMode: mode,
+		table:      escapeTableFor(mode),
 	}
-	tw.table = buildEscapeTable(mode)
 	return tw
 }
 
-// setEscapeMode changes the escape mode and rebuilds the table.
+// frameAssembler collects everything written between two flushes so that a
+// protocol unit reaches the transport as exactly one Write (Config.AtomicFrames).
+type frameAssembler struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (fa *frameAssembler) Write(p []byte) (int, error) {
+	fa.buf = append(fa.buf, p...)
+	return len(p), nil
+}
+
+// emit writes the assembled frame in one call.
+func (fa *frameAssembler) emit() error {
+	if len(fa.buf) == 0 {
+		return nil
+	}
+	_, err := fa.w.Write(fa.buf)
+	fa.buf = fa.buf[:0]
+	return err
+}
+
+// setAtomic switches the writer to assembling whole frames (see
+// Config.AtomicFrames). Call it before anything is written.
+func (tw *transportWriter) setAtomic() {
+	tw.asm = &frameAssembler{w: tw.wire}
+	tw.w.Reset(tw.asm)
+}
+
+// buffered reports bytes accepted but not yet handed to the transport.
+func (tw *transportWriter) buffered() int {
+	n := tw.w.Buffered()
+	if tw.asm != nil {
+		n += len(tw.asm.buf)
+	}
+	return n
+}
+
+// discard drops the bytes accepted but not yet handed to the transport.
+func (tw *transportWriter) discard() {
+	if tw.asm != nil {
+		tw.asm.buf = tw.asm.buf[:0]
+		tw.w.Reset(tw.asm)
+		return
+	}
+	tw.w.Reset(tw.wire)
+}
+
+// setEscapeMode changes the escape mode. lastSent carries over: it is the last
+// byte on the wire whatever mode wrote it, so a CR following an '@' sent in
+// one mode is still escaped if the new mode protects CR.
 func (tw *transportWriter) setEscapeMode(mode EscapeMode) {
 	tw.escapeMode = mode
-	tw.table = buildEscapeTable(mode)
+	tw.table = escapeTableFor(mode)
+}
+
+// err returns the first transport failure, or nil. Once a write or flush has
+// failed, the bytes already queued can never be delivered in order, so the
+// failure is sticky: every later write and flush returns it at once instead of
+// queueing more bytes behind it (bufio would accept them until its buffer
+// filled, and with AtomicFrames it never sees the failure at all). A write
+// the run's context ended is not a transport failure and is not kept.
+func (tw *transportWriter) err() error {
+	return tw.wire.err
+}
+
+// reset clears what an earlier run left in the writer: its transport failure,
+// and the output it did not deliver, which bufio also holds the error of a
+// cancelled write for. Each run starts on a clean writer.
+func (tw *transportWriter) reset() {
+	tw.discard()
+	tw.wire.err = nil
+}
+
+// setSink points the writer at a replacement transport (Session.SetTransport).
+// The old transport's failure goes with it.
+func (tw *transportWriter) setSink(w io.Writer) {
+	tw.wire.w = w
+	tw.wire.err = nil
+	tw.wire.ds, _ = w.(writeDeadlineSetter)
+	tw.wire.fl, _ = w.(flusher)
+	tw.wire.armed = false
+}
+
+// clearDeadline removes the write deadline this writer armed, if any, leaving
+// Config.RestoreDeadline (zero by default) in its place. Called on session exit
+// so callers can reuse the transport without stale deadlines. A caller-managed
+// write deadline (SendTimeout == 0) is left alone.
+func (tw *transportWriter) clearDeadline() {
+	if tw.wire.armed {
+		_ = tw.wire.ds.SetWriteDeadline(tw.wire.restoreDeadline)
+		tw.wire.armed = false
+	}
 }
 
 // Flush writes buffered data to the underlying transport.
 func (tw *transportWriter) Flush() error {
-	return tw.w.Flush()
+	if tw.wire.err != nil {
+		return tw.wire.err
+	}
+	if err := tw.w.Flush(); err != nil {
+		return err
+	}
+	if tw.asm != nil {
+		return tw.asm.emit()
+	}
+	return nil
+}
+
+// flushFrame is Flush at a frame boundary (end of a header, or of a subpacket
+// the peer may answer): it also asks a flushing transport to ship the bytes
+// now instead of holding them for more (see Config.DisableTransportFlush).
+func (tw *transportWriter) flushFrame() error {
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	if tw.wire.fl != nil && !tw.noTransportFlush {
+		if err := tw.wire.fl.Flush(); err != nil {
+			tw.wire.err = fmt.Errorf("zmodem: transport flush: %w", err)
+			return tw.wire.err
+		}
+	}
+	return nil
+}
+
+// writeNow drops the output not yet handed to the transport and writes data
+// in its place at once, flushing a flushing transport (see wireWriter.writeNow).
+func (tw *transportWriter) writeNow(data []byte) error {
+	tw.discard()
+	tw.wire.err = nil
+	if err := tw.wire.writeNow(data); err != nil {
+		return err
+	}
+	if len(data) > 0 {
+		tw.lastSent = data[len(data)-1]
+	}
+	if tw.wire.fl != nil && !tw.noTransportFlush {
+		if err := tw.wire.fl.Flush(); err != nil {
+			return fmt.Errorf("zmodem: transport flush: %w", err)
+		}
+	}
+	return nil
 }
 
 // writeRaw writes bytes directly without escaping.
 func (tw *transportWriter) writeRaw(data []byte) error {
+	if tw.wire.err != nil {
+		return tw.wire.err
+	}
 	_, err := tw.w.Write(data)
 	if len(data) > 0 {
 		tw.lastSent = data[len(data)-1]
@@ -46,6 +399,9 @@ func (tw *transportWriter) writeRaw(data []byte) error {
 
 // writeByte writes a single raw byte.
 func (tw *transportWriter) writeByte(b byte) error {
+	if tw.wire.err != nil {
+		return tw.wire.err
+	}
 	err := tw.w.WriteByte(b)
 	if err == nil {
 		tw.lastSent = b
@@ -54,22 +410,79 @@ func (tw *transportWriter) writeByte(b byte) error {
 }
 
 // writeEscaped writes bytes with ZDLE escaping.
+// It scans for the next byte that needs escaping and emits each clean run with
+// a single Write. The escIfAtCR rule depends on the previously sent byte, which
+// inside a clean run is simply the preceding data byte.
 func (tw *transportWriter) writeEscaped(data []byte) error {
-	for _, b := range data {
-		if err := tw.writeEscapedByte(b); err != nil {
+	if tw.wire.err != nil {
+		return tw.wire.err
+	}
+	start := 0
+	last := tw.lastSent
+	for i, b := range data {
+		if !escapeRequired(tw.table, b, last) {
+			last = b
+			continue
+		}
+		if i > start {
+			if err := tw.writeSpan(data[start:i]); err != nil {
+				return err
+			}
+		}
+		esc1, esc2 := escapeByte(b)
+		if err := tw.w.WriteByte(esc1); err != nil {
+			return err
+		}
+		if err := tw.w.WriteByte(esc2); err != nil {
+			return err
+		}
+		tw.escapes++
+		last = esc2
+		start = i + 1
+	}
+	if start < len(data) {
+		if err := tw.writeSpan(data[start:]); err != nil {
 			return err
 		}
 	}
+	tw.lastSent = last
 	return nil
 }
 
+// writeSpan writes a run of bytes that need no escaping. A run that fits in
+// the write buffer is copied into it as usual. A longer one of at least
+// directSpanMin bytes skips the buffer: what is buffered goes out first, then
+// the run in one Write, so the transport sees the same bytes in the same
+// order with one copy fewer. With AtomicFrames the run still lands in the
+// frame being assembled.
+func (tw *transportWriter) writeSpan(p []byte) error {
+	if len(p) < directSpanMin || len(p) <= tw.w.Available() {
+		_, err := tw.w.Write(p)
+		return err
+	}
+	if err := tw.w.Flush(); err != nil {
+		return err
+	}
+	var err error
+	if tw.asm != nil {
+		_, err = tw.asm.Write(p)
+	} else {
+		_, err = tw.wire.Write(p)
+	}
+	return err
+}
+
 // writeEscapedByte writes a single byte, escaping if needed.
 func (tw *transportWriter) writeEscapedByte(b byte) error {
-	if escapeRequired(&tw.table, b, tw.lastSent) {
+	if tw.wire.err != nil {
+		return tw.wire.err
+	}
+	if escapeRequired(tw.table, b, tw.lastSent) {
 		esc1, esc2 := escapeByte(b)
 		if err := tw.w.WriteByte(esc1); err != nil {
 			return err
 		}
+		tw.escapes++
 		tw.lastSent = esc2
 		return tw.w.WriteByte(esc2)
 	}
@@ -77,6 +490,17 @@ func (tw *transportWriter) writeEscapedByte(b byte) error {
 	return tw.w.WriteByte(b)
 }
 
+// writeEscapedCRC32 writes a CRC-32 escaped, least significant byte first.
+func (tw *transportWriter) writeEscapedCRC32(crc uint32) error {
+	for range 4 {
+		if err := tw.writeEscapedByte(byte(crc)); err != nil {
+			return err
+		}
+		crc >>= 8
+	}
+	return nil
+}
+
 // writeHex writes a byte as two lowercase hex digits.
 func (tw *transportWriter) writeHex(b byte) error {
 	const hexDigits = "0123456789abcdef"
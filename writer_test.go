@@ -0,0 +1,762 @@
+package zmodem
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestSendTimeoutStalledPeer: a peer that never reads must not wedge the sender
+// inside Flush. With SendTimeout set on a deadline-capable transport the session
+// fails promptly with ErrWriteTimeout.
+func TestSendTimeoutStalledPeer(t *testing.T) {
+	c1, c2 := net.Pipe() // synchronous: writes block until the far end reads
+	defer c1.Close()
+	defer c2.Close()
+
+	h := newTestHandler()
+	s := NewSession(c1, h, &Config{SendTimeout: 100 * time.Millisecond, Logger: discardLogger()})
+
+	done := make(chan error, 1)
+	go func() { done <- s.Send(context.Background()) }()
+
+	select {
+	case err := <-done:
+		if !errors.Is(err, ErrWriteTimeout) {
+			t.Fatalf("Send error = %v, want ErrWriteTimeout", err)
+		}
+		var ne net.Error
+		if !errors.As(err, &ne) || !ne.Timeout() {
+			t.Fatalf("Send error = %v, want the transport timeout preserved", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Send blocked on a stalled peer despite SendTimeout")
+	}
+}
+
+// recordingDeadlineWriter records every write deadline applied to it.
+type recordingDeadlineWriter struct {
+	deadlines []time.Time
+}
+
+func (w *recordingDeadlineWriter) Write(p []byte) (int, error) { return len(p), nil }
+func (w *recordingDeadlineWriter) SetWriteDeadline(t time.Time) error {
+	w.deadlines = append(w.deadlines, t)
+	return nil
+}
+
+func TestWriteDeadlineArmedAndCleared(t *testing.T) {
+	w := &recordingDeadlineWriter{}
+	tw := newTransportWriter(w, EscapeStandard)
+	tw.wire.timeout = time.Second
+
+	tw.writeRaw([]byte("hello"))
+	if len(w.deadlines) != 0 {
+		t.Fatalf("deadline armed before flush: %v", w.deadlines)
+	}
+	if err := tw.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if len(w.deadlines) != 1 || w.deadlines[0].IsZero() {
+		t.Fatalf("deadlines after flush = %v, want one non-zero deadline", w.deadlines)
+	}
+
+	tw.clearDeadline()
+	if last := w.deadlines[len(w.deadlines)-1]; !last.IsZero() {
+		t.Fatalf("final deadline = %v, want cleared", last)
+	}
+}
+
+func TestWriteDeadlineUntouchedWhenDisabled(t *testing.T) {
+	w := &recordingDeadlineWriter{}
+	tw := newTransportWriter(w, EscapeStandard)
+
+	tw.writeRaw([]byte("hello"))
+	tw.Flush()
+	tw.clearDeadline()
+	if len(w.deadlines) != 0 {
+		t.Fatalf("SendTimeout=0 touched the write deadline: %v", w.deadlines)
+	}
+}
+
+// writeEscapedPerByte is the reference encoder: one writeEscapedByte per byte.
+func writeEscapedPerByte(tw *transportWriter, data []byte) error {
+	for _, b := range data {
+		if err := tw.writeEscapedByte(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// TestWriteEscapedMatchesPerByte checks the run-scanning encoder against the
+// per-byte reference in every escape mode, including lastSent carried across
+// calls (the CR-after-@ rule spans call boundaries).
+func TestWriteEscapedMatchesPerByte(t *testing.T) {
+	rng := rand.New(rand.NewPCG(1, 2))
+	random := make([]byte, 64*1024)
+	for i := range random {
+		random[i] = byte(rng.Uint32())
+	}
+	allZDLE := bytes.Repeat([]byte{ZDLE}, 4096)
+	crAfterAt := bytes.Repeat([]byte{'@', 0x0d, 0xc0, 0x8d, 'x', 0x0d, '@', '@', 0x0d}, 512)
+	every := make([]byte, 256)
+	for i := range every {
+		every[i] = byte(i)
+	}
+	// Clean runs long enough for writeSpan's direct path, broken now and then
+	// by an escape.
+	text := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog.\n"), 1500)
+	for i := 5000; i < len(text); i += 7919 {
+		text[i] = ZDLE
+	}
+
+	corpora := map[string][]byte{
+		"random": random, "allZDLE": allZDLE, "crAfterAt": crAfterAt, "every": every, "empty": nil, "text": text,
+	}
+	for _, mode := range []EscapeMode{EscapeStandard, EscapeAll, EscapeMinimal} {
+		for name, data := range corpora {
+			var got, want bytes.Buffer
+			twGot := newTransportWriter(&got, mode)
+			twWant := newTransportWriter(&want, mode)
+			// Split into uneven chunks so lastSent crosses call boundaries;
+			// every so often a long one.
+			for off := 0; off < len(data); {
+				limit := uint32(300)
+				if rng.Uint32()%4 == 0 {
+					limit = 12000
+				}
+				n := min(1+int(rng.Uint32()%limit), len(data)-off)
+				if err := twGot.writeEscaped(data[off : off+n]); err != nil {
+					t.Fatal(err)
+				}
+				if err := writeEscapedPerByte(twWant, data[off:off+n]); err != nil {
+					t.Fatal(err)
+				}
+				off += n
+			}
+			twGot.Flush()
+			twWant.Flush()
+			if !bytes.Equal(got.Bytes(), want.Bytes()) {
+				t.Errorf("mode %d corpus %s: run encoder output differs from per-byte reference", mode, name)
+			}
+			if twGot.lastSent != twWant.lastSent {
+				t.Errorf("mode %d corpus %s: lastSent = 0x%02x, want 0x%02x", mode, name, twGot.lastSent, twWant.lastSent)
+			}
+		}
+	}
+}
+
+func benchmarkWriteEscaped(b *testing.B, encode func(*transportWriter, []byte) error) {
+	data := make([]byte, 8192)
+	rng := rand.New(rand.NewPCG(3, 4))
+	for i := range data {
+		data[i] = byte(rng.Uint32())
+	}
+	tw := newTransportWriter(io.Discard, EscapeStandard)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := encode(tw, data); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkWriteEscaped(b *testing.B) {
+	benchmarkWriteEscaped(b, (*transportWriter).writeEscaped)
+}
+
+func BenchmarkWriteEscapedPerByte(b *testing.B) {
+	benchmarkWriteEscaped(b, writeEscapedPerByte)
+}
+
+// BenchmarkWriteSubpacketClean sends 8 KB ZCRCG subpackets that need no
+// escaping, each behind a ZDATA header so the write buffer is never empty
+// when the block arrives.
+func BenchmarkWriteSubpacketClean(b *testing.B) {
+	block := bytes.Repeat([]byte("0123456789abcdef"), 512)
+	fw := NewFrameWriter(io.Discard, EscapeStandard)
+	b.SetBytes(int64(len(block)))
+	for b.Loop() {
+		fw.WriteBinHeader(makePosHeader(ZDATA, 0), true)
+		if err := fw.WriteSubpacket(block, ZCRCG, true); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestLargeSpanWrittenDirectly(t *testing.T) {
+	block := bytes.Repeat([]byte("0123456789abcdef"), 512)
+	for _, tc := range []struct {
+		name string
+		cfg  Config
+	}{
+		{"direct", Config{}},
+		{"atomic", Config{AtomicFrames: true}},
+		{"chunked", Config{MaxWriteChunk: 1024}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			w := &writeLog{}
+			tc.cfg.Logger = discardLogger()
+			s := NewSession(w, newTestHandler(), &tc.cfg)
+			if err := s.sendBinHeader(makePosHeader(ZDATA, 0)); err != nil {
+				t.Fatal(err)
+			}
+			if err := s.sendSubpacket(block, ZCRCW); err != nil {
+				t.Fatal(err)
+			}
+			wire := bytes.Join(w.writes, nil)
+			fr := NewFrameReader(bytes.NewReader(wire), EscapeStandard)
+			if hdr, err := fr.ReadHeader(); err != nil || hdr.Type != ZDATA {
+				t.Fatalf("ReadHeader = %s, %v", hdr, err)
+			}
+			if data, end, err := fr.ReadSubpacket(len(block), false); err != nil || end != ZCRCW || !bytes.Equal(data, block) {
+				t.Fatalf("ReadSubpacket: %d bytes, end %s, %v", len(data), frameEndName(end), err)
+			}
+			if st := s.Stats(); st.BytesWritten != int64(len(wire)) {
+				t.Fatalf("Stats.BytesWritten = %d, want %d", st.BytesWritten, len(wire))
+			}
+			switch tc.name {
+			case "direct":
+				// Header, the block as is, and the frame end.
+				if len(w.writes) != 3 || !bytes.Equal(w.writes[1], block) {
+					t.Fatalf("%d writes, want the block alone in the second of 3", len(w.writes))
+				}
+			case "atomic":
+				// ZDATA and its subpacket are one unit.
+				if len(w.writes) != 1 {
+					t.Fatalf("%d writes, want 1", len(w.writes))
+				}
+			case "chunked":
+				for i, p := range w.writes {
+					if len(p) > 1024 {
+						t.Fatalf("write %d is %d bytes, over MaxWriteChunk", i, len(p))
+					}
+				}
+			}
+		})
+	}
+}
+
+// writeLog is a transport that records each Write separately.
+type writeLog struct {
+	writes [][]byte
+}
+
+func (w *writeLog) Read([]byte) (int, error) { return 0, io.EOF }
+func (w *writeLog) Write(p []byte) (int, error) {
+	w.writes = append(w.writes, append([]byte(nil), p...))
+	return len(p), nil
+}
+
+// emitFrames sends a representative sequence of protocol units and reports
+// how many units it sent.
+func emitFrames(t *testing.T, s *Session, block []byte) int {
+	t.Helper()
+	steps := []func() error{
+		func() error { return s.sendHexHeader(makeHeader(ZRQINIT)) },
+		func() error {
+			if err := s.sendBinHeader(makeHeader(ZFILE)); err != nil {
+				return err
+			}
+			return s.sendSubpacket([]byte("name\x0012345 0 0\x00"), ZCRCW)
+		},
+		func() error {
+			if err := s.sendBinHeaderWithZnulls(makePosHeader(ZDATA, 0)); err != nil {
+				return err
+			}
+			return s.sendSubpacket(block, ZCRCG)
+		},
+		func() error { return s.sendSubpacket(block, ZCRCQ) },
+		func() error { return s.sendSubpacket(block[:100], ZCRCE) },
+		func() error { return s.sendHexHeader(makePosHeader(ZEOF, int64(2*len(block)+100))) },
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("unit %d: %v", i, err)
+		}
+	}
+	return len(steps)
+}
+
+func TestAtomicFramesOneWritePerUnit(t *testing.T) {
+	// An 8 KiB block full of bytes needing escapes is far larger than the
+	// bufio buffer, so the assembler must gather several internal flushes.
+	block := make([]byte, 8192)
+	rng := rand.New(rand.NewPCG(7, 9))
+	for i := range block {
+		block[i] = byte(rng.IntN(256))
+	}
+	cfg := Config{MaxBlockSize: 8192, Znulls: 4, Use32BitCRC: true, Logger: discardLogger()}
+
+	plain := &writeLog{}
+	ps := NewSession(plain, newTestHandler(), &cfg)
+	ps.useCRC32 = true
+	emitFrames(t, ps, block)
+
+	atomicCfg := cfg
+	atomicCfg.AtomicFrames = true
+	atomic := &writeLog{}
+	as := NewSession(atomic, newTestHandler(), &atomicCfg)
+	as.useCRC32 = true
+	units := emitFrames(t, as, block)
+
+	if len(atomic.writes) != units {
+		t.Fatalf("%d transport writes for %d protocol units", len(atomic.writes), units)
+	}
+	if got, want := bytes.Join(atomic.writes, nil), bytes.Join(plain.writes, nil); !bytes.Equal(got, want) {
+		t.Fatalf("atomic output differs from streaming output (%d vs %d bytes)", len(got), len(want))
+	}
+	for i, w := range atomic.writes {
+		if i != 3 && i != 4 && w[0] != ZPAD && w[0] != 0 {
+			t.Fatalf("write %d does not start a frame: % x", i, w[:8])
+		}
+	}
+	if st := as.Stats(); st.BytesWritten != int64(len(bytes.Join(atomic.writes, nil))) {
+		t.Fatalf("Stats.BytesWritten = %d, want %d", st.BytesWritten, len(bytes.Join(atomic.writes, nil)))
+	}
+}
+
+func TestLoopbackAtomicFrames(t *testing.T) {
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+	content := make([]byte, 100_000)
+	rng := rand.New(rand.NewPCG(1, 2))
+	for i := range content {
+		content[i] = byte(rng.IntN(256))
+	}
+	sh := newTestHandler()
+	sh.filesToSend = []*FileOffer{{Name: "atomic.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	rh := newTestHandler()
+	cfg := &Config{AtomicFrames: true, MaxBlockSize: 8192, Logger: discardLogger()}
+	sender := NewSession(senderT, sh, cfg)
+	receiver := NewSession(receiverT, rh, cfg)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	errs := make(chan error, 2)
+	go func() { defer senderClose(); errs <- sender.Send(ctx) }()
+	go func() { defer receiverClose(); errs <- receiver.Receive(ctx) }()
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	rh.mu.Lock()
+	defer rh.mu.Unlock()
+	if got := rh.receivedFiles["atomic.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("content mismatch")
+	}
+}
+
+// dyingWriter accepts limit bytes, then fails every Write with a connection
+// reset, counting the calls made after the first failure.
+type dyingWriter struct {
+	w          io.Writer
+	limit      int
+	written    int
+	callsAfter int
+}
+
+var errLinkReset = &net.OpError{Op: "write", Net: "tcp", Err: syscall.ECONNRESET}
+
+func (d *dyingWriter) Write(p []byte) (int, error) {
+	if d.written >= d.limit {
+		d.callsAfter++
+		return 0, errLinkReset
+	}
+	n := min(len(p), d.limit-d.written)
+	n, err := d.w.Write(p[:n])
+	d.written += n
+	if err == nil && n < len(p) {
+		err = errLinkReset
+	}
+	return n, err
+}
+
+func TestWriteErrorSticky(t *testing.T) {
+	for _, atomic := range []bool{false, true} {
+		d := &dyingWriter{w: io.Discard, limit: 10}
+		tw := newTransportWriter(d, EscapeStandard)
+		if atomic {
+			tw.setAtomic()
+		}
+		tw.writeRaw(make([]byte, 64))
+		if err := tw.Flush(); !errors.Is(err, syscall.ECONNRESET) {
+			t.Fatalf("atomic=%v: Flush = %v, want the transport's error", atomic, err)
+		}
+		// Everything after the failure returns it without touching the
+		// transport, though the buffer has room to accept it.
+		for name, write := range map[string]func() error{
+			"writeRaw":     func() error { return tw.writeRaw([]byte("x")) },
+			"writeByte":    func() error { return tw.writeByte('x') },
+			"writeEscaped": func() error { return tw.writeEscaped([]byte{ZDLE}) },
+			"Flush":        tw.Flush,
+			"flushFrame":   tw.flushFrame,
+		} {
+			if err := write(); !errors.Is(err, syscall.ECONNRESET) {
+				t.Fatalf("atomic=%v: %s after failure = %v, want the transport's error", atomic, name, err)
+			}
+		}
+		if d.callsAfter != 0 {
+			t.Fatalf("atomic=%v: %d transport writes after the failure", atomic, d.callsAfter)
+		}
+	}
+}
+
+func TestSendFailsPromptlyOnTransportError(t *testing.T) {
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+	// Die in the middle of a data subpacket, well into the file.
+	d := &dyingWriter{w: w1, limit: 20000 + 37}
+
+	content := bytes.Repeat([]byte("sticky write error "), 5000)
+	sh := newTestHandler()
+	sh.filesToSend = []*FileOffer{{Name: "dies.txt", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: d}, sh, &Config{Logger: discardLogger()})
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, newTestHandler(), &Config{RecvTimeout: time.Second, Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	recvDone := make(chan struct{})
+	go func() { defer close(recvDone); defer w2.Close(); receiver.Receive(ctx) }()
+
+	start := time.Now()
+	err := sender.Send(ctx)
+	elapsed := time.Since(start)
+	w1.Close()
+	<-recvDone
+
+	var opErr *net.OpError
+	if !errors.Is(err, syscall.ECONNRESET) || !errors.As(err, &opErr) {
+		t.Fatalf("Send = %v, want the transport's *net.OpError", err)
+	}
+	if d.callsAfter != 0 {
+		t.Fatalf("sender made %d more transport writes after the failure", d.callsAfter)
+	}
+	if elapsed > 500*time.Millisecond {
+		t.Fatalf("Send took %v to notice a dead transport", elapsed)
+	}
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	if got, ok := sh.completedFiles["dies.txt"]; !ok || !errors.Is(got, syscall.ECONNRESET) {
+		t.Fatalf("FileCompleted(dies.txt) = %v (reported %v), want the transport's error", got, ok)
+	}
+}
+
+// trickleWriter accepts at most 3 bytes per Write and reports short writes
+// with a nil error, as some serial and js/wasm transports do.
+type trickleWriter struct {
+	bytes.Buffer
+}
+
+func (w *trickleWriter) Read([]byte) (int, error) { return 0, io.EOF }
+func (w *trickleWriter) Write(p []byte) (int, error) {
+	return w.Buffer.Write(p[:min(len(p), 3)])
+}
+
+func TestShortWritesRetried(t *testing.T) {
+	block := bytes.Repeat([]byte{'a', ZDLE, 'b'}, 2000)
+	for _, atomic := range []bool{false, true} {
+		w := &trickleWriter{}
+		s := NewSession(w, newTestHandler(), &Config{AtomicFrames: atomic, Logger: discardLogger()})
+		if err := s.sendBinHeader(makePosHeader(ZDATA, 0)); err != nil {
+			t.Fatalf("atomic=%v: %v", atomic, err)
+		}
+		if err := s.sendSubpacket(block, ZCRCW); err != nil {
+			t.Fatalf("atomic=%v: %v", atomic, err)
+		}
+		if err := s.Abort(); err != nil {
+			t.Fatalf("atomic=%v: %v", atomic, err)
+		}
+
+		fr := NewFrameReader(bytes.NewReader(w.Bytes()), EscapeStandard)
+		if hdr, err := fr.ReadHeader(); err != nil || hdr.Type != ZDATA {
+			t.Fatalf("atomic=%v: ReadHeader = %s, %v", atomic, hdr, err)
+		}
+		if data, _, err := fr.ReadSubpacket(len(block), false); err != nil || !bytes.Equal(data, block) {
+			t.Fatalf("atomic=%v: ReadSubpacket: %d bytes, %v", atomic, len(data), err)
+		}
+		if !bytes.HasSuffix(w.Bytes(), abortSequence) {
+			t.Fatalf("atomic=%v: abort sequence not written in full", atomic)
+		}
+	}
+}
+
+// cappedWriter fails any Write larger than max, as some USB-serial drivers do.
+type cappedWriter struct {
+	bytes.Buffer
+	max int
+}
+
+func (w *cappedWriter) Read([]byte) (int, error) { return 0, io.EOF }
+func (w *cappedWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		return 0, syscall.EAGAIN
+	}
+	return w.Buffer.Write(p)
+}
+
+func TestMaxWriteChunk(t *testing.T) {
+	// An 8 KB block of ZDLEs escapes to 16 KB; the 4 KB write buffer alone
+	// overruns a driver that takes 1 KB at a time.
+	block := bytes.Repeat([]byte{ZDLE}, 8192)
+	for _, atomic := range []bool{false, true} {
+		send := func(chunk int) (*cappedWriter, error) {
+			w := &cappedWriter{max: 1024}
+			s := NewSession(w, newTestHandler(), &Config{MaxWriteChunk: chunk, AtomicFrames: atomic, Logger: discardLogger()})
+			if err := s.sendBinHeader(makePosHeader(ZDATA, 0)); err != nil {
+				return w, err
+			}
+			return w, s.sendSubpacket(block, ZCRCW)
+		}
+		if _, err := send(0); !errors.Is(err, syscall.EAGAIN) {
+			t.Fatalf("atomic=%v: uncapped send = %v, want EAGAIN", atomic, err)
+		}
+		w, err := send(1024)
+		if err != nil {
+			t.Fatalf("atomic=%v: capped send: %v", atomic, err)
+		}
+		fr := NewFrameReader(bytes.NewReader(w.Bytes()), EscapeStandard)
+		if hdr, err := fr.ReadHeader(); err != nil || hdr.Type != ZDATA {
+			t.Fatalf("atomic=%v: ReadHeader = %s, %v", atomic, hdr, err)
+		}
+		if data, _, err := fr.ReadSubpacket(len(block), false); err != nil || !bytes.Equal(data, block) {
+			t.Fatalf("atomic=%v: ReadSubpacket: %d bytes, %v", atomic, len(data), err)
+		}
+	}
+}
+
+// stuckWriter accepts nothing and reports no error.
+type stuckWriter struct{ calls int }
+
+func (w *stuckWriter) Write([]byte) (int, error) { w.calls++; return 0, nil }
+
+func TestWriteFullGivesUp(t *testing.T) {
+	w := &stuckWriter{}
+	if _, err := writeFull(context.Background(), w, []byte("abc")); !errors.Is(err, io.ErrNoProgress) {
+		t.Fatalf("writeFull to a stuck writer = %v, want io.ErrNoProgress", err)
+	}
+	if w.calls != maxEmptyWrites {
+		t.Fatalf("%d writes, want %d", w.calls, maxEmptyWrites)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := writeFull(ctx, &trickleWriter{}, []byte("abcdefg")); !errors.Is(err, context.Canceled) {
+		t.Fatalf("writeFull with a canceled context = %v", err)
+	}
+}
+
+// recordingWriter records each Write to the transport beneath it.
+type recordingWriter struct {
+	w      io.Writer
+	mu     sync.Mutex
+	writes [][]byte
+}
+
+func (r *recordingWriter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	r.writes = append(r.writes, append([]byte(nil), p...))
+	r.mu.Unlock()
+	return r.w.Write(p)
+}
+
+func TestZDATAHeaderCoalescedWithData(t *testing.T) {
+	senderT, receiverT, senderClose, receiverClose := newTestTransports()
+	rec := &recordingWriter{w: senderT}
+	content := []byte("a file small enough for one subpacket")
+	sh := newTestHandler()
+	sh.filesToSend = []*FileOffer{{Name: "small.txt", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	rh := newTestHandler()
+	sender := NewSession(&pipeReadWriter{Reader: senderT, Writer: rec}, sh, &Config{Logger: discardLogger()})
+	receiver := NewSession(receiverT, rh, &Config{Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	var sendErr, recvErr error
+	wg.Add(2)
+	go func() { defer wg.Done(); defer senderClose(); sendErr = sender.Send(ctx) }()
+	go func() { defer wg.Done(); defer receiverClose(); recvErr = receiver.Receive(ctx) }()
+	wg.Wait()
+	if sendErr != nil || recvErr != nil {
+		t.Fatalf("send=%v recv=%v", sendErr, recvErr)
+	}
+
+	// Exactly one write carries the ZDATA header, and the file's data is in
+	// it too.
+	found := 0
+	for _, w := range rec.writes {
+		fr := NewFrameReader(bytes.NewReader(w), EscapeStandard)
+		hdr, err := fr.ReadHeader()
+		if err != nil || hdr.Type != ZDATA {
+			continue
+		}
+		found++
+		data, _, err := fr.ReadSubpacket(1024, hdr.Encoding == ZBIN32)
+		if err != nil || !bytes.Equal(data, content) {
+			t.Fatalf("ZDATA write holds subpacket %q, %v; want the whole file", data, err)
+		}
+	}
+	if found != 1 {
+		t.Fatalf("%d writes start with a ZDATA header, want 1", found)
+	}
+}
+
+// completionRecorder counts FileCompleted calls and keeps the last one. With
+// cancelAt set it also cancels the session once FileProgress passes it.
+type completionRecorder struct {
+	*testFileHandler
+	calls    int
+	bytes    int64
+	err      error
+	cancelAt int64
+	cancel   context.CancelFunc
+}
+
+func (c *completionRecorder) FileProgress(info FileInfo, bytesTransferred int64) {
+	c.testFileHandler.FileProgress(info, bytesTransferred)
+	if c.cancel != nil && bytesTransferred >= c.cancelAt {
+		c.cancel()
+	}
+}
+
+func (c *completionRecorder) FileCompleted(info FileInfo, bytesTransferred int64, err error) {
+	c.testFileHandler.FileCompleted(info, bytesTransferred, err)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.calls++
+	c.bytes = bytesTransferred
+	c.err = err
+}
+
+// TestSendReportsFileWhenSessionDies kills a send at several points — in the
+// first block, mid-stream, just before ZEOF, and by cancelling the context —
+// and checks the handler hears once, with Send's error and a byte count no
+// lower than what reached the receiver.
+func TestSendReportsFileWhenSessionDies(t *testing.T) {
+	content := bytes.Repeat([]byte("file completes on failure "), 4000)
+	for _, tc := range []struct {
+		name  string
+		limit int // bytes the sender may write; 0 cancels the context instead
+	}{
+		{name: "first block", limit: 300},
+		{name: "mid stream", limit: 40000 + 11},
+		{name: "near eof", limit: len(content) - 100},
+		{name: "context"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r1, w1 := bufferedPipe(256)
+			r2, w2 := bufferedPipe(256)
+			var out io.Writer = w1
+			if tc.limit > 0 {
+				out = &dyingWriter{w: w1, limit: tc.limit}
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+			defer cancel()
+			sendCtx, cancelSend := context.WithCancel(ctx)
+			defer cancelSend()
+
+			sh := &completionRecorder{testFileHandler: newTestHandler()}
+			sh.filesToSend = []*FileOffer{{Name: "dies.txt", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+			if tc.limit == 0 {
+				sh.cancelAt, sh.cancel = int64(len(content)/2), cancelSend
+			}
+			rh := newTestHandler()
+			sender := NewSession(&pipeReadWriter{Reader: r2, Writer: out}, sh, &Config{Logger: discardLogger()})
+			receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, rh, &Config{RecvTimeout: time.Second, Logger: discardLogger()})
+
+			recvDone := make(chan struct{})
+			go func() { defer close(recvDone); defer w2.Close(); receiver.Receive(ctx) }()
+
+			err := sender.Send(sendCtx)
+			w1.Close()
+			<-recvDone
+
+			switch {
+			case tc.limit == 0 && !errors.Is(err, context.Canceled):
+				t.Fatalf("Send = %v, want context.Canceled", err)
+			case tc.limit > 0 && !errors.Is(err, syscall.ECONNRESET):
+				t.Fatalf("Send = %v, want the transport's error", err)
+			}
+			sh.mu.Lock()
+			defer sh.mu.Unlock()
+			if sh.calls != 1 {
+				t.Fatalf("FileCompleted called %d times, want once", sh.calls)
+			}
+			if sh.err != err {
+				t.Fatalf("FileCompleted err = %v, Send returned %v", sh.err, err)
+			}
+			var got int64
+			if buf := rh.receivedFiles["dies.txt"]; buf != nil {
+				got = int64(buf.Len())
+			}
+			if sh.bytes < got || sh.bytes > int64(len(content)) {
+				t.Fatalf("FileCompleted bytes = %d, receiver has %d of %d", sh.bytes, got, len(content))
+			}
+		})
+	}
+}
+
+// throttledWriter takes one byte per Write, a few milliseconds apart while
+// slow is set, so that a context ends in the middle of a write.
+type throttledWriter struct {
+	w    io.Writer
+	slow atomic.Bool
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	if !tw.slow.Load() {
+		return tw.w.Write(p)
+	}
+	time.Sleep(5 * time.Millisecond)
+	return tw.w.Write(p[:1])
+}
+
+// TestContextErrorNotSticky: a Send whose context ends in the middle of a
+// write leaves the session usable; the next run on it transfers a file.
+func TestContextErrorNotSticky(t *testing.T) {
+	r1, w1 := bufferedPipe(256)
+	r2, w2 := bufferedPipe(256)
+	tw := &throttledWriter{w: w1}
+	tw.slow.Store(true)
+	content := randomContent(10000)
+	sh := newTestHandler()
+	sh.filesToSend = []*FileOffer{{Name: "again.bin", Size: int64(len(content)), Reader: bytes.NewReader(content)}}
+	sender := NewSession(&pipeReadWriter{Reader: r2, Writer: tw}, sh, &Config{Logger: discardLogger()})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	if err := sender.Send(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("first Send = %v, want its context's error", err)
+	}
+	if err := sender.tw.err(); err != nil {
+		t.Fatalf("the context's error was kept as a transport failure: %v", err)
+	}
+
+	tw.slow.Store(false)
+	rh := newTestHandler()
+	receiver := NewSession(&pipeReadWriter{Reader: r1, Writer: w2}, rh, &Config{Logger: discardLogger()})
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	recvErr := make(chan error, 1)
+	go func() { defer w2.Close(); recvErr <- receiver.Receive(ctx) }()
+	err := sender.Send(ctx)
+	w1.Close()
+	if rerr := <-recvErr; err != nil || rerr != nil {
+		t.Fatalf("second Send = %v, Receive = %v", err, rerr)
+	}
+	if got := rh.receivedFiles["again.bin"]; got == nil || !bytes.Equal(got.Bytes(), content) {
+		t.Fatal("content mismatch")
+	}
+}
@@ -1,17 +1,60 @@
 package zmodem
 
 import (
+	"bufio"
 	"context"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // ErrSkip is returned by AcceptFile to skip a file.
 var ErrSkip = errors.New("skip file")
 
+// ErrFileTooLarge is reported to FileCompleted for an incoming file larger
+// than Config.MaxFileSize, which the receiver skipped without calling
+// AcceptFile. It matches ErrSkip under errors.Is.
+var ErrFileTooLarge = fmt.Errorf("zmodem: file exceeds MaxFileSize: %w", ErrSkip)
+
+// ErrSkippedByRemote is reported to the sender's FileCompleted for a file the
+// receiver skipped with ZSKIP part-way through its data. It matches ErrSkip
+// under errors.Is.
+var ErrSkippedByRemote = fmt.Errorf("zmodem: file skipped by receiver: %w", ErrSkip)
+
+// ErrRemoteFileError is reported to the sender's FileCompleted, and returned by
+// Send, when the receiver answers a file's ZEOF with ZFERR: it could not store
+// the file (see Config.CloseErrorZFERR).
+var ErrRemoteFileError = errors.New("zmodem: receiver failed to store file (ZFERR)")
+
+// ErrSizeOverrun is reported (wrapped, with the declared and actual sizes) to
+// the receiver's FileCompleted for a file whose sender sent more data than its
+// ZFILE declared. What became of the extra data depends on
+// Config.SizeOverrunPolicy.
+var ErrSizeOverrun = errors.New("zmodem: file larger than its declared size")
+
+// ErrCloseIncomplete is returned by Send when the receiver kept answering the
+// closing ZFIN with other frames. Every file was already reported to
+// FileCompleted; only the end of the session is in doubt.
+var ErrCloseIncomplete = errors.New("zmodem: close handshake incomplete")
+
+// ErrBadFileInfo is reported to FileCompleted for a ZFILE whose file
+// information is malformed (no name, a negative or oversized size, ...). The
+// receiver skips that offer and carries on with the batch. It matches ErrSkip
+// under errors.Is.
+var ErrBadFileInfo = fmt.Errorf("zmodem: malformed file info: %w", ErrSkip)
+
+// ErrAborted is returned (wrapped) by Send and Receive when the remote cancels
+// the session with the CAN abort sequence.
+var ErrAborted = errors.New("zmodem: session aborted by remote")
+
+// ErrLocalAbort is returned by Send and Receive when Abort ended them.
+var ErrLocalAbort = errors.New("zmodem: session aborted locally")
+
 // DefaultRecvTimeout is the idle read timeout applied when NewSession is
 // called with a nil Config. It is exported so callers that synthesize a
 // Config (e.g. to inject a logger) can replicate the nil-config behaviour
@@ -34,44 +77,128 @@ type FileHandler interface {
 	AcceptFile(info FileInfo) (io.WriteCloser, int64, error)
 
 	// FileProgress is called periodically during transfer with the current byte count.
+	//
+	// The count is the absolute file offset reached, on send and on receive
+	// alike: a transfer resumed at 1 MB reports from 1 MB, and a sender's
+	// count steps back when a ZRPOS rewinds it. A handler implementing
+	// ProgressHandler gets TransferProgress instead, which also tells the
+	// bytes moved in this session.
+	//
+	// On receive the count is the protocol position: bytes accepted from the
+	// sender, not bytes on disk. Up to Config.FileBufferSize of them may still
+	// be buffered on their way to the writer from AcceptFile.
 	FileProgress(info FileInfo, bytesTransferred int64)
 
 	// FileCompleted is called when a file transfer finishes (success or error).
+	// On send it is called exactly once for every offer NextFile returned,
+	// including one in flight when Send fails; err is then Send's error.
 	FileCompleted(info FileInfo, bytesTransferred int64, err error)
 }
 
+// Progress is a file's transfer progress, as given to ProgressHandler.
+type Progress struct {
+	// Offset is the file offset reached, the count FileProgress reports.
+	Offset int64
+	// StartOffset is where this transfer of the file began: the resume
+	// offset, or 0.
+	StartOffset int64
+	// SessionBytes counts the file data moved in this session, from
+	// StartOffset to the furthest offset reached. Data sent again after a
+	// ZRPOS rewind is not counted twice.
+	SessionBytes int64
+}
+
+// ProgressHandler is an optional extension of FileHandler. A handler that
+// implements it gets TransferProgress in place of FileProgress, with the
+// session's share of the transfer told apart from the file offset: after a
+// resume at 1 MB, Offset starts at 1 MB and SessionBytes at 0.
+type ProgressHandler interface {
+	TransferProgress(info FileInfo, p Progress)
+}
+
 // FileOffer describes a file to send.
 type FileOffer struct {
 	Name    string
 	Size    int64
 	ModTime time.Time
-	Mode    uint32
+	// Mode holds Unix permission bits (07777); they are sent marked as a
+	// regular file, as lrzsz does, so rz applies them. 0 sends no mode.
+	Mode uint32
 	// Reader provides file data. If it implements io.ReadSeeker, resume via
 	// ZRPOS is supported. If it only implements io.Reader, ZRPOS with non-zero
 	// offset will cause the file to be skipped.
 	Reader io.Reader
+	// CRC32, if set, is the CRC-32 (IEEE) of the whole file, known in advance
+	// (from the application's manifest, say). A receiver's ZCRC request for
+	// the full file is then answered from it at once, without reading Reader;
+	// requests for a prefix are still computed.
+	CRC32 *uint32
 }
 
 // FileInfo describes an incoming file (parsed from ZFILE subpacket).
 type FileInfo struct {
-	Name           string
-	Size           int64
-	ModTime        time.Time
+	Name    string
+	Size    int64
+	ModTime time.Time
+	// Mode is the sender's mode field as sent: lrzsz includes the file type
+	// bits (0100644), and a hostile sender may set anything. Use Permissions
+	// rather than applying it to a file directly.
 	Mode           uint32
 	FilesRemaining int
 	BytesRemaining int64
+	// Text is set for a file the sender asked to have converted as text
+	// (ZCNL, as sz -a sends). The receiver stores it the way rz does: CRs
+	// dropped, so CR LF line ends become LF, and nothing kept from a ^Z on.
+	// Size is then the sender's local size rather than what the wire
+	// carries, so the receiver holds the data to no size; offsets (the one
+	// AcceptFile returns, and the bytes FileCompleted reports) count the
+	// data as sent.
+	Text bool
 }
 
 // Config controls session behavior.
 type Config struct {
-	// MaxBlockSize: data subpacket size (default 1024, max 8192 for ZedZap)
+	// MaxBlockSize: data subpacket size (default 1024, max 8192 for ZedZap, or
+	// 65536 with LargeBlocks)
 	MaxBlockSize int
-	// WindowSize: streaming window size (0 = full streaming, >0 = windowed)
+	// LargeBlocks lifts the 8 KB block limit to 64 KiB for transfers between
+	// two copies of this library — over TCP, say, where per-subpacket overhead
+	// at 8 KB still costs throughput. A receiver with it set advertises (in a
+	// ZRINIT ZF1 bit other implementations ignore) that it takes blocks up to
+	// 64 KiB; a sender uses a MaxBlockSize over 8192 only with a receiver that
+	// did, and caps its blocks at 8192 otherwise. lrzsz and other peers see
+	// standard ZMODEM either way.
+	LargeBlocks bool
+	// WindowSize: streaming window size (0 = full streaming, >0 = windowed).
+	// A receiver advertises it in ZRINIT. A full-duplex sender then keeps at
+	// most this many bytes unacknowledged, asking for a ZACK every quarter window
+	// and sending on while it comes; without CANFDX it ends each window with
+	// ZCRCW and waits.
 	WindowSize int
+	// TextMode offers every file as text, as sz -a does: ZFILE asks the
+	// receiver to convert line ends to its own (ZCNL). The data goes out as
+	// it is, so the declared size still matches it.
+	TextMode bool
 	// EscapeMode controls ZDLE escaping: EscapeStandard (default), EscapeAll, or EscapeMinimal (DirZap).
+	// It needs no setting to match the peer: escaped data decodes in any
+	// mode, and a peer asking for EscapeAll (ESCCTL in ZRINIT, TESCCTL in
+	// ZSINIT) gets it. EscapeAll here asks the peer for the same.
 	EscapeMode EscapeMode
+	// LenientEscapes decodes ZDLE followed by any byte from 0x40 up as that
+	// byte XOR 0x40, for quirky peers that escape bytes outside the spec's
+	// set. By default only the escapes a ZMODEM sender can produce are taken
+	// (as lrzsz does), and any other ZDLE pair fails the frame like a CRC
+	// error, so a corrupted escape byte is caught rather than decoded.
+	LenientEscapes bool
 	// Use32BitCRC: prefer CRC-32 when receiver supports it
 	Use32BitCRC bool
+	// StickyNegotiation makes a sender keep what the receiver's first ZRINIT
+	// of a Send negotiated — window, capability flags, CRC mode, escaping —
+	// and ignore the ZRINITs that follow, between files or otherwise. Without
+	// it a later ZRINIT still never turns CRC-32 or escape-all off, and never
+	// turns an advertised window into unlimited streaming, but does apply a
+	// changed non-zero window and changed flags.
+	StickyNegotiation bool
 	// DetectMergedSubpackets guards the CRC-16 lost-ZDLE merge detector
 	// (detectMergedSubpacketCRC16). When a peer that cannot do CRC-32 transfers
 	// over a link that drops bytes locally (e.g. a flaky RS232/USB serial path),
@@ -85,7 +212,10 @@ type Config struct {
 	DetectMergedSubpackets bool
 	// AttnSequence: attention string for interrupting sender (max 32 bytes)
 	AttnSequence []byte
-	// RecvTimeout: idle timeout for reads from the remote.
+	// RecvTimeout: idle timeout for reads from the remote. To spare the
+	// transport a deadline update per read, the deadline is renewed about every
+	// eighth of the timeout, so silence is detected after between one and 9/8
+	// of it.
 	//
 	// 0 disables deadline management. This is useful if the caller manages read
 	// deadlines externally (e.g. on net.Conn) or the transport provides its own
@@ -95,10 +225,28 @@ type Config struct {
 	//
 	// Effective only when the transport implements SetReadDeadline (e.g. net.Conn).
 	// When enabled (>0), this overwrites any existing read deadline on the transport
-	// while the session is running (cleared on exit).
+	// while the session is running; on exit the deadline is cleared, or set to
+	// RestoreDeadline. With RecvTimeout == 0 the session never touches it.
 	// For transports without deadline support, callers must handle cancellation
 	// externally (e.g. by closing the transport).
 	RecvTimeout time.Duration
+	// SendTimeout: per-write timeout for writes to the remote. 0 disables it.
+	//
+	// Effective only when the transport implements SetWriteDeadline (e.g.
+	// net.Conn). Without it a peer that stops reading leaves a Flush blocked in
+	// the kernel indefinitely, out of reach of context cancellation. When a write
+	// does not complete in time the session fails with an error wrapping
+	// ErrWriteTimeout. The deadline is cleared (or set to RestoreDeadline) on
+	// exit.
+	SendTimeout time.Duration
+	// RestoreDeadline: the deadline to leave on the transport when Send or
+	// Receive returns, in place of the zero value, for each of the read and
+	// write deadlines the session managed (see RecvTimeout, SendTimeout). A
+	// net.Conn cannot report its current deadline, so a caller with its own —
+	// an overall idle timeout on an interactive connection, say — passes it
+	// here to have it back after the transfer. Deadlines the session never
+	// touched are left as they were.
+	RestoreDeadline time.Time
 	// DataRecvTimeout: idle read timeout used DURING the data phase (while
 	// receiving ZDATA subpackets), in place of RecvTimeout. 0 means "use
 	// RecvTimeout". A value larger than RecvTimeout lets a brief mid-stream
@@ -109,30 +257,229 @@ type Config struct {
 	// (DCD poll) regardless of how long this timeout is, so a longer wait only
 	// delays recovery on a live-but-quiet line, never on a dead one.
 	DataRecvTimeout time.Duration
+	// AutoDetectTimeout: how long Auto waits for the peer's first frame
+	// before giving up with ErrCannotDetermineRole. 0 means 30s, long enough
+	// for rz or sz to repeat their opening frame.
+	AutoDetectTimeout time.Duration
 	// Capabilities: receiver capability flags to advertise
 	Capabilities byte
-	// MaxFileSize: maximum accepted file size (0 = unlimited)
+	// MaxFileSize: maximum accepted file size (0 = unlimited). A larger file
+	// is skipped without AcceptFile; FileCompleted reports ErrFileTooLarge.
 	MaxFileSize int64
-	// MaxRetries: maximum retransmission attempts before abort (default 10)
+	// CheckFile: optional receive-side policy hook, called for each offered
+	// file before the MaxFileSize check and AcceptFile. A non-nil error skips
+	// the file (ZSKIP) and is passed to FileCompleted; the session goes on to
+	// the next file. Unlike AcceptFile it sees files MaxFileSize would refuse.
+	CheckFile func(info FileInfo) error
+	// SizeOverrunPolicy: what the receiver does with data past a file's
+	// declared size, OverrunTruncate (default) or OverrunAccept. Under either
+	// a sender whose ZEOF lands beyond the declared size completes the file
+	// with ErrSizeOverrun; bytes past the size followed by a ZEOF at it are a
+	// corrupt subpacket, dropped under OverrunTruncate.
+	SizeOverrunPolicy SizeOverrunPolicy
+	// CloseErrorZFERR makes a receiver answer the ZEOF of a file whose writer
+	// failed to Close with ZFERR instead of the ZRINIT that asks for the next
+	// file, and end the session, so the sender learns the file was not stored.
+	// Either way FileCompleted reports the Close error.
+	CloseErrorZFERR bool
+	// MaxRetries: maximum retransmission attempts before abort (default 10).
+	// On receive it bounds the failed reads while waiting for each ZFILE.
 	MaxRetries int
+	// FileWaitIdle: how long the receiver waits quietly between files, after
+	// answering a ZEOF or skipping a file, before it re-prompts the sender
+	// with ZRINIT and starts spending MaxRetries. 0 means 2s after a ZEOF and
+	// no quiet wait after a skip. Senders that pause between the files of a
+	// batch and take a re-prompt there for an error (Mystic BBS) need it
+	// longer than their pause; see MysticCompat. Needs RecvTimeout > 0.
+	FileWaitIdle time.Duration
+	// DataRetries: receive-side data-phase budget — consecutive recovery
+	// cycles (ZRPOS with no valid subpacket since) before the file is aborted
+	// (default 25). Reset per file and by every valid subpacket; unused when
+	// DataStallTimeout > 0.
+	DataRetries int
 	// GarbageThreshold: max garbage bytes before aborting (default 1200)
 	GarbageThreshold int
+	// GarbageSink, if set, receives every byte skipped as line noise while
+	// looking for a frame header — a login banner, a PPP frame, double-escaped
+	// data — for diagnosing sessions that fail on garbage. A session that then
+	// gives up on noise also summarizes it in the error (byte count, first and
+	// last 32 bytes in hex). Write errors from the sink are ignored.
+	GarbageSink io.Writer
+	// GarbageSinkLimit caps the total bytes given to GarbageSink over the
+	// Session's life, so a hostile peer cannot make it grow without bound
+	// (default 64 KiB).
+	GarbageSinkLimit int
 	// DataStallTimeout: progress-aware data-phase abort window. When > 0, a
 	// mid-stream transfer is aborted only if it makes NO progress (no valid data
 	// subpacket received) for this long — instead of after a fixed count of
 	// consecutive errors. A noisy-but-advancing link (frequent CRC errors with
 	// good subpackets in between, each of which resets the timer) therefore keeps
 	// going as long as it advances, while a genuinely dead transfer still aborts.
-	// 0 ⇒ the legacy count-based budget (dataRetryBudget) applies, unchanged. The
+	// 0 ⇒ the legacy count-based budget (DataRetries) applies, unchanged. The
 	// maxConsecutiveErr "peer not ZMODEM" guard is the pure-garbage backstop in
 	// both modes.
 	DataStallTimeout time.Duration
+	// SoftwareFlowControl enables outbound XON/XOFF flow control for serial
+	// links configured for it: when the remote sends XOFF (its receive buffer is
+	// full) output pauses before the next write to the transport until XON
+	// arrives, for at most MaxXoffPause. The abort sequence of Abort does not
+	// wait. Inbound XON/XOFF are stripped either way. Ignored with EscapeMinimal, whose reader takes raw 0x11/0x13 as data
+	// from a DirZap peer that does not escape them.
+	//
+	// The transport is then read by a dedicated goroutine so an XOFF is seen
+	// while a streaming sender is not reading. It reads only while Send or
+	// Receive runs: on return it is interrupted through the transport's read
+	// deadline, if it has one, and otherwise ends when its current Read does.
+	// Bytes it read past the session's end are kept for the next Send or
+	// Receive on the Session rather than handed back to the transport.
+	SoftwareFlowControl bool
+	// MaxXoffPause bounds one XOFF pause (default 10s) so a device that loses
+	// its XON cannot deadlock the session; output resumes when it expires.
+	MaxXoffPause time.Duration
+	// PurgeIdle: when > 0, data-phase error recovery drains in-flight data
+	// before sending ZRPOS, reading and discarding until the line has been idle
+	// this long (e.g. 500ms; bounded to 64 KiB per purge). This stops the
+	// sender's already-transmitted backlog from arriving after our ZRPOS as
+	// garbage that triggers further errors. 0 discards only what is already
+	// buffered, the right choice for a continuously streaming peer that never
+	// goes quiet. Needs read deadline management (RecvTimeout > 0 and a
+	// transport with SetReadDeadline); otherwise only buffered data is dropped.
+	//
+	// It is off by default because every recovery then waits at least this
+	// long for the line to go quiet. That pays off when errors are sparse and
+	// the backlog large (a deep socket or modem buffer), where it saves whole
+	// rounds of recovery. When errors come every few dozen subpackets the wait
+	// dominates instead, and the transfer can run a thousand times slower than
+	// with the buffered-only purge, for barely fewer retries.
+	PurgeIdle time.Duration
+	// DisableTransportFlush: a transport with a Flush() error method (an SSH
+	// channel, a websocket adapter, a buffered serial wrapper) is normally
+	// flushed at every frame boundary — after each header and each subpacket
+	// the peer may answer — so small protocol frames are not held in its
+	// buffers and handshakes do not crawl. Set this for transports where a
+	// flush per frame costs more than it saves (e.g. one packet per flush).
+	DisableTransportFlush bool
+	// AtomicFrames: assemble each protocol unit — a header together with the
+	// data subpacket that follows it, or one subpacket with its CRC and
+	// trailing XON — in memory and hand it to the transport in exactly one
+	// Write. For message-oriented transports (WebSocket binary frames, radio
+	// modems that packetize per write) where a frame split over several writes
+	// becomes several messages. The bytes on the wire are unchanged.
+	AtomicFrames bool
+	// CloseOnCancel closes the transport, if it is an io.Closer, when the
+	// context passed to Send or Receive is cancelled. Send and Receive return
+	// promptly on cancellation either way: a transport without read deadlines
+	// is read on a helper goroutine the session stops waiting for. That
+	// goroutine, though, stays in the transport's Read until it returns —
+	// for an idle serial port, never — unless the transport is closed.
+	CloseOnCancel bool
+	// ReconnectWait: optional hook for links that drop and come back (e.g. a
+	// USB serial adapter re-enumerating). When set, a fatal transport error
+	// (anything but a timeout, including EOF) no longer ends the session:
+	// ReconnectWait is called with the error and may block until a new
+	// connection is open. Before returning nil it must hand that connection to
+	// Session.SetTransport; the session then resumes on it — a receiver re-sends
+	// ZRPOS at its current offset, a sender restarts its data frame — so the
+	// transfer continues where it stopped. Returning an error ends the session
+	// with that error. ctx is the one passed to Send/Receive.
+	ReconnectWait func(ctx context.Context, err error) error
+	// MaxWriteChunk caps the size of a single Write to the transport: each
+	// flush is cut into pieces no larger than this, each retried on short
+	// writes as usual. For drivers that fail large writes outright (some
+	// USB-serial drivers refuse anything over 4 KB with EAGAIN) or radio modems
+	// that silently truncate them. It splits AtomicFrames units too. 0 (the
+	// default) writes whatever has been buffered in one call.
+	MaxWriteChunk int
+	// EmulatedBaud paces everything the session sends — headers, escapes and
+	// all — to the line rate of an async serial link at this many bits per
+	// second, counting 10 bits per byte for the start and stop bits. For BBS
+	// doors that want the feel of a 28.8k or 57.6k modem, or old clients whose
+	// polling loops fall over when data arrives faster than a real line could
+	// carry it. Output goes to the transport in chunks of about 50ms of line
+	// time, or a frame at a time with AtomicFrames. 0 (the default) sends at
+	// full speed.
+	EmulatedBaud int
+	// FileBufferSize: size of the buffer between received data subpackets and
+	// the writer returned by AcceptFile (default 64 KiB), so an unbuffered
+	// *os.File or pipe sees a few large writes rather than one per subpacket.
+	// It is flushed whenever the sender waits on us (ZCRCW) or a frame ends
+	// (ZCRCE), and before the writer is closed; an error from that final flush
+	// or from Close is reported to FileCompleted. A negative value writes each
+	// subpacket straight through.
+	//
+	// Data subpackets are decoded straight into the buffer and committed only
+	// once their CRC checks out, so it is never smaller than the largest
+	// subpacket the receiver accepts (a little over 64 KiB with LargeBlocks),
+	// and it is the only block-sized buffer a receiving session holds.
+	FileBufferSize int
+	// FileCRCBufferSize: read size used to compute the file CRC a receiver
+	// asks for with ZCRC (default 256 KiB).
+	FileCRCBufferSize int
+	// MinCheckpointInterval and MaxCheckpointInterval bound how many data
+	// subpackets a streaming sender sends between ZCRCQ checkpoints, each of
+	// which it waits to have answered (defaults 8 and 256). Within them the
+	// spacing follows the measured round trip and send rate: close together on
+	// a LAN, where an answer costs nothing and errors surface sooner, far
+	// apart on a satellite hop, where every answer costs a long wait. Until
+	// the first answer the sender uses MinCheckpointInterval. Set both to the
+	// same value for a fixed spacing.
+	//
+	// Unless MinCheckpointInterval asks for more, a span also never holds more
+	// than 16 KiB of data (see maxCheckpointSpan): with the default 1 KiB
+	// blocks the spacing tops out at 16 subpackets, and MaxCheckpointInterval
+	// only bites on blocks of 64 bytes or less, as after an error recovery.
+	MinCheckpointInterval int
+	MaxCheckpointInterval int
 	// Znulls: number of null bytes before ZDATA headers (default 0)
 	Znulls int
+	// DSZLog, if set, gets a DSZLOG line for each file sent or received, as
+	// FileCompleted is called: the log DSZ writes to the file its DSZLOG
+	// environment variable names, which BBS software reads to credit uploads
+	// and downloads. A file received whole is logged with Z, one sent with z;
+	// a skipped file is logged as failed (E), so it is not credited. Lines are written from the goroutine running the session.
+	DSZLog io.Writer
+	// FrameTrace, if set, is called for every header and data subpacket the
+	// session sends or receives, on the goroutine running the session, before
+	// the frame is acted on. A header has payloadLen -1 and endType 0; a
+	// subpacket comes with the header of the frame it belongs to, its data
+	// length and its end type (ZCRCE, ZCRCG, ZCRCQ or ZCRCW). A received frame
+	// that fails its CRC or does not parse is reported too, with err set (and
+	// hdr zero for a header); timeouts and a lost connection are not frames
+	// and are not reported. err on a sent frame is the write's error.
+	FrameTrace func(dir Direction, hdr Header, payloadLen int, endType byte, err error)
+	// WireDump, if set, gets a timestamped hex and ASCII dump of every byte
+	// read from and written to the transport, as it crossed the transport
+	// (escaped), one line per 16 bytes with >> marking bytes sent and <<
+	// bytes received. Write errors are ignored.
+	WireDump io.Writer
+	// WireDumpLimit stops WireDump after this many bytes, both ways
+	// together, so a long transfer cannot fill a disk (default 0: no limit).
+	WireDumpLimit int64
+	// Collector, if set, gets the session's metrics: each run's start and
+	// end, file completions, error recoveries, CRC errors and garbage
+	// overflows. Give many sessions the same one to sum them; Metrics is
+	// one kept in memory.
+	Collector Collector
+	// EventBuffer is the capacity of the channel Session.Events returns
+	// (default DefaultEventBuffer, 64).
+	EventBuffer int
+	// EventPolicy is what the session does with an event when that channel
+	// is full: drop the oldest (EventsDropOldest, the default) or wait for
+	// the reader (EventsBlock).
+	EventPolicy EventPolicy
+	// DisableSummaryLog drops the Info line each Send, Receive or Auto logs
+	// as it ends, summing it up (see SessionSummary). Session.Summary still
+	// returns it.
+	DisableSummaryLog bool
 	// Logger: optional structured logger for frame traces (recv/send headers,
 	// ZDATA position mismatches, ZRPOS resync, garbage-skip diagnostics). When
 	// nil, slog.Default() is used. Lets the caller route the protocol-level
-	// trace into the same stream as its transport/byte trace.
+	// trace into the same stream as its transport/byte trace. Each Send,
+	// Receive or Auto tags its records with a random session ID and its role
+	// (session=3f9a0c1e role=send|recv), a sender's with the receiver's
+	// ZRINIT capabilities (peer.flags, peer.window, peer.large_blocks) once
+	// known, and those of a file in progress with file= and size=, so the
+	// records of concurrent transfers can be told apart.
 	Logger *slog.Logger
 }
 
@@ -140,18 +487,49 @@ func (c *Config) defaults() {
 	if c.MaxBlockSize <= 0 {
 		c.MaxBlockSize = 1024
 	}
-	if c.MaxBlockSize > 8192 {
-		c.MaxBlockSize = 8192
+	if limit := maxBlockSize; c.MaxBlockSize > limit {
+		if c.LargeBlocks {
+			limit = maxLargeBlockSize
+		}
+		c.MaxBlockSize = min(c.MaxBlockSize, limit)
 	}
 	if c.RecvTimeout < 0 {
 		c.RecvTimeout = 0
 	}
+	if c.SendTimeout < 0 {
+		c.SendTimeout = 0
+	}
 	if c.MaxRetries <= 0 {
 		c.MaxRetries = 10
 	}
+	if c.DataRetries <= 0 {
+		c.DataRetries = dataRetryBudget
+	}
 	if c.GarbageThreshold <= 0 {
 		c.GarbageThreshold = 1200
 	}
+	if c.GarbageSinkLimit <= 0 {
+		c.GarbageSinkLimit = defaultGarbageSinkLimit
+	}
+	if c.FileBufferSize == 0 {
+		c.FileBufferSize = defaultFileBufferSize
+	}
+	if c.FileCRCBufferSize <= 0 {
+		c.FileCRCBufferSize = defaultFileCRCBufferSize
+	}
+	if c.AutoDetectTimeout <= 0 {
+		c.AutoDetectTimeout = defaultAutoDetectTimeout
+	}
+	if c.MaxXoffPause <= 0 {
+		c.MaxXoffPause = defaultMaxXoffPause
+	}
+	if c.MinCheckpointInterval <= 0 {
+		c.MinCheckpointInterval = defaultMinCheckpointInterval
+	}
+	if c.MaxCheckpointInterval <= 0 {
+		c.MaxCheckpointInterval = defaultMaxCheckpointInterval
+	}
+	c.MaxCheckpointInterval = max(c.MaxCheckpointInterval, c.MinCheckpointInterval)
 	// DataStallTimeout is left as supplied: 0 means "use the legacy count-based
 	// budget", a deliberate opt-in for the progress-aware abort.
 }
@@ -163,15 +541,31 @@ type Session struct {
 	cfg       Config
 	logger    *slog.Logger
 
+	// During a run, logger adds the run's attributes (logRun) to the records
+	// of logBase, the session's own logger, through logHandler (see
+	// sessionlog.go).
+	logBase    *slog.Logger
+	logRun     runAttrs
+	logHandler runHandler
+
 	tw *transportWriter
 	tr *transportReader
 
 	// Protocol state
 	useCRC32         bool   // negotiated CRC mode
+	rxEnc            byte   // encoding of the last header received; sets its subpackets' CRC (see subpacketCRC32)
+	txEnc            byte   // encoding of the last header sent, likewise
+	rxHdr, txHdr     Header // the last header received and sent, for Config.FrameTrace
 	remoteFlags      byte   // remote ZRINIT ZF0 flags
 	remoteEscAll     bool   // remote wants all control chars escaped
 	attnSeq          []byte // negotiated attention sequence
 	remoteWindowSize int    // receiver buffer size from ZRINIT (ZP0+ZP1)
+	sendBlockLimit   int    // largest block to send: MaxBlockSize, capped by what the receiver takes
+	zrinitSeen       bool   // a ZRINIT has been processed in the running Send
+
+	// pending is the peer's opening frame, read by Auto to choose the state
+	// machine; the machine's first recvHeader returns it.
+	pending *Header
 
 	// lastProgressAt is the clock time of the most recent valid data subpacket,
 	// used by the progress-aware data-phase abort (Config.DataStallTimeout). It is
@@ -186,8 +580,71 @@ type Session struct {
 	// loop. -1 = none outstanding. See detectMergedSubpacketCRC16.
 	mergeSuspectOffset int64
 
-	mu     sync.Mutex
-	active bool // prevents concurrent Send/Receive
+	// fileInfo is the file being offered or transferred, set by beginFile;
+	// fileStart is the offset its transfer began at (Progress.StartOffset).
+	fileInfo  FileInfo
+	fileStart int64
+
+	// Per-file accounting for Config.DSZLog, reset by beginFile: when the
+	// file was offered or accepted, its error recoveries (ZRPOS), the XOFF
+	// pause count it began at, and the length of its last data block.
+	fileBegan  time.Time
+	fileErrors int
+	fileXoffs  int64
+	blockLen   int
+
+	// fileDone, if set, is told of each file's end with the handler (the
+	// status lines of a Proxy).
+	fileDone func(info FileInfo, n int64, err error)
+
+	// results, set by SendResult, ReceiveResult and AutoResult, collects a
+	// TransferResult for each file completed; filePath is the current
+	// file's TransferResult.Path.
+	results  *[]TransferResult
+	filePath string
+
+	// summary is the running Send, Receive or Auto's SessionSummary as the
+	// files add to it, and runCRC32 whether any subpacket went with a
+	// CRC-32; lastSummary is the last run's, under mu (see summary.go).
+	summary     SessionSummary
+	runCRC32    bool
+	lastSummary SessionSummary
+
+	// fileCRC keeps the CRCs computed for ZCRC requests on the file being
+	// offered.
+	fileCRC fileCRCCache
+
+	// rxBuf is reused to decode received subpackets (see recvSubpacket).
+	rxBuf []byte
+
+	// ckpt spaces the sender's ZCRCQ checkpoints and measures the round trip.
+	ckpt checkpointPacer
+
+	// fileBuf buffers writes to the receive writer (Config.FileBufferSize),
+	// reused across files; nil until the first file is accepted.
+	fileBuf *bufio.Writer
+
+	// stats holds the counters the state machines keep; Stats() adds the
+	// transport-level ones.
+	stats Stats
+
+	// events is the stream Events returned, fed by the running Send,
+	// Receive or Auto; nil when nobody asked for one. It is set and cleared
+	// under mu.
+	events atomic.Pointer[eventStream]
+
+	// turn is the direction of a HalfDuplex transport; nil = full duplex.
+	turn *turnaround
+	// flow is the outbound XON/XOFF state (Config.SoftwareFlowControl); nil = off.
+	flow *flowControl
+	pump *pumpReader // the reader input returned, with SoftwareFlowControl
+	// ctx is the context of the running Send/Receive, for Config.ReconnectWait.
+	ctx context.Context
+
+	mu            sync.Mutex
+	active        bool                    // prevents concurrent Send/Receive
+	abort         context.CancelCauseFunc // cancels the running Send/Receive (Abort); nil outside one
+	nextTransport io.ReadWriter           // set by SetTransport, taken by reconnect
 }
 
 // NewSession creates a new ZMODEM session over the given transport.
@@ -213,9 +670,27 @@ func NewSession(transport io.ReadWriter, handler FileHandler, cfg *Config) *Sess
 		handler:            handler,
 		cfg:                c,
 		logger:             logger,
-		tw:                 newTransportWriter(transport, c.EscapeMode),
-		tr:                 newTransportReader(transport, c.GarbageThreshold, c.RecvTimeout, c.EscapeMode != EscapeMinimal, logger),
 		mergeSuspectOffset: -1,
+		sendBlockLimit:     min(c.MaxBlockSize, maxBlockSize),
+		ckpt:               newCheckpointPacer(c.MinCheckpointInterval, c.MaxCheckpointInterval),
+	}
+	if c.SoftwareFlowControl && c.EscapeMode != EscapeMinimal {
+		s.flow = newFlowControl(c.MaxXoffPause, logger)
+	}
+	s.tw = newTransportWriter(transport, c.EscapeMode)
+	s.tr = newTransportReader(s.input(transport), c.GarbageThreshold, c.RecvTimeout, c.EscapeMode != EscapeMinimal, logger)
+	s.tw.wire.flow = s.flow
+	s.setTurnaround(newTurnaround(transport))
+	s.tw.noTransportFlush = c.DisableTransportFlush
+	if c.AtomicFrames {
+		s.tw.setAtomic()
+	} else {
+		s.tw.batchData = true
+	}
+	s.tr.lenientEscapes = c.LenientEscapes
+	if c.ReconnectWait != nil {
+		s.tr.wire.reconnect = s.reconnect
+		s.tw.wire.reconnect = s.reconnect
 	}
 	// Seed the attention sequence from config so a receiver has a default Attn to
 	// interrupt a streaming sender even when the peer sends no ZSINIT to negotiate
@@ -223,42 +698,252 @@ func NewSession(transport io.ReadWriter, handler FileHandler, cfg *Config) *Sess
 	s.attnSeq = c.AttnSequence
 	// The data phase may use a longer idle read timeout than the control phases.
 	s.tr.dataTimeout = c.DataRecvTimeout
+	s.tr.purgeIdle = c.PurgeIdle
+	if c.GarbageSink != nil {
+		s.tr.capture = newGarbageCapture(c.GarbageSink, c.GarbageSinkLimit)
+	}
+	if c.WireDump != nil {
+		d := newWireDump(c.WireDump, c.WireDumpLimit)
+		s.tr.wire.dump = d
+		s.tw.wire.dump = d
+	}
+	s.tw.wire.timeout = c.SendTimeout
+	if c.EmulatedBaud > 0 {
+		s.tw.wire.pace = newPacer(c.EmulatedBaud)
+		if c.AtomicFrames {
+			s.tw.wire.pace.chunk = math.MaxInt // one paced Write per frame
+		}
+	}
+	s.tw.wire.chunk = max(c.MaxWriteChunk, 0)
+	s.tr.restoreDeadline = c.RestoreDeadline
+	s.tw.wire.restoreDeadline = c.RestoreDeadline
 	return s
 }
 
+// input returns the reader the session reads transport from. A port with
+// per-read timeouts (ReadTimeoutSetter) and no read deadlines is given them
+// by a timeoutReader. With outbound flow control it is a pump goroutine that
+// watches for XON/XOFF as bytes arrive; the session reads from the pump. A
+// transport without read deadlines is read through an asyncReader, so
+// cancelling Send or Receive ends a read that would otherwise block until the
+// peer sent something.
+func (s *Session) input(transport io.ReadWriter) io.Reader {
+	var src io.Reader = transport
+	if _, ok := transport.(deadlineSetter); !ok {
+		if rts, ok := transport.(ReadTimeoutSetter); ok {
+			src = newTimeoutReader(transport, rts)
+		}
+	}
+	if s.flow != nil {
+		s.pump = newPumpReader(src, s.flow.observe)
+		s.pump.restore = s.cfg.RestoreDeadline
+		return s.pump
+	}
+	if _, ok := src.(deadlineSetter); !ok {
+		return newAsyncReader(src)
+	}
+	return src
+}
+
+// setTurnaround installs the direction tracker for a HalfDuplex transport (nil
+// for a full-duplex one) in both wire layers.
+func (s *Session) setTurnaround(t *turnaround) {
+	s.turn = t
+	s.tr.wire.turn = t
+	s.tw.wire.turn = t
+}
+
+// debug reports whether the logger keeps Debug records. Log calls on the
+// per-frame paths check it first: the arguments of a discarded record are
+// still formatted and boxed.
+func (s *Session) debug() bool {
+	return s.logger.Enabled(context.Background(), slog.LevelDebug)
+}
+
+// releaseLine un-keys a HalfDuplex transport left transmitting when Send or
+// Receive returns.
+func (s *Session) releaseLine() {
+	if s.turn != nil {
+		if err := s.turn.receive(); err != nil {
+			s.logger.Debug("releasing half-duplex line", "err", err)
+		}
+	}
+}
+
+// SetTransport hands the session a replacement for a transport that has
+// failed. It is meant to be called from (or before the return of)
+// Config.ReconnectWait, from any goroutine; the session switches to rw when
+// the hook returns. Escape mode, CRC mode and everything else negotiated on
+// the old connection carry over.
+func (s *Session) SetTransport(rw io.ReadWriter) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.nextTransport = rw
+}
+
+// reconnect is offered every fatal transport error by the wire layers. It
+// returns nil once the transport has been replaced, or the error that should
+// end the session.
+func (s *Session) reconnect(cause error) error {
+	if errors.Is(cause, errReconnected) {
+		return cause
+	}
+	ctx := s.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	s.logger.Warn("transport failed, waiting for reconnect", "err", cause)
+	if err := s.cfg.ReconnectWait(ctx, cause); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	rw := s.nextTransport
+	s.nextTransport = nil
+	if rw != nil {
+		s.transport = rw
+	}
+	s.mu.Unlock()
+	if rw == nil {
+		return fmt.Errorf("zmodem: ReconnectWait returned without SetTransport: %w", cause)
+	}
+	if s.pump != nil {
+		s.pump.stop()
+	}
+	s.tr.setSource(s.input(rw))
+	s.tw.setSink(rw)
+	s.setTurnaround(newTurnaround(rw))
+	s.logger.Info("transport replaced, resynchronizing")
+	return nil
+}
+
+// closeOnCancel closes the transport if ctx is cancelled before the returned
+// func is called, when Config.CloseOnCancel asks for it and the transport is
+// an io.Closer.
+func (s *Session) closeOnCancel(ctx context.Context) func() {
+	s.mu.Lock()
+	c, ok := s.transport.(io.Closer)
+	s.mu.Unlock()
+	if !s.cfg.CloseOnCancel || !ok {
+		return func() {}
+	}
+	closed := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		_ = c.Close()
+		close(closed)
+	})
+	return func() {
+		if !stop() {
+			<-closed // cancelled: the transport is closed when Send returns
+		}
+	}
+}
+
 // Send initiates a file sending session (batch upload).
 func (s *Session) Send(ctx context.Context) error {
-	if !s.acquire() {
-		return errors.New("zmodem: session already active")
-	}
-	defer s.release()
-	defer s.tr.clearDeadline()
-	return s.runSender(ctx)
+	return s.run(ctx, roleSend, s.runSender)
 }
 
 // Receive initiates a file receiving session (batch download).
 func (s *Session) Receive(ctx context.Context) error {
-	if !s.acquire() {
+	return s.run(ctx, roleReceive, s.runReceiver)
+}
+
+// run runs one of the state machines as Send, Receive or Auto, logging as
+// role.
+func (s *Session) run(ctx context.Context, role string, machine func(context.Context) error) (err error) {
+	outer := ctx
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if !s.acquire(cancel) {
 		return errors.New("zmodem: session already active")
 	}
 	defer s.release()
+	defer func() { s.endEvents(err) }()
+	if s.cfg.Collector != nil {
+		ended := s.collectRun()
+		defer func() { ended(err) }()
+	}
+	defer s.beginLog(role)()
+	summarize := s.beginSummary()
+	defer func() { summarize(err) }()
 	defer s.tr.clearDeadline()
-	return s.runReceiver(ctx)
+	defer s.tw.clearDeadline()
+	defer s.releaseLine()
+	defer s.drainOutput()
+	if s.pump != nil {
+		s.pump.start()
+		defer s.pump.stop()
+	}
+	s.ctx = ctx
+	s.tw.reset()
+	s.tw.wire.ctx = ctx
+	s.tr.wire.ctx = ctx
+	defer func() { s.tw.wire.ctx, s.tr.wire.ctx = context.Background(), context.Background() }()
+	defer s.closeOnCancel(outer)()
+	s.emitStarted()
+	return s.endAborted(ctx, machine(ctx))
 }
 
-// Abort sends the abort sequence and terminates the session.
+// Abort sends the abort sequence and terminates the session. It may be called
+// from any goroutine, including a FileHandler callback. During a Send or
+// Receive it only cancels the running session, which stops at its next read
+// or write and sends the abort sequence itself, after whatever it had already
+// written, then returns ErrLocalAbort; the session's own writes and the abort
+// never overlap. Outside one it writes the abort sequence to the transport.
 func (s *Session) Abort() error {
-	_, err := s.transport.Write(abortSequence)
+	s.mu.Lock()
+	transport, abort := s.transport, s.abort
+	s.mu.Unlock()
+	if abort != nil {
+		abort(ErrLocalAbort)
+		return nil
+	}
+	_, err := writeFull(context.Background(), transport, abortSequence)
+	if fl, ok := transport.(flusher); ok && err == nil && !s.cfg.DisableTransportFlush {
+		err = fl.Flush()
+	}
 	return err
 }
 
-func (s *Session) acquire() bool {
+// endAborted finishes a Send or Receive that Abort cancelled: the output not
+// yet handed to the transport is dropped, part of a frame at most, and the
+// abort sequence goes out in its place, straight to the transport. Any other
+// result passes through.
+func (s *Session) endAborted(ctx context.Context, err error) error {
+	if context.Cause(ctx) != ErrLocalAbort {
+		return err
+	}
+	// Neither a line held by XOFF nor EmulatedBaud may hold up the abort.
+	if werr := s.tw.writeNow(abortSequence); werr != nil {
+		return errors.Join(ErrLocalAbort, werr)
+	}
+	return ErrLocalAbort
+}
+
+// progress reports a file's progress to the handler: offset is the position
+// reached, high the furthest reached since the transfer began at fileStart.
+func (s *Session) progress(info FileInfo, offset, high int64) {
+	p := Progress{
+		Offset:       offset,
+		StartOffset:  s.fileStart,
+		SessionBytes: max(0, high-s.fileStart),
+	}
+	s.emitProgress(info, p)
+	if ph, ok := s.handler.(ProgressHandler); ok {
+		ph.TransferProgress(info, p)
+		return
+	}
+	s.handler.FileProgress(info, offset)
+}
+
+func (s *Session) acquire(abort context.CancelCauseFunc) bool {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	if s.active {
 		return false
 	}
 	s.active = true
+	s.abort = abort
 	return true
 }
 
@@ -266,4 +951,5 @@ func (s *Session) release() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.active = false
+	s.abort = nil
 }